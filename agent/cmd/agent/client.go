@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/zeropr/agent/internal/config"
+	"github.com/zeropr/agent/internal/crypto"
+	"github.com/zeropr/agent/internal/peerclient"
+	"github.com/zeropr/agent/internal/peers"
+	"github.com/zeropr/agent/internal/sessions"
+)
+
+const clientUsage = `usage: zeropr-agent [run] [flags]          run the agent (the default)
+       zeropr-agent status [flags]
+       zeropr-agent peers [flags]
+       zeropr-agent sessions [flags]
+       zeropr-agent broadcast start|stop [flags]
+       zeropr-agent file get [flags] <peer> <path>
+       zeropr-agent storage migrate --to files|bolt
+
+Client commands talk to the running agent's local API. Their flags:
+  -port N      local API port (default: from the agent's configuration)
+  -token T     API token (default: <state-dir>/token, when present)
+  -json        print the agent's JSON instead of a table
+  -follow      for peers and sessions, print the list and then every change
+               to it as one JSON object per line, until interrupted
+  -repo NAME   repository to read from, for file get
+`
+
+// clientTimeout bounds each call to the local agent; file get goes through
+// the agent to a peer, so it gets longer, and a followed list runs until
+// it's interrupted
+const (
+	clientTimeout     = 10 * time.Second
+	clientFileTimeout = 2 * time.Minute
+)
+
+// errNotRunning is returned when nothing answers on the agent's port
+var errNotRunning = errors.New("agent not running")
+
+// client calls the local agent's HTTP API
+type client struct {
+	base   string
+	token  string
+	http   *http.Client
+	asJSON bool
+	out    io.Writer // where followed lists are written
+}
+
+// runClient runs a client subcommand against the running agent and returns
+// the exit code: 0 on success, 1 when the agent fails or isn't running, and
+// 2 for usage errors
+func runClient(cfg *config.Config, args []string) int {
+	command := args[0]
+	fs := flag.NewFlagSet(command, flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, clientUsage) }
+	host, port := localAddr(cfg.Listen)
+	fs.IntVar(&port, "port", port, "")
+	token := fs.String("token", "", "")
+	asJSON := fs.Bool("json", false, "")
+	follow := fs.Bool("follow", false, "")
+	repo := fs.String("repo", "", "")
+	if err := fs.Parse(args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	rest := fs.Args()
+
+	c, err := newClient(cfg, host, port, *token)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	c.asJSON = *asJSON
+
+	switch {
+	case command == "status" && len(rest) == 0:
+		err = c.status()
+	case (command == "peers" || command == "sessions") && len(rest) == 0 && *follow:
+		c.http.Timeout = 0
+		err = c.follow("/api/" + command)
+	case command == "peers" && len(rest) == 0:
+		err = c.peers()
+	case command == "sessions" && len(rest) == 0:
+		err = c.sessions()
+	case command == "broadcast" && len(rest) == 1 && (rest[0] == "start" || rest[0] == "stop"):
+		err = c.broadcast(rest[0])
+	case command == "file" && len(rest) >= 1 && rest[0] == "get":
+		// Flags may also follow the subcommand: file get -repo api <peer> <path>
+		if err := fs.Parse(rest[1:]); err != nil {
+			return 2
+		}
+		if fs.NArg() != 2 {
+			fmt.Fprint(os.Stderr, clientUsage)
+			return 2
+		}
+		c.asJSON = *asJSON
+		c.http.Timeout = clientFileTimeout
+		err = c.fileGet(fs.Arg(0), fs.Arg(1), *repo)
+	default:
+		fmt.Fprint(os.Stderr, clientUsage)
+		return 2
+	}
+
+	if errors.Is(err, errNotRunning) {
+		fmt.Fprintf(os.Stderr, "The agent isn't running at %s. Start it with `zeropr-agent run`, or pass -port if it listens elsewhere.\n", c.base)
+		return 1
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	return 0
+}
+
+// localAddr returns where to reach the local listener: its port, on
+// loopback when it listens on every interface
+func localAddr(listen string) (string, int) {
+	host, port, _ := net.SplitHostPort(listen)
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+	n, _ := strconv.Atoi(port)
+	return host, n
+}
+
+// newClient builds a client for the agent at host:port. Without an explicit
+// token it uses the primary token the agent wrote to the state directory;
+// with TLS on it pins the certificate saved there.
+func newClient(cfg *config.Config, host string, port int, token string) (*client, error) {
+	if token == "" {
+		if data, err := os.ReadFile(filepath.Join(cfg.StateDir, "token")); err == nil {
+			token = strings.TrimSpace(string(data))
+		}
+	}
+
+	c := &client{
+		base:  "http://" + net.JoinHostPort(host, strconv.Itoa(port)),
+		token: token,
+		http:  &http.Client{Timeout: clientTimeout},
+		out:   os.Stdout,
+	}
+	if cfg.TLS {
+		fingerprint, err := crypto.SavedCertFingerprint(cfg.StateDir)
+		if cfg.TLSCert != "" {
+			fingerprint, err = crypto.CertFileFingerprint(cfg.TLSCert)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("TLS is on but the agent's certificate can't be read: %w", err)
+		}
+		c.base = "https://" + net.JoinHostPort(host, strconv.Itoa(port))
+		c.http.Transport = &http.Transport{TLSClientConfig: crypto.PinnedTLSConfig(fingerprint)}
+	}
+	return c, nil
+}
+
+// call sends a request to the agent and returns the response body, turning
+// the agent's JSON errors into Go errors
+func (c *client) call(method, path string, body interface{}) ([]byte, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, c.base+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.send(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+// send sends req with the client's token. An answer other than a success
+// is closed and returned as the agent's JSON error.
+func (c *client) send(req *http.Request) (*http.Response, error) {
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			return nil, errNotRunning
+		}
+		return nil, err
+	}
+	if resp.StatusCode < 400 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var apiErr struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(data, &apiErr) == nil && apiErr.Message != "" {
+		return nil, fmt.Errorf("%s (%s)", apiErr.Message, apiErr.Code)
+	}
+	return nil, fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(data))
+}
+
+// follow streams the list at path as newline-delimited JSON: its items, then
+// a record for every change to it. Each line is written as it arrives, for
+// piping into jq, until the agent closes the stream.
+func (c *client) follow(path string) error {
+	req, err := http.NewRequest(http.MethodGet, c.base+path+"?format=ndjson&follow=1", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.send(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	lines := bufio.NewReader(resp.Body)
+	for {
+		line, err := lines.ReadBytes('\n')
+		if len(line) > 0 {
+			if _, err := c.out.Write(line); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// get fetches path and either prints the raw JSON (with -json) or decodes
+// it into v for the table view. It reports whether v is to be printed.
+func (c *client) get(path string, v interface{}) (bool, error) {
+	data, err := c.call(http.MethodGet, path, nil)
+	if err != nil {
+		return false, err
+	}
+	if c.asJSON {
+		os.Stdout.Write(data)
+		return false, nil
+	}
+	return true, json.Unmarshal(data, v)
+}
+
+func (c *client) status() error {
+	var status struct {
+		Version         string `json:"version"`
+		Commit          string `json:"commit"`
+		ProtocolVersion string `json:"protocolVersion"`
+		Ready           bool   `json:"ready"`
+		UptimeSeconds   int64  `json:"uptimeSeconds"`
+		PeersCount      int    `json:"peersCount"`
+		Broadcasting    bool   `json:"broadcasting"`
+		ActiveSessions  int    `json:"activeSessions"`
+		Connections     int    `json:"connections"`
+		Branch          string `json:"branch"`
+		Fingerprint     string `json:"fingerprint"`
+	}
+	if ok, err := c.get("/api/status", &status); !ok || err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Agent\t%s (commit %s, protocol %s) at %s\n", status.Version, orDash(status.Commit), status.ProtocolVersion, c.base)
+	fmt.Fprintf(tw, "Ready\t%s\n", yesNo(status.Ready))
+	fmt.Fprintf(tw, "Uptime\t%s\n", time.Duration(status.UptimeSeconds)*time.Second)
+	fmt.Fprintf(tw, "Broadcasting\t%s\n", yesNo(status.Broadcasting))
+	fmt.Fprintf(tw, "Peers\t%d\n", status.PeersCount)
+	fmt.Fprintf(tw, "Sessions\t%d active, %d connections\n", status.ActiveSessions, status.Connections)
+	if status.Branch != "" {
+		fmt.Fprintf(tw, "Branch\t%s\n", status.Branch)
+	}
+	if status.Fingerprint != "" {
+		fmt.Fprintf(tw, "Fingerprint\t%s\n", status.Fingerprint)
+	}
+	return tw.Flush()
+}
+
+func (c *client) peers() error {
+	var list struct {
+		Peers []peers.Peer `json:"peers"`
+	}
+	if ok, err := c.get("/api/peers", &list); !ok || err != nil {
+		return err
+	}
+	if len(list.Peers) == 0 {
+		fmt.Println("No peers found.")
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tADDRESS\tBRANCH\tSTATUS\tLAST SEEN")
+	for _, p := range list.Peers {
+		name := p.Name
+		if p.Alias != "" {
+			name = p.Alias
+		}
+		status := p.Status
+		if p.ConnectionState != "" {
+			status += " (" + p.ConnectionState + ")"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", p.ShortID, name, net.JoinHostPort(p.Address, strconv.Itoa(p.Port)),
+			orDash(p.Branch), status, ago(p.LastSeen))
+	}
+	return tw.Flush()
+}
+
+func (c *client) sessions() error {
+	var list struct {
+		Sessions []sessions.Session `json:"sessions"`
+	}
+	if ok, err := c.get("/api/sessions", &list); !ok || err != nil {
+		return err
+	}
+	if len(list.Sessions) == 0 {
+		fmt.Println("No active sessions.")
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tFILE\tPARTICIPANTS\tCONNECTED\tSTARTED")
+	for _, s := range list.Sessions {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%s\n", s.ID, s.FilePath, len(s.Participants), s.Connected, ago(s.CreatedAt))
+	}
+	return tw.Flush()
+}
+
+func (c *client) broadcast(action string) error {
+	data, err := c.call(http.MethodPost, "/api/broadcast/"+action, nil)
+	if err != nil {
+		return err
+	}
+	if c.asJSON {
+		os.Stdout.Write(data)
+		return nil
+	}
+	if action == "start" {
+		fmt.Println("Broadcasting started.")
+	} else {
+		fmt.Println("Broadcasting stopped.")
+	}
+	return nil
+}
+
+// fileGet fetches path from peer, named by ID, name, or alias, and writes
+// its content to stdout
+func (c *client) fileGet(peer, path, repo string) error {
+	var list struct {
+		Peers []peers.Peer `json:"peers"`
+	}
+	data, err := c.call(http.MethodGet, "/api/peers", nil)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	id, err := findPeer(list.Peers, peer)
+	if err != nil {
+		return err
+	}
+
+	data, err = c.call(http.MethodPost, "/api/file/request", map[string]string{
+		"peerId":   id,
+		"repo":     repo,
+		"filePath": path,
+	})
+	if err != nil {
+		return err
+	}
+	if c.asJSON {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	var file peerclient.File
+	if err := json.Unmarshal(data, &file); err != nil {
+		return err
+	}
+	content, err := file.Bytes()
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(content)
+	return err
+}
+
+// findPeer resolves a peer argument to an ID: an exact ID wins, then a
+// unique alias or name. Anything else is passed on for the agent to
+// resolve as a short ID, a prefix of one, or a fingerprint.
+func findPeer(list []peers.Peer, arg string) (string, error) {
+	var matches []string
+	for _, p := range list {
+		if p.ID == arg {
+			return p.ID, nil
+		}
+		if p.Alias == arg || p.Name == arg {
+			matches = append(matches, p.ShortID)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return arg, nil
+	case 1:
+		return matches[0], nil
+	default:
+		return "", fmt.Errorf("%q matches %d peers; use one of their IDs: %s", arg, len(matches), strings.Join(matches, ", "))
+	}
+}
+
+// ago renders how long before now t was, to the second
+func ago(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return time.Since(t).Truncate(time.Second).String() + " ago"
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFollowPrintsLinesAsTheyArrive(t *testing.T) {
+	release := make(chan struct{})
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/peers" || r.URL.RawQuery != "format=ndjson&follow=1" || r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, `{"code":"bad_request","message":"unexpected request"}`, http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		io.WriteString(w, `{"id":"alice"}`+"\n")
+		w.(http.Flusher).Flush()
+		<-release
+		io.WriteString(w, `{"op":"remove","item":{"id":"alice"}}`+"\n")
+	}))
+	defer agent.Close()
+
+	out, printed := io.Pipe()
+	c := &client{base: agent.URL, token: "secret", http: &http.Client{}, out: printed}
+	done := make(chan error, 1)
+	go func() {
+		done <- c.follow("/api/peers")
+		printed.Close()
+	}()
+
+	// The listing is printed while the stream is still open
+	lines := bufio.NewReader(out)
+	read := make(chan string)
+	go func() {
+		for {
+			line, err := lines.ReadString('\n')
+			if err != nil {
+				close(read)
+				return
+			}
+			read <- line
+		}
+	}()
+	next := func() string {
+		select {
+		case line := <-read:
+			return line
+		case <-time.After(2 * time.Second):
+			t.Fatal("no line printed")
+			return ""
+		}
+	}
+	if line := next(); line != `{"id":"alice"}`+"\n" {
+		t.Fatalf("printed %q", line)
+	}
+	close(release)
+	if line := next(); line != `{"op":"remove","item":{"id":"alice"}}`+"\n" {
+		t.Errorf("printed %q", line)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("follow: %v", err)
+	}
+}
+
+func TestFollowReportsAgentErrors(t *testing.T) {
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		io.WriteString(w, `{"code":"missing_token","message":"an API token is required"}`)
+	}))
+	defer agent.Close()
+
+	var out strings.Builder
+	c := &client{base: agent.URL, http: &http.Client{}, out: &out}
+	if err := c.follow("/api/sessions"); err == nil || !strings.Contains(err.Error(), "missing_token") || out.Len() != 0 {
+		t.Errorf("follow refused: %v, printed %q", err, out.String())
+	}
+}
@@ -2,58 +2,397 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
+	"os/user"
+	"path/filepath"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
+	"github.com/zeropr/agent/internal/auth"
+	"github.com/zeropr/agent/internal/clock"
+	"github.com/zeropr/agent/internal/config"
+	"github.com/zeropr/agent/internal/crypto"
 	"github.com/zeropr/agent/internal/discovery"
+	"github.com/zeropr/agent/internal/events"
+	"github.com/zeropr/agent/internal/health"
+	"github.com/zeropr/agent/internal/i18n"
+	"github.com/zeropr/agent/internal/instance"
+	"github.com/zeropr/agent/internal/logging"
+	"github.com/zeropr/agent/internal/metrics"
+	"github.com/zeropr/agent/internal/notify"
+	"github.com/zeropr/agent/internal/peerclient"
 	"github.com/zeropr/agent/internal/peers"
+	"github.com/zeropr/agent/internal/retention"
 	"github.com/zeropr/agent/internal/server"
+	"github.com/zeropr/agent/internal/sessions"
+	"github.com/zeropr/agent/internal/storage"
+	"github.com/zeropr/agent/internal/version"
+	"github.com/zeropr/agent/internal/workspace"
 )
 
 const (
-	version = "0.1.0"
-)
-
-var (
-	httpPort   = flag.Int("http-port", 8080, "HTTP API port")
-	wsPort     = flag.Int("ws-port", 9000, "WebSocket port")
-	deviceName = flag.String("name", "zeropr-agent", "Device name for mDNS")
+	// trustReconcileDelay gives discovery time to collect peer keys before
+	// the startup trust reconciliation
+	trustReconcileDelay = 30 * time.Second
 )
 
 func main() {
-	flag.Parse()
+	// Flags override ZEROPR_* variables, which override the config file
+	cfg, err := config.Load(os.Args[1:], os.LookupEnv)
+	switch {
+	case err == flag.ErrHelp:
+		os.Exit(0)
+	case err == config.ErrUsage:
+		os.Exit(2)
+	case err != nil:
+		fmt.Fprintln(os.Stderr, "Invalid configuration:", err)
+		os.Exit(2)
+	}
+	if cfg.Version {
+		fmt.Println(version.Get())
+		os.Exit(0)
+	}
 
-	deviceLabel := resolveDeviceName(*deviceName)
+	// Route all logging through the rate limiter so a runaway subsystem can't flood the disk
+	logLevel := new(slog.LevelVar)
+	logLevel.Set(cfg.LogLevel)
+	handler, err := logging.NewHandler(os.Stderr, cfg.LogFormat, logLevel)
+	if err != nil {
+		fatal("Failed to create log handler", "err", err)
+	}
+	logLimiter := logging.NewRateLimitHandler(handler, cfg.LogLimits)
+	logger := slog.New(logLimiter)
+	// Anything still using the standard log package is bridged at info level
+	slog.SetDefault(logger)
 
-	log.Printf("ZeroPR Agent v%s starting...\n", version)
-	log.Printf("Device name: %s\n", deviceLabel)
-	log.Printf("HTTP port: %d, WebSocket port: %d\n", *httpPort, *wsPort)
+	// Anything but run is a one-shot command
+	if len(cfg.Args) > 0 {
+		switch cfg.Args[0] {
+		case "run":
+		case "storage":
+			os.Exit(runStorage(cfg.StateDir, cfg.Args[1:]))
+		default:
+			os.Exit(runClient(cfg, cfg.Args))
+		}
+	}
+
+	// ctx scopes the background loops and is cancelled on shutdown
+	ctx, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+	go logLimiter.Run(ctx)
 
-	// Initialize peer registry
-	peerRegistry := peers.NewRegistry()
+	build := version.Get()
+	logger.Info("ZeroPR Agent starting", "version", build.Version, "commit", build.Commit, "device", cfg.DeviceName)
+	if cfg.File != "" {
+		logger.Info("Config file loaded", "path", cfg.File)
+	}
+
+	if cfg.SelfTest {
+		port := cfg.AdvertisePort()
+		if port == 0 {
+			port = cfg.HTTPPort + 1
+		}
+		os.Exit(runSelfTest(ctx, cfg.DeviceName, port, cfg.Locale))
+	}
+
+	// One agent per state directory. A second launch, say by the extension
+	// while one runs from a terminal, reports the first and exits before it
+	// touches mDNS or the state store.
+	lock, err := instance.Acquire(cfg.StateDir, instanceInfo(cfg))
+	if err != nil {
+		exitIfRunning(logger, err)
+		fatal("Failed to lock the state directory", "dir", cfg.StateDir, "err", err)
+	}
+	defer lock.Release()
+	if err := settlePorts(cfg, logger); err != nil {
+		lock.Release()
+		exitIfRunning(logger, err)
+		var busy *instance.BusyError
+		if errors.As(err, &busy) {
+			fatal("Port taken by another program; pass -port-auto or pick another -http-port", "addr", busy.Addr)
+		}
+		fatal("Failed to check the listen addresses", "err", err)
+	}
+	self := instanceInfo(cfg)
+	if err := lock.Update(self); err != nil {
+		logger.Warn("Failed to record ports in the state directory lock", "err", err)
+	}
+
+	// Open the keyed state store; JSON files an older agent wrote are
+	// imported into it by the stores that own them
+	db, err := storage.Open(cfg.Storage, cfg.StateDir)
+	if err != nil {
+		fatal("Failed to open storage", "backend", cfg.Storage, "err", err)
+	}
+	defer db.Close()
+	logger.Debug("Storage opened", "backend", db.Backend())
+
+	// Initialize peer registry and event bus
+	bus := events.NewBus()
+	peerRegistry := peers.NewRegistry(bus)
+	peerRegistry.SetFilter(cfg.PeerFilter)
+	aliases, err := db.Collection("aliases")
+	if err == nil {
+		err = peerRegistry.PersistAliases(aliases)
+	}
+	if err != nil {
+		fatal("Failed to load peer aliases", "err", err)
+	}
 
 	// Initialize mDNS discovery
-	discoveryService, err := discovery.NewService(deviceLabel, *httpPort, peerRegistry)
+	// Peers reach us on the peer listener, so that's the port we advertise
+	discoveryService, err := discovery.NewService(cfg, peerRegistry)
 	if err != nil {
-		log.Fatalf("Failed to initialize discovery service: %v", err)
+		fatal("Failed to initialize discovery service", "err", err)
+	}
+	discoveryService.SetLogger(logger)
+
+	// Metrics are opt-in; a nil *metrics.Metrics records nothing
+	var agentMetrics *metrics.Metrics
+	if cfg.Metrics {
+		agentMetrics = metrics.New()
+		agentMetrics.TrackPeers(peerRegistry.Count)
+		discoveryService.SetMetrics(agentMetrics)
+		agentMetrics.TrackBus(bus)
+		go agentMetrics.Watch(ctx, bus)
+	}
+
+	// Load our signing identity and the keys of peers we trust
+	identity, err := crypto.LoadOrCreateIdentity(cfg.StateDir)
+	if err != nil {
+		fatal("Failed to load identity", "err", err)
+	}
+	trust, err := crypto.OpenTrustStore(cfg.StateDir, db)
+	if err != nil {
+		fatal("Failed to open trust store", "err", err)
+	}
+	trust.SetActor(localActor(cfg.DeviceName))
+	logger.Info("Identity loaded", "fingerprint", identity.Fingerprint())
+	discoveryService.SetTrustStore(trust)
+	discoveryService.SetTXT("pk", identity.EncodedPublicKey())
+	peerClient := peerclient.New(identity, cfg.PeerTimeouts)
+	peerClient.SetLogger(logger)
+	peerClient.SetLimits(cfg.PeerLimits)
+
+	// Open the repository roots we serve files from
+	logger.Info("Working directory", "path", cfg.WorkDir)
+	ws, err := workspace.New(cfg.Roots)
+	if err != nil {
+		fatal("Invalid -root", "err", err)
+	}
+	for _, root := range ws.Info() {
+		logger.Info("Serving repo", "repo", root.Name, "path", root.Path.Reveal(), "hash", root.Hash)
+	}
+	// Advertise the default root's identity, and with several roots every
+	// root's hash, and follow branch switches in every root. Schema 2 lists
+	// every root's hash in repos even when there's only one.
+	advertiseRepos := func() {
+		hashes := ws.Hashes()
+		if len(hashes) > 1 {
+			discoveryService.SetTXT("repos", strings.Join(hashes, ","))
+		}
+		discoveryService.SetTXTv2(map[string]string{"repos": strings.Join(hashes, ",")})
+	}
+	defaultRoot, err := ws.Root("")
+	if err != nil {
+		logger.Warn("Not serving files: no -root given and the working directory isn't inside a git repository", "workdir", cfg.WorkDir)
+	} else {
+		discoveryService.SetTXT("repoHash", defaultRoot.RepoHash())
+		discoveryService.SetTXT("branch", defaultRoot.Branch())
+		advertiseRepos()
+	}
+	for _, info := range ws.Info() {
+		root, _ := ws.Root(info.Name)
+		go root.WatchBranch(ctx, cfg.BranchPoll, func(branch string) {
+			logger.Info("Repo switched branch", "repo", root.Name, "branch", branch)
+			if root == defaultRoot {
+				discoveryService.SetTXT("branch", branch)
+				discoveryService.SetTXT("repoHash", root.RepoHash())
+			}
+			advertiseRepos()
+		})
 	}
 
 	// Initialize HTTP/WebSocket server
-	srv := server.NewServer(*httpPort, *wsPort, peerRegistry, discoveryService)
+	srv := server.NewServer(cfg, peerRegistry, discoveryService, bus, ws)
+	srv.SetLogger(logger)
+	srv.SetLogLimiter(logLimiter)
+	if agentMetrics != nil {
+		srv.SetMetrics(agentMetrics)
+	}
+	srv.SetPeerIdentity(identity, trust, peerClient)
+	if cfg.TLS {
+		var cert tls.Certificate
+		var fingerprint string
+		if cfg.TLSCert != "" {
+			cert, fingerprint, err = crypto.LoadKeyPair(cfg.TLSCert, cfg.TLSKey)
+		} else {
+			hostname, _ := os.Hostname()
+			cert, fingerprint, err = identity.LoadOrCreateCertificate(cfg.StateDir, []string{hostname})
+		}
+		if err != nil {
+			fatal("Failed to prepare TLS certificate", "err", err)
+		}
+		srv.SetTLS(cert, fingerprint)
+		discoveryService.SetTXT("tls", "1")
+		discoveryService.SetTXT("certfp", fingerprint)
+		logger.Info("TLS enabled", "certFingerprint", fingerprint)
+	}
+	if cfg.RequireToken {
+		tokens, err := auth.OpenStore(cfg.StateDir, db)
+		if err != nil {
+			fatal("Failed to open token store", "err", err)
+		}
+		srv.RequireTokens(tokens)
+		logger.Info("API token required", "primaryToken", filepath.Join(cfg.StateDir, "token"))
+	}
+
+	// Pick up the observe/advertise/serve switches where the last run left them
+	planes, err := db.Collection("planes")
+	if err == nil {
+		err = srv.SetPlaneStore(planes)
+	}
+	if err != nil {
+		fatal("Failed to load plane switches", "err", err)
+	}
+
+	// Keep ended-session artifacts under the retention policy
+	artifacts, err := retention.OpenStore(cfg.StateDir)
+	if err != nil {
+		fatal("Failed to open session artifacts", "err", err)
+	}
+	janitor, err := retention.NewJanitor(artifacts, cfg.StateDir, db)
+	if err != nil {
+		fatal("Failed to load retention policy", "err", err)
+	}
+	srv.SetRetention(janitor)
+	go retention.RecordTimelines(ctx, bus, artifacts)
+	go janitor.RunEvery(ctx, cfg.RetentionInterval)
+
+	// Bring back the sessions the last run left open, documents and all
+	if cfg.SessionSnapshots > 0 {
+		store, err := sessions.OpenSessionStore(filepath.Join(cfg.StateDir, "sessions"), cfg.SessionRestoreTTL)
+		if err != nil {
+			fatal("Failed to open session store", "err", err)
+		}
+		for _, id := range srv.SetSessionStore(store) {
+			if err := artifacts.Reopen(id); err != nil {
+				logger.Warn("Failed to reopen restored session's artifacts", "session", id, "err", err)
+			}
+		}
+		go srv.SnapshotSessions(ctx, cfg.SessionSnapshots)
+	}
+
+	// Start peer health checks
+	checker := health.NewChecker(cfg.Health, peerRegistry, bus, peerClient)
+	go checker.Run(ctx)
+
+	// A wall-clock jump can leave peers judged by a clock that has since
+	// moved, so re-check and re-browse rather than wait for the next round
+	clockWatcher := clock.NewWatcher(bus)
+	clockWatcher.SetLogger(logger)
+	healthChecks := cfg.Health.Interval > 0
+	clockWatcher.OnJump(func(clock.Jump) {
+		if healthChecks {
+			go checker.CheckAll(ctx)
+		}
+		discoveryService.Refresh()
+	})
+	go clockWatcher.Run(ctx)
+
+	// Reconcile the trust store once discovery has had time to see peers,
+	// in case the state directory was restored from an old backup
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-time.After(trustReconcileDelay):
+			if _, err := srv.ReconcileTrust(nil); err != nil {
+				logger.Warn("Trust reconciliation failed", "err", err)
+			}
+		}
+	}()
+
+	// SIGHUP and POST /api/admin/reload re-read the configuration. Settings
+	// that need a restart, such as ports and the state directory, are only
+	// reported; sessions and sync connections carry on either way.
+	var reloadMu sync.Mutex
+	reload := func() ([]string, []string, error) {
+		reloadMu.Lock()
+		defer reloadMu.Unlock()
+
+		next, err := config.Load(os.Args[1:], os.LookupEnv)
+		if err != nil {
+			logger.Warn("Config reload failed; keeping the current settings", "err", err)
+			return nil, nil, err
+		}
+		applied, restart := cfg.Adopt(next)
+		logLevel.Set(cfg.LogLevel)
+		logLimiter.SetLimits(cfg.LogLimits)
+		checker.SetSkip(cfg.Health.Skip)
+		peerRegistry.SetFilter(cfg.PeerFilter)
+		srv.Reload(cfg)
+
+		logger.Info("Config reloaded", "applied", applied)
+		for _, key := range restart {
+			logger.Warn("Setting changed but needs a restart to apply", "key", key)
+		}
+		return applied, restart, nil
+	}
+	srv.SetReloader(reload)
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				reload()
+			}
+		}
+	}()
+
+	// Optional desktop notifications for standalone use
+	if len(cfg.Notify.Categories) > 0 {
+		backend, err := notify.PlatformBackend()
+		if err != nil {
+			logger.Warn("Desktop notifications disabled", "err", err)
+		} else {
+			notifier := notify.New(cfg.Notify, backend)
+			go notifier.Run(ctx, bus)
+		}
+	}
+
+	// Whoever launched us with -port-auto reads the ports we ended up on
+	if cfg.PortAuto {
+		srv.OnListening(func() {
+			instance.WriteLine(os.Stdout, instance.LineListening, self)
+		})
+	}
 
 	// Start server in background
 	go func() {
-		log.Printf("HTTP API listening on :%d\n", *httpPort)
-		log.Printf("WebSocket listening on :%d\n", *wsPort)
+		logger.Info("Local API listening", "addr", cfg.Listen)
+		if cfg.PeerListen != "" {
+			logger.Info("Peer API listening", "addr", cfg.PeerListen)
+		} else {
+			logger.Warn("Peer listener disabled; other agents cannot reach this one")
+		}
+		if cfg.SyncListen != "" {
+			logger.Info("Sync sockets listening", "addr", cfg.SyncListen)
+		}
 		if err := srv.Start(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Server error: %v", err)
+			fatal("Server error", "err", err)
 		}
 	}()
 
@@ -62,72 +401,137 @@ func main() {
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 
-	log.Println("Shutting down...")
+	logger.Info("Shutting down")
 
-	// Stop discovery
+	// Stop discovery and background loops
 	discoveryService.Stop()
+	stopBackground()
 
 	// Stop server with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	if err := srv.Shutdown(ctx); err != nil {
-		log.Printf("Server forced to shutdown: %v", err)
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		logger.Warn("Server forced to shutdown", "err", err)
 	}
+	peerClient.CloseIdleConnections()
 
-	log.Println("Agent stopped")
+	logger.Info("Agent stopped")
 }
 
-func resolveDeviceName(name string) string {
-	const defaultName = "zeropr-agent"
+// portAutoTries bounds how far -port-auto moves the listeners up
+const portAutoTries = 50
 
-	base := strings.TrimSpace(name)
-	if base == "" {
-		base = defaultName
+// settlePorts checks that every listener can bind before anything is
+// advertised. With -port-auto, taken ports move all the listeners up until
+// they're free; without it, a port another agent holds means that agent is
+// already running, reported as an *instance.RunningError.
+func settlePorts(cfg *config.Config, logger *slog.Logger) error {
+	for tries := 0; ; tries++ {
+		err := instance.CheckFree(cfg.Listen, cfg.PeerListen, cfg.SyncListen)
+		var busy *instance.BusyError
+		if !errors.As(err, &busy) {
+			if err == nil && tries > 0 {
+				logger.Info("Configured ports taken; moved to free ones", "listen", cfg.Listen, "peerListen", cfg.PeerListen, "syncListen", cfg.SyncListen)
+			}
+			return err
+		}
+		if !cfg.PortAuto || tries == portAutoTries {
+			if other, ok := instance.Probe(busy.Addr); ok {
+				return &instance.RunningError{Info: other}
+			}
+			return err
+		}
+		logger.Debug("Port taken; trying the next ones", "addr", busy.Addr)
+		cfg.ShiftPorts(1)
 	}
+}
+
+// instanceInfo describes this agent for the state directory lock
+func instanceInfo(cfg *config.Config) instance.Info {
+	return instance.NewInfo(cfg.Listen, cfg.PeerListen, cfg.SyncListen, cfg.TLS, cfg.StateDir)
+}
 
-	// If user provided a non-default custom name, honor it as-is.
-	if name != "" && name != defaultName {
-		return base
+// exitIfRunning exits cleanly when err says another agent is running,
+// telling whoever launched us where to find it
+func exitIfRunning(logger *slog.Logger, err error) {
+	var running *instance.RunningError
+	if !errors.As(err, &running) {
+		return
 	}
+	other := running.Info
+	logger.Info("Agent already running; exiting", "pid", other.PID, "listen", other.Listen, "version", other.Version)
+	instance.WriteLine(os.Stdout, instance.LineRunning, other)
+	os.Exit(0)
+}
 
-	host, err := os.Hostname()
-	if err != nil {
-		return fmt.Sprintf("%s-%d", base, time.Now().UnixNano())
+// fatal logs msg with args at error level and exits
+func fatal(msg string, args ...interface{}) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// runSelfTest runs the discovery self-test and prints a pass/fail report
+// in locale, returning the process exit code
+func runSelfTest(ctx context.Context, deviceLabel string, port int, locale string) int {
+	const timeout = 5 * time.Second
+	text := func(id string, args ...interface{}) string {
+		return i18n.Text(locale, id, args...)
 	}
+	fmt.Printf("%s\n\n", text(i18n.MsgSelfTestTitle, timeout))
+	report := discovery.SelfTest(ctx, deviceLabel, port, timeout)
 
-	sanitized := sanitizeHostname(host)
-	if sanitized == "" {
-		return fmt.Sprintf("%s-%d", base, time.Now().UnixNano())
+	check := func(ok bool, id string, args ...interface{}) {
+		mark := "PASS"
+		if !ok {
+			mark = "FAIL"
+		}
+		fmt.Printf("  [%s] %s\n", mark, text(id, args...))
 	}
 
-	return fmt.Sprintf("%s-%s", base, sanitized)
-}
+	fmt.Println(text(i18n.MsgSelfTestAddresses))
+	for _, addr := range append(report.LocalIPv4, report.LocalIPv6...) {
+		fmt.Printf("  %s\n", addr)
+	}
+	if len(report.LocalIPv4)+len(report.LocalIPv6) == 0 {
+		fmt.Printf("  %s\n", text(i18n.MsgSelfTestNoAddresses))
+	}
+	fmt.Println()
 
-func sanitizeHostname(host string) string {
-	host = strings.ToLower(host)
-
-	var builder strings.Builder
-	lastDash := false
-
-	for _, r := range host {
-		switch {
-		case r >= 'a' && r <= 'z':
-			builder.WriteRune(r)
-			lastDash = false
-		case r >= '0' && r <= '9':
-			builder.WriteRune(r)
-			lastDash = false
-		case r == '-' || r == '_' || r == ' ':
-			if !lastDash {
-				builder.WriteRune('-')
-				lastDash = true
-			}
-		default:
-			// Skip other characters
+	if report.RegisterErr != nil {
+		check(false, i18n.MsgSelfTestRegisterFail, report.Instance, port, report.RegisterErr)
+	} else {
+		check(true, i18n.MsgSelfTestRegistered, report.Instance, port)
+	}
+	if report.BrowseErr != nil {
+		check(false, i18n.MsgSelfTestBrowseFail, report.BrowseErr)
+	}
+	if report.RegisterErr == nil && report.BrowseErr == nil {
+		if report.Found {
+			check(true, i18n.MsgSelfTestFound, report.FoundAfter.Round(time.Millisecond), strings.Join(report.Announced, ", "))
+			check(report.SelfDetected, i18n.MsgSelfTestRecognized)
+		} else {
+			check(false, i18n.MsgSelfTestNotFound)
 		}
 	}
 
-	result := strings.Trim(builder.String(), "-")
-	return result
+	fmt.Printf("\n%s\n", text(i18n.MsgSelfTestOthers, len(report.Others)))
+	for _, other := range report.Others {
+		fmt.Printf("  %s\n", other)
+	}
+
+	if report.Passed() {
+		fmt.Printf("\n%s\n", text(i18n.MsgSelfTestResult, "PASS"))
+		return 0
+	}
+	fmt.Printf("\n%s\n", text(i18n.MsgSelfTestResult, "FAIL"))
+	return 1
+}
+
+// localActor names who grants trust on this machine, as user@device
+func localActor(deviceLabel string) string {
+	if u, err := user.Current(); err == nil && u.Username != "" {
+		return u.Username + "@" + deviceLabel
+	}
+	return deviceLabel
 }
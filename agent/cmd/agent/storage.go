@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/zeropr/agent/internal/storage"
+)
+
+// runStorage runs a storage subcommand and returns the exit code:
+//
+//	zeropr-agent [-state-dir DIR] storage migrate --to bolt
+func runStorage(stateDir string, args []string) int {
+	if len(args) == 0 || args[0] != "migrate" {
+		fmt.Fprintln(os.Stderr, "usage: zeropr-agent [-state-dir DIR] storage migrate --to files|bolt")
+		return 2
+	}
+
+	fs := flag.NewFlagSet("storage migrate", flag.ContinueOnError)
+	to := fs.String("to", "", "Backend to copy the state into: files or bolt")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	var from string
+	switch *to {
+	case storage.BackendFiles:
+		from = storage.BackendBolt
+	case storage.BackendBolt:
+		from = storage.BackendFiles
+	default:
+		fmt.Fprintf(os.Stderr, "--to must be one of %v\n", storage.Backends)
+		return 2
+	}
+
+	// Opening the bolt side fails while an agent using it is running
+	src, err := storage.Open(from, stateDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open %s storage: %v (stop the agent first)\n", from, err)
+		return 1
+	}
+	defer src.Close()
+	dst, err := storage.Open(*to, stateDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open %s storage: %v (stop the agent first)\n", *to, err)
+		return 1
+	}
+	defer dst.Close()
+
+	counts, err := storage.Migrate(src, dst)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Migration failed: %v\n", err)
+		fmt.Fprintln(os.Stderr, "Nothing was removed; run the command again to finish.")
+		return 1
+	}
+
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Printf("Copied %s storage in %s to %s:\n", from, stateDir, *to)
+	for _, name := range names {
+		fmt.Printf("  %-10s %d keys\n", name, counts[name])
+	}
+	if len(names) == 0 {
+		fmt.Println("  (nothing stored yet)")
+	}
+	fmt.Printf("\nStart the agent with -storage %s to use it. The %s copy is left in place.\n", *to, from)
+	return 0
+}
@@ -0,0 +1,84 @@
+//go:build bench
+
+// Command benchgate runs the hot-path benchmark suite (or reads `go test
+// -bench -benchmem` output) and fails when results regress beyond the
+// thresholds against the checked-in baseline.
+//
+//	go run -tags bench ./cmd/benchgate
+//	go run -tags bench ./cmd/benchgate -update
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/zeropr/agent/internal/bench"
+)
+
+var (
+	baselinePath   = flag.String("baseline", "internal/bench/baseline.json", "Baseline file")
+	input          = flag.String("input", "", "Read `go test -bench -benchmem` output from this file instead of running the suite")
+	update         = flag.Bool("update", false, "Rewrite the baseline with the current results")
+	nsThreshold    = flag.Float64("ns-threshold", 0.25, "Tolerated ns/op regression (fraction)")
+	allocThreshold = flag.Float64("alloc-threshold", 0, "Tolerated allocs/op regression (fraction)")
+)
+
+func main() {
+	flag.Parse()
+
+	var results []bench.Result
+	if *input != "" {
+		f, err := os.Open(*input)
+		if err != nil {
+			log.Fatal(err)
+		}
+		results, err = bench.ParseGoTest(f)
+		f.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		results = bench.Run()
+	}
+
+	for _, r := range results {
+		fmt.Printf("%-28s %12.0f ns/op %8d B/op %6d allocs/op", r.Name, r.NsPerOp, r.BytesPerOp, r.AllocsPerOp)
+		for unit, value := range r.Extra {
+			fmt.Printf(" %10.0f %s", value, unit)
+		}
+		fmt.Println()
+	}
+
+	baseline, err := bench.LoadBaseline(*baselinePath)
+	if err != nil && !os.IsNotExist(err) {
+		log.Fatal(err)
+	}
+
+	if *update {
+		next := &bench.Baseline{Results: results}
+		if err := next.Save(*baselinePath, baseline); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Baseline written to %s\n", *baselinePath)
+		return
+	}
+
+	if baseline == nil {
+		log.Fatalf("No baseline at %s; run with -update to create one", *baselinePath)
+	}
+
+	regressions := bench.Compare(baseline, results, bench.Thresholds{
+		NsPerOp:     *nsThreshold,
+		AllocsPerOp: *allocThreshold,
+	})
+	if len(regressions) == 0 {
+		fmt.Println("No regressions")
+		return
+	}
+	for _, r := range regressions {
+		fmt.Println("REGRESSION", r)
+	}
+	os.Exit(1)
+}
@@ -0,0 +1,87 @@
+// Command wiregen writes the control-frame constants editors share with
+// the agent, from the registry in internal/wire, to shared/src/frames.ts.
+// With -check it only fails when the file is out of date.
+//
+//	go run ./cmd/wiregen
+//	go run ./cmd/wiregen -check
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"unicode"
+
+	"github.com/zeropr/agent/internal/wire"
+)
+
+var (
+	out   = flag.String("out", "../shared/src/frames.ts", "TypeScript file to write")
+	check = flag.Bool("check", false, "Fail if the file doesn't match the registry instead of writing it")
+)
+
+func main() {
+	flag.Parse()
+
+	generated := generate(wire.Specs())
+	if *check {
+		current, err := os.ReadFile(*out)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !bytes.Equal(current, generated) {
+			fmt.Printf("%s is out of date; run go run ./cmd/wiregen\n", *out)
+			os.Exit(1)
+		}
+		fmt.Printf("%s matches the frame registry\n", *out)
+		return
+	}
+	if err := os.WriteFile(*out, generated, 0o644); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Wrote %d frame types to %s\n", len(wire.Specs()), *out)
+}
+
+// generate renders the TypeScript constants for specs
+func generate(specs []wire.Spec) []byte {
+	var b bytes.Buffer
+	b.WriteString("// Code generated by go run ./cmd/wiregen in agent/; DO NOT EDIT.\n\n")
+	b.WriteString("/**\n * Control frame types on session sockets, with the payload version\n")
+	b.WriteString(" * the agent sends, who sends them, and whether the agent relays a\n")
+	b.WriteString(" * client's frame of the type (relay) or handles it (consume)\n */\n")
+
+	b.WriteString("export const FRAME_TYPES = {\n")
+	for _, spec := range specs {
+		fmt.Fprintf(&b, "  %s: '%s',\n", constName(spec.Type), spec.Type)
+	}
+	b.WriteString("} as const;\n\n")
+	b.WriteString("export type FrameType = (typeof FRAME_TYPES)[keyof typeof FRAME_TYPES];\n\n")
+
+	b.WriteString("export const FRAME_SPECS: Record<FrameType, { version: number; direction: 'client' | 'agent' | 'both'; class: 'relay' | 'consume' }> = {\n")
+	for _, spec := range specs {
+		fmt.Fprintf(&b, "  %s: { version: %d, direction: '%s', class: '%s' },\n", spec.Type, spec.Version, spec.Direction, spec.Class)
+	}
+	b.WriteString("};\n")
+	return b.Bytes()
+}
+
+// constName turns a frame type such as rosterSync or participant_joined
+// into ROSTER_SYNC or PARTICIPANT_JOINED
+func constName(frameType string) string {
+	var b strings.Builder
+	for i, r := range frameType {
+		switch {
+		case r == '_' || r == '.' || r == '-':
+			b.WriteRune('_')
+		case unicode.IsUpper(r) && i > 0:
+			b.WriteRune('_')
+			b.WriteRune(r)
+		default:
+			b.WriteRune(unicode.ToUpper(r))
+		}
+	}
+	return b.String()
+}
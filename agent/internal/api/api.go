@@ -0,0 +1,174 @@
+// Package api holds the payloads agents exchange with each other and the
+// rules that keep neighbouring releases talking through a rolling upgrade,
+// when half the team still runs the previous agent:
+//
+//   - Every peer payload carries a schemaVersion. Agents that predate it
+//     send none, which reads as Legacy.
+//   - Peer payloads are decoded leniently: fields this agent doesn't know
+//     come from newer agents and are ignored, logged at debug. Requests
+//     from local clients, which ship with this agent, stay strict.
+//   - A new field is optional, with a default an older payload decodes to,
+//     for at least one minor release before anything may require it.
+//   - A field is never removed or retyped while a release that reads it is
+//     still compatible (see version.MinCompatible).
+//
+// The frozen payloads of earlier releases live under testdata/golden/, and
+// the package's tests fail when a change would break them.
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// SchemaVersion is the peer payload schema this agent sends. Bump it when a
+// payload gains fields whose defaults depend on the sender's schema.
+const SchemaVersion = 1
+
+// Headers of GET /api/file/raw, which describe the whole file even when
+// the response carries only a range of it
+const (
+	HeaderSHA256 = "X-ZeroPR-SHA256" // hex SHA-256 of the whole file
+	HeaderSize   = "X-ZeroPR-Size"   // the whole file's size in bytes
+)
+
+// Legacy is the schemaVersion of payloads from agents that predate the field
+const Legacy = 0
+
+// Header is embedded in every peer payload
+type Header struct {
+	SchemaVersion int `json:"schemaVersion"`
+}
+
+// Current is the header of payloads this agent sends
+var Current = Header{SchemaVersion: SchemaVersion}
+
+// Schema returns the schemaVersion the payload was sent with
+func (h Header) Schema() int {
+	return h.SchemaVersion
+}
+
+// Payload is a message agents exchange. Only this package defines them, so
+// each one has its defaults and checks next to its fields.
+type Payload interface {
+	Schema() int
+
+	// defaults fills in what senders of schema from, or of this schema
+	// that predate a field, leave out
+	defaults(from int)
+
+	// validate checks the fields a receiver can't do without
+	validate() error
+}
+
+// DecodePeer reads a payload another agent sent. Fields this agent doesn't
+// know are skipped, and logged at debug when logger is set; defaults are
+// filled in for the sender's schema before the payload is validated.
+func DecodePeer(r io.Reader, v Payload, logger *slog.Logger) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return err
+	}
+
+	schema := v.Schema()
+	// Collecting the unknown fields decodes the payload twice; skip it
+	// unless someone is going to read the log
+	if logger != nil && logger.Enabled(context.Background(), slog.LevelDebug) {
+		if unknown := unknownFields(data, v); len(unknown) > 0 {
+			logger.Debug("Ignoring unknown fields from peer",
+				"payload", payloadName(v), "schemaVersion", schema, "newerSchema", schema > SchemaVersion, "fields", unknown)
+		}
+	}
+
+	v.defaults(schema)
+	if err := v.validate(); err != nil {
+		if schema > SchemaVersion {
+			return fmt.Errorf("%w (sent with newer schema %d)", err, schema)
+		}
+		return err
+	}
+	return nil
+}
+
+// DecodeLocal reads a request from a local client: the extension or the
+// command line, both of which ship with this agent. Unknown fields and
+// trailing data are errors, so a misspelled field isn't silently ignored.
+// Payloads are validated as they would be from a peer.
+func DecodeLocal(r io.Reader, v interface{}) error {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("unexpected data after JSON body")
+	}
+	if p, ok := v.(Payload); ok {
+		return p.validate()
+	}
+	return nil
+}
+
+// knownFields caches the JSON field names of each payload type, lower-cased
+// since encoding/json matches them without regard to case
+var knownFields sync.Map // reflect.Type -> map[string]bool
+
+// unknownFields returns the top-level fields in data that v doesn't have
+func unknownFields(data []byte, v Payload) []string {
+	var raw map[string]json.RawMessage
+	if json.Unmarshal(data, &raw) != nil {
+		return nil
+	}
+	known := fieldsOf(reflect.TypeOf(v).Elem())
+	var unknown []string
+	for name := range raw {
+		if !known[strings.ToLower(name)] {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// fieldsOf returns the JSON field names of a struct type, including those
+// of embedded structs
+func fieldsOf(t reflect.Type) map[string]bool {
+	if cached, ok := knownFields.Load(t); ok {
+		return cached.(map[string]bool)
+	}
+	fields := make(map[string]bool)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		switch {
+		case name == "-":
+		case field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct:
+			for embedded := range fieldsOf(field.Type) {
+				fields[embedded] = true
+			}
+		case !field.IsExported():
+		case name == "":
+			fields[strings.ToLower(field.Name)] = true
+		default:
+			fields[strings.ToLower(name)] = true
+		}
+	}
+	knownFields.Store(t, fields)
+	return fields
+}
+
+// payloadName names a payload's type in logs and reports
+func payloadName(v Payload) string {
+	return reflect.TypeOf(v).Elem().Name()
+}
@@ -0,0 +1,271 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zeropr/agent/internal/protocol"
+	"github.com/zeropr/agent/internal/version"
+	"github.com/zeropr/agent/internal/ydoc"
+)
+
+// goldenDir holds the frozen payloads, one subdirectory per release
+const goldenDir = "testdata/golden"
+
+var (
+	update  = flag.Bool("update", false, "Write the current payloads as the golden ones for -release")
+	release = flag.String("release", version.Version, "The release -update freezes payloads for")
+)
+
+// samples returns a filled-in example of every peer payload this agent
+// sends, keyed by the name of its golden file
+func samples() map[string]Payload {
+	modTime := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	return map[string]Payload{
+		"status": &Status{
+			Header:          Current,
+			Running:         true,
+			Version:         "0.1.0",
+			ProtocolVersion: protocol.Version,
+			MinCompatible:   "0.1.0",
+			PublicKey:       "MCowBQYDK2VwAyEA",
+		},
+		"file": &File{
+			Header:      Current,
+			Status:      "success",
+			FilePath:    "src/main.go",
+			Content:     "package main\n",
+			ContentType: "text/plain; charset=utf-8",
+			Size:        13,
+			ModTime:     &modTime,
+			SHA256:      "df1d036cbbf3df46e2045071e082245ece204c7f53ecf0a4e022bff9bb228f47",
+		},
+		"fileBinary": &File{
+			Header:      Current,
+			Status:      "success",
+			FilePath:    "assets/dot.gif",
+			Content:     "R0lGODlhAQABAIAAAP///wAAACwAAAAAAQABAAACAkQBADs=",
+			Encoding:    EncodingBase64,
+			ContentType: "image/gif",
+			Size:        35,
+			ModTime:     &modTime,
+			SHA256:      "6adc3d4c1056996e4e8b765a62604c78b1f867cceb3b15d0b9bedb7c4857f992",
+		},
+		"certAttestation": &CertAttestation{
+			Header:      Current,
+			Certificate: []byte("certificate DER"),
+			Signature:   []byte("signature"),
+		},
+		"fileSendRequest": &FileSendRequest{
+			Header:   Current,
+			Repo:     "web",
+			FilePath: "src/main.go",
+		},
+		"joinRequest": &JoinRequest{
+			Header:        Current,
+			SessionID:     "session-1",
+			ParticipantID: "peer-1",
+			Name:          "Peer One",
+			Color:         "#4363d8",
+			Role:          RoleEditor,
+		},
+		"joinResponse": &JoinResponse{
+			Header:         Current,
+			Status:         "joined",
+			Role:           "participant",
+			ReconnectToken: "rt-1",
+			SyncToken:      "st-1",
+			WSPath:         "/ws/sync/session-1?token=st-1",
+			WSPort:         8081,
+		},
+		"segmentRequest": &SegmentRequest{
+			Header:    Current,
+			SessionID: "session-1",
+			Since:     modTime,
+			Until:     modTime.Add(time.Minute),
+		},
+		"segment": &Segment{
+			Header:          Current,
+			Shared:          true,
+			Version:         "0.1.0",
+			ProtocolVersion: protocol.Version,
+			Frames: []RecordedFrame{
+				{At: modTime, Participant: "peer-1", Direction: "in", Data: []byte{0, 2, 1, 1}},
+				{At: modTime, Participant: "peer-1", Direction: "out", Dropped: "viewer", Data: []byte{0, 0, 1, 0}},
+			},
+			Document: &ydoc.State{
+				Vector:  map[uint64]uint64{7: 11},
+				Pending: map[uint64]uint64{9: 1},
+				Deleted: 2,
+				Hash:    "sha256:2d711642b726b04401627ca9fbac32f5c8530fb1903cc4db02258717921a4881",
+			},
+			StateVectors: map[string]map[uint64]uint64{"peer-1": {7: 11}},
+		},
+	}
+}
+
+// TestCurrentPayloadsRoundTrip checks each payload this agent sends
+// decodes as a peer payload back to itself
+func TestCurrentPayloadsRoundTrip(t *testing.T) {
+	for name, sample := range samples() {
+		data, _ := json.Marshal(sample)
+		decoded := newPayload(sample)
+		if err := DecodePeer(bytes.NewReader(data), decoded, nil); err != nil {
+			t.Errorf("%s doesn't decode: %v", name, err)
+		} else if !reflect.DeepEqual(decoded, sample) {
+			t.Errorf("%s changes on a round trip", name)
+		}
+	}
+}
+
+// TestGoldenPayloads round-trips payloads through every release frozen
+// under testdata/golden. An old payload must decode and validate as a peer
+// payload today; a current payload must still carry every field the old
+// one did, with the same JSON type, so old receivers can read it.
+//
+//	go test ./internal/api -run Golden -update -release 0.2.0
+//
+// freezes this build's payloads when cutting a release.
+func TestGoldenPayloads(t *testing.T) {
+	if *update {
+		freeze(t, filepath.Join(goldenDir, *release))
+	}
+
+	releases, err := os.ReadDir(goldenDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current := samples()
+	for _, dir := range releases {
+		if !dir.IsDir() {
+			continue
+		}
+		files, err := filepath.Glob(filepath.Join(goldenDir, dir.Name(), "*.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, file := range files {
+			name := strings.TrimSuffix(filepath.Base(file), ".json")
+			t.Run(dir.Name()+"/"+name, func(t *testing.T) {
+				golden, err := os.ReadFile(file)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, problem := range checkPayload(golden, current[name]) {
+					t.Error(problem)
+				}
+			})
+		}
+	}
+}
+
+// freeze writes the current samples to target, making them the golden
+// payloads later changes are checked against
+func freeze(t *testing.T, target string) {
+	t.Helper()
+	if err := os.MkdirAll(target, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for name, sample := range samples() {
+		data, err := json.MarshalIndent(sample, "", "  ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(target, name+".json"), append(data, '\n'), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Logf("Payloads frozen in %s", target)
+}
+
+// checkPayload compares a golden payload with the current sample of it
+func checkPayload(golden []byte, sample Payload) []string {
+	if sample == nil {
+		return []string{"no longer sent"}
+	}
+
+	var problems []string
+	if err := DecodePeer(bytes.NewReader(golden), newPayload(sample), nil); err != nil {
+		problems = append(problems, "old payload no longer decodes: "+err.Error())
+	}
+
+	current, err := json.Marshal(sample)
+	if err != nil {
+		return append(problems, err.Error())
+	}
+	var was, is interface{}
+	if err := json.Unmarshal(golden, &was); err != nil {
+		return append(problems, "invalid golden JSON: "+err.Error())
+	}
+	json.Unmarshal(current, &is)
+	return append(problems, compareShape("", was, is)...)
+}
+
+// compareShape reports fields of was that is lacks or holds as another
+// JSON type. Fields is adds are fine; old receivers skip them.
+func compareShape(path string, was, is interface{}) []string {
+	if was == nil {
+		return nil
+	}
+	if kindOf(was) != kindOf(is) {
+		return []string{fmt.Sprintf("%s changed from %s to %s", fieldName(path), kindOf(was), kindOf(is))}
+	}
+	wasObj, ok := was.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	isObj := is.(map[string]interface{})
+
+	var problems []string
+	for key, value := range wasObj {
+		child := key
+		if path != "" {
+			child = path + "." + key
+		}
+		next, ok := isObj[key]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s was removed", child))
+			continue
+		}
+		problems = append(problems, compareShape(child, value, next)...)
+	}
+	return problems
+}
+
+// newPayload returns an empty payload of the same type as p
+func newPayload(p Payload) Payload {
+	return reflect.New(reflect.TypeOf(p).Elem()).Interface().(Payload)
+}
+
+// kindOf names the JSON type of a decoded value
+func kindOf(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+func fieldName(path string) string {
+	if path == "" {
+		return "payload"
+	}
+	return path
+}
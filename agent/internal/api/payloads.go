@@ -0,0 +1,275 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/zeropr/agent/internal/protocol"
+	"github.com/zeropr/agent/internal/ydoc"
+)
+
+// Status is the part of GET /api/status other agents read. The rest of the
+// response is for local clients and isn't part of the peer contract.
+type Status struct {
+	Header
+	Running         bool   `json:"running"`
+	Version         string `json:"version"`
+	ProtocolVersion string `json:"protocolVersion"` // default protocol.Legacy
+	MinCompatible   string `json:"minCompatible"`   // default none
+	PublicKey       string `json:"publicKey,omitempty"`
+}
+
+func (s *Status) defaults(from int) {
+	if s.ProtocolVersion == "" {
+		s.ProtocolVersion = protocol.Legacy
+	}
+}
+
+func (s *Status) validate() error {
+	if !s.Running {
+		return errors.New("not a ZeroPR agent")
+	}
+	return nil
+}
+
+// File answers GET /api/file/get and POST /api/file/send
+type File struct {
+	Header
+	Status   string `json:"status"`
+	FilePath string `json:"filePath"`
+	Content  string `json:"content"`
+	Encoding string `json:"encoding,omitempty"` // EncodingBase64, or default UTF-8 text
+	// ContentType is sniffed from the file's bytes, e.g. image/png
+	ContentType string     `json:"contentType,omitempty"` // default unknown
+	Size        int64      `json:"size"`                  // default the content's length
+	ModTime     *time.Time `json:"modTime,omitempty"`     // default unknown
+	SHA256      string     `json:"sha256,omitempty"`      // default the content's hash
+}
+
+// EncodingBase64 marks a File whose Content is its bytes in standard
+// base64, because they aren't UTF-8 text a JSON string could carry
+const EncodingBase64 = "base64"
+
+// SetContent fills in Content, Encoding, and ContentType from a file's
+// bytes. Text goes as is; anything else, e.g. an image, is base64 encoded,
+// since JSON would replace its invalid UTF-8.
+func (f *File) SetContent(content []byte) {
+	if utf8.Valid(content) {
+		f.Content, f.Encoding = string(content), ""
+	} else {
+		f.Content, f.Encoding = base64.StdEncoding.EncodeToString(content), EncodingBase64
+	}
+	f.ContentType = http.DetectContentType(content)
+}
+
+// Bytes returns the file's bytes, decoding Content as Encoding says
+func (f *File) Bytes() ([]byte, error) {
+	switch f.Encoding {
+	case "":
+		return []byte(f.Content), nil
+	case EncodingBase64:
+		return base64.StdEncoding.DecodeString(f.Content)
+	}
+	return nil, fmt.Errorf("unknown file encoding %q", f.Encoding)
+}
+
+// Agents that predate file metadata send only the path and content
+func (f *File) defaults(from int) {
+	if f.SHA256 == "" {
+		content, _ := f.Bytes()
+		sum := sha256.Sum256(content)
+		f.SHA256 = hex.EncodeToString(sum[:])
+		f.Size = int64(len(content))
+	}
+}
+
+func (f *File) validate() error {
+	if f.FilePath == "" {
+		return errors.New("file response has no filePath")
+	}
+	if _, err := f.Bytes(); err != nil {
+		return fmt.Errorf("file response content: %w", err)
+	}
+	return nil
+}
+
+// CertAttestation answers GET /p2p/cert-attestation: the TLS certificate an
+// agent serves, signed by its identity key
+type CertAttestation struct {
+	Header
+	Certificate []byte `json:"certificate"` // DER
+	Signature   []byte `json:"signature"`   // Ed25519 over the certificate's fingerprint and validity
+}
+
+func (a *CertAttestation) defaults(from int) {}
+
+func (a *CertAttestation) validate() error {
+	if len(a.Certificate) == 0 || len(a.Signature) == 0 {
+		return errors.New("certificate attestation is incomplete")
+	}
+	return nil
+}
+
+// FileSendRequest asks an agent to POST /api/file/send a file
+type FileSendRequest struct {
+	Header
+	Repo     string `json:"repo,omitempty"` // default the agent's default root
+	FilePath string `json:"filePath"`
+}
+
+func (r *FileSendRequest) defaults(from int) {}
+
+func (r *FileSendRequest) validate() error {
+	if r.FilePath == "" {
+		return errors.New("filePath is required")
+	}
+	return nil
+}
+
+// Roles a participant may join a session with
+const (
+	RoleEditor = "editor"
+	RoleViewer = "viewer" // follows along without editing
+)
+
+// MaxParticipantName is the longest display name a participant may give,
+// in bytes
+const MaxParticipantName = 64
+
+// JoinRequest is the body of POST /api/session/join
+type JoinRequest struct {
+	Header
+	SessionID     string `json:"sessionId"`
+	ParticipantID string `json:"participantId"`
+	Name          string `json:"name,omitempty"`  // display name; default none
+	Color         string `json:"color,omitempty"` // cursor color as #rrggbb; default one the session assigns
+	Role          string `json:"role,omitempty"`  // default RoleEditor
+	// Token is the participant's sync or reconnection token, which joining
+	// again as someone already in the session takes; default none
+	Token string `json:"token,omitempty"`
+}
+
+func (r *JoinRequest) defaults(from int) {
+	if r.Role == "" {
+		r.Role = RoleEditor
+	}
+}
+
+func (r *JoinRequest) validate() error {
+	if r.SessionID == "" || strings.TrimSpace(r.ParticipantID) == "" {
+		return errors.New("sessionId and participantId are required")
+	}
+	return CheckParticipant(r.Name, r.Color, r.Role)
+}
+
+// CheckParticipant validates how a participant asks to be shown. Each of
+// name, color and role may be empty.
+func CheckParticipant(name, color, role string) error {
+	if len(name) > MaxParticipantName {
+		return fmt.Errorf("name is over %d bytes", MaxParticipantName)
+	}
+	for _, r := range name {
+		if r < 0x20 || r == 0x7f {
+			return errors.New("name has control characters")
+		}
+	}
+	if !validColor(color) {
+		return fmt.Errorf("color %q is not #rrggbb", color)
+	}
+	if role != "" && role != RoleEditor && role != RoleViewer {
+		return fmt.Errorf("role %q is not %s or %s", role, RoleEditor, RoleViewer)
+	}
+	return nil
+}
+
+// validColor reports whether color is empty or #rrggbb
+func validColor(color string) bool {
+	if color == "" {
+		return true
+	}
+	if len(color) != 7 || color[0] != '#' {
+		return false
+	}
+	_, err := hex.DecodeString(color[1:])
+	return err == nil
+}
+
+// JoinResponse answers POST /api/session/join
+type JoinResponse struct {
+	Header
+	Status         string `json:"status"`
+	Role           string `json:"role"`
+	ReconnectToken string `json:"reconnectToken"`
+	SyncToken      string `json:"syncToken"` // the joining participant's own; the sockets take their identity from it
+	WSPath         string `json:"wsPath"`
+	WSPort         int    `json:"wsPort,omitempty"` // default the port the join went to
+}
+
+func (r *JoinResponse) defaults(from int) {}
+
+func (r *JoinResponse) validate() error {
+	if r.WSPath == "" || r.SyncToken == "" {
+		return errors.New("join response has no sync socket")
+	}
+	return nil
+}
+
+// SegmentRequest asks the other agent in a session, through POST
+// /api/debug/divergence-segment, for the sync frames it recorded of the
+// session over a window, to bundle with the asker's own
+type SegmentRequest struct {
+	Header
+	SessionID string    `json:"sessionId"`
+	Since     time.Time `json:"since"`
+	Until     time.Time `json:"until"`
+}
+
+func (r *SegmentRequest) defaults(from int) {}
+
+func (r *SegmentRequest) validate() error {
+	if r.SessionID == "" {
+		return errors.New("sessionId is required")
+	}
+	if r.Since.IsZero() || r.Until.Before(r.Since) {
+		return errors.New("the window must start before it ends")
+	}
+	return nil
+}
+
+// RecordedFrame is a sync frame as an agent saw it pass
+type RecordedFrame struct {
+	At          time.Time `json:"at"`
+	Participant string    `json:"participant"`
+	Direction   string    `json:"dir"`               // "in" from a participant's editor, "out" to it
+	Dropped     string    `json:"dropped,omitempty"` // why the frame went no further, if it didn't
+	Data        []byte    `json:"data"`
+}
+
+// Segment answers a SegmentRequest. Without the user's consent nothing
+// recorded is shared, and Reason says why.
+type Segment struct {
+	Header
+	Shared          bool                         `json:"shared"`
+	Reason          string                       `json:"reason,omitempty"`
+	Version         string                       `json:"version"`
+	ProtocolVersion string                       `json:"protocolVersion"`
+	Frames          []RecordedFrame              `json:"frames,omitempty"`
+	Document        *ydoc.State                  `json:"document,omitempty"`     // what the frames that weren't dropped add up to
+	StateVectors    map[string]map[uint64]uint64 `json:"stateVectors,omitempty"` // the last each participant announced, by participant
+}
+
+func (s *Segment) defaults(from int) {}
+
+func (s *Segment) validate() error {
+	if s.Shared && s.Document == nil {
+		return errors.New("shared segment has no document")
+	}
+	return nil
+}
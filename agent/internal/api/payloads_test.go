@@ -0,0 +1,53 @@
+package api
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestFileContent(t *testing.T) {
+	gif := []byte("GIF89a\x01\x00\x01\x00\x80\x00\x00\xff\xff\xff\x00\x00\x00!\xf9\x04")
+	tests := []struct {
+		name        string
+		content     []byte
+		encoding    string
+		contentType string
+	}{
+		{"empty", []byte{}, "", "text/plain; charset=utf-8"},
+		{"text", []byte("package main\n"), "", "text/plain; charset=utf-8"},
+		{"not utf-8", gif, EncodingBase64, "image/gif"},
+		{"a nul in utf-8", []byte("a\x00b"), "", "application/octet-stream"},
+	}
+	for _, tt := range tests {
+		var f File
+		f.SetContent(tt.content)
+		if f.Encoding != tt.encoding || f.ContentType != tt.contentType {
+			t.Errorf("%s: encoding %q, content type %q", tt.name, f.Encoding, f.ContentType)
+		}
+		if got, err := f.Bytes(); err != nil || !bytes.Equal(got, tt.content) {
+			t.Errorf("%s: Bytes = %q, %v", tt.name, got, err)
+		}
+	}
+}
+
+func TestFileDecodesAsPeerPayload(t *testing.T) {
+	// Hashes left out by older agents are of the decoded bytes
+	var f File
+	body := `{"v":1,"status":"success","filePath":"dot.gif","content":"R0lGODlhAQABAIAAAP///wAAACwAAAAAAQABAAACAkQBADs=","encoding":"base64"}`
+	if err := DecodePeer(strings.NewReader(body), &f, nil); err != nil {
+		t.Fatal(err)
+	}
+	if f.Size != 35 || f.SHA256 != "6adc3d4c1056996e4e8b765a62604c78b1f867cceb3b15d0b9bedb7c4857f992" {
+		t.Errorf("defaulted size %d, hash %s", f.Size, f.SHA256)
+	}
+
+	for _, body := range []string{
+		`{"v":1,"status":"success","filePath":"a","content":"x","encoding":"gzip"}`,
+		`{"v":1,"status":"success","filePath":"a","content":"not base64!","encoding":"base64"}`,
+	} {
+		if err := DecodePeer(strings.NewReader(body), &File{}, nil); err == nil {
+			t.Errorf("decoded %s", body)
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zeropr/agent/internal/redact"
+	"github.com/zeropr/agent/internal/storage"
+)
+
+// Scopes a token may carry
+const (
+	ScopeRead     = "read"     // read-only access to peers, status, and sessions
+	ScopePeers    = "peers"    // manage peers, presence, and broadcasting
+	ScopeSessions = "sessions" // create, join, and sync sessions
+	ScopeFiles    = "files"    // read and request files
+	ScopeAdmin    = "admin"    // everything, including token management
+)
+
+// PrimaryTokenName names the full-scope token handed to the editor extension
+const PrimaryTokenName = "primary"
+
+const (
+	tokenPrefix     = "zpr_"
+	displayPrefix   = 8
+	tokensFile      = "tokens.json" // where tokens were kept before the storage layer
+	collection      = "tokens"
+	primaryFile     = "token"
+	lastUsedFlushAt = time.Minute
+)
+
+var validScopes = map[string]bool{
+	ScopeRead:     true,
+	ScopePeers:    true,
+	ScopeSessions: true,
+	ScopeFiles:    true,
+	ScopeAdmin:    true,
+}
+
+// ErrUnknownToken is returned when a presented token doesn't match any entry
+var ErrUnknownToken = errors.New("unknown token")
+
+// Token is a named API token. Only the SHA-256 hash of the secret is kept.
+type Token struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Prefix    string     `json:"prefix"`
+	Hash      string     `json:"hash"`
+	Scopes    []string   `json:"scopes"`
+	CreatedAt time.Time  `json:"createdAt"`
+	LastUsed  *time.Time `json:"lastUsed,omitempty"`
+}
+
+// HasScope reports whether the token grants scope. Admin implies every scope.
+func (t *Token) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// Store persists tokens hashed at rest, one storage key per token ID
+type Store struct {
+	dir       string
+	db        storage.Collection
+	tokens    map[string]*Token // keyed by ID
+	used      map[string]bool   // IDs whose last-used time isn't written yet
+	lastFlush time.Time
+	mu        sync.Mutex
+}
+
+// OpenStore loads the token store from db, first importing the tokens.json
+// an older agent left in dir, and creates the primary extension token
+// (written in plaintext to dir/token, mode 0600) if it doesn't exist.
+func OpenStore(dir string, db storage.Store) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create state dir: %w", err)
+	}
+
+	c, err := db.Collection(collection)
+	if err != nil {
+		return nil, err
+	}
+	if err := storage.ImportFile(c, filepath.Join(dir, tokensFile), storage.SplitArray("id")); err != nil {
+		return nil, fmt.Errorf("failed to import %s: %w", tokensFile, err)
+	}
+
+	s := &Store{
+		dir:    dir,
+		db:     c,
+		tokens: make(map[string]*Token),
+		used:   make(map[string]bool),
+	}
+
+	values, err := c.List()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load tokens: %w", err)
+	}
+	for id, data := range values {
+		var t Token
+		if err := json.Unmarshal(data, &t); err != nil {
+			return nil, fmt.Errorf("failed to parse token %s: %w", id, err)
+		}
+		s.tokens[id] = &t
+	}
+
+	if err := s.ensurePrimary(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// ensurePrimary makes sure the full-scope extension token exists on disk
+func (s *Store) ensurePrimary() error {
+	path := filepath.Join(s.dir, primaryFile)
+	if secret, err := os.ReadFile(path); err == nil {
+		if _, err := s.lookup(strings.TrimSpace(string(secret))); err == nil {
+			return nil
+		}
+	}
+
+	// Missing or stale: replace any previous primary entry
+	s.mu.Lock()
+	var stale []string
+	for id, t := range s.tokens {
+		if t.Name == PrimaryTokenName {
+			delete(s.tokens, id)
+			stale = append(stale, id)
+		}
+	}
+	err := s.saveLocked(stale...)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	secret, _, err := s.Create(PrimaryTokenName, []string{ScopeAdmin})
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, []byte(secret.Reveal()+"\n"), 0o600); err != nil {
+		return fmt.Errorf("failed to write primary token: %w", err)
+	}
+	return nil
+}
+
+// Create issues a new token and returns its secret, which is never stored
+func (s *Store) Create(name string, scopes []string) (redact.Secret, *Token, error) {
+	if strings.TrimSpace(name) == "" {
+		return "", nil, errors.New("token name is required")
+	}
+	if len(scopes) == 0 {
+		return "", nil, errors.New("at least one scope is required")
+	}
+	for _, scope := range scopes {
+		if !validScopes[scope] {
+			return "", nil, fmt.Errorf("unknown scope %q", scope)
+		}
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", nil, err
+	}
+	secret := tokenPrefix + hex.EncodeToString(raw)
+
+	idBytes := make([]byte, 6)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", nil, err
+	}
+
+	token := &Token{
+		ID:        hex.EncodeToString(idBytes),
+		Name:      name,
+		Prefix:    secret[:len(tokenPrefix)+displayPrefix],
+		Hash:      hashSecret(secret),
+		Scopes:    append([]string(nil), scopes...),
+		CreatedAt: time.Now(),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tokens[token.ID] = token
+	if err := s.saveLocked(token.ID); err != nil {
+		delete(s.tokens, token.ID)
+		return "", nil, err
+	}
+	return redact.Secret(secret), token, nil
+}
+
+// Revoke deletes a token. The primary token cannot be revoked.
+func (s *Store) Revoke(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, ok := s.tokens[id]
+	if !ok {
+		return ErrUnknownToken
+	}
+	if token.Name == PrimaryTokenName {
+		return errors.New("the primary token cannot be revoked")
+	}
+
+	delete(s.tokens, id)
+	if err := s.saveLocked(id); err != nil {
+		s.tokens[id] = token
+		return err
+	}
+	return nil
+}
+
+// List returns all tokens ordered by creation time
+func (s *Store) List() []Token {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := make([]Token, 0, len(s.tokens))
+	for _, t := range s.tokens {
+		list = append(list, *t)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.Before(list[j].CreatedAt)
+	})
+	return list
+}
+
+// Authenticate resolves a presented secret to its token and records the use
+func (s *Store) Authenticate(secret string) (*Token, error) {
+	token, err := s.lookup(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	token.LastUsed = &now
+	s.used[token.ID] = true
+	// Last-used times are advisory; don't write them on every request
+	if now.Sub(s.lastFlush) >= lastUsedFlushAt {
+		s.lastFlush = now
+		used := make([]string, 0, len(s.used))
+		for id := range s.used {
+			used = append(used, id)
+		}
+		s.used = make(map[string]bool)
+		s.saveLocked(used...)
+	}
+
+	cp := *token
+	return &cp, nil
+}
+
+// lookup finds the token matching secret in constant time per entry
+func (s *Store) lookup(secret string) (*Token, error) {
+	if !strings.HasPrefix(secret, tokenPrefix) {
+		return nil, ErrUnknownToken
+	}
+	hash := []byte(hashSecret(secret))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, t := range s.tokens {
+		if subtle.ConstantTimeCompare(hash, []byte(t.Hash)) == 1 {
+			return t, nil
+		}
+	}
+	return nil, ErrUnknownToken
+}
+
+// saveLocked writes the tokens with the given IDs, deleting those no
+// longer held; s.mu must be held
+func (s *Store) saveLocked(ids ...string) error {
+	for _, id := range ids {
+		token, ok := s.tokens[id]
+		if !ok {
+			if err := s.db.Delete(id); err != nil {
+				return fmt.Errorf("failed to delete token %s: %w", id, err)
+			}
+			continue
+		}
+		data, err := json.Marshal(token)
+		if err != nil {
+			return err
+		}
+		if err := s.db.Put(id, data); err != nil {
+			return fmt.Errorf("failed to write token %s: %w", id, err)
+		}
+	}
+	return nil
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,153 @@
+package auth
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/zeropr/agent/internal/storage"
+)
+
+func openTestStore(t *testing.T, backend, dir string) (*Store, storage.Store) {
+	t.Helper()
+	db, err := storage.Open(backend, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := OpenStore(dir, db)
+	if err != nil {
+		db.Close()
+		t.Fatal(err)
+	}
+	return s, db
+}
+
+// filesHolding lists the files under dir containing value
+func filesHolding(t *testing.T, dir, value string) []string {
+	t.Helper()
+	var holding []string
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if bytes.Contains(data, []byte(value)) {
+			rel, _ := filepath.Rel(dir, path)
+			holding = append(holding, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return holding
+}
+
+func TestTokensHashedAtRest(t *testing.T) {
+	for _, backend := range []string{storage.BackendFiles, storage.BackendBolt} {
+		t.Run(backend, func(t *testing.T) {
+			dir := t.TempDir()
+			s, db := openTestStore(t, backend, dir)
+			secret, token, err := s.Create("dashboard", []string{ScopeRead})
+			if err != nil {
+				t.Fatal(err)
+			}
+			plain := secret.Reveal()
+			if !strings.HasPrefix(plain, tokenPrefix) || !strings.HasPrefix(plain, token.Prefix) {
+				t.Fatalf("secret %q doesn't start with %q and prefix %q", plain, tokenPrefix, token.Prefix)
+			}
+			if _, err := s.Authenticate(plain); err != nil {
+				t.Fatal(err)
+			}
+			db.Close()
+
+			if held := filesHolding(t, dir, plain); len(held) > 0 {
+				t.Errorf("the secret is on disk in %v", held)
+			}
+			if held := filesHolding(t, dir, hashSecret(plain)); len(held) == 0 {
+				t.Error("the secret's hash isn't on disk")
+			}
+			// Only the primary token is written out, for the extension
+			primary, err := os.ReadFile(filepath.Join(dir, primaryFile))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if held := filesHolding(t, dir, strings.TrimSpace(string(primary))); len(held) != 1 || held[0] != primaryFile {
+				t.Errorf("the primary secret is in %v, want only %s", held, primaryFile)
+			}
+
+			// The hash alone authenticates the secret after a restart
+			s, db = openTestStore(t, backend, dir)
+			defer db.Close()
+			got, err := s.Authenticate(plain)
+			if err != nil {
+				t.Fatalf("after reopening: %v", err)
+			}
+			if got.ID != token.ID || !got.HasScope(ScopeRead) || got.HasScope(ScopeFiles) {
+				t.Errorf("authenticated as %+v", got)
+			}
+			if _, err := s.Authenticate(got.Hash); err != ErrUnknownToken {
+				t.Errorf("the stored hash authenticated: %v", err)
+			}
+		})
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	dir := t.TempDir()
+	s, db := openTestStore(t, storage.BackendFiles, dir)
+	defer db.Close()
+
+	secret, token, err := s.Create("script", []string{ScopePeers})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Revoke(token.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Authenticate(secret.Reveal()); err != ErrUnknownToken {
+		t.Errorf("revoked token authenticated: %v", err)
+	}
+	if err := s.Revoke(token.ID); err != ErrUnknownToken {
+		t.Errorf("revoking twice: %v", err)
+	}
+	for _, listed := range s.List() {
+		if listed.Name == PrimaryTokenName {
+			if err := s.Revoke(listed.ID); err == nil {
+				t.Error("the primary token was revoked")
+			}
+		}
+	}
+
+	// Gone after a restart too
+	db.Close()
+	s, db = openTestStore(t, storage.BackendFiles, dir)
+	defer db.Close()
+	if _, err := s.Authenticate(secret.Reveal()); err != ErrUnknownToken {
+		t.Errorf("revoked token authenticated after reopening: %v", err)
+	}
+}
+
+func TestScopes(t *testing.T) {
+	s, db := openTestStore(t, storage.BackendFiles, t.TempDir())
+	defer db.Close()
+
+	if _, _, err := s.Create("bad", []string{"root"}); err == nil {
+		t.Error("created a token with an unknown scope")
+	}
+	admin := Token{Scopes: []string{ScopeAdmin}}
+	for _, scope := range []string{ScopeRead, ScopePeers, ScopeSessions, ScopeFiles, ScopeAdmin} {
+		if !admin.HasScope(scope) {
+			t.Errorf("admin lacks %s", scope)
+		}
+	}
+	read := Token{Scopes: []string{ScopeRead}}
+	if read.HasScope(ScopePeers) || read.HasScope(ScopeAdmin) || !read.HasScope(ScopeRead) {
+		t.Errorf("read token scopes wrong")
+	}
+}
@@ -0,0 +1,164 @@
+// Package bench holds the performance regression gate for the agent's hot
+// paths. The benchmark suite itself is only built with the "bench" tag;
+// the baseline and comparison logic here is always compiled.
+package bench
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Result is one benchmark measurement
+type Result struct {
+	Name        string  `json:"name"`
+	NsPerOp     float64 `json:"nsPerOp"`
+	BytesPerOp  int64   `json:"bytesPerOp"`
+	AllocsPerOp int64   `json:"allocsPerOp"`
+	Note        string  `json:"note,omitempty"`
+
+	// Extra holds custom metrics reported with b.ReportMetric, keyed by
+	// unit; they are recorded for context but not gated
+	Extra map[string]float64 `json:"extra,omitempty"`
+}
+
+// Baseline is the checked-in set of reference results. Maintainers update
+// it deliberately with `benchgate -update` after an intended change.
+type Baseline struct {
+	Results []Result `json:"results"`
+}
+
+// Thresholds are the tolerated relative regressions, e.g. 0.25 for 25%
+type Thresholds struct {
+	NsPerOp     float64
+	AllocsPerOp float64
+}
+
+// Regression describes a benchmark that got worse than its baseline allows
+type Regression struct {
+	Name     string
+	Metric   string
+	Baseline float64
+	Current  float64
+}
+
+func (r Regression) String() string {
+	return fmt.Sprintf("%s: %s regressed from %.0f to %.0f", r.Name, r.Metric, r.Baseline, r.Current)
+}
+
+// LoadBaseline reads a baseline file
+func LoadBaseline(path string) (*Baseline, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var baseline Baseline
+	if err := json.Unmarshal(data, &baseline); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return &baseline, nil
+}
+
+// Save writes the baseline with results sorted by name, preserving notes
+// from previous entries of the same name
+func (b *Baseline) Save(path string, previous *Baseline) error {
+	if previous != nil {
+		notes := make(map[string]string, len(previous.Results))
+		for _, r := range previous.Results {
+			notes[r.Name] = r.Note
+		}
+		for i := range b.Results {
+			if b.Results[i].Note == "" {
+				b.Results[i].Note = notes[b.Results[i].Name]
+			}
+		}
+	}
+	sort.Slice(b.Results, func(i, j int) bool {
+		return b.Results[i].Name < b.Results[j].Name
+	})
+
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
+// Compare checks current results against the baseline. A metric regresses
+// when it exceeds baseline*(1+threshold); allocation counts must also grow
+// by at least one whole allocation so tiny baselines aren't flaky.
+// Benchmarks missing from the baseline are ignored.
+func Compare(baseline *Baseline, current []Result, t Thresholds) []Regression {
+	byName := make(map[string]Result, len(baseline.Results))
+	for _, r := range baseline.Results {
+		byName[r.Name] = r
+	}
+
+	var regressions []Regression
+	for _, cur := range current {
+		base, ok := byName[cur.Name]
+		if !ok {
+			continue
+		}
+
+		if base.NsPerOp > 0 && cur.NsPerOp > base.NsPerOp*(1+t.NsPerOp) {
+			regressions = append(regressions, Regression{
+				Name: cur.Name, Metric: "ns/op", Baseline: base.NsPerOp, Current: cur.NsPerOp,
+			})
+		}
+
+		allowed := float64(base.AllocsPerOp) * (1 + t.AllocsPerOp)
+		if float64(cur.AllocsPerOp) > allowed && cur.AllocsPerOp > base.AllocsPerOp {
+			regressions = append(regressions, Regression{
+				Name: cur.Name, Metric: "allocs/op", Baseline: float64(base.AllocsPerOp), Current: float64(cur.AllocsPerOp),
+			})
+		}
+	}
+	return regressions
+}
+
+// ParseGoTest extracts results from `go test -bench . -benchmem` output so
+// the gate can also consume benchmarks run through the go tool
+func ParseGoTest(r io.Reader) ([]Result, error) {
+	var results []Result
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || !strings.HasPrefix(fields[0], "Benchmark") {
+			continue
+		}
+
+		// Strip the -GOMAXPROCS suffix
+		name := fields[0]
+		if dash := strings.LastIndex(name, "-"); dash > 0 {
+			if _, err := strconv.Atoi(name[dash+1:]); err == nil {
+				name = name[:dash]
+			}
+		}
+		result := Result{Name: strings.TrimPrefix(name, "Benchmark")}
+
+		// Values come in "<value> <unit>" pairs after the iteration count
+		for i := 2; i+1 < len(fields); i += 2 {
+			value, err := strconv.ParseFloat(fields[i], 64)
+			if err != nil {
+				return nil, fmt.Errorf("bad value %q in %q", fields[i], scanner.Text())
+			}
+			switch fields[i+1] {
+			case "ns/op":
+				result.NsPerOp = value
+			case "B/op":
+				result.BytesPerOp = int64(value)
+			case "allocs/op":
+				result.AllocsPerOp = int64(value)
+			}
+		}
+		results = append(results, result)
+	}
+	return results, scanner.Err()
+}
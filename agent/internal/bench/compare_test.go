@@ -0,0 +1,88 @@
+package bench
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCompareThresholds(t *testing.T) {
+	baseline := &Baseline{Results: []Result{
+		{Name: "Fast", NsPerOp: 100, AllocsPerOp: 0},
+		{Name: "Busy", NsPerOp: 1000, AllocsPerOp: 10},
+		{Name: "Tiny", NsPerOp: 50, AllocsPerOp: 1},
+	}}
+	thresholds := Thresholds{NsPerOp: 0.25, AllocsPerOp: 0.1}
+
+	tests := []struct {
+		name    string
+		current Result
+		want    []string // regressed metrics
+	}{
+		{"within both thresholds", Result{Name: "Busy", NsPerOp: 1250, AllocsPerOp: 11}, nil},
+		{"slower than allowed", Result{Name: "Busy", NsPerOp: 1251, AllocsPerOp: 10}, []string{"ns/op"}},
+		{"more allocations than allowed", Result{Name: "Busy", NsPerOp: 900, AllocsPerOp: 12}, []string{"allocs/op"}},
+		{"both", Result{Name: "Busy", NsPerOp: 2000, AllocsPerOp: 20}, []string{"ns/op", "allocs/op"}},
+		// A zero-alloc path regresses on its first allocation
+		{"first allocation", Result{Name: "Fast", NsPerOp: 100, AllocsPerOp: 1}, []string{"allocs/op"}},
+		// 10% of a single allocation allows none more
+		{"one more on a tiny baseline", Result{Name: "Tiny", NsPerOp: 50, AllocsPerOp: 2}, []string{"allocs/op"}},
+		{"faster", Result{Name: "Busy", NsPerOp: 10, AllocsPerOp: 0}, nil},
+		{"not in the baseline", Result{Name: "New", NsPerOp: 1e9, AllocsPerOp: 1000}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, r := range Compare(baseline, []Result{tt.current}, thresholds) {
+				got = append(got, r.Metric)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("regressed %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseGoTest(t *testing.T) {
+	output := `goos: linux
+goarch: amd64
+pkg: github.com/zeropr/agent/internal/bench
+BenchmarkHubBroadcast-8     	  123456	      9512 ns/op	     128 B/op	       2 allocs/op
+BenchmarkTXTBuild           	 1000000	      1043 ns/op	       0 B/op	       0 allocs/op
+PASS
+ok  	github.com/zeropr/agent/internal/bench	2.345s
+`
+	got, err := ParseGoTest(strings.NewReader(output))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Result{
+		{Name: "HubBroadcast", NsPerOp: 9512, BytesPerOp: 128, AllocsPerOp: 2},
+		{Name: "TXTBuild", NsPerOp: 1043},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parsed %+v, want %+v", got, want)
+	}
+
+	if _, err := ParseGoTest(strings.NewReader("BenchmarkBad 1 fast ns/op\n")); err == nil {
+		t.Error("a line with a non-numeric value parsed")
+	}
+}
+
+func TestSaveKeepsNotes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "baseline.json")
+	previous := &Baseline{Results: []Result{{Name: "Busy", NsPerOp: 1000, Note: "dominated by the gzip writer"}}}
+	updated := &Baseline{Results: []Result{{Name: "TXTBuild", NsPerOp: 900}, {Name: "Busy", NsPerOp: 800}}}
+	if err := updated.Save(path, previous); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadBaseline(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Result{{Name: "Busy", NsPerOp: 800, Note: "dominated by the gzip writer"}, {Name: "TXTBuild", NsPerOp: 900}}
+	if !reflect.DeepEqual(loaded.Results, want) {
+		t.Errorf("saved %+v, want %+v", loaded.Results, want)
+	}
+}
@@ -0,0 +1,274 @@
+//go:build bench
+
+package bench
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/zeropr/agent/internal/config"
+	"github.com/zeropr/agent/internal/discovery"
+	"github.com/zeropr/agent/internal/events"
+	"github.com/zeropr/agent/internal/peers"
+	"github.com/zeropr/agent/internal/server"
+	"github.com/zeropr/agent/internal/sessions"
+	"github.com/zeropr/agent/internal/workspace"
+)
+
+// Benchmark is one named hot-path benchmark
+type Benchmark struct {
+	Name string
+	Fn   func(b *testing.B)
+}
+
+// Suite lists the hot paths guarded by the regression gate. Names match the
+// entries in baseline.json.
+var Suite = []Benchmark{
+	{"HubBroadcast8", benchHubBroadcast},
+	{"RegistryUpsertBatch500", benchRegistryUpsertBatch},
+	{"StatusHandlerParallel", benchStatusHandler},
+	{"TXTBuild", benchTXTBuild},
+	{"PathResolve", benchPathResolve},
+	{"FileGetPlain64K", benchFileGet(false)},
+	{"FileGetGzip64K", benchFileGet(true)},
+}
+
+// Run executes every benchmark in the suite with allocation reporting
+func Run() []Result {
+	results := make([]Result, 0, len(Suite))
+	for _, bm := range Suite {
+		fn := bm.Fn
+		r := testing.Benchmark(func(b *testing.B) {
+			b.ReportAllocs()
+			fn(b)
+		})
+		results = append(results, Result{
+			Name:        bm.Name,
+			NsPerOp:     float64(r.NsPerOp()),
+			BytesPerOp:  r.AllocedBytesPerOp(),
+			AllocsPerOp: r.AllocsPerOp(),
+			Extra:       r.Extra,
+		})
+	}
+	return results
+}
+
+// benchHubBroadcast relays one message from a sender to 8 other participants.
+// A tight loop of broadcasts would outrun the sockets and have receivers
+// dropped as too slow, so the sender keeps at most window frames ahead of
+// the slowest receiver; what's timed is fan-out every participant keeps up
+// with.
+func benchHubBroadcast(b *testing.B) {
+	const (
+		clients = 8
+		window  = 64 // well inside the hub's per-client send queue
+	)
+	hub := sessions.NewHub(sessions.DuplicateReplace)
+	upgrader := websocket.Upgrader{}
+
+	registered := make(chan *sessions.Client, clients+1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		client, _ := hub.Register("bench", r.URL.Query().Get("participant"), conn)
+		registered <- client
+	}))
+	defer srv.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+	var sender *sessions.Client
+	var received []chan struct{} // one per receiver, a token per frame read
+	for i := 0; i <= clients; i++ {
+		conn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("%s?participant=p%d", url, i), nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer conn.Close()
+		var got chan struct{}
+		if i > 0 {
+			got = make(chan struct{}, 2*window)
+			received = append(received, got)
+		}
+		go func() {
+			for {
+				if _, _, err := conn.NextReader(); err != nil {
+					return
+				}
+				if got != nil {
+					got <- struct{}{}
+				}
+			}
+		}()
+		client := <-registered
+		if i == 0 {
+			sender = client
+		}
+	}
+
+	// caughtUp waits until every receiver has read n more frames
+	caughtUp := func(n int) {
+		for _, got := range received {
+			for j := 0; j < n; j++ {
+				select {
+				case <-got:
+				case <-time.After(5 * time.Second):
+					b.Fatal("a receiver stopped getting frames")
+				}
+			}
+		}
+	}
+
+	msg := make([]byte, 256)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		hub.Broadcast(sender, websocket.BinaryMessage, msg)
+		if i >= window {
+			caughtUp(1)
+		}
+	}
+	caughtUp(min(b.N, window))
+	b.StopTimer()
+	if n := hub.Participants("bench"); n != clients+1 {
+		b.Fatalf("%d of %d participants still connected", n, clients+1)
+	}
+}
+
+// benchRegistryUpsertBatch refreshes 500 known peers in one batch
+func benchRegistryUpsertBatch(b *testing.B) {
+	registry := peers.NewRegistry(events.NewBus())
+	batch := make([]*peers.Peer, 500)
+	for i := range batch {
+		batch[i] = &peers.Peer{ID: fmt.Sprintf("peer-%d", i), Name: fmt.Sprintf("peer-%d", i), Address: "10.0.0.1", Port: 8080}
+	}
+	registry.UpsertBatch(batch)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		registry.UpsertBatch(batch)
+	}
+}
+
+// benchStatusHandler serves /api/status from many goroutines at once
+func benchStatusHandler(b *testing.B) {
+	dir, err := os.MkdirTemp("", "zeropr-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ws, err := workspace.New([]workspace.Root{{Name: "bench", Path: dir}})
+	if err != nil {
+		b.Fatal(err)
+	}
+	bus := events.NewBus()
+	registry := peers.NewRegistry(bus)
+	cfg := benchConfig()
+	disc, _ := discovery.NewService(cfg, registry)
+	handler := server.NewServer(cfg, registry, disc, bus, ws).Handler()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			req := httptest.NewRequest(http.MethodGet, "/api/status", nil)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			io.Copy(io.Discard, rec.Body)
+		}
+	})
+}
+
+// benchConfig is the default configuration with a fixed device name, and
+// display name rather than the host's
+func benchConfig() *config.Config {
+	cfg := config.Default()
+	cfg.DeviceName = "bench"
+	cfg.DisplayName = "Bénch"
+	return cfg
+}
+
+// benchTXTBuild renders the advertised TXT record set
+func benchTXTBuild(b *testing.B) {
+	disc, _ := discovery.NewService(benchConfig(), peers.NewRegistry(events.NewBus()))
+	disc.SetTXT("repoHash", "0123456789abcdef")
+	disc.SetTXT("branch", "feat/bench")
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		disc.TXTRecords()
+	}
+}
+
+// benchPathResolve normalizes and sandboxes a repo-relative path
+func benchPathResolve(b *testing.B) {
+	dir, err := os.MkdirTemp("", "zeropr-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ws, err := workspace.New([]workspace.Root{{Name: "bench", Path: dir}})
+	if err != nil {
+		b.Fatal(err)
+	}
+	root, _ := ws.Root("")
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		root.Resolve("src/components/../components/Login.tsx")
+	}
+}
+
+// benchFileGet serves a 64 KiB source file through /api/file/get, with or
+// without gzip, to weigh compression CPU against the bytes saved
+func benchFileGet(gzip bool) func(b *testing.B) {
+	return func(b *testing.B) {
+		dir, err := os.MkdirTemp("", "zeropr-bench")
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		// Varied lines so the compression ratio resembles real source
+		var content strings.Builder
+		for i := 0; content.Len() < 64<<10; i++ {
+			fmt.Fprintf(&content, "\tresult%d, err := handler.Process(ctx, %d, %q)\n", i, i*7919%1000, fmt.Sprint(i*31))
+		}
+		if err := os.WriteFile(filepath.Join(dir, "main.go"), []byte(content.String()), 0o644); err != nil {
+			b.Fatal(err)
+		}
+
+		ws, err := workspace.New([]workspace.Root{{Name: "bench", Path: dir}})
+		if err != nil {
+			b.Fatal(err)
+		}
+		bus := events.NewBus()
+		registry := peers.NewRegistry(bus)
+		cfg := benchConfig()
+		disc, _ := discovery.NewService(cfg, registry)
+		handler := server.NewServer(cfg, registry, disc, bus, ws).Handler()
+
+		var wire int
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			req := httptest.NewRequest(http.MethodGet, "/api/file/get?path=main.go", nil)
+			req.RemoteAddr = "127.0.0.1:40000" // local client; remote callers must sign
+			if gzip {
+				req.Header.Set("Accept-Encoding", "gzip")
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			wire = rec.Body.Len()
+		}
+		b.ReportMetric(float64(wire), "wire-bytes")
+	}
+}
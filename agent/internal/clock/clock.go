@@ -0,0 +1,110 @@
+// Package clock notices when the wall clock jumps, as after an NTP step or
+// a manual change. The agent's own timeouts and expiries already run on
+// Go's monotonic clock and ride through a jump; what can't is anything
+// compared with another machine's wall clock, such as signed request
+// timestamps, so a jump is logged, published, and used to re-check peers.
+package clock
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/zeropr/agent/internal/events"
+	"github.com/zeropr/agent/internal/logging"
+)
+
+// EventJump is published when the wall clock jumps
+const EventJump = "clock.jump"
+
+const (
+	// checkInterval is how often the wall clock is compared with the
+	// monotonic one
+	checkInterval = 5 * time.Second
+
+	// JumpThreshold is how far the two may drift apart in one interval
+	// before it counts as a jump. NTP slewing moves the wall clock by
+	// milliseconds per interval, far below it.
+	JumpThreshold = 2 * time.Second
+)
+
+// Jump is the payload of EventJump
+type Jump struct {
+	OffsetMs int64     `json:"offsetMs"` // positive when the clock jumped forward
+	Wall     time.Time `json:"wall"`     // wall time after the jump
+}
+
+// Watcher compares the wall clock with the monotonic clock and reports
+// jumps between them
+type Watcher struct {
+	bus    *events.Bus
+	logger *slog.Logger
+	hooks  []func(Jump)
+	read   func() (wall time.Time, mono time.Duration) // the two clocks; tests replace it
+	mu     sync.Mutex
+}
+
+// NewWatcher creates a watcher publishing jumps on bus
+func NewWatcher(bus *events.Bus) *Watcher {
+	start := time.Now()
+	return &Watcher{
+		bus:    bus,
+		logger: logging.Component(nil, "clock"),
+		read: func() (time.Time, time.Duration) {
+			now := time.Now()
+			return now.Round(0), now.Sub(start)
+		},
+	}
+}
+
+// SetLogger sets the logger jumps are reported to
+func (w *Watcher) SetLogger(logger *slog.Logger) {
+	w.logger = logging.Component(logger, "clock")
+}
+
+// OnJump registers fn to run after each jump
+func (w *Watcher) OnJump(fn func(Jump)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.hooks = append(w.hooks, fn)
+}
+
+// Run checks for jumps until ctx is done
+func (w *Watcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+
+	wall, mono := w.read()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			wall, mono = w.check(wall, mono)
+		}
+	}
+}
+
+// check reads the clocks again and reports a jump if the wall clock moved
+// further than the monotonic one since the last reading, which it returns
+func (w *Watcher) check(lastWall time.Time, lastMono time.Duration) (time.Time, time.Duration) {
+	wall, mono := w.read()
+	if offset := wall.Sub(lastWall) - (mono - lastMono); offset >= JumpThreshold || offset <= -JumpThreshold {
+		w.report(Jump{OffsetMs: offset.Milliseconds(), Wall: wall})
+	}
+	return wall, mono
+}
+
+func (w *Watcher) report(jump Jump) {
+	w.logger.Warn("Wall clock jumped; re-checking peers",
+		"offset", time.Duration(jump.OffsetMs)*time.Millisecond)
+	w.bus.Publish(EventJump, jump)
+
+	w.mu.Lock()
+	hooks := append([]func(Jump){}, w.hooks...)
+	w.mu.Unlock()
+	for _, fn := range hooks {
+		fn(jump)
+	}
+}
@@ -0,0 +1,73 @@
+package clock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zeropr/agent/internal/events"
+)
+
+// fakeClocks are a wall and a monotonic clock the test moves by hand
+type fakeClocks struct {
+	wall time.Time
+	mono time.Duration
+}
+
+func (c *fakeClocks) read() (time.Time, time.Duration) {
+	return c.wall, c.mono
+}
+
+// tick advances both clocks by one check interval, the wall clock by skew more
+func (c *fakeClocks) tick(skew time.Duration) {
+	c.mono += checkInterval
+	c.wall = c.wall.Add(checkInterval + skew)
+}
+
+func TestWatcherReportsJumps(t *testing.T) {
+	bus := events.NewBus()
+	published, cancel := bus.Subscribe("test", 8)
+	defer cancel()
+	clocks := &fakeClocks{wall: time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)}
+	w := NewWatcher(bus)
+	w.read = clocks.read
+	var hooked []Jump
+	w.OnJump(func(j Jump) { hooked = append(hooked, j) })
+
+	wall, mono := w.read()
+	for _, skew := range []time.Duration{
+		0,
+		15 * time.Millisecond, // NTP slewing
+		-10 * time.Minute,     // an NTP step back
+		0,
+		JumpThreshold - time.Millisecond,
+		3 * time.Second, // someone set the clock forward
+	} {
+		clocks.tick(skew)
+		wall, mono = w.check(wall, mono)
+	}
+
+	want := []int64{-600000, 3000}
+	if len(hooked) != len(want) || hooked[0].OffsetMs != want[0] || hooked[1].OffsetMs != want[1] {
+		t.Fatalf("jumps %+v, want offsets %v", hooked, want)
+	}
+	if !hooked[1].Wall.Equal(clocks.wall) {
+		t.Errorf("jump at %v, want the wall time after it, %v", hooked[1].Wall, clocks.wall)
+	}
+	for _, offset := range want {
+		event := <-published
+		if jump, ok := event.Data.(Jump); event.Type != EventJump || !ok || jump.OffsetMs != offset {
+			t.Errorf("published %s %+v, want a jump of %dms", event.Type, event.Data, offset)
+		}
+	}
+}
+
+func TestWatcherRealClocks(t *testing.T) {
+	// Without a jump the real clocks agree to well within the threshold
+	w := NewWatcher(events.NewBus())
+	w.OnJump(func(j Jump) { t.Errorf("reported a jump of %dms", j.OffsetMs) })
+	wall, mono := w.read()
+	time.Sleep(20 * time.Millisecond)
+	if wall2, mono2 := w.check(wall, mono); mono2-mono < 20*time.Millisecond || wall2.Sub(wall) < 15*time.Millisecond {
+		t.Errorf("readings moved %v and %v over 20ms", wall2.Sub(wall), mono2-mono)
+	}
+}
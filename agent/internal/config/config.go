@@ -0,0 +1,855 @@
+// Package config assembles the agent's settings from, in order of
+// precedence, command-line flags, ZEROPR_* environment variables, a YAML
+// config file, and built-in defaults. Every flag can be set at each level:
+// -log-level is ZEROPR_LOG_LEVEL in the environment and log-level (or
+// log: {level: ...}) in the file.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zeropr/agent/internal/crypto"
+	"github.com/zeropr/agent/internal/gitinfo"
+	"github.com/zeropr/agent/internal/health"
+	"github.com/zeropr/agent/internal/i18n"
+	"github.com/zeropr/agent/internal/logging"
+	"github.com/zeropr/agent/internal/names"
+	"github.com/zeropr/agent/internal/notify"
+	"github.com/zeropr/agent/internal/peerclient"
+	"github.com/zeropr/agent/internal/peers"
+	"github.com/zeropr/agent/internal/sessions"
+	"github.com/zeropr/agent/internal/storage"
+	"github.com/zeropr/agent/internal/workspace"
+)
+
+// EnvPrefix starts the environment variable for each setting
+const EnvPrefix = "ZEROPR_"
+
+// DefaultCompressThreshold is the smallest file response worth gzipping
+const DefaultCompressThreshold = 4096
+
+// ErrUsage is returned for a malformed command line, after the flag set
+// has printed the problem and usage
+var ErrUsage = errors.New("invalid command line")
+
+// mDNS backends for -mdns-backend
+const (
+	MDNSBuiltin = "builtin" // the built-in responder, reporting conflicts with a system daemon
+	MDNSAuto    = "auto"    // the built-in responder, moving to the system daemon on a conflict
+	MDNSAvahi   = "avahi"   // avahi-daemon over D-Bus from the start (Linux)
+)
+
+// defaultName is the device name that gets the hostname appended
+const defaultName = "zeropr-agent"
+
+// maxDisplayName is the longest display name, in bytes, so it fits its TXT
+// string with room to spare
+const maxDisplayName = 128
+
+// cliOnly lists flags that only make sense on the command line
+var cliOnly = map[string]bool{"config": true, "selftest": true, "version": true}
+
+// Config is the agent's resolved configuration
+type Config struct {
+	File string   // config file read, if any
+	Args []string // arguments left after the flags, such as a subcommand
+
+	DeviceName  string // normalized name advertised over mDNS
+	DisplayName string // human-readable name advertised beside it, in any script; empty when the same
+	HTTPPort    int
+	Listen      string // local client API address
+	PeerListen  string // LAN address serving other agents; empty when disabled
+	SyncListen  string // address serving only sync sockets; empty serves them on the API listeners
+	PortAuto    bool   // move up to free ports when the configured ones are taken
+	MDNSBackend string // publishes and browses mDNS: MDNSBuiltin, MDNSAuto, or MDNSAvahi
+	SelfTest    bool
+	Version     bool // print build metadata and exit
+
+	StateDir       string
+	Storage        string
+	RequireToken   bool
+	AllowedOrigins []string
+	TLS            bool
+	TLSCert        string // PEM certificate served instead of the self-signed one
+	TLSKey         string
+	ReadOnly       bool // serve no files, e.g. from a repo with embargoed changes
+	VerifiedOnly   crypto.Policy
+
+	WorkDir string // absolute; stands in for the directory the agent was started from
+	Roots   []workspace.Root
+	Locale  string
+	Metrics bool
+	Debug   bool // serve debug helpers such as adding a mock peer
+
+	LogLevel  slog.Level
+	LogFormat string
+	LogLimits logging.RateLimitConfig
+
+	Health       health.Config
+	Notify       notify.Config
+	PeerFilter   peers.Filter        // peers discovery and manual adds may list
+	PeerLimits   peerclient.Limits   // ceilings on what we send any one peer
+	PeerTimeouts peerclient.Timeouts // bounds on each request to a peer
+
+	DuplicatePolicy        sessions.DuplicatePolicy
+	SyncKeepalive          sessions.Keepalive // pings and write timeout on sync and chat sockets
+	CursorGhost            time.Duration
+	RejoinGrace            time.Duration
+	DrainGrace             time.Duration // how long sessions carry on after serving is turned off
+	PresenceDebounce       time.Duration // presence updates within this window reach peers as one
+	IdleAfter              time.Duration // inactivity after which idle is advertised; 0 never
+	UnattendedVerifiedOnly bool          // while nobody is at the keyboard, serve files to verified peers only
+	DNDAllowVerified       bool          // peers verified with a pairing code may join sessions during do-not-disturb
+	SessionBudget          sessions.Budget
+	MaxSessionFileSize     int64                   // largest file a session may be opened on, in bytes; 0 is unlimited
+	NetworkProfile         sessions.NetworkProfile // the kind of link this machine is on, for session estimates
+	SessionMaxParticipants int                     // participants a session takes unless its create request says otherwise; 0 is no cap
+	SessionRecording       int                     // bytes of each session's sync frames kept for debugging; 0 keeps none
+	CaptureConsentWait     time.Duration           // how long another agent's divergence capture waits on the user to share this one's recording
+
+	CompressThreshold int           // -1 disables compression
+	FileReads         int           // concurrent file reads; 0 is unlimited
+	FileReadWait      time.Duration // how long a file read may queue for a slot
+	FileCacheSize     int64         // bytes of file content kept in memory; 0 disables the cache
+	RetentionInterval time.Duration
+	SessionSnapshots  time.Duration // how often live sessions are saved to disk; 0 disables saving and restoring them
+	SessionRestoreTTL time.Duration // how recently a saved session must have been saved to be restored
+	BranchPoll        time.Duration
+
+	raw     raw
+	sources map[string]string // setting -> where it was set, for errors
+	values  map[string]string // setting -> its value as given, to spot changes on reload
+}
+
+// raw holds settings as given, before finish parses them
+type raw struct {
+	name           string
+	displayName    string
+	listen         string
+	peerListen     string
+	wsPort         int
+	verifiedOnly   string
+	allowedOrigins string
+	locale         string
+	logLevel       string
+	logRateLimit   int
+	logOverrides   string
+	duplicates     string
+	healthSkip     string
+	allow          string
+	block          string
+	notify         string
+	notifyRate     int
+	sessionFrames  int
+	sessionBytes   int
+	networkProfile string
+	roots          rootList
+}
+
+// AdvertisePort is the port peers reach this agent on, or 0 when the peer
+// listener is disabled
+func (c *Config) AdvertisePort() int {
+	if c.PeerListen == "" {
+		return 0
+	}
+	return listenPort(c.PeerListen)
+}
+
+// Load resolves the configuration from command-line args, the environment
+// as read by lookupEnv, and the config file named by -config or
+// ZEROPR_CONFIG (default ~/.zeropr/config.yaml, which may be absent). It
+// returns flag.ErrHelp if args ask for usage and ErrUsage if they're
+// malformed.
+func Load(args []string, lookupEnv func(string) (string, bool)) (*Config, error) {
+	return load(args, lookupEnv, true)
+}
+
+// Default returns the built-in defaults, ignoring the environment and any
+// config file
+func Default() *Config {
+	cfg, err := load(nil, func(string) (string, bool) { return "", false }, false)
+	if err != nil {
+		panic(err)
+	}
+	return cfg
+}
+
+func load(args []string, lookupEnv func(string) (string, bool), readConfig bool) (*Config, error) {
+	c := &Config{sources: make(map[string]string)}
+	fs := c.flags()
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return nil, err
+		}
+		return nil, ErrUsage
+	}
+	c.Args = fs.Args()
+	fs.Visit(func(f *flag.Flag) {
+		c.sources[f.Name] = "-" + f.Name
+	})
+
+	// Environment variables fill in what the command line left unset
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || cliOnly[f.Name] || c.sources[f.Name] != "" {
+			return
+		}
+		env := EnvName(f.Name)
+		value, ok := lookupEnv(env)
+		if !ok {
+			return
+		}
+		if _, repeatable := f.Value.(repeatable); repeatable {
+			err = setAll(f.Value, filepath.SplitList(value))
+		} else {
+			err = f.Value.Set(value)
+		}
+		if err != nil {
+			err = fmt.Errorf("%s: invalid value %q: %w", env, value, err)
+			return
+		}
+		c.sources[f.Name] = env
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if readConfig {
+		if err := c.readConfig(fs, lookupEnv); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.finish(); err != nil {
+		return nil, err
+	}
+	c.values = make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		if !cliOnly[f.Name] {
+			c.values[f.Name] = f.Value.String()
+		}
+	})
+	return c, nil
+}
+
+// reloadable lists the settings Adopt applies to a running agent; the
+// rest take effect on restart
+var reloadable = map[string]bool{
+	"log-level":                true,
+	"log-rate-limit":           true,
+	"log-rate-limit-component": true,
+	"allowed-origins":          true,
+	"verified-only":            true,
+	"compress-threshold":       true,
+	"cursor-ghost":             true,
+	"drain-grace":              true,
+	"presence-debounce":        true,
+	"idle-after":               true,
+	"unattended-verified-only": true,
+	"dnd-allow-verified":       true,
+	"session-frame-budget":     true,
+	"session-byte-budget":      true,
+	"max-session-file-size":    true,
+	"session-max-participants": true,
+	"network-profile":          true,
+	"health-skip":              true,
+	"allow":                    true,
+	"block":                    true,
+}
+
+// Adopt takes the reloadable settings that differ in next, as loaded again
+// on reload, and reports which changed. Changed settings that need a
+// restart are left alone and listed in restart, so they are reported on
+// every reload until the agent restarts.
+func (c *Config) Adopt(next *Config) (applied, restart []string) {
+	for key, value := range next.values {
+		if c.values[key] == value {
+			continue
+		}
+		if !reloadable[key] {
+			restart = append(restart, key)
+			continue
+		}
+		applied = append(applied, key)
+		c.values[key] = value
+	}
+	sort.Strings(applied)
+	sort.Strings(restart)
+
+	c.LogLevel = next.LogLevel
+	c.LogLimits = next.LogLimits
+	c.AllowedOrigins = next.AllowedOrigins
+	c.VerifiedOnly = next.VerifiedOnly
+	c.CompressThreshold = next.CompressThreshold
+	c.CursorGhost = next.CursorGhost
+	c.DrainGrace = next.DrainGrace
+	c.PresenceDebounce = next.PresenceDebounce
+	c.IdleAfter = next.IdleAfter
+	c.UnattendedVerifiedOnly = next.UnattendedVerifiedOnly
+	c.DNDAllowVerified = next.DNDAllowVerified
+	c.SessionBudget = next.SessionBudget
+	c.MaxSessionFileSize = next.MaxSessionFileSize
+	c.SessionMaxParticipants = next.SessionMaxParticipants
+	c.NetworkProfile = next.NetworkProfile
+	c.Health.Skip = next.Health.Skip
+	c.PeerFilter = next.PeerFilter
+	return applied, restart
+}
+
+// EnvName returns the environment variable for a setting: ZEROPR_LOG_LEVEL
+// for log-level
+func EnvName(key string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+}
+
+// flags binds every setting to a flag on a new flag set
+func (c *Config) flags() *flag.FlagSet {
+	fs := flag.NewFlagSet(defaultName, flag.ContinueOnError)
+	r := &c.raw
+
+	fs.StringVar(&c.File, "config", "", "YAML config file (default ~/.zeropr/config.yaml)")
+
+	fs.IntVar(&c.HTTPPort, "http-port", 8080, "HTTP API port; the peer listener defaults to the next port")
+	fs.StringVar(&r.listen, "listen", "", "Address for the local client API (default 127.0.0.1:<http-port>)")
+	fs.StringVar(&r.peerListen, "peer-listen", "", `LAN address serving other agents (default :<http-port+1>, "none" disables)`)
+	fs.StringVar(&r.name, "name", defaultName, "Device name for mDNS")
+	fs.StringVar(&r.displayName, "display-name", "", "Name peers show for this device, in any script (default the hostname as written, when -name is left at its default)")
+	fs.StringVar(&c.MDNSBackend, "mdns-backend", MDNSBuiltin, "mDNS backend: builtin, auto (switch to the system daemon when it conflicts with the built-in responder), or avahi")
+	fs.BoolVar(&c.SelfTest, "selftest", false, "Check that mDNS discovery works on this machine, print a report, and exit")
+	fs.BoolVar(&c.Version, "version", false, "Print the version, commit, and build date, and exit")
+
+	fs.IntVar(&r.wsPort, "ws-port", 0, "Port serving only sync sockets, so API and sync traffic can be firewalled separately (0 serves them on the API listeners)")
+	fs.BoolVar(&c.PortAuto, "port-auto", false, "When the configured ports are taken, move every listener up to the next free ones and print them on stdout")
+
+	fs.DurationVar(&c.Health.Interval, "health-interval", 15*time.Second, "Peer health check interval (0 disables)")
+	fs.DurationVar(&c.Health.Timeout, "health-timeout", 3*time.Second, "Per-peer health check timeout")
+	fs.IntVar(&c.PeerLimits.Concurrent, "peer-max-concurrent", peerclient.DefaultLimits.Concurrent, "Most requests in flight to any one peer at once (0 is unlimited)")
+	fs.Float64Var(&c.PeerLimits.PerSecond, "peer-max-rate", peerclient.DefaultLimits.PerSecond, "Most requests started per second to any one peer (0 is unlimited)")
+	fs.DurationVar(&c.PeerTimeouts.Dial, "peer-dial-timeout", peerclient.DefaultTimeouts.Dial, "How long connecting to a peer, TLS handshake included, may take (0 is unbounded)")
+	fs.DurationVar(&c.PeerTimeouts.Response, "peer-response-timeout", peerclient.DefaultTimeouts.Response, "How long a peer may take to start answering a request (0 is unbounded)")
+	fs.DurationVar(&c.PeerTimeouts.Request, "peer-request-timeout", peerclient.DefaultTimeouts.Request, "How long a whole request to a peer, body included, may take; background transfers are exempt (0 is unbounded)")
+	fs.StringVar(&r.healthSkip, "health-skip", "", "Comma-separated peer IDs, names, or addresses to never probe")
+	fs.StringVar(&r.allow, "allow", "", "Comma-separated peer IDs, names, addresses, or key fingerprints; when set, only these peers are listed")
+	fs.StringVar(&r.block, "block", "", "Comma-separated peer IDs, names, addresses, or key fingerprints to ignore entirely")
+
+	fs.StringVar(&c.StateDir, "state-dir", defaultStateDir(), "Directory for agent state (tokens, keys)")
+	fs.BoolVar(&c.RequireToken, "require-token", false, "Require an API token on all non-public endpoints")
+	fs.StringVar(&r.verifiedOnly, "verified-only", "", "Comma-separated capabilities (files) reserved for peers verified with a pairing code")
+	fs.StringVar(&r.allowedOrigins, "allowed-origins", "", "Comma-separated browser origins allowed to call the API and open sync sockets (* allows any)")
+	fs.BoolVar(&c.TLS, "tls", false, "Serve HTTPS/WSS with a self-signed certificate keyed to the agent identity")
+	fs.StringVar(&c.TLSCert, "tls-cert", "", "PEM certificate (or chain) to serve HTTPS/WSS with instead of the self-signed one; needs -tls-key")
+	fs.StringVar(&c.TLSKey, "tls-key", "", "PEM private key for -tls-cert")
+	fs.BoolVar(&c.ReadOnly, "read-only", false, "Serve no files to anyone, while discovery and sessions keep working (toggle at runtime with POST /api/mode)")
+	fs.StringVar(&c.Storage, "storage", storage.BackendFiles, "Backend for trust, tokens, aliases, and policies: files or bolt")
+
+	fs.StringVar(&r.logLevel, "log-level", "info", "Minimum log level: debug, info, warn, or error")
+	fs.StringVar(&c.LogFormat, "log-format", logging.FormatText, "Log output format: text or json")
+	fs.IntVar(&r.logRateLimit, "log-rate-limit", 60, "Identical log lines allowed per component per minute (0 disables)")
+	fs.StringVar(&r.logOverrides, "log-rate-limit-component", "", "Per-component overrides as component=N,... (N<=0 disables)")
+
+	fs.StringVar(&r.duplicates, "duplicate-connections", string(sessions.DuplicateReplace), "Second sync connection from the same participant: replace or refuse")
+	fs.DurationVar(&c.SyncKeepalive.Interval, "ws-ping-interval", sessions.DefaultKeepalive.Interval, "How often sync sockets are pinged; a client that misses two pings is dropped (0 disables)")
+	fs.DurationVar(&c.SyncKeepalive.WriteTimeout, "ws-write-timeout", sessions.DefaultKeepalive.WriteTimeout, "How long a write to a sync socket may take before the client is dropped (0 is unbounded)")
+
+	fs.DurationVar(&c.CursorGhost, "cursor-ghost", sessions.DefaultGhostTTL, "How long a departed participant's cursor stays visible (0 disables)")
+	fs.DurationVar(&c.RejoinGrace, "rejoin-grace", sessions.DefaultRejoinGrace, "How long a dropped participant's reconnection token stays valid")
+	fs.DurationVar(&c.DrainGrace, "drain-grace", 30*time.Second, "How long live sessions carry on after the serve plane is turned off before their sockets are closed")
+	fs.DurationVar(&c.PresenceDebounce, "presence-debounce", 2*time.Second, "Presence updates arriving within this window are advertised to peers as one; status changes go out at once (0 disables)")
+	fs.DurationVar(&c.IdleAfter, "idle-after", 10*time.Minute, "Advertise the status idle after this long without presence updates or editor socket messages, until the next one (0 disables)")
+	fs.BoolVar(&c.UnattendedVerifiedOnly, "unattended-verified-only", false, "While nobody is at the keyboard (away, idle, or no editor attached), serve files only to peers verified with a pairing code")
+	fs.BoolVar(&c.DNDAllowVerified, "dnd-allow-verified", false, "Let peers verified with a pairing code join sessions while the status is dnd")
+
+	fs.IntVar(&r.sessionFrames, "session-frame-budget", 500, "Sync frames per second one session may relay before its frames are queued (0 disables)")
+	fs.IntVar(&r.sessionBytes, "session-byte-budget", 4<<20, "Sync bytes per second one session may relay before its frames are queued (0 disables)")
+	fs.Int64Var(&c.MaxSessionFileSize, "max-session-file-size", 16<<20, "Largest file in bytes a session may be opened on without force (0 is unlimited)")
+	fs.IntVar(&c.SessionMaxParticipants, "session-max-participants", sessions.DefaultMaxParticipants, "Participants a session takes unless created with its own cap (0 is no cap)")
+	fs.IntVar(&c.SessionRecording, "session-recording", sessions.DefaultRecording, "Bytes of each live session's most recent sync frames kept for divergence captures (0 disables)")
+	fs.DurationVar(&c.CaptureConsentWait, "capture-consent-wait", 20*time.Second, "How long another agent's divergence capture waits for you to share this agent's recording; keep it under its -peer-response-timeout")
+	fs.StringVar(&r.networkProfile, "network-profile", string(sessions.ProfileNormal), "The link this machine is on, for session estimates: normal, metered, or low-power")
+
+	fs.StringVar(&r.notify, "notify", "", "Desktop notification categories to show: peers,sessions,health (empty disables)")
+	fs.IntVar(&r.notifyRate, "notify-rate", 6, "Desktop notifications allowed per minute")
+
+	fs.IntVar(&c.FileReads, "max-file-reads", 16, "File reads served at once; more wait for a slot, then get 503 (0 is unlimited)")
+	fs.Int64Var(&c.FileCacheSize, "file-cache-size", 0, "Bytes of recently served file content kept in memory, so repeated reads of unchanged files skip the disk (0 disables)")
+	fs.DurationVar(&c.FileReadWait, "file-read-wait", 2*time.Second, "How long a file read waits for a slot under -max-file-reads before getting 503")
+
+	fs.IntVar(&c.CompressThreshold, "compress-threshold", DefaultCompressThreshold, "File responses at least this many bytes are gzipped for clients that accept it (-1 disables)")
+
+	fs.StringVar(&r.locale, "locale", i18n.DefaultLocale, "Language of notifications, the self-test report, and error messages for clients that send no supported Accept-Language")
+
+	fs.BoolVar(&c.Metrics, "metrics", false, "Serve Prometheus metrics at /metrics on the local listener")
+	fs.BoolVar(&c.Debug, "debug", false, "Serve debug helpers that inject state, such as POST /api/debug/add-mock-peer; never on a real network")
+
+	fs.DurationVar(&c.RetentionInterval, "retention-interval", time.Hour, "How often the retention policy is enforced on ended-session artifacts (0 disables scheduled runs)")
+	fs.DurationVar(&c.SessionSnapshots, "session-snapshot-interval", sessions.DefaultSnapshotInterval, "How often live sessions and their documents are saved under the state directory, to be restored after a restart (0 disables)")
+	fs.DurationVar(&c.SessionRestoreTTL, "session-restore-ttl", sessions.DefaultRestoreTTL, "How long after it was last saved a session is still restored at startup (0 restores none)")
+
+	fs.DurationVar(&c.BranchPoll, "branch-poll", 5*time.Second, "How often .git/HEAD is checked for branch switches")
+
+	fs.Var(&r.roots, "root", "Repository root to serve as name=path (repeatable; defaults to the working directory if it is inside a git repository)")
+	fs.StringVar(&c.WorkDir, "workdir", "", "Directory to use instead of the one the agent was started from: relative -root paths resolve against it, and without -root it is served (default: the current directory)")
+	return fs
+}
+
+// readConfig applies the config file's settings to flags not already set
+// on the command line or in the environment
+func (c *Config) readConfig(fs *flag.FlagSet, lookupEnv func(string) (string, bool)) error {
+	path, explicit := c.File, c.File != ""
+	if !explicit {
+		if env, ok := lookupEnv(EnvName("config")); ok && env != "" {
+			path, explicit = env, true
+		}
+	}
+	if !explicit {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil
+		}
+		path = filepath.Join(home, ".zeropr", "config.yaml")
+	}
+
+	settings, err := readFile(path)
+	if err != nil {
+		if !explicit && errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	c.File = path
+
+	for _, s := range settings {
+		f := fs.Lookup(s.key)
+		if f == nil || cliOnly[s.key] {
+			return fmt.Errorf("%s:%d: unknown key %q", path, s.line, s.key)
+		}
+		if c.sources[s.key] != "" {
+			continue
+		}
+		if _, repeatable := f.Value.(repeatable); repeatable {
+			err = setAll(f.Value, s.values)
+		} else {
+			err = f.Value.Set(strings.Join(s.values, ","))
+		}
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s: invalid value %q: %w", path, s.line, s.key, strings.Join(s.values, ","), err)
+		}
+		c.sources[s.key] = fmt.Sprintf("%s:%d: %s", path, s.line, s.key)
+	}
+	return nil
+}
+
+// finish parses and validates the settings that aren't plain values
+func (c *Config) finish() error {
+	r := &c.raw
+	var err error
+
+	// Names are shown in other agents' trust prompts, so refuse look-alike tricks
+	if c.DeviceName, err = names.Normalize(resolveDeviceName(r.name)); err != nil {
+		return c.invalid("name", err)
+	}
+	if c.DisplayName, err = resolveDisplayName(r.displayName, r.name); err != nil {
+		return c.invalid("display-name", err)
+	}
+	if c.DisplayName == c.DeviceName {
+		c.DisplayName = ""
+	}
+	c.Listen, c.PeerListen = resolveListeners(r.listen, r.peerListen, c.HTTPPort)
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		return c.invalid("listen", err)
+	}
+	if c.PeerListen != "" {
+		if _, _, err := net.SplitHostPort(c.PeerListen); err != nil {
+			return c.invalid("peer-listen", err)
+		}
+		if port := listenPort(c.PeerListen); port != 0 && port == listenPort(c.Listen) {
+			return c.invalid("peer-listen", fmt.Errorf("local and peer listeners both use port %d", port))
+		}
+	}
+	if c.SyncListen, err = syncListener(r.wsPort, c.Listen, c.PeerListen); err != nil {
+		return c.invalid("ws-port", err)
+	}
+	switch c.MDNSBackend {
+	case MDNSBuiltin, MDNSAuto, MDNSAvahi:
+	default:
+		return c.invalid("mdns-backend", fmt.Errorf("unknown backend %q (use %s, %s, or %s)", c.MDNSBackend, MDNSBuiltin, MDNSAuto, MDNSAvahi))
+	}
+	if !validBackend(c.Storage) {
+		return c.invalid("storage", fmt.Errorf("unknown backend %q (known: %v)", c.Storage, storage.Backends))
+	}
+	if c.VerifiedOnly, err = crypto.NewPolicy(splitList(r.verifiedOnly)); err != nil {
+		return c.invalid("verified-only", err)
+	}
+	c.AllowedOrigins = splitList(r.allowedOrigins)
+	switch {
+	case c.TLSCert != "" && c.TLSKey == "":
+		return c.invalid("tls-key", errors.New("required with -tls-cert"))
+	case c.TLSKey != "" && c.TLSCert == "":
+		return c.invalid("tls-cert", errors.New("required with -tls-key"))
+	case c.TLSCert != "":
+		c.TLS = true
+	}
+
+	locale, ok := i18n.Lookup(r.locale)
+	if !ok {
+		return c.invalid("locale", fmt.Errorf("no catalog for %q (available: %v)", r.locale, i18n.Locales()))
+	}
+	c.Locale = locale
+
+	if c.LogLevel, err = logging.ParseLevel(r.logLevel); err != nil {
+		return c.invalid("log-level", err)
+	}
+	if c.LogFormat != logging.FormatText && c.LogFormat != logging.FormatJSON {
+		return c.invalid("log-format", fmt.Errorf("unknown format %q (use %s or %s)", c.LogFormat, logging.FormatText, logging.FormatJSON))
+	}
+	c.LogLimits.PerMinute = r.logRateLimit
+	if c.LogLimits.Components, err = parseOverrides(r.logOverrides); err != nil {
+		return c.invalid("log-rate-limit-component", err)
+	}
+
+	if c.DuplicatePolicy, err = sessions.ParsePolicy(r.duplicates); err != nil {
+		return c.invalid("duplicate-connections", err)
+	}
+	if c.SyncKeepalive.Interval < 0 {
+		return c.invalid("ws-ping-interval", fmt.Errorf("must not be negative, got %s", c.SyncKeepalive.Interval))
+	}
+	if c.SyncKeepalive.WriteTimeout < 0 {
+		return c.invalid("ws-write-timeout", fmt.Errorf("must not be negative, got %s", c.SyncKeepalive.WriteTimeout))
+	}
+	if c.PeerLimits.Concurrent < 0 {
+		return c.invalid("peer-max-concurrent", fmt.Errorf("must not be negative, got %d", c.PeerLimits.Concurrent))
+	}
+	if c.PeerLimits.PerSecond < 0 {
+		return c.invalid("peer-max-rate", fmt.Errorf("must not be negative, got %g", c.PeerLimits.PerSecond))
+	}
+	if c.FileCacheSize < 0 {
+		return c.invalid("file-cache-size", fmt.Errorf("must not be negative, got %d", c.FileCacheSize))
+	}
+	if c.SessionSnapshots < 0 {
+		return c.invalid("session-snapshot-interval", fmt.Errorf("must not be negative, got %s", c.SessionSnapshots))
+	}
+	if c.SessionRestoreTTL < 0 {
+		return c.invalid("session-restore-ttl", fmt.Errorf("must not be negative, got %s", c.SessionRestoreTTL))
+	}
+	if c.SessionMaxParticipants < 0 {
+		return c.invalid("session-max-participants", fmt.Errorf("must not be negative, got %d", c.SessionMaxParticipants))
+	}
+	if c.SessionRecording < 0 {
+		return c.invalid("session-recording", fmt.Errorf("must not be negative, got %d", c.SessionRecording))
+	}
+	if c.CaptureConsentWait <= 0 {
+		return c.invalid("capture-consent-wait", fmt.Errorf("must be positive, got %s", c.CaptureConsentWait))
+	}
+	if c.MaxSessionFileSize < 0 {
+		return c.invalid("max-session-file-size", fmt.Errorf("must not be negative, got %d", c.MaxSessionFileSize))
+	}
+	if c.NetworkProfile, err = sessions.ParseProfile(r.networkProfile); err != nil {
+		return c.invalid("network-profile", err)
+	}
+	if c.FileReads < 0 {
+		return c.invalid("max-file-reads", fmt.Errorf("must not be negative, got %d", c.FileReads))
+	}
+
+	c.SessionBudget = sessions.Budget{Frames: r.sessionFrames, Bytes: r.sessionBytes}
+
+	c.Health.Skip = splitList(r.healthSkip)
+	c.PeerFilter = peers.Filter{Allow: splitList(r.allow), Block: splitList(r.block)}
+	c.Notify = notify.Config{Categories: splitList(r.notify), PerMinute: r.notifyRate, Locale: c.Locale}
+	if err := notify.ParseCategories(c.Notify.Categories); err != nil {
+		return c.invalid("notify", err)
+	}
+
+	explicitWorkDir := c.WorkDir != ""
+	if c.WorkDir, err = resolveWorkDir(c.WorkDir); err != nil {
+		return c.invalid("workdir", err)
+	}
+
+	// Without -root, the working directory is shared only if it's inside a
+	// git repository or was named with -workdir: an agent started from a
+	// home directory would otherwise serve all of it
+	c.Roots = make([]workspace.Root, 0, len(r.roots))
+	for _, root := range r.roots {
+		if !filepath.IsAbs(root.Path) {
+			root.Path = filepath.Join(c.WorkDir, root.Path)
+		}
+		c.Roots = append(c.Roots, root)
+	}
+	if len(c.Roots) == 0 {
+		if _, err := gitinfo.FindGitDir(c.WorkDir); err == nil || explicitWorkDir {
+			c.Roots = []workspace.Root{{Name: workspace.DefaultRootName, Path: c.WorkDir}}
+		}
+	}
+	return nil
+}
+
+// resolveWorkDir returns dir as an absolute path after checking it is a
+// directory, or the current directory when dir is empty
+func resolveWorkDir(dir string) (string, error) {
+	if dir == "" {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return "", fmt.Errorf("failed to determine working directory: %w", err)
+		}
+		return cwd, nil
+	}
+
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(abs)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return "", fmt.Errorf("%s does not exist", abs)
+	case err != nil:
+		return "", err
+	case !info.IsDir():
+		return "", fmt.Errorf("%s is not a directory", abs)
+	}
+	return abs, nil
+}
+
+// invalid reports a bad setting along with where it was set: the flag,
+// the environment variable, or the config file line
+func (c *Config) invalid(key string, err error) error {
+	source := c.sources[key]
+	if source == "" {
+		source = key
+	}
+	return fmt.Errorf("%s: %w", source, err)
+}
+
+func validBackend(name string) bool {
+	for _, backend := range storage.Backends {
+		if name == backend {
+			return true
+		}
+	}
+	return false
+}
+
+func resolveDeviceName(name string) string {
+	base := strings.TrimSpace(name)
+	if base == "" {
+		base = defaultName
+	}
+
+	// If user provided a non-default custom name, honor it as-is.
+	if name != "" && name != defaultName {
+		return base
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		return fmt.Sprintf("%s-%d", base, time.Now().UnixNano())
+	}
+
+	sanitized := sanitizeHostname(host)
+	if sanitized == "" {
+		return fmt.Sprintf("%s-%d", base, time.Now().UnixNano())
+	}
+
+	return fmt.Sprintf("%s-%s", base, sanitized)
+}
+
+// resolveDisplayName returns the display name to advertise: the one given,
+// or without one and a custom -name, none, since that name is shown as
+// written; otherwise the hostname, which the device name had to mangle. A
+// hostname that wouldn't pass as a display name is left out rather than
+// refused.
+func resolveDisplayName(display, name string) (string, error) {
+	if display != "" {
+		normalized, err := names.Normalize(display)
+		if err == nil && len(normalized) > maxDisplayName {
+			err = fmt.Errorf("must be at most %d bytes, got %d", maxDisplayName, len(normalized))
+		}
+		return normalized, err
+	}
+	if name != "" && name != defaultName {
+		return "", nil
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		return "", nil
+	}
+	normalized, err := names.Normalize(strings.TrimSuffix(host, ".local"))
+	if err != nil || len(normalized) > maxDisplayName {
+		return "", nil
+	}
+	return normalized, nil
+}
+
+func sanitizeHostname(host string) string {
+	host = strings.ToLower(host)
+
+	var builder strings.Builder
+	lastDash := false
+
+	for _, r := range host {
+		switch {
+		case r >= 'a' && r <= 'z':
+			builder.WriteRune(r)
+			lastDash = false
+		case r >= '0' && r <= '9':
+			builder.WriteRune(r)
+			lastDash = false
+		case r == '-' || r == '_' || r == ' ':
+			if !lastDash {
+				builder.WriteRune('-')
+				lastDash = true
+			}
+		default:
+			// Skip other characters
+		}
+	}
+
+	result := strings.Trim(builder.String(), "-")
+	return result
+}
+
+// resolveListeners fills in the default local and peer listen addresses.
+// The local API stays on loopback unless --listen says otherwise; an empty
+// peer address means the peer listener is disabled.
+func resolveListeners(local, peer string, httpPort int) (string, string) {
+	if local == "" {
+		local = fmt.Sprintf("127.0.0.1:%d", httpPort)
+	}
+	switch peer {
+	case "":
+		peer = fmt.Sprintf(":%d", httpPort+1)
+	case "none":
+		peer = ""
+	}
+	return local, peer
+}
+
+// syncListener returns the address of the sync-only listener on port, or
+// "" if port is 0. Sync sockets serve both the local editor and peers, so
+// it binds the peer listener's host, or the local one when peers are shut
+// out.
+func syncListener(port int, local, peer string) (string, error) {
+	switch {
+	case port == 0:
+		return "", nil
+	case port < 0 || port > 65535:
+		return "", fmt.Errorf("port %d out of range", port)
+	case port == listenPort(local) || (peer != "" && port == listenPort(peer)):
+		return "", fmt.Errorf("port %d is already used by an API listener", port)
+	}
+	bind := peer
+	if bind == "" {
+		bind = local
+	}
+	host, _, _ := net.SplitHostPort(bind)
+	return net.JoinHostPort(host, strconv.Itoa(port)), nil
+}
+
+// ShiftPorts moves every listener with a fixed port up by offset, keeping
+// their spacing, for -port-auto
+func (c *Config) ShiftPorts(offset int) {
+	c.HTTPPort += offset
+	c.Listen = shiftPort(c.Listen, offset)
+	c.PeerListen = shiftPort(c.PeerListen, offset)
+	c.SyncListen = shiftPort(c.SyncListen, offset)
+}
+
+// shiftPort adds offset to the port of a listen address; empty addresses
+// and port 0, which the system picks, are left alone
+func shiftPort(addr string, offset int) string {
+	port := listenPort(addr)
+	if port == 0 {
+		return addr
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	return net.JoinHostPort(host, strconv.Itoa(port+offset))
+}
+
+// listenPort returns the port of a host:port listen address
+func listenPort(addr string) int {
+	_, port, _ := net.SplitHostPort(addr)
+	n, _ := strconv.Atoi(port)
+	return n
+}
+
+// defaultStateDir returns ~/.zeropr, falling back to a relative directory
+func defaultStateDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".zeropr"
+	}
+	return filepath.Join(home, ".zeropr")
+}
+
+// parseOverrides parses component=N pairs for per-component log limits
+func parseOverrides(value string) (map[string]int, error) {
+	overrides := make(map[string]int)
+	for _, item := range splitList(value) {
+		name, limit, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("expected component=N, got %q", item)
+		}
+		n, err := strconv.Atoi(limit)
+		if err != nil {
+			return nil, fmt.Errorf("invalid limit for %s: %w", name, err)
+		}
+		overrides[strings.TrimSpace(name)] = n
+	}
+	return overrides, nil
+}
+
+// splitList parses a comma-separated value, dropping empty items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// repeatable marks flags set once per item rather than from a joined list
+type repeatable interface {
+	repeatable()
+}
+
+func setAll(value flag.Value, items []string) error {
+	for _, item := range items {
+		if err := value.Set(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rootList collects repeated -root flags
+type rootList []workspace.Root
+
+func (l *rootList) repeatable() {}
+
+func (l *rootList) String() string {
+	parts := make([]string, 0, len(*l))
+	for _, root := range *l {
+		parts = append(parts, root.Name+"="+root.Path)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (l *rootList) Set(value string) error {
+	root, err := workspace.ParseRoot(value)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, root)
+	return nil
+}
@@ -0,0 +1,65 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSanitizeHostname(t *testing.T) {
+	for host, want := range map[string]string{
+		"Zoë-MBP":          "zo-mbp",
+		"build box_2":      "build-box-2",
+		"🚀-rocket":         "rocket",
+		"山田のMac":           "mac",
+		"李华":               "",
+		"--Alice--Laptop-": "alice-laptop",
+	} {
+		if got := sanitizeHostname(host); got != want {
+			t.Errorf("sanitizeHostname(%q) = %q, want %q", host, got, want)
+		}
+	}
+}
+
+func TestDisplayName(t *testing.T) {
+	tests := []struct {
+		display, want string
+		ok            bool
+	}{
+		{"Zoë's MBP", "Zoë's MBP", true},
+		{"Zoe\u0308's MBP", "Zoe\u0308's MBP", true}, // the accent as a combining mark
+		{"🚀 rocket", "🚀 rocket", true},
+		{"山田のMac", "山田のMac", true},
+		{"李华的电脑", "李华的电脑", true},
+		{"  Zoë  \u200b ", "Zoë", true}, // zero-width space
+		{"аlice", "", false},            // Cyrillic а among Latin
+		{"\u200b", "", false},
+		{strings.Repeat("山", maxDisplayName), "", false},
+	}
+	for _, tt := range tests {
+		got, err := resolveDisplayName(tt.display, "zoe-mbp")
+		if (err == nil) != tt.ok || (tt.ok && got != tt.want) {
+			t.Errorf("resolveDisplayName(%q) = %q, %v", tt.display, got, err)
+		}
+	}
+	// A custom -name is shown as written, so needs no display name
+	if got, _ := resolveDisplayName("", "my-box"); got != "" {
+		t.Errorf("display name %q beside a custom name", got)
+	}
+}
+
+func TestDisplayNameFlag(t *testing.T) {
+	load := func(args ...string) (*Config, error) {
+		return Load(append([]string{"-state-dir", t.TempDir()}, args...), func(string) (string, bool) { return "", false })
+	}
+	cfg, err := load("-name", "zoe-mbp", "-display-name", "Zoë's MBP")
+	if err != nil || cfg.DeviceName != "zoe-mbp" || cfg.DisplayName != "Zoë's MBP" {
+		t.Fatalf("loaded %q, %q, %v", cfg.DeviceName, cfg.DisplayName, err)
+	}
+	// The same as the device name is nothing to advertise
+	if cfg, _ := load("-name", "zoe-mbp", "-display-name", "zoe-mbp"); cfg.DisplayName != "" {
+		t.Errorf("display name %q repeats the device name", cfg.DisplayName)
+	}
+	if _, err := load("-display-name", "аlice"); err == nil || !strings.Contains(err.Error(), "display-name") {
+		t.Errorf("a mixed-script display name: %v", err)
+	}
+}
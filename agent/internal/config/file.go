@@ -0,0 +1,99 @@
+package config
+
+import (
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// setting is one key read from the config file
+type setting struct {
+	key    string
+	values []string // one per list item; a scalar has one
+	line   int
+}
+
+// readFile reads the YAML config file at path into settings. Keys are flag
+// names; nested mappings join their keys with '-', so
+//
+//	log:
+//	  level: debug
+//
+// sets log-level.
+func readFile(path string) ([]setting, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%s:%d: expected a mapping of settings", path, root.Line)
+	}
+
+	var settings []setting
+	if err := flatten(path, "", root, make(map[string]int), &settings); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// flatten appends the settings in mapping m, prefixing keys with prefix.
+// seen maps each key to the line that set it, to catch duplicates.
+func flatten(path, prefix string, m *yaml.Node, seen map[string]int, settings *[]setting) error {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		k, v := m.Content[i], m.Content[i+1]
+		key := prefix + k.Value
+		if v.Kind == yaml.AliasNode {
+			v = v.Alias
+		}
+
+		if v.Kind == yaml.MappingNode {
+			if err := flatten(path, key+"-", v, seen, settings); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if line, ok := seen[key]; ok {
+			return fmt.Errorf("%s:%d: %s is already set on line %d", path, k.Line, key, line)
+		}
+		seen[key] = k.Line
+
+		s := setting{key: key, line: k.Line}
+		switch v.Kind {
+		case yaml.ScalarNode:
+			s.values = []string{scalar(v)}
+		case yaml.SequenceNode:
+			for _, item := range v.Content {
+				if item.Kind == yaml.AliasNode {
+					item = item.Alias
+				}
+				if item.Kind != yaml.ScalarNode {
+					return fmt.Errorf("%s:%d: %s: list items must be plain values", path, item.Line, key)
+				}
+				s.values = append(s.values, scalar(item))
+			}
+		default:
+			return fmt.Errorf("%s:%d: %s: unsupported value", path, v.Line, key)
+		}
+		*settings = append(*settings, s)
+	}
+	return nil
+}
+
+// scalar returns a scalar's text, with null read as empty
+func scalar(n *yaml.Node) string {
+	if n.Tag == "!!null" {
+		return ""
+	}
+	return n.Value
+}
@@ -0,0 +1,172 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// attestationContext separates certificate attestations from every other
+// signature an identity makes
+const attestationContext = "zeropr-cert-attestation-v2\n"
+
+// maxPinRotations bounds how many pin rotations a trust entry remembers
+const maxPinRotations = 16
+
+var (
+	// ErrBadAttestation is returned when an attestation isn't signed by the
+	// expected identity or isn't for the certificate the peer presented
+	ErrBadAttestation = errors.New("certificate attestation does not verify")
+	// ErrRetiredPin is returned when a peer presents a certificate, or a
+	// certificate for a key, it rotated away from before
+	ErrRetiredPin = errors.New("certificate was retired by an earlier rotation")
+)
+
+// CertPin identifies a certificate a peer is pinned to
+type CertPin struct {
+	Fingerprint string // of the DER certificate
+	SPKI        string // of its public key info; empty when not known
+}
+
+// AttestedCert is a certificate whose attestation verified
+type AttestedCert struct {
+	CertPin
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+// AttestCertificate signs the fingerprint and validity window of the DER
+// certificate an agent serves, vouching for exactly that certificate with
+// the identity key so peers that pinned an older certificate can move
+// their pin without the user stepping in
+func (id *Identity) AttestCertificate(der []byte) ([]byte, error) {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return id.Sign(attestationMessage(der, cert)), nil
+}
+
+// VerifyAttestation checks that signature is key's attestation of attested,
+// that attested is presented, the DER certificate a peer's TLS handshake
+// offered, and that it's valid now
+func VerifyAttestation(key ed25519.PublicKey, presented, attested, signature []byte) (*AttestedCert, error) {
+	if !bytes.Equal(attested, presented) {
+		return nil, ErrBadAttestation
+	}
+	cert, err := x509.ParseCertificate(attested)
+	if err != nil || !ed25519.Verify(key, attestationMessage(attested, cert), signature) {
+		return nil, ErrBadAttestation
+	}
+	if now := time.Now(); now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return nil, ErrBadAttestation
+	}
+	return &AttestedCert{
+		CertPin:   CertPin{Fingerprint: CertFingerprint(attested), SPKI: spkiFingerprint(cert)},
+		NotBefore: cert.NotBefore,
+		NotAfter:  cert.NotAfter,
+	}, nil
+}
+
+// attestationMessage is what an attestation signs: the whole certificate's
+// fingerprint, so another certificate for the same key can't borrow it, and
+// its validity window in Unix seconds
+func attestationMessage(der []byte, cert *x509.Certificate) []byte {
+	msg := []byte(attestationContext)
+	msg = append(msg, CertFingerprint(der)...)
+	msg = append(msg, '\n')
+	msg = strconv.AppendInt(msg, cert.NotBefore.Unix(), 10)
+	msg = append(msg, '\n')
+	msg = strconv.AppendInt(msg, cert.NotAfter.Unix(), 10)
+	return msg
+}
+
+// SPKIFingerprint returns the fingerprint of a DER certificate's public key
+// info
+func SPKIFingerprint(der []byte) (string, error) {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return "", err
+	}
+	return spkiFingerprint(cert), nil
+}
+
+func spkiFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:])
+}
+
+// CertMismatchError is returned when a peer's certificate isn't the one
+// pinned for it; it matches ErrCertMismatch
+type CertMismatchError struct {
+	Pinned    string
+	Presented []byte // DER
+}
+
+func (e *CertMismatchError) Error() string        { return ErrCertMismatch.Error() }
+func (e *CertMismatchError) Is(target error) bool { return target == ErrCertMismatch }
+
+// PinRotation records a peer's certificate pin moving to a certificate its
+// identity key attested
+type PinRotation struct {
+	From     string    `json:"from"` // retired certificate fingerprint
+	To       string    `json:"to"`
+	FromSPKI string    `json:"fromSpki,omitempty"` // empty when the old certificate wasn't seen
+	ToSPKI   string    `json:"toSpki,omitempty"`
+	At       time.Time `json:"at"`
+}
+
+// RecordPinRotation notes on the trusted entry for fingerprint that the
+// peer's pin moved from one certificate to another. When the new
+// certificate is for a different key, the old key is retired with the old
+// certificate. It fails with ErrRetiredPin for a certificate, or a key, the
+// peer rotated away from before, so an old certificate or key that leaked
+// can't be rotated back to.
+func (t *TrustStore) RecordPinRotation(fingerprint string, from, to CertPin) (*PinRotation, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entry, ok := t.entries[fingerprint]
+	if !ok || entry.State != StateTrusted {
+		return nil, ErrUnknownTrust
+	}
+	for _, spki := range entry.RetiredSPKIs {
+		if spki == to.SPKI {
+			return nil, ErrRetiredPin
+		}
+	}
+	for _, rotation := range entry.PinRotations {
+		if rotation.From == to.Fingerprint {
+			return nil, ErrRetiredPin
+		}
+		// The old certificate was rotated to before, so its key is known
+		if from.SPKI == "" && rotation.To == from.Fingerprint {
+			from.SPKI = rotation.ToSPKI
+		}
+	}
+
+	previousRotations, previousRetired := entry.PinRotations, entry.RetiredSPKIs
+	rotation := PinRotation{From: from.Fingerprint, To: to.Fingerprint, FromSPKI: from.SPKI, ToSPKI: to.SPKI, At: time.Now()}
+	entry.PinRotations = append(append([]PinRotation(nil), previousRotations...), rotation)
+	if len(entry.PinRotations) > maxPinRotations {
+		entry.PinRotations = entry.PinRotations[len(entry.PinRotations)-maxPinRotations:]
+	}
+	// A self-signed certificate renewed for the same identity key keeps
+	// its key in use
+	if from.SPKI != "" && from.SPKI != to.SPKI {
+		entry.RetiredSPKIs = append(append([]string(nil), previousRetired...), from.SPKI)
+		if len(entry.RetiredSPKIs) > maxPinRotations {
+			entry.RetiredSPKIs = entry.RetiredSPKIs[len(entry.RetiredSPKIs)-maxPinRotations:]
+		}
+	}
+	if err := t.saveLocked(fingerprint); err != nil {
+		entry.PinRotations, entry.RetiredSPKIs = previousRotations, previousRetired
+		return nil, err
+	}
+	return &rotation, nil
+}
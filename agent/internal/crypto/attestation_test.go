@@ -0,0 +1,232 @@
+package crypto
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/zeropr/agent/internal/storage"
+)
+
+// newKeyCert returns a self-signed certificate for a fresh key, as an agent
+// given its own certificate with -tls-cert serves, valid from notBefore
+// for a day
+func newKeyCert(t *testing.T, notBefore time.Time) []byte {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return selfSigned(t, pub, priv, notBefore)
+}
+
+func selfSigned(t *testing.T, pub ed25519.PublicKey, priv ed25519.PrivateKey, notBefore time.Time) []byte {
+	t.Helper()
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "zeropr-test"},
+		NotBefore:    notBefore,
+		NotAfter:     notBefore.Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, pub, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func pinOf(t *testing.T, der []byte) CertPin {
+	t.Helper()
+	spki, err := SPKIFingerprint(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return CertPin{Fingerprint: CertFingerprint(der), SPKI: spki}
+}
+
+// newTrustedPeer returns a trust store trusting peer's identity
+func newTrustedPeer(t *testing.T, peer *Identity) *TrustStore {
+	t.Helper()
+	dir := t.TempDir()
+	db, err := storage.Open(storage.BackendFiles, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	trust, err := OpenTrustStore(dir, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := trust.Trust(peer.PublicKey, "peer", Provenance{Method: ProvenanceUnknown}); err != nil {
+		t.Fatal(err)
+	}
+	return trust
+}
+
+func TestLegitimateRotation(t *testing.T) {
+	peer := newTestIdentity(t)
+	trust := newTrustedPeer(t, peer)
+	old, err := peer.createCert(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The peer reinstalls and renews its certificate for the same key
+	renewed, err := peer.createCert(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := peer.AttestCertificate(renewed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attested, err := VerifyAttestation(peer.PublicKey, renewed, renewed, signature)
+	if err != nil {
+		t.Fatalf("VerifyAttestation: %v", err)
+	}
+	if attested.Fingerprint != CertFingerprint(renewed) {
+		t.Errorf("attested fingerprint %s, want %s", attested.Fingerprint, CertFingerprint(renewed))
+	}
+
+	rotation, err := trust.RecordPinRotation(peer.Fingerprint(), pinOf(t, old), attested.CertPin)
+	if err != nil {
+		t.Fatalf("RecordPinRotation: %v", err)
+	}
+	if rotation.From != CertFingerprint(old) || rotation.To != attested.Fingerprint {
+		t.Errorf("rotation = %+v", rotation)
+	}
+	// The identity key is still in use, so it isn't retired
+	entry := trust.List()[0]
+	if len(entry.RetiredSPKIs) != 0 {
+		t.Errorf("RetiredSPKIs = %v after a renewal for the same key", entry.RetiredSPKIs)
+	}
+
+	// ... and it can renew again
+	again, _ := peer.createCert(nil)
+	if _, err := trust.RecordPinRotation(peer.Fingerprint(), attested.CertPin, pinOf(t, again)); err != nil {
+		t.Errorf("second renewal: %v", err)
+	}
+}
+
+func TestAttackerWithoutIdentityKey(t *testing.T) {
+	peer := newTestIdentity(t)
+	attacker := newTestIdentity(t)
+	genuine, _ := peer.createCert(nil)
+	genuineSig, _ := peer.AttestCertificate(genuine)
+
+	forged, _ := attacker.createCert(nil)
+	forgedSig, _ := attacker.AttestCertificate(forged)
+
+	// A certificate for the peer's key, which the attacker can't use in a
+	// handshake, but mints to borrow the peer's attestation
+	sameKey := selfSigned(t, peer.PublicKey, peer.privateKey, time.Now().Add(-time.Minute))
+
+	tests := []struct {
+		name                string
+		presented, attested []byte
+		signature           []byte
+	}{
+		{"own key signs own certificate", forged, forged, forgedSig},
+		{"genuine attestation for another certificate", forged, genuine, genuineSig},
+		{"genuine signature over another certificate", forged, forged, genuineSig},
+		{"genuine signature for another certificate of the same key", sameKey, sameKey, genuineSig},
+		{"garbage signature", forged, forged, make([]byte, ed25519.SignatureSize)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := VerifyAttestation(peer.PublicKey, tt.presented, tt.attested, tt.signature); !errors.Is(err, ErrBadAttestation) {
+				t.Errorf("VerifyAttestation = %v, want ErrBadAttestation", err)
+			}
+		})
+	}
+}
+
+func TestAttestationOutsideValidity(t *testing.T) {
+	peer := newTestIdentity(t)
+	expired := selfSigned(t, peer.PublicKey, peer.privateKey, time.Now().Add(-48*time.Hour))
+	signature, _ := peer.AttestCertificate(expired)
+	if _, err := VerifyAttestation(peer.PublicKey, expired, expired, signature); !errors.Is(err, ErrBadAttestation) {
+		t.Errorf("VerifyAttestation(expired) = %v, want ErrBadAttestation", err)
+	}
+}
+
+// TestAttackerWithStolenOldCert has a peer serving certificates it was
+// given rotate away from one whose private key leaked. The attacker holds
+// the old certificate, its key, and the attestation the peer served for it.
+func TestAttackerWithStolenOldCert(t *testing.T) {
+	peer := newTestIdentity(t)
+	trust := newTrustedPeer(t, peer)
+	start := time.Now().Add(-time.Minute)
+
+	stolen := newKeyCert(t, start)
+	stolenSig, _ := peer.AttestCertificate(stolen)
+	current := newKeyCert(t, start)
+	currentSig, _ := peer.AttestCertificate(current)
+
+	attested, err := VerifyAttestation(peer.PublicKey, current, current, currentSig)
+	if err != nil {
+		t.Fatalf("VerifyAttestation(current): %v", err)
+	}
+	if _, err := trust.RecordPinRotation(peer.Fingerprint(), pinOf(t, stolen), attested.CertPin); err != nil {
+		t.Fatalf("rotating away from the leaked certificate: %v", err)
+	}
+
+	// The old attestation still verifies on its own...
+	replayed, err := VerifyAttestation(peer.PublicKey, stolen, stolen, stolenSig)
+	if err != nil {
+		t.Fatalf("VerifyAttestation(stolen): %v", err)
+	}
+	// ...but the certificate was retired
+	if _, err := trust.RecordPinRotation(peer.Fingerprint(), attested.CertPin, replayed.CertPin); !errors.Is(err, ErrRetiredPin) {
+		t.Errorf("rotating back to the stolen certificate = %v, want ErrRetiredPin", err)
+	}
+
+	// A fresh certificate for the leaked key can't carry the old attestation
+	spki, _ := SPKIFingerprint(stolen)
+	reminted := pinOf(t, stolen)
+	reminted.Fingerprint = "a fresh certificate for the same key"
+	if _, err := trust.RecordPinRotation(peer.Fingerprint(), attested.CertPin, reminted); !errors.Is(err, ErrRetiredPin) {
+		t.Errorf("rotating to the retired key = %v, want ErrRetiredPin", err)
+	}
+	if entry := trust.List()[0]; len(entry.RetiredSPKIs) != 1 || entry.RetiredSPKIs[0] != spki {
+		t.Errorf("RetiredSPKIs = %v, want [%s]", entry.RetiredSPKIs, spki)
+	}
+}
+
+// TestRetiredKeyLearnedFromRotation rotates away from a certificate whose
+// key the client never saw but an earlier rotation recorded
+func TestRetiredKeyLearnedFromRotation(t *testing.T) {
+	peer := newTestIdentity(t)
+	trust := newTrustedPeer(t, peer)
+	start := time.Now().Add(-time.Minute)
+	first, second, third := newKeyCert(t, start), newKeyCert(t, start), newKeyCert(t, start)
+
+	if _, err := trust.RecordPinRotation(peer.Fingerprint(), CertPin{Fingerprint: CertFingerprint(first)}, pinOf(t, second)); err != nil {
+		t.Fatal(err)
+	}
+	if entry := trust.List()[0]; len(entry.RetiredSPKIs) != 0 {
+		t.Errorf("retired %v without knowing the old key", entry.RetiredSPKIs)
+	}
+	if _, err := trust.RecordPinRotation(peer.Fingerprint(), CertPin{Fingerprint: CertFingerprint(second)}, pinOf(t, third)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := trust.RecordPinRotation(peer.Fingerprint(), pinOf(t, third), pinOf(t, second)); !errors.Is(err, ErrRetiredPin) {
+		t.Errorf("rotating back to the second key = %v, want ErrRetiredPin", err)
+	}
+}
+
+func TestRotationNeedsTrustedPeer(t *testing.T) {
+	peer := newTestIdentity(t)
+	trust := newTrustedPeer(t, peer)
+	stranger := newTestIdentity(t)
+	cert, _ := stranger.createCert(nil)
+	if _, err := trust.RecordPinRotation(stranger.Fingerprint(), CertPin{Fingerprint: "old"}, pinOf(t, cert)); !errors.Is(err, ErrUnknownTrust) {
+		t.Errorf("RecordPinRotation(untrusted) = %v, want ErrUnknownTrust", err)
+	}
+}
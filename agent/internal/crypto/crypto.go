@@ -1,11 +0,0 @@
-package crypto
-
-// Package crypto handles encryption and authentication for ZeroPR
-// TODO: Implement in Phase 4 (Security + Trust)
-
-// This will include:
-// - Ed25519 keypair generation
-// - Pairing/verification codes
-// - Encrypted communication (NaCl/Noise protocol)
-// - Trust store management
-
@@ -0,0 +1,115 @@
+// Package crypto handles identity, request signing, and trust for ZeroPR.
+//
+// Each agent has a long-lived Ed25519 keypair. Agent-to-agent requests are
+// signed with it, and the trust store records which peers' keys the user
+// has chosen to trust.
+package crypto
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+const identityFile = "identity.key"
+
+// Identity is this agent's signing keypair
+type Identity struct {
+	PublicKey  ed25519.PublicKey
+	privateKey ed25519.PrivateKey
+}
+
+// LoadOrCreateIdentity reads the identity seed from dir, generating and
+// persisting a new keypair (mode 0600) on first run
+func LoadOrCreateIdentity(dir string) (*Identity, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create state dir: %w", err)
+	}
+	path := filepath.Join(dir, identityFile)
+
+	seed, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("%s is corrupt: expected %d bytes", path, ed25519.SeedSize)
+		}
+	case os.IsNotExist(err):
+		seed = make([]byte, ed25519.SeedSize)
+		if _, err := rand.Read(seed); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, seed, 0o600); err != nil {
+			return nil, fmt.Errorf("failed to write identity: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("failed to read identity: %w", err)
+	}
+
+	private := ed25519.NewKeyFromSeed(seed)
+	return &Identity{
+		PublicKey:  private.Public().(ed25519.PublicKey),
+		privateKey: private,
+	}, nil
+}
+
+// Sign signs message with the identity's private key
+func (id *Identity) Sign(message []byte) []byte {
+	return ed25519.Sign(id.privateKey, message)
+}
+
+// Fingerprint returns the identity's fingerprint
+func (id *Identity) Fingerprint() string {
+	return Fingerprint(id.PublicKey)
+}
+
+// String names the identity by its fingerprint, so printing one never
+// prints its private key
+func (id *Identity) String() string {
+	return "identity " + id.Fingerprint()
+}
+
+// GoString keeps the private key out of %#v
+func (id *Identity) GoString() string {
+	return id.String()
+}
+
+// LogValue keeps the private key out of logs
+func (id *Identity) LogValue() slog.Value {
+	return slog.StringValue(id.Fingerprint())
+}
+
+// EncodedPublicKey returns the public key in the form advertised to peers
+func (id *Identity) EncodedPublicKey() string {
+	return EncodeKey(id.PublicKey)
+}
+
+// Fingerprint is the hex SHA-256 of a public key
+func Fingerprint(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:])
+}
+
+// EncodeKey renders a public key as unpadded URL-safe base64, compact
+// enough for an mDNS TXT field
+func EncodeKey(key ed25519.PublicKey) string {
+	return base64.RawURLEncoding.EncodeToString(key)
+}
+
+// DecodeKey parses a key produced by EncodeKey
+func DecodeKey(encoded string) (ed25519.PublicKey, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid public key length")
+	}
+	return ed25519.PublicKey(raw), nil
+}
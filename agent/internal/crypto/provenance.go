@@ -0,0 +1,201 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Ways a trust entry can come about
+const (
+	ProvenanceUnknown     = "unknown"              // stored before provenance was recorded
+	ProvenanceTOFU        = "tofu"                 // accepted on first use without verification
+	ProvenancePairingCode = "pairing-code"         // both users compared a pairing code
+	ProvenanceManifest    = "manifest"             // listed in the team manifest
+	ProvenanceGuestPass   = "guest-pass-promotion" // a guest pass holder was promoted
+	ProvenanceImport      = "import"               // copied from another agent's export
+)
+
+var (
+	// ErrStepUpRequired is returned when a capability needs a verified
+	// peer and the entry was only accepted on first use
+	ErrStepUpRequired = errors.New("capability requires a peer verified with a pairing code")
+	// ErrPairingCode is returned when a pairing code doesn't match
+	ErrPairingCode = errors.New("pairing code does not match")
+)
+
+// Provenance records how and by whom a trust entry was granted
+type Provenance struct {
+	Method    string      `json:"method"`
+	At        time.Time   `json:"at"`
+	Actor     string      `json:"actor,omitempty"`     // local user@device that granted it
+	Artifacts []string    `json:"artifacts,omitempty"` // fingerprints of what was verified
+	Previous  *Provenance `json:"previous,omitempty"`  // what this superseded, e.g. before a step-up or import
+}
+
+// Verified reports whether the method involved checking the key out of
+// band, rather than accepting whatever was presented
+func (p *Provenance) Verified() bool {
+	if p == nil {
+		return false
+	}
+	switch p.Method {
+	case ProvenancePairingCode, ProvenanceManifest:
+		return true
+	}
+	return false
+}
+
+// CapabilityFiles covers the file endpoints peers call
+const CapabilityFiles = "files"
+
+// Capabilities lists what a Policy can reserve for verified peers
+var Capabilities = []string{CapabilityFiles}
+
+// Policy names capabilities only verified peers may use
+type Policy struct {
+	VerifiedOnly map[string]bool
+}
+
+// NewPolicy reserves the named capabilities for peers whose trust was
+// verified with a pairing code or the team manifest
+func NewPolicy(names []string) (Policy, error) {
+	verified := make(map[string]bool, len(names))
+	for _, name := range names {
+		known := false
+		for _, c := range Capabilities {
+			known = known || c == name
+		}
+		if !known {
+			return Policy{}, fmt.Errorf("unknown capability %q (known: %v)", name, Capabilities)
+		}
+		verified[name] = true
+	}
+	return Policy{VerifiedOnly: verified}, nil
+}
+
+// Allow decides whether a trusted peer whose entry has provenance may use capability
+func (p Policy) Allow(provenance *Provenance, capability string) error {
+	if !p.VerifiedOnly[capability] || provenance.Verified() {
+		return nil
+	}
+	return ErrStepUpRequired
+}
+
+// PairingCode derives the six-digit code both users compare to verify
+// each other's keys. It's the same whichever side computes it.
+func PairingCode(a, b ed25519.PublicKey) string {
+	if bytes.Compare(a, b) > 0 {
+		a, b = b, a
+	}
+	h := sha256.New()
+	h.Write([]byte("zeropr-pairing-v1"))
+	h.Write(a)
+	h.Write(b)
+	sum := h.Sum(nil)
+	return fmt.Sprintf("%06d", binary.BigEndian.Uint32(sum[:4])%1000000)
+}
+
+// CheckPairingCode compares a code the user typed, ignoring spacing
+func CheckPairingCode(typed string, a, b ed25519.PublicKey) bool {
+	typed = strings.NewReplacer(" ", "", "-", "").Replace(typed)
+	return subtle.ConstantTimeCompare([]byte(typed), []byte(PairingCode(a, b))) == 1
+}
+
+// SetActor names the local user and device recorded on new provenance
+func (t *TrustStore) SetActor(actor string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.actor = actor
+}
+
+// Get returns a copy of the entry for a fingerprint
+func (t *TrustStore) Get(fingerprint string) (*TrustEntry, bool) {
+	if t == nil {
+		return nil, false
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	entry, ok := t.entries[fingerprint]
+	if !ok {
+		return nil, false
+	}
+	cp := *entry
+	return &cp, true
+}
+
+// StepUp records a fresh verification of a trusted entry, keeping the
+// provenance it replaces. Quarantined entries must be resolved first.
+func (t *TrustStore) StepUp(fingerprint, method string, artifacts []string) (*TrustEntry, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entry, ok := t.entries[fingerprint]
+	if !ok || entry.State != StateTrusted {
+		return nil, ErrUnknownTrust
+	}
+
+	previous := entry.Provenance
+	entry.Provenance = &Provenance{
+		Method:    method,
+		At:        time.Now(),
+		Actor:     t.actor,
+		Artifacts: artifacts,
+		Previous:  previous,
+	}
+	if err := t.saveLocked(fingerprint); err != nil {
+		entry.Provenance = previous
+		return nil, err
+	}
+	cp := *entry
+	return &cp, nil
+}
+
+// Import adds entries exported by another agent. Each keeps its original
+// provenance as Previous under a new import record; entries already
+// present are left alone. It returns how many were added.
+func (t *TrustStore) Import(entries []TrustEntry) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	var added []string
+	for _, e := range entries {
+		key, err := DecodeKey(e.PublicKey)
+		if err != nil || Fingerprint(key) != e.Fingerprint {
+			return 0, fmt.Errorf("entry %q has an invalid key", e.Name)
+		}
+		if _, exists := t.entries[e.Fingerprint]; exists || (e.State != "" && e.State != StateTrusted) {
+			continue
+		}
+
+		imported := e
+		imported.AddedAt = now
+		imported.State = StateTrusted
+		imported.Provenance = &Provenance{
+			Method:    ProvenanceImport,
+			At:        now,
+			Actor:     t.actor,
+			Artifacts: []string{e.Fingerprint},
+			Previous:  e.Provenance,
+		}
+		t.entries[e.Fingerprint] = &imported
+		added = append(added, e.Fingerprint)
+	}
+
+	if err := t.saveLocked(added...); err != nil {
+		for _, fp := range added {
+			delete(t.entries, fp)
+		}
+		return 0, err
+	}
+	return len(added), nil
+}
@@ -0,0 +1,116 @@
+package crypto
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/zeropr/agent/internal/storage"
+)
+
+// openTrust opens a trust store in dir, on the files backend
+func openTrust(t *testing.T, dir string) *TrustStore {
+	t.Helper()
+	db, err := storage.Open(storage.BackendFiles, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	trust, err := OpenTrustStore(dir, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return trust
+}
+
+func TestProvenanceRecorded(t *testing.T) {
+	dir := t.TempDir()
+	trust := openTrust(t, dir)
+	trust.SetActor("alice@laptop")
+	bob := newTestIdentity(t)
+	if _, err := trust.Trust(bob.PublicKey, "bob", Provenance{Method: ProvenanceTOFU}); err != nil {
+		t.Fatal(err)
+	}
+	entry, _ := trust.Get(bob.Fingerprint())
+	if p := entry.Provenance; p.Method != ProvenanceTOFU || p.Actor != "alice@laptop" || p.At.IsZero() || p.Verified() {
+		t.Fatalf("provenance %+v", p)
+	}
+
+	// Stepping up keeps what it replaced, and survives a restart
+	code := []string{bob.Fingerprint()}
+	if _, err := trust.StepUp(bob.Fingerprint(), ProvenancePairingCode, code); err != nil {
+		t.Fatal(err)
+	}
+	entry, _ = openTrust(t, dir).Get(bob.Fingerprint())
+	p := entry.Provenance
+	if p.Method != ProvenancePairingCode || !p.Verified() || len(p.Artifacts) != 1 || p.Previous == nil || p.Previous.Method != ProvenanceTOFU {
+		t.Errorf("provenance after a step-up and restart %+v", p)
+	}
+}
+
+func TestImportKeepsOriginalProvenance(t *testing.T) {
+	source := openTrust(t, t.TempDir())
+	bob := newTestIdentity(t)
+	if _, err := source.Trust(bob.PublicKey, "bob", Provenance{Method: ProvenanceManifest, Actor: "carol@desk"}); err != nil {
+		t.Fatal(err)
+	}
+
+	trust := openTrust(t, t.TempDir())
+	trust.SetActor("alice@laptop")
+	if n, err := trust.Import(source.List()); err != nil || n != 1 {
+		t.Fatalf("imported %d, %v", n, err)
+	}
+	entry, _ := trust.Get(bob.Fingerprint())
+	p := entry.Provenance
+	if p.Method != ProvenanceImport || p.Actor != "alice@laptop" || p.Previous == nil || p.Previous.Method != ProvenanceManifest || p.Previous.Actor != "carol@desk" {
+		t.Errorf("imported provenance %+v", p)
+	}
+	// An import vouches for nothing itself
+	if p.Verified() {
+		t.Error("an imported entry counts as verified")
+	}
+
+	// Entries already present are left alone
+	if n, _ := trust.Import(source.List()); n != 0 {
+		t.Errorf("imported %d entries already present", n)
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	if _, err := NewPolicy([]string{"teleport"}); err == nil {
+		t.Error("an unknown capability was accepted")
+	}
+	policy, err := NewPolicy([]string{CapabilityFiles})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, method := range []string{ProvenanceTOFU, ProvenanceImport, ProvenanceUnknown} {
+		if err := policy.Allow(&Provenance{Method: method}, CapabilityFiles); !errors.Is(err, ErrStepUpRequired) {
+			t.Errorf("%s trust was allowed files: %v", method, err)
+		}
+	}
+	for _, method := range []string{ProvenancePairingCode, ProvenanceManifest} {
+		if err := policy.Allow(&Provenance{Method: method}, CapabilityFiles); err != nil {
+			t.Errorf("%s trust was refused files: %v", method, err)
+		}
+	}
+	if err := (Policy{}).Allow(nil, CapabilityFiles); err != nil {
+		t.Errorf("files needed verification without a policy: %v", err)
+	}
+}
+
+func TestPairingCode(t *testing.T) {
+	alice, bob := newTestIdentity(t), newTestIdentity(t)
+	code := PairingCode(alice.PublicKey, bob.PublicKey)
+	if len(code) != 6 || code != PairingCode(bob.PublicKey, alice.PublicKey) {
+		t.Fatalf("codes %s and %s", code, PairingCode(bob.PublicKey, alice.PublicKey))
+	}
+	if !CheckPairingCode(code[:3]+" "+code[3:], alice.PublicKey, bob.PublicKey) {
+		t.Error("a spaced code didn't match")
+	}
+	n, _ := strconv.Atoi(code)
+	if wrong := fmt.Sprintf("%06d", (n+1)%1000000); CheckPairingCode(wrong, alice.PublicKey, bob.PublicKey) {
+		t.Errorf("the wrong code %s matched %s", wrong, code)
+	}
+}
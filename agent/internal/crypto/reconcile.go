@@ -0,0 +1,122 @@
+package crypto
+
+import (
+	"fmt"
+	"time"
+)
+
+// Claim is a key a live peer currently presents under a name
+type Claim struct {
+	Name        string
+	Fingerprint string
+}
+
+// ReconcileSummary counts the outcome of a reconciliation pass
+type ReconcileSummary struct {
+	Checked     int      `json:"checked"`
+	Conflicts   int      `json:"conflicts"`   // newly quarantined this pass
+	Quarantined int      `json:"quarantined"` // total awaiting a decision
+	Flagged     []string `json:"flagged"`     // fingerprints quarantined this pass
+}
+
+// Reconcile compares trusted entries against what live peers claim and the
+// fingerprints the team manifest revokes. Conflicting entries move to
+// StateQuarantined; nothing is ever resolved automatically, in particular
+// a peer's new key is never trusted just because the network presents it.
+func (t *TrustStore) Reconcile(claims []Claim, revoked map[string]bool) (ReconcileSummary, error) {
+	byName := make(map[string][]string)
+	for _, claim := range claims {
+		byName[claim.Name] = append(byName[claim.Name], claim.Fingerprint)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	summary := ReconcileSummary{Flagged: []string{}}
+	now := time.Now()
+	for _, entry := range t.entries {
+		summary.Checked++
+		if entry.State == StateQuarantined || entry.Name == "" {
+			continue
+		}
+
+		conflict, other := "", ""
+		if revoked[entry.Fingerprint] {
+			conflict = ConflictRevoked
+		} else if other = changedKey(entry.Fingerprint, byName[entry.Name]); other != "" {
+			conflict = ConflictKeyChanged
+		}
+		if conflict == "" {
+			continue
+		}
+
+		entry.State = StateQuarantined
+		entry.Conflict = conflict
+		entry.ConflictKey = other
+		entry.QuarantinedAt = &now
+		summary.Conflicts++
+		summary.Flagged = append(summary.Flagged, entry.Fingerprint)
+	}
+
+	for _, entry := range t.entries {
+		if entry.State == StateQuarantined {
+			summary.Quarantined++
+		}
+	}
+
+	if summary.Conflicts > 0 {
+		if err := t.saveLocked(summary.Flagged...); err != nil {
+			return summary, err
+		}
+	}
+	return summary, nil
+}
+
+// changedKey returns a fingerprint claimed under the entry's name that
+// differs from the stored one, unless the stored key is also still claimed
+func changedKey(stored string, claimed []string) string {
+	other := ""
+	for _, fp := range claimed {
+		if fp == stored {
+			return ""
+		}
+		other = fp
+	}
+	return other
+}
+
+// Resolve applies the user's decision for a quarantined entry: keep
+// restores it to trusted, revoke removes it
+func (t *TrustStore) Resolve(fingerprint string, keep bool) (*TrustEntry, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entry, ok := t.entries[fingerprint]
+	if !ok {
+		return nil, ErrUnknownTrust
+	}
+	if entry.State != StateQuarantined {
+		return nil, fmt.Errorf("entry %s is not quarantined", fingerprint)
+	}
+
+	if !keep {
+		delete(t.entries, fingerprint)
+		if err := t.saveLocked(fingerprint); err != nil {
+			t.entries[fingerprint] = entry
+			return nil, err
+		}
+		return nil, nil
+	}
+
+	previous := *entry
+	entry.State = StateTrusted
+	entry.Conflict = ""
+	entry.ConflictKey = ""
+	entry.QuarantinedAt = nil
+	if err := t.saveLocked(fingerprint); err != nil {
+		*entry = previous
+		return nil, err
+	}
+	cp := *entry
+	return &cp, nil
+}
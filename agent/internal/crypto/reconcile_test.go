@@ -0,0 +1,90 @@
+package crypto
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/zeropr/agent/internal/storage"
+)
+
+func TestReconcileAfterRestore(t *testing.T) {
+	dir := t.TempDir()
+	db, err := storage.Open(storage.BackendFiles, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	trust, err := OpenTrustStore(dir, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The trust a backup restored: alice has since reinstalled, bob is
+	// mid-way through moving to a new key, and carol was revoked by the team
+	alice, bob, carol, dave := newTestIdentity(t), newTestIdentity(t), newTestIdentity(t), newTestIdentity(t)
+	for name, id := range map[string]*Identity{"alice": alice, "bob": bob, "carol": carol, "dave": dave} {
+		if _, err := trust.Trust(id.PublicKey, name, Provenance{Method: ProvenancePairingCode}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	aliceNow, bobNext := newTestIdentity(t), newTestIdentity(t)
+	claims := []Claim{
+		{Name: "alice", Fingerprint: aliceNow.Fingerprint()},
+		{Name: "bob", Fingerprint: bob.Fingerprint()},
+		{Name: "bob", Fingerprint: bobNext.Fingerprint()},
+	}
+	revoked := map[string]bool{carol.Fingerprint(): true}
+
+	summary, err := trust.Reconcile(claims, revoked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(summary.Flagged)
+	want := []string{alice.Fingerprint(), carol.Fingerprint()}
+	sort.Strings(want)
+	if summary.Checked != 4 || summary.Conflicts != 2 || summary.Quarantined != 2 || !reflect.DeepEqual(summary.Flagged, want) {
+		t.Fatalf("summary %+v", summary)
+	}
+	entry, _ := trust.Get(alice.Fingerprint())
+	if entry.State != StateQuarantined || entry.Conflict != ConflictKeyChanged || entry.ConflictKey != aliceNow.Fingerprint() {
+		t.Errorf("alice's entry %+v", entry)
+	}
+	if entry, _ := trust.Get(carol.Fingerprint()); entry.Conflict != ConflictRevoked {
+		t.Errorf("carol's entry %+v", entry)
+	}
+	// Quarantined keys are denied, the new key isn't trusted for showing
+	// up, and dave, whom nobody claimed, is left alone
+	if trust.IsTrusted(alice.PublicKey) || trust.IsTrusted(carol.PublicKey) || trust.IsTrusted(aliceNow.PublicKey) {
+		t.Error("a quarantined or claimed key is trusted")
+	}
+	if !trust.IsTrusted(bob.PublicKey) || !trust.IsTrusted(dave.PublicKey) {
+		t.Error("an entry without a conflict lost its trust")
+	}
+
+	// Another pass flags nothing new, and the quarantine survives a restart
+	if summary, _ := trust.Reconcile(claims, revoked); summary.Conflicts != 0 || summary.Quarantined != 2 {
+		t.Errorf("second pass %+v", summary)
+	}
+	reopened, err := OpenTrustStore(dir, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry, _ := reopened.Get(alice.Fingerprint()); entry.State != StateQuarantined {
+		t.Errorf("alice's entry after a restart %+v", entry)
+	}
+
+	// Only the user resolves it
+	if entry, err := reopened.Resolve(alice.Fingerprint(), true); err != nil || entry.State != StateTrusted || entry.Conflict != "" {
+		t.Errorf("keeping alice: %+v, %v", entry, err)
+	}
+	if _, err := reopened.Resolve(carol.Fingerprint(), false); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reopened.Get(carol.Fingerprint()); ok {
+		t.Error("a revoked entry was kept")
+	}
+	if _, err := reopened.Resolve(dave.Fingerprint(), true); err == nil {
+		t.Error("resolved an entry that wasn't quarantined")
+	}
+}
@@ -0,0 +1,190 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Headers carrying a signed agent-to-agent request
+const (
+	HeaderKey       = "X-ZeroPR-Key"
+	HeaderTimestamp = "X-ZeroPR-Timestamp"
+	HeaderNonce     = "X-ZeroPR-Nonce"
+	HeaderSignature = "X-ZeroPR-Signature"
+)
+
+// SignatureWindow is how far a request timestamp may drift from our clock
+const SignatureWindow = 2 * time.Minute
+
+// maxSignedBody bounds how much of a request body is buffered for verification
+const maxSignedBody = 10 << 20
+
+// nonceSize is how many random bytes SignRequest puts in each nonce;
+// Verify accepts nonces of 16 to 64 bytes so the size can change later
+const (
+	nonceSize    = 16
+	minNonceSize = 16
+	maxNonceSize = 64
+)
+
+var (
+	// ErrUnsigned is returned when a request carries no signature headers
+	ErrUnsigned = errors.New("request is not signed")
+	// ErrBadSignature is returned when a signature doesn't verify
+	ErrBadSignature = errors.New("invalid request signature")
+	// ErrStaleRequest is returned for timestamps outside the window or replays
+	ErrStaleRequest = errors.New("request timestamp outside window or replayed")
+)
+
+// canonical builds the signed string: method, path with query, body hash,
+// timestamp, nonce
+func canonical(method, path string, body []byte, timestamp, nonce string) []byte {
+	sum := sha256.Sum256(body)
+	var buf bytes.Buffer
+	buf.WriteString(method)
+	buf.WriteByte('\n')
+	buf.WriteString(path)
+	buf.WriteByte('\n')
+	buf.WriteString(hex.EncodeToString(sum[:]))
+	buf.WriteByte('\n')
+	buf.WriteString(timestamp)
+	buf.WriteByte('\n')
+	buf.WriteString(nonce)
+	return buf.Bytes()
+}
+
+// newNonce returns a random nonce for one request
+func newNonce() string {
+	b := make([]byte, nonceSize)
+	if _, err := rand.Read(b); err != nil {
+		panic("crypto/rand failed: " + err.Error())
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// SignRequest adds identity headers and a signature over the request. Each
+// call picks a fresh nonce, so two identical requests in the same second
+// still sign differently and the receiver can tell a replay from a retry.
+func (id *Identity) SignRequest(req *http.Request, body []byte) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := newNonce()
+	signature := id.Sign(canonical(req.Method, req.URL.RequestURI(), body, timestamp, nonce))
+
+	req.Header.Set(HeaderKey, id.EncodedPublicKey())
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderNonce, nonce)
+	req.Header.Set(HeaderSignature, base64.StdEncoding.EncodeToString(signature))
+}
+
+// Verifier checks signed requests and rejects replays within the window.
+// Nonces are kept in buckets by request timestamp, SignatureWindow wide: a
+// replay carries the timestamp it was signed with, so it's looked for in one
+// bucket, and a bucket is dropped whole once every timestamp in it has left
+// the window.
+type Verifier struct {
+	seen map[int64]map[string]struct{} // timestamp bucket -> signer and nonce
+	mu   sync.Mutex
+}
+
+// NewVerifier creates a request verifier
+func NewVerifier() *Verifier {
+	return &Verifier{seen: make(map[int64]map[string]struct{})}
+}
+
+// Verify checks the signature headers on req, restoring its body for the
+// handler. It returns the caller's public key, or ErrUnsigned when the
+// request carries no signature at all.
+func (v *Verifier) Verify(req *http.Request) (ed25519.PublicKey, error) {
+	encodedKey := req.Header.Get(HeaderKey)
+	timestamp := req.Header.Get(HeaderTimestamp)
+	nonce := req.Header.Get(HeaderNonce)
+	encodedSig := req.Header.Get(HeaderSignature)
+	if encodedKey == "" && encodedSig == "" {
+		return nil, ErrUnsigned
+	}
+
+	key, err := DecodeKey(encodedKey)
+	if err != nil {
+		return nil, ErrBadSignature
+	}
+	signature, err := base64.StdEncoding.DecodeString(encodedSig)
+	if err != nil {
+		return nil, ErrBadSignature
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, ErrStaleRequest
+	}
+	now := time.Now()
+	if drift := now.Sub(time.Unix(unix, 0)); drift > SignatureWindow || drift < -SignatureWindow {
+		return nil, ErrStaleRequest
+	}
+	if raw, err := base64.RawURLEncoding.DecodeString(nonce); err != nil || len(raw) < minNonceSize || len(raw) > maxNonceSize {
+		return nil, ErrBadSignature
+	}
+
+	var body []byte
+	if req.Body != nil {
+		body, err = io.ReadAll(io.LimitReader(req.Body, maxSignedBody))
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	if !ed25519.Verify(key, canonical(req.Method, req.URL.RequestURI(), body, timestamp, nonce), signature) {
+		return nil, ErrBadSignature
+	}
+
+	// Nonces are scoped to their signer, so one peer can't burn another's
+	if !v.remember(encodedKey+" "+nonce, unix, now) {
+		return nil, ErrStaleRequest
+	}
+	return key, nil
+}
+
+// bucketOf returns the replay bucket a Unix timestamp falls in
+func bucketOf(unix int64) int64 {
+	return unix / int64(SignatureWindow/time.Second)
+}
+
+// remember records the nonce of a request signed at unix, returning false
+// if it was already seen. Buckets whose timestamps are all older than the
+// window are dropped first; there are never more than a few.
+func (v *Verifier) remember(nonce string, unix int64, now time.Time) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	// The newest timestamp in bucket b is accepted until the bucket after
+	// next begins
+	current := bucketOf(now.Unix())
+	for bucket := range v.seen {
+		if bucket < current-1 {
+			delete(v.seen, bucket)
+		}
+	}
+
+	bucket := bucketOf(unix)
+	nonces := v.seen[bucket]
+	if nonces == nil {
+		nonces = make(map[string]struct{})
+		v.seen[bucket] = nonces
+	}
+	if _, dup := nonces[nonce]; dup {
+		return false
+	}
+	nonces[nonce] = struct{}{}
+	return true
+}
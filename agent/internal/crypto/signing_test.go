@@ -0,0 +1,187 @@
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTestIdentity(t *testing.T) *Identity {
+	t.Helper()
+	id, err := LoadOrCreateIdentity(t.TempDir())
+	if err != nil {
+		t.Fatalf("create identity: %v", err)
+	}
+	return id
+}
+
+func signedRequest(t *testing.T, id *Identity, body string) *http.Request {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/api/file/get?path=a.go", bytes.NewBufferString(body))
+	id.SignRequest(req, []byte(body))
+	return req
+}
+
+// replay copies req's headers and body into a fresh request, as an attacker
+// who captured it would send it
+func replay(req *http.Request, body string) *http.Request {
+	again := httptest.NewRequest(req.Method, req.URL.RequestURI(), bytes.NewBufferString(body))
+	again.Header = req.Header.Clone()
+	return again
+}
+
+func TestVerifyAcceptsSignedRequest(t *testing.T) {
+	id := newTestIdentity(t)
+	req := signedRequest(t, id, `{"path":"a.go"}`)
+
+	key, err := NewVerifier().Verify(req)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if EncodeKey(key) != id.EncodedPublicKey() {
+		t.Errorf("Verify returned key %s, want %s", EncodeKey(key), id.EncodedPublicKey())
+	}
+	body, _ := io.ReadAll(req.Body)
+	if string(body) != `{"path":"a.go"}` {
+		t.Errorf("body after Verify = %q, want it restored", body)
+	}
+}
+
+func TestVerifyUnsigned(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/api/status", nil)
+	if _, err := NewVerifier().Verify(req); !errors.Is(err, ErrUnsigned) {
+		t.Errorf("Verify(unsigned) = %v, want ErrUnsigned", err)
+	}
+}
+
+func TestVerifyRejectsReplay(t *testing.T) {
+	id := newTestIdentity(t)
+	v := NewVerifier()
+	req := signedRequest(t, id, "{}")
+	captured := replay(req, "{}")
+
+	if _, err := v.Verify(req); err != nil {
+		t.Fatalf("first Verify: %v", err)
+	}
+	if _, err := v.Verify(captured); !errors.Is(err, ErrStaleRequest) {
+		t.Errorf("replayed Verify = %v, want ErrStaleRequest", err)
+	}
+}
+
+func TestIdenticalRequestsSignDifferently(t *testing.T) {
+	id := newTestIdentity(t)
+	v := NewVerifier()
+	first := signedRequest(t, id, "{}")
+	second := signedRequest(t, id, "{}")
+
+	if first.Header.Get(HeaderNonce) == second.Header.Get(HeaderNonce) {
+		t.Fatal("two requests got the same nonce")
+	}
+	// Same method, path, body and (almost certainly) second: both must pass
+	for i, req := range []*http.Request{first, second} {
+		if _, err := v.Verify(req); err != nil {
+			t.Errorf("Verify request %d: %v", i, err)
+		}
+	}
+}
+
+func TestVerifyRejectsTampering(t *testing.T) {
+	id := newTestIdentity(t)
+	tests := []struct {
+		name   string
+		tamper func(req *http.Request) *http.Request
+		want   error
+	}{
+		{"body", func(req *http.Request) *http.Request {
+			return replay(req, `{"path":"../secret"}`)
+		}, ErrBadSignature},
+		{"path", func(req *http.Request) *http.Request {
+			again := httptest.NewRequest(req.Method, "/api/file/get?path=b.go", bytes.NewBufferString("{}"))
+			again.Header = req.Header.Clone()
+			return again
+		}, ErrBadSignature},
+		{"nonce", func(req *http.Request) *http.Request {
+			again := replay(req, "{}")
+			again.Header.Set(HeaderNonce, newNonce())
+			return again
+		}, ErrBadSignature},
+		{"missing nonce", func(req *http.Request) *http.Request {
+			again := replay(req, "{}")
+			again.Header.Del(HeaderNonce)
+			return again
+		}, ErrBadSignature},
+		{"short nonce", func(req *http.Request) *http.Request {
+			again := replay(req, "{}")
+			again.Header.Set(HeaderNonce, "AAAA")
+			return again
+		}, ErrBadSignature},
+		{"timestamp", func(req *http.Request) *http.Request {
+			again := replay(req, "{}")
+			unix, _ := strconv.ParseInt(req.Header.Get(HeaderTimestamp), 10, 64)
+			again.Header.Set(HeaderTimestamp, strconv.FormatInt(unix+1, 10))
+			return again
+		}, ErrBadSignature},
+		{"stale", func(req *http.Request) *http.Request {
+			again := replay(req, "{}")
+			again.Header.Set(HeaderTimestamp, strconv.FormatInt(time.Now().Add(-2*SignatureWindow).Unix(), 10))
+			return again
+		}, ErrStaleRequest},
+		{"other key", func(req *http.Request) *http.Request {
+			again := replay(req, "{}")
+			again.Header.Set(HeaderKey, newTestIdentity(t).EncodedPublicKey())
+			return again
+		}, ErrBadSignature},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := tt.tamper(signedRequest(t, id, "{}"))
+			if _, err := NewVerifier().Verify(req); !errors.Is(err, tt.want) {
+				t.Errorf("Verify = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRememberExpiresBuckets(t *testing.T) {
+	v := NewVerifier()
+	start := time.Unix(1_700_000_000, 0)
+	width := int64(SignatureWindow / time.Second)
+
+	if !v.remember("k n1", start.Unix(), start) {
+		t.Fatal("first nonce refused")
+	}
+	if v.remember("k n1", start.Unix(), start.Add(SignatureWindow)) {
+		t.Error("nonce accepted again while its timestamp is still in the window")
+	}
+	if !v.remember("other n1", start.Unix(), start) {
+		t.Error("another signer's request refused for sharing a nonce")
+	}
+
+	// Once the window has passed for every timestamp in the bucket it goes
+	later := time.Unix((bucketOf(start.Unix())+2)*width, 0)
+	v.remember("k n2", later.Unix(), later)
+	if _, ok := v.seen[bucketOf(start.Unix())]; ok {
+		t.Error("expired bucket still held")
+	}
+	if len(v.seen) != 1 {
+		t.Errorf("held %d buckets, want 1", len(v.seen))
+	}
+}
+
+func TestRememberKeepsBucketWhileInWindow(t *testing.T) {
+	v := NewVerifier()
+	width := int64(SignatureWindow / time.Second)
+	// The last second of a bucket is still acceptable a full window later
+	last := (bucketOf(1_700_000_000)+1)*width - 1
+	v.remember("k n", last, time.Unix(last, 0))
+
+	now := time.Unix(last, 0).Add(SignatureWindow)
+	if v.remember("k n", last, now) {
+		t.Error("replay accepted at the edge of the window")
+	}
+}
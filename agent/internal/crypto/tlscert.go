@@ -0,0 +1,179 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const certFile = "tls.crt"
+
+// Certificate lifetimes
+const (
+	certValidity = 5 * 365 * 24 * time.Hour
+	certRenewal  = 30 * 24 * time.Hour // regenerate when this close to expiry
+)
+
+// CertFingerprint is the hex SHA-256 of a DER certificate, the value peers pin
+func CertFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// LoadOrCreateCertificate returns a self-signed TLS certificate for the
+// identity's key, reusing <dir>/tls.crt while it matches the key and isn't
+// near expiry. The private key never leaves identity.key.
+func (id *Identity) LoadOrCreateCertificate(dir string, hosts []string) (tls.Certificate, string, error) {
+	path := filepath.Join(dir, certFile)
+
+	if data, err := os.ReadFile(path); err == nil {
+		if der, ok := id.usableCert(data); ok {
+			return id.tlsCertificate(der), CertFingerprint(der), nil
+		}
+	} else if !os.IsNotExist(err) {
+		return tls.Certificate{}, "", fmt.Errorf("failed to read %s: %w", certFile, err)
+	}
+
+	der, err := id.createCert(hosts)
+	if err != nil {
+		return tls.Certificate{}, "", err
+	}
+	encoded := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := os.WriteFile(path, encoded, 0o644); err != nil {
+		return tls.Certificate{}, "", fmt.Errorf("failed to write %s: %w", certFile, err)
+	}
+	return id.tlsCertificate(der), CertFingerprint(der), nil
+}
+
+// SavedCertFingerprint returns the fingerprint of the certificate in
+// <dir>/tls.crt, so local clients can pin the agent serving from dir
+func SavedCertFingerprint(dir string) (string, error) {
+	return CertFileFingerprint(filepath.Join(dir, certFile))
+}
+
+// CertFileFingerprint returns the fingerprint of the first certificate in
+// a PEM file, the leaf when the file holds a chain
+func CertFileFingerprint(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return "", fmt.Errorf("%s is not a PEM certificate", filepath.Base(path))
+	}
+	return CertFingerprint(block.Bytes), nil
+}
+
+// LoadKeyPair loads a certificate and private key from PEM files, for an
+// agent serving a certificate it was given rather than its self-signed one,
+// and returns the leaf's fingerprint for peers to pin
+func LoadKeyPair(certPath, keyPath string) (tls.Certificate, string, error) {
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return tls.Certificate{}, "", err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return tls.Certificate{}, "", err
+	}
+	if time.Now().After(leaf.NotAfter) {
+		return tls.Certificate{}, "", fmt.Errorf("%s expired on %s", filepath.Base(certPath), leaf.NotAfter.Format("2006-01-02"))
+	}
+	cert.Leaf = leaf
+	return cert, CertFingerprint(cert.Certificate[0]), nil
+}
+
+// usableCert reports whether a PEM certificate belongs to this identity and
+// is valid for a while yet
+func (id *Identity) usableCert(data []byte) ([]byte, bool) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, false
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, false
+	}
+	key, ok := cert.PublicKey.(ed25519.PublicKey)
+	if !ok || !bytes.Equal(key, id.PublicKey) {
+		return nil, false
+	}
+	if time.Until(cert.NotAfter) < certRenewal {
+		return nil, false
+	}
+	return block.Bytes, true
+}
+
+func (id *Identity) createCert(hosts []string) ([]byte, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "zeropr-" + id.Fingerprint()[:16]},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(certValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, host := range append([]string{"localhost", "127.0.0.1", "::1"}, hosts...) {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if host != "" {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, id.PublicKey, id.privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create certificate: %w", err)
+	}
+	return der, nil
+}
+
+func (id *Identity) tlsCertificate(der []byte) tls.Certificate {
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  id.privateKey,
+	}
+}
+
+// ErrCertMismatch is returned when a peer's certificate isn't the one it advertised
+var ErrCertMismatch = errors.New("peer certificate does not match advertised fingerprint")
+
+// PinnedTLSConfig trusts exactly the certificate with the given fingerprint,
+// in place of CA verification, which self-signed agent certs can't pass.
+// A mismatch fails the handshake with a *CertMismatchError.
+func PinnedTLSConfig(fingerprint string) *tls.Config {
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: true, // replaced by the pin check below
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return ErrCertMismatch
+			}
+			if CertFingerprint(rawCerts[0]) != fingerprint {
+				return &CertMismatchError{Pinned: fingerprint, Presented: rawCerts[0]}
+			}
+			return nil
+		},
+	}
+}
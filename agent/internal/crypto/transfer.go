@@ -0,0 +1,230 @@
+package crypto
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"filippo.io/edwards25519"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// Headers negotiating an encrypted file transfer
+const (
+	HeaderAcceptEncryption = "X-ZeroPR-Accept-Encryption" // requester supports TransferScheme
+	HeaderEncryption       = "X-ZeroPR-Encryption"        // response body is sealed
+	HeaderTransferKey      = "X-ZeroPR-Transfer-Key"      // boxed per-transfer key
+	HeaderSealedEncoding   = "X-ZeroPR-Sealed-Encoding"   // content coding applied before sealing
+)
+
+// TransferScheme names the sealing scheme: a random secretbox key per
+// transfer, boxed from sender to recipient with their X25519 keys derived
+// from the Ed25519 identities, and the body sealed in numbered chunks.
+const TransferScheme = "box-v1"
+
+// transferChunk is the plaintext size of each sealed chunk
+const transferChunk = 64 << 10
+
+// ErrTampered is returned when a sealed transfer fails authentication,
+// is truncated, or was not sealed for us
+var ErrTampered = errors.New("encrypted transfer failed authentication")
+
+const (
+	prefixSize = 16 // random nonce prefix; the remaining 8 bytes count chunks
+	chunkMore  = 0
+	chunkFinal = 1
+)
+
+// x25519Private derives the X25519 private key matching the identity's
+// Ed25519 key, as in RFC 8032 section 5.1.5
+func (id *Identity) x25519Private() *[32]byte {
+	h := sha512.Sum512(id.privateKey.Seed())
+	var key [32]byte
+	copy(key[:], h[:32])
+	key[0] &= 248
+	key[31] &= 127
+	key[31] |= 64
+	return &key
+}
+
+// x25519Public converts an Ed25519 public key to its X25519 form
+func x25519Public(key ed25519.PublicKey) (*[32]byte, error) {
+	point, err := new(edwards25519.Point).SetBytes(key)
+	if err != nil {
+		return nil, err
+	}
+	var out [32]byte
+	copy(out[:], point.BytesMontgomery())
+	return &out, nil
+}
+
+// SealWriter encrypts a transfer body chunk by chunk. Close must be called
+// to write the final chunk; a stream without one is rejected as truncated.
+type SealWriter struct {
+	w       io.Writer
+	key     [32]byte
+	prefix  [prefixSize]byte
+	counter uint64
+	buf     []byte
+	closed  bool
+}
+
+// SealTransfer starts an encrypted transfer to recipient. The returned
+// header value goes in HeaderTransferKey; the body is written through the
+// SealWriter.
+func (id *Identity) SealTransfer(w io.Writer, recipient ed25519.PublicKey) (string, *SealWriter, error) {
+	peerKey, err := x25519Public(recipient)
+	if err != nil {
+		return "", nil, err
+	}
+
+	sw := &SealWriter{w: w, buf: make([]byte, 0, transferChunk)}
+	var nonce [24]byte
+	for _, b := range [][]byte{sw.key[:], sw.prefix[:], nonce[:]} {
+		if _, err := rand.Read(b); err != nil {
+			return "", nil, err
+		}
+	}
+
+	header := append(append([]byte{}, sw.prefix[:]...), nonce[:]...)
+	header = box.Seal(header, sw.key[:], &nonce, peerKey, id.x25519Private())
+	return base64.StdEncoding.EncodeToString(header), sw, nil
+}
+
+// Write buffers p, sealing every full chunk
+func (sw *SealWriter) Write(p []byte) (int, error) {
+	if sw.closed {
+		return 0, errors.New("write to closed transfer")
+	}
+	written := len(p)
+	for len(p) > 0 {
+		n := copy(sw.buf[len(sw.buf):cap(sw.buf)], p)
+		sw.buf = sw.buf[:len(sw.buf)+n]
+		p = p[n:]
+		if len(sw.buf) == cap(sw.buf) && len(p) > 0 {
+			if err := sw.seal(chunkMore); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Close seals the remaining data as the final chunk
+func (sw *SealWriter) Close() error {
+	if sw.closed {
+		return nil
+	}
+	sw.closed = true
+	return sw.seal(chunkFinal)
+}
+
+// seal writes the buffered data as one length-prefixed chunk
+func (sw *SealWriter) seal(flag byte) error {
+	plain := append([]byte{flag}, sw.buf...)
+	sealed := secretbox.Seal(make([]byte, 4), plain, sw.nonce(), &sw.key)
+	binary.BigEndian.PutUint32(sealed[:4], uint32(len(sealed)-4))
+
+	sw.counter++
+	sw.buf = sw.buf[:0]
+	_, err := sw.w.Write(sealed)
+	return err
+}
+
+func (sw *SealWriter) nonce() *[24]byte {
+	return chunkNonce(sw.prefix, sw.counter)
+}
+
+func chunkNonce(prefix [prefixSize]byte, counter uint64) *[24]byte {
+	var nonce [24]byte
+	copy(nonce[:], prefix[:])
+	binary.BigEndian.PutUint64(nonce[prefixSize:], counter)
+	return &nonce
+}
+
+// openReader decrypts a sealed transfer body
+type openReader struct {
+	r       io.Reader
+	key     [32]byte
+	prefix  [prefixSize]byte
+	counter uint64
+	pending []byte
+	done    bool
+}
+
+// OpenTransfer decrypts a transfer sealed for this identity by sender.
+// Reads fail with ErrTampered if any chunk doesn't authenticate or the
+// stream ends before its final chunk.
+func (id *Identity) OpenTransfer(r io.Reader, sender ed25519.PublicKey, header string) (io.Reader, error) {
+	peerKey, err := x25519Public(sender)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := base64.StdEncoding.DecodeString(header)
+	if err != nil || len(raw) < prefixSize+24 {
+		return nil, ErrTampered
+	}
+
+	or := &openReader{r: r}
+	copy(or.prefix[:], raw[:prefixSize])
+	var nonce [24]byte
+	copy(nonce[:], raw[prefixSize:prefixSize+24])
+
+	key, ok := box.Open(nil, raw[prefixSize+24:], &nonce, peerKey, id.x25519Private())
+	if !ok || len(key) != len(or.key) {
+		return nil, ErrTampered
+	}
+	copy(or.key[:], key)
+	return or, nil
+}
+
+func (or *openReader) Read(p []byte) (int, error) {
+	for len(or.pending) == 0 {
+		if or.done {
+			return 0, io.EOF
+		}
+		if err := or.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, or.pending)
+	or.pending = or.pending[n:]
+	return n, nil
+}
+
+// next reads and opens one chunk
+func (or *openReader) next() error {
+	var size [4]byte
+	if _, err := io.ReadFull(or.r, size[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrTampered
+		}
+		return err
+	}
+	length := binary.BigEndian.Uint32(size[:])
+	if length < secretbox.Overhead+1 || length > transferChunk+secretbox.Overhead+1 {
+		return ErrTampered
+	}
+
+	sealed := make([]byte, length)
+	if _, err := io.ReadFull(or.r, sealed); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrTampered
+		}
+		return err
+	}
+
+	plain, ok := secretbox.Open(nil, sealed, chunkNonce(or.prefix, or.counter), &or.key)
+	if !ok {
+		return ErrTampered
+	}
+	or.counter++
+	or.done = plain[0] == chunkFinal
+	or.pending = plain[1:]
+	return nil
+}
@@ -0,0 +1,108 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+// seal encrypts body from sender to recipient, returning the key header
+// and the sealed stream
+func seal(t *testing.T, sender, recipient *Identity, body []byte) (string, []byte) {
+	t.Helper()
+	var sealed bytes.Buffer
+	header, w, err := sender.SealTransfer(&sealed, recipient.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(body); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return header, sealed.Bytes()
+}
+
+// open decrypts a sealed stream from sender, as recipient
+func open(recipient, sender *Identity, header string, sealed []byte) ([]byte, error) {
+	r, err := recipient.OpenTransfer(bytes.NewReader(sealed), sender.PublicKey, header)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+// chunks splits a sealed stream into its length-prefixed chunks
+func chunks(sealed []byte) [][]byte {
+	var out [][]byte
+	for len(sealed) >= 4 {
+		n := 4 + int(binary.BigEndian.Uint32(sealed))
+		out = append(out, sealed[:n])
+		sealed = sealed[n:]
+	}
+	return out
+}
+
+func TestTransferRoundTrip(t *testing.T) {
+	alice, bob := newTestIdentity(t), newTestIdentity(t)
+	for _, size := range []int{0, 1, transferChunk - 1, transferChunk, transferChunk + 1, 3*transferChunk + 7} {
+		body := bytes.Repeat([]byte("zeropr"), size/6+1)[:size]
+		header, sealed := seal(t, alice, bob, body)
+		if bytes.Contains(sealed, []byte("zeropr")) {
+			t.Errorf("%d bytes: plaintext in the sealed stream", size)
+		}
+		got, err := open(bob, alice, header, sealed)
+		if err != nil || !bytes.Equal(got, body) {
+			t.Errorf("%d bytes: opened %d bytes, %v", size, len(got), err)
+		}
+		// A full last chunk is the final one, not followed by an empty one
+		if want := max(1, (size+transferChunk-1)/transferChunk); len(chunks(sealed)) != want {
+			t.Errorf("%d bytes sealed in %d chunks, want %d", size, len(chunks(sealed)), want)
+		}
+	}
+}
+
+func TestTransferSealedForSomeoneElse(t *testing.T) {
+	alice, bob, eve := newTestIdentity(t), newTestIdentity(t), newTestIdentity(t)
+	header, sealed := seal(t, alice, bob, []byte("secret"))
+	if _, err := open(eve, alice, header, sealed); !errors.Is(err, ErrTampered) {
+		t.Errorf("eve opened bob's transfer: %v", err)
+	}
+	// nor does bob accept it as coming from eve
+	if _, err := open(bob, eve, header, sealed); !errors.Is(err, ErrTampered) {
+		t.Errorf("bob opened alice's transfer as eve's: %v", err)
+	}
+}
+
+func TestTransferTampering(t *testing.T) {
+	alice, bob := newTestIdentity(t), newTestIdentity(t)
+	header, sealed := seal(t, alice, bob, bytes.Repeat([]byte{7}, 2*transferChunk+10))
+	parts := chunks(sealed)
+	if len(parts) != 3 {
+		t.Fatalf("sealed in %d chunks, want 3", len(parts))
+	}
+
+	flipped := append([]byte(nil), sealed...)
+	flipped[len(flipped)/2] ^= 1
+	tests := map[string][]byte{
+		"flipped bit":     flipped,
+		"truncated":       bytes.Join(parts[:2], nil),
+		"cut mid-chunk":   sealed[:len(sealed)-5],
+		"reordered":       bytes.Join([][]byte{parts[1], parts[0], parts[2]}, nil),
+		"chunk dropped":   bytes.Join([][]byte{parts[0], parts[2]}, nil),
+		"empty":           nil,
+		"oversized chunk": append([]byte{0xff, 0xff, 0xff, 0xff}, sealed[4:]...),
+	}
+	for name, stream := range tests {
+		if _, err := open(bob, alice, header, stream); !errors.Is(err, ErrTampered) {
+			t.Errorf("%s: %v, want ErrTampered", name, err)
+		}
+	}
+
+	if _, err := open(bob, alice, "not base64!", sealed); !errors.Is(err, ErrTampered) {
+		t.Errorf("a malformed key header: %v", err)
+	}
+}
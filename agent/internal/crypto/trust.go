@@ -0,0 +1,190 @@
+package crypto
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/zeropr/agent/internal/storage"
+)
+
+const (
+	trustCollection = "trust"
+	trustFile       = "trust.json" // where trust was kept before the storage layer
+)
+
+// Trust entry states
+const (
+	StateTrusted     = "trusted"
+	StateQuarantined = "quarantined" // conflicted; denied until the user decides
+)
+
+// Reasons an entry was quarantined
+const (
+	ConflictKeyChanged = "key_changed" // a live peer with this name presents a different key
+	ConflictRevoked    = "revoked"     // the team manifest revokes this key
+)
+
+// ErrUnknownTrust is returned when resolving a fingerprint that isn't stored
+var ErrUnknownTrust = errors.New("no trust entry for fingerprint")
+
+// TrustEntry is a peer key the user has chosen to trust
+type TrustEntry struct {
+	Fingerprint   string        `json:"fingerprint"`
+	PublicKey     string        `json:"publicKey"`
+	Name          string        `json:"name"`
+	AddedAt       time.Time     `json:"addedAt"`
+	State         string        `json:"state"`
+	Conflict      string        `json:"conflict,omitempty"`
+	ConflictKey   string        `json:"conflictFingerprint,omitempty"`
+	QuarantinedAt *time.Time    `json:"quarantinedAt,omitempty"`
+	Provenance    *Provenance   `json:"provenance,omitempty"`
+	PinRotations  []PinRotation `json:"pinRotations,omitempty"` // TLS certificates the peer attested, oldest first
+	RetiredSPKIs  []string      `json:"retiredSpkis,omitempty"` // keys of certificates the peer rotated away from
+}
+
+// TrustStore persists trusted peer keys, one storage key per fingerprint
+type TrustStore struct {
+	db      storage.Collection
+	entries map[string]*TrustEntry // keyed by fingerprint
+	actor   string                 // recorded on new provenance
+	mu      sync.RWMutex
+}
+
+// OpenTrustStore loads the trust store from db, first importing the
+// trust.json an older agent left in dir
+func OpenTrustStore(dir string, db storage.Store) (*TrustStore, error) {
+	c, err := db.Collection(trustCollection)
+	if err != nil {
+		return nil, err
+	}
+	if err := storage.ImportFile(c, filepath.Join(dir, trustFile), storage.SplitArray("fingerprint")); err != nil {
+		return nil, fmt.Errorf("failed to import %s: %w", trustFile, err)
+	}
+
+	t := &TrustStore{
+		db:      c,
+		entries: make(map[string]*TrustEntry),
+	}
+
+	values, err := c.List()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load trust entries: %w", err)
+	}
+	for fingerprint, data := range values {
+		var e TrustEntry
+		if err := json.Unmarshal(data, &e); err != nil {
+			return nil, fmt.Errorf("failed to parse trust entry %s: %w", fingerprint, err)
+		}
+		if e.State == "" {
+			e.State = StateTrusted // written before quarantine existed
+		}
+		if e.Provenance == nil {
+			e.Provenance = &Provenance{Method: ProvenanceUnknown, At: e.AddedAt}
+		}
+		t.entries[fingerprint] = &e
+	}
+	return t, nil
+}
+
+// Trust records key as trusted under a display name. The provenance's
+// time and actor are filled in if unset.
+func (t *TrustStore) Trust(key ed25519.PublicKey, name string, provenance Provenance) (*TrustEntry, error) {
+	entry := &TrustEntry{
+		Fingerprint: Fingerprint(key),
+		PublicKey:   EncodeKey(key),
+		Name:        name,
+		AddedAt:     time.Now(),
+		State:       StateTrusted,
+		Provenance:  &provenance,
+	}
+	if provenance.At.IsZero() {
+		provenance.At = entry.AddedAt
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if provenance.Actor == "" {
+		provenance.Actor = t.actor
+	}
+
+	t.entries[entry.Fingerprint] = entry
+	if err := t.saveLocked(entry.Fingerprint); err != nil {
+		delete(t.entries, entry.Fingerprint)
+		return nil, err
+	}
+	return entry, nil
+}
+
+// Revoke removes trust for a fingerprint, returning false if it wasn't trusted
+func (t *TrustStore) Revoke(fingerprint string) (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.entries[fingerprint]; !ok {
+		return false, nil
+	}
+	entry := t.entries[fingerprint]
+	delete(t.entries, fingerprint)
+	if err := t.saveLocked(fingerprint); err != nil {
+		t.entries[fingerprint] = entry
+		return false, err
+	}
+	return true, nil
+}
+
+// IsTrusted reports whether key is in the trust store and not quarantined
+func (t *TrustStore) IsTrusted(key ed25519.PublicKey) bool {
+	if t == nil || len(key) == 0 {
+		return false
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	entry, ok := t.entries[Fingerprint(key)]
+	return ok && entry.State == StateTrusted
+}
+
+// List returns all trusted entries ordered by when they were added
+func (t *TrustStore) List() []TrustEntry {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	list := make([]TrustEntry, 0, len(t.entries))
+	for _, e := range t.entries {
+		list = append(list, *e)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].AddedAt.Before(list[j].AddedAt)
+	})
+	return list
+}
+
+// saveLocked writes the entries for fingerprints, deleting those no longer
+// held; t.mu must be held
+func (t *TrustStore) saveLocked(fingerprints ...string) error {
+	for _, fp := range fingerprints {
+		entry, ok := t.entries[fp]
+		if !ok {
+			if err := t.db.Delete(fp); err != nil {
+				return fmt.Errorf("failed to delete trust entry %s: %w", fp, err)
+			}
+			continue
+		}
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		if err := t.db.Put(fp, data); err != nil {
+			return fmt.Errorf("failed to write trust entry %s: %w", fp, err)
+		}
+	}
+	return nil
+}
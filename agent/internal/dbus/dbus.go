@@ -0,0 +1,276 @@
+// Package dbus is a minimal client for the D-Bus system bus: enough to call
+// methods on a system service such as avahi-daemon and receive the signals
+// it sends back. It speaks the wire protocol itself, covering the types
+// those services use, rather than pulling in a full D-Bus library.
+package dbus
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Message types
+const (
+	TypeMethodCall   = 1
+	TypeMethodReturn = 2
+	TypeError        = 3
+	TypeSignal       = 4
+)
+
+// signalBuffer is how many signals wait for a reader before new ones are dropped
+const signalBuffer = 256
+
+// systemBusSocket is where the system bus listens unless
+// DBUS_SYSTEM_BUS_ADDRESS says otherwise
+const systemBusSocket = "/var/run/dbus/system_bus_socket"
+
+// ErrClosed is returned by calls on a closed connection
+var ErrClosed = errors.New("dbus: connection closed")
+
+// ObjectPath is a D-Bus object path ("o")
+type ObjectPath string
+
+// Variant is a value carried with its own signature ("v")
+type Variant struct {
+	Signature string
+	Value     interface{}
+}
+
+// Error is an error reply from the bus or a service
+type Error struct {
+	Name    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return e.Name
+	}
+	return e.Name + ": " + e.Message
+}
+
+// Message is a decoded D-Bus message
+type Message struct {
+	Type        byte
+	Flags       byte
+	Serial      uint32
+	ReplySerial uint32
+	Path        ObjectPath
+	Interface   string
+	Member      string
+	ErrorName   string
+	Destination string
+	Sender      string
+	Signature   string
+	Body        []interface{}
+}
+
+// Conn is a connection to a message bus
+type Conn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	serial  atomic.Uint32
+	writeMu sync.Mutex
+	pending map[uint32]chan *Message
+	mu      sync.Mutex
+	signals chan *Message
+	closed  chan struct{}
+	err     error // why the read loop ended
+}
+
+// SystemBus connects to the system message bus
+func SystemBus() (*Conn, error) {
+	address := os.Getenv("DBUS_SYSTEM_BUS_ADDRESS")
+	if address == "" {
+		address = "unix:path=" + systemBusSocket
+	}
+	return Dial(address)
+}
+
+// Dial connects to the bus at a unix: address and says hello
+func Dial(address string) (*Conn, error) {
+	path, err := socketPath(address)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Conn{
+		conn:    raw,
+		reader:  bufio.NewReader(raw),
+		pending: make(map[uint32]chan *Message),
+		signals: make(chan *Message, signalBuffer),
+		closed:  make(chan struct{}),
+	}
+	if err := c.auth(); err != nil {
+		raw.Close()
+		return nil, err
+	}
+	go c.readLoop()
+
+	if _, err := c.Call(context.Background(), "org.freedesktop.DBus", "/org/freedesktop/DBus",
+		"org.freedesktop.DBus", "Hello", ""); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// socketPath picks the first unix socket out of a bus address list
+func socketPath(address string) (string, error) {
+	for _, entry := range strings.Split(address, ";") {
+		transport, params, ok := strings.Cut(entry, ":")
+		if !ok || transport != "unix" {
+			continue
+		}
+		for _, param := range strings.Split(params, ",") {
+			key, value, _ := strings.Cut(param, "=")
+			switch key {
+			case "path":
+				return value, nil
+			case "abstract":
+				return "@" + value, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("dbus: no unix socket in address %q", address)
+}
+
+// auth authenticates as this process's user with SASL EXTERNAL
+func (c *Conn) auth() error {
+	uid := hex.EncodeToString([]byte(strconv.Itoa(os.Getuid())))
+	if _, err := c.conn.Write([]byte("\x00AUTH EXTERNAL " + uid + "\r\n")); err != nil {
+		return err
+	}
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "OK ") {
+		return fmt.Errorf("dbus: authentication refused: %s", strings.TrimSpace(line))
+	}
+	_, err = c.conn.Write([]byte("BEGIN\r\n"))
+	return err
+}
+
+// Call invokes a method and returns the reply's body. args are encoded
+// with signature, which names one type per argument. An error reply is
+// returned as an *Error.
+func (c *Conn) Call(ctx context.Context, dest string, path ObjectPath, iface, member, signature string, args ...interface{}) ([]interface{}, error) {
+	serial := c.serial.Add(1)
+	msg := &Message{
+		Type:        TypeMethodCall,
+		Serial:      serial,
+		Path:        path,
+		Interface:   iface,
+		Member:      member,
+		Destination: dest,
+		Signature:   signature,
+		Body:        args,
+	}
+	data, err := encodeMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := make(chan *Message, 1)
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	c.pending[serial] = reply
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, serial)
+		c.mu.Unlock()
+	}()
+
+	c.writeMu.Lock()
+	_, err = c.conn.Write(data)
+	c.writeMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.closed:
+		return nil, c.err
+	case msg := <-reply:
+		if msg.Type == TypeError {
+			e := &Error{Name: msg.ErrorName}
+			if len(msg.Body) > 0 {
+				e.Message, _ = msg.Body[0].(string)
+			}
+			return nil, e
+		}
+		return msg.Body, nil
+	}
+}
+
+// AddMatch asks the bus to route signals matching rule to this connection
+func (c *Conn) AddMatch(ctx context.Context, rule string) error {
+	_, err := c.Call(ctx, "org.freedesktop.DBus", "/org/freedesktop/DBus", "org.freedesktop.DBus", "AddMatch", "s", rule)
+	return err
+}
+
+// Signals delivers the signals sent to this connection. Signals arriving
+// while the channel is full are dropped.
+func (c *Conn) Signals() <-chan *Message {
+	return c.signals
+}
+
+// Closed is closed once the connection is gone
+func (c *Conn) Closed() <-chan struct{} {
+	return c.closed
+}
+
+// Close closes the connection, failing calls still waiting for replies
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+// readLoop hands replies to their callers and signals to Signals until
+// the connection fails
+func (c *Conn) readLoop() {
+	for {
+		msg, err := readMessage(c.reader)
+		if err != nil {
+			c.mu.Lock()
+			c.err = ErrClosed
+			c.mu.Unlock()
+			close(c.closed)
+			return
+		}
+
+		switch msg.Type {
+		case TypeMethodReturn, TypeError:
+			c.mu.Lock()
+			reply := c.pending[msg.ReplySerial]
+			c.mu.Unlock()
+			if reply != nil {
+				reply <- msg
+			}
+		case TypeSignal:
+			select {
+			case c.signals <- msg:
+			default:
+			}
+		}
+	}
+}
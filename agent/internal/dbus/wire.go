@@ -0,0 +1,513 @@
+package dbus
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+)
+
+// Header field codes
+const (
+	fieldPath        = 1
+	fieldInterface   = 2
+	fieldMember      = 3
+	fieldErrorName   = 4
+	fieldReplySerial = 5
+	fieldDestination = 6
+	fieldSender      = 7
+	fieldSignature   = 8
+)
+
+// maxMessage bounds what readMessage accepts, as the spec does
+const maxMessage = 128 << 20
+
+// encodeMessage renders msg in little-endian wire format
+func encodeMessage(msg *Message) ([]byte, error) {
+	body := &encoder{}
+	types, err := splitSignature(msg.Signature)
+	if err != nil {
+		return nil, err
+	}
+	if len(types) != len(msg.Body) {
+		return nil, fmt.Errorf("dbus: signature %q has %d types for %d values", msg.Signature, len(types), len(msg.Body))
+	}
+	for i, sig := range types {
+		if err := body.encode(sig, msg.Body[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	fields := []interface{}{}
+	add := func(code byte, sig string, value interface{}) {
+		fields = append(fields, []interface{}{code, Variant{Signature: sig, Value: value}})
+	}
+	if msg.Path != "" {
+		add(fieldPath, "o", msg.Path)
+	}
+	if msg.Interface != "" {
+		add(fieldInterface, "s", msg.Interface)
+	}
+	if msg.Member != "" {
+		add(fieldMember, "s", msg.Member)
+	}
+	if msg.ErrorName != "" {
+		add(fieldErrorName, "s", msg.ErrorName)
+	}
+	if msg.ReplySerial != 0 {
+		add(fieldReplySerial, "u", msg.ReplySerial)
+	}
+	if msg.Destination != "" {
+		add(fieldDestination, "s", msg.Destination)
+	}
+	if msg.Signature != "" {
+		add(fieldSignature, "g", msg.Signature)
+	}
+
+	head := &encoder{}
+	head.buf = append(head.buf, 'l', msg.Type, msg.Flags, 1)
+	head.encode("u", uint32(len(body.buf)))
+	head.encode("u", msg.Serial)
+	if err := head.encode("a(yv)", fields); err != nil {
+		return nil, err
+	}
+	head.align(8)
+	return append(head.buf, body.buf...), nil
+}
+
+// readMessage reads and decodes one message
+func readMessage(r io.Reader) (*Message, error) {
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, err
+	}
+	var order binary.ByteOrder
+	switch fixed[0] {
+	case 'l':
+		order = binary.LittleEndian
+	case 'B':
+		order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("dbus: bad endianness %q", fixed[0])
+	}
+	bodyLen := order.Uint32(fixed[4:])
+	fieldsLen := order.Uint32(fixed[12:])
+	if bodyLen > maxMessage || fieldsLen > maxMessage {
+		return nil, errors.New("dbus: message too large")
+	}
+	headerLen := 16 + int(fieldsLen)
+	total := (headerLen+7)&^7 + int(bodyLen)
+
+	data := make([]byte, total)
+	copy(data, fixed)
+	if _, err := io.ReadFull(r, data[16:]); err != nil {
+		return nil, err
+	}
+
+	msg := &Message{Type: fixed[1], Flags: fixed[2], Serial: order.Uint32(fixed[8:])}
+	d := &decoder{buf: data, pos: 12, order: order}
+	raw, err := d.decode("a(yv)")
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range raw.([]interface{}) {
+		field := f.([]interface{})
+		value := field[1].(Variant).Value
+		switch field[0].(byte) {
+		case fieldPath:
+			msg.Path, _ = value.(ObjectPath)
+		case fieldInterface:
+			msg.Interface, _ = value.(string)
+		case fieldMember:
+			msg.Member, _ = value.(string)
+		case fieldErrorName:
+			msg.ErrorName, _ = value.(string)
+		case fieldReplySerial:
+			msg.ReplySerial, _ = value.(uint32)
+		case fieldDestination:
+			msg.Destination, _ = value.(string)
+		case fieldSender:
+			msg.Sender, _ = value.(string)
+		case fieldSignature:
+			msg.Signature, _ = value.(string)
+		}
+	}
+
+	d.align(8)
+	types, err := splitSignature(msg.Signature)
+	if err != nil {
+		return nil, err
+	}
+	for _, sig := range types {
+		value, err := d.decode(sig)
+		if err != nil {
+			return nil, err
+		}
+		msg.Body = append(msg.Body, value)
+	}
+	return msg, nil
+}
+
+// splitSignature splits a signature into its single complete types
+func splitSignature(sig string) ([]string, error) {
+	var types []string
+	for sig != "" {
+		n, err := typeLen(sig)
+		if err != nil {
+			return nil, err
+		}
+		types = append(types, sig[:n])
+		sig = sig[n:]
+	}
+	return types, nil
+}
+
+// typeLen returns the length of the single complete type sig starts with
+func typeLen(sig string) (int, error) {
+	if sig == "" {
+		return 0, errors.New("dbus: truncated signature")
+	}
+	switch sig[0] {
+	case 'y', 'b', 'n', 'q', 'i', 'u', 'x', 't', 'd', 's', 'o', 'g', 'v', 'h':
+		return 1, nil
+	case 'a':
+		n, err := typeLen(sig[1:])
+		return n + 1, err
+	case '(', '{':
+		end := byte(')')
+		if sig[0] == '{' {
+			end = '}'
+		}
+		i := 1
+		for i < len(sig) && sig[i] != end {
+			n, err := typeLen(sig[i:])
+			if err != nil {
+				return 0, err
+			}
+			i += n
+		}
+		if i >= len(sig) {
+			return 0, fmt.Errorf("dbus: unterminated %q in signature", sig[0])
+		}
+		return i + 1, nil
+	}
+	return 0, fmt.Errorf("dbus: unknown type %q in signature", sig[0])
+}
+
+// alignment returns the alignment of a type's first byte
+func alignment(sig byte) int {
+	switch sig {
+	case 'n', 'q':
+		return 2
+	case 'b', 'i', 'u', 's', 'o', 'a', 'h':
+		return 4
+	case 'x', 't', 'd', '(', '{':
+		return 8
+	}
+	return 1
+}
+
+// encoder renders values in little-endian wire format. Offsets, and so
+// padding, count from the start of buf, which starts a message or its body.
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) align(n int) {
+	for len(e.buf)%n != 0 {
+		e.buf = append(e.buf, 0)
+	}
+}
+
+func (e *encoder) encode(sig string, v interface{}) error {
+	e.align(alignment(sig[0]))
+	le := binary.LittleEndian
+	switch sig[0] {
+	case 'y':
+		b, ok := v.(byte)
+		if !ok {
+			return typeError(sig, v)
+		}
+		e.buf = append(e.buf, b)
+	case 'b':
+		b, ok := v.(bool)
+		if !ok {
+			return typeError(sig, v)
+		}
+		var n uint32
+		if b {
+			n = 1
+		}
+		e.buf = le.AppendUint32(e.buf, n)
+	case 'n':
+		n, ok := v.(int16)
+		if !ok {
+			return typeError(sig, v)
+		}
+		e.buf = le.AppendUint16(e.buf, uint16(n))
+	case 'q':
+		n, ok := v.(uint16)
+		if !ok {
+			return typeError(sig, v)
+		}
+		e.buf = le.AppendUint16(e.buf, n)
+	case 'i':
+		n, ok := v.(int32)
+		if !ok {
+			return typeError(sig, v)
+		}
+		e.buf = le.AppendUint32(e.buf, uint32(n))
+	case 'u', 'h':
+		n, ok := v.(uint32)
+		if !ok {
+			return typeError(sig, v)
+		}
+		e.buf = le.AppendUint32(e.buf, n)
+	case 'x':
+		n, ok := v.(int64)
+		if !ok {
+			return typeError(sig, v)
+		}
+		e.buf = le.AppendUint64(e.buf, uint64(n))
+	case 't':
+		n, ok := v.(uint64)
+		if !ok {
+			return typeError(sig, v)
+		}
+		e.buf = le.AppendUint64(e.buf, n)
+	case 'd':
+		f, ok := v.(float64)
+		if !ok {
+			return typeError(sig, v)
+		}
+		e.buf = le.AppendUint64(e.buf, math.Float64bits(f))
+	case 's', 'o':
+		var s string
+		switch str := v.(type) {
+		case string:
+			s = str
+		case ObjectPath:
+			s = string(str)
+		default:
+			return typeError(sig, v)
+		}
+		e.buf = le.AppendUint32(e.buf, uint32(len(s)))
+		e.buf = append(append(e.buf, s...), 0)
+	case 'g':
+		s, ok := v.(string)
+		if !ok || len(s) > 255 {
+			return typeError(sig, v)
+		}
+		e.buf = append(e.buf, byte(len(s)))
+		e.buf = append(append(e.buf, s...), 0)
+	case 'v':
+		variant, ok := v.(Variant)
+		if !ok {
+			return typeError(sig, v)
+		}
+		if err := e.encode("g", variant.Signature); err != nil {
+			return err
+		}
+		return e.encode(variant.Signature, variant.Value)
+	case 'a':
+		elem := sig[1:]
+		rv := reflect.ValueOf(v)
+		if rv.Kind() != reflect.Slice {
+			return typeError(sig, v)
+		}
+		lenAt := len(e.buf)
+		e.buf = append(e.buf, 0, 0, 0, 0)
+		e.align(alignment(elem[0]))
+		start := len(e.buf)
+		for i := 0; i < rv.Len(); i++ {
+			if err := e.encode(elem, rv.Index(i).Interface()); err != nil {
+				return err
+			}
+		}
+		le.PutUint32(e.buf[lenAt:], uint32(len(e.buf)-start))
+	case '(', '{':
+		fields, ok := v.([]interface{})
+		types, err := splitSignature(sig[1 : len(sig)-1])
+		if err != nil {
+			return err
+		}
+		if !ok || len(fields) != len(types) {
+			return typeError(sig, v)
+		}
+		for i, t := range types {
+			if err := e.encode(t, fields[i]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("dbus: can't encode type %q", sig)
+	}
+	return nil
+}
+
+func typeError(sig string, v interface{}) error {
+	return fmt.Errorf("dbus: can't encode %T as %q", v, sig)
+}
+
+// decoder reads values out of a whole message, so alignment counts from
+// its first byte
+type decoder struct {
+	buf   []byte
+	pos   int
+	order binary.ByteOrder
+}
+
+var errShort = errors.New("dbus: message ends early")
+
+func (d *decoder) align(n int) {
+	d.pos = (d.pos + n - 1) / n * n
+}
+
+func (d *decoder) take(n int) ([]byte, error) {
+	if n < 0 || d.pos+n > len(d.buf) {
+		return nil, errShort
+	}
+	b := d.buf[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *decoder) decode(sig string) (interface{}, error) {
+	d.align(alignment(sig[0]))
+	switch sig[0] {
+	case 'y':
+		b, err := d.take(1)
+		if err != nil {
+			return nil, err
+		}
+		return b[0], nil
+	case 'b':
+		b, err := d.take(4)
+		if err != nil {
+			return nil, err
+		}
+		return d.order.Uint32(b) != 0, nil
+	case 'n':
+		b, err := d.take(2)
+		if err != nil {
+			return nil, err
+		}
+		return int16(d.order.Uint16(b)), nil
+	case 'q':
+		b, err := d.take(2)
+		if err != nil {
+			return nil, err
+		}
+		return d.order.Uint16(b), nil
+	case 'i':
+		b, err := d.take(4)
+		if err != nil {
+			return nil, err
+		}
+		return int32(d.order.Uint32(b)), nil
+	case 'u', 'h':
+		b, err := d.take(4)
+		if err != nil {
+			return nil, err
+		}
+		return d.order.Uint32(b), nil
+	case 'x':
+		b, err := d.take(8)
+		if err != nil {
+			return nil, err
+		}
+		return int64(d.order.Uint64(b)), nil
+	case 't':
+		b, err := d.take(8)
+		if err != nil {
+			return nil, err
+		}
+		return d.order.Uint64(b), nil
+	case 'd':
+		b, err := d.take(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(d.order.Uint64(b)), nil
+	case 's', 'o':
+		b, err := d.take(4)
+		if err != nil {
+			return nil, err
+		}
+		s, err := d.take(int(d.order.Uint32(b)) + 1)
+		if err != nil {
+			return nil, err
+		}
+		if sig[0] == 'o' {
+			return ObjectPath(s[:len(s)-1]), nil
+		}
+		return string(s[:len(s)-1]), nil
+	case 'g':
+		b, err := d.take(1)
+		if err != nil {
+			return nil, err
+		}
+		s, err := d.take(int(b[0]) + 1)
+		if err != nil {
+			return nil, err
+		}
+		return string(s[:len(s)-1]), nil
+	case 'v':
+		inner, err := d.decode("g")
+		if err != nil {
+			return nil, err
+		}
+		innerSig := inner.(string)
+		if n, err := typeLen(innerSig); err != nil || n != len(innerSig) {
+			return nil, fmt.Errorf("dbus: bad variant signature %q", innerSig)
+		}
+		value, err := d.decode(innerSig)
+		if err != nil {
+			return nil, err
+		}
+		return Variant{Signature: innerSig, Value: value}, nil
+	case 'a':
+		b, err := d.take(4)
+		if err != nil {
+			return nil, err
+		}
+		n := int(d.order.Uint32(b))
+		elem := sig[1:]
+		d.align(alignment(elem[0]))
+		end := d.pos + n
+		if n < 0 || end > len(d.buf) {
+			return nil, errShort
+		}
+		if elem == "y" {
+			bytes := append([]byte(nil), d.buf[d.pos:end]...)
+			d.pos = end
+			return bytes, nil
+		}
+		items := []interface{}{}
+		for d.pos < end {
+			item, err := d.decode(elem)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	case '(', '{':
+		types, err := splitSignature(sig[1 : len(sig)-1])
+		if err != nil {
+			return nil, err
+		}
+		fields := make([]interface{}, 0, len(types))
+		for _, t := range types {
+			field, err := d.decode(t)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, field)
+		}
+		return fields, nil
+	}
+	return nil, fmt.Errorf("dbus: can't decode type %q", sig)
+}
@@ -0,0 +1,138 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+)
+
+// Reasons discovery reports itself degraded
+const (
+	ConflictBind        = "bind_conflict"        // the built-in responder couldn't bind mDNS
+	ConflictForeign     = "foreign_announcement" // something re-announces us with TXT we never set
+	ConflictUnavailable = "daemon_unavailable"   // -mdns-backend asked for a system daemon that isn't there
+	MulticastSilent     = "multicast_silent"     // browsing hears nothing, not even ourselves
+)
+
+const (
+	// foreignCycles is how many browse cycles in a row must see us
+	// announced with foreign TXT before it counts as a conflict, so one
+	// stray packet from a cache flushing doesn't switch backends
+	foreignCycles = 2
+
+	// txtMemory is how long TXT we published still counts as ours, since
+	// caches keep answering with it after we change it
+	txtMemory = 5 * time.Minute
+
+	// silentCycles is how many browse cycles in a row must hear nothing
+	// before multicast counts as blocked
+	silentCycles = 3
+)
+
+// silentRemedy is what to do when multicast seems blocked
+const silentRemedy = "Multicast looks blocked on this network, so peers can't be discovered. " +
+	"Add them by address with POST /api/peers, or ask for mDNS (UDP 5353 to 224.0.0.251) to be allowed."
+
+// publisher is a live registration of this agent's service
+type publisher interface {
+	SetText(records []string)
+	Shutdown()
+}
+
+// daemon publishes and browses through the platform's mDNS daemon, for
+// machines where it owns port 5353 and competing with it fails
+type daemon interface {
+	Name() string
+	Publish(instance string, port int, records []string) (publisher, error)
+
+	// Browse sends the services it finds to entries until ctx is done or
+	// the daemon has answered from what it knows, then closes entries
+	Browse(ctx context.Context, entries chan<- *zeroconf.ServiceEntry) error
+
+	Close() error
+}
+
+// Degraded describes an mDNS conflict discovery couldn't get around
+type Degraded struct {
+	Reason string    `json:"reason"`
+	Detail string    `json:"detail"`
+	Remedy string    `json:"remedy"`
+	Since  time.Time `json:"since"`
+}
+
+// bindConflict reports whether a registration failed because another
+// responder holds the mDNS port or its multicast groups
+func bindConflict(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, syscall.EADDRINUSE) {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	for _, symptom := range []string{
+		"address already in use",
+		"only one usage of each socket address", // Windows
+		"failed to join any of these interfaces",
+		"no suitable interfaces",
+	} {
+		if strings.Contains(msg, symptom) {
+			return true
+		}
+	}
+	return strings.Contains(msg, "5353") && strings.Contains(msg, "bind")
+}
+
+// txtSignature renders TXT records for comparison, ignoring their order
+func txtSignature(records []string) string {
+	sorted := append([]string(nil), records...)
+	sort.Strings(sorted)
+	return strings.Join(sorted, "\x00")
+}
+
+// txtHistory remembers the TXT this agent published, to tell its own
+// announcements, stale ones included, from copies a reflector rewrote
+type txtHistory struct {
+	published map[string]time.Time // signature -> when it was last ours
+	streak    int                  // browse cycles in a row that saw foreign TXT
+}
+
+// publish records records as published at now
+func (h *txtHistory) publish(records []string, now time.Time) {
+	if h.published == nil {
+		h.published = make(map[string]time.Time)
+	}
+	h.published[txtSignature(records)] = now
+	for sig, at := range h.published {
+		if now.Sub(at) > txtMemory && len(h.published) > 1 {
+			delete(h.published, sig)
+		}
+	}
+}
+
+// foreign reports whether records, seen in an announcement of ourselves,
+// are something we never published
+func (h *txtHistory) foreign(records []string, current []string) bool {
+	sig := txtSignature(records)
+	if sig == txtSignature(current) {
+		return false
+	}
+	_, ours := h.published[sig]
+	return !ours
+}
+
+// endCycle records whether a browse cycle saw foreign TXT and reports
+// whether that has now held for foreignCycles cycles
+func (h *txtHistory) endCycle(sawForeign bool) bool {
+	if !sawForeign {
+		h.streak = 0
+		return false
+	}
+	h.streak++
+	return h.streak >= foreignCycles
+}
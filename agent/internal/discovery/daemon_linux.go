@@ -0,0 +1,286 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+	"github.com/zeropr/agent/internal/dbus"
+)
+
+// avahi-daemon's D-Bus API
+const (
+	avahiBus         = "org.freedesktop.Avahi"
+	avahiServer      = "org.freedesktop.Avahi.Server"
+	avahiEntryGroup  = "org.freedesktop.Avahi.EntryGroup"
+	avahiBrowser     = "org.freedesktop.Avahi.ServiceBrowser"
+	avahiRunning     = 2  // AVAHI_SERVER_RUNNING
+	avahiUnspec      = -1 // AVAHI_IF_UNSPEC and AVAHI_PROTO_UNSPEC
+	avahiProtoInet6  = 1  // AVAHI_PROTO_INET6
+	avahiDomain      = "local"
+	avahiCallTimeout = 5 * time.Second
+)
+
+// avahi publishes and browses through avahi-daemon over the system bus
+type avahi struct {
+	conn   *dbus.Conn
+	logger *slog.Logger
+}
+
+// newDaemon connects to avahi-daemon, failing if it isn't running
+func newDaemon(logger *slog.Logger) (daemon, error) {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return nil, fmt.Errorf("system bus unavailable: %w", err)
+	}
+	a := &avahi{conn: conn, logger: logger}
+
+	ctx, cancel := context.WithTimeout(context.Background(), avahiCallTimeout)
+	defer cancel()
+	out, err := a.server(ctx, "GetState", "")
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("avahi-daemon unavailable: %w", err)
+	}
+	if state, _ := first(out).(int32); state != avahiRunning {
+		conn.Close()
+		return nil, fmt.Errorf("avahi-daemon isn't running (state %d)", state)
+	}
+
+	// Subscribe up front: a browser starts signalling as soon as it's
+	// created, before its path is known
+	if err := conn.AddMatch(ctx, "type='signal',sender='"+avahiBus+"',interface='"+avahiBrowser+"'"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *avahi) Name() string { return "avahi" }
+
+// server calls a method on the daemon's root object
+func (a *avahi) server(ctx context.Context, member, signature string, args ...interface{}) ([]interface{}, error) {
+	return a.conn.Call(ctx, avahiBus, "/", avahiServer, member, signature, args...)
+}
+
+// first returns the first value of a reply, or nil for an empty one
+func first(out []interface{}) interface{} {
+	if len(out) == 0 {
+		return nil
+	}
+	return out[0]
+}
+
+// Publish registers the service in a new entry group, which the daemon
+// withdraws when it's freed or this connection closes
+func (a *avahi) Publish(instance string, port int, records []string) (publisher, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), avahiCallTimeout)
+	defer cancel()
+
+	out, err := a.server(ctx, "EntryGroupNew", "")
+	if err != nil {
+		return nil, err
+	}
+	path, ok := first(out).(dbus.ObjectPath)
+	if !ok {
+		return nil, fmt.Errorf("avahi EntryGroupNew returned %v", out)
+	}
+	group := &avahiGroup{avahi: a, path: path, instance: instance}
+
+	_, err = a.conn.Call(ctx, avahiBus, path, avahiEntryGroup, "AddService", "iiussssqaay",
+		int32(avahiUnspec), int32(avahiUnspec), uint32(0), instance, serviceType, avahiDomain, "", uint16(port), txtBytes(records))
+	if err == nil {
+		_, err = a.conn.Call(ctx, avahiBus, path, avahiEntryGroup, "Commit", "")
+	}
+	if err != nil {
+		group.Shutdown()
+		return nil, err
+	}
+	return group, nil
+}
+
+// Browse runs a service browser until it reports it has answered from
+// what the daemon knows, resolving each service it finds
+func (a *avahi) Browse(ctx context.Context, entries chan<- *zeroconf.ServiceEntry) error {
+	defer close(entries)
+
+	out, err := a.server(ctx, "ServiceBrowserNew", "iissu",
+		int32(avahiUnspec), int32(avahiUnspec), serviceType, avahiDomain, uint32(0))
+	if err != nil {
+		return err
+	}
+	path, ok := first(out).(dbus.ObjectPath)
+	if !ok {
+		return fmt.Errorf("avahi ServiceBrowserNew returned %v", out)
+	}
+	defer func() {
+		freeCtx, cancel := context.WithTimeout(context.Background(), avahiCallTimeout)
+		defer cancel()
+		a.conn.Call(freeCtx, avahiBus, path, avahiBrowser, "Free", "")
+	}()
+
+	// The daemon reports a service once per interface and protocol; the
+	// addresses are merged into one entry per instance
+	found := make(map[string]*zeroconf.ServiceEntry)
+	var order []string
+	flush := func() {
+		for _, name := range order {
+			entries <- found[name]
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			flush()
+			return nil
+		case <-a.conn.Closed():
+			flush()
+			return dbus.ErrClosed
+		case signal := <-a.conn.Signals():
+			if signal.Path != path || signal.Interface != avahiBrowser {
+				continue
+			}
+			switch signal.Member {
+			case "ItemNew":
+				entry, err := a.resolve(ctx, signal.Body)
+				if err != nil {
+					a.logger.Debug("Failed to resolve service via avahi", "err", err)
+					continue
+				}
+				if existing, ok := found[entry.Instance]; ok {
+					existing.AddrIPv4 = appendIP(existing.AddrIPv4, entry.AddrIPv4...)
+					existing.AddrIPv6 = appendIP(existing.AddrIPv6, entry.AddrIPv6...)
+					continue
+				}
+				found[entry.Instance] = entry
+				order = append(order, entry.Instance)
+			case "AllForNow":
+				flush()
+				return nil
+			case "Failure":
+				flush()
+				return fmt.Errorf("avahi browse failed: %v", signal.Body)
+			}
+		}
+	}
+}
+
+// resolve looks up an ItemNew (interface, protocol, name, type, domain,
+// flags) as a service entry
+func (a *avahi) resolve(ctx context.Context, item []interface{}) (*zeroconf.ServiceEntry, error) {
+	if len(item) < 5 {
+		return nil, fmt.Errorf("short ItemNew signal")
+	}
+	iface, _ := item[0].(int32)
+	proto, _ := item[1].(int32)
+	name, _ := item[2].(string)
+
+	resolveCtx, cancel := context.WithTimeout(ctx, avahiCallTimeout)
+	defer cancel()
+	out, err := a.server(resolveCtx, "ResolveService", "iisssiu",
+		iface, proto, name, serviceType, avahiDomain, proto, uint32(0))
+	if err != nil {
+		return nil, err
+	}
+	// interface, protocol, name, type, domain, host, aprotocol, address,
+	// port, txt, flags
+	if len(out) < 10 {
+		return nil, fmt.Errorf("short ResolveService reply")
+	}
+	entry := zeroconf.NewServiceEntry(name, serviceType, domain)
+	entry.HostName, _ = out[5].(string)
+	port, _ := out[8].(uint16)
+	entry.Port = int(port)
+	if records, ok := out[9].([]interface{}); ok {
+		for _, record := range records {
+			if b, ok := record.([]byte); ok {
+				entry.Text = append(entry.Text, string(b))
+			}
+		}
+	}
+	address, _ := out[7].(string)
+	if ip := net.ParseIP(address); ip != nil {
+		if aproto, _ := out[6].(int32); aproto == avahiProtoInet6 || ip.To4() == nil {
+			entry.AddrIPv6 = []net.IP{ip}
+		} else {
+			entry.AddrIPv4 = []net.IP{ip.To4()}
+		}
+	}
+	return entry, nil
+}
+
+func (a *avahi) Close() error {
+	return a.conn.Close()
+}
+
+// avahiGroup is a service published through an avahi entry group
+type avahiGroup struct {
+	avahi    *avahi
+	path     dbus.ObjectPath
+	instance string
+}
+
+func (g *avahiGroup) SetText(records []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), avahiCallTimeout)
+	defer cancel()
+	_, err := g.avahi.conn.Call(ctx, avahiBus, g.path, avahiEntryGroup, "UpdateServiceTxt", "iiusssaay",
+		int32(avahiUnspec), int32(avahiUnspec), uint32(0), g.instance, serviceType, avahiDomain, txtBytes(records))
+	if err != nil {
+		g.avahi.logger.Warn("Failed to update TXT via avahi", "err", err)
+	}
+}
+
+func (g *avahiGroup) Shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), avahiCallTimeout)
+	defer cancel()
+	if _, err := g.avahi.conn.Call(ctx, avahiBus, g.path, avahiEntryGroup, "Free", ""); err != nil {
+		g.avahi.logger.Debug("Failed to free avahi entry group", "err", err)
+	}
+}
+
+// txtBytes renders TXT records as avahi's aay
+func txtBytes(records []string) [][]byte {
+	out := make([][]byte, 0, len(records))
+	for _, record := range records {
+		out = append(out, []byte(record))
+	}
+	return out
+}
+
+// appendIP adds the addresses ips lacks
+func appendIP(ips []net.IP, more ...net.IP) []net.IP {
+	for _, ip := range more {
+		seen := false
+		for _, have := range ips {
+			if have.Equal(ip) {
+				seen = true
+				break
+			}
+		}
+		if !seen {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// conflictRemedy tells the user how to clear an mDNS conflict. daemonErr
+// says why avahi-daemon couldn't take over, if it was tried.
+func conflictRemedy(reason string, daemonErr error) string {
+	switch {
+	case daemonErr != nil && reason == ConflictUnavailable:
+		return "Start avahi-daemon, or run with -mdns-backend builtin."
+	case daemonErr != nil:
+		return "avahi-daemon couldn't take over. Start it so the agent can publish through it, or stop whatever else answers on port 5353. " +
+			"Peers can still be added by address with POST /api/peers."
+	case reason == ConflictForeign:
+		return "A reflector re-announces this agent with rewritten TXT. Set enable-reflector=no in /etc/avahi/avahi-daemon.conf, " +
+			"or run with -mdns-backend auto to publish through avahi-daemon."
+	default:
+		return "Another mDNS responder holds port 5353. Run with -mdns-backend auto or avahi to publish through avahi-daemon."
+	}
+}
@@ -0,0 +1,26 @@
+//go:build !linux
+
+package discovery
+
+import (
+	"errors"
+	"log/slog"
+	"runtime"
+)
+
+// newDaemon fails: publishing through the system daemon is only done with
+// avahi-daemon on Linux
+func newDaemon(logger *slog.Logger) (daemon, error) {
+	return nil, errors.New("no mDNS daemon fallback on this platform")
+}
+
+// conflictRemedy tells the user how to clear an mDNS conflict, which on
+// this platform the agent can't work around itself
+func conflictRemedy(reason string, daemonErr error) string {
+	if runtime.GOOS == "darwin" {
+		return "mDNSResponder, or a reflector it relays for, conflicts with the agent's responder. Ask IT whether a " +
+			"profile restricts multicast DNS on this Mac, or add peers by address with POST /api/peers."
+	}
+	return "Another mDNS responder conflicts with the agent's on port 5353. Stop it, " +
+		"or add peers by address with POST /api/peers."
+}
@@ -0,0 +1,150 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+	"github.com/zeropr/agent/internal/config"
+)
+
+// publishingDaemon is a system daemon that publishes, or refuses to
+type publishingDaemon struct {
+	err       error
+	published [][]string
+}
+
+func (d *publishingDaemon) Name() string { return "avahi" }
+
+func (d *publishingDaemon) Publish(_ string, _ int, records []string) (publisher, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	d.published = append(d.published, records)
+	return &fakePublisher{}, nil
+}
+
+func (d *publishingDaemon) Browse(_ context.Context, entries chan<- *zeroconf.ServiceEntry) error {
+	close(entries)
+	return nil
+}
+
+func (d *publishingDaemon) Close() error { return nil }
+
+type fakePublisher struct{ shutdown bool }
+
+func (p *fakePublisher) SetText([]string) {}
+func (p *fakePublisher) Shutdown()        { p.shutdown = true }
+
+func TestBindConflict(t *testing.T) {
+	for err, want := range map[error]bool{
+		nil: false,
+		fmt.Errorf("listen: %w", syscall.EADDRINUSE):                                    true,
+		errors.New("bind: Only one usage of each socket address is normally permitted"): true,
+		errors.New("udp4: failed to join any of these interfaces: [eth0]"):              true,
+		errors.New("bind udp 0.0.0.0:5353: permission denied"):                          true,
+		errors.New("no route to host"):                                                  false,
+	} {
+		if got := bindConflict(err); got != want {
+			t.Errorf("bindConflict(%v) = %v", err, got)
+		}
+	}
+}
+
+func TestTXTHistory(t *testing.T) {
+	var h txtHistory
+	now := time.Now()
+	h.publish([]string{"status=idle", "v=1"}, now)
+	h.publish([]string{"status=editing", "v=1"}, now.Add(time.Minute))
+	current := []string{"v=1", "status=editing"}
+
+	// Ours, in any order, or stale but recent, isn't foreign
+	if h.foreign([]string{"status=editing", "v=1"}, current) || h.foreign([]string{"v=1", "status=idle"}, current) {
+		t.Error("TXT we published counted as foreign")
+	}
+	if !h.foreign([]string{"status=editing", "v=1", "reflected=yes"}, current) {
+		t.Error("rewritten TXT wasn't foreign")
+	}
+
+	// What we published long ago is forgotten
+	h.publish(current, now.Add(txtMemory+2*time.Minute))
+	if !h.foreign([]string{"status=idle", "v=1"}, current) {
+		t.Errorf("TXT from %v ago still counts as ours", txtMemory)
+	}
+
+	// One stray cycle isn't a conflict; foreignCycles in a row is
+	if h.endCycle(true) || h.endCycle(false) || h.endCycle(true) || !h.endCycle(true) {
+		t.Errorf("foreign cycles reported wrongly, streak %d", h.streak)
+	}
+}
+
+func TestForeignAnnouncementsDegrade(t *testing.T) {
+	s, _ := newTestService(t)
+	s.backend = config.MDNSBuiltin
+	s.broadcasting = true
+	s.server = &fakePublisher{}
+
+	for i := 0; i < foreignCycles; i++ {
+		s.endCycle(true)
+	}
+	d := s.Degraded()
+	if d == nil || d.Reason != ConflictForeign || d.Remedy == "" {
+		t.Fatalf("degraded %+v after %d foreign cycles", d, foreignCycles)
+	}
+	s.endCycle(false)
+	if d := s.Degraded(); d != nil {
+		t.Errorf("still degraded %+v once the foreign announcements stopped", d)
+	}
+}
+
+func TestSilenceDegrades(t *testing.T) {
+	s, _ := newTestService(t)
+	s.broadcasting = true
+
+	for i := 0; i < silentCycles-1; i++ {
+		s.noteSilence(false)
+	}
+	if d := s.Degraded(); d != nil {
+		t.Fatalf("degraded %+v before %d silent cycles", d, silentCycles)
+	}
+	s.noteSilence(false)
+	if d := s.Degraded(); d == nil || d.Reason != MulticastSilent || d.Remedy != silentRemedy {
+		t.Fatalf("degraded %+v after %d silent cycles", d, silentCycles)
+	}
+	s.noteSilence(true)
+	if d := s.Degraded(); d != nil {
+		t.Errorf("still degraded %+v after hearing an answer", d)
+	}
+}
+
+func TestPublishThroughDaemon(t *testing.T) {
+	s, _ := newTestService(t)
+	s.backend = config.MDNSAvahi
+
+	// The daemon refusing leaves discovery degraded, with its reason
+	d := &publishingDaemon{err: errors.New("org.freedesktop.DBus.Error.ServiceUnknown")}
+	s.daemon = d
+	s.mu.Lock()
+	_, err := s.register([]string{"status=idle"})
+	degraded := s.degraded
+	s.mu.Unlock()
+	if err == nil || degraded == nil || degraded.Reason != ConflictUnavailable || degraded.Detail != d.err.Error() {
+		t.Fatalf("register through a refusing daemon: %v, degraded %+v", err, degraded)
+	}
+
+	// Once it publishes, that's over and its TXT counts as ours
+	d.err = nil
+	s.mu.Lock()
+	_, err = s.register([]string{"status=idle"})
+	degraded = s.degraded
+	backend := s.backendName()
+	foreign := s.history.foreign([]string{"status=idle"}, nil)
+	s.mu.Unlock()
+	if err != nil || degraded != nil || len(d.published) != 1 || backend != "avahi" || foreign {
+		t.Errorf("register through the daemon: %v, degraded %+v, published %v, backend %s", err, degraded, d.published, backend)
+	}
+}
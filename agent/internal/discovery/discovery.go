@@ -3,19 +3,51 @@ package discovery
 import (
 	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/grandcat/zeroconf"
+	"github.com/zeropr/agent/internal/config"
+	"github.com/zeropr/agent/internal/crypto"
+	"github.com/zeropr/agent/internal/logging"
+	"github.com/zeropr/agent/internal/metrics"
+	"github.com/zeropr/agent/internal/names"
 	"github.com/zeropr/agent/internal/peers"
+	"github.com/zeropr/agent/internal/protocol"
+	"github.com/zeropr/agent/internal/version"
 )
 
 const (
 	serviceType = "_zeropr._tcp"
 	domain      = "local."
+
+	browseWindow = 5 * time.Second // how long each browse listens for answers
+	browsePause  = 5 * time.Second // pause between browse cycles
+
+	maxTXTString = 255 // longest string in a TXT record, key=value included
+	// maxTXTTotal is DNS-SD's guidance for a TXT record's whole size, so
+	// announcements fit one packet
+	maxTXTTotal = 1300
+)
+
+// TXT schemas. A new schema is announced beside the legacy one for a
+// transition window: its fields ride under a "v2." prefix, and only where
+// they differ from the legacy field, so older agents, which misparse what
+// changed, keep reading the unprefixed fields they know.
+const (
+	SchemaLegacy = 1 // unmarked, and all agents before schema 2 announce
+	SchemaV2     = 2
+
+	schemaKey    = "schema"
+	schemaRecord = schemaKey + "=2" // what this agent announces
+	v2Prefix     = "v2."
 )
 
 // Service handles mDNS discovery
@@ -23,29 +55,190 @@ type Service struct {
 	deviceName   string
 	port         int
 	registry     *peers.Registry
-	server       *zeroconf.Server
-	resolver     *zeroconf.Resolver
+	server       publisher
+	backend      string    // config.MDNSBuiltin, MDNSAuto, or MDNSAvahi
+	daemon       daemon    // the system mDNS daemon, once we publish and browse through it
+	degraded     *Degraded // an mDNS conflict we couldn't get around
+	history      txtHistory
+	registerErr  error // why the last registration failed, until one succeeds
+	silent       int   // browse cycles in a row that heard nothing at all
 	ctx          context.Context
 	cancel       context.CancelFunc
 	broadcasting bool
+	since        time.Time // when the current broadcast started
+	announced    time.Time // when it was last (re-)registered
+	discoverOnce sync.Once
+	reclaimOnce  sync.Once
 	localIPv4    map[string]struct{}
 	localIPv6    map[string]struct{}
+	addrSeen     map[string]time.Time // when each local address was last present
+	addrsChanged atomic.Bool          // set when the watcher sees addresses change
+	blind        atomic.Bool          // set while observing is off; browse cycles are skipped
+	refresh      chan struct{}        // cuts the pause before the next browse short
+	txt          map[string]string
+	txtV2        map[string]string // schema 2 fields, where they may differ from txt
+	trust        *crypto.TrustStore
+	logger       *slog.Logger
+	metrics      *metrics.Metrics
 	mu           sync.RWMutex
 }
 
-// NewService creates a new discovery service
-func NewService(deviceName string, port int, registry *peers.Registry) (*Service, error) {
+// NewService creates a discovery service advertising cfg.DeviceName on the
+// peer listener's port, with cfg.DisplayName in the display TXT field
+func NewService(cfg *config.Config, registry *peers.Registry) (*Service, error) {
 	ctx, cancel := context.WithCancel(context.Background())
 
-	return &Service{
-		deviceName: deviceName,
-		port:       port,
+	s := &Service{
+		deviceName: cfg.DeviceName,
+		port:       cfg.AdvertisePort(),
 		registry:   registry,
+		backend:    cfg.MDNSBackend,
 		ctx:        ctx,
 		cancel:     cancel,
 		localIPv4:  make(map[string]struct{}),
 		localIPv6:  make(map[string]struct{}),
-	}, nil
+		refresh:    make(chan struct{}, 1),
+		txt: map[string]string{
+			"version":       version.Version,
+			"minCompatible": version.MinCompatible,
+			"proto":         protocol.Version,
+			// Tells this run's announcements from any a killed one left behind
+			"boot": strconv.FormatInt(time.Now().UnixMilli(), 10),
+		},
+		txtV2:  make(map[string]string),
+		logger: logging.Component(nil, "discovery"),
+	}
+	if cfg.DisplayName != "" {
+		s.txt["display"] = cfg.DisplayName
+	}
+	return s, nil
+}
+
+// SetLogger sets the logger discovery reports to. Call before StartBroadcast.
+func (s *Service) SetLogger(logger *slog.Logger) {
+	s.logger = logging.Component(logger, "discovery")
+}
+
+// SetMetrics sets where browse cycle durations are recorded; call it
+// before discovery starts
+func (s *Service) SetMetrics(m *metrics.Metrics) {
+	s.metrics = m
+}
+
+// SetTrustStore decides which discovered peers are marked trusted. Without
+// one no peer is trusted, whatever its TXT records claim.
+func (s *Service) SetTrustStore(trust *crypto.TrustStore) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.trust = trust
+}
+
+// SetTXT sets a TXT record field, re-announcing if we're broadcasting.
+// An empty value removes the field.
+func (s *Service) SetTXT(key, value string) {
+	s.SetTXTFields(map[string]string{key: value})
+}
+
+// SetTXTFields sets several TXT record fields as SetTXT does, with a
+// single re-announcement for all of them
+func (s *Service) SetTXTFields(fields map[string]string) {
+	s.setTXT(s.txt, "", fields)
+}
+
+// SetTXTv2 sets fields as schema 2 reads them, where that differs from the
+// legacy field of the same name, re-announcing if we're broadcasting. An
+// empty value removes the field; a value equal to the legacy one isn't
+// announced twice.
+func (s *Service) SetTXTv2(fields map[string]string) {
+	s.setTXT(s.txtV2, v2Prefix, fields)
+}
+
+// setTXT sets fields of one schema's TXT map, whose keys are announced
+// under prefix
+func (s *Service) setTXT(txt map[string]string, prefix string, fields map[string]string) {
+	s.mu.Lock()
+	changed := false
+	for key, value := range fields {
+		value = fitTXT(prefix+key, value)
+		if txt[key] == value {
+			continue
+		}
+		changed = true
+		if value == "" {
+			delete(txt, key)
+		} else {
+			txt[key] = value
+		}
+	}
+	if !changed {
+		s.mu.Unlock()
+		return
+	}
+	records := s.buildTXT()
+	server := s.server
+	if server != nil && s.broadcasting {
+		s.history.publish(records, time.Now())
+	}
+	s.mu.Unlock()
+
+	if server != nil && s.broadcasting {
+		server.SetText(records)
+	}
+}
+
+// TXTRecords returns the TXT records we advertise (or would advertise)
+func (s *Service) TXTRecords() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.buildTXT()
+}
+
+// buildTXT renders the TXT fields as sorted key=value records; s.mu must be held
+// fitTXT cuts a value so key=value fits in one TXT string, ending it with
+// an ellipsis where it was cut
+func fitTXT(key, value string) string {
+	room := maxTXTString - len(key) - 1
+	if len(value) <= room {
+		return value
+	}
+	const ellipsis = "…"
+	cut := room - len(ellipsis)
+	for cut > 0 && !utf8.RuneStart(value[cut]) {
+		cut--
+	}
+	return value[:cut] + ellipsis
+}
+
+func (s *Service) buildTXT() []string {
+	records := make([]string, 0, len(s.txt)+len(s.txtV2)+1)
+	size := 0
+	for key, value := range s.txt {
+		records = append(records, key+"="+value)
+		size += 1 + len(key) + 1 + len(value) // with the string's length byte
+	}
+	records = append(records, schemaRecord)
+	size += 1 + len(schemaRecord)
+
+	// Schema 2 fields that differ go in while they fit the budget; one left
+	// out falls back to the legacy field for schema 2 readers too
+	keys := make([]string, 0, len(s.txtV2))
+	for key, value := range s.txtV2 {
+		if s.txt[key] != value {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		record := v2Prefix + key + "=" + s.txtV2[key]
+		if size+1+len(record) > maxTXTTotal {
+			continue
+		}
+		records = append(records, record)
+		size += 1 + len(record)
+	}
+	sort.Strings(records)
+	return records
 }
 
 // StartBroadcast starts broadcasting this device
@@ -53,173 +246,405 @@ func (s *Service) StartBroadcast() error {
 	if s.broadcasting {
 		return fmt.Errorf("already broadcasting")
 	}
+	if s.port == 0 {
+		return fmt.Errorf("peer listener is disabled")
+	}
+
+	s.reclaimOnce.Do(s.reclaim)
 
-	server, err := zeroconf.Register(
-		s.deviceName,
-		serviceType,
-		domain,
-		s.port,
-		[]string{"version=0.1.0"},
-		nil,
-	)
+	s.mu.Lock()
+	server, err := s.register(s.buildTXT())
+	s.registerErr = err
 	if err != nil {
+		s.mu.Unlock()
+		// Browse anyway: peers may still be found, and if nothing is
+		// heard either the status says discovery is degraded
+		s.startLoops()
 		return fmt.Errorf("failed to register service: %w", err)
 	}
-
 	s.server = server
 	s.broadcasting = true
+	s.since = time.Now()
+	s.announced = s.since
+	backend := s.backendName()
+	s.mu.Unlock()
 	s.updateLocalAddrs()
 
-	log.Printf("Broadcasting as '%s' on port %d", s.deviceName, s.port)
-
-	// Start listening for other peers
-	go s.startDiscovery()
+	s.logger.Info("Broadcasting", "name", s.deviceName, "port", s.port, "backend", backend)
 
+	s.startLoops()
 	return nil
 }
 
+// startLoops starts listening for other peers and following interface
+// changes; restarting the broadcast keeps the same loops
+func (s *Service) startLoops() {
+	s.discoverOnce.Do(func() {
+		go s.startDiscovery()
+		go s.watchInterfaces()
+	})
+}
+
+// register publishes records through the system daemon if we've moved to
+// it, else through the built-in responder, moving to the daemon in auto
+// mode when the responder conflicts with it; s.mu must be held
+func (s *Service) register(records []string) (publisher, error) {
+	if s.daemon != nil || s.backend == config.MDNSAvahi {
+		return s.publishDaemon(records, ConflictUnavailable, nil)
+	}
+
+	server, err := zeroconf.Register(s.deviceName, serviceType, domain, s.port, records, nil)
+	if err == nil {
+		s.history.publish(records, time.Now())
+		return server, nil
+	}
+	if !bindConflict(err) {
+		return nil, err
+	}
+	if s.backend != config.MDNSAuto {
+		s.degrade(ConflictBind, err, nil)
+		return nil, err
+	}
+	s.logger.Warn("Built-in mDNS responder conflicts with another; publishing through the system daemon", "err", err)
+	return s.publishDaemon(records, ConflictBind, err)
+}
+
+// publishDaemon publishes records through the system mDNS daemon, which
+// from then on serves browsing too. reason and cause describe the conflict
+// that sent us there, for the degraded status if the daemon fails us.
+// s.mu must be held.
+func (s *Service) publishDaemon(records []string, reason string, cause error) (publisher, error) {
+	if s.daemon == nil {
+		d, err := newDaemon(s.logger)
+		if err != nil {
+			s.degrade(reason, cause, err)
+			return nil, err
+		}
+		s.daemon = d
+	}
+	server, err := s.daemon.Publish(s.deviceName, s.port, records)
+	if err != nil {
+		s.degrade(reason, cause, err)
+		return nil, err
+	}
+	s.history.publish(records, time.Now())
+	s.degraded = nil
+	return server, nil
+}
+
+// degrade records an mDNS conflict we couldn't get around. daemonErr says
+// why the system daemon couldn't take over, if it was tried. s.mu must be
+// held.
+func (s *Service) degrade(reason string, cause, daemonErr error) {
+	detail := cause
+	if detail == nil {
+		detail = daemonErr
+	}
+	since := time.Now()
+	if s.degraded != nil && s.degraded.Reason == reason {
+		since = s.degraded.Since
+	}
+	remedy := silentRemedy
+	if reason != MulticastSilent {
+		remedy = conflictRemedy(reason, daemonErr)
+	}
+	s.degraded = &Degraded{
+		Reason: reason,
+		Detail: detail.Error(),
+		Remedy: remedy,
+		Since:  since,
+	}
+	s.logger.Warn("mDNS discovery degraded", "reason", reason, "detail", s.degraded.Detail)
+}
+
+// backendName names what we publish through; s.mu must be held
+func (s *Service) backendName() string {
+	if s.daemon != nil {
+		return s.daemon.Name()
+	}
+	return config.MDNSBuiltin
+}
+
 // StopBroadcast stops broadcasting
 func (s *Service) StopBroadcast() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	if s.server != nil {
 		s.server.Shutdown()
 		s.broadcasting = false
-		log.Println("Broadcast stopped")
+		s.logger.Info("Broadcast stopped")
 	}
 }
 
-// startDiscovery listens for other peers
+// startDiscovery browses for other peers until the service is stopped
 func (s *Service) startDiscovery() {
-	resolver, err := zeroconf.NewResolver(nil)
-	if err != nil {
-		log.Printf("Failed to create resolver: %v", err)
-		return
+	s.logger.Debug("Starting peer discovery loop")
+
+	for {
+		if !s.blind.Load() {
+			start := time.Now()
+			s.browse()
+			s.metrics.ObserveBrowse(time.Since(start))
+		}
+
+		// Cleanup stale peers
+		s.registry.Cleanup(peers.TTL)
+
+		select {
+		case <-s.ctx.Done():
+			s.logger.Debug("Discovery loop stopped")
+			return
+		case <-time.After(browsePause):
+		case <-s.refresh:
+		}
 	}
-	s.resolver = resolver
-
-	log.Println("Starting peer discovery loop...")
-
-	// Browse for services continuously
-	go func() {
-		for {
-			select {
-			case <-s.ctx.Done():
-				log.Println("Discovery loop stopped")
-				return
-			default:
-				s.updateLocalAddrs()
-				log.Printf("Browsing for peers...")
-
-				// Create new channel for each browse session
-				entries := make(chan *zeroconf.ServiceEntry, 100)
-
-				ctx, cancel := context.WithTimeout(s.ctx, 5*time.Second)
-				done := make(chan struct{})
-
-				// Start listening for entries in this goroutine
-				go func() {
-					defer close(done)
-					for entry := range entries {
-						if s.isSelf(entry) {
-							log.Printf("Skipping self: %s", entry.Instance)
-							continue
-						}
-
-						// Add discovered peer to registry
-						if peer := s.buildPeer(entry); peer != nil {
-							s.registry.Add(peer)
-							log.Printf("Discovered peer: %s at %s:%d", peer.Name, peer.Address, peer.Port)
-						}
-					}
-					log.Println("Entry channel closed")
-				}()
-
-				go func() {
-					<-ctx.Done()
-					for range entries {
-					}
-				}()
-
-				err := resolver.Browse(ctx, serviceType, domain, entries)
-				if err != nil && err != context.Canceled && err != context.DeadlineExceeded {
-					log.Printf("Browse error: %v", err)
-				}
-
-				<-done
-				cancel()
-
-				log.Printf("Browse cycle complete, found %d peers", s.registry.Count())
-
-				// Cleanup stale peers (5 minutes)
-				s.registry.Cleanup(5 * time.Minute)
-
-				time.Sleep(5 * time.Second)
-			}
+}
+
+// SetObserving starts or stops browsing for peers, independently of
+// broadcasting. Peers already listed expire as usual while it's off.
+func (s *Service) SetObserving(on bool) {
+	changed := s.blind.Swap(!on) == on
+	switch {
+	case on:
+		s.startLoops()
+		if changed {
+			s.logger.Info("Observing peers again")
+			s.Refresh()
 		}
-	}()
+	case changed:
+		s.logger.Info("Stopped observing peers")
+	}
 }
 
-// Stop stops the discovery service
-func (s *Service) Stop() {
-	s.StopBroadcast()
-	s.cancel()
+// IsObserving returns whether we browse for peers
+func (s *Service) IsObserving() bool {
+	return !s.blind.Load()
 }
 
-// IsBroadcasting returns whether we're currently broadcasting
-func (s *Service) IsBroadcasting() bool {
-	return s.broadcasting
+// Refresh starts the next browse cycle without waiting out the pause
+func (s *Service) Refresh() {
+	select {
+	case s.refresh <- struct{}{}:
+	default:
+	}
 }
 
-// updateLocalAddrs refreshes the set of local IP addresses for self-identification.
-func (s *Service) updateLocalAddrs() {
-	ipv4 := make(map[string]struct{})
-	ipv6 := make(map[string]struct{})
+// browse runs one browse cycle, adding the peers it finds to the registry.
+// zeroconf or the daemon closes entries when the cycle's context ends (or
+// the browse fails), and that is what ends the loop below.
+func (s *Service) browse() {
+	s.updateLocalAddrs()
+	s.logger.Debug("Browsing for peers")
 
-	ifaces, err := net.Interfaces()
-	if err != nil {
-		log.Printf("Failed to list network interfaces: %v", err)
-		return
+	ctx, cancel := context.WithTimeout(s.ctx, browseWindow)
+	defer cancel()
+	entries := make(chan *zeroconf.ServiceEntry, 100)
+
+	// Once we publish through the system daemon it's authoritative for
+	// this machine, so browse through it too
+	s.mu.RLock()
+	d := s.daemon
+	s.mu.RUnlock()
+	if d != nil {
+		go func() {
+			if err := d.Browse(ctx, entries); err != nil {
+				s.logger.Warn("Browse failed", "backend", d.Name(), "err", err)
+			}
+		}()
+	} else {
+		// A resolver's connections are shut down when its browse ends, so
+		// each cycle needs a fresh one
+		resolver, err := zeroconf.NewResolver(nil)
+		if err != nil {
+			s.logger.Warn("Failed to create resolver", "err", err)
+			return
+		}
+		if err := resolver.Browse(ctx, serviceType, domain, entries); err != nil {
+			s.logger.Warn("Browse failed", "err", err)
+		}
 	}
 
-	for _, iface := range ifaces {
-		if iface.Flags&net.FlagUp == 0 {
+	sawForeign, heard := false, false
+	for entry := range entries {
+		heard = true
+		// Addresses changed mid-browse: catch up before judging who's who
+		if s.addrsChanged.Swap(false) {
+			s.updateLocalAddrs()
+		}
+		if s.isSelf(entry) {
+			if s.staleSelf(entry) {
+				s.logger.Debug("Skipping announcement left by a previous run", "instance", entry.Instance)
+				continue
+			}
+			if s.foreignTXT(entry.Text) {
+				s.logger.Debug("Self announced with TXT we never published", "instance", entry.Instance, "txt", entry.Text)
+				sawForeign = true
+			}
+			s.logger.Debug("Skipping self", "instance", entry.Instance)
 			continue
 		}
 
-		addrs, err := iface.Addrs()
-		if err != nil {
-			continue
+		// Add discovered peer to registry
+		if peer := s.buildPeer(entry); peer != nil {
+			txt, _ := readTXT(entry.Text)
+			s.mergePeer(peer, txt)
 		}
+	}
 
-		for _, addr := range addrs {
-			var ip net.IP
-			switch v := addr.(type) {
-			case *net.IPNet:
-				ip = v.IP
-			case *net.IPAddr:
-				ip = v.IP
-			default:
-				continue
-			}
+	s.endCycle(sawForeign)
+	s.noteSilence(heard)
+	s.logger.Debug("Browse cycle complete", "peers", s.registry.Count())
+}
 
-			if ip == nil || ip.IsLoopback() || ip.IsUnspecified() {
-				continue
-			}
+// noteSilence reports discovery degraded once silentCycles browse cycles in
+// a row have heard nothing while we broadcast or failed to. A working
+// network at least echoes our own announcement back, so silence means
+// multicast isn't getting through. Hearing anything clears it.
+func (s *Service) noteSilence(heard bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-			if ipv4Addr := ip.To4(); ipv4Addr != nil {
-				ipv4[ipv4Addr.String()] = struct{}{}
-				continue
-			}
+	if heard {
+		s.silent = 0
+		if s.degraded != nil && s.degraded.Reason == MulticastSilent {
+			s.logger.Info("mDNS answers are getting through again")
+			s.degraded = nil
+		}
+		return
+	}
+	s.silent++
+	if s.silent < silentCycles || (!s.broadcasting && s.registerErr == nil) {
+		return
+	}
+	// A conflict we already know about explains the silence better
+	if s.degraded != nil {
+		return
+	}
+	cause := fmt.Errorf("no mDNS answers in %d browse cycles, not even this agent's own", s.silent)
+	if s.registerErr != nil {
+		cause = fmt.Errorf("%w; registration failed: %v", cause, s.registerErr)
+	}
+	s.degrade(MulticastSilent, cause, nil)
+}
 
-			if ipv6Addr := ip.To16(); ipv6Addr != nil {
-				ipv6[ipv6Addr.String()] = struct{}{}
-			}
+// foreignTXT reports whether records, seen in an announcement of
+// ourselves, are TXT we never published
+func (s *Service) foreignTXT(records []string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.broadcasting && s.history.foreign(records, s.buildTXT())
+}
+
+// endCycle acts on what a browse cycle saw of ourselves. Once something has
+// kept re-announcing us with foreign TXT, auto mode moves the broadcast to
+// the system daemon; otherwise, or if we're already there, it's reported.
+func (s *Service) endCycle(sawForeign bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.history.endCycle(sawForeign) {
+		if !sawForeign && s.degraded != nil && s.degraded.Reason == ConflictForeign {
+			s.logger.Info("Foreign announcements of this agent stopped")
+			s.degraded = nil
 		}
+		return
+	}
+	if !s.broadcasting {
+		return
+	}
+
+	cause := fmt.Errorf("%q is announced with TXT this agent never published", s.deviceName)
+	if s.backend != config.MDNSAuto || s.daemon != nil {
+		if s.degraded == nil || s.degraded.Reason != ConflictForeign {
+			s.degrade(ConflictForeign, cause, nil)
+		}
+		return
+	}
+	s.logger.Warn("Another responder re-announces this agent; publishing through the system daemon", "err", cause)
+	server, err := s.publishDaemon(s.buildTXT(), ConflictForeign, cause)
+	if err != nil {
+		return
 	}
+	s.server.Shutdown()
+	s.server = server
+	s.announced = time.Now()
+}
+
+// Stop stops the discovery service
+func (s *Service) Stop() {
+	s.StopBroadcast()
+	s.cancel()
 
 	s.mu.Lock()
-	s.localIPv4 = ipv4
-	s.localIPv6 = ipv6
-	s.mu.Unlock()
+	defer s.mu.Unlock()
+	if s.daemon != nil {
+		s.daemon.Close()
+	}
+}
+
+// IsBroadcasting returns whether we're currently broadcasting
+func (s *Service) IsBroadcasting() bool {
+	return s.broadcasting
+}
+
+// Degraded returns what's keeping discovery from working, or nil if
+// nothing known is
+func (s *Service) Degraded() *Degraded {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.degraded
+}
+
+// BroadcastStatus is what this agent advertises over mDNS, for comparing
+// two agents that can't see each other
+type BroadcastStatus struct {
+	Broadcasting     bool       `json:"broadcasting"`
+	Instance         string     `json:"instance"`
+	Service          string     `json:"service"`
+	Domain           string     `json:"domain"`
+	Port             int        `json:"port"`
+	Addresses        []string   `json:"addresses"` // includes addresses lingering after an interface change
+	TXT              []string   `json:"txt"`
+	Since            *time.Time `json:"since,omitempty"`
+	BroadcastSeconds int64      `json:"broadcastSeconds"`
+	LastAnnounced    *time.Time `json:"lastAnnounced,omitempty"` // re-announced after interface changes
+	Backend          string     `json:"backend"`                 // builtin, or the system daemon published through
+	Degraded         *Degraded  `json:"degraded,omitempty"`      // an mDNS conflict discovery couldn't get around
+}
+
+// BroadcastStatus reports what we advertise, or would once broadcasting
+func (s *Service) BroadcastStatus() BroadcastStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	status := BroadcastStatus{
+		Broadcasting: s.broadcasting,
+		Instance:     s.deviceName,
+		Service:      serviceType,
+		Domain:       domain,
+		Port:         s.port,
+		Addresses:    make([]string, 0, len(s.localIPv4)+len(s.localIPv6)),
+		TXT:          s.buildTXT(),
+		Backend:      s.backendName(),
+		Degraded:     s.degraded,
+	}
+	for addr := range s.localIPv4 {
+		status.Addresses = append(status.Addresses, addr)
+	}
+	for addr := range s.localIPv6 {
+		status.Addresses = append(status.Addresses, addr)
+	}
+	sort.Strings(status.Addresses)
+
+	if s.broadcasting {
+		since, announced := s.since, s.announced
+		status.Since = &since
+		status.LastAnnounced = &announced
+		status.BroadcastSeconds = int64(time.Since(since).Seconds())
+	}
+	return status
 }
 
 // isSelf returns true if the given service entry refers to this agent.
@@ -228,13 +653,19 @@ func (s *Service) isSelf(entry *zeroconf.ServiceEntry) bool {
 		return false
 	}
 
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// Our key in the TXT record identifies us whatever address the
+	// announcement arrived from, e.g. an adapter that just came up
+	if pk := s.txt["pk"]; pk != "" && parseTXT(entry.Text)["pk"] == pk {
+		return true
+	}
+
 	if entry.Port != s.port || entry.Instance != s.deviceName {
 		return false
 	}
 
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
 	for _, addr := range entry.AddrIPv4 {
 		if _, ok := s.localIPv4[addr.String()]; ok {
 			return true
@@ -250,6 +681,89 @@ func (s *Service) isSelf(entry *zeroconf.ServiceEntry) bool {
 	return false
 }
 
+// displayName is the name to list a peer under: the display name it
+// advertises, unless that's missing or plays the tricks names.Suspicious
+// looks for, and otherwise its instance name
+func displayName(instance, display string) string {
+	if display == "" || names.Suspicious(display) != "" {
+		return instance
+	}
+	normalized, err := names.Normalize(display)
+	if err != nil {
+		return instance
+	}
+	return normalized
+}
+
+// mergePeer records a discovered peer. One already listed keeps the
+// presence fields this announcement's TXT record doesn't carry, so an
+// answer without them doesn't wipe the peer's active file or branch.
+func (s *Service) mergePeer(peer *peers.Peer, txt map[string]string) {
+	// A peer that restarted is added afresh, which also drops anything its
+	// previous run left in the registry
+	if existing, ok := s.registry.Get(peer.ID); ok && existing.Boot != peer.Boot {
+		if s.registry.Add(peer) {
+			s.logger.Info("Peer restarted", "peerId", peer.ID, "peer", peer.Name)
+		}
+		return
+	}
+
+	_, known := s.registry.Update(peer.ID, func(existing *peers.Peer) {
+		existing.Name = peer.Name
+		existing.Instance = peer.Instance
+		existing.Address = peer.Address
+		existing.Port = peer.Port
+		existing.TLS = peer.TLS
+		existing.CertFingerprint = peer.CertFingerprint
+		existing.PublicKey = peer.PublicKey
+		existing.Fingerprint = peer.Fingerprint
+		existing.Trusted = peer.Trusted
+		existing.PossibleSpoof = peer.PossibleSpoof
+		existing.SpoofReason = peer.SpoofReason
+		existing.SpoofOf = peer.SpoofOf
+		existing.Version = peer.Version
+		existing.ProtocolVersion = peer.ProtocolVersion
+		existing.Incompatible = peer.Incompatible
+		existing.IncompatibleReason = peer.IncompatibleReason
+		existing.LastSeen = peer.LastSeen
+		existing.NotServing = peer.NotServing
+		existing.ReadOnly = peer.ReadOnly
+		existing.AnnounceSchema = peer.AnnounceSchema
+
+		if _, ok := txt["repoHash"]; ok {
+			existing.RepoHash = peer.RepoHash
+		}
+		if _, ok := txt["branch"]; ok {
+			existing.Branch = peer.Branch
+		}
+		if _, ok := txt["repos"]; ok {
+			existing.RepoHashes = peer.RepoHashes
+		}
+		if _, ok := txt["activeFile"]; ok {
+			existing.ActiveFile = peer.ActiveFile
+		}
+		if _, ok := txt["status"]; ok {
+			existing.Status = peer.Status
+		}
+		// A cleared message leaves the record, so one carrying the status
+		// it's set with clears it here too
+		if _, ok := txt["message"]; ok || txt["status"] != "" {
+			existing.Message = peer.Message
+		}
+	})
+	if known {
+		s.logger.Debug("Refreshed peer", "peerId", peer.ID)
+		return
+	}
+	s.registry.Add(peer)
+	s.logger.Info("Discovered peer", "peerId", peer.ID, "peer", peer.Name, "addr", net.JoinHostPort(peer.Address, strconv.Itoa(peer.Port)))
+	if peer.Incompatible {
+		s.logger.Warn("Peer is incompatible with this agent; file requests to it are refused",
+			"peerId", peer.ID, "reason", peer.IncompatibleReason, "peerVersion", peer.Version,
+			"peerProtocol", peer.ProtocolVersion, "version", version.Version, "protocol", protocol.Version)
+	}
+}
+
 // buildPeer constructs a peers.Peer from a zeroconf entry.
 func (s *Service) buildPeer(entry *zeroconf.ServiceEntry) *peers.Peer {
 	if entry == nil {
@@ -263,34 +777,136 @@ func (s *Service) buildPeer(entry *zeroconf.ServiceEntry) *peers.Peer {
 	case len(entry.AddrIPv6) > 0:
 		address = entry.AddrIPv6[0].String()
 	default:
-		log.Printf("Discovered entry without address: %s", entry.Instance)
+		s.logger.Debug("Discovered entry without address", "instance", entry.Instance)
 		return nil
 	}
 
 	id := fmt.Sprintf("%s@%s:%d", entry.Instance, address, entry.Port)
 
 	status := "idle"
-	txt := parseTXT(entry.Text)
+	txt, schema := readTXT(entry.Text)
 	if v, ok := txt["status"]; ok && v != "" {
 		status = v
 	}
 
 	peer := &peers.Peer{
-		ID:         id,
-		Name:       entry.Instance,
-		Address:    address,
-		Port:       entry.Port,
-		RepoHash:   txt["repoHash"],
-		Branch:     txt["branch"],
-		ActiveFile: txt["activeFile"],
-		Status:     status,
-		LastSeen:   time.Now(),
-		Trusted:    txt["trusted"] == "true",
+		ID:             id,
+		Name:           displayName(entry.Instance, txt["display"]),
+		Address:        address,
+		Port:           entry.Port,
+		RepoHash:       txt["repoHash"],
+		Branch:         txt["branch"],
+		ActiveFile:     txt["activeFile"],
+		Status:         status,
+		Message:        peers.CleanMessage(txt["message"]),
+		LastSeen:       time.Now(),
+		AnnounceSchema: schema,
+	}
+
+	// The protocol version rides in TXT rather than a DNS-SD subtype, which
+	// the zeroconf library can't advertise, so every agent is browsed and
+	// incompatible ones are flagged for UIs to warn about
+	peer.SetCompatibility(txt["proto"], txt["version"], txt["minCompatible"])
+	if peer.Name != entry.Instance {
+		peer.Instance = entry.Instance
+	}
+	peer.Boot, _ = strconv.ParseInt(txt["boot"], 10, 64)
+	peer.NotServing = txt["serve"] == "0"
+	peer.ReadOnly = txt["readOnly"] == "1"
+	if repos := txt["repos"]; repos != "" {
+		peer.RepoHashes = strings.Split(repos, ",")
+	}
+
+	// TLS peers pin the certificate they advertise instead of a CA chain
+	if txt["tls"] == "1" && txt["certfp"] != "" {
+		peer.TLS = true
+		peer.CertFingerprint = txt["certfp"]
+	}
+
+	// Trust comes from our own trust store, never from what the peer claims
+	if key, err := crypto.DecodeKey(txt["pk"]); err == nil {
+		s.mu.RLock()
+		trust := s.trust
+		s.mu.RUnlock()
+
+		peer.PublicKey = crypto.EncodeKey(key)
+		peer.Fingerprint = crypto.Fingerprint(key)
+		peer.Trusted = trust.IsTrusted(key)
+	}
+
+	// Filtered peers are dropped here, before the spoof check compares
+	// them with every trusted peer
+	if !s.registry.Admits(peer) {
+		s.logger.Debug("Ignoring filtered peer", "peerId", peer.ID, "peer", peer.Name)
+		return nil
 	}
 
+	s.flagSpoof(peer)
 	return peer
 }
 
+// flagSpoof marks a peer whose name hides invisible characters or imitates
+// a trusted peer's name or alias, so UIs can warn before pairing
+func (s *Service) flagSpoof(peer *peers.Peer) {
+	if reason := names.Suspicious(peer.Name); reason != "" {
+		peer.PossibleSpoof = true
+		peer.SpoofReason = reason
+	}
+
+	s.mu.RLock()
+	trust := s.trust
+	s.mu.RUnlock()
+
+	var known []names.Known
+	if trust != nil {
+		for _, entry := range trust.List() {
+			known = append(known, names.Known{Name: entry.Name, Fingerprint: entry.Fingerprint})
+		}
+	}
+	for _, p := range s.registry.GetAll() {
+		if !p.Trusted {
+			continue
+		}
+		known = append(known, names.Known{Name: p.Name, Fingerprint: p.Fingerprint})
+		if p.Alias != "" {
+			known = append(known, names.Known{Name: p.Alias, Fingerprint: p.Fingerprint})
+		}
+	}
+
+	if match, ok := names.Lookalike(peer.Name, peer.Fingerprint, known); ok {
+		peer.PossibleSpoof = true
+		peer.SpoofReason = "name looks like a trusted peer's"
+		peer.SpoofOf = &peers.SpoofOf{Name: match.Name, Fingerprint: match.Fingerprint}
+	}
+}
+
+// readTXT reads a peer's TXT records as the newest schema they carry that
+// we know: schema 2 fields take precedence over the legacy fields they
+// share a name with, and fields it doesn't set keep their legacy value. It
+// returns the fields by unprefixed name and the schema the peer announces.
+func readTXT(records []string) (map[string]string, int) {
+	txt := parseTXT(records)
+	schema, err := strconv.Atoi(txt[schemaKey])
+	if err != nil || schema < SchemaLegacy {
+		schema = SchemaLegacy
+	}
+	if schema < SchemaV2 {
+		return txt, schema
+	}
+	legacy := make(map[string]string, len(txt))
+	for key, value := range txt {
+		if !strings.HasPrefix(key, v2Prefix) {
+			legacy[key] = value
+		}
+	}
+	for key, value := range txt {
+		if name := strings.TrimPrefix(key, v2Prefix); name != key && name != "" {
+			legacy[name] = value
+		}
+	}
+	return legacy, schema
+}
+
 // parseTXT converts zeroconf TXT records into a key/value map.
 func parseTXT(records []string) map[string]string {
 	values := make(map[string]string, len(records))
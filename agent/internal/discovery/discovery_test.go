@@ -0,0 +1,301 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+	"github.com/zeropr/agent/internal/config"
+	"github.com/zeropr/agent/internal/events"
+	"github.com/zeropr/agent/internal/peers"
+	"go.uber.org/goleak"
+)
+
+// TestMain fails the package's tests if any leaves a goroutine running
+func TestMain(m *testing.M) {
+	goleak.VerifyTestMain(m)
+}
+
+// fakeDaemon answers each browse with the same entries, then closes the
+// channel once the browse's context ends, as the system daemons do
+type fakeDaemon struct {
+	entries []*zeroconf.ServiceEntry
+}
+
+func (d *fakeDaemon) Name() string { return "fake" }
+
+func (d *fakeDaemon) Publish(string, int, []string) (publisher, error) {
+	return nil, fmt.Errorf("fake daemon doesn't publish")
+}
+
+func (d *fakeDaemon) Browse(ctx context.Context, entries chan<- *zeroconf.ServiceEntry) error {
+	go func() {
+		defer close(entries)
+		for _, entry := range d.entries {
+			select {
+			case entries <- entry:
+			case <-ctx.Done():
+				return
+			}
+		}
+		<-ctx.Done()
+	}()
+	return nil
+}
+
+func (d *fakeDaemon) Close() error { return nil }
+
+func newTestService(t *testing.T) (*Service, *peers.Registry) {
+	t.Helper()
+	cfg, err := config.Load([]string{"-state-dir", t.TempDir(), "-name", "test-agent"}, func(string) (string, bool) { return "", false })
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := peers.NewRegistry(events.NewBus())
+	s, err := NewService(cfg, registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	t.Cleanup(s.Stop)
+	return s, registry
+}
+
+func peerEntry(instance string, port int) *zeroconf.ServiceEntry {
+	entry := zeroconf.NewServiceEntry(instance, serviceType, domain)
+	entry.AddrIPv4 = []net.IP{net.ParseIP("192.0.2.10")}
+	entry.Port = port
+	entry.Text = []string{"status=editing"}
+	return entry
+}
+
+// cancelAfter ends s's browsing after wait, as Stop does
+func cancelAfter(s *Service, wait time.Duration) {
+	time.AfterFunc(wait, s.cancel)
+}
+
+func TestBrowseCyclesEndCleanly(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	for cycle := 0; cycle < 5; cycle++ {
+		s, registry := newTestService(t)
+		s.daemon = &fakeDaemon{entries: []*zeroconf.ServiceEntry{
+			peerEntry("alice", 7001),
+			peerEntry("bob", 7002),
+		}}
+		cancelAfter(s, 50*time.Millisecond)
+
+		done := make(chan struct{})
+		go func() {
+			s.browse()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("cycle %d: browse didn't return once cancelled", cycle)
+		}
+		if n := registry.Count(); n != 2 {
+			t.Errorf("cycle %d: %d peers listed, want 2", cycle, n)
+		}
+	}
+}
+
+func TestBrowseEndsWhenEntriesClose(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	s, _ := newTestService(t)
+	s.daemon = &closingDaemon{}
+	done := make(chan struct{})
+	go func() {
+		s.browse()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("browse didn't return when the daemon closed its entries early")
+	}
+}
+
+// closingDaemon has nothing to say and closes entries at once, as a daemon
+// answering from its cache does
+type closingDaemon struct{ fakeDaemon }
+
+func (d *closingDaemon) Browse(_ context.Context, entries chan<- *zeroconf.ServiceEntry) error {
+	close(entries)
+	return nil
+}
+
+func TestResolverBrowseEndsCleanly(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	// A fresh resolver per cycle; each must shut down with its browse.
+	// Without a multicast interface the cycles end before browsing.
+	for cycle := 0; cycle < 3; cycle++ {
+		s, _ := newTestService(t)
+		cancelAfter(s, 50*time.Millisecond)
+		s.browse()
+	}
+}
+
+func TestRediscoveryKeepsPresence(t *testing.T) {
+	s, registry := newTestService(t)
+	entry := peerEntry("alice", 7001)
+	entry.Text = []string{"status=editing", "activeFile=main.go", "branch=main"}
+	peer := s.buildPeer(entry)
+	s.mergePeer(peer, parseTXT(entry.Text))
+	registry.RecordHealth(peer.ID, peers.HealthResult{State: peers.StateAway})
+
+	// An answer without the presence fields, say from another interface,
+	// refreshes the peer but leaves what it didn't carry
+	bare := peerEntry("alice", 7001)
+	bare.Text = []string{"status=idle"}
+	s.mergePeer(s.buildPeer(bare), parseTXT(bare.Text))
+	got, _ := registry.Get(peer.ID)
+	if got.Status != "idle" || got.ActiveFile != "main.go" || got.Branch != "main" || got.ConnectionState != peers.StateAway {
+		t.Errorf("peer after re-discovery %+v", got)
+	}
+	if got.LastSeen.Before(peer.LastSeen) {
+		t.Errorf("last seen went back from %v to %v", peer.LastSeen, got.LastSeen)
+	}
+}
+
+func TestIncompatiblePeerIsFlagged(t *testing.T) {
+	s, registry := newTestService(t)
+	entry := peerEntry("future", 7001)
+	entry.Text = append(entry.Text, "proto=0.2.0", "version=0.2.0")
+	peer := s.buildPeer(entry)
+	s.mergePeer(peer, parseTXT(entry.Text))
+
+	// Listed, so the UI can warn, but marked as one we can't sync with
+	got, ok := registry.Get(peer.ID)
+	if !ok || !got.Incompatible || got.IncompatibleReason != peers.IncompatibleProtocol || got.ProtocolVersion != "0.2.0" || got.Version != "0.2.0" {
+		t.Errorf("peer %+v", got)
+	}
+}
+
+func TestFilteredPeersAreDropped(t *testing.T) {
+	s, registry := newTestService(t)
+	registry.SetFilter(peers.Filter{Block: []string{"mallory"}})
+	if peer := s.buildPeer(peerEntry("mallory", 7001)); peer != nil {
+		t.Errorf("built blocked peer %+v", peer)
+	}
+	if peer := s.buildPeer(peerEntry("alice", 7002)); peer == nil {
+		t.Error("an unblocked peer was dropped")
+	}
+
+	registry.SetFilter(peers.Filter{Allow: []string{"192.0.2.10"}})
+	if peer := s.buildPeer(peerEntry("anyone", 7003)); peer == nil {
+		t.Error("a peer allowed by address was dropped")
+	}
+}
+
+func TestReadTXT(t *testing.T) {
+	tests := []struct {
+		name    string
+		records []string
+		want    map[string]string
+		schema  int
+	}{
+		{"legacy", []string{"repoHash=abc", "v2.repoHash=def"}, map[string]string{"repoHash": "abc", "v2.repoHash": "def"}, SchemaLegacy},
+		{"schema 2 over legacy", []string{"schema=2", "repoHash=abc", "v2.repoHash=def", "branch=main"},
+			map[string]string{"schema": "2", "repoHash": "def", "branch": "main"}, SchemaV2},
+		{"schema 2 field only", []string{"schema=2", "v2.repos=abc,def"}, map[string]string{"schema": "2", "repos": "abc,def"}, SchemaV2},
+		{"a schema we can't read", []string{"schema=x", "status=idle"}, map[string]string{"schema": "x", "status": "idle"}, SchemaLegacy},
+	}
+	for _, tt := range tests {
+		got, schema := readTXT(tt.records)
+		if schema != tt.schema || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: %v, schema %d", tt.name, got, schema)
+		}
+	}
+}
+
+func TestAnnounceSchema2(t *testing.T) {
+	s, _ := newTestService(t)
+	s.SetTXTFields(map[string]string{"repoHash": "abc", "status": "idle"})
+	s.SetTXTv2(map[string]string{"repoHash": "abc", "repos": "abc,def"})
+
+	// A field the same in both schemas is announced once
+	txt := strings.Join(s.TXTRecords(), " ")
+	for _, record := range []string{"schema=2", "repoHash=abc", "v2.repos=abc,def"} {
+		if !strings.Contains(txt, record) {
+			t.Errorf("%s not announced in %s", record, txt)
+		}
+	}
+	if strings.Contains(txt, "v2.repoHash") {
+		t.Errorf("an unchanged field was announced twice: %s", txt)
+	}
+
+	// Schema 2 fields that would take the record past the budget are left
+	// for the legacy ones to stand in for
+	big := make(map[string]string)
+	for i := 0; i < 10; i++ {
+		big[fmt.Sprintf("f%d", i)] = strings.Repeat("x", 200)
+	}
+	s.SetTXTv2(big)
+	size := 0
+	for _, record := range s.TXTRecords() {
+		size += 1 + len(record)
+	}
+	if size > maxTXTTotal || !strings.Contains(strings.Join(s.TXTRecords(), " "), "v2.f0=") {
+		t.Errorf("announced %d bytes of TXT", size)
+	}
+
+	// What we announce reads back as schema 2, and peers say so
+	peer := s.buildPeer(&zeroconf.ServiceEntry{ServiceRecord: *zeroconf.NewServiceRecord("alice", serviceType, domain),
+		AddrIPv4: []net.IP{net.ParseIP("192.0.2.10")}, Port: 7001, Text: s.TXTRecords()})
+	if peer == nil || peer.AnnounceSchema != SchemaV2 || peer.RepoHash != "abc" {
+		t.Errorf("peer from our announcement %+v", peer)
+	}
+	if legacy := s.buildPeer(peerEntry("bob", 7002)); legacy.AnnounceSchema != SchemaLegacy {
+		t.Errorf("an older agent announces schema %d", legacy.AnnounceSchema)
+	}
+}
+
+func TestDisplayNameListed(t *testing.T) {
+	s, registry := newTestService(t)
+	for display, want := range map[string]string{
+		"Zoë's MBP": "Zoë's MBP",
+		"🚀 rocket":  "🚀 rocket",
+		"山田のMac":    "山田のMac",
+		"":          "zoe-mbp", // an older agent
+		"zo​e-mbp":  "zoe-mbp", // hides a zero-width space
+		"а́́́":      "zoe-mbp",
+	} {
+		entry := peerEntry("zoe-mbp", 7001)
+		if display != "" {
+			entry.Text = append(entry.Text, "display="+display)
+		}
+		peer := s.buildPeer(entry)
+		if peer.Name != want {
+			t.Errorf("display=%q listed as %q, want %q", display, peer.Name, want)
+		}
+		// The instance name is kept aside only when it isn't the name shown
+		if listedByDisplay := want != "zoe-mbp"; (peer.Instance == "zoe-mbp") != listedByDisplay {
+			t.Errorf("display=%q has instance %q", display, peer.Instance)
+		}
+	}
+
+	// Its short ID and the filters still go by the instance name
+	plain := s.buildPeer(peerEntry("zoe-mbp", 7001))
+	registry.Add(plain)
+	entry := peerEntry("zoe-mbp", 7001)
+	entry.Text = append(entry.Text, "display=Zoë's MBP")
+	s.mergePeer(s.buildPeer(entry), parseTXT(entry.Text))
+	if peer, _ := registry.Get(plain.ID); peer.Name != "Zoë's MBP" || peer.ShortID != plain.ShortID {
+		t.Errorf("after the display name was announced %+v, short ID was %s", peer, plain.ShortID)
+	}
+	registry.SetFilter(peers.Filter{Block: []string{"zoe-mbp"}})
+	if peer := s.buildPeer(entry); peer != nil {
+		t.Errorf("a peer blocked by instance name was listed as %q", peer.Name)
+	}
+}
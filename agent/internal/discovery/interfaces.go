@@ -0,0 +1,197 @@
+package discovery
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	ifacePoll   = time.Second      // how often interfaces are checked for changes
+	ifaceSettle = 3 * time.Second  // how long a change must hold before we re-announce
+	addrLinger  = 30 * time.Second // how long a vanished address still counts as ours
+)
+
+// localAddrs lists the non-loopback addresses of interfaces that are up
+func localAddrs() (ipv4, ipv6 map[string]struct{}, err error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ipv4 = make(map[string]struct{})
+	ipv6 = make(map[string]struct{})
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+
+		for _, addr := range addrs {
+			var ip net.IP
+			switch v := addr.(type) {
+			case *net.IPNet:
+				ip = v.IP
+			case *net.IPAddr:
+				ip = v.IP
+			default:
+				continue
+			}
+
+			if ip == nil || ip.IsLoopback() || ip.IsUnspecified() {
+				continue
+			}
+
+			if ipv4Addr := ip.To4(); ipv4Addr != nil {
+				ipv4[ipv4Addr.String()] = struct{}{}
+				continue
+			}
+
+			if ipv6Addr := ip.To16(); ipv6Addr != nil {
+				ipv6[ipv6Addr.String()] = struct{}{}
+			}
+		}
+	}
+	return ipv4, ipv6, nil
+}
+
+// updateLocalAddrs refreshes the set of local IP addresses for self-identification.
+// An address that disappears still counts as ours for addrLinger, so an
+// adapter cycling down and up (vEthernet on WSL2 and Docker Desktop) doesn't
+// make our own announcement look like another agent's.
+func (s *Service) updateLocalAddrs() {
+	ipv4, ipv6, err := localAddrs()
+	if err != nil {
+		s.logger.Warn("Failed to list network interfaces", "err", err)
+		return
+	}
+	s.applyLocalAddrs(ipv4, ipv6, time.Now())
+}
+
+// applyLocalAddrs records the addresses present at now, adding those seen
+// within addrLinger
+func (s *Service) applyLocalAddrs(ipv4, ipv6 map[string]struct{}, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.addrSeen == nil {
+		s.addrSeen = make(map[string]time.Time)
+	}
+	for addr := range ipv4 {
+		s.addrSeen[addr] = now
+	}
+	for addr := range ipv6 {
+		s.addrSeen[addr] = now
+	}
+	for addr, seen := range s.addrSeen {
+		switch {
+		case now.Sub(seen) > addrLinger:
+			delete(s.addrSeen, addr)
+		case strings.Contains(addr, ":"):
+			ipv6[addr] = struct{}{}
+		default:
+			ipv4[addr] = struct{}{}
+		}
+	}
+
+	s.localIPv4 = ipv4
+	s.localIPv6 = ipv6
+}
+
+// settler applies hysteresis to a changing value: a change is acted on only
+// once the value has held for settle, so a burst of flaps ends in at most
+// one reaction and flapping back to the original value in none
+type settler struct {
+	settle  time.Duration
+	applied string
+	pending string
+	since   time.Time
+}
+
+// observe records value at now and reports whether a change has settled
+func (t *settler) observe(value string, now time.Time) bool {
+	switch {
+	case value == t.applied:
+		t.since = time.Time{}
+		return false
+	case t.since.IsZero() || value != t.pending:
+		t.pending, t.since = value, now
+		return false
+	case now.Sub(t.since) < t.settle:
+		return false
+	}
+	t.applied = value
+	t.since = time.Time{}
+	return true
+}
+
+// addrSignature renders an address set for comparison
+func addrSignature(ipv4, ipv6 map[string]struct{}) string {
+	addrs := append(sortedKeys(ipv4), sortedKeys(ipv6)...)
+	sort.Strings(addrs)
+	return strings.Join(addrs, ",")
+}
+
+// watchInterfaces follows interface changes until the service is stopped.
+// Any change marks the local addresses stale for the browse loop at once;
+// only a change that has settled re-registers the broadcast.
+func (s *Service) watchInterfaces() {
+	ticker := time.NewTicker(ifacePoll)
+	defer ticker.Stop()
+
+	var last string
+	if ipv4, ipv6, err := localAddrs(); err == nil {
+		last = addrSignature(ipv4, ipv6)
+	}
+	settled := settler{settle: ifaceSettle, applied: last}
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case now := <-ticker.C:
+			ipv4, ipv6, err := localAddrs()
+			if err != nil {
+				continue
+			}
+			signature := addrSignature(ipv4, ipv6)
+			if signature != last {
+				last = signature
+				s.addrsChanged.Store(true)
+			}
+			if settled.observe(signature, now) {
+				s.logger.Info("Network interfaces changed; re-announcing", "addrs", signature)
+				s.updateLocalAddrs()
+				s.reannounce()
+				// Peers on the new network are worth finding now, not after the pause
+				s.Refresh()
+			}
+		}
+	}
+}
+
+// reannounce re-registers the broadcast so it covers the interfaces as they
+// are now; zeroconf only joins the multicast groups present at registration
+func (s *Service) reannounce() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The system daemon follows interface changes itself
+	if !s.broadcasting || s.server == nil || s.daemon != nil {
+		return
+	}
+
+	server, err := s.register(s.buildTXT())
+	if err != nil {
+		s.logger.Warn("Failed to re-announce after interface change", "err", err)
+		return
+	}
+	s.server.Shutdown()
+	s.server = server
+	s.announced = time.Now()
+}
@@ -0,0 +1,92 @@
+package discovery
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+)
+
+func TestSettlerFlapping(t *testing.T) {
+	start := time.Now()
+	at := func(ms int) time.Time { return start.Add(time.Duration(ms) * time.Millisecond) }
+
+	tests := []struct {
+		name     string
+		sequence []string // one observation every 500ms
+		settled  []int    // the observations reported as settled changes
+	}{
+		{"steady", []string{"a", "a", "a", "a"}, nil},
+		{"flaps back", []string{"a+b", "a", "a+b", "a", "a+b", "a", "a", "a", "a", "a", "a", "a"}, nil},
+		{"burst then holds", []string{"a+b", "a", "a+b", "a+c", "a+b", "a+b", "a+b", "a+b", "a+b", "a+b", "a+b", "a+b", "a+b", "a+b"}, []int{10}},
+		{"two changes", []string{"b", "b", "b", "b", "b", "b", "b", "c", "c", "c", "c", "c", "c", "c"}, []int{6, 13}},
+	}
+	for _, tt := range tests {
+		settled := settler{settle: ifaceSettle, applied: "a"}
+		var got []int
+		for i, value := range tt.sequence {
+			if settled.observe(value, at(i*500)) {
+				got = append(got, i)
+			}
+		}
+		if len(got) != len(tt.settled) || (len(got) > 0 && got[0] != tt.settled[0]) || (len(got) > 1 && got[1] != tt.settled[1]) {
+			t.Errorf("%s: settled at %v, want %v", tt.name, got, tt.settled)
+		}
+	}
+}
+
+func TestLocalAddrsLinger(t *testing.T) {
+	s, _ := newTestService(t)
+	now := time.Now()
+	set := func(addrs ...string) map[string]struct{} {
+		m := make(map[string]struct{})
+		for _, addr := range addrs {
+			m[addr] = struct{}{}
+		}
+		return m
+	}
+
+	// A vEthernet adapter cycles away and back; its address stays ours
+	s.applyLocalAddrs(set("192.0.2.1", "172.20.0.1"), set("fe80::1"), now)
+	s.applyLocalAddrs(set("192.0.2.1"), set(), now.Add(5*time.Second))
+	if _, ok := s.localIPv4["172.20.0.1"]; !ok {
+		t.Error("a briefly vanished address no longer counts as ours")
+	}
+	if _, ok := s.localIPv6["fe80::1"]; !ok {
+		t.Error("a briefly vanished IPv6 address no longer counts as ours")
+	}
+
+	s.applyLocalAddrs(set("192.0.2.1"), set(), now.Add(addrLinger+time.Second))
+	if _, ok := s.localIPv4["172.20.0.1"]; ok || len(s.localIPv6) != 0 {
+		t.Errorf("addresses gone for longer than %v still count: %v %v", addrLinger, s.localIPv4, s.localIPv6)
+	}
+}
+
+func TestSelfFromUnknownAddress(t *testing.T) {
+	s, registry := newTestService(t)
+	s.SetTXT("pk", "our-key")
+
+	// Our own announcement, arriving from an adapter that just came up,
+	// under an instance name and port that aren't ours either
+	self := zeroconf.NewServiceEntry("renamed", serviceType, domain)
+	self.AddrIPv4 = []net.IP{net.ParseIP("198.51.100.7")}
+	self.Port = 9999
+	self.Text = s.TXTRecords()
+	if !s.isSelf(self) {
+		t.Fatal("our announcement from an unknown address wasn't recognized")
+	}
+
+	other := peerEntry("alice", 7001)
+	other.Text = append(other.Text, "pk=their-key")
+	if s.isSelf(other) {
+		t.Error("another agent's announcement was taken for ours")
+	}
+
+	s.daemon = &fakeDaemon{entries: []*zeroconf.ServiceEntry{self, other}}
+	cancelAfter(s, 50*time.Millisecond)
+	s.browse()
+	if peers := registry.GetAll(); len(peers) != 1 || peers[0].Name != "alice" {
+		t.Errorf("listed %d peers after browsing our own announcement", len(peers))
+	}
+}
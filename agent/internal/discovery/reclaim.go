@@ -0,0 +1,89 @@
+package discovery
+
+import (
+	"context"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+	"github.com/zeropr/agent/internal/config"
+)
+
+// reclaimWindow is how long the startup probe listens for announcements a
+// previous run of this agent left behind
+const reclaimWindow = 2 * time.Second
+
+// staleSelf reports whether entry announces our key from an earlier run of
+// this agent, one killed before it could withdraw its announcement
+func (s *Service) staleSelf(entry *zeroconf.ServiceEntry) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	txt := parseTXT(entry.Text)
+	return s.txt["pk"] != "" && txt["pk"] == s.txt["pk"] && txt["boot"] != s.txt["boot"]
+}
+
+// reclaim runs before the first registration: it browses briefly for
+// announcements of our key from a previous run and withdraws any made under
+// another instance name, so peers aren't left listing us twice until the
+// record expires from their caches. One under our own name needs nothing,
+// since registering announces over it with the cache-flush bit set. The
+// system daemon withdraws what it published when we disconnect, so this is
+// only for the built-in responder.
+func (s *Service) reclaim() {
+	s.mu.RLock()
+	skip := s.backend == config.MDNSAvahi || s.daemon != nil || s.txt["pk"] == ""
+	s.mu.RUnlock()
+	if skip {
+		return
+	}
+
+	resolver, err := zeroconf.NewResolver(nil)
+	if err != nil {
+		s.logger.Debug("Skipping the check for stale announcements", "err", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(s.ctx, reclaimWindow)
+	defer cancel()
+	entries := make(chan *zeroconf.ServiceEntry, 16)
+	if err := resolver.Browse(ctx, serviceType, domain, entries); err != nil {
+		s.logger.Debug("Skipping the check for stale announcements", "err", err)
+		return
+	}
+
+	for _, entry := range s.staleInstances(entries) {
+		s.withdraw(entry)
+	}
+}
+
+// staleInstances reads entries until closed and returns the announcements
+// of our key from a previous run that need withdrawing, one per instance
+// name other than our own
+func (s *Service) staleInstances(entries <-chan *zeroconf.ServiceEntry) []*zeroconf.ServiceEntry {
+	var stale []*zeroconf.ServiceEntry
+	seen := make(map[string]bool)
+	for entry := range entries {
+		if !s.staleSelf(entry) {
+			continue
+		}
+		s.logger.Info("Found an announcement left by a previous run", "instance", entry.Instance, "port", entry.Port)
+		if entry.Instance == s.deviceName || seen[entry.Instance] {
+			continue
+		}
+		seen[entry.Instance] = true
+		stale = append(stale, entry)
+	}
+	return stale
+}
+
+// withdraw sends a goodbye for an announcement we no longer stand behind.
+// zeroconf has no call for that alone, but shutting a registration down
+// announces its records with a zero TTL, which tells caches to drop them.
+func (s *Service) withdraw(entry *zeroconf.ServiceEntry) {
+	server, err := zeroconf.Register(entry.Instance, serviceType, domain, entry.Port, entry.Text, nil)
+	if err != nil {
+		s.logger.Warn("Failed to withdraw stale announcement", "instance", entry.Instance, "err", err)
+		return
+	}
+	server.Shutdown()
+	s.logger.Info("Withdrew stale announcement", "instance", entry.Instance)
+}
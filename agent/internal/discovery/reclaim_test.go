@@ -0,0 +1,80 @@
+package discovery
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+)
+
+// previousRun is an announcement of s's key left by an earlier run, under
+// instance
+func previousRun(s *Service, instance string) *zeroconf.ServiceEntry {
+	entry := zeroconf.NewServiceEntry(instance, serviceType, domain)
+	entry.AddrIPv4 = []net.IP{net.ParseIP("192.0.2.1")}
+	entry.Port = 7000
+	entry.Text = []string{"pk=our-key", "boot=1"}
+	return entry
+}
+
+func TestStaleSelf(t *testing.T) {
+	s, _ := newTestService(t)
+	if s.staleSelf(previousRun(s, "test-agent (2)")) {
+		t.Error("an announcement was stale before we had a key")
+	}
+	s.SetTXT("pk", "our-key")
+
+	current := zeroconf.NewServiceEntry("test-agent", serviceType, domain)
+	current.Text = s.TXTRecords()
+	other := peerEntry("alice", 7001)
+	other.Text = append(other.Text, "pk=their-key", "boot=1")
+	for entry, want := range map[*zeroconf.ServiceEntry]bool{
+		previousRun(s, "test-agent (2)"): true,
+		current:                          false,
+		other:                            false,
+	} {
+		if got := s.staleSelf(entry); got != want {
+			t.Errorf("staleSelf(%s %v) = %v", entry.Instance, entry.Text, got)
+		}
+	}
+}
+
+func TestStaleInstances(t *testing.T) {
+	s, _ := newTestService(t)
+	s.SetTXT("pk", "our-key")
+	current := zeroconf.NewServiceEntry("test-agent", serviceType, domain)
+	current.Text = s.TXTRecords()
+
+	entries := make(chan *zeroconf.ServiceEntry, 8)
+	for _, entry := range []*zeroconf.ServiceEntry{
+		previousRun(s, "test-agent (2)"),
+		current,
+		previousRun(s, "test-agent"), // registering over it replaces it
+		peerEntry("alice", 7001),
+		previousRun(s, "test-agent (2)"), // heard again on another interface
+	} {
+		entries <- entry
+	}
+	close(entries)
+
+	stale := s.staleInstances(entries)
+	if len(stale) != 1 || stale[0].Instance != "test-agent (2)" {
+		var names []string
+		for _, entry := range stale {
+			names = append(names, entry.Instance)
+		}
+		t.Errorf("would withdraw %v, want only test-agent (2)", names)
+	}
+}
+
+func TestBrowseSkipsStaleSelf(t *testing.T) {
+	s, registry := newTestService(t)
+	s.SetTXT("pk", "our-key")
+	s.daemon = &fakeDaemon{entries: []*zeroconf.ServiceEntry{previousRun(s, "test-agent (2)"), peerEntry("alice", 7001)}}
+	cancelAfter(s, 50*time.Millisecond)
+	s.browse()
+	if all := registry.GetAll(); len(all) != 1 || all[0].Name != "alice" {
+		t.Errorf("listed %d peers after browsing our previous run's announcement", len(all))
+	}
+}
@@ -0,0 +1,116 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+	"github.com/zeropr/agent/internal/logging"
+)
+
+// SelfTestReport is the outcome of a discovery self-test
+type SelfTestReport struct {
+	Instance     string   // throwaway instance name that was registered
+	LocalIPv4    []string // addresses isSelf treats as ours
+	LocalIPv6    []string
+	RegisterErr  error         // registering the service failed
+	BrowseErr    error         // browsing failed outright
+	Found        bool          // our own announcement came back over multicast
+	FoundAfter   time.Duration // how long that took
+	Announced    []string      // addresses the announcement carried
+	SelfDetected bool          // isSelf recognized the announcement as ours
+	Others       []string      // other agents that answered the browse
+}
+
+// Passed reports whether discovery works end to end on this machine
+func (r *SelfTestReport) Passed() bool {
+	return r.RegisterErr == nil && r.BrowseErr == nil && r.Found && r.SelfDetected
+}
+
+// SelfTest registers a throwaway instance on port, browses for it for up
+// to timeout, and checks that it's recognized as ourselves. Other agents
+// answering the browse are listed as well. Nothing is added to a registry.
+func SelfTest(ctx context.Context, deviceName string, port int, timeout time.Duration) *SelfTestReport {
+	instance := fmt.Sprintf("%s-selftest-%d", deviceName, os.Getpid())
+	s := &Service{
+		deviceName: instance,
+		port:       port,
+		localIPv4:  make(map[string]struct{}),
+		localIPv6:  make(map[string]struct{}),
+		logger:     logging.Component(nil, "discovery"),
+	}
+	s.updateLocalAddrs()
+
+	report := &SelfTestReport{
+		Instance:  instance,
+		LocalIPv4: sortedKeys(s.localIPv4),
+		LocalIPv6: sortedKeys(s.localIPv6),
+	}
+
+	server, err := zeroconf.Register(instance, serviceType, domain, port, []string{"selftest=1"}, nil)
+	if err != nil {
+		report.RegisterErr = err
+		return report
+	}
+	defer server.Shutdown()
+
+	resolver, err := zeroconf.NewResolver(nil)
+	if err != nil {
+		report.BrowseErr = err
+		return report
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	entries := make(chan *zeroconf.ServiceEntry, 16)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		seen := make(map[string]bool)
+		for entry := range entries {
+			if entry.Instance != instance {
+				if !seen[entry.Instance] {
+					seen[entry.Instance] = true
+					report.Others = append(report.Others, fmt.Sprintf("%s (port %d)", entry.Instance, entry.Port))
+				}
+				continue
+			}
+			if report.Found {
+				continue
+			}
+			report.Found = true
+			report.FoundAfter = time.Since(start)
+			report.SelfDetected = s.isSelf(entry)
+			for _, ip := range entry.AddrIPv4 {
+				report.Announced = append(report.Announced, ip.String())
+			}
+			for _, ip := range entry.AddrIPv6 {
+				report.Announced = append(report.Announced, ip.String())
+			}
+		}
+	}()
+
+	if err := resolver.Browse(ctx, serviceType, domain, entries); err != nil {
+		report.BrowseErr = err
+		return report
+	}
+	// The resolver closes entries once the browse times out
+	<-done
+
+	sort.Strings(report.Others)
+	return report
+}
+
+func sortedKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,173 @@
+package events
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// EventGap is delivered with a Gap to a subscriber that missed events
+// because its buffer was full, ahead of the first event it gets again
+const EventGap = "bus.gap"
+
+// Event is a single notification published on the bus
+type Event struct {
+	ID   uint64      `json:"id"`
+	Type string      `json:"type"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+// Gap tells a subscriber it missed every event after LastEventID up to the
+// next one it receives
+type Gap struct {
+	LastEventID uint64 `json:"lastEventId"` // the last event delivered before the gap
+}
+
+// SubscriberStats is the delivery accounting of the subscribers sharing a
+// name
+type SubscriberStats struct {
+	Name        string `json:"name"`
+	Subscribers int    `json:"subscribers"`
+	Queued      int    `json:"queued"`  // events waiting to be read
+	Lagging     int    `json:"lagging"` // subscribers dropping events since a gap
+	Dropped     uint64 `json:"dropped"` // events never delivered, including by subscribers since gone
+}
+
+// Bus fans out events to any number of subscribers
+type Bus struct {
+	subs    map[int]*subscriber
+	dropped map[string]uint64 // subscriber name -> events dropped
+	nextSub int
+	nextID  uint64
+	mu      sync.Mutex
+}
+
+// subscriber is one subscription. Its channel has a slot beyond its buffer
+// so a gap marker always fits behind the events it was too slow for.
+type subscriber struct {
+	name    string
+	ch      chan Event
+	buffer  int
+	last    uint64 // ID of the last event delivered
+	lagging bool   // events were dropped since last
+	marked  bool   // the gap marker for them is queued
+}
+
+// NewBus creates a new event bus
+func NewBus() *Bus {
+	return &Bus{
+		subs:    make(map[int]*subscriber),
+		dropped: make(map[string]uint64),
+	}
+}
+
+// Publish delivers an event to every subscriber. A subscriber whose buffer
+// is full misses the event rather than blocking the publisher, and is sent
+// one EventGap once it has room, so it knows to catch up some other way.
+func (b *Bus) Publish(eventType string, data interface{}) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.nextID++
+	event := Event{
+		ID:   b.nextID,
+		Type: eventType,
+		Time: time.Now(),
+		Data: data,
+	}
+
+	for _, sub := range b.subs {
+		if !sub.deliver(event) {
+			b.dropped[sub.name]++
+		}
+	}
+}
+
+// deliver queues event unless the subscriber is full, in which case it
+// starts lagging and gets a gap marker in the slot kept for one. Only the
+// publisher sends, under the bus lock, so the channel can't fill between
+// checking its length and sending.
+func (s *subscriber) deliver(event Event) bool {
+	if s.lagging && !s.marked {
+		s.marked = s.mark(event.Time)
+	}
+	if (!s.lagging || s.marked) && len(s.ch) < s.buffer {
+		s.ch <- event
+		s.last, s.lagging, s.marked = event.ID, false, false
+		return true
+	}
+	if !s.lagging {
+		s.lagging = true
+		s.marked = s.mark(event.Time)
+	}
+	return false
+}
+
+// mark queues the gap marker if there's room for it
+func (s *subscriber) mark(now time.Time) bool {
+	select {
+	case s.ch <- Event{Type: EventGap, Time: now, Data: Gap{LastEventID: s.last}}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Subscribe registers a new subscriber with the given buffer size; name
+// groups it with others of its kind in Stats. The returned function
+// unsubscribes and closes the channel.
+func (b *Bus) Subscribe(name string, buffer int) (<-chan Event, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	id := b.nextSub
+	b.nextSub++
+
+	ch := make(chan Event, buffer+1)
+	b.subs[id] = &subscriber{name: name, ch: ch, buffer: buffer}
+	if _, ok := b.dropped[name]; !ok {
+		b.dropped[name] = 0
+	}
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, id)
+			b.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// Stats reports delivery accounting by subscriber name, for every name
+// that has subscribed
+func (b *Bus) Stats() []SubscriberStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	byName := make(map[string]*SubscriberStats, len(b.dropped))
+	for name, dropped := range b.dropped {
+		byName[name] = &SubscriberStats{Name: name, Dropped: dropped}
+	}
+	for _, sub := range b.subs {
+		stats := byName[sub.name]
+		stats.Subscribers++
+		stats.Queued += len(sub.ch)
+		if sub.lagging {
+			stats.Lagging++
+		}
+	}
+
+	list := make([]SubscriberStats, 0, len(byName))
+	for _, stats := range byName {
+		list = append(list, *stats)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
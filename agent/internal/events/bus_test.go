@@ -0,0 +1,107 @@
+package events
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// drain reads what's queued on ch without waiting for more
+func drain(ch <-chan Event) []Event {
+	var got []Event
+	for {
+		select {
+		case e := <-ch:
+			got = append(got, e)
+		default:
+			return got
+		}
+	}
+}
+
+func TestStalledSubscriberGetsGap(t *testing.T) {
+	bus := NewBus()
+	slow, cancelSlow := bus.Subscribe("feed", 2)
+	defer cancelSlow()
+	fast, cancelFast := bus.Subscribe("notify", 10)
+	defer cancelFast()
+
+	// The stalled subscriber holds its buffer and one gap marker, however
+	// much is published, and doesn't hold up the publisher
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			bus.Publish("peer.updated", i)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a stalled subscriber blocked Publish")
+	}
+	if len(slow) != 3 || cap(slow) != 3 {
+		t.Fatalf("the stalled subscriber holds %d of %d", len(slow), cap(slow))
+	}
+
+	got := drain(slow)
+	if got[0].ID != 1 || got[1].ID != 2 || got[2].Type != EventGap || got[2].Data != (Gap{LastEventID: 2}) {
+		t.Fatalf("the stalled subscriber got %+v", got)
+	}
+	// Once it has room it gets what follows, with no second marker
+	bus.Publish("peer.updated", "next")
+	if got := drain(slow); len(got) != 1 || got[0].ID != 1001 {
+		t.Errorf("after catching up got %+v", got)
+	}
+	// The other fell behind too, on its own larger buffer
+	if got := drain(fast); len(got) != 11 || got[9].ID != 10 || got[10].Data != (Gap{LastEventID: 10}) {
+		t.Errorf("the other subscriber got %d events", len(got))
+	}
+}
+
+func TestGapMarkedWhenRoomOpens(t *testing.T) {
+	bus := NewBus()
+	ch, cancel := bus.Subscribe("feed", 1)
+	defer cancel()
+
+	// The first missed event queues the marker; later ones queue nothing
+	// more, and reading makes room for what's published next
+	bus.Publish("a", nil)
+	bus.Publish("b", nil)
+	bus.Publish("c", nil)
+	if got := drain(ch); len(got) != 2 || got[0].Type != "a" || got[1].Type != EventGap {
+		t.Fatalf("got %+v", got)
+	}
+	bus.Publish("d", nil)
+	if got := drain(ch); len(got) != 1 || got[0].Type != "d" {
+		t.Errorf("after reading got %+v", got)
+	}
+}
+
+func TestStats(t *testing.T) {
+	bus := NewBus()
+	_, cancelA := bus.Subscribe("feed", 1)
+	_, cancelB := bus.Subscribe("feed", 5)
+	_, cancelC := bus.Subscribe("notify", 5)
+	defer cancelB()
+	defer cancelC()
+	for i := 0; i < 3; i++ {
+		bus.Publish("x", i)
+	}
+
+	want := []SubscriberStats{
+		{Name: "feed", Subscribers: 2, Queued: 2 + 3, Lagging: 1, Dropped: 2},
+		{Name: "notify", Subscribers: 1, Queued: 3},
+	}
+	if got := bus.Stats(); !reflect.DeepEqual(got, want) {
+		t.Errorf("stats %+v, want %+v", got, want)
+	}
+
+	// What a subscriber since gone dropped still counts
+	cancelA()
+	cancelA()
+	want[0] = SubscriberStats{Name: "feed", Subscribers: 1, Queued: 3, Dropped: 2}
+	if got := bus.Stats(); !reflect.DeepEqual(got, want) {
+		t.Errorf("stats after unsubscribing %+v, want %+v", got, want)
+	}
+}
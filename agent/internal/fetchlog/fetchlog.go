@@ -0,0 +1,143 @@
+// Package fetchlog records the files peers fetch from this agent and
+// whether anyone was at the keyboard when they did, so the user can see
+// afterwards what was taken while they were away.
+package fetchlog
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// EventAwaySummary is published with a Summary when the user comes back
+// to their editor, or do-not-disturb ends, and peers fetched files in the
+// meantime
+const EventAwaySummary = "fetches.away"
+
+// EventFetchRecorded is published with the Entry of each fetch recorded
+const EventFetchRecorded = "fetches.recorded"
+
+// DefaultCapacity is how many fetches the log keeps, oldest dropped first
+const DefaultCapacity = 500
+
+// Entry is one file a peer fetched. Unattended is decided when the request
+// arrives and stored with the entry; it isn't recomputed later.
+type Entry struct {
+	At           time.Time `json:"at"`
+	Peer         string    `json:"peer"` // the name the peer was trusted under
+	Fingerprint  string    `json:"fingerprint"`
+	Repo         string    `json:"repo,omitempty"`
+	Path         string    `json:"path"`
+	Unattended   bool      `json:"unattended"`             // nobody was at the keyboard
+	DoNotDisturb bool      `json:"doNotDisturb,omitempty"` // the user was in do-not-disturb
+}
+
+// PeerFetches is what one peer fetched while the user was away or in
+// do-not-disturb
+type PeerFetches struct {
+	Peer        string    `json:"peer"`
+	Fingerprint string    `json:"fingerprint"`
+	Files       []string  `json:"files"` // distinct paths, first fetched first
+	Fetches     int       `json:"fetches"`
+	Last        time.Time `json:"last"`
+}
+
+// Summary aggregates the fetches held back since the user was last back:
+// those made unattended or during do-not-disturb
+type Summary struct {
+	Since   time.Time     `json:"since"` // when the user was last back; zero before the first return
+	Fetches int           `json:"fetches"`
+	Peers   []PeerFetches `json:"peers"` // most recent first
+}
+
+// Log keeps the most recent fetches in memory
+type Log struct {
+	entries  []Entry // oldest first
+	capacity int
+	returned time.Time // when the user last came back
+	mu       sync.Mutex
+}
+
+// New creates a log keeping up to capacity fetches
+func New(capacity int) *Log {
+	if capacity <= 0 {
+		capacity = DefaultCapacity
+	}
+	return &Log{capacity: capacity}
+}
+
+// Record adds a fetch
+func (l *Log) Record(entry Entry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = append(l.entries, entry)
+	if len(l.entries) > l.capacity {
+		l.entries = append([]Entry(nil), l.entries[len(l.entries)-l.capacity:]...)
+	}
+}
+
+// Entries returns the fetches kept, newest first, only the unattended ones
+// when unattendedOnly is set
+func (l *Log) Entries(unattendedOnly bool) []Entry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entries := make([]Entry, 0, len(l.entries))
+	for i := len(l.entries) - 1; i >= 0; i-- {
+		if !unattendedOnly || l.entries[i].Unattended {
+			entries = append(entries, l.entries[i])
+		}
+	}
+	return entries
+}
+
+// Away summarizes the fetches held back since the user was last back
+func (l *Log) Away() Summary {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.summaryLocked()
+}
+
+// Returned marks the user as back and returns the summary of what was
+// fetched while they were away, which the next one starts after
+func (l *Log) Returned(at time.Time) Summary {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	summary := l.summaryLocked()
+	l.returned = at
+	return summary
+}
+
+func (l *Log) summaryLocked() Summary {
+	summary := Summary{Since: l.returned, Peers: []PeerFetches{}}
+	byPeer := make(map[string]*PeerFetches)
+	for _, entry := range l.entries {
+		if !(entry.Unattended || entry.DoNotDisturb) || !entry.At.After(l.returned) {
+			continue
+		}
+		summary.Fetches++
+		peer, ok := byPeer[entry.Fingerprint]
+		if !ok {
+			peer = &PeerFetches{Peer: entry.Peer, Fingerprint: entry.Fingerprint, Files: []string{}}
+			byPeer[entry.Fingerprint] = peer
+		}
+		peer.Fetches++
+		peer.Last = entry.At
+		if !contains(peer.Files, entry.Path) {
+			peer.Files = append(peer.Files, entry.Path)
+		}
+	}
+	for _, peer := range byPeer {
+		summary.Peers = append(summary.Peers, *peer)
+	}
+	sort.Slice(summary.Peers, func(i, j int) bool { return summary.Peers[i].Last.After(summary.Peers[j].Last) })
+	return summary
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,56 @@
+package fetchlog
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEntries(t *testing.T) {
+	l := New(3)
+	for i, unattended := range []bool{true, false, true, false} {
+		l.Record(Entry{Path: string(rune('a' + i)), Unattended: unattended})
+	}
+	var paths []string
+	for _, entry := range l.Entries(false) {
+		paths = append(paths, entry.Path)
+	}
+	if !reflect.DeepEqual(paths, []string{"d", "c", "b"}) {
+		t.Errorf("entries %v, want the newest three, newest first", paths)
+	}
+	if unattended := l.Entries(true); len(unattended) != 1 || unattended[0].Path != "c" {
+		t.Errorf("unattended entries %+v", unattended)
+	}
+}
+
+func TestAway(t *testing.T) {
+	start := time.Now()
+	at := func(minutes int) time.Time { return start.Add(time.Duration(minutes) * time.Minute) }
+	l := New(0)
+	l.Record(Entry{At: at(1), Peer: "alice", Fingerprint: "fp-a", Path: "main.go", Unattended: true})
+	l.Record(Entry{At: at(2), Peer: "bob", Fingerprint: "fp-b", Path: "go.mod", Unattended: true})
+	l.Record(Entry{At: at(3), Peer: "alice", Fingerprint: "fp-a", Path: "main.go", Unattended: true})
+	l.Record(Entry{At: at(4), Peer: "alice", Fingerprint: "fp-a", Path: "util.go", DoNotDisturb: true})
+	l.Record(Entry{At: at(5), Peer: "bob", Fingerprint: "fp-b", Path: "seen.go"}) // someone was there
+
+	summary := l.Away()
+	want := []PeerFetches{
+		{Peer: "alice", Fingerprint: "fp-a", Files: []string{"main.go", "util.go"}, Fetches: 3, Last: at(4)},
+		{Peer: "bob", Fingerprint: "fp-b", Files: []string{"go.mod"}, Fetches: 1, Last: at(2)},
+	}
+	if summary.Fetches != 4 || !summary.Since.IsZero() || !reflect.DeepEqual(summary.Peers, want) {
+		t.Fatalf("summary %+v", summary)
+	}
+
+	// Coming back hands over the summary and starts the next one after it
+	if returned := l.Returned(at(6)); !reflect.DeepEqual(returned, summary) {
+		t.Errorf("Returned gave %+v, want %+v", returned, summary)
+	}
+	l.Record(Entry{At: at(7), Peer: "bob", Fingerprint: "fp-b", Path: "later.go", Unattended: true})
+	if next := l.Away(); next.Fetches != 1 || !next.Since.Equal(at(6)) || len(next.Peers) != 1 || next.Peers[0].Files[0] != "later.go" {
+		t.Errorf("summary after coming back %+v", next)
+	}
+	if len(l.Entries(false)) != 6 {
+		t.Error("coming back dropped entries from the log")
+	}
+}
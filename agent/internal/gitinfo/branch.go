@@ -0,0 +1,79 @@
+package gitinfo
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// shortCommitLength is how much of the commit is shown for a detached HEAD
+const shortCommitLength = 7
+
+// ReadBranch returns the checked-out branch of the repository containing
+// root by parsing .git/HEAD directly. A detached HEAD yields the short commit.
+func ReadBranch(root string) (string, error) {
+	gitDir, err := FindGitDir(root)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := os.ReadFile(filepath.Join(gitDir, "HEAD"))
+	if err != nil {
+		return "", err
+	}
+	head := strings.TrimSpace(string(data))
+
+	if ref, ok := strings.CutPrefix(head, "ref:"); ok {
+		ref = strings.TrimSpace(ref)
+		return strings.TrimPrefix(ref, "refs/heads/"), nil
+	}
+
+	if len(head) > shortCommitLength {
+		head = head[:shortCommitLength]
+	}
+	return head, nil
+}
+
+// Branch returns the cached branch, reading it on first use
+func (r *Repo) Branch() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.branchRead {
+		r.branch, _ = ReadBranch(r.root)
+		r.branchRead = true
+	}
+	return r.branch
+}
+
+// Watch polls .git/HEAD every interval and calls onChange with the new
+// branch whenever it changes, invalidating the cached repo hash first.
+// It returns when ctx is cancelled.
+func (r *Repo) Watch(ctx context.Context, interval time.Duration, onChange func(branch string)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	current := r.Branch()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			branch, err := ReadBranch(r.root)
+			if err != nil || branch == current {
+				continue
+			}
+			current = branch
+
+			r.mu.Lock()
+			r.branch = branch
+			r.branchRead = true
+			r.hash = ""
+			r.mu.Unlock()
+
+			onChange(branch)
+		}
+	}
+}
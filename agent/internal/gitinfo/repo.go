@@ -0,0 +1,173 @@
+package gitinfo
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// hashLength is the number of hex characters advertised for a repo hash
+const hashLength = 16
+
+// ErrNotRepo is returned when no .git directory is found above a path
+var ErrNotRepo = errors.New("not a git repository")
+
+// Repo caches git-derived identity for a working tree
+type Repo struct {
+	root       string
+	hash       string
+	branch     string
+	branchRead bool
+	mu         sync.Mutex
+}
+
+// NewRepo creates a Repo for the working tree at root
+func NewRepo(root string) *Repo {
+	return &Repo{root: root}
+}
+
+// Hash returns a stable identity for the repository so peers working on
+// the same project advertise the same value. It is derived from the origin
+// remote URL when there is one, falling back to a hash of the top-level
+// file listing. The result is cached until Invalidate is called.
+func (r *Repo) Hash() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.hash == "" {
+		r.hash = computeHash(r.root)
+	}
+	return r.hash
+}
+
+// Invalidate drops the cached hash, e.g. after a branch switch
+func (r *Repo) Invalidate() {
+	r.mu.Lock()
+	r.hash = ""
+	r.mu.Unlock()
+}
+
+func computeHash(root string) string {
+	if gitDir, err := FindGitDir(root); err == nil {
+		if url := RemoteURL(gitDir, "origin"); url != "" {
+			return shortHash("remote:" + NormalizeRemote(url))
+		}
+	}
+	return contentHash(root)
+}
+
+// FindGitDir walks up from path to the repository's git directory,
+// following "gitdir:" files used by worktrees and submodules.
+func FindGitDir(path string) (string, error) {
+	dir, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+
+	for {
+		candidate := filepath.Join(dir, ".git")
+		info, err := os.Stat(candidate)
+		if err == nil {
+			if info.IsDir() {
+				return candidate, nil
+			}
+			data, err := os.ReadFile(candidate)
+			if err != nil {
+				return "", err
+			}
+			if target, ok := strings.CutPrefix(strings.TrimSpace(string(data)), "gitdir:"); ok {
+				target = strings.TrimSpace(target)
+				if !filepath.IsAbs(target) {
+					target = filepath.Join(dir, target)
+				}
+				return target, nil
+			}
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", ErrNotRepo
+		}
+		dir = parent
+	}
+}
+
+// RemoteURL reads the URL of the named remote from the repository config
+func RemoteURL(gitDir, remote string) string {
+	f, err := os.Open(filepath.Join(gitDir, "config"))
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	section := `[remote "` + remote + `"]`
+	inSection := false
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") {
+			inSection = line == section
+			continue
+		}
+		if !inSection {
+			continue
+		}
+		if key, value, ok := strings.Cut(line, "="); ok && strings.TrimSpace(key) == "url" {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
+
+// NormalizeRemote reduces equivalent remote URLs (https, ssh, scp-style,
+// with or without .git) to host/path so they hash identically.
+func NormalizeRemote(url string) string {
+	url = strings.TrimSpace(url)
+	if _, rest, ok := strings.Cut(url, "://"); ok {
+		url = rest
+	} else if host, path, ok := strings.Cut(url, ":"); ok && !strings.Contains(host, "/") {
+		// scp-style git@host:owner/repo
+		url = host + "/" + path
+	}
+	if at := strings.LastIndex(url, "@"); at >= 0 && at < strings.Index(url+"/", "/") {
+		url = url[at+1:]
+	}
+	url = strings.TrimSuffix(strings.TrimSuffix(url, "/"), ".git")
+
+	host, path, _ := strings.Cut(url, "/")
+	// Drop an explicit port, which differs between ssh and https remotes
+	if h, _, ok := strings.Cut(host, ":"); ok {
+		host = h
+	}
+	return strings.ToLower(host) + "/" + path
+}
+
+// contentHash hashes the sorted top-level entries of root as a last resort
+func contentHash(root string) string {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return shortHash("path:" + root)
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Name() == ".git" {
+			continue
+		}
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+	return shortHash("content:" + strings.Join(names, "\n"))
+}
+
+func shortHash(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])[:hashLength]
+}
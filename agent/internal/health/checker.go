@@ -0,0 +1,189 @@
+package health
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/zeropr/agent/internal/events"
+	"github.com/zeropr/agent/internal/logging"
+	"github.com/zeropr/agent/internal/peerclient"
+	"github.com/zeropr/agent/internal/peers"
+)
+
+// EventStateChanged is published whenever a peer's connection state changes
+const EventStateChanged = "peer.state"
+
+// Config controls how peers are probed
+type Config struct {
+	Interval   time.Duration // time between probe rounds; 0 disables checking
+	Timeout    time.Duration // per-request timeout
+	Workers    int           // number of peers probed in parallel
+	SeenWindow time.Duration // how recently mDNS must have seen a peer to count as away
+	Skip       []string      // peer IDs, names, or addresses that are never probed
+}
+
+// StateChange is the payload of EventStateChanged
+type StateChange struct {
+	PeerID string `json:"peerId"`
+	Name   string `json:"name"`
+	From   string `json:"from"`
+	To     string `json:"to"`
+}
+
+// Checker periodically probes known peers and derives their connection state
+type Checker struct {
+	cfg      Config
+	registry *peers.Registry
+	bus      *events.Bus
+	client   *peerclient.Client
+	skip     map[string]struct{}
+	logger   *slog.Logger
+	mu       sync.RWMutex // guards skip
+}
+
+// NewChecker creates a new health checker. Probes go through client so they
+// are signed like every other agent-to-agent call; cfg.Timeout bounds each
+// probe on top of the client's own timeout.
+func NewChecker(cfg Config, registry *peers.Registry, bus *events.Bus, client *peerclient.Client) *Checker {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 3 * time.Second
+	}
+	if cfg.Workers <= 0 {
+		cfg.Workers = 4
+	}
+	if cfg.SeenWindow <= 0 {
+		cfg.SeenWindow = time.Minute
+	}
+
+	return &Checker{
+		cfg:      cfg,
+		registry: registry,
+		bus:      bus,
+		client:   client,
+		skip:     skipSet(cfg.Skip),
+		logger:   logging.Component(nil, "health"),
+	}
+}
+
+// SetSkip replaces the peers that are never probed, from the next round on
+func (c *Checker) SetSkip(skip []string) {
+	set := skipSet(skip)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.skip = set
+}
+
+func skipSet(skip []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(skip))
+	for _, s := range skip {
+		set[s] = struct{}{}
+	}
+	return set
+}
+
+// Run probes peers every interval until ctx is cancelled
+func (c *Checker) Run(ctx context.Context) {
+	if c.cfg.Interval <= 0 {
+		c.logger.Info("Peer health checks disabled")
+		return
+	}
+
+	ticker := time.NewTicker(c.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.CheckAll(ctx)
+		}
+	}
+}
+
+// CheckAll runs a single probe round across all known peers
+func (c *Checker) CheckAll(ctx context.Context) {
+	jobs := make(chan *peers.Peer)
+	var wg sync.WaitGroup
+
+	for i := 0; i < c.cfg.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for peer := range jobs {
+				c.check(ctx, peer)
+			}
+		}()
+	}
+
+	for _, peer := range c.registry.GetAll() {
+		select {
+		case jobs <- peer:
+		case <-ctx.Done():
+		}
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// check probes one peer and records its derived state
+func (c *Checker) check(ctx context.Context, peer *peers.Peer) {
+	seen := time.Since(peer.LastSeen) <= c.cfg.SeenWindow
+	result := peers.HealthResult{At: time.Now()}
+
+	switch {
+	case c.skipped(peer):
+		// Static peers on metered links: trust mDNS alone
+		result.State = peers.StateOffline
+		if seen {
+			result.State = peers.StateOnline
+		}
+	default:
+		if rtt, err := c.probe(ctx, peer); err == nil {
+			result.Healthy = true
+			result.RTT = rtt
+			result.State = peers.StateOnline
+		} else if seen {
+			result.State = peers.StateAway
+		} else {
+			result.State = peers.StateOffline
+		}
+	}
+
+	state := result.State
+	prev, ok := c.registry.RecordHealth(peer.ID, result)
+	if !ok || prev == state {
+		return
+	}
+
+	c.logger.Info("Peer state changed", "peerId", peer.ID, "peer", peer.Name, "from", prev, "to", state)
+	c.bus.Publish(EventStateChanged, StateChange{
+		PeerID: peer.ID,
+		Name:   peer.Name,
+		From:   prev,
+		To:     state,
+	})
+}
+
+// probe requests the peer's /api/status and returns the round-trip time
+func (c *Checker) probe(ctx context.Context, peer *peers.Peer) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.cfg.Timeout)
+	defer cancel()
+
+	_, rtt, err := c.client.Status(ctx, peerclient.TargetOf(peer))
+	return rtt, err
+}
+
+// skipped reports whether the peer is configured to never be probed
+func (c *Checker) skipped(peer *peers.Peer) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, key := range []string{peer.ID, peer.Name, peer.Address} {
+		if _, ok := c.skip[key]; ok {
+			return true
+		}
+	}
+	return false
+}
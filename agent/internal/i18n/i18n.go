@@ -0,0 +1,121 @@
+// Package i18n looks up the agent's user-facing strings (error messages,
+// desktop notifications, self-test hints) by stable message ID. Each
+// locale's catalog is embedded from catalogs/<locale>.json; English is the
+// default and stands in for any message a locale doesn't translate. Log
+// lines are for operators and stay in English.
+package i18n
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultLocale is the locale every message is defined in
+const DefaultLocale = "en"
+
+//go:embed catalogs/*.json
+var catalogFiles embed.FS
+
+// catalogs maps a locale to its messages, keyed by message ID
+var catalogs = load()
+
+func load() map[string]map[string]string {
+	files, err := catalogFiles.ReadDir("catalogs")
+	if err != nil {
+		panic(err)
+	}
+
+	loaded := make(map[string]map[string]string, len(files))
+	for _, file := range files {
+		data, err := catalogFiles.ReadFile(path.Join("catalogs", file.Name()))
+		if err != nil {
+			panic(err)
+		}
+		messages := make(map[string]string)
+		if err := json.Unmarshal(data, &messages); err != nil {
+			panic(fmt.Sprintf("i18n: catalog %s: %v", file.Name(), err))
+		}
+		loaded[strings.TrimSuffix(file.Name(), ".json")] = messages
+	}
+	if _, ok := loaded[DefaultLocale]; !ok {
+		panic("i18n: missing the default catalog")
+	}
+	return loaded
+}
+
+// Locales lists the locales with a catalog, sorted
+func Locales() []string {
+	locales := make([]string, 0, len(catalogs))
+	for locale := range catalogs {
+		locales = append(locales, locale)
+	}
+	sort.Strings(locales)
+	return locales
+}
+
+// Lookup returns the catalog locale serving a language tag such as "es" or
+// "es-MX": the tag itself if it has a catalog, otherwise its primary
+// language. ok is false if neither has one.
+func Lookup(tag string) (locale string, ok bool) {
+	tag = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(tag), "_", "-"))
+	if _, ok := catalogs[tag]; ok {
+		return tag, true
+	}
+	primary, _, _ := strings.Cut(tag, "-")
+	if _, ok := catalogs[primary]; ok {
+		return primary, true
+	}
+	return "", false
+}
+
+// Has reports whether the default catalog defines id
+func Has(id string) bool {
+	_, ok := catalogs[DefaultLocale][id]
+	return ok
+}
+
+// Match picks the locale for an Accept-Language header: the supported
+// language the client weights highest, or fallback if it names none
+func Match(acceptLanguage, fallback string) string {
+	best, bestQ := fallback, 0.0
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag, params, _ := strings.Cut(part, ";")
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		if q <= bestQ {
+			continue
+		}
+		if locale, ok := Lookup(tag); ok {
+			best, bestQ = locale, q
+		}
+	}
+	return best
+}
+
+// Text renders message id in locale, falling back to English when the
+// locale doesn't translate it. Arguments fill the message's fmt verbs. An
+// ID missing from every catalog renders as itself, so a mistake shows up
+// rather than an empty message.
+func Text(locale, id string, args ...interface{}) string {
+	format, ok := catalogs[locale][id]
+	if !ok {
+		if format, ok = catalogs[DefaultLocale][id]; !ok {
+			return id
+		}
+	}
+	if len(args) == 0 {
+		return format
+	}
+	return fmt.Sprintf(format, args...)
+}
@@ -0,0 +1,122 @@
+package i18n
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		header, fallback, want string
+	}{
+		{"", "en", "en"},
+		{"", "es", "es"},
+		{"es", "en", "es"},
+		{"es-MX,es;q=0.9,en;q=0.8", "en", "es"},
+		{"ES_mx", "en", "es"},
+		{"fr-FR, de;q=0.9", "en", "en"},    // nothing we have
+		{"fr, es;q=0.5", "en", "es"},       // the best we have
+		{"en;q=0.4, es;q=0.7", "en", "es"}, // weights, not order
+		{"es;q=0, en", "es", "en"},
+		{"es;q=bogus, en", "es", "en"},
+	}
+	for _, tt := range tests {
+		if got := Match(tt.header, tt.fallback); got != tt.want {
+			t.Errorf("Match(%q, %q) = %q, want %q", tt.header, tt.fallback, got, tt.want)
+		}
+	}
+}
+
+func TestText(t *testing.T) {
+	if got := Text("es", MsgInvalidRequest); got != "Solicitud no válida" {
+		t.Errorf("Spanish text %q", got)
+	}
+	if got := Text("es", MsgAliasTooLong, 64); got != "El alias supera los 64 bytes" {
+		t.Errorf("Spanish text with args %q", got)
+	}
+	// A message Spanish doesn't translate, and a locale without a catalog,
+	// fall back to English
+	for id := range catalogs[DefaultLocale] {
+		if _, ok := catalogs["es"][id]; !ok {
+			if got := Text("es", id); got != catalogs[DefaultLocale][id] {
+				t.Errorf("untranslated %s rendered %q", id, got)
+			}
+			break
+		}
+	}
+	if got := Text("fr", MsgInvalidRequest); got != "Invalid request" {
+		t.Errorf("text for a locale without a catalog %q", got)
+	}
+	if got := Text("es", "error.no_such_message"); got != "error.no_such_message" {
+		t.Errorf("unknown message rendered %q", got)
+	}
+}
+
+// messageIDs returns the value of every Msg constant in messages.go
+func messageIDs(t *testing.T) map[string]string {
+	t.Helper()
+	file, err := parser.ParseFile(token.NewFileSet(), "messages.go", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make(map[string]string)
+	ast.Inspect(file, func(n ast.Node) bool {
+		spec, ok := n.(*ast.ValueSpec)
+		if !ok {
+			return true
+		}
+		for i, name := range spec.Names {
+			if lit, ok := spec.Values[i].(*ast.BasicLit); ok && lit.Kind == token.STRING {
+				ids[name.Name], _ = strconv.Unquote(lit.Value)
+			}
+		}
+		return false
+	})
+	return ids
+}
+
+func TestCatalogsCoverMessages(t *testing.T) {
+	ids := messageIDs(t)
+	if len(ids) == 0 {
+		t.Fatal("found no message IDs in messages.go")
+	}
+	defined := make(map[string]bool, len(ids))
+	for name, id := range ids {
+		if !Has(id) {
+			t.Errorf("%s (%s) is missing from the default catalog", name, id)
+		}
+		defined[id] = true
+	}
+	for id := range catalogs[DefaultLocale] {
+		if !defined[id] {
+			t.Errorf("the default catalog's %s has no constant", id)
+		}
+	}
+}
+
+var verb = regexp.MustCompile(`%[-+# 0-9.]*[a-zA-Z%]`)
+
+func TestTranslationsMatchDefault(t *testing.T) {
+	for _, locale := range Locales() {
+		for id, text := range catalogs[locale] {
+			english, ok := catalogs[DefaultLocale][id]
+			if !ok {
+				t.Errorf("%s translates %s, which English doesn't define", locale, id)
+				continue
+			}
+			// The same arguments fill both, so they need the same verbs
+			want, got := verb.FindAllString(english, -1), verb.FindAllString(text, -1)
+			sort.Strings(want)
+			sort.Strings(got)
+			if strings.Join(want, " ") != strings.Join(got, " ") {
+				t.Errorf("%s %s has verbs %v, English %v", locale, id, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package i18n
+
+// Message IDs. They are stable: clients may key their own rendering on
+// them, so a message's wording can change but its ID can't. Every ID must
+// be defined in catalogs/en.json.
+const (
+	// Error responses
+	MsgInvalidRequest       = "error.invalid_request"
+	MsgInvalidRequestBody   = "error.invalid_request_body"
+	MsgMissingPath          = "error.missing_path"
+	MsgUnsupportedSort      = "error.unsupported_sort"
+	MsgAliasTooLong         = "error.alias_too_long"
+	MsgInvalidDecision      = "error.invalid_decision"
+	MsgPairingCodeRequired  = "error.pairing_code_required"
+	MsgInvalidRange         = "error.invalid_range"
+	MsgEncodeFailed         = "error.encode_failed"
+	MsgEncryptFailed        = "error.encrypt_failed"
+	MsgAliasSaveFailed      = "error.alias_save_failed"
+	MsgSessionCreateFailed  = "error.session_create_failed"
+	MsgReconnectIssueFailed = "error.reconnect_issue_failed"
+	MsgBridgeIssueFailed    = "error.bridge_issue_failed"
+	MsgBroadcastFailed      = "error.broadcast_failed"
+	MsgIdentityDisabled     = "error.identity_disabled"
+	MsgTokensDisabled       = "error.tokens_disabled"
+	MsgReloadDisabled       = "error.reload_disabled"
+	MsgRetentionDisabled    = "error.retention_disabled"
+	MsgTLSDisabled          = "error.tls_disabled"
+	MsgMissingToken         = "error.missing_token"
+	MsgInvalidToken         = "error.invalid_token"
+	MsgInsufficientScope    = "error.insufficient_scope"
+	MsgTokenNotFound        = "error.token_not_found"
+	MsgUnsigned             = "error.unsigned"
+	MsgBadSignature         = "error.bad_signature"
+	MsgStaleRequest         = "error.stale_request"
+	MsgUntrustedPeer        = "error.untrusted_peer"
+	MsgStepUpRequired       = "error.step_up_required"
+	MsgPeerBlocked          = "error.peer_blocked"
+	MsgPeerNotFound         = "error.peer_not_found"
+	MsgAmbiguousPeer        = "error.ambiguous_peer_id"
+	MsgPeerNoKey            = "error.peer_no_key"
+	MsgPeerNotTrusted       = "error.peer_not_trusted"
+	MsgTrustNotFound        = "error.trust_not_found"
+	MsgPairingMismatch      = "error.pairing_code_mismatch"
+	MsgPeerUnreachable      = "error.peer_unreachable"
+	MsgPeerRequestFailed    = "error.peer_request_failed"
+	MsgPeerIncompatible     = "error.peer_incompatible"
+	MsgRepoNotFound         = "error.repo_not_found"
+	MsgNoShareRoot          = "error.no_share_root"
+	MsgFileNotFound         = "error.file_not_found"
+	MsgPathForbidden        = "error.path_forbidden"
+	MsgSessionNotFound      = "error.session_not_found"
+	MsgInvalidSessionID     = "error.invalid_session_id"
+	MsgSessionActive        = "error.session_active"
+	MsgSessionFull          = "error.session_full"
+	MsgParticipantExists    = "error.participant_exists"
+	MsgCapBelowOccupancy    = "error.cap_below_occupancy"
+	MsgDocumentsDisabled    = "error.documents_disabled"
+	MsgDocumentUnavailable  = "error.document_unavailable"
+	MsgRecordingDisabled    = "error.recording_disabled"
+	MsgCaptureDecision      = "error.capture_decision"
+	MsgCaptureNotFound      = "error.capture_request_not_found"
+	MsgCaptureFailed        = "error.capture_failed"
+	MsgSessionToken         = "error.session_token"
+	MsgReconnectUnknown     = "error.reconnect_unknown"
+	MsgReconnectExpired     = "error.reconnect_expired"
+	MsgNotParticipant       = "error.not_participant"
+	MsgNotInitiator         = "error.not_initiator"
+	MsgInitiatorRole        = "error.initiator_role"
+	MsgLockNotFound         = "error.lock_not_found"
+	MsgLockConflict         = "error.lock_conflict"
+	MsgFileReadsBusy        = "error.file_reads_busy"
+	MsgTransferNotFound     = "error.transfer_not_found"
+	MsgTransferStartFailed  = "error.transfer_start_failed"
+	MsgTransferNotResumable = "error.transfer_not_resumable"
+	MsgFileChanged          = "error.file_changed"
+	MsgServingDisabled      = "error.serving_disabled"
+	MsgObservingDisabled    = "error.observing_disabled"
+	MsgReadOnly             = "error.read_only"
+	MsgUnattendedUnverified = "error.unattended_unverified"
+	MsgDoNotDisturb         = "error.do_not_disturb"
+	MsgPresenceUntilPast    = "error.presence_until_past"
+	MsgSessionFileTooLarge  = "error.session_file_too_large"
+	MsgStatusMessageLong    = "error.presence_message_long"
+	MsgStatusMessageControl = "error.presence_message_control"
+	MsgEstimateSizeRequired = "error.estimate_size_required"
+
+	// Desktop notifications
+	MsgNotifyPeerTitle      = "notify.peer.title"
+	MsgNotifyPeerNearby     = "notify.peer.nearby"
+	MsgNotifyPeerOnBranch   = "notify.peer.nearby_on_branch"
+	MsgNotifySessionTitle   = "notify.session.title"
+	MsgNotifySessionStarted = "notify.session.started"
+	MsgNotifySomeone        = "notify.session.someone"
+	MsgNotifyHealthTitle    = "notify.health.title"
+	MsgNotifyHealthChanged  = "notify.health.changed"
+	MsgNotifyAwayTitle      = "notify.away.title"
+	MsgNotifyAwayFetched    = "notify.away.fetched"
+
+	// Discovery self-test report
+	MsgSelfTestTitle        = "selftest.title"
+	MsgSelfTestAddresses    = "selftest.addresses"
+	MsgSelfTestNoAddresses  = "selftest.no_addresses"
+	MsgSelfTestRegistered   = "selftest.registered"
+	MsgSelfTestRegisterFail = "selftest.register_failed"
+	MsgSelfTestBrowseFail   = "selftest.browse_failed"
+	MsgSelfTestFound        = "selftest.found"
+	MsgSelfTestRecognized   = "selftest.recognized"
+	MsgSelfTestNotFound     = "selftest.not_found"
+	MsgSelfTestOthers       = "selftest.others"
+	MsgSelfTestResult       = "selftest.result"
+)
@@ -0,0 +1,235 @@
+// Package instance keeps to one agent per state directory and finds ports
+// the agent can listen on. The extension may start an agent while one is
+// already running from a terminal; the second one notices the first and
+// reports it rather than failing halfway through startup.
+package instance
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/zeropr/agent/internal/version"
+)
+
+// lockFile in the state directory names the agent using it
+const lockFile = "agent.lock"
+
+// startupGrace is how long a live process holding the lock counts as an
+// agent still starting up, before it has to answer on its address
+const startupGrace = 15 * time.Second
+
+// Prefixes of the lines written to stdout for whoever launched the agent.
+// Each is followed by a space and the Info as JSON.
+const (
+	LineListening = "ZEROPR_LISTENING" // this agent's ports, with -port-auto
+	LineRunning   = "ZEROPR_RUNNING"   // another agent is already running
+)
+
+// Info describes a running agent: what the lock file holds, and what the
+// stdout lines carry
+type Info struct {
+	PID        int       `json:"pid,omitempty"`
+	Version    string    `json:"version,omitempty"`
+	Listen     string    `json:"listen"`
+	PeerListen string    `json:"peerListen,omitempty"`
+	SyncListen string    `json:"syncListen,omitempty"`
+	HTTPPort   int       `json:"httpPort"`
+	PeerPort   int       `json:"peerPort,omitempty"`
+	WSPort     int       `json:"wsPort,omitempty"`
+	TLS        bool      `json:"tls,omitempty"`
+	StateDir   string    `json:"stateDir,omitempty"`
+	StartedAt  time.Time `json:"startedAt"`
+}
+
+// NewInfo describes this process listening on the given addresses
+func NewInfo(listen, peerListen, syncListen string, tls bool, stateDir string) Info {
+	return Info{
+		PID:        os.Getpid(),
+		Version:    version.Version,
+		Listen:     listen,
+		PeerListen: peerListen,
+		SyncListen: syncListen,
+		HTTPPort:   port(listen),
+		PeerPort:   port(peerListen),
+		WSPort:     port(syncListen),
+		TLS:        tls,
+		StateDir:   stateDir,
+		StartedAt:  time.Now(),
+	}
+}
+
+// WriteLine writes info to w as one machine-readable line starting with prefix
+func WriteLine(w io.Writer, prefix string, info Info) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s %s\n", prefix, data)
+	return err
+}
+
+// RunningError is returned when another agent already runs
+type RunningError struct {
+	Info Info
+}
+
+func (e *RunningError) Error() string {
+	if e.Info.PID != 0 {
+		return fmt.Sprintf("an agent is already running (pid %d, listening on %s)", e.Info.PID, e.Info.Listen)
+	}
+	return fmt.Sprintf("an agent is already listening on %s", e.Info.Listen)
+}
+
+// Lock is this agent's hold on its state directory
+type Lock struct {
+	path string
+}
+
+// Acquire takes the state directory's lock, recording info in it. If the
+// lock names an agent that still answers on its address, or one that is
+// still starting, it returns a *RunningError describing that agent. A lock
+// left behind by an agent that crashed is taken over.
+func Acquire(dir string, info Info) (*Lock, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, lockFile)
+
+	for attempt := 0; attempt < 2; attempt++ {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if err == nil {
+			err = json.NewEncoder(f).Encode(info)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				os.Remove(path)
+				return nil, err
+			}
+			return &Lock{path: path}, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		if held, ok := readLock(path); ok && held.alive() {
+			return nil, &RunningError{Info: held}
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("%s keeps reappearing; is another agent starting?", path)
+}
+
+// Update rewrites the lock with info, once the agent's ports are settled
+func (l *Lock) Update(info Info) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(l.path, append(data, '\n'), 0o600)
+}
+
+// Release removes the lock
+func (l *Lock) Release() error {
+	return os.Remove(l.path)
+}
+
+// readLock reads the agent a lock file names
+func readLock(path string) (Info, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Info{}, false
+	}
+	var info Info
+	if json.Unmarshal(data, &info) != nil {
+		return Info{}, false
+	}
+	return info, true
+}
+
+// alive reports whether the agent a lock names is still running: it
+// answers on its local address, or its process lives and is still within
+// its startup grace
+func (i Info) alive() bool {
+	if i.PID == os.Getpid() {
+		return false
+	}
+	if _, ok := Probe(i.Listen); ok {
+		return true
+	}
+	return time.Since(i.StartedAt) < startupGrace && processAlive(i.PID)
+}
+
+// processAlive reports whether a process with pid exists
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	// On Windows finding the process opens it, which fails once it's gone
+	if runtime.GOOS == "windows" {
+		return true
+	}
+	return p.Signal(syscall.Signal(0)) == nil
+}
+
+// BusyError is returned when a listen address is taken
+type BusyError struct {
+	Addr string
+	Err  error
+}
+
+func (e *BusyError) Error() string {
+	return fmt.Sprintf("%s is in use: %v", e.Addr, e.Err)
+}
+
+func (e *BusyError) Unwrap() error { return e.Err }
+
+// CheckFree binds each non-empty address and lets it go again, returning a
+// *BusyError for the first one that is taken
+func CheckFree(addrs ...string) error {
+	for _, addr := range addrs {
+		if addr == "" {
+			continue
+		}
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			if addrInUse(err) {
+				return &BusyError{Addr: addr, Err: err}
+			}
+			return err
+		}
+		listener.Close()
+	}
+	return nil
+}
+
+// addrInUse reports whether err is a bind to a taken port
+func addrInUse(err error) bool {
+	if errors.Is(err, syscall.EADDRINUSE) {
+		return true
+	}
+	const wsaeaddrinuse = syscall.Errno(10048) // syscall names only the Unix value
+	return runtime.GOOS == "windows" && errors.Is(err, wsaeaddrinuse)
+}
+
+// port returns the port of a host:port address, or 0
+func port(addr string) int {
+	_, p, _ := net.SplitHostPort(addr)
+	n, _ := strconv.Atoi(p)
+	return n
+}
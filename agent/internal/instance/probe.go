@@ -0,0 +1,56 @@
+package instance
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// probeTimeout bounds each attempt to reach an agent
+const probeTimeout = time.Second
+
+// Probe asks whatever listens on addr for /api/status and reports whether
+// it's an agent, and which. It tries HTTP, then HTTPS for agents serving
+// TLS; the status is public, so the certificate isn't checked.
+func Probe(addr string) (Info, bool) {
+	host, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return Info{}, false
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+	target := net.JoinHostPort(host, p)
+
+	client := &http.Client{
+		Timeout: probeTimeout,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, // only reads the public status
+		},
+	}
+	defer client.CloseIdleConnections()
+
+	for _, scheme := range []string{"http", "https"} {
+		resp, err := client.Get(scheme + "://" + target + "/api/status")
+		if err != nil {
+			continue
+		}
+		var status struct {
+			Running   bool      `json:"running"`
+			Version   string    `json:"version"`
+			TLS       bool      `json:"tls"`
+			StartedAt time.Time `json:"startedAt"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&status)
+		resp.Body.Close()
+		if err != nil || !status.Running {
+			continue
+		}
+		n, _ := strconv.Atoi(p)
+		return Info{Version: status.Version, Listen: addr, HTTPPort: n, TLS: status.TLS, StartedAt: status.StartedAt}, true
+	}
+	return Info{}, false
+}
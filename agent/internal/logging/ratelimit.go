@@ -0,0 +1,282 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ComponentKey is the attribute naming the subsystem a log line comes from
+const ComponentKey = "component"
+
+// defaultComponent is used for lines that don't carry a component attribute,
+// such as those bridged from the standard log package
+const defaultComponent = "agent"
+
+// maxTrackedKeys bounds the limiter's memory when messages are high-cardinality
+const maxTrackedKeys = 4096
+
+// RateLimitConfig controls per-component log suppression
+type RateLimitConfig struct {
+	PerMinute  int            // identical messages allowed per minute; 0 disables limiting
+	Components map[string]int // per-component overrides; 0 or less disables limiting for that component
+	Window     time.Duration  // defaults to one minute
+}
+
+// Suppression reports how many lines were dropped for one component/message key
+type Suppression struct {
+	Component  string `json:"component"`
+	Message    string `json:"message"`
+	Suppressed int64  `json:"suppressed"`
+}
+
+// window tracks one key within the current rate-limit window
+type window struct {
+	component  string
+	message    string
+	level      slog.Level
+	start      time.Time
+	count      int
+	suppressed int
+}
+
+// limiter is shared between a handler and every handler derived from it
+type limiter struct {
+	cfg     RateLimitConfig
+	limits  atomic.Pointer[limits] // swapped by SetLimits
+	base    slog.Handler
+	windows map[string]*window
+	totals  map[string]*Suppression
+	mu      sync.Mutex
+}
+
+// RateLimitHandler drops identical messages (keyed by component and message
+// template, never by attributes) above a per-minute limit and periodically
+// logs how many similar lines were suppressed.
+type RateLimitHandler struct {
+	next      slog.Handler
+	component string
+	limiter   *limiter
+}
+
+// NewRateLimitHandler wraps next with per-component rate limiting
+func NewRateLimitHandler(next slog.Handler, cfg RateLimitConfig) *RateLimitHandler {
+	if cfg.Window <= 0 {
+		cfg.Window = time.Minute
+	}
+	l := &limiter{
+		cfg:     cfg,
+		base:    next,
+		windows: make(map[string]*window),
+		totals:  make(map[string]*Suppression),
+	}
+	l.limits.Store(&limits{perMinute: cfg.PerMinute, components: cfg.Components})
+	return &RateLimitHandler{
+		next:      next,
+		component: defaultComponent,
+		limiter:   l,
+	}
+}
+
+// limits are the allowances in force
+type limits struct {
+	perMinute  int
+	components map[string]int
+}
+
+// SetLimits replaces the per-minute allowances while the handler is in
+// use; cfg.Window is ignored. Lines already counted this window still count.
+func (h *RateLimitHandler) SetLimits(cfg RateLimitConfig) {
+	h.limiter.limits.Store(&limits{perMinute: cfg.PerMinute, components: cfg.Components})
+}
+
+// Enabled implements slog.Handler
+func (h *RateLimitHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+// Handle implements slog.Handler
+func (h *RateLimitHandler) Handle(ctx context.Context, r slog.Record) error {
+	component := h.component
+	r.Attrs(func(a slog.Attr) bool {
+		if a.Key == ComponentKey {
+			component = a.Value.String()
+			return false
+		}
+		return true
+	})
+
+	allowed, summary := h.limiter.allow(component, r.Message, r.Level, r.Time)
+	if summary != nil {
+		h.limiter.emit(ctx, summary)
+	}
+	if !allowed {
+		return nil
+	}
+	return h.next.Handle(ctx, r)
+}
+
+// WithAttrs implements slog.Handler
+func (h *RateLimitHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	component := h.component
+	for _, a := range attrs {
+		if a.Key == ComponentKey {
+			component = a.Value.String()
+		}
+	}
+	return &RateLimitHandler{
+		next:      h.next.WithAttrs(attrs),
+		component: component,
+		limiter:   h.limiter,
+	}
+}
+
+// WithGroup implements slog.Handler
+func (h *RateLimitHandler) WithGroup(name string) slog.Handler {
+	return &RateLimitHandler{
+		next:      h.next.WithGroup(name),
+		component: h.component,
+		limiter:   h.limiter,
+	}
+}
+
+// Run flushes suppression summaries for idle keys until ctx is cancelled
+func (h *RateLimitHandler) Run(ctx context.Context) {
+	ticker := time.NewTicker(h.limiter.cfg.Window)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, summary := range h.limiter.expire(now) {
+				h.limiter.emit(context.Background(), summary)
+			}
+		}
+	}
+}
+
+// Suppressions returns cumulative suppression counts, largest first
+func (h *RateLimitHandler) Suppressions() []Suppression {
+	l := h.limiter
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	list := make([]Suppression, 0, len(l.totals))
+	for _, s := range l.totals {
+		list = append(list, *s)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Suppressed > list[j].Suppressed
+	})
+	return list
+}
+
+// limit returns the per-window allowance for component, or 0 for unlimited
+func (l *limiter) limit(component string) int {
+	limits := l.limits.Load()
+	if n, ok := limits.components[component]; ok {
+		return n
+	}
+	return limits.perMinute
+}
+
+// allow counts one line against its key. It returns whether the line may be
+// written and, when the key's previous window ended with suppressed lines,
+// a summary of that window to emit first.
+func (l *limiter) allow(component, message string, level slog.Level, now time.Time) (bool, *window) {
+	max := l.limit(component)
+	if max <= 0 {
+		return true, nil
+	}
+
+	key := component + "\x00" + message
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var summary *window
+	w, ok := l.windows[key]
+	if ok && now.Sub(w.start) >= l.cfg.Window {
+		if w.suppressed > 0 {
+			done := *w
+			summary = &done
+		}
+		delete(l.windows, key)
+		ok = false
+	}
+	if !ok {
+		if len(l.windows) >= maxTrackedKeys {
+			l.evictLocked(now)
+		}
+		w = &window{component: component, message: message, level: level, start: now}
+		l.windows[key] = w
+	}
+
+	w.count++
+	if w.count <= max {
+		return true, summary
+	}
+
+	w.suppressed++
+	total, ok := l.totals[key]
+	if !ok {
+		total = &Suppression{Component: component, Message: message}
+		l.totals[key] = total
+	}
+	total.Suppressed++
+	return false, summary
+}
+
+// expire closes every window that has ended and returns their summaries
+func (l *limiter) expire(now time.Time) []*window {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var summaries []*window
+	for key, w := range l.windows {
+		if now.Sub(w.start) < l.cfg.Window {
+			continue
+		}
+		if w.suppressed > 0 {
+			summaries = append(summaries, w)
+		}
+		delete(l.windows, key)
+	}
+	return summaries
+}
+
+// evictLocked makes room by dropping ended windows, or all windows if none
+// have ended. Their pending summaries are lost, which is acceptable under a
+// flood of distinct messages. l.mu must be held.
+func (l *limiter) evictLocked(now time.Time) {
+	for key, w := range l.windows {
+		if now.Sub(w.start) >= l.cfg.Window {
+			delete(l.windows, key)
+		}
+	}
+	if len(l.windows) >= maxTrackedKeys {
+		l.windows = make(map[string]*window)
+	}
+}
+
+// emit writes a suppression summary straight to the base handler
+func (l *limiter) emit(ctx context.Context, w *window) {
+	level := w.level
+	if level < slog.LevelWarn {
+		level = slog.LevelWarn
+	}
+
+	r := slog.NewRecord(time.Now(), level, fmt.Sprintf("suppressed %d similar messages", w.suppressed), 0)
+	r.AddAttrs(
+		slog.String(ComponentKey, w.component),
+		slog.String("message", w.message),
+		slog.Int("suppressed", w.suppressed),
+	)
+	l.base.Handle(ctx, r)
+}
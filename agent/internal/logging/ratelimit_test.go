@@ -0,0 +1,115 @@
+package logging
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recorder keeps the records it's handed
+type recorder struct {
+	mu      sync.Mutex
+	records []slog.Record
+}
+
+func (r *recorder) Enabled(context.Context, slog.Level) bool { return true }
+
+func (r *recorder) Handle(_ context.Context, record slog.Record) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.records = append(r.records, record)
+	return nil
+}
+
+func (r *recorder) WithAttrs([]slog.Attr) slog.Handler { return r }
+func (r *recorder) WithGroup(string) slog.Handler      { return r }
+
+// messages returns the messages handled so far, and forgets them
+func (r *recorder) messages() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var messages []string
+	for _, record := range r.records {
+		messages = append(messages, record.Message)
+	}
+	r.records = nil
+	return messages
+}
+
+// logAt handles a line with message at the given time
+func logAt(h slog.Handler, at time.Time, message string) {
+	h.Handle(context.Background(), slog.NewRecord(at, slog.LevelInfo, message, 0))
+}
+
+func TestRateLimitPerComponent(t *testing.T) {
+	out := &recorder{}
+	h := NewRateLimitHandler(out, RateLimitConfig{PerMinute: 2, Components: map[string]int{"relay": 1, "discovery": 0}})
+	relay := h.WithAttrs([]slog.Attr{slog.String(ComponentKey, "relay")})
+	discovery := h.WithAttrs([]slog.Attr{slog.String(ComponentKey, "discovery")})
+	now := time.Now()
+
+	for i := 0; i < 5; i++ {
+		logAt(h, now, "flood")
+		logAt(relay, now, "flood")
+		logAt(discovery, now, "flood")
+	}
+	// Lines with another message count on their own
+	logAt(h, now, "other")
+
+	counts := make(map[string]int)
+	for _, message := range out.messages() {
+		counts[message]++
+	}
+	// 2 from the default component, 1 from relay, 5 from discovery
+	if counts["flood"] != 8 || counts["other"] != 1 {
+		t.Errorf("logged %v, want 8 floods and the other line", counts)
+	}
+
+	got := make(map[string]int64)
+	for _, s := range h.Suppressions() {
+		got[s.Component] = s.Suppressed
+	}
+	if got[defaultComponent] != 3 || got["relay"] != 4 || got["discovery"] != 0 {
+		t.Errorf("suppressions %v", h.Suppressions())
+	}
+}
+
+func TestRateLimitSummarizesWindow(t *testing.T) {
+	out := &recorder{}
+	h := NewRateLimitHandler(out, RateLimitConfig{PerMinute: 1, Window: time.Minute})
+	now := time.Now()
+	for i := 0; i < 4; i++ {
+		logAt(h, now, "flood")
+	}
+	out.messages()
+
+	// The key's next line, a window later, is preceded by the summary
+	logAt(h, now.Add(time.Minute), "flood")
+	if got := out.messages(); len(got) != 2 || got[0] != "suppressed 3 similar messages" || got[1] != "flood" {
+		t.Errorf("logged %q after the window", got)
+	}
+
+	// Keys that go quiet are summarized when their window expires
+	logAt(h, now.Add(time.Minute), "flood")
+	for _, summary := range h.limiter.expire(now.Add(2 * time.Minute)) {
+		h.limiter.emit(context.Background(), summary)
+	}
+	if got := out.messages(); len(got) != 1 || got[0] != "suppressed 1 similar messages" {
+		t.Errorf("logged %q when the window expired", got)
+	}
+}
+
+func TestSetLimits(t *testing.T) {
+	out := &recorder{}
+	h := NewRateLimitHandler(out, RateLimitConfig{PerMinute: 1})
+	now := time.Now()
+	logAt(h, now, "flood")
+	logAt(h, now, "flood")
+	h.SetLimits(RateLimitConfig{PerMinute: 0})
+	logAt(h, now, "flood")
+	if got := out.messages(); len(got) != 2 {
+		t.Errorf("logged %q, want the first line and the one after lifting the limit", got)
+	}
+}
@@ -0,0 +1,290 @@
+// Package metrics exposes the agent's counters and gauges in the Prometheus
+// text format. Everything is registered on a dedicated registry rather than
+// the global default, so tests can gather exact values.
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/zeropr/agent/internal/events"
+	"github.com/zeropr/agent/internal/peers"
+)
+
+const namespace = "zeropr"
+
+// File request results
+const (
+	FileServed = "served"
+	FileDenied = "denied"
+	FileBusy   = "busy"
+)
+
+// File cache lookup results
+const (
+	CacheHit  = "hit"
+	CacheMiss = "miss"
+)
+
+// Why the agent dropped a sync connection
+const (
+	DropPingTimeout = "ping_timeout" // missed two pings
+	DropWriteFailed = "write_failed" // a write failed or took longer than the write timeout
+	DropTooSlow     = "too_slow"     // fell a whole send queue behind
+)
+
+// Metrics holds the agent's collectors. A nil *Metrics is valid and
+// records nothing, so instrumented code doesn't need to check.
+type Metrics struct {
+	registry        *prometheus.Registry
+	peersDiscovered prometheus.Counter
+	peersRemoved    prometheus.Counter
+	relayMessages   prometheus.Counter
+	relayBytes      prometheus.Counter
+	syncDropped     *prometheus.CounterVec
+	viewerDropped   prometheus.Counter
+	fileRequests    *prometheus.CounterVec
+	fileCache       *prometheus.CounterVec
+	httpDuration    *prometheus.HistogramVec
+	browseDuration  prometheus.Histogram
+}
+
+// New creates the collectors on a fresh registry
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		peersDiscovered: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "peers_discovered_total",
+			Help:      "Peers added to the registry, by discovery or by hand.",
+		}),
+		peersRemoved: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "peers_removed_total",
+			Help:      "Peers removed from the registry after going stale or by hand.",
+		}),
+		relayMessages: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "relay_messages_total",
+			Help:      "Sync messages relayed, counted once per recipient.",
+		}),
+		relayBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "relay_bytes_total",
+			Help:      "Sync message bytes relayed, counted once per recipient.",
+		}),
+		syncDropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "websocket_dropped_total",
+			Help:      "Sync WebSocket connections the agent gave up on, by reason (ping_timeout, write_failed, or too_slow).",
+		}, []string{"reason"}),
+		viewerDropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "viewer_updates_dropped_total",
+			Help:      "Document updates sent by viewers and dropped instead of relayed.",
+		}),
+		fileRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "file_requests_total",
+			Help:      "File reads answered, by result (served, denied, or busy).",
+		}, []string{"result"}),
+		fileCache: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "file_cache_lookups_total",
+			Help:      "File reads looked up in the file cache, by result (hit or miss).",
+		}, []string{"result"}),
+		httpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "HTTP request durations by route template, method, and status code.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method", "code"}),
+		browseDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "discovery",
+			Name:      "browse_duration_seconds",
+			Help:      "Duration of each mDNS browse cycle.",
+			Buckets:   []float64{0.5, 1, 2, 5, 7.5, 10, 20},
+		}),
+	}
+
+	m.registry.MustRegister(
+		m.peersDiscovered,
+		m.peersRemoved,
+		m.relayMessages,
+		m.relayBytes,
+		m.syncDropped,
+		m.viewerDropped,
+		m.fileRequests,
+		m.fileCache,
+		m.httpDuration,
+		m.browseDuration,
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+	// Every result shows up at zero before the first request
+	m.fileRequests.WithLabelValues(FileServed)
+	m.fileRequests.WithLabelValues(FileDenied)
+	m.fileRequests.WithLabelValues(FileBusy)
+	m.fileCache.WithLabelValues(CacheHit)
+	m.fileCache.WithLabelValues(CacheMiss)
+	m.syncDropped.WithLabelValues(DropPingTimeout)
+	m.syncDropped.WithLabelValues(DropWriteFailed)
+	m.syncDropped.WithLabelValues(DropTooSlow)
+	return m
+}
+
+// Registry returns the registry the collectors are registered on
+func (m *Metrics) Registry() *prometheus.Registry {
+	return m.registry
+}
+
+// Handler serves the registry in the Prometheus exposition format
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{Registry: m.registry})
+}
+
+// TrackPeers exports the number of known peers as read from count
+func (m *Metrics) TrackPeers(count func() int) {
+	m.gauge("peers_known", "Peers currently in the registry.", count)
+}
+
+// TrackSessions exports the number of active sessions and live sync
+// connections as read from the given functions
+func (m *Metrics) TrackSessions(sessions, connections func() int) {
+	m.gauge("sessions_active", "Co-editing sessions currently active.", sessions)
+	m.gauge("websocket_connections", "Sync WebSocket connections currently open.", connections)
+}
+
+func (m *Metrics) gauge(name, help string, read func() int) {
+	if m == nil {
+		return
+	}
+	m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      name,
+		Help:      help,
+	}, func() float64 { return float64(read()) }))
+}
+
+// TrackBus exports the event bus's delivery accounting by subscriber name:
+// events queued, subscribers lagging, and events dropped
+func (m *Metrics) TrackBus(bus *events.Bus) {
+	if m == nil {
+		return
+	}
+	m.registry.MustRegister(busCollector{bus: bus})
+}
+
+var (
+	busQueuedDesc = prometheus.NewDesc(prometheus.BuildFQName(namespace, "bus", "queued_events"),
+		"Events waiting for bus subscribers to read them, by subscriber.", []string{"subscriber"}, nil)
+	busLaggingDesc = prometheus.NewDesc(prometheus.BuildFQName(namespace, "bus", "lagging_subscribers"),
+		"Bus subscribers dropping events since falling a full buffer behind, by subscriber.", []string{"subscriber"}, nil)
+	busDroppedDesc = prometheus.NewDesc(prometheus.BuildFQName(namespace, "bus", "dropped_total"),
+		"Events bus subscribers missed because their buffer was full, by subscriber.", []string{"subscriber"}, nil)
+)
+
+// busCollector reads the bus's accounting on every scrape
+type busCollector struct {
+	bus *events.Bus
+}
+
+func (c busCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- busQueuedDesc
+	ch <- busLaggingDesc
+	ch <- busDroppedDesc
+}
+
+func (c busCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, stats := range c.bus.Stats() {
+		ch <- prometheus.MustNewConstMetric(busQueuedDesc, prometheus.GaugeValue, float64(stats.Queued), stats.Name)
+		ch <- prometheus.MustNewConstMetric(busLaggingDesc, prometheus.GaugeValue, float64(stats.Lagging), stats.Name)
+		ch <- prometheus.MustNewConstMetric(busDroppedDesc, prometheus.CounterValue, float64(stats.Dropped), stats.Name)
+	}
+}
+
+// Watch counts peers added to and removed from the registry, as published
+// on bus, until ctx is done
+func (m *Metrics) Watch(ctx context.Context, bus *events.Bus) {
+	ch, unsubscribe := bus.Subscribe("metrics", 256)
+	defer unsubscribe()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-ch:
+			if !ok {
+				return
+			}
+			switch event.Type {
+			case peers.EventPeerAdded:
+				m.peersDiscovered.Inc()
+			case peers.EventPeerRemoved:
+				m.peersRemoved.Inc()
+			}
+		}
+	}
+}
+
+// Relayed records one sync message of size bytes delivered to a participant
+func (m *Metrics) Relayed(size int) {
+	if m == nil {
+		return
+	}
+	m.relayMessages.Inc()
+	m.relayBytes.Add(float64(size))
+}
+
+// SyncDropped records a sync connection dropped for reason
+func (m *Metrics) SyncDropped(reason string) {
+	if m == nil {
+		return
+	}
+	m.syncDropped.WithLabelValues(reason).Inc()
+}
+
+// ViewerDropped records a document update from a viewer that wasn't relayed
+func (m *Metrics) ViewerDropped() {
+	if m == nil {
+		return
+	}
+	m.viewerDropped.Inc()
+}
+
+// FileRequest records a file read that was served or denied
+func (m *Metrics) FileRequest(result string) {
+	if m == nil {
+		return
+	}
+	m.fileRequests.WithLabelValues(result).Inc()
+}
+
+// FileCache records a file cache lookup that hit or missed
+func (m *Metrics) FileCache(result string) {
+	if m == nil {
+		return
+	}
+	m.fileCache.WithLabelValues(result).Inc()
+}
+
+// ObserveHTTP records how long a request to route took
+func (m *Metrics) ObserveHTTP(route, method string, code int, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.httpDuration.WithLabelValues(route, method, strconv.Itoa(code)).Observe(d.Seconds())
+}
+
+// ObserveBrowse records how long a discovery browse cycle took
+func (m *Metrics) ObserveBrowse(d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.browseDuration.Observe(d.Seconds())
+}
@@ -0,0 +1,33 @@
+package names
+
+// confusables maps characters to the Latin letters they are commonly
+// mistaken for. It covers the Cyrillic, Greek, and Armenian look-alikes seen
+// in real spoofing plus digit and case tricks; characters are looked up as
+// written and then lowercased, so capital-only look-alikes are listed as such.
+var confusables = map[rune]string{
+	// Digits, symbols, and Latin case tricks
+	'0': "o", '1': "l", '|': "l", 'I': "l",
+	'ı': "i", 'ɩ': "i", 'ɑ': "a", 'ɡ': "g", 'ℓ': "l",
+
+	// Cyrillic
+	'а': "a", 'е': "e", 'о': "o", 'р': "p", 'с': "c", 'у': "y", 'х': "x",
+	'і': "i", 'ј': "j", 'ѕ': "s", 'ԁ': "d", 'һ': "h", 'ԛ': "q", 'ԝ': "w",
+	'ӏ': "l", 'ү': "y",
+	'В': "b", 'Н': "h", 'К': "k", 'М': "m", 'Т': "t", 'І': "l",
+
+	// Greek
+	'α': "a", 'ο': "o", 'ρ': "p", 'ν': "v", 'ι': "i", 'κ': "k", 'υ': "u",
+	'χ': "x", 'γ': "y",
+	'Α': "a", 'Β': "b", 'Ε': "e", 'Ζ': "z", 'Η': "h", 'Ι': "l", 'Κ': "k",
+	'Μ': "m", 'Ν': "n", 'Ο': "o", 'Ρ': "p", 'Τ': "t", 'Υ': "y", 'Χ': "x",
+
+	// Armenian
+	'օ': "o", 'ս': "u", 'հ': "h", 'ո': "n", 'զ': "q",
+}
+
+// sequences are multi-character look-alikes, folded after confusables
+var sequences = [][2]string{
+	{"rn", "m"},
+	{"vv", "w"},
+	{"cl", "d"},
+}
@@ -0,0 +1,197 @@
+// Package names validates device names before they are advertised and
+// detects discovered names that imitate a trusted peer's.
+package names
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+)
+
+// maxCombining is how many combining marks may follow one base character
+const maxCombining = 2
+
+var (
+	// ErrMixedScript is returned for names mixing scripts that are not
+	// normally written together, such as Latin with Cyrillic or Greek
+	ErrMixedScript = errors.New("name mixes letters from different scripts")
+	// ErrCombining is returned for names stacking combining marks
+	ErrCombining = errors.New("name stacks too many combining marks")
+	// ErrEmpty is returned when nothing printable is left
+	ErrEmpty = errors.New("name is empty")
+)
+
+// invisible reports whether r renders as nothing or reorders text: zero-width
+// characters, bidi controls, and other format characters
+func invisible(r rune) bool {
+	switch r {
+	case '\u034F', '\u115F', '\u1160', '\u3164', '\uFFA0': // grapheme joiner, Hangul fillers
+		return true
+	}
+	return unicode.Is(unicode.Cf, r)
+}
+
+// scripts the mixing rules know about; anything else counts as its own script
+var scripts = []struct {
+	name  string
+	table *unicode.RangeTable
+}{
+	{"Latin", unicode.Latin},
+	{"Greek", unicode.Greek},
+	{"Cyrillic", unicode.Cyrillic},
+	{"Armenian", unicode.Armenian},
+	{"Hebrew", unicode.Hebrew},
+	{"Arabic", unicode.Arabic},
+	{"Devanagari", unicode.Devanagari},
+	{"Thai", unicode.Thai},
+	{"Han", unicode.Han},
+	{"Hiragana", unicode.Hiragana},
+	{"Katakana", unicode.Katakana},
+	{"Hangul", unicode.Hangul},
+	{"Bopomofo", unicode.Bopomofo},
+}
+
+// compatible lists the script sets Unicode's "highly restrictive" profile
+// (UTS #39) allows in one identifier
+var compatible = []map[string]bool{
+	{"Latin": true, "Han": true, "Hiragana": true, "Katakana": true},
+	{"Latin": true, "Han": true, "Bopomofo": true},
+	{"Latin": true, "Han": true, "Hangul": true},
+}
+
+// scriptOf returns the script of a letter, or "" for digits, punctuation,
+// and other characters shared by every script
+func scriptOf(r rune) string {
+	if unicode.Is(unicode.Common, r) || unicode.Is(unicode.Inherited, r) {
+		return ""
+	}
+	for _, s := range scripts {
+		if unicode.Is(s.table, r) {
+			return s.name
+		}
+	}
+	return "Other"
+}
+
+// mixedScript reports whether name combines scripts that aren't written
+// together, such as Latin with Cyrillic
+func mixedScript(name string) bool {
+	used := make(map[string]bool)
+	for _, r := range name {
+		if s := scriptOf(r); s != "" {
+			used[s] = true
+		}
+	}
+	if len(used) <= 1 {
+		return false
+	}
+	for _, allowed := range compatible {
+		subset := true
+		for s := range used {
+			subset = subset && allowed[s]
+		}
+		if subset {
+			return false
+		}
+	}
+	return true
+}
+
+// Normalize prepares a device name for advertising. Invisible characters
+// are stripped; names mixing scripts or abusing combining marks are rejected.
+func Normalize(name string) (string, error) {
+	var b strings.Builder
+	marks := 0
+	for _, r := range name {
+		switch {
+		case invisible(r):
+			continue
+		case unicode.Is(unicode.Mn, r) || unicode.Is(unicode.Me, r):
+			marks++
+			if marks > maxCombining {
+				return "", ErrCombining
+			}
+		default:
+			marks = 0
+		}
+		b.WriteRune(r)
+	}
+
+	normalized := strings.Join(strings.Fields(b.String()), " ")
+	if normalized == "" {
+		return "", ErrEmpty
+	}
+	if mixedScript(normalized) {
+		return "", ErrMixedScript
+	}
+	return normalized, nil
+}
+
+// Suspicious reports why a discovered name looks crafted to deceive, or ""
+// if it doesn't. Mixed scripts alone aren't flagged here: such a name only
+// deceives when it imitates a known one, which Lookalike catches.
+func Suspicious(name string) string {
+	if _, err := Normalize(name); err == ErrCombining {
+		return err.Error()
+	}
+	for _, r := range name {
+		if invisible(r) {
+			return "name contains invisible characters"
+		}
+	}
+	return ""
+}
+
+// Skeleton maps a name to the form it is visually confusable with, so two
+// names that look alike share a skeleton. It follows the UTS #39 skeleton
+// idea with a small embedded table rather than the full confusables data.
+func Skeleton(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		if invisible(r) || unicode.Is(unicode.Mn, r) || unicode.Is(unicode.Me, r) {
+			continue
+		}
+		if r >= 0xFF01 && r <= 0xFF5E {
+			r -= 0xFF01 - '!' // fullwidth ASCII
+		}
+		if mapped, ok := confusables[r]; ok {
+			b.WriteString(mapped)
+			continue
+		}
+		lower := unicode.ToLower(r)
+		if mapped, ok := confusables[lower]; ok {
+			b.WriteString(mapped)
+			continue
+		}
+		b.WriteRune(lower)
+	}
+
+	// Multi-character look-alikes are folded after single characters
+	skeleton := b.String()
+	for _, pair := range sequences {
+		skeleton = strings.ReplaceAll(skeleton, pair[0], pair[1])
+	}
+	return strings.Join(strings.Fields(skeleton), " ")
+}
+
+// Known is a name the user has reason to recognize, such as a trusted
+// peer's advertised name or the alias they gave it
+type Known struct {
+	Name        string
+	Fingerprint string
+}
+
+// Lookalike returns the known name that name imitates: one with the same
+// skeleton but different text, belonging to a different key
+func Lookalike(name, fingerprint string, known []Known) (Known, bool) {
+	skeleton := Skeleton(name)
+	for _, k := range known {
+		if k.Name == name || (fingerprint != "" && k.Fingerprint == fingerprint) {
+			continue
+		}
+		if Skeleton(k.Name) == skeleton {
+			return k, true
+		}
+	}
+	return Known{}, false
+}
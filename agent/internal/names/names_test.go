@@ -0,0 +1,84 @@
+package names
+
+import "testing"
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		name, want string
+		err        error
+	}{
+		{"alice-laptop", "alice-laptop", nil},
+		{"  alice   laptop ", "alice laptop", nil},
+		{"al\u200bice\u200d-laptop", "alice-laptop", nil}, // zero-width space and joiner
+		{"\u202eabc", "abc", nil},                         // bidi override
+		{"José's Mac", "José's Mac", nil},
+		{"Jose\u0301", "Jose\u0301", nil}, // one combining accent
+		{"山田のMac", "山田のMac", nil},         // Han, Hiragana and Latin go together
+		{"김-laptop", "김-laptop", nil},
+		{"аlice", "", ErrMixedScript},        // Cyrillic а
+		{"alicе-laptop", "", ErrMixedScript}, // Cyrillic е
+		{"αlice", "", ErrMixedScript},        // Greek α
+		{"e\u0301\u0301\u0301", "", ErrCombining},
+		{"\u200b\u200c", "", ErrEmpty},
+		{"   ", "", ErrEmpty},
+	}
+	for _, tt := range tests {
+		got, err := Normalize(tt.name)
+		if got != tt.want || err != tt.err {
+			t.Errorf("Normalize(%q) = %q, %v; want %q, %v", tt.name, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestSuspicious(t *testing.T) {
+	for name, want := range map[string]bool{
+		"alice-laptop":        false,
+		"аlice":               false, // only deceptive next to a known name
+		"ali\u200bce":         true,
+		"a\u0301\u0301\u0301": true,
+	} {
+		if got := Suspicious(name) != ""; got != want {
+			t.Errorf("Suspicious(%q) = %q", name, Suspicious(name))
+		}
+	}
+}
+
+func TestSkeleton(t *testing.T) {
+	same := [][2]string{
+		{"alice", "аlice"},           // Cyrillic а
+		{"alice", "Alice"},           // case
+		{"alice", "a1ice"},           // digit for letter
+		{"modern", "rnodern"},        // rn for m
+		{"bob", "ｂｏｂ"},               // fullwidth
+		{"alice", "ali\u200bce"},     // zero-width space
+		{"build box", "build   box"}, // spacing
+		{"Ρaul's box", "Paul's box"}, // Greek capital rho
+		{"hugo", "հսgօ"},             // Armenian
+	}
+	for _, pair := range same {
+		if Skeleton(pair[0]) != Skeleton(pair[1]) {
+			t.Errorf("%q and %q have skeletons %q and %q", pair[0], pair[1], Skeleton(pair[0]), Skeleton(pair[1]))
+		}
+	}
+	if Skeleton("alice") == Skeleton("alina") {
+		t.Error("different names share a skeleton")
+	}
+}
+
+func TestLookalike(t *testing.T) {
+	known := []Known{{Name: "alice-laptop", Fingerprint: "fp-alice"}, {Name: "bob", Fingerprint: "fp-bob"}}
+
+	if k, ok := Lookalike("аlice-laptop", "fp-mallory", known); !ok || k.Fingerprint != "fp-alice" {
+		t.Errorf("a Cyrillic imitation of alice's name wasn't caught: %+v", k)
+	}
+	// The same name, or the same key under a changed name, isn't an imitation
+	if _, ok := Lookalike("alice-laptop", "fp-other", known); ok {
+		t.Error("the known name itself was flagged")
+	}
+	if _, ok := Lookalike("аlice-laptop", "fp-alice", known); ok {
+		t.Error("alice's own key was flagged")
+	}
+	if _, ok := Lookalike("carol", "fp-carol", known); ok {
+		t.Error("an unrelated name was flagged")
+	}
+}
@@ -0,0 +1,222 @@
+// Package notify turns actionable bus events into desktop notifications for
+// users running the agent without an editor attached.
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/zeropr/agent/internal/events"
+	"github.com/zeropr/agent/internal/fetchlog"
+	"github.com/zeropr/agent/internal/health"
+	"github.com/zeropr/agent/internal/i18n"
+	"github.com/zeropr/agent/internal/logging"
+	"github.com/zeropr/agent/internal/peers"
+	"github.com/zeropr/agent/internal/sessions"
+)
+
+// Notification categories that can be enabled independently
+const (
+	CategoryPeers    = "peers"    // a new peer appeared
+	CategorySessions = "sessions" // a co-editing session was started
+	CategoryHealth   = "health"   // a peer went away or came back
+	CategoryAway     = "away"     // peers fetched files while nobody was at the keyboard
+)
+
+// Limits on what reaches the platform notifier
+const (
+	maxTitle = 64
+	maxBody  = 256
+)
+
+// unsafeChars are dropped because some notifiers interpret them as markup
+// or quoting
+const unsafeChars = "<>&\"\\`"
+
+// ErrUnsupported is returned by PlatformBackend where no notifier exists
+var ErrUnsupported = errors.New("desktop notifications are not supported on this platform")
+
+// Backend displays a notification. Title and body are plain text that has
+// already been sanitized.
+type Backend interface {
+	Notify(title, body string) error
+}
+
+// Config controls which notifications are shown and how often
+type Config struct {
+	Categories []string // enabled categories; empty disables everything
+	PerMinute  int      // notifications allowed per minute (<=0 means 6)
+	Locale     string   // language of the notification text (empty means English)
+}
+
+// ParseCategories validates a list of category names
+func ParseCategories(names []string) error {
+	for _, name := range names {
+		switch name {
+		case CategoryPeers, CategorySessions, CategoryHealth, CategoryAway:
+		default:
+			return fmt.Errorf("unknown notification category %q", name)
+		}
+	}
+	return nil
+}
+
+// Notifier subscribes to the bus and forwards actionable events to a backend
+type Notifier struct {
+	backend   Backend
+	enabled   map[string]bool
+	perMinute int
+	locale    string
+	sent      []time.Time // send times within the last minute
+	failing   bool        // a failure has been logged and not yet recovered
+	logger    *slog.Logger
+	mu        sync.Mutex
+}
+
+// New creates a notifier that shows cfg's categories through backend
+func New(cfg Config, backend Backend) *Notifier {
+	if cfg.PerMinute <= 0 {
+		cfg.PerMinute = 6
+	}
+	enabled := make(map[string]bool, len(cfg.Categories))
+	for _, category := range cfg.Categories {
+		enabled[category] = true
+	}
+	return &Notifier{
+		backend:   backend,
+		enabled:   enabled,
+		perMinute: cfg.PerMinute,
+		locale:    cfg.Locale,
+		logger:    logging.Component(nil, "notify"),
+	}
+}
+
+// Run delivers notifications until ctx is done. It has its own bus
+// subscription, so a slow or failing backend only ever drops its own events.
+func (n *Notifier) Run(ctx context.Context, bus *events.Bus) {
+	ch, unsubscribe := bus.Subscribe("notify", 32)
+	defer unsubscribe()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-ch:
+			if !ok {
+				return
+			}
+			n.Handle(event)
+		}
+	}
+}
+
+// Handle shows a notification for event if its category is enabled and the
+// rate limit allows it
+func (n *Notifier) Handle(event events.Event) {
+	category, title, body, ok := message(event, n.locale)
+	if !ok || !n.enabled[category] || !n.allow(time.Now()) {
+		return
+	}
+
+	err := n.backend.Notify(Sanitize(title, maxTitle), Sanitize(body, maxBody))
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	switch {
+	case err != nil && !n.failing:
+		n.failing = true
+		n.logger.Warn("Desktop notification failed (further failures are not logged)", "err", err)
+	case err == nil && n.failing:
+		n.failing = false
+		n.logger.Info("Desktop notifications recovered")
+	}
+}
+
+// allow applies the per-minute limit, recording a send when it passes
+func (n *Notifier) allow(now time.Time) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	cutoff := now.Add(-time.Minute)
+	kept := n.sent[:0]
+	for _, t := range n.sent {
+		if t.After(cutoff) {
+			kept = append(kept, t)
+		}
+	}
+	n.sent = kept
+
+	if len(n.sent) >= n.perMinute {
+		return false
+	}
+	n.sent = append(n.sent, now)
+	return true
+}
+
+// message maps an event to a category and notification text in locale
+func message(event events.Event, locale string) (category, title, body string, ok bool) {
+	switch data := event.Data.(type) {
+	case peers.Peer:
+		if event.Type != peers.EventPeerAdded {
+			return "", "", "", false
+		}
+		body = i18n.Text(locale, i18n.MsgNotifyPeerNearby, data.Name)
+		if data.Branch != "" {
+			body = i18n.Text(locale, i18n.MsgNotifyPeerOnBranch, data.Name, data.Branch)
+		}
+		return CategoryPeers, i18n.Text(locale, i18n.MsgNotifyPeerTitle), body, true
+	case sessions.Session:
+		if event.Type != sessions.EventSessionCreated {
+			return "", "", "", false
+		}
+		who := data.Initiator
+		if who == "" {
+			who = i18n.Text(locale, i18n.MsgNotifySomeone)
+		}
+		return CategorySessions, i18n.Text(locale, i18n.MsgNotifySessionTitle), i18n.Text(locale, i18n.MsgNotifySessionStarted, who, data.FilePath), true
+	case health.StateChange:
+		return CategoryHealth, i18n.Text(locale, i18n.MsgNotifyHealthTitle, data.To), i18n.Text(locale, i18n.MsgNotifyHealthChanged, data.Name, data.To), true
+	case fetchlog.Summary:
+		if event.Type != fetchlog.EventAwaySummary || len(data.Peers) == 0 {
+			return "", "", "", false
+		}
+		names := make([]string, len(data.Peers))
+		for i, peer := range data.Peers {
+			names[i] = peer.Peer
+		}
+		return CategoryAway, i18n.Text(locale, i18n.MsgNotifyAwayTitle), i18n.Text(locale, i18n.MsgNotifyAwayFetched, strings.Join(names, ", "), data.Fetches), true
+	}
+	return "", "", "", false
+}
+
+// Sanitize reduces s to a single line of printable plain text of at most
+// max runes, so peer-controlled names can't inject markup or control codes
+// into the platform notifier
+func Sanitize(s string, max int) string {
+	out := make([]rune, 0, max)
+	pendingSpace := false
+	for _, r := range s {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			pendingSpace = len(out) > 0
+			continue
+		}
+		if !unicode.IsPrint(r) || strings.ContainsRune(unsafeChars, r) {
+			continue
+		}
+		if pendingSpace {
+			out = append(out, ' ')
+			pendingSpace = false
+		}
+		out = append(out, r)
+		if len(out) >= max {
+			break
+		}
+	}
+	return strings.TrimSpace(string(out))
+}
@@ -0,0 +1,104 @@
+package notify
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/zeropr/agent/internal/events"
+	"github.com/zeropr/agent/internal/health"
+	"github.com/zeropr/agent/internal/peers"
+	"github.com/zeropr/agent/internal/sessions"
+)
+
+// shown is a backend that keeps what it's asked to show
+type shown struct {
+	titles, bodies []string
+	err            error
+}
+
+func (s *shown) Notify(title, body string) error {
+	s.titles = append(s.titles, title)
+	s.bodies = append(s.bodies, body)
+	return s.err
+}
+
+func TestCategories(t *testing.T) {
+	backend := &shown{}
+	n := New(Config{Categories: []string{CategorySessions}}, backend)
+	n.Handle(events.Event{Type: peers.EventPeerAdded, Data: peers.Peer{Name: "bob"}})
+	n.Handle(events.Event{Type: sessions.EventSessionCreated, Data: sessions.Session{Initiator: "alice", FilePath: "main.go"}})
+	// Only a session's creation is news
+	n.Handle(events.Event{Type: sessions.EventSessionEnded, Data: sessions.Session{Initiator: "alice", FilePath: "main.go"}})
+
+	if len(backend.bodies) != 1 || backend.bodies[0] != "alice started editing main.go" {
+		t.Errorf("showed %q, want alice's session alone", backend.bodies)
+	}
+}
+
+func TestLocalizedText(t *testing.T) {
+	backend := &shown{}
+	n := New(Config{Categories: []string{CategoryPeers, CategoryHealth}, Locale: "es"}, backend)
+	n.Handle(events.Event{Type: peers.EventPeerAdded, Data: peers.Peer{Name: "bob", Branch: "main"}})
+	n.Handle(events.Event{Type: health.EventStateChanged, Data: health.StateChange{Name: "bob", To: "away"}})
+
+	want := []string{"bob está cerca, en main", "bob ahora está away"}
+	if len(backend.bodies) != 2 || backend.bodies[0] != want[0] || backend.bodies[1] != want[1] {
+		t.Errorf("showed %q, want %q", backend.bodies, want)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	backend := &shown{}
+	n := New(Config{Categories: []string{CategoryPeers}, PerMinute: 2}, backend)
+	for i := 0; i < 5; i++ {
+		n.Handle(events.Event{Type: peers.EventPeerAdded, Data: peers.Peer{Name: "bob"}})
+	}
+	if len(backend.bodies) != 2 {
+		t.Errorf("showed %d notifications, want 2", len(backend.bodies))
+	}
+
+	// A minute later there's room again
+	if !n.allow(time.Now().Add(time.Minute + time.Second)) {
+		t.Error("the limit didn't reset after a minute")
+	}
+}
+
+func TestFailingBackendKeepsGoing(t *testing.T) {
+	backend := &shown{err: errors.New("no display")}
+	n := New(Config{Categories: []string{CategoryPeers}}, backend)
+	n.Handle(events.Event{Type: peers.EventPeerAdded, Data: peers.Peer{Name: "bob"}})
+	backend.err = nil
+	n.Handle(events.Event{Type: peers.EventPeerAdded, Data: peers.Peer{Name: "carol"}})
+	if len(backend.bodies) != 2 || n.failing {
+		t.Errorf("showed %q, failing %v", backend.bodies, n.failing)
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	tests := []struct {
+		in, want string
+		max      int
+	}{
+		{"plain", "plain", 64},
+		{"  line one\nline\ttwo  ", "line one line two", 64},
+		{`<b>bob</b> & "friends"`, "bbob/b friends", 64},
+		{"bell\athen\x1b[31mred", "bell then [31mred", 64},
+		{"zero\u200bwidth", "zerowidth", 64},
+		{"truncated here", "truncated", 9},
+	}
+	for _, tt := range tests {
+		if got := Sanitize(tt.in, tt.max); got != tt.want {
+			t.Errorf("Sanitize(%q, %d) = %q, want %q", tt.in, tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestParseCategories(t *testing.T) {
+	if err := ParseCategories([]string{CategoryPeers, CategoryAway}); err != nil {
+		t.Error(err)
+	}
+	if err := ParseCategories([]string{"spam"}); err == nil {
+		t.Error("an unknown category parsed")
+	}
+}
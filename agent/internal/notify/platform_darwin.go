@@ -0,0 +1,26 @@
+package notify
+
+import "os/exec"
+
+// script takes title and body as arguments so neither is parsed as AppleScript
+var script = []string{
+	"-e", "on run argv",
+	"-e", "display notification (item 2 of argv) with title (item 1 of argv)",
+	"-e", "end run",
+}
+
+type osascript struct{ path string }
+
+// PlatformBackend returns the osascript backend
+func PlatformBackend() (Backend, error) {
+	path, err := exec.LookPath("osascript")
+	if err != nil {
+		return nil, err
+	}
+	return osascript{path: path}, nil
+}
+
+func (o osascript) Notify(title, body string) error {
+	args := append(append([]string{}, script...), title, body)
+	return exec.Command(o.path, args...).Run()
+}
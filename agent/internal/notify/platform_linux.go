@@ -0,0 +1,18 @@
+package notify
+
+import "os/exec"
+
+type notifySend struct{ path string }
+
+// PlatformBackend returns the notify-send backend
+func PlatformBackend() (Backend, error) {
+	path, err := exec.LookPath("notify-send")
+	if err != nil {
+		return nil, err
+	}
+	return notifySend{path: path}, nil
+}
+
+func (n notifySend) Notify(title, body string) error {
+	return exec.Command(n.path, "--app-name=ZeroPR", "--", title, body).Run()
+}
@@ -0,0 +1,8 @@
+//go:build !linux && !darwin && !windows
+
+package notify
+
+// PlatformBackend reports that this platform has no notifier
+func PlatformBackend() (Backend, error) {
+	return nil, ErrUnsupported
+}
@@ -0,0 +1,34 @@
+package notify
+
+import (
+	"os"
+	"os/exec"
+)
+
+// toastScript reads the text from the environment so neither is parsed as PowerShell
+const toastScript = `
+[Windows.UI.Notifications.ToastNotificationManager, Windows.UI.Notifications, ContentType = WindowsRuntime] | Out-Null
+$template = [Windows.UI.Notifications.ToastNotificationManager]::GetTemplateContent([Windows.UI.Notifications.ToastTemplateType]::ToastText02)
+$text = $template.GetElementsByTagName('text')
+$text.Item(0).AppendChild($template.CreateTextNode($env:ZEROPR_TITLE)) | Out-Null
+$text.Item(1).AppendChild($template.CreateTextNode($env:ZEROPR_BODY)) | Out-Null
+$toast = [Windows.UI.Notifications.ToastNotification]::new($template)
+[Windows.UI.Notifications.ToastNotificationManager]::CreateToastNotifier('ZeroPR').Show($toast)
+`
+
+type powershellToast struct{ path string }
+
+// PlatformBackend returns the PowerShell toast backend
+func PlatformBackend() (Backend, error) {
+	path, err := exec.LookPath("powershell.exe")
+	if err != nil {
+		return nil, err
+	}
+	return powershellToast{path: path}, nil
+}
+
+func (p powershellToast) Notify(title, body string) error {
+	cmd := exec.Command(p.path, "-NoProfile", "-NonInteractive", "-Command", toastScript)
+	cmd.Env = append(os.Environ(), "ZEROPR_TITLE="+title, "ZEROPR_BODY="+body)
+	return cmd.Run()
+}
@@ -0,0 +1,348 @@
+// Package peerclient makes outbound agent-to-agent HTTP calls. Every request
+// is signed with this agent's identity so the receiving agent can tell who
+// is calling.
+package peerclient
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/zeropr/agent/internal/api"
+	"github.com/zeropr/agent/internal/crypto"
+	"github.com/zeropr/agent/internal/logging"
+	"github.com/zeropr/agent/internal/peers"
+)
+
+// maxErrorBody bounds how much of an error response is kept for the message
+const maxErrorBody = 1024
+
+// StatusError is returned when a peer answers with a non-2xx status
+type StatusError struct {
+	Code      int
+	ErrorCode string // the peer's stable error code; empty from older agents
+	Message   string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("peer returned %d: %s", e.Code, e.Message)
+}
+
+// newStatusError reads a {code, message} error body, falling back to the
+// raw text that older agents send
+func newStatusError(status int, body []byte) *StatusError {
+	var typed struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(body, &typed); err == nil && typed.Code != "" {
+		return &StatusError{Code: status, ErrorCode: typed.Code, Message: typed.Message}
+	}
+	return &StatusError{Code: status, Message: string(bytes.TrimSpace(body))}
+}
+
+// Status is the subset of a peer's /api/status we care about
+type Status = api.Status
+
+// File is a peer's /api/file/get response
+type File = api.File
+
+// Target is where and how to reach a peer agent
+type Target struct {
+	Host            string
+	Port            int
+	TLS             bool
+	CertFingerprint string // pinned certificate, required when TLS is set
+	PublicKey       string // identity key that may attest a new certificate
+}
+
+// TargetOf returns the target for a discovered or manually added peer
+func TargetOf(peer *peers.Peer) Target {
+	return Target{
+		Host:            peer.Address,
+		Port:            peer.Port,
+		TLS:             peer.TLS,
+		CertFingerprint: peer.CertFingerprint,
+		PublicKey:       peer.PublicKey,
+	}
+}
+
+// ErrNoPin is returned when dialing a TLS peer without a pinned certificate
+var ErrNoPin = errors.New("TLS peer has no certificate fingerprint to pin")
+
+// Client signs and sends requests to other agents, queueing them per
+// destination within its Limits
+type Client struct {
+	identity     *crypto.Identity
+	timeouts     Timeouts
+	http         *http.Client
+	pinned       map[string]*http.Client // cert fingerprint -> client pinned to it
+	pinKeys      map[string]string       // cert fingerprint -> its SPKI fingerprint, once seen
+	limits       Limits
+	destinations map[string]*destination // host:port -> its outbound queue
+	repinner     Repinner
+	watcher      ReachabilityWatcher
+	logger       *slog.Logger
+	mu           sync.Mutex
+}
+
+// New creates a client whose connections are pooled per peer and bounded
+// by timeouts. A nil identity sends unsigned requests.
+func New(identity *crypto.Identity, timeouts Timeouts) *Client {
+	return &Client{
+		identity:     identity,
+		timeouts:     timeouts,
+		http:         &http.Client{Transport: newTransport(timeouts, nil)},
+		pinned:       make(map[string]*http.Client),
+		pinKeys:      make(map[string]string),
+		limits:       DefaultLimits,
+		destinations: make(map[string]*destination),
+		logger:       logging.Component(nil, "peerclient"),
+	}
+}
+
+// SetLogger sets the logger that notes what peers send that we don't read
+func (c *Client) SetLogger(logger *slog.Logger) {
+	c.logger = logging.Component(logger, "peerclient")
+}
+
+// httpClient returns the client for a target, pinning its certificate for TLS
+func (c *Client) httpClient(target Target) (*http.Client, error) {
+	if !target.TLS {
+		return c.http, nil
+	}
+	if target.CertFingerprint == "" {
+		return nil, ErrNoPin
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	client, ok := c.pinned[target.CertFingerprint]
+	if !ok {
+		client = &http.Client{Transport: newTransport(c.timeouts, crypto.PinnedTLSConfig(target.CertFingerprint))}
+		c.pinned[target.CertFingerprint] = client
+	}
+	return client, nil
+}
+
+// Do sends a signed request to target and returns the raw response.
+// Non-2xx responses are turned into a *StatusError. The request waits its
+// turn in target's queue; a GET the peer tells to back off is sent again
+// once the pause it asked for is over, and a request to a TLS peer whose
+// certificate changed is sent again if the peer attests the new one and
+// the Repinner accepts it. While calls to target are held off because it
+// stopped answering, Do fails at once with an *UnreachableError. The
+// Request timeout runs until the response body is closed.
+func (c *Client) Do(ctx context.Context, method string, target Target, path string, body []byte) (*http.Response, error) {
+	ctx, cancel := c.bounded(ctx)
+	resp, err := c.do(ctx, method, target, path, body, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: cancel}
+	return resp, nil
+}
+
+// do is Do with extra request headers
+func (c *Client) do(ctx context.Context, method string, target Target, path string, body []byte, header http.Header) (*http.Response, error) {
+	client, err := c.httpClient(target)
+	if err != nil {
+		return nil, err
+	}
+
+	scheme := "http"
+	if target.TLS {
+		scheme = "https"
+	}
+	destination := net.JoinHostPort(target.Host, strconv.Itoa(target.Port))
+	address := fmt.Sprintf("%s://%s%s", scheme, destination, path)
+	retryable := method == http.MethodGet || method == http.MethodHead
+	repinned := false
+	if err := c.holdOff(destination); err != nil {
+		return nil, err
+	}
+
+	for attempt := 0; ; attempt++ {
+		release, err := c.acquire(ctx, destination)
+		if err != nil {
+			return nil, err
+		}
+
+		// Signatures carry a nonce, so every attempt is signed afresh
+		req, err := http.NewRequestWithContext(ctx, method, address, bytes.NewReader(body))
+		if err != nil {
+			release()
+			return nil, err
+		}
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		if len(body) > 0 {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if c.identity != nil {
+			c.identity.SignRequest(req, body)
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			release()
+			// The handshake failed before anything was sent, so the request
+			// is safe to repeat whatever its method
+			if !repinned {
+				if target, repinned = c.repin(ctx, target, err); repinned {
+					if client, err = c.httpClient(target); err == nil {
+						continue
+					}
+				}
+			}
+			c.missed(ctx, destination, target, err)
+			return nil, err
+		}
+		c.reached(destination, target)
+		if target.TLS {
+			c.notePinKey(target.CertFingerprint, resp)
+		}
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			msg, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+			resp.Body.Close()
+			release()
+			if wait, ok := backoff(resp); ok {
+				c.pause(destination, wait)
+				if retryable && attempt < maxThrottleRetries {
+					continue
+				}
+			}
+			return nil, newStatusError(resp.StatusCode, msg)
+		}
+		resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+		return resp, nil
+	}
+}
+
+// Status probes a peer's /api/status and returns the round-trip time
+func (c *Client) Status(ctx context.Context, target Target) (*Status, time.Duration, error) {
+	start := time.Now()
+	resp, err := c.Do(ctx, http.MethodGet, target, "/api/status", nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	rtt := time.Since(start)
+
+	var status Status
+	if err := api.DecodePeer(resp.Body, &status, c.logger); err != nil {
+		return nil, 0, fmt.Errorf("not a ZeroPR agent")
+	}
+	return &status, rtt, nil
+}
+
+// Offline tells a peer this agent is shutting down, so it can drop us
+// rather than wait for mDNS caches to expire
+func (c *Client) Offline(ctx context.Context, target Target) error {
+	resp, err := c.Do(ctx, http.MethodPost, target, "/api/peer/offline", nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Progress is told how many response bytes have arrived so far, and how
+// many to expect in all, or -1 when the peer didn't say
+type Progress func(read, total int64)
+
+// progressReader reports each read to a Progress
+type progressReader struct {
+	r        io.Reader
+	read     int64
+	total    int64
+	progress Progress
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.read += int64(n)
+		p.progress(p.read, p.total)
+	}
+	return n, err
+}
+
+// GetFile fetches a file from a peer's repo. The content is end-to-end
+// encrypted whenever both agents have identities; plaintext is accepted
+// only from peers that don't advertise a key, i.e. older agents. progress,
+// if not nil, follows the response body as it arrives; cancelling ctx
+// aborts the request.
+func (c *Client) GetFile(ctx context.Context, peer *peers.Peer, repo, path string, progress Progress) (*File, error) {
+	ctx, cancel := c.bounded(ctx)
+	defer cancel()
+
+	query := url.Values{"path": {path}}
+	if repo != "" {
+		query.Set("repo", repo)
+	}
+
+	peerKey, keyErr := crypto.DecodeKey(peer.PublicKey)
+	// Asking for gzip explicitly turns off the transport's transparent
+	// decompression, so both plain and sealed bodies are handled below
+	header := http.Header{"Accept-Encoding": {"gzip"}}
+	if c.identity != nil && keyErr == nil {
+		header.Set(crypto.HeaderAcceptEncryption, crypto.TransferScheme)
+	}
+
+	resp, err := c.do(ctx, http.MethodGet, TargetOf(peer), "/api/file/get?"+query.Encode(), nil, header)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var body io.Reader = resp.Body
+	if progress != nil {
+		body = &progressReader{r: resp.Body, total: resp.ContentLength, progress: progress}
+	}
+	coding := resp.Header.Get("Content-Encoding")
+	switch {
+	case resp.Header.Get(crypto.HeaderEncryption) == crypto.TransferScheme:
+		if c.identity == nil || keyErr != nil {
+			return nil, fmt.Errorf("peer sent an encrypted file we can't open")
+		}
+		body, err = c.identity.OpenTransfer(body, peerKey, resp.Header.Get(crypto.HeaderTransferKey))
+		if err != nil {
+			return nil, err
+		}
+		coding = resp.Header.Get(crypto.HeaderSealedEncoding)
+	case header.Get(crypto.HeaderAcceptEncryption) != "":
+		// The peer has an identity, so plaintext here means a downgrade
+		return nil, fmt.Errorf("peer answered without encryption")
+	}
+	if coding == "gzip" {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid compressed response: %w", err)
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	// Decoding reads through the final sealed chunk, so a truncated stream
+	// is caught
+	var file File
+	if err := api.DecodePeer(body, &file, c.logger); err != nil {
+		return nil, fmt.Errorf("invalid file response: %w", err)
+	}
+	return &file, nil
+}
@@ -0,0 +1,221 @@
+package peerclient
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zeropr/agent/internal/api"
+	"github.com/zeropr/agent/internal/crypto"
+	"github.com/zeropr/agent/internal/peers"
+)
+
+// hashLength is the length of the hex SHA-256 that opens a sealed raw file
+const hashLength = 64
+
+var (
+	// ErrChanged is returned when the file changed on the peer since the
+	// download started; the download was reset and must start over
+	ErrChanged = errors.New("file changed on the peer since the download started")
+
+	// ErrHashMismatch is returned when the downloaded bytes don't hash to
+	// what the peer said; the download was reset
+	ErrHashMismatch = errors.New("downloaded file doesn't match its SHA-256")
+
+	// ErrRawUnsupported is returned by agents that predate /api/file/raw;
+	// use GetFile instead
+	ErrRawUnsupported = errors.New("peer can't serve raw files")
+)
+
+// Download is a file fetched from a peer with Fetch. What has arrived is
+// kept when a fetch fails, so calling Fetch again resumes it.
+type Download struct {
+	Repo    string
+	Path    string
+	Content []byte
+	SHA256  string    // the whole file's hash, once the peer has said
+	ETag    string    // pins resumed fetches to the version first fetched
+	ModTime time.Time // zero when the peer didn't say
+	Total   int64     // the whole file's size, or -1 until known
+}
+
+// NewDownload starts an empty download of path in a peer's repo
+func NewDownload(repo, path string) *Download {
+	return &Download{Repo: repo, Path: path, Total: -1}
+}
+
+// Resumable reports whether a fetch would continue where the last one stopped
+func (d *Download) Resumable() bool {
+	return len(d.Content) > 0 && d.ETag != ""
+}
+
+// Reset discards what has arrived, so the next fetch starts from the beginning
+func (d *Download) Reset() {
+	d.Content = d.Content[:0]
+	d.SHA256, d.ETag, d.ModTime, d.Total = "", "", time.Time{}, -1
+}
+
+// File returns the finished download as a file response
+func (d *Download) File() *File {
+	file := &File{
+		Header:   api.Current,
+		Status:   "success",
+		FilePath: d.Path,
+		Size:     int64(len(d.Content)),
+		SHA256:   d.SHA256,
+	}
+	file.SetContent(d.Content)
+	if !d.ModTime.IsZero() {
+		modTime := d.ModTime.UTC()
+		file.ModTime = &modTime
+	}
+	return file
+}
+
+// Fetch downloads d from peer's /api/file/raw, or the rest of it when an
+// earlier fetch was cut off. The result is checked against the file's
+// SHA-256. Encryption follows the same rules as GetFile. progress, if not
+// nil, is told the file bytes held so far against the file's size. The
+// Request timeout doesn't apply, since a transfer takes as long as the
+// file does; cancel ctx to stop it.
+func (c *Client) Fetch(ctx context.Context, peer *peers.Peer, d *Download, progress Progress) error {
+	if d.Resumable() && int64(len(d.Content)) == d.Total {
+		// Cut off after the last byte; there's nothing left to ask for
+		return d.verify()
+	}
+
+	query := url.Values{"path": {d.Path}}
+	if d.Repo != "" {
+		query.Set("repo", d.Repo)
+	}
+
+	peerKey, keyErr := crypto.DecodeKey(peer.PublicKey)
+	header := http.Header{"Accept-Encoding": {"identity"}}
+	if c.identity != nil && keyErr == nil {
+		header.Set(crypto.HeaderAcceptEncryption, crypto.TransferScheme)
+	}
+	if d.Resumable() {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", len(d.Content)))
+		header.Set("If-Match", d.ETag)
+	} else {
+		d.Reset()
+	}
+
+	resp, err := c.do(ctx, http.MethodGet, TargetOf(peer), "/api/file/raw?"+query.Encode(), nil, header)
+	if err != nil {
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) {
+			switch {
+			case statusErr.Code == http.StatusPreconditionFailed,
+				statusErr.Code == http.StatusRequestedRangeNotSatisfiable:
+				d.Reset()
+				return ErrChanged
+			case statusErr.Code == http.StatusNotFound && statusErr.ErrorCode == "":
+				return ErrRawUnsupported
+			}
+		}
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		if start := rangeStart(resp.Header.Get("Content-Range")); start != int64(len(d.Content)) {
+			return fmt.Errorf("peer sent a range starting at %d, not %d", start, len(d.Content))
+		}
+	case http.StatusOK:
+		d.Content = d.Content[:0]
+	default:
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	var body io.Reader = resp.Body
+	hash := resp.Header.Get(api.HeaderSHA256)
+	switch {
+	case resp.Header.Get(crypto.HeaderEncryption) == crypto.TransferScheme:
+		if c.identity == nil || keyErr != nil {
+			return fmt.Errorf("peer sent an encrypted file we can't open")
+		}
+		body, err = c.identity.OpenTransfer(body, peerKey, resp.Header.Get(crypto.HeaderTransferKey))
+		if err != nil {
+			return err
+		}
+		// The hash is sealed ahead of the file bytes
+		prefix := make([]byte, hashLength)
+		if _, err := io.ReadFull(body, prefix); err != nil {
+			return fmt.Errorf("invalid encrypted file: %w", err)
+		}
+		hash = string(prefix)
+	case header.Get(crypto.HeaderAcceptEncryption) != "":
+		// The peer has an identity, so plaintext here means a downgrade
+		return fmt.Errorf("peer answered without encryption")
+	}
+
+	if d.SHA256 != "" && hash != d.SHA256 {
+		d.Reset()
+		return ErrChanged
+	}
+	d.SHA256 = hash
+	d.ETag = resp.Header.Get("ETag")
+	if total, err := strconv.ParseInt(resp.Header.Get(api.HeaderSize), 10, 64); err == nil {
+		d.Total = total
+	}
+	if modTime, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		d.ModTime = modTime
+	}
+
+	// Whatever arrives is kept, so a broken connection leaves a download
+	// that can be resumed
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			d.Content = append(d.Content, buf[:n]...)
+			if progress != nil {
+				progress(int64(len(d.Content)), d.Total)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return d.verify()
+}
+
+// verify checks the download against the hash the peer sent, resetting it
+// if it doesn't match
+func (d *Download) verify() error {
+	sum := sha256.Sum256(d.Content)
+	if hex.EncodeToString(sum[:]) != d.SHA256 {
+		d.Reset()
+		return ErrHashMismatch
+	}
+	return nil
+}
+
+// rangeStart returns the first byte of a "bytes first-last/size"
+// Content-Range, or -1
+func rangeStart(contentRange string) int64 {
+	spec, ok := strings.CutPrefix(contentRange, "bytes ")
+	if !ok {
+		return -1
+	}
+	first, _, _ := strings.Cut(spec, "-")
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return -1
+	}
+	return start
+}
@@ -0,0 +1,47 @@
+package peerclient
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/zeropr/agent/internal/crypto"
+)
+
+// newTestClient returns a client signing as a fresh identity
+func newTestClient(t *testing.T) *Client {
+	t.Helper()
+	id, err := crypto.LoadOrCreateIdentity(t.TempDir())
+	if err != nil {
+		t.Fatalf("create identity: %v", err)
+	}
+	c := New(id, DefaultTimeouts)
+	c.SetLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	t.Cleanup(c.CloseIdleConnections)
+	return c
+}
+
+// targetOf returns the target for a plain HTTP test server
+func targetOf(t *testing.T, srv *httptest.Server) Target {
+	t.Helper()
+	host, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("split %s: %v", srv.Listener.Addr(), err)
+	}
+	p, _ := strconv.Atoi(port)
+	return Target{Host: host, Port: p}
+}
+
+// get sends a GET and closes the response
+func get(c *Client, target Target, path string) error {
+	resp, err := c.Do(context.Background(), http.MethodGet, target, path, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
@@ -0,0 +1,141 @@
+package peerclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/zeropr/agent/internal/crypto"
+	"github.com/zeropr/agent/internal/peers"
+)
+
+const (
+	// UnreachableAfter is how many calls in a row must fail to reach a peer
+	// before it's reported unreachable
+	UnreachableAfter = 3
+
+	// minUnreachableBackoff and maxUnreachableBackoff bound how long calls
+	// to a peer that stopped answering are held off; the wait doubles with
+	// each failure in between
+	minUnreachableBackoff = time.Second
+	maxUnreachableBackoff = 2 * time.Minute
+)
+
+// UnreachableError is returned, without calling the peer, while calls to a
+// destination are held off after failing to reach it
+type UnreachableError struct {
+	Destination string
+	Failures    int       // calls in a row that failed to reach it
+	RetryAt     time.Time // when the next call is let through
+}
+
+func (e *UnreachableError) Error() string {
+	return fmt.Sprintf("peer %s did not answer %d calls in a row; retrying after %s", e.Destination, e.Failures, e.RetryAt.Format(time.RFC3339))
+}
+
+// ReachabilityWatcher is told how calls to target are going whenever a call
+// to it fails to reach it, and when it answers again after failing
+type ReachabilityWatcher func(target Target, reach peers.Reachability)
+
+// SetReachabilityWatcher sets who is told when peers stop or start
+// answering; call it before the first request
+func (c *Client) SetReachabilityWatcher(watch ReachabilityWatcher) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.watcher = watch
+}
+
+// holdOff returns an *UnreachableError while calls to address are held
+// off. Once the wait is over one call is let through to see whether the
+// peer answers again, and the others keep waiting for its outcome.
+func (c *Client) holdOff(address string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	d := c.destinationLocked(address)
+	if d.failures == 0 {
+		return nil
+	}
+	now := time.Now()
+	if now.Before(d.retryAt) {
+		return &UnreachableError{Destination: address, Failures: d.failures, RetryAt: d.retryAt}
+	}
+	d.retryAt = now.Add(unreachableBackoff(d.failures))
+	return nil
+}
+
+// reached records that a call to target got an answer, whatever its status
+func (c *Client) reached(address string, target Target) {
+	c.mu.Lock()
+	d := c.destinationLocked(address)
+	failures := d.failures
+	d.failures = 0
+	d.retryAt = time.Time{}
+	watch := c.watcher
+	c.mu.Unlock()
+
+	if failures == 0 {
+		return
+	}
+	if failures >= UnreachableAfter {
+		c.logger.Info("Peer answering again", "peer", address, "failures", failures)
+	}
+	if watch != nil {
+		watch(target, peers.Reachability{})
+	}
+}
+
+// missed records that a call to target failed with err. Failures that
+// say nothing about the peer, such as the caller giving up, don't count.
+func (c *Client) missed(ctx context.Context, address string, target Target, err error) {
+	if !unreachable(ctx, err) {
+		return
+	}
+	c.mu.Lock()
+	d := c.destinationLocked(address)
+	d.failures++
+	d.retryAt = time.Now().Add(unreachableBackoff(d.failures))
+	reach := peers.Reachability{
+		Failures:    d.failures,
+		Unreachable: d.failures >= UnreachableAfter,
+		RetryAt:     d.retryAt,
+	}
+	watch := c.watcher
+	c.mu.Unlock()
+
+	if reach.Failures == UnreachableAfter {
+		c.logger.Warn("Peer unreachable; backing off", "peer", address, "failures", reach.Failures, "retryAt", reach.RetryAt, "err", err)
+	}
+	if watch != nil {
+		watch(target, reach)
+	}
+}
+
+// unreachable reports whether err, from a call made under ctx, means the
+// peer didn't answer: the connection failed or timed out. A call the
+// caller cancelled, or a certificate the peer presented that we refused,
+// says nothing about whether it's there.
+func unreachable(ctx context.Context, err error) bool {
+	var mismatch *crypto.CertMismatchError
+	if errors.Is(ctx.Err(), context.Canceled) || errors.As(err, &mismatch) {
+		return false
+	}
+	var opErr *net.OpError
+	var netErr net.Error
+	return errors.As(err, &opErr) || errors.Is(err, context.DeadlineExceeded) ||
+		(errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// unreachableBackoff is how long calls are held off after failures in a row
+func unreachableBackoff(failures int) time.Duration {
+	wait := minUnreachableBackoff
+	for i := 1; i < failures && wait < maxUnreachableBackoff; i++ {
+		wait *= 2
+	}
+	if wait > maxUnreachableBackoff {
+		wait = maxUnreachableBackoff
+	}
+	return wait
+}
@@ -0,0 +1,123 @@
+package peerclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/zeropr/agent/internal/api"
+	"github.com/zeropr/agent/internal/crypto"
+)
+
+// AttestationPath is where an agent serves the attestation of its TLS
+// certificate
+const AttestationPath = "/p2p/cert-attestation"
+
+// Repinner is asked to accept to as target's new certificate pin, in place
+// of from, once target's identity key has attested it; it records the
+// rotation and reports whether the client may use the new pin
+type Repinner func(target Target, from, to crypto.CertPin) bool
+
+// SetRepinner lets pin mismatches with peers that attest their new
+// certificate be resolved by repin instead of failing
+func (c *Client) SetRepinner(repin Repinner) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.repinner = repin
+}
+
+// repin handles a request to target that failed with err. If the failure
+// is a pin mismatch and the certificate the peer presented is attested by
+// target's identity key and accepted by the Repinner, it returns target
+// pinned to the new certificate.
+func (c *Client) repin(ctx context.Context, target Target, err error) (Target, bool) {
+	var mismatch *crypto.CertMismatchError
+	if !errors.As(err, &mismatch) {
+		return target, false
+	}
+	c.mu.Lock()
+	repinner := c.repinner
+	c.mu.Unlock()
+	if repinner == nil || target.PublicKey == "" {
+		return target, false
+	}
+
+	key, err := crypto.DecodeKey(target.PublicKey)
+	if err != nil {
+		return target, false
+	}
+	var attested *crypto.AttestedCert
+	attestation, err := c.fetchAttestation(ctx, target, mismatch.Presented)
+	if err == nil {
+		attested, err = crypto.VerifyAttestation(key, mismatch.Presented, attestation.Certificate, attestation.Signature)
+	}
+	if err != nil {
+		c.logger.Warn("Peer presented an unpinned certificate", "addr", net.JoinHostPort(target.Host, strconv.Itoa(target.Port)), "pinned", mismatch.Pinned, "err", err)
+		return target, false
+	}
+	c.mu.Lock()
+	from := crypto.CertPin{Fingerprint: mismatch.Pinned, SPKI: c.pinKeys[mismatch.Pinned]}
+	c.mu.Unlock()
+	if !repinner(target, from, attested.CertPin) {
+		return target, false
+	}
+	target.CertFingerprint = attested.Fingerprint
+
+	// The old pin is done with
+	c.mu.Lock()
+	if client, ok := c.pinned[mismatch.Pinned]; ok {
+		client.CloseIdleConnections()
+		delete(c.pinned, mismatch.Pinned)
+	}
+	delete(c.pinKeys, mismatch.Pinned)
+	c.pinKeys[attested.Fingerprint] = attested.SPKI
+	c.mu.Unlock()
+	return target, true
+}
+
+// notePinKey remembers the public key info of the certificate a TLS peer
+// answered with, so the key can be retired if the peer rotates away from it
+func (c *Client) notePinKey(fingerprint string, resp *http.Response) {
+	if resp.TLS == nil || len(resp.TLS.PeerCertificates) == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.pinKeys[fingerprint]; ok {
+		return
+	}
+	spki, err := crypto.SPKIFingerprint(resp.TLS.PeerCertificates[0].Raw)
+	if err == nil {
+		c.pinKeys[fingerprint] = spki
+	}
+}
+
+// fetchAttestation asks target for the attestation of its certificate,
+// over a connection pinned to the certificate it presented
+func (c *Client) fetchAttestation(ctx context.Context, target Target, presented []byte) (*api.CertAttestation, error) {
+	client := &http.Client{Transport: newTransport(c.timeouts, crypto.PinnedTLSConfig(crypto.CertFingerprint(presented)))}
+	defer client.CloseIdleConnections()
+
+	address := fmt.Sprintf("https://%s%s", net.JoinHostPort(target.Host, strconv.Itoa(target.Port)), AttestationPath)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, address, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("peer has no certificate attestation (%d)", resp.StatusCode)
+	}
+
+	var attestation api.CertAttestation
+	if err := api.DecodePeer(resp.Body, &attestation, c.logger); err != nil {
+		return nil, fmt.Errorf("invalid certificate attestation: %w", err)
+	}
+	return &attestation, nil
+}
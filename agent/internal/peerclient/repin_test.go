@@ -0,0 +1,149 @@
+package peerclient
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/zeropr/agent/internal/api"
+	"github.com/zeropr/agent/internal/crypto"
+)
+
+// rotatingPeer is a TLS agent whose certificate can be swapped
+type rotatingPeer struct {
+	identity *crypto.Identity
+	dir      string
+	cert     atomic.Pointer[tls.Certificate]
+	srv      *httptest.Server
+}
+
+func newRotatingPeer(t *testing.T) *rotatingPeer {
+	t.Helper()
+	p := &rotatingPeer{dir: t.TempDir()}
+	var err error
+	if p.identity, err = crypto.LoadOrCreateIdentity(p.dir); err != nil {
+		t.Fatal(err)
+	}
+	p.renew(t)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(AttestationPath, func(w http.ResponseWriter, r *http.Request) {
+		der := p.cert.Load().Certificate[0]
+		signature, err := p.identity.AttestCertificate(der)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(api.CertAttestation{Header: api.Current, Certificate: der, Signature: signature})
+	})
+	mux.HandleFunc("/api/status", func(w http.ResponseWriter, r *http.Request) {})
+	// Served through our own listener: StartTLS would answer clients that
+	// send no server name with httptest's certificate
+	p.srv = httptest.NewUnstartedServer(mux)
+	p.srv.Listener = tls.NewListener(p.srv.Listener, &tls.Config{GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return p.cert.Load(), nil
+	}})
+	p.srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	p.srv.Start()
+	t.Cleanup(p.srv.Close)
+	return p
+}
+
+// renew replaces the certificate with a fresh one for the identity key,
+// as a reinstalled agent generates
+func (p *rotatingPeer) renew(t *testing.T) string {
+	t.Helper()
+	os.Remove(filepath.Join(p.dir, "tls.crt"))
+	cert, fingerprint, err := p.identity.LoadOrCreateCertificate(p.dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.cert.Store(&cert)
+	return fingerprint
+}
+
+func (p *rotatingPeer) target(t *testing.T, pin string) Target {
+	target := targetOf(t, p.srv)
+	target.TLS = true
+	target.CertFingerprint = pin
+	target.PublicKey = p.identity.EncodedPublicKey()
+	return target
+}
+
+func TestRepinAfterRotation(t *testing.T) {
+	peer := newRotatingPeer(t)
+	oldPin := crypto.CertFingerprint(peer.cert.Load().Certificate[0])
+	oldKey, _ := crypto.SPKIFingerprint(peer.cert.Load().Certificate[0])
+	target := peer.target(t, oldPin)
+
+	c := newTestClient(t)
+	var mu sync.Mutex
+	var from, to crypto.CertPin
+	c.SetRepinner(func(_ Target, f, tt crypto.CertPin) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		from, to = f, tt
+		return true
+	})
+	if err := get(c, target, "/api/status"); err != nil {
+		t.Fatalf("GET with the original pin: %v", err)
+	}
+
+	// Handshakes from now on see the new certificate
+	newPin := peer.renew(t)
+	c.CloseIdleConnections()
+	if err := get(c, target, "/api/status"); err != nil {
+		t.Fatalf("GET after rotation: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if from.Fingerprint != oldPin || from.SPKI != oldKey {
+		t.Errorf("repinned from %+v, want %s with key %s", from, oldPin, oldKey)
+	}
+	if to.Fingerprint != newPin {
+		t.Errorf("repinned to %s, want %s", to.Fingerprint, newPin)
+	}
+}
+
+func TestRepinRefused(t *testing.T) {
+	peer := newRotatingPeer(t)
+	target := peer.target(t, crypto.CertFingerprint(peer.cert.Load().Certificate[0]))
+	peer.renew(t)
+
+	c := newTestClient(t)
+	c.SetRepinner(func(Target, crypto.CertPin, crypto.CertPin) bool { return false })
+	if err := get(c, target, "/api/status"); !errors.Is(err, crypto.ErrCertMismatch) {
+		t.Errorf("GET with the rotation refused = %v, want ErrCertMismatch", err)
+	}
+}
+
+func TestRepinNeedsIdentityAttestation(t *testing.T) {
+	peer := newRotatingPeer(t)
+	impostor := newRotatingPeer(t)
+	// The impostor answers at the peer's address with its own certificate,
+	// attested by its own key
+	target := impostor.target(t, crypto.CertFingerprint(peer.cert.Load().Certificate[0]))
+	target.PublicKey = peer.identity.EncodedPublicKey()
+
+	c := newTestClient(t)
+	var asked atomic.Bool
+	c.SetRepinner(func(Target, crypto.CertPin, crypto.CertPin) bool {
+		asked.Store(true)
+		return true
+	})
+	if err := get(c, target, "/api/status"); !errors.Is(err, crypto.ErrCertMismatch) {
+		t.Errorf("GET to the impostor = %v, want ErrCertMismatch", err)
+	}
+	if asked.Load() {
+		t.Error("Repinner asked about a certificate the identity key didn't attest")
+	}
+}
@@ -0,0 +1,43 @@
+package peerclient
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/gorilla/websocket"
+	"github.com/zeropr/agent/internal/crypto"
+)
+
+// DialSync opens a session's sync socket on target at path, as a joining
+// participant's editor would, pinning target's certificate like any other
+// call. port, when set, is the port the peer serves sockets on instead of
+// its API's. A refused upgrade is a *StatusError.
+func (c *Client) DialSync(ctx context.Context, target Target, port int, path string) (*websocket.Conn, error) {
+	dialer := websocket.Dialer{HandshakeTimeout: c.timeouts.Dial}
+	scheme := "ws"
+	if target.TLS {
+		if target.CertFingerprint == "" {
+			return nil, ErrNoPin
+		}
+		scheme = "wss"
+		dialer.TLSClientConfig = crypto.PinnedTLSConfig(target.CertFingerprint)
+	}
+	if port == 0 {
+		port = target.Port
+	}
+
+	address := fmt.Sprintf("%s://%s%s", scheme, net.JoinHostPort(target.Host, strconv.Itoa(port)), path)
+	conn, resp, err := dialer.DialContext(ctx, address, nil)
+	if err != nil {
+		if resp != nil && resp.StatusCode != 0 {
+			msg, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+			resp.Body.Close()
+			return nil, newStatusError(resp.StatusCode, msg)
+		}
+		return nil, err
+	}
+	return conn, nil
+}
@@ -0,0 +1,224 @@
+package peerclient
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits bound the requests sent to any one peer agent, on top of the
+// transport's connection pooling, so bulk work doesn't trip the peer's
+// rate limits or look like an attack
+type Limits struct {
+	Concurrent int     // requests in flight at once; 0 is unlimited
+	PerSecond  float64 // requests started per second; 0 is unlimited
+}
+
+// DefaultLimits apply until SetLimits is called
+var DefaultLimits = Limits{Concurrent: 4, PerSecond: 20}
+
+const (
+	// maxRetryAfter caps how long one Retry-After can pause a destination
+	maxRetryAfter = time.Minute
+
+	// maxThrottleRetries is how often a GET that was told to back off is
+	// sent again once the pause is over
+	maxThrottleRetries = 3
+)
+
+// destination is the outbound queue to one peer address
+type destination struct {
+	slots       chan struct{} // one per request in flight; nil when unlimited
+	inFlight    int
+	queued      int       // waiting for a slot, the rate ceiling, or a pause
+	next        time.Time // earliest start of the next request under the rate ceiling
+	pausedUntil time.Time // set from the peer's Retry-After
+	pauses      int
+	failures    int       // calls in a row that failed to reach the peer
+	retryAt     time.Time // calls are held off until then while failures > 0
+}
+
+// Throttle is the outbound throttling state of one destination
+type Throttle struct {
+	Destination string     `json:"destination"`
+	InFlight    int        `json:"inFlight"`
+	Queued      int        `json:"queued"`
+	Pauses      int        `json:"pausesHonored"`
+	PausedUntil *time.Time `json:"pausedUntil,omitempty"`
+	Failures    int        `json:"failures,omitempty"` // calls in a row that failed to reach it
+	RetryAt     *time.Time `json:"retryAt,omitempty"`  // calls are held off until then
+}
+
+// SetLimits sets the per-destination ceilings; call it before the first
+// request
+func (c *Client) SetLimits(limits Limits) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.limits = limits
+}
+
+// Throttles reports every destination requests have been sent to, in
+// address order
+func (c *Client) Throttles() []Throttle {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	throttles := make([]Throttle, 0, len(c.destinations))
+	for address, d := range c.destinations {
+		throttle := Throttle{Destination: address, InFlight: d.inFlight, Queued: d.queued, Pauses: d.pauses, Failures: d.failures}
+		if d.pausedUntil.After(now) {
+			until := d.pausedUntil
+			throttle.PausedUntil = &until
+		}
+		if d.retryAt.After(now) {
+			at := d.retryAt
+			throttle.RetryAt = &at
+		}
+		throttles = append(throttles, throttle)
+	}
+	sort.Slice(throttles, func(i, j int) bool { return throttles[i].Destination < throttles[j].Destination })
+	return throttles
+}
+
+// destinationLocked returns the queue for address, creating it; c.mu must
+// be held
+func (c *Client) destinationLocked(address string) *destination {
+	d, ok := c.destinations[address]
+	if !ok {
+		d = &destination{}
+		if c.limits.Concurrent > 0 {
+			d.slots = make(chan struct{}, c.limits.Concurrent)
+		}
+		c.destinations[address] = d
+	}
+	return d
+}
+
+// acquire waits until a request may be sent to address: a slot is free,
+// the rate ceiling allows it, and no pause is in force. The returned
+// function gives the slot back.
+func (c *Client) acquire(ctx context.Context, address string) (func(), error) {
+	c.mu.Lock()
+	d := c.destinationLocked(address)
+	d.queued++
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		d.queued--
+		c.mu.Unlock()
+	}()
+
+	if d.slots != nil {
+		select {
+		case d.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			c.mu.Lock()
+			d.inFlight--
+			c.mu.Unlock()
+			if d.slots != nil {
+				<-d.slots
+			}
+		})
+	}
+
+	// A pause can be extended while we wait, so look again after each one
+	for {
+		c.mu.Lock()
+		now := time.Now()
+		start := now
+		if d.pausedUntil.After(start) {
+			start = d.pausedUntil
+		}
+		if c.limits.PerSecond > 0 && d.next.After(start) {
+			start = d.next
+		}
+		if !start.After(now) {
+			if c.limits.PerSecond > 0 {
+				d.next = now.Add(time.Duration(float64(time.Second) / c.limits.PerSecond))
+			}
+			d.inFlight++
+			c.mu.Unlock()
+			return release, nil
+		}
+		c.mu.Unlock()
+
+		timer := time.NewTimer(start.Sub(now))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			if d.slots != nil {
+				<-d.slots
+			}
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// pause holds every request to address for the peer's Retry-After
+func (c *Client) pause(address string, wait time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d := c.destinationLocked(address)
+	if until := time.Now().Add(wait); until.After(d.pausedUntil) {
+		d.pausedUntil = until
+	}
+	d.pauses++
+	c.logger.Info("Peer asked us to back off; pausing requests to it", "peer", address, "wait", wait)
+}
+
+// backoff returns how long the peer asked us to wait, when resp is a 429,
+// or a 503 as agents send when their file reads are busy, with a
+// Retry-After of seconds or an HTTP date. Fractional seconds are honoured
+// as sent: a retry is signed with a fresh nonce, so resending within the
+// same second isn't taken for a replay.
+func backoff(resp *http.Response) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+	value := strings.TrimSpace(resp.Header.Get("Retry-After"))
+	if value == "" {
+		return 0, false
+	}
+
+	var wait time.Duration
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil && !math.IsNaN(seconds) {
+		wait = time.Duration(math.Min(seconds, maxRetryAfter.Seconds()) * float64(time.Second))
+	} else if at, err := http.ParseTime(value); err == nil {
+		wait = time.Until(at)
+	} else {
+		return 0, false
+	}
+	switch {
+	case wait < 0:
+		wait = 0
+	case wait > maxRetryAfter:
+		wait = maxRetryAfter
+	}
+	return wait, true
+}
+
+// releasingBody gives a request's slot back once its response is read
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
@@ -0,0 +1,265 @@
+package peerclient
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zeropr/agent/internal/crypto"
+)
+
+func TestBackoff(t *testing.T) {
+	date := time.Now().Add(30 * time.Second).UTC().Format(http.TimeFormat)
+	tests := []struct {
+		name       string
+		status     int
+		retryAfter string
+		want       time.Duration
+		ok         bool
+	}{
+		{"seconds", http.StatusTooManyRequests, "2", 2 * time.Second, true},
+		{"sub-second", http.StatusTooManyRequests, "0.25", 250 * time.Millisecond, true},
+		{"zero", http.StatusTooManyRequests, "0", 0, true},
+		{"negative", http.StatusTooManyRequests, "-3", 0, true},
+		{"capped", http.StatusTooManyRequests, "3600", maxRetryAfter, true},
+		{"busy", http.StatusServiceUnavailable, "1", time.Second, true},
+		{"missing", http.StatusTooManyRequests, "", 0, false},
+		{"garbage", http.StatusTooManyRequests, "soon", 0, false},
+		{"not throttled", http.StatusInternalServerError, "1", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{StatusCode: tt.status, Header: http.Header{}}
+			if tt.retryAfter != "" {
+				resp.Header.Set("Retry-After", tt.retryAfter)
+			}
+			got, ok := backoff(resp)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("backoff = %v, %v; want %v, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+
+	t.Run("date", func(t *testing.T) {
+		resp := &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": {date}}}
+		got, ok := backoff(resp)
+		if !ok || got <= 28*time.Second || got > 30*time.Second {
+			t.Errorf("backoff = %v, %v; want about 30s", got, ok)
+		}
+	})
+}
+
+// TestSubSecondRetryAfter has a verifying peer tell the first GET to come
+// back in 100ms: the retry must wait that long and no longer than a second,
+// and must not be refused as a replay of the first attempt
+func TestSubSecondRetryAfter(t *testing.T) {
+	verifier := crypto.NewVerifier()
+	var calls atomic.Int32
+	var first, second time.Time
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := verifier.Verify(r); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if calls.Add(1) == 1 {
+			first = time.Now()
+			w.Header().Set("Retry-After", "0.1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		second = time.Now()
+	}))
+	defer srv.Close()
+
+	c := newTestClient(t)
+	if err := get(c, targetOf(t, srv), "/api/status"); err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Fatalf("peer saw %d calls, want 2", n)
+	}
+	if wait := second.Sub(first); wait < 100*time.Millisecond || wait >= time.Second {
+		t.Errorf("retried after %v, want 100ms to 1s", wait)
+	}
+	if throttles := c.Throttles(); len(throttles) != 1 || throttles[0].Pauses != 1 {
+		t.Errorf("Throttles = %+v, want one destination with one pause", throttles)
+	}
+}
+
+// TestRateLimitedPeer runs a burst of GETs against a peer that allows two
+// requests at once and throttles every fourth one: the client never goes
+// over its ceilings, waits out each Retry-After, and finishes the run
+func TestRateLimitedPeer(t *testing.T) {
+	const (
+		requests   = 24
+		concurrent = 2
+		perSecond  = 200
+		pauseFor   = 50 * time.Millisecond
+	)
+	var (
+		mu          sync.Mutex
+		inFlight    int
+		maxInFlight int
+		seen        int
+		pausedUntil time.Time
+		early       int
+		starts      []time.Time
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		now := time.Now()
+		if now.Before(pausedUntil) {
+			early++
+		}
+		starts = append(starts, now)
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		seen++
+		throttle := seen%4 == 0
+		if throttle {
+			pausedUntil = now.Add(pauseFor)
+		}
+		mu.Unlock()
+
+		time.Sleep(5 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		if throttle {
+			w.Header().Set("Retry-After", "0.05")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer srv.Close()
+
+	c := newTestClient(t)
+	c.SetLimits(Limits{Concurrent: concurrent, PerSecond: perSecond})
+	target := targetOf(t, srv)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, requests)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- get(c, target, "/api/status")
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		var status *StatusError
+		// A request throttled on every attempt gives up with the 429
+		if err != nil && !(errors.As(err, &status) && status.Code == http.StatusTooManyRequests) {
+			t.Errorf("GET: %v", err)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if maxInFlight > concurrent {
+		t.Errorf("peer saw %d requests at once, ceiling is %d", maxInFlight, concurrent)
+	}
+	// Requests already in flight when a pause starts may land inside it,
+	// but no more than the concurrency ceiling per pause
+	if pauses := seen / 4; early > pauses*concurrent {
+		t.Errorf("%d requests arrived during a pause, want at most %d", early, pauses*concurrent)
+	}
+	// Starts are stamped in the handler, so allow for the scheduler
+	// bunching a few of them up, but not for the run going faster overall
+	interval := time.Second / perSecond
+	if span, min := starts[len(starts)-1].Sub(starts[0]), time.Duration(len(starts)-1)*interval*3/4; span < min {
+		t.Errorf("%d requests started within %v, rate ceiling needs at least %v", len(starts), span, min)
+	}
+	if throttles := c.Throttles(); len(throttles) != 1 || throttles[0].InFlight != 0 || throttles[0].Queued != 0 {
+		t.Errorf("Throttles after the run = %+v, want an idle destination", throttles)
+	}
+}
+
+// TestPauseHoldsOnlyItsDestination has one peer keep asking us to back
+// off while requests to another go straight through
+func TestPauseHoldsOnlyItsDestination(t *testing.T) {
+	busy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "0.3")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer busy.Close()
+	calm := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer calm.Close()
+
+	c := newTestClient(t)
+	done := make(chan error, 1)
+	go func() { done <- get(c, targetOf(t, busy), "/api/status") }()
+	time.Sleep(50 * time.Millisecond) // into the first pause
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := get(c, targetOf(t, calm), "/api/status"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if took := time.Since(start); took > 250*time.Millisecond {
+		t.Errorf("requests to a calm peer took %v while another was paused", took)
+	}
+	if throttles := c.Throttles(); len(throttles) != 2 || throttles[0].Pauses+throttles[1].Pauses != 1 {
+		t.Errorf("Throttles = %+v, want one pause on one destination", throttles)
+	}
+	var status *StatusError
+	if err := <-done; !errors.As(err, &status) || status.Code != http.StatusTooManyRequests {
+		t.Errorf("the busy peer's GET ended with %v, want its 429 once retries ran out", err)
+	}
+}
+
+// TestQueuedRequestGivesUp cancels a request waiting for the one slot:
+// it returns the context's error and leaves the queue as it found it
+func TestQueuedRequestGivesUp(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { <-release }))
+	defer srv.Close()
+	c := newTestClient(t)
+	c.SetLimits(Limits{Concurrent: 1})
+	target := targetOf(t, srv)
+
+	done := make(chan error, 1)
+	go func() { done <- get(c, target, "/api/status") }()
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		if throttles := c.Throttles(); len(throttles) == 1 && throttles[0].InFlight == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the first request never went out")
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.Do(ctx, http.MethodGet, target, "/api/status", nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("queued request ended with %v", err)
+	}
+	if throttles := c.Throttles(); throttles[0].Queued != 0 || throttles[0].InFlight != 1 {
+		t.Errorf("Throttles after giving up = %+v", throttles)
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	// The slot is free again
+	go func() { done <- get(c, target, "/api/status") }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("the slot wasn't given back")
+	}
+}
@@ -0,0 +1,65 @@
+package peerclient
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Timeouts bound each stage of a request to a peer agent, so a slow or
+// vanished peer can't hold a goroutine or a connection indefinitely
+type Timeouts struct {
+	Dial     time.Duration // connecting, and the TLS handshake; 0 is unbounded
+	Response time.Duration // from sending a request to the peer's response headers; 0 is unbounded
+	Request  time.Duration // a whole call but background transfers, body included; 0 is unbounded
+}
+
+// DefaultTimeouts are the flags' defaults
+var DefaultTimeouts = Timeouts{Dial: 5 * time.Second, Response: 30 * time.Second, Request: time.Minute}
+
+const (
+	// idleConnsPerPeer is how many kept-alive connections to one peer are
+	// pooled, matching DefaultLimits.Concurrent
+	idleConnsPerPeer = 4
+
+	// idleConnTimeout closes a pooled connection nobody has used for a while
+	idleConnTimeout = 90 * time.Second
+)
+
+// newTransport returns a pooled transport bounded by timeouts. Peers are on
+// the local network, so proxy settings from the environment don't apply.
+func newTransport(timeouts Timeouts, tlsConfig *tls.Config) *http.Transport {
+	dialer := &net.Dialer{Timeout: timeouts.Dial, KeepAlive: 30 * time.Second}
+	return &http.Transport{
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   timeouts.Dial,
+		ResponseHeaderTimeout: timeouts.Response,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   idleConnsPerPeer,
+		IdleConnTimeout:       idleConnTimeout,
+	}
+}
+
+// bounded derives the context of a call bounded by the Request timeout;
+// cancelling the caller's context, such as an inbound request's, still
+// cancels the call
+func (c *Client) bounded(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.timeouts.Request <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, c.timeouts.Request)
+}
+
+// CloseIdleConnections closes the pooled connections to every peer, as on
+// shutdown
+func (c *Client) CloseIdleConnections() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.http.CloseIdleConnections()
+	for _, client := range c.pinned {
+		client.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,37 @@
+package peers
+
+import (
+	"github.com/zeropr/agent/internal/protocol"
+	"github.com/zeropr/agent/internal/version"
+)
+
+// Reasons a peer is flagged Incompatible
+const (
+	IncompatibleProtocol = "protocol" // speaks a protocol version we can't sync with
+	IncompatibleTooOld   = "too_old"  // older than our minimum compatible version
+	IncompatibleTooNew   = "too_new"  // requires a newer agent than this one
+)
+
+// SetCompatibility records the protocol version, agent version, and minimum
+// compatible version a peer advertises, and flags it Incompatible when it
+// and this agent can't work together. Empty values come from agents that
+// predate them and are taken to be the oldest release.
+func (p *Peer) SetCompatibility(proto, agentVersion, minCompatible string) {
+	if proto == "" {
+		proto = protocol.Legacy
+	}
+	p.ProtocolVersion = proto
+	p.Version = agentVersion
+
+	switch {
+	case !protocol.Compatible(protocol.Version, proto):
+		p.IncompatibleReason = IncompatibleProtocol
+	case agentVersion != "" && version.Compare(agentVersion, version.MinCompatible) < 0:
+		p.IncompatibleReason = IncompatibleTooOld
+	case minCompatible != "" && version.Compare(version.Version, minCompatible) < 0:
+		p.IncompatibleReason = IncompatibleTooNew
+	default:
+		p.IncompatibleReason = ""
+	}
+	p.Incompatible = p.IncompatibleReason != ""
+}
@@ -0,0 +1,40 @@
+package peers
+
+import (
+	"testing"
+
+	"github.com/zeropr/agent/internal/protocol"
+)
+
+func TestSetCompatibility(t *testing.T) {
+	tests := []struct {
+		proto, version, minCompatible string
+		reason                        string
+	}{
+		{protocol.Version, "0.1.0", "0.1.0", ""},
+		{"", "", "", ""}, // predates the fields
+		{"0.2.0", "0.2.0", "", IncompatibleProtocol},
+		{"9", "", "", IncompatibleProtocol}, // doesn't parse
+		{protocol.Version, "0.0.9", "", IncompatibleTooOld},
+		{protocol.Version, "0.1.5", "99.0.0", IncompatibleTooNew},
+	}
+	for _, tt := range tests {
+		var p Peer
+		p.SetCompatibility(tt.proto, tt.version, tt.minCompatible)
+		if p.IncompatibleReason != tt.reason || p.Incompatible != (tt.reason != "") {
+			t.Errorf("SetCompatibility(%q, %q, %q) flagged %v %q, want %q", tt.proto, tt.version, tt.minCompatible, p.Incompatible, p.IncompatibleReason, tt.reason)
+		}
+	}
+
+	// A peer that upgrades is cleared on its next announcement
+	var p Peer
+	p.SetCompatibility("0.2.0", "0.2.0", "")
+	p.SetCompatibility(protocol.Version, "0.1.1", "")
+	if p.Incompatible || p.ProtocolVersion != protocol.Version || p.Version != "0.1.1" {
+		t.Errorf("peer after upgrading %+v", p)
+	}
+	p.SetCompatibility("", "", "")
+	if p.ProtocolVersion != protocol.Legacy {
+		t.Errorf("a peer without a version speaks %q, want %q", p.ProtocolVersion, protocol.Legacy)
+	}
+}
@@ -0,0 +1,47 @@
+package peers
+
+// Filter modes, as reported in /api/status
+const (
+	FilterOff   = "off"   // every peer is listed
+	FilterBlock = "block" // every peer but the blocked ones is listed
+	FilterAllow = "allow" // only allowed peers are listed, less any blocked
+)
+
+// Filter decides which peers the registry takes in. Entries match a peer's
+// ID, name, address, or key fingerprint. A blocked peer stays out even if
+// it is also allowed.
+type Filter struct {
+	Allow []string // when not empty, the only peers listed
+	Block []string // peers never listed
+}
+
+// Mode names how the filter treats peers it has no entry for
+func (f Filter) Mode() string {
+	switch {
+	case len(f.Allow) > 0:
+		return FilterAllow
+	case len(f.Block) > 0:
+		return FilterBlock
+	default:
+		return FilterOff
+	}
+}
+
+// Admits reports whether the registry may list peer
+func (f Filter) Admits(peer *Peer) bool {
+	if matchAny(f.Block, peer) {
+		return false
+	}
+	return len(f.Allow) == 0 || matchAny(f.Allow, peer)
+}
+
+// matchAny reports whether any entry names peer
+func matchAny(entries []string, peer *Peer) bool {
+	for _, entry := range entries {
+		switch entry {
+		case peer.ID, peer.Name, peer.Instance, peer.Address, peer.Fingerprint:
+			return true
+		}
+	}
+	return false
+}
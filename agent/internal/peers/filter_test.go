@@ -0,0 +1,66 @@
+package peers
+
+import (
+	"testing"
+
+	"github.com/zeropr/agent/internal/events"
+)
+
+func TestFilter(t *testing.T) {
+	alice := &Peer{ID: "alice@192.0.2.1:7000", Name: "alice", Address: "192.0.2.1", Fingerprint: "fp-alice"}
+	bob := &Peer{ID: "bob@192.0.2.2:7000", Name: "Bob's Mac", Instance: "bob", Address: "192.0.2.2", Fingerprint: "fp-bob"}
+	mallory := &Peer{ID: "mallory@192.0.2.66:7000", Name: "mallory", Address: "192.0.2.66"}
+
+	tests := []struct {
+		filter              Filter
+		mode                string
+		alice, bob, mallory bool
+	}{
+		{Filter{}, FilterOff, true, true, true},
+		{Filter{Block: []string{"mallory"}}, FilterBlock, true, true, false},
+		{Filter{Block: []string{"192.0.2.66", "fp-bob"}}, FilterBlock, true, false, false},
+		{Filter{Allow: []string{"fp-alice", "bob"}}, FilterAllow, true, true, false}, // bob by instance name
+		{Filter{Allow: []string{"alice@192.0.2.1:7000"}}, FilterAllow, true, false, false},
+		{Filter{Allow: []string{"alice", "mallory"}, Block: []string{"mallory"}}, FilterAllow, true, false, false}, // blocking wins
+	}
+	for _, tt := range tests {
+		if mode := tt.filter.Mode(); mode != tt.mode {
+			t.Errorf("%+v: mode %s, want %s", tt.filter, mode, tt.mode)
+		}
+		for _, c := range []struct {
+			peer *Peer
+			want bool
+		}{{alice, tt.alice}, {bob, tt.bob}, {mallory, tt.mallory}} {
+			if got := tt.filter.Admits(c.peer); got != c.want {
+				t.Errorf("%+v admits %s: %v, want %v", tt.filter, c.peer.Name, got, c.want)
+			}
+		}
+	}
+}
+
+func TestRegistryFilter(t *testing.T) {
+	registry := NewRegistry(events.NewBus())
+	registry.Add(&Peer{ID: "alice", Name: "alice"})
+	registry.Add(&Peer{ID: "mallory", Name: "mallory"})
+
+	// Blocking a listed peer removes it, and it isn't taken back
+	registry.SetFilter(Filter{Block: []string{"mallory"}})
+	if _, ok := registry.Get("mallory"); ok {
+		t.Error("a newly blocked peer is still listed")
+	}
+	if registry.Add(&Peer{ID: "mallory", Name: "mallory"}) || registry.Count() != 1 {
+		t.Error("a blocked peer was added")
+	}
+
+	// Allowing only alice keeps everyone else out
+	registry.SetFilter(Filter{Allow: []string{"alice"}})
+	if registry.Add(&Peer{ID: "carol", Name: "carol"}) {
+		t.Error("a peer outside the allowlist was added")
+	}
+	if !registry.Add(&Peer{ID: "alice", Name: "alice"}) || !registry.Admits(&Peer{Name: "alice"}) {
+		t.Error("an allowed peer was refused")
+	}
+	if registry.Filter().Mode() != FilterAllow {
+		t.Errorf("mode %s", registry.Filter().Mode())
+	}
+}
@@ -0,0 +1,76 @@
+package peers
+
+import "time"
+
+// HistoryLength is how many presence changes are kept per peer
+const HistoryLength = 32
+
+// PresenceEntry is a presence a peer advertised, from when it did
+type PresenceEntry struct {
+	ActiveFile string    `json:"activeFile,omitempty"`
+	Status     string    `json:"status"`
+	At         time.Time `json:"at"`
+}
+
+// presenceHistory is a ring buffer of a peer's last HistoryLength presences
+type presenceHistory struct {
+	entries [HistoryLength]PresenceEntry
+	next    int // where the next entry goes
+	count   int
+}
+
+// latest returns the newest entry, or false if there's none
+func (h *presenceHistory) latest() (PresenceEntry, bool) {
+	if h.count == 0 {
+		return PresenceEntry{}, false
+	}
+	return h.entries[(h.next+HistoryLength-1)%HistoryLength], true
+}
+
+// add records an entry, overwriting the oldest once full
+func (h *presenceHistory) add(entry PresenceEntry) {
+	h.entries[h.next] = entry
+	h.next = (h.next + 1) % HistoryLength
+	if h.count < HistoryLength {
+		h.count++
+	}
+}
+
+// list returns the entries newest first
+func (h *presenceHistory) list() []PresenceEntry {
+	list := make([]PresenceEntry, 0, h.count)
+	for i := 1; i <= h.count; i++ {
+		list = append(list, h.entries[(h.next+HistoryLength-i)%HistoryLength])
+	}
+	return list
+}
+
+// notePresenceLocked records peer's presence in its history when it
+// differs from the last one recorded; r.mu must be held
+func (r *Registry) notePresenceLocked(peer *Peer, now time.Time) {
+	h, ok := r.history[peer.ID]
+	if !ok {
+		h = &presenceHistory{}
+		r.history[peer.ID] = h
+	}
+	if last, ok := h.latest(); ok && last.ActiveFile == peer.ActiveFile && last.Status == peer.Status {
+		return
+	}
+	h.add(PresenceEntry{ActiveFile: peer.ActiveFile, Status: peer.Status, At: now})
+}
+
+// History returns the presences a peer advertised recently, newest first,
+// or false if the peer is unknown. It is forgotten with the peer.
+func (r *Registry) History(id string) ([]PresenceEntry, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if _, ok := r.peers[id]; !ok {
+		return nil, false
+	}
+	h, ok := r.history[id]
+	if !ok {
+		return []PresenceEntry{}, true
+	}
+	return h.list(), true
+}
@@ -0,0 +1,57 @@
+package peers
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MaxMessage is the longest status message, in characters
+const MaxMessage = 100
+
+var (
+	// ErrMessageTooLong is returned by CheckMessage for a message over MaxMessage
+	ErrMessageTooLong = errors.New("status message too long")
+
+	// ErrMessageControl is returned by CheckMessage for a message with control
+	// characters, which could break a line or reorder text in a tooltip
+	ErrMessageControl = errors.New("status message has control characters")
+)
+
+// CheckMessage trims the status message a user posted and reports why it
+// can't be advertised
+func CheckMessage(message string) (string, error) {
+	message = strings.TrimSpace(message)
+	for _, r := range message {
+		if unsafeInMessage(r) {
+			return "", ErrMessageControl
+		}
+	}
+	if utf8.RuneCountInString(message) > MaxMessage {
+		return "", ErrMessageTooLong
+	}
+	return message, nil
+}
+
+// CleanMessage makes a status message a peer advertised safe to show: its
+// control characters are dropped and it's cut to MaxMessage characters
+func CleanMessage(message string) string {
+	message = strings.Map(func(r rune) rune {
+		if unsafeInMessage(r) || r == utf8.RuneError {
+			return -1
+		}
+		return r
+	}, message)
+	message = strings.TrimSpace(message)
+	if utf8.RuneCountInString(message) > MaxMessage {
+		message = string([]rune(message)[:MaxMessage])
+	}
+	return message
+}
+
+// unsafeInMessage reports whether r is a control character, bidirectional
+// overrides included
+func unsafeInMessage(r rune) bool {
+	return unicode.IsControl(r) || unicode.Is(unicode.Bidi_Control, r)
+}
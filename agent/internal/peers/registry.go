@@ -1,51 +1,342 @@
 package peers
 
 import (
+	"encoding/json"
 	"sync"
 	"time"
+
+	"github.com/zeropr/agent/internal/events"
+	"github.com/zeropr/agent/internal/storage"
+)
+
+// Events published on the bus when the registry changes
+const (
+	EventPeerAdded   = "peer.added"
+	EventPeerUpdated = "peer.updated"
+	EventPeerRemoved = "peer.removed"
+)
+
+// Connection states derived by the health checker
+const (
+	StateOnline  = "online"  // responded to a health check recently
+	StateAway    = "away"    // still seen via mDNS but not responding
+	StateOffline = "offline" // neither seen nor responding
 )
 
 // Peer represents a discovered peer on the network
+
 type Peer struct {
-	ID         string    `json:"id"`
-	Name       string    `json:"name"`
-	Address    string    `json:"address"`
-	Port       int       `json:"port"`
-	RepoHash   string    `json:"repoHash"`
-	Branch     string    `json:"branch"`
-	ActiveFile string    `json:"activeFile,omitempty"`
-	Status     string    `json:"status"`
-	LastSeen   time.Time `json:"lastSeen"`
-	Trusted    bool      `json:"trusted"`
+	ID                 string     `json:"id"`
+	ShortID            string     `json:"shortId"`            // compact and URL-safe; see ShortID
+	Name               string     `json:"name"`               // the display name it advertises, else Instance
+	Instance           string     `json:"instance,omitempty"` // its mDNS instance name, when Name is a display name
+	Alias              string     `json:"alias,omitempty"`
+	Address            string     `json:"address"`
+	Port               int        `json:"port"`
+	TLS                bool       `json:"tls,omitempty"`
+	CertFingerprint    string     `json:"certFingerprint,omitempty"`
+	RepoHash           string     `json:"repoHash"`
+	RepoHashes         []string   `json:"repoHashes,omitempty"` // every repo the peer serves, when it serves several
+	Branch             string     `json:"branch"`
+	ActiveFile         string     `json:"activeFile,omitempty"`
+	Status             string     `json:"status"`
+	Message            string     `json:"message,omitempty"` // free text the user set beside their status
+	ConnectionState    string     `json:"connectionState"`
+	LastHealthy        *time.Time `json:"lastHealthy,omitempty"`
+	LatencyMs          *float64   `json:"latencyMs"`
+	LatencyAt          *time.Time `json:"latencyMeasuredAt,omitempty"`
+	Unreachable        bool       `json:"unreachable,omitempty"` // our calls to it keep failing; see RecordReachability
+	FailedCalls        int        `json:"failedCalls,omitempty"` // calls in a row that failed to reach it
+	RetryAt            *time.Time `json:"retryAt,omitempty"`     // calls to it are held off until then
+	LastSeen           time.Time  `json:"lastSeen"`
+	PublicKey          string     `json:"publicKey,omitempty"`
+	Fingerprint        string     `json:"fingerprint,omitempty"`
+	Trusted            bool       `json:"trusted"`
+	Manual             bool       `json:"manual,omitempty"`
+	PossibleSpoof      bool       `json:"possibleSpoof,omitempty"`
+	SpoofReason        string     `json:"spoofReason,omitempty"`
+	SpoofOf            *SpoofOf   `json:"spoofOf,omitempty"`
+	Version            string     `json:"version,omitempty"`
+	ProtocolVersion    string     `json:"protocolVersion,omitempty"`
+	Incompatible       bool       `json:"incompatible,omitempty"` // can't sync with us; see SetCompatibility
+	IncompatibleReason string     `json:"incompatibleReason,omitempty"`
+	NotServing         bool       `json:"notServing,omitempty"`     // its serve plane is off: no files, sessions, or invites
+	ReadOnly           bool       `json:"readOnly,omitempty"`       // in read-only mode: it serves no files
+	AnnounceSchema     int        `json:"announceSchema,omitempty"` // TXT schema it announces, 1 for legacy; unset for manual peers
+	Boot               int64      `json:"-"`                        // when the peer's agent started, from its TXT; tells a restart from a stale announcement
+}
+
+// HasRepo reports whether the peer serves the repo with the given hash
+func (p *Peer) HasRepo(hash string) bool {
+	if hash == "" {
+		return false
+	}
+	if p.RepoHash == hash {
+		return true
+	}
+	for _, h := range p.RepoHashes {
+		if h == hash {
+			return true
+		}
+	}
+	return false
+}
+
+// SpoofOf is the known peer whose name a possible spoof imitates
+type SpoofOf struct {
+	Name        string `json:"name"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
+// TTL is how long a peer stays listed after it was last seen
+const TTL = 5 * time.Minute
+
+// DepartHold is how long a peer that said it was going offline stays out
+// of the registry, so announcements still cached on the network don't
+// bring it straight back
+const DepartHold = 10 * time.Second
+
+// latencyWeight is the weight of the newest sample in the rolling RTT average
+const latencyWeight = 0.3
+
+// HealthResult is the outcome of a single health probe
+type HealthResult struct {
+	State   string
+	Healthy bool          // the peer responded to the probe
+	RTT     time.Duration // round-trip time, valid only when Healthy
+	At      time.Time
+}
+
+// Reachability is how this agent's calls to a peer are going, as its peer
+// client sees them. The zero value is a peer that answers.
+type Reachability struct {
+	Failures    int       // calls in a row that failed to reach the peer
+	Unreachable bool      // enough of them failed to give up on it for now
+	RetryAt     time.Time // calls to it are held off until then
 }
 
 // Registry manages discovered peers
 type Registry struct {
-	peers map[string]*Peer
-	mu    sync.RWMutex
+	peers    map[string]*Peer
+	short    map[string]map[string]struct{} // short ID -> IDs of the peers with it
+	aliases  map[string]string              // local labels, kept across re-discovery
+	aliasDB  storage.Collection             // persists aliases across restarts when set
+	filter   Filter
+	departed map[string]time.Time        // fingerprint -> when that agent said it was going offline
+	history  map[string]*presenceHistory // peer ID -> its recent presences
+	bus      *events.Bus
+	mu       sync.RWMutex
 }
 
-// NewRegistry creates a new peer registry
-func NewRegistry() *Registry {
+// NewRegistry creates a new peer registry that publishes changes on bus
+func NewRegistry(bus *events.Bus) *Registry {
 	return &Registry{
-		peers: make(map[string]*Peer),
+		peers:    make(map[string]*Peer),
+		short:    make(map[string]map[string]struct{}),
+		aliases:  make(map[string]string),
+		departed: make(map[string]time.Time),
+		history:  make(map[string]*presenceHistory),
+		bus:      bus,
 	}
 }
 
-// Add adds or updates a peer
-func (r *Registry) Add(peer *Peer) {
+// Add adds or updates a peer. Locally derived state (health, the manual
+// flag, and any alias) is carried over so re-discovery doesn't reset it.
+// It reports false, adding nothing, if the filter keeps the peer out.
+func (r *Registry) Add(peer *Peer) bool {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	
-	peer.LastSeen = time.Now()
+
+	return r.addLocked(peer, time.Now())
+}
+
+// UpsertBatch adds or updates many peers under a single lock acquisition,
+// with the same merge semantics as Add
+func (r *Registry) UpsertBatch(batch []*Peer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for _, peer := range batch {
+		r.addLocked(peer, now)
+	}
+}
+
+// addLocked merges peer into the registry unless the filter keeps it out;
+// r.mu must be held
+func (r *Registry) addLocked(peer *Peer, now time.Time) bool {
+	if !r.filter.Admits(peer) {
+		return false
+	}
+	if at, ok := r.departed[peer.Fingerprint]; ok {
+		if now.Sub(at) < DepartHold && !peer.Manual {
+			return false
+		}
+		delete(r.departed, peer.Fingerprint)
+	}
+	if r.supersededLocked(peer) {
+		return false
+	}
+	existing, exists := r.peers[peer.ID]
+	switch {
+	case exists && existing.Fingerprint == peer.Fingerprint && existing.Name == peer.Name && existing.ShortID != "":
+		peer.ShortID = existing.ShortID
+	default:
+		peer.ShortID = ShortID(peer)
+		if exists {
+			r.unindexLocked(existing)
+		}
+		r.indexLocked(peer)
+	}
+	if exists {
+		peer.ConnectionState = existing.ConnectionState
+		peer.LastHealthy = existing.LastHealthy
+		peer.LatencyMs = existing.LatencyMs
+		peer.LatencyAt = existing.LatencyAt
+		peer.Unreachable = existing.Unreachable
+		peer.FailedCalls = existing.FailedCalls
+		peer.RetryAt = existing.RetryAt
+		peer.Manual = peer.Manual || existing.Manual
+	}
+	peer.Alias = r.aliases[peer.ID]
+	if peer.ConnectionState == "" {
+		peer.ConnectionState = StateOnline
+	}
+
+	peer.LastSeen = now
 	r.peers[peer.ID] = peer
+	r.notePresenceLocked(peer, now)
+
+	if exists {
+		r.bus.Publish(EventPeerUpdated, *peer)
+	} else {
+		r.bus.Publish(EventPeerAdded, *peer)
+	}
+	return true
+}
+
+// supersededLocked reconciles an agent that restarted while announcements
+// from its previous run still circulate, e.g. after it was killed: entries
+// with the same key from an earlier run are removed, and an announcement
+// from an earlier run than one already listed is refused. It reports
+// whether peer is such a stale announcement. r.mu must be held.
+func (r *Registry) supersededLocked(peer *Peer) bool {
+	if peer.Manual || peer.Fingerprint == "" || peer.Boot == 0 {
+		return false
+	}
+	for id, existing := range r.peers {
+		if existing.Manual || existing.Fingerprint != peer.Fingerprint || existing.Boot == 0 || existing.Boot == peer.Boot {
+			continue
+		}
+		if existing.Boot > peer.Boot {
+			return true
+		}
+		if id != peer.ID {
+			r.deleteLocked(existing)
+			r.bus.Publish(EventPeerRemoved, *existing)
+		}
+	}
+	return false
+}
+
+// Update applies fn to a copy of the peer and stores the result, so fields
+// fn doesn't touch are kept and readers holding the old pointer are safe.
+// It returns the updated peer, or false if the peer is unknown.
+func (r *Registry) Update(id string, fn func(*Peer)) (*Peer, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	existing, ok := r.peers[id]
+	if !ok {
+		return nil, false
+	}
+
+	updated := *existing
+	fn(&updated)
+	updated.ID = id
+	updated.Alias = r.aliases[id]
+	r.peers[id] = &updated
+	r.notePresenceLocked(&updated, time.Now())
+	r.bus.Publish(EventPeerUpdated, updated)
+
+	return &updated, true
+}
+
+// RecordHealth stores the result of a health check, folding the RTT into
+// a rolling average. Unreachable peers have their latency cleared rather
+// than left stale. It returns the previous state, or false if the peer is
+// unknown.
+func (r *Registry) RecordHealth(id string, result HealthResult) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	existing, ok := r.peers[id]
+	if !ok {
+		return "", false
+	}
+
+	// Replace rather than mutate so readers holding the old pointer are safe
+	updated := *existing
+	updated.ConnectionState = result.State
+	if result.Healthy {
+		at := result.At
+		sample := float64(result.RTT.Microseconds()) / 1000
+		if updated.LatencyMs != nil {
+			sample = latencyWeight*sample + (1-latencyWeight)*(*updated.LatencyMs)
+		}
+		updated.LastHealthy = &at
+		updated.LatencyMs = &sample
+		updated.LatencyAt = &at
+	} else {
+		updated.LatencyMs = nil
+		updated.LatencyAt = nil
+	}
+	r.peers[id] = &updated
+
+	if existing.ConnectionState != result.State {
+		r.bus.Publish(EventPeerUpdated, updated)
+	}
+
+	return existing.ConnectionState, true
+}
+
+// RecordReachability stores how calls to address:port are going on every
+// peer listed there, so clients can tell the ones that stopped answering
+// apart while mDNS still announces them. It returns how many peers changed.
+func (r *Registry) RecordReachability(address string, port int, reach Reachability) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var retryAt *time.Time
+	if !reach.RetryAt.IsZero() {
+		at := reach.RetryAt
+		retryAt = &at
+	}
+	changed := 0
+	for id, existing := range r.peers {
+		if existing.Address != address || existing.Port != port {
+			continue
+		}
+		if existing.FailedCalls == reach.Failures && existing.Unreachable == reach.Unreachable {
+			continue
+		}
+		// Replace rather than mutate so readers holding the old pointer are safe
+		updated := *existing
+		updated.Unreachable = reach.Unreachable
+		updated.FailedCalls = reach.Failures
+		updated.RetryAt = retryAt
+		r.peers[id] = &updated
+		r.bus.Publish(EventPeerUpdated, updated)
+		changed++
+	}
+	return changed
 }
 
 // Get retrieves a peer by ID
 func (r *Registry) Get(id string) (*Peer, bool) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
-	
+
 	peer, ok := r.peers[id]
 	return peer, ok
 }
@@ -54,7 +345,7 @@ func (r *Registry) Get(id string) (*Peer, bool) {
 func (r *Registry) GetAll() []*Peer {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
-	
+
 	peers := make([]*Peer, 0, len(r.peers))
 	for _, peer := range r.peers {
 		peers = append(peers, peer)
@@ -62,32 +353,184 @@ func (r *Registry) GetAll() []*Peer {
 	return peers
 }
 
-// Remove removes a peer by ID
-func (r *Registry) Remove(id string) {
+// PersistAliases loads the aliases saved in c and saves every later change
+// there, keyed by peer ID
+func (r *Registry) PersistAliases(c storage.Collection) error {
+	values, err := c.List()
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for id, data := range values {
+		var alias string
+		if err := json.Unmarshal(data, &alias); err != nil {
+			return err
+		}
+		r.aliases[id] = alias
+	}
+	r.aliasDB = c
+	return nil
+}
+
+// SetAlias sets a local label for a peer; an empty alias clears it.
+// It returns false if the peer is unknown.
+func (r *Registry) SetAlias(id, alias string) (*Peer, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	existing, ok := r.peers[id]
+	if !ok {
+		return nil, false, nil
+	}
+
+	if r.aliasDB != nil {
+		var err error
+		if alias == "" {
+			err = r.aliasDB.Delete(id)
+		} else {
+			data, _ := json.Marshal(alias)
+			err = r.aliasDB.Put(id, data)
+		}
+		if err != nil {
+			return nil, true, err
+		}
+	}
+
+	if alias == "" {
+		delete(r.aliases, id)
+	} else {
+		r.aliases[id] = alias
+	}
+
+	updated := *existing
+	updated.Alias = alias
+	r.peers[id] = &updated
+	r.bus.Publish(EventPeerUpdated, updated)
+
+	return &updated, true, nil
+}
+
+// SetTrusted marks every peer advertising fingerprint as trusted or not,
+// returning how many peers changed
+func (r *Registry) SetTrusted(fingerprint string, trusted bool) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	changed := 0
+	for id, existing := range r.peers {
+		if existing.Fingerprint != fingerprint || existing.Trusted == trusted {
+			continue
+		}
+		updated := *existing
+		updated.Trusted = trusted
+		r.peers[id] = &updated
+		r.bus.Publish(EventPeerUpdated, updated)
+		changed++
+	}
+	return changed
+}
+
+// Remove removes a peer by ID along with its alias. It returns false if
+// the peer is unknown.
+func (r *Registry) Remove(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	peer, ok := r.peers[id]
+	if !ok {
+		return false
+	}
+
+	r.deleteLocked(peer)
+	delete(r.aliases, id)
+	r.bus.Publish(EventPeerRemoved, *peer)
+	return true
+}
+
+// Depart handles an agent saying it's going offline: discovered peers with
+// its key fingerprint are removed and kept out for DepartHold, while
+// manually added ones are marked offline. It returns how many peers changed.
+func (r *Registry) Depart(fingerprint string) int {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	
-	delete(r.peers, id)
+
+	r.departed[fingerprint] = time.Now()
+	changed := 0
+	for id, existing := range r.peers {
+		if existing.Fingerprint != fingerprint {
+			continue
+		}
+		changed++
+		if !existing.Manual {
+			r.deleteLocked(existing)
+			r.bus.Publish(EventPeerRemoved, *existing)
+			continue
+		}
+		updated := *existing
+		updated.ConnectionState = StateOffline
+		updated.LatencyMs = nil
+		updated.LatencyAt = nil
+		r.peers[id] = &updated
+		r.bus.Publish(EventPeerUpdated, updated)
+	}
+	return changed
 }
 
-// Cleanup removes stale peers (not seen in timeout duration)
+// Cleanup removes stale peers (not seen in timeout duration). Manually
+// added peers are kept until explicitly removed.
 func (r *Registry) Cleanup(timeout time.Duration) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	
+
 	now := time.Now()
-	for id, peer := range r.peers {
-		if now.Sub(peer.LastSeen) > timeout {
-			delete(r.peers, id)
+	for _, peer := range r.peers {
+		if !peer.Manual && now.Sub(peer.LastSeen) > timeout {
+			r.deleteLocked(peer)
+			r.bus.Publish(EventPeerRemoved, *peer)
+		}
+	}
+	for fingerprint, at := range r.departed {
+		if now.Sub(at) >= DepartHold {
+			delete(r.departed, fingerprint)
 		}
 	}
 }
 
+// SetFilter replaces the filter, removing listed peers it keeps out
+func (r *Registry) SetFilter(filter Filter) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.filter = filter
+	for _, peer := range r.peers {
+		if !filter.Admits(peer) {
+			r.deleteLocked(peer)
+			r.bus.Publish(EventPeerRemoved, *peer)
+		}
+	}
+}
+
+// Filter returns the filter peers are added through
+func (r *Registry) Filter() Filter {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.filter
+}
+
+// Admits reports whether the filter lets peer into the registry
+func (r *Registry) Admits(peer *Peer) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.filter.Admits(peer)
+}
+
 // Count returns the number of peers
 func (r *Registry) Count() int {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
-	
+
 	return len(r.peers)
 }
-
@@ -0,0 +1,151 @@
+package peers
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/zeropr/agent/internal/events"
+)
+
+func TestUpdate(t *testing.T) {
+	bus := events.NewBus()
+	registry := NewRegistry(bus)
+	registry.Add(&Peer{ID: "alice", Name: "alice", Branch: "main", ActiveFile: "main.go", Status: "editing"})
+	if _, _, err := registry.SetAlias("alice", "Al"); err != nil {
+		t.Fatal(err)
+	}
+	before, _ := registry.Get("alice")
+	updates, cancel := bus.Subscribe("test", 4)
+	defer cancel()
+
+	peer, ok := registry.Update("alice", func(p *Peer) {
+		p.Status = "idle"
+		p.ID = "someone-else"
+	})
+	if !ok || peer.Status != "idle" || peer.ActiveFile != "main.go" || peer.Branch != "main" || peer.ID != "alice" || peer.Alias != "Al" {
+		t.Fatalf("updated peer %+v", peer)
+	}
+	// The peer handed out before is a snapshot, left as it was
+	if before.Status != "editing" {
+		t.Errorf("an earlier reader saw the update: %+v", before)
+	}
+	if event := <-updates; event.Type != EventPeerUpdated || event.Data.(Peer).Status != "idle" {
+		t.Errorf("published %s %+v", event.Type, event.Data)
+	}
+
+	if _, ok := registry.Update("nobody", func(*Peer) { t.Error("fn ran for an unknown peer") }); ok {
+		t.Error("updated an unknown peer")
+	}
+}
+
+func TestUpdateConcurrent(t *testing.T) {
+	registry := NewRegistry(events.NewBus())
+	registry.Add(&Peer{ID: "alice", Name: "alice", RepoHash: "abc", ActiveFile: "main.go"})
+
+	// Writers each own one field and readers look on; no write may undo
+	// another's, and nothing they didn't touch may change
+	const writers, rounds = 8, 200
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(2)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				registry.Update("alice", func(p *Peer) {
+					switch w % 3 {
+					case 0:
+						p.FailedCalls++
+					case 1:
+						p.Branch = fmt.Sprintf("b%d", i)
+					case 2:
+						p.Status = fmt.Sprintf("s%d", i)
+					}
+				})
+			}
+		}(w)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				if p, _ := registry.Get("alice"); p.ActiveFile != "main.go" {
+					t.Errorf("a reader saw active file %q", p.ActiveFile)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	peer, _ := registry.Get("alice")
+	if want := (writers + 2) / 3 * rounds; peer.FailedCalls != want {
+		t.Errorf("%d increments survived, want %d", peer.FailedCalls, want)
+	}
+	if peer.RepoHash != "abc" || peer.ActiveFile != "main.go" || peer.Branch != fmt.Sprintf("b%d", rounds-1) {
+		t.Errorf("peer after concurrent updates %+v", peer)
+	}
+}
+
+func TestDepart(t *testing.T) {
+	bus := events.NewBus()
+	registry := NewRegistry(bus)
+	registry.Add(&Peer{ID: "bob@wifi", Name: "bob", Fingerprint: "fp-bob"})
+	registry.Add(&Peer{ID: "bob@lan", Name: "bob", Fingerprint: "fp-bob", Manual: true, LatencyMs: new(float64)})
+	registry.Add(&Peer{ID: "carol", Name: "carol", Fingerprint: "fp-carol"})
+	changes, cancel := bus.Subscribe("test", 4)
+	defer cancel()
+
+	if n := registry.Depart("fp-bob"); n != 2 {
+		t.Fatalf("Depart changed %d peers, want 2", n)
+	}
+	if _, ok := registry.Get("bob@wifi"); ok {
+		t.Error("the discovered entry of a departed peer is still listed")
+	}
+	if manual, ok := registry.Get("bob@lan"); !ok || manual.ConnectionState != StateOffline || manual.LatencyMs != nil {
+		t.Errorf("the manual entry after departing %+v", manual)
+	}
+	if _, ok := registry.Get("carol"); !ok {
+		t.Error("another peer was dropped")
+	}
+	published := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		published[(<-changes).Type] = true
+	}
+	if !published[EventPeerRemoved] || !published[EventPeerUpdated] {
+		t.Errorf("published %v, want a removal and an update", published)
+	}
+
+	// A late mDNS answer doesn't bring it back, but adding it by hand does
+	if registry.Add(&Peer{ID: "bob@wifi", Name: "bob", Fingerprint: "fp-bob"}) {
+		t.Errorf("a departed peer came back within %v", DepartHold)
+	}
+	if !registry.Add(&Peer{ID: "bob@vpn", Name: "bob", Fingerprint: "fp-bob", Manual: true}) {
+		t.Error("a departed peer couldn't be added by hand")
+	}
+	if !registry.Add(&Peer{ID: "bob@wifi", Name: "bob", Fingerprint: "fp-bob"}) {
+		t.Error("the hold outlived adding the peer by hand")
+	}
+}
+
+func TestRestartSupersedes(t *testing.T) {
+	registry := NewRegistry(events.NewBus())
+	registry.Add(&Peer{ID: "bob@7000", Name: "bob", Fingerprint: "fp-bob", Boot: 1})
+	registry.Add(&Peer{ID: "bob-manual", Name: "bob", Fingerprint: "fp-bob", Boot: 1, Manual: true})
+
+	// bob restarted under a new instance: the old run's entry goes
+	if !registry.Add(&Peer{ID: "bob (2)@7000", Name: "bob", Fingerprint: "fp-bob", Boot: 2}) {
+		t.Fatal("the restarted peer wasn't added")
+	}
+	if _, ok := registry.Get("bob@7000"); ok {
+		t.Error("the previous run's entry is still listed")
+	}
+	// and its announcement, still cached somewhere, stays out
+	if registry.Add(&Peer{ID: "bob@7000", Name: "bob", Fingerprint: "fp-bob", Boot: 1}) {
+		t.Error("the previous run's announcement came back")
+	}
+	if _, ok := registry.Get("bob-manual"); !ok {
+		t.Error("a manually added entry was reconciled away")
+	}
+	if registry.Count() != 2 {
+		t.Errorf("%d peers listed, want the new run and the manual entry", registry.Count())
+	}
+}
@@ -0,0 +1,161 @@
+package peers
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	// ShortIDLength is the length of a peer's short ID
+	ShortIDLength = 10
+
+	// MinShortPrefix is the shortest prefix of a short ID Resolve accepts
+	MinShortPrefix = 4
+)
+
+// shortEncoding is lowercase base32 without padding: letters and 2-7 only,
+// safe in URL paths, shell arguments, and grep patterns
+var shortEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// ErrUnknownPeer is returned by Resolve when nothing matches
+var ErrUnknownPeer = errors.New("unknown peer")
+
+// AmbiguousError is returned by Resolve for a short ID prefix matching more
+// than one peer, listing them so the caller can pick a longer prefix
+type AmbiguousError struct {
+	Prefix     string
+	Candidates []string // "shortId name", sorted
+}
+
+func (e *AmbiguousError) Error() string {
+	return fmt.Sprintf("peer ID %q is ambiguous; candidates: %s", e.Prefix, strings.Join(e.Candidates, ", "))
+}
+
+// ShortID derives a peer's short ID. A peer with an identity key gets the
+// base32 of its fingerprint, so the ID follows the key wherever the agent
+// moves. One without, from an older agent, gets a hash of its name: mDNS
+// keeps instance names unique on the link, and leaving the address out
+// keeps the ID stable when the peer's address changes.
+func ShortID(peer *Peer) string {
+	if raw, err := hex.DecodeString(peer.Fingerprint); err == nil && len(raw) == sha256.Size {
+		return shortOf(raw)
+	}
+	digest := sha256.Sum256([]byte(agentKey(peer)))
+	return shortOf(digest[:])
+}
+
+// shortOf encodes the leading bits of sum as a short ID
+func shortOf(sum []byte) string {
+	return shortEncoding.EncodeToString(sum[:7])[:ShortIDLength]
+}
+
+// indexLocked records peer under its short ID; r.mu must be held
+func (r *Registry) indexLocked(peer *Peer) {
+	ids, ok := r.short[peer.ShortID]
+	if !ok {
+		ids = make(map[string]struct{}, 1)
+		r.short[peer.ShortID] = ids
+	}
+	ids[peer.ID] = struct{}{}
+}
+
+// unindexLocked forgets peer's short ID; r.mu must be held
+func (r *Registry) unindexLocked(peer *Peer) {
+	ids := r.short[peer.ShortID]
+	delete(ids, peer.ID)
+	if len(ids) == 0 {
+		delete(r.short, peer.ShortID)
+	}
+}
+
+// deleteLocked removes peer from the registry, the short ID index, and
+// the presence histories; r.mu must be held
+func (r *Registry) deleteLocked(peer *Peer) {
+	delete(r.peers, peer.ID)
+	delete(r.history, peer.ID)
+	r.unindexLocked(peer)
+}
+
+// Resolve finds a peer by its full ID, its key fingerprint, or its short ID
+// or a prefix of it at least MinShortPrefix long. Several entries of one
+// agent, say discovered and also added by hand, share a short ID; the one
+// seen last is returned. A prefix naming several agents is an
+// *AmbiguousError; nothing matching is ErrUnknownPeer.
+func (r *Registry) Resolve(ref string) (*Peer, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if peer, ok := r.peers[ref]; ok {
+		return peer, nil
+	}
+
+	ref = strings.ToLower(strings.TrimSpace(ref))
+	var matches []string // distinct short IDs
+	switch {
+	case len(ref) == sha256.Size*2:
+		// A full fingerprint is the same agent as its short ID
+		if raw, err := hex.DecodeString(ref); err == nil {
+			matches = append(matches, shortOf(raw))
+		}
+	case len(ref) >= MinShortPrefix && len(ref) <= ShortIDLength:
+		for short := range r.short {
+			if strings.HasPrefix(short, ref) {
+				matches = append(matches, short)
+			}
+		}
+	}
+
+	// Entries of one agent, say one found by mDNS and one added by hand,
+	// share a short ID; the one seen last stands for the agent
+	found := make(map[string]*Peer) // agent -> its entry seen last
+	for _, short := range matches {
+		for id := range r.short[short] {
+			peer := r.peers[id]
+			if len(ref) == sha256.Size*2 && peer.Fingerprint != ref {
+				continue
+			}
+			agent := agentKey(peer)
+			if best, ok := found[agent]; !ok || peer.LastSeen.After(best.LastSeen) {
+				found[agent] = peer
+			}
+		}
+	}
+	switch len(found) {
+	case 0:
+		return nil, ErrUnknownPeer
+	case 1:
+		for _, peer := range found {
+			return peer, nil
+		}
+	}
+	candidates := make([]string, 0, len(found))
+	for _, peer := range found {
+		candidate := peer.ShortID + " " + peer.Name
+		if peer.Fingerprint != "" {
+			candidate += " (" + peer.Fingerprint[:16] + ")"
+		}
+		candidates = append(candidates, candidate)
+	}
+	sort.Strings(candidates)
+	return nil, &AmbiguousError{Prefix: ref, Candidates: candidates}
+}
+
+// agentKey is what tells agents apart: the key fingerprint, or for an agent
+// without one the instance name its short ID is derived from
+func agentKey(peer *Peer) string {
+	if peer.Fingerprint != "" {
+		return peer.Fingerprint
+	}
+	if peer.Instance != "" {
+		return "name\x00" + peer.Instance
+	}
+	if peer.Name == "" {
+		return "name\x00" + peer.Address
+	}
+	return "name\x00" + peer.Name
+}
@@ -0,0 +1,123 @@
+package peers
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zeropr/agent/internal/events"
+)
+
+// fingerprint is a key fingerprint starting with prefix, in hex, and
+// padded with fill
+func fingerprint(prefix string, fill byte) string {
+	return prefix + strings.Repeat(string(fill), 64-len(prefix))
+}
+
+func TestShortID(t *testing.T) {
+	alice := &Peer{Name: "Sam's MacBook", Address: "192.168.1.40", Fingerprint: fingerprint("", 'a')}
+	id := ShortID(alice)
+	if len(id) != ShortIDLength || strings.Trim(id, "abcdefghijklmnopqrstuvwxyz234567") != "" {
+		t.Fatalf("short ID %q isn't %d URL-safe characters", id, ShortIDLength)
+	}
+	// It follows the key, whatever the peer is called or wherever it is
+	if moved := (&Peer{Name: "sam-laptop", Address: "10.0.0.2", Fingerprint: alice.Fingerprint}); ShortID(moved) != id {
+		t.Error("the short ID changed with the name and address")
+	}
+
+	legacy := &Peer{Name: "Sam's MacBook", Address: "192.168.1.40"}
+	if ShortID(legacy) == id {
+		t.Error("a peer without a key shares a keyed peer's short ID")
+	}
+	if moved := (&Peer{Name: "Sam's MacBook", Address: "192.168.1.77"}); ShortID(moved) != ShortID(legacy) {
+		t.Error("a legacy peer's short ID changed with its address")
+	}
+	if other := (&Peer{Name: "Bob's MacBook", Address: "192.168.1.40"}); ShortID(other) == ShortID(legacy) {
+		t.Error("two legacy peers at one address share a short ID")
+	}
+}
+
+func TestResolve(t *testing.T) {
+	registry := NewRegistry(events.NewBus())
+	// 0x00000000 and 0x00000080 share their first 24 bits, so their short
+	// IDs share the first four characters and part with the fifth
+	alice := &Peer{ID: "Sam's MacBook@192.168.1.40:8080", Name: "Sam's MacBook", Fingerprint: fingerprint("00000000", 'a')}
+	bob := &Peer{ID: "bob@192.168.1.41:8080", Name: "bob", Fingerprint: fingerprint("00000080", 'b')}
+	legacy := &Peer{ID: "old@192.168.1.42:8080", Name: "old", Address: "192.168.1.42"}
+	for _, peer := range []*Peer{alice, bob, legacy} {
+		registry.Add(peer)
+	}
+	if alice.ShortID[:4] != bob.ShortID[:4] || alice.ShortID[:5] == bob.ShortID[:5] {
+		t.Fatalf("short IDs %s and %s don't share just their first four characters", alice.ShortID, bob.ShortID)
+	}
+
+	for ref, want := range map[string]*Peer{
+		alice.ID:                           alice,
+		alice.Fingerprint:                  alice,
+		strings.ToUpper(alice.Fingerprint): alice,
+		alice.ShortID:                      alice,
+		alice.ShortID[:5]:                  alice,
+		" " + strings.ToUpper(bob.ShortID[:6]) + " ": bob,
+		legacy.ShortID: legacy,
+	} {
+		if got, err := registry.Resolve(ref); err != nil || got.ID != want.ID {
+			t.Errorf("Resolve(%q) = %v, %v; want %s", ref, got, err, want.ID)
+		}
+	}
+	for _, ref := range []string{"", alice.ShortID[:3], "zzzzzzzz", fingerprint("ff", 'f'), alice.ShortID + "x"} {
+		if _, err := registry.Resolve(ref); err != ErrUnknownPeer {
+			t.Errorf("Resolve(%q): %v, want ErrUnknownPeer", ref, err)
+		}
+	}
+
+	// Four characters shared by two agents is ambiguous, listing both
+	_, err := registry.Resolve(alice.ShortID[:4])
+	var ambiguous *AmbiguousError
+	if !errors.As(err, &ambiguous) || len(ambiguous.Candidates) != 2 ||
+		!strings.HasPrefix(ambiguous.Candidates[0], alice.ShortID+" Sam's MacBook (00000000") ||
+		!strings.HasPrefix(ambiguous.Candidates[1], bob.ShortID+" bob") {
+		t.Errorf("Resolve of a shared prefix: %v", err)
+	}
+
+	// Once one is gone, the prefix is the other's alone
+	registry.Remove(bob.ID)
+	if got, err := registry.Resolve(alice.ShortID[:4]); err != nil || got.ID != alice.ID {
+		t.Errorf("after removing bob: %v, %v", got, err)
+	}
+}
+
+func TestResolveCollision(t *testing.T) {
+	registry := NewRegistry(events.NewBus())
+	// Keys agreeing in their first 7 bytes get the same short ID
+	alice := &Peer{ID: "alice", Name: "alice", Fingerprint: fingerprint("00112233445566", 'a')}
+	mallory := &Peer{ID: "mallory", Name: "mallory", Fingerprint: fingerprint("00112233445566", 'b')}
+	registry.Add(alice)
+	registry.Add(mallory)
+	if alice.ShortID != mallory.ShortID {
+		t.Fatalf("short IDs %s and %s", alice.ShortID, mallory.ShortID)
+	}
+
+	var ambiguous *AmbiguousError
+	if _, err := registry.Resolve(alice.ShortID); !errors.As(err, &ambiguous) {
+		t.Errorf("Resolve of a colliding short ID: %v", err)
+	}
+	// The full fingerprint still tells them apart
+	if got, err := registry.Resolve(mallory.Fingerprint); err != nil || got.ID != "mallory" {
+		t.Errorf("Resolve by fingerprint: %v, %v", got, err)
+	}
+}
+
+func TestResolveOneAgentTwice(t *testing.T) {
+	registry := NewRegistry(events.NewBus())
+	key := fingerprint("", 'c')
+	registry.Add(&Peer{ID: "carol@wifi", Name: "carol", Fingerprint: key})
+	registry.Add(&Peer{ID: "carol@lan", Name: "carol", Fingerprint: key, Manual: true})
+	registry.Update("carol@wifi", func(p *Peer) { p.LastSeen = time.Now().Add(time.Minute) })
+
+	// Both entries are the same agent: not ambiguous, and the fresher wins
+	got, err := registry.Resolve(ShortID(&Peer{Fingerprint: key}))
+	if err != nil || got.ID != "carol@wifi" {
+		t.Errorf("Resolve = %v, %v; want carol@wifi", got, err)
+	}
+}
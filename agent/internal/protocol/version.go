@@ -0,0 +1,54 @@
+// Package protocol holds the version of the agent-to-agent protocol: the
+// sync sockets, the peer API, and what discovery advertises.
+package protocol
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Version is the protocol this agent speaks, as major.minor.patch. Bump the
+// minor (the major from 1.0 on) for changes older agents can't follow.
+const Version = "0.1.0"
+
+// Legacy is the version assumed for agents that don't advertise one; they
+// predate the field and all spoke 0.1
+const Legacy = "0.1.0"
+
+// Compatible reports whether agents speaking versions a and b can work
+// together. Before 1.0 every minor release may break the protocol, so
+// 0.1.x and 0.2.x are incompatible; from 1.0 on only the major counts.
+// A version that doesn't parse is compatible with nothing.
+func Compatible(a, b string) bool {
+	aMajor, aMinor, err := Parse(a)
+	if err != nil {
+		return false
+	}
+	bMajor, bMinor, err := Parse(b)
+	if err != nil {
+		return false
+	}
+	if aMajor != bMajor {
+		return false
+	}
+	return aMajor > 0 || aMinor == bMinor
+}
+
+// Parse returns the major and minor parts of a version such as "0.1.0" or
+// "1.2". The patch part, if any, must be a number but is otherwise ignored.
+func Parse(v string) (major, minor int, err error) {
+	parts := strings.Split(strings.TrimPrefix(v, "v"), ".")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, 0, fmt.Errorf("invalid protocol version %q", v)
+	}
+	nums := make([]int, len(parts))
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return 0, 0, fmt.Errorf("invalid protocol version %q", v)
+		}
+		nums[i] = n
+	}
+	return nums[0], nums[1], nil
+}
@@ -0,0 +1,35 @@
+package protocol
+
+import "testing"
+
+func TestCompatible(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"0.1.0", "0.1.0", true},
+		{"0.1.0", "0.1.7", true},
+		{"0.1", "v0.1.2", true},
+		{"0.1.0", "0.2.0", false}, // minor releases break before 1.0
+		{"0.2.0", "0.1.0", false},
+		{"1.0.0", "1.4.2", true}, // from 1.0 only the major counts
+		{"1.3.0", "2.0.0", false},
+		{"0.9.0", "1.0.0", false},
+		{"0.1.0", "", false},
+		{"0.1.0", "banana", false},
+		{"0.1.0", "0.1.x", false},
+		{"0.1.0", "0.1.0.0", false},
+		{"0.1.0", "0.-1.0", false},
+	}
+	for _, tt := range tests {
+		if got := Compatible(tt.a, tt.b); got != tt.want {
+			t.Errorf("Compatible(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+		if got := Compatible(tt.b, tt.a); got != tt.want {
+			t.Errorf("Compatible(%q, %q) = %v, want %v", tt.b, tt.a, got, tt.want)
+		}
+	}
+	if !Compatible(Version, Legacy) {
+		t.Error("this agent can't work with agents that predate the version field")
+	}
+}
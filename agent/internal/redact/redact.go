@@ -0,0 +1,126 @@
+// Package redact keeps secrets and local paths out of what the agent
+// serializes outward: responses, error messages, logs, and events.
+//
+// A Secret or SensitivePath marshals, prints, and logs redacted however it
+// is reached, so a token added to a struct that's listed, logged, or
+// published on the bus doesn't leak with it. The value itself has to be
+// unwrapped with Reveal, at the few places meant to hand it out.
+package redact
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Redacted stands in for a redacted value
+const Redacted = "[redacted]"
+
+// Secret is a token or key. It shows as Redacted, or empty when unset.
+type Secret string
+
+// Reveal returns the secret itself
+func (s Secret) Reveal() string {
+	return string(s)
+}
+
+// String returns Redacted, or "" for an unset secret
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return Redacted
+}
+
+// GoString keeps the secret out of %#v
+func (s Secret) GoString() string {
+	return s.String()
+}
+
+// MarshalText keeps the secret out of JSON and other text encodings
+func (s Secret) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// LogValue keeps the secret out of logs
+func (s Secret) LogValue() slog.Value {
+	return slog.StringValue(s.String())
+}
+
+// SensitivePath is an absolute path on this machine. It shows as its final
+// element under Redacted, e.g. [redacted]/main.go, so a message still says
+// which file it's about without saying where it lives.
+type SensitivePath string
+
+// Reveal returns the path itself
+func (p SensitivePath) Reveal() string {
+	return string(p)
+}
+
+// String returns the path with everything but its final element redacted
+func (p SensitivePath) String() string {
+	if p == "" {
+		return ""
+	}
+	return Redacted + "/" + filepath.Base(string(p))
+}
+
+// GoString keeps the path out of %#v
+func (p SensitivePath) GoString() string {
+	return p.String()
+}
+
+// MarshalText keeps the path out of JSON and other text encodings
+func (p SensitivePath) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+// LogValue keeps the path out of logs
+func (p SensitivePath) LogValue() slog.Value {
+	return slog.StringValue(p.String())
+}
+
+// Error returns err with the paths of any file system errors in its chain
+// redacted as a SensitivePath is, for error messages leaving the machine
+func Error(err error) error {
+	if err == nil {
+		return nil
+	}
+	msg := err.Error()
+	for _, path := range errorPaths(err) {
+		if path != "" && path != "." {
+			msg = strings.ReplaceAll(msg, path, SensitivePath(path).String())
+		}
+	}
+	if msg == err.Error() {
+		return err
+	}
+	return &scrubbed{msg: msg, err: err}
+}
+
+// errorPaths collects the paths named by file system errors in err's chain
+func errorPaths(err error) []string {
+	var paths []string
+	for ; err != nil; err = errors.Unwrap(err) {
+		switch e := err.(type) {
+		case *fs.PathError:
+			paths = append(paths, e.Path)
+		case *os.LinkError:
+			paths = append(paths, e.Old, e.New)
+		}
+	}
+	return paths
+}
+
+// scrubbed is an error whose message had paths redacted; errors.Is and As
+// still see the original
+type scrubbed struct {
+	msg string
+	err error
+}
+
+func (e *scrubbed) Error() string { return e.msg }
+func (e *scrubbed) Unwrap() error { return e.err }
@@ -0,0 +1,218 @@
+package retention
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/zeropr/agent/internal/storage"
+)
+
+const (
+	policyCollection = "retention"
+	policyKey        = "policy"
+	policyFile       = "retention.json" // where the policy was kept before the storage layer
+)
+
+// Rule limits how much of one artifact type ended sessions keep. A zero
+// field doesn't limit; an artifact is deleted as soon as any limit is hit.
+type Rule struct {
+	KeepDays     int   `json:"keepDays,omitempty"`     // delete once the session ended this many days ago
+	KeepSessions int   `json:"keepSessions,omitempty"` // keep only the most recently ended sessions
+	MaxBytes     int64 `json:"maxBytes,omitempty"`     // keep the most recent sessions that fit in this total
+}
+
+// Policy maps artifact types to their rule. Types without a rule are kept.
+type Policy map[string]Rule
+
+// Validate checks that every type is known and every limit non-negative
+func (p Policy) Validate() error {
+	for artifactType, rule := range p {
+		known := false
+		for _, t := range Types {
+			known = known || t == artifactType
+		}
+		if !known {
+			return fmt.Errorf("unknown artifact type %q (known: %v)", artifactType, Types)
+		}
+		if rule.KeepDays < 0 || rule.KeepSessions < 0 || rule.MaxBytes < 0 {
+			return fmt.Errorf("limits for %s must not be negative", artifactType)
+		}
+	}
+	return nil
+}
+
+// Report is the outcome of one janitor run
+type Report struct {
+	RanAt          time.Time  `json:"ranAt"`
+	Deleted        []Deletion `json:"deleted"`
+	BytesReclaimed int64      `json:"bytesReclaimed"`
+}
+
+// Janitor enforces the retention policy on a store, on a schedule and on
+// demand. The whole policy is kept under one storage key so it is replaced
+// atomically.
+type Janitor struct {
+	store  *Store
+	db     storage.Collection
+	policy Policy
+	mu     sync.Mutex
+}
+
+// NewJanitor loads the policy saved in db, first importing the
+// retention.json an older agent left in stateDir; with none saved every
+// artifact is kept until one is set
+func NewJanitor(store *Store, stateDir string, db storage.Store) (*Janitor, error) {
+	c, err := db.Collection(policyCollection)
+	if err != nil {
+		return nil, err
+	}
+	if err := storage.ImportFile(c, filepath.Join(stateDir, policyFile), storage.Whole(policyKey)); err != nil {
+		return nil, fmt.Errorf("failed to import %s: %w", policyFile, err)
+	}
+
+	j := &Janitor{
+		store:  store,
+		db:     c,
+		policy: Policy{},
+	}
+
+	data, err := c.Get(policyKey)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &j.policy); err != nil {
+			return nil, fmt.Errorf("failed to parse the retention policy: %w", err)
+		}
+		if err := j.policy.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid retention policy: %w", err)
+		}
+	case err != storage.ErrNotFound:
+		return nil, fmt.Errorf("failed to read the retention policy: %w", err)
+	}
+	return j, nil
+}
+
+// Store returns the artifact store the janitor cleans
+func (j *Janitor) Store() *Store {
+	return j.store
+}
+
+// Policy returns a copy of the current policy
+func (j *Janitor) Policy() Policy {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	cp := make(Policy, len(j.policy))
+	for t, rule := range j.policy {
+		cp[t] = rule
+	}
+	return cp
+}
+
+// SetPolicy validates, saves, and replaces the policy. It takes effect on
+// the next run.
+func (j *Janitor) SetPolicy(policy Policy) error {
+	if err := policy.Validate(); err != nil {
+		return err
+	}
+	if policy == nil {
+		policy = Policy{}
+	}
+
+	data, err := json.Marshal(policy)
+	if err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err := j.db.Put(policyKey, data); err != nil {
+		return fmt.Errorf("failed to save the retention policy: %w", err)
+	}
+	j.policy = policy
+	return nil
+}
+
+// Run deletes every artifact the policy no longer keeps as of now
+func (j *Janitor) Run(now time.Time) (*Report, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	s := j.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Decide per type which sessions lose their artifacts of that type
+	expired := make(map[string]map[string]bool) // session ID -> types
+	for artifactType, rule := range j.policy {
+		kept := 0
+		var keptBytes int64
+		for _, m := range s.endedLocked() {
+			size := m.Bytes(artifactType)
+			if size == 0 && !m.has(artifactType) {
+				continue
+			}
+
+			tooOld := rule.KeepDays > 0 && now.Sub(*m.EndedAt) > time.Duration(rule.KeepDays)*24*time.Hour
+			tooMany := rule.KeepSessions > 0 && kept >= rule.KeepSessions
+			tooBig := rule.MaxBytes > 0 && keptBytes+size > rule.MaxBytes
+			if tooOld || tooMany || tooBig {
+				if expired[m.SessionID] == nil {
+					expired[m.SessionID] = make(map[string]bool)
+				}
+				expired[m.SessionID][artifactType] = true
+				continue
+			}
+			kept++
+			keptBytes += size
+		}
+	}
+
+	ids := make([]string, 0, len(expired))
+	for id := range expired {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	report := &Report{RanAt: now, Deleted: []Deletion{}}
+	for _, id := range ids {
+		d, err := s.deleteLocked(s.manifests[id], expired[id])
+		if err != nil {
+			return report, fmt.Errorf("failed to delete artifacts of %s: %w", id, err)
+		}
+		report.Deleted = append(report.Deleted, d)
+		report.BytesReclaimed += d.Bytes
+	}
+	return report, nil
+}
+
+// RunEvery runs the janitor every interval until ctx is cancelled
+func (j *Janitor) RunEvery(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		j.store.logger.Info("Scheduled retention runs disabled")
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			report, err := j.Run(now)
+			if err != nil {
+				j.store.logger.Error("Retention run failed", "err", err)
+			}
+			if report != nil && len(report.Deleted) > 0 {
+				j.store.logger.Info("Retention run finished", "sessions", len(report.Deleted), "bytesReclaimed", report.BytesReclaimed)
+			}
+		}
+	}
+}
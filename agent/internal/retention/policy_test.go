@@ -0,0 +1,223 @@
+package retention
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/zeropr/agent/internal/storage"
+)
+
+// endedSessions fills a store with three sessions that ended 10, 5 and 1
+// days before now, each leaving a 100-byte snapshot, a 1000-byte recording
+// and 10 bytes of chat
+func endedSessions(t *testing.T, stateDir string, now time.Time) *Store {
+	t.Helper()
+	store, err := OpenStore(stateDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, days := range map[string]int{"old": 10, "mid": 5, "new": 1} {
+		for _, a := range []struct {
+			artifactType, name string
+			size               int
+		}{
+			{TypeSnapshot, "doc.snapshot", 100},
+			{TypeRecording, "updates.log", 1000},
+			{TypeChat, "chat.jsonl", 10},
+		} {
+			if err := store.Append(id, a.artifactType, a.name, bytes.Repeat([]byte("x"), a.size)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := store.End(id, "repo", "main.go", now.Add(-time.Duration(days)*24*time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return store
+}
+
+func newTestJanitor(t *testing.T, store *Store) *Janitor {
+	t.Helper()
+	dir := t.TempDir()
+	db, err := storage.Open(storage.BackendFiles, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	janitor, err := NewJanitor(store, dir, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return janitor
+}
+
+func TestJanitorRun(t *testing.T) {
+	now := time.Now()
+	stateDir := t.TempDir()
+	store := endedSessions(t, stateDir, now)
+	janitor := newTestJanitor(t, store)
+	if err := janitor.SetPolicy(Policy{
+		TypeSnapshot:  {KeepDays: 7},
+		TypeRecording: {KeepSessions: 1},
+		TypeChat:      {MaxBytes: 15},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := janitor.Run(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Deletion{
+		{SessionID: "mid", Types: []string{TypeChat, TypeRecording}, Files: []string{"updates.log", "chat.jsonl"}, Bytes: 1010},
+		{SessionID: "old", Types: []string{TypeChat, TypeRecording, TypeSnapshot}, Files: []string{"doc.snapshot", "updates.log", "chat.jsonl"}, Bytes: 1110, Session: true},
+	}
+	if !reflect.DeepEqual(report.Deleted, want) || report.BytesReclaimed != 2120 {
+		t.Fatalf("report %+v", report)
+	}
+
+	// Exactly those files are gone, and the listing already shows it
+	for id, names := range map[string][]string{
+		"mid": {"doc.snapshot", manifestFile},
+		"new": {"chat.jsonl", "doc.snapshot", manifestFile, "updates.log"},
+	} {
+		var got []string
+		entries, _ := os.ReadDir(filepath.Join(stateDir, sessionsDir, id))
+		for _, entry := range entries {
+			got = append(got, entry.Name())
+		}
+		if !reflect.DeepEqual(got, names) {
+			t.Errorf("%s keeps %v, want %v", id, got, names)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(stateDir, sessionsDir, "old")); !os.IsNotExist(err) {
+		t.Errorf("old's directory is still there: %v", err)
+	}
+	ended := store.Ended()
+	if len(ended) != 2 || ended[0].SessionID != "new" || ended[1].SessionID != "mid" || ended[1].Bytes("") != 100 {
+		t.Errorf("ended sessions %+v", ended)
+	}
+
+	// Nothing more is due until time passes
+	if report, _ := janitor.Run(now); len(report.Deleted) != 0 {
+		t.Errorf("a second run deleted %+v", report.Deleted)
+	}
+	if report, _ := janitor.Run(now.Add(7 * 24 * time.Hour)); len(report.Deleted) != 2 {
+		t.Errorf("a week later deleted %+v, want both snapshots", report.Deleted)
+	}
+}
+
+func TestJanitorKeepsWithoutPolicy(t *testing.T) {
+	now := time.Now()
+	store := endedSessions(t, t.TempDir(), now)
+	report, err := newTestJanitor(t, store).Run(now.Add(365 * 24 * time.Hour))
+	if err != nil || len(report.Deleted) != 0 || len(store.Ended()) != 3 {
+		t.Errorf("deleted %+v, %v without a policy", report.Deleted, err)
+	}
+}
+
+func TestPolicySaved(t *testing.T) {
+	store, err := OpenStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	db, err := storage.Open(storage.BackendFiles, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	janitor, err := NewJanitor(store, dir, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, bad := range []Policy{{"thumbnails": {KeepDays: 1}}, {TypeChat: {MaxBytes: -1}}} {
+		if err := janitor.SetPolicy(bad); err == nil {
+			t.Errorf("policy %v was accepted", bad)
+		}
+	}
+	policy := Policy{TypeChat: {KeepDays: 30}, TypeRecording: {KeepSessions: 5, MaxBytes: 1 << 20}}
+	if err := janitor.SetPolicy(policy); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := NewJanitor(store, dir, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(reloaded.Policy(), policy) {
+		t.Errorf("reloaded policy %v, want %v", reloaded.Policy(), policy)
+	}
+}
+
+func TestDeleteSession(t *testing.T) {
+	store := endedSessions(t, t.TempDir(), time.Now())
+	if err := store.Append("live", TypeChat, "chat.jsonl", []byte("hi\n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Delete("live"); err != ErrActiveSession {
+		t.Errorf("deleting a live session: %v", err)
+	}
+	if _, err := store.Delete("nobody"); err != ErrUnknownSession {
+		t.Errorf("deleting an unknown session: %v", err)
+	}
+	d, err := store.Delete("mid")
+	if err != nil || !d.Session || d.Bytes != 1110 || len(d.Files) != 3 {
+		t.Fatalf("deletion %+v, %v", d, err)
+	}
+	if _, ok := store.Get("mid"); ok {
+		t.Error("the deleted session is still kept")
+	}
+	if err := store.Append("../escape", TypeChat, "chat.jsonl", nil); err == nil {
+		t.Error("a session ID outside the store was accepted")
+	}
+}
+
+func TestOpenStoreRecovers(t *testing.T) {
+	stateDir := t.TempDir()
+	store := endedSessions(t, stateDir, time.Now())
+	if err := store.Append("live", TypeChat, "chat.jsonl", []byte("hi\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A crash left a deletion half done and a file no manifest lists
+	dir := filepath.Join(stateDir, sessionsDir)
+	if err := os.Rename(filepath.Join(dir, "old"), filepath.Join(dir, deletingPrefix+"old")); err != nil {
+		t.Fatal(err)
+	}
+	stray := filepath.Join(dir, "mid", "partial.tmp")
+	if err := os.WriteFile(stray, []byte("x"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "new", "updates.log")); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := OpenStore(stateDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, deletingPrefix+"old")); !os.IsNotExist(err) {
+		t.Error("the interrupted deletion wasn't finished")
+	}
+	if _, err := os.Stat(stray); !os.IsNotExist(err) {
+		t.Error("an unlisted file was kept")
+	}
+	if m, _ := reopened.Get("new"); m.has(TypeRecording) {
+		t.Errorf("the manifest still lists a missing file: %+v", m.Files)
+	}
+	// The session the last run left open is over
+	if m, ok := reopened.Get("live"); !ok || m.EndedAt == nil {
+		t.Errorf("live after a restart %+v", m)
+	}
+	if err := reopened.Reopen("live"); err != nil {
+		t.Fatal(err)
+	}
+	if len(reopened.Ended()) != 2 {
+		t.Errorf("ended %+v after reopening live", reopened.Ended())
+	}
+}
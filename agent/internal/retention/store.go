@@ -0,0 +1,448 @@
+// Package retention keeps the artifacts sessions leave in the state
+// directory and deletes those of ended sessions under a per-type policy.
+package retention
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zeropr/agent/internal/events"
+	"github.com/zeropr/agent/internal/logging"
+)
+
+// Artifact types a session can leave behind
+const (
+	TypeSnapshot  = "snapshot"  // persisted document state
+	TypeTimeline  = "timeline"  // participant and lock history
+	TypeRecording = "recording" // replayable update log
+	TypeChat      = "chat"      // chat history
+)
+
+// Types lists every artifact type a policy may name
+var Types = []string{TypeSnapshot, TypeTimeline, TypeRecording, TypeChat}
+
+const (
+	sessionsDir    = "sessions"
+	manifestFile   = "manifest.json"
+	deletingPrefix = ".deleting-"
+)
+
+// Events published with the Manifest of an ended session as its artifacts
+// change, once the store is given a bus
+const (
+	EventArtifactsKept     = "artifacts.kept"     // the session ended; its artifacts are under the policy
+	EventArtifactsUpdated  = "artifacts.updated"  // artifacts were added to or deleted from it
+	EventArtifactsDeleted  = "artifacts.deleted"  // the last of them were deleted
+	EventArtifactsReopened = "artifacts.reopened" // it was restored and is live again
+)
+
+var (
+	// ErrUnknownSession is returned when no artifacts are kept for a session
+	ErrUnknownSession = errors.New("no artifacts for session")
+	// ErrActiveSession is returned when deleting a session that hasn't ended
+	ErrActiveSession = errors.New("session has not ended")
+)
+
+// File is one artifact listed in a session's manifest
+type File struct {
+	Type string `json:"type"`
+	Name string `json:"name"` // relative to the session directory
+	Size int64  `json:"size"`
+}
+
+// Manifest lists every file a session left behind so they are found and
+// deleted together
+type Manifest struct {
+	SessionID string     `json:"sessionId"`
+	Repo      string     `json:"repo,omitempty"`
+	FilePath  string     `json:"filePath,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+	EndedAt   *time.Time `json:"endedAt,omitempty"`
+	Files     []File     `json:"files"`
+}
+
+// Bytes returns the total size of the session's artifacts of one type,
+// or of all of them when artifactType is empty
+func (m *Manifest) Bytes(artifactType string) int64 {
+	var total int64
+	for _, f := range m.Files {
+		if artifactType == "" || f.Type == artifactType {
+			total += f.Size
+		}
+	}
+	return total
+}
+
+// has reports whether the session kept any artifact of a type, even an empty one
+func (m *Manifest) has(artifactType string) bool {
+	for _, f := range m.Files {
+		if f.Type == artifactType {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Manifest) copy() Manifest {
+	cp := *m
+	cp.Files = append([]File{}, m.Files...)
+	return cp
+}
+
+// Deletion reports the files removed for one session
+type Deletion struct {
+	SessionID string   `json:"sessionId"`
+	Types     []string `json:"types"`
+	Files     []string `json:"files"`
+	Bytes     int64    `json:"bytes"`
+	Session   bool     `json:"session"` // nothing is left; the session is no longer listed
+}
+
+// Store keeps session artifacts under <state-dir>/sessions/<id>/, each
+// directory holding a manifest that lists its files
+type Store struct {
+	dir       string
+	manifests map[string]*Manifest
+	logger    *slog.Logger
+	bus       *events.Bus
+	mu        sync.Mutex
+}
+
+// OpenStore loads the manifests under stateDir. Deletions interrupted by a
+// crash are finished, files no manifest lists are removed, and sessions
+// left open by the previous run are marked ended.
+func OpenStore(stateDir string) (*Store, error) {
+	dir := filepath.Join(stateDir, sessionsDir)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+
+	s := &Store{
+		dir:       dir,
+		manifests: make(map[string]*Manifest),
+		logger:    logging.Component(nil, "retention"),
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", dir, err)
+	}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if strings.HasPrefix(entry.Name(), deletingPrefix) {
+			os.RemoveAll(path)
+			continue
+		}
+		if !entry.IsDir() {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(path, manifestFile))
+		if err != nil {
+			s.logger.Warn("Skipping session artifacts", "dir", path, "err", err)
+			continue
+		}
+		var m Manifest
+		if err := json.Unmarshal(data, &m); err != nil || m.SessionID != entry.Name() {
+			s.logger.Warn("Skipping session artifacts with an invalid manifest", "dir", path)
+			continue
+		}
+		s.sweep(&m)
+		s.manifests[m.SessionID] = &m
+
+		// Sessions live in memory, so one the last run never ended is over
+		if m.EndedAt == nil {
+			ended := time.Now()
+			if info, err := os.Stat(filepath.Join(path, manifestFile)); err == nil {
+				ended = info.ModTime()
+			}
+			m.EndedAt = &ended
+			if err := s.saveLocked(&m); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return s, nil
+}
+
+// SetBus sets the bus changes to ended sessions' artifacts are published on
+func (s *Store) SetBus(bus *events.Bus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bus = bus
+}
+
+// publishLocked publishes eventType with a copy of m
+func (s *Store) publishLocked(eventType string, m *Manifest) {
+	s.bus.Publish(eventType, m.copy())
+}
+
+// sweep drops manifest entries whose file is gone and removes files the
+// manifest doesn't list, left over when a partial deletion was interrupted
+func (s *Store) sweep(m *Manifest) {
+	listed := map[string]bool{manifestFile: true}
+	kept := m.Files[:0]
+	for _, f := range m.Files {
+		info, err := os.Stat(s.path(m.SessionID, f.Name))
+		if err != nil {
+			continue
+		}
+		f.Size = info.Size()
+		kept = append(kept, f)
+		listed[f.Name] = true
+	}
+	m.Files = kept
+
+	entries, _ := os.ReadDir(filepath.Join(s.dir, m.SessionID))
+	for _, entry := range entries {
+		if !listed[entry.Name()] {
+			os.RemoveAll(s.path(m.SessionID, entry.Name()))
+		}
+	}
+}
+
+func (s *Store) path(sessionID, name string) string {
+	return filepath.Join(s.dir, sessionID, name)
+}
+
+// validName rejects IDs and file names that would escape their directory
+func validName(name string) bool {
+	return name != "" && !strings.HasPrefix(name, ".") && !strings.ContainsAny(name, `/\`) && name != manifestFile
+}
+
+// Append adds data to one of a session's artifacts, creating the artifact
+// and the session's manifest as needed
+func (s *Store) Append(sessionID, artifactType, name string, data []byte) error {
+	if !validName(sessionID) || !validName(name) {
+		return fmt.Errorf("invalid artifact %q for session %q", name, sessionID)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, err := s.manifestLocked(sessionID)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(s.path(sessionID, name), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	for i := range m.Files {
+		if m.Files[i].Name == name {
+			m.Files[i].Size += int64(len(data))
+			return s.saveLocked(m)
+		}
+	}
+	m.Files = append(m.Files, File{Type: artifactType, Name: name, Size: int64(len(data))})
+	if err := s.saveLocked(m); err != nil {
+		return err
+	}
+	if m.EndedAt != nil {
+		s.publishLocked(EventArtifactsUpdated, m)
+	}
+	return nil
+}
+
+// End marks a session on filePath in repo as ended, making its artifacts
+// subject to the policy
+func (s *Store) End(sessionID, repo, filePath string, at time.Time) error {
+	if !validName(sessionID) {
+		return fmt.Errorf("invalid session ID %q", sessionID)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, err := s.manifestLocked(sessionID)
+	if err != nil {
+		return err
+	}
+	m.Repo = repo
+	m.FilePath = filePath
+	m.EndedAt = &at
+	if err := s.saveLocked(m); err != nil {
+		return err
+	}
+	s.publishLocked(EventArtifactsKept, m)
+	return nil
+}
+
+// Reopen takes a session restored after a restart, which OpenStore marked
+// ended, back out from under the policy
+func (s *Store) Reopen(sessionID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, ok := s.manifests[sessionID]
+	if !ok || m.EndedAt == nil {
+		return nil
+	}
+	m.EndedAt = nil
+	if err := s.saveLocked(m); err != nil {
+		return err
+	}
+	s.publishLocked(EventArtifactsReopened, m)
+	return nil
+}
+
+// manifestLocked returns the session's manifest, creating its directory
+func (s *Store) manifestLocked(sessionID string) (*Manifest, error) {
+	if m, ok := s.manifests[sessionID]; ok {
+		return m, nil
+	}
+	if err := os.MkdirAll(filepath.Join(s.dir, sessionID), 0o700); err != nil {
+		return nil, err
+	}
+	m := &Manifest{SessionID: sessionID, CreatedAt: time.Now(), Files: []File{}}
+	s.manifests[sessionID] = m
+	return m, nil
+}
+
+func (s *Store) saveLocked(m *Manifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := s.path(m.SessionID, manifestFile)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write manifest for %s: %w", m.SessionID, err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// Ended returns the manifests of ended sessions, most recently ended first
+func (s *Store) Ended() []Manifest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.endedLocked()
+}
+
+func (s *Store) endedLocked() []Manifest {
+	ended := make([]Manifest, 0, len(s.manifests))
+	for _, m := range s.manifests {
+		if m.EndedAt != nil {
+			ended = append(ended, m.copy())
+		}
+	}
+	sort.Slice(ended, func(i, j int) bool {
+		if !ended[i].EndedAt.Equal(*ended[j].EndedAt) {
+			return ended[i].EndedAt.After(*ended[j].EndedAt)
+		}
+		return ended[i].SessionID < ended[j].SessionID
+	})
+	return ended
+}
+
+// Get returns a copy of a session's manifest
+func (s *Store) Get(sessionID string) (Manifest, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, ok := s.manifests[sessionID]
+	if !ok {
+		return Manifest{}, false
+	}
+	return m.copy(), true
+}
+
+// Read returns the content of one of a session's artifacts
+func (s *Store) Read(sessionID, name string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, ok := s.manifests[sessionID]
+	if !ok {
+		return nil, ErrUnknownSession
+	}
+	for _, f := range m.Files {
+		if f.Name == name {
+			return os.ReadFile(s.path(sessionID, name))
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+// Delete removes every artifact of an ended session at once
+func (s *Store) Delete(sessionID string) (Deletion, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, ok := s.manifests[sessionID]
+	if !ok {
+		return Deletion{}, ErrUnknownSession
+	}
+	if m.EndedAt == nil {
+		return Deletion{}, ErrActiveSession
+	}
+	return s.deleteLocked(m, nil)
+}
+
+// deleteLocked removes the session's artifacts of the given types, or all
+// of them when types is nil. Removing everything renames the directory
+// aside first, so the session disappears in one step; removing some
+// rewrites the manifest before the files go, so it never lists a missing one.
+func (s *Store) deleteLocked(m *Manifest, types map[string]bool) (Deletion, error) {
+	d := Deletion{SessionID: m.SessionID}
+	var kept []File
+	seen := make(map[string]bool)
+	for _, f := range m.Files {
+		if types != nil && !types[f.Type] {
+			kept = append(kept, f)
+			continue
+		}
+		d.Files = append(d.Files, f.Name)
+		d.Bytes += f.Size
+		if !seen[f.Type] {
+			seen[f.Type] = true
+			d.Types = append(d.Types, f.Type)
+		}
+	}
+	sort.Strings(d.Types)
+
+	if len(kept) == 0 {
+		dir := filepath.Join(s.dir, m.SessionID)
+		trash := filepath.Join(s.dir, deletingPrefix+m.SessionID)
+		if err := os.Rename(dir, trash); err != nil {
+			return Deletion{}, err
+		}
+		delete(s.manifests, m.SessionID)
+		d.Session = true
+		s.publishLocked(EventArtifactsDeleted, m)
+		return d, os.RemoveAll(trash)
+	}
+
+	files := m.Files
+	m.Files = kept
+	if err := s.saveLocked(m); err != nil {
+		m.Files = files
+		return Deletion{}, err
+	}
+	s.publishLocked(EventArtifactsUpdated, m)
+	for _, name := range d.Files {
+		if err := os.Remove(s.path(m.SessionID, name)); err != nil && !os.IsNotExist(err) {
+			s.logger.Warn("Failed to remove session artifact", "session", m.SessionID, "file", name, "err", err)
+		}
+	}
+	return d, nil
+}
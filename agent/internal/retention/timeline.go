@@ -0,0 +1,66 @@
+package retention
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/zeropr/agent/internal/events"
+	"github.com/zeropr/agent/internal/sessions"
+)
+
+// timelineFile is the artifact each session's timeline is appended to
+const timelineFile = "timeline.jsonl"
+
+// timelineEntry is one line of a session timeline
+type timelineEntry struct {
+	Time         time.Time `json:"time"`
+	Event        string    `json:"event"`
+	Participants []string  `json:"participants"`
+	Locks        int       `json:"locks"`
+}
+
+// RecordTimelines appends every session event on bus to that session's
+// timeline and marks sessions ended in the store, until ctx is done
+func RecordTimelines(ctx context.Context, bus *events.Bus, store *Store) {
+	ch, unsubscribe := bus.Subscribe("timeline", 64)
+	defer unsubscribe()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-ch:
+			if !ok {
+				return
+			}
+			if gap, ok := event.Data.(events.Gap); ok {
+				store.logger.Warn("Session timelines missed events", "afterEvent", gap.LastEventID)
+				continue
+			}
+			session, ok := event.Data.(sessions.Session)
+			if !ok {
+				continue
+			}
+
+			line, err := json.Marshal(timelineEntry{
+				Time:         event.Time,
+				Event:        event.Type,
+				Participants: session.Participants,
+				Locks:        len(session.Locks),
+			})
+			if err != nil {
+				continue
+			}
+			if err := store.Append(session.ID, TypeTimeline, timelineFile, append(line, '\n')); err != nil {
+				store.logger.Warn("Failed to record session timeline", "session", session.ID, "err", err)
+				continue
+			}
+			if event.Type == sessions.EventSessionEnded {
+				if err := store.End(session.ID, session.Repo, session.FilePath, event.Time); err != nil {
+					store.logger.Warn("Failed to mark session ended", "session", session.ID, "err", err)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/zeropr/agent/internal/api"
+	"github.com/zeropr/agent/internal/auth"
+	"github.com/zeropr/agent/internal/i18n"
+	"github.com/zeropr/agent/internal/peerclient"
+)
+
+type contextKey int
+
+const (
+	tokenContextKey contextKey = iota
+	peerContextKey
+)
+
+// routeScopes returns the scopes any one of which grants access to the
+// request, or nil for public routes such as the liveness probe. Every route
+// is listed; one that isn't falls back to admin, and the route table test
+// fails until it's classified.
+func routeScopes(r *http.Request) []string {
+	path := r.URL.Path
+	read := r.Method == http.MethodGet
+
+	switch {
+	case path == "/api/status" || path == "/api/ready" || path == peerclient.AttestationPath:
+		return nil
+	case path == "/api/peer/offline":
+		// Signed by the departing agent, and only ever drops the signer
+		return nil
+	case strings.HasPrefix(path, "/ws/sync"), strings.HasPrefix(path, "/ws/chat"), strings.HasPrefix(path, "/ws/bridge"):
+		// Each takes the sync or bridge token that creating, joining or
+		// bridging issued, in place of an API token, and answers 401 without it
+		return nil
+	case strings.HasPrefix(path, "/api/tokens"), strings.HasPrefix(path, "/api/debug"),
+		strings.HasPrefix(path, "/api/trust"), strings.HasSuffix(path, "/trust"),
+		strings.HasSuffix(path, "/trust/verify"), strings.HasSuffix(path, "/pairing-code"),
+		path == "/api/admin/reload", path == "/api/retention/run":
+		return []string{auth.ScopeAdmin}
+	case path == "/api/retention":
+		if read {
+			return []string{auth.ScopeRead}
+		}
+		return []string{auth.ScopeAdmin}
+	case path == "/api/mode":
+		// Leaving read-only mode starts serving files again
+		if read {
+			return []string{auth.ScopeRead, auth.ScopePeers}
+		}
+		return []string{auth.ScopeAdmin}
+	case path == "/metrics", path == "/ws/events":
+		return []string{auth.ScopeRead}
+	case path == "/api/fetches", path == "/api/fetches/away":
+		// The fetch journal names the files peers took, not their content
+		return []string{auth.ScopeRead, auth.ScopeFiles}
+	case strings.HasPrefix(path, "/api/file"), strings.HasPrefix(path, "/api/transfers"):
+		return []string{auth.ScopeFiles}
+	case strings.HasPrefix(path, "/api/session"):
+		if read {
+			return []string{auth.ScopeRead, auth.ScopeSessions}
+		}
+		return []string{auth.ScopeSessions}
+	case strings.HasPrefix(path, "/api/peers"), path == "/api/presence", strings.HasPrefix(path, "/api/broadcast"),
+		path == "/api/planes":
+		if read {
+			return []string{auth.ScopeRead, auth.ScopePeers}
+		}
+		return []string{auth.ScopePeers}
+	default:
+		return []string{auth.ScopeAdmin}
+	}
+}
+
+// authMiddleware resolves the presented token and enforces route scopes.
+// It is a no-op when token auth is disabled.
+func (s *Server) authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scopes := routeScopes(r)
+		if s.tokens == nil || scopes == nil || r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Trusted agents prove themselves by signature rather than token
+		if caller, ok := peerFromContext(r.Context()); ok && caller.Trusted && peerRoute(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		secret := bearerToken(r)
+		if secret == "" {
+			s.writeError(w, r, http.StatusUnauthorized, CodeMissingToken, i18n.MsgMissingToken)
+			return
+		}
+
+		token, err := s.tokens.Authenticate(secret)
+		if err != nil {
+			s.writeError(w, r, http.StatusUnauthorized, CodeInvalidToken, i18n.MsgInvalidToken)
+			return
+		}
+
+		allowed := false
+		for _, scope := range scopes {
+			if token.HasScope(scope) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			s.writeError(w, r, http.StatusForbidden, CodeInsufficientScope, i18n.MsgInsufficientScope)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tokenContextKey, token)))
+	})
+}
+
+// bearerToken extracts the token from the Authorization header, falling
+// back to a token query parameter for WebSocket clients that can't set headers.
+func bearerToken(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+	}
+	return r.URL.Query().Get("token")
+}
+
+// Token management handlers
+
+func (s *Server) handleListTokens(w http.ResponseWriter, r *http.Request) {
+	if s.tokens == nil {
+		s.writeError(w, r, http.StatusNotFound, CodeFeatureDisabled, i18n.MsgTokensDisabled)
+		return
+	}
+
+	type tokenView struct {
+		auth.Token
+		Hash string `json:"hash,omitempty"`
+	}
+
+	// Only prefixes are ever listed; hashes stay on disk
+	list := s.tokens.List()
+	views := make([]tokenView, 0, len(list))
+	for _, t := range list {
+		views = append(views, tokenView{Token: t})
+	}
+
+	writeList(s, w, r, tokenList, views)
+}
+
+func (s *Server) handleCreateToken(w http.ResponseWriter, r *http.Request) {
+	if s.tokens == nil {
+		s.writeError(w, r, http.StatusNotFound, CodeFeatureDisabled, i18n.MsgTokensDisabled)
+		return
+	}
+
+	var req struct {
+		Name   string   `json:"name"`
+		Scopes []string `json:"scopes"`
+	}
+	if err := api.DecodeLocal(r.Body, &req); err != nil {
+		s.writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, i18n.MsgInvalidRequest)
+		return
+	}
+
+	secret, token, err := s.tokens.Create(req.Name, req.Scopes)
+	if err != nil {
+		s.writeErrorFor(w, r, http.StatusBadRequest, CodeInvalidRequest, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":     token.ID,
+		"name":   token.Name,
+		"prefix": token.Prefix,
+		"scopes": token.Scopes,
+		"token":  secret.Reveal(),
+	})
+}
+
+func (s *Server) handleRevokeToken(w http.ResponseWriter, r *http.Request) {
+	if s.tokens == nil {
+		s.writeError(w, r, http.StatusNotFound, CodeFeatureDisabled, i18n.MsgTokensDisabled)
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	if err := s.tokens.Revoke(id); err != nil {
+		if err == auth.ErrUnknownToken {
+			s.writeErrorFor(w, r, http.StatusNotFound, CodeTokenNotFound, err)
+			return
+		}
+		s.writeErrorFor(w, r, http.StatusBadRequest, CodeInvalidRequest, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "revoked"})
+}
@@ -0,0 +1,295 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/zeropr/agent/internal/auth"
+	"github.com/zeropr/agent/internal/metrics"
+	"github.com/zeropr/agent/internal/peerclient"
+)
+
+// routeScopeTable is the scopes each registered route takes, by method and
+// path template; "public" routes take none
+var routeScopeTable = map[string]string{
+	"GET /api/status":                       "public",
+	"GET /api/ready":                        "public",
+	"GET " + peerclient.AttestationPath:     "public",
+	"POST /api/peer/offline":                "public",
+	"GET /api/file/get":                     "files",
+	"GET /api/file/raw":                     "files",
+	"POST /api/file/request":                "files",
+	"POST /api/file/send":                   "files",
+	"GET /api/transfers":                    "files",
+	"GET /api/transfers/{id}":               "files",
+	"DELETE /api/transfers/{id}":            "files",
+	"POST /api/transfers/{id}/resume":       "files",
+	"GET /api/fetches":                      "read files",
+	"GET /api/fetches/away":                 "read files",
+	"GET /api/peers":                        "read peers",
+	"POST /api/peers":                       "peers",
+	"GET /api/peers/{id}":                   "read peers",
+	"PATCH /api/peers/{id}":                 "peers",
+	"DELETE /api/peers/{id}":                "peers",
+	"GET /api/peers/{id}/history":           "read peers",
+	"POST /api/broadcast/start":             "peers",
+	"POST /api/broadcast/stop":              "peers",
+	"GET /api/broadcast/status":             "read peers",
+	"GET /api/planes":                       "read peers",
+	"PUT /api/planes":                       "peers",
+	"GET /api/mode":                         "read peers",
+	"POST /api/mode":                        "admin",
+	"GET /api/presence":                     "read peers",
+	"POST /api/presence":                    "peers",
+	"POST /api/session/estimate":            "sessions",
+	"POST /api/session/create":              "sessions",
+	"POST /api/session/join":                "sessions",
+	"POST /api/session/leave":               "sessions",
+	"POST /api/session/bridge":              "sessions",
+	"POST /api/session/lock":                "sessions",
+	"POST /api/session/unlock":              "sessions",
+	"GET /api/session/{id}/participants":    "read sessions",
+	"POST /api/session/{id}/role":           "sessions",
+	"POST /api/session/{id}/capacity":       "sessions",
+	"GET /api/session/{id}/export":          "read sessions",
+	"GET /api/session/{id}/chat":            "read sessions",
+	"GET /api/sessions":                     "read sessions",
+	"GET /api/sessions/stats":               "read sessions",
+	"GET /api/sessions/ended":               "read sessions",
+	"DELETE /api/sessions/ended/{id}":       "sessions",
+	"GET /ws/sync/{sessionId}":              "public",
+	"GET /ws/chat/{sessionId}":              "public",
+	"GET /ws/bridge/{sessionId}":            "public",
+	"GET /ws/events":                        "read",
+	"GET /metrics":                          "read",
+	"GET /api/retention":                    "read",
+	"PUT /api/retention":                    "admin",
+	"POST /api/retention/run":               "admin",
+	"GET /api/debug/runtime":                "admin",
+	"POST /api/debug/capture-divergence":    "admin",
+	"POST /api/debug/capture-requests/{id}": "admin",
+	"POST /api/debug/divergence-segment":    "admin",
+	"POST /api/debug/add-mock-peer":         "admin",
+	"POST /api/admin/reload":                "admin",
+	"GET /api/tokens":                       "admin",
+	"POST /api/tokens":                      "admin",
+	"DELETE /api/tokens/{id}":               "admin",
+	"GET /api/trust":                        "admin",
+	"POST /api/trust/reconcile":             "admin",
+	"POST /api/trust/{fingerprint}/resolve": "admin",
+	"GET /api/trust/export":                 "admin",
+	"POST /api/trust/import":                "admin",
+	"POST /api/peers/{id}/trust":            "admin",
+	"DELETE /api/peers/{id}/trust":          "admin",
+	"POST /api/peers/{id}/trust/verify":     "admin",
+	"GET /api/peers/{id}/pairing-code":      "admin",
+}
+
+// TestRouteScopes checks every route the local router registers against
+// the table, so a new route can't fall back to admin unnoticed
+func TestRouteScopes(t *testing.T) {
+	a := newTestAgent(t, "-debug")
+	a.srv.SetMetrics(metrics.New())
+	router := a.srv.Handler().(*mux.Router)
+
+	seen := map[string]bool{}
+	err := router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil || route.GetHandler() == nil { // a subrouter's prefix
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			methods = []string{http.MethodGet} // sockets upgrade a GET
+		}
+		path := strings.NewReplacer("{id}", "x", "{sessionId}", "x", "{fingerprint}", "x").Replace(template)
+		for _, method := range methods {
+			key := method + " " + template
+			seen[key] = true
+			want, ok := routeScopeTable[key]
+			if !ok {
+				t.Errorf("%s isn't in the route scope table", key)
+				continue
+			}
+			got := strings.Join(routeScopes(httptest.NewRequest(method, path, nil)), " ")
+			if got == "" {
+				got = "public"
+			}
+			if got != want {
+				t.Errorf("%s takes %q, want %q", key, got, want)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key := range routeScopeTable {
+		if !seen[key] {
+			t.Errorf("%s is in the table but not registered", key)
+		}
+	}
+}
+
+// withTokens has the agent require tokens, sending the primary one
+func (a *testAgent) withTokens(t *testing.T) {
+	t.Helper()
+	store, err := auth.OpenStore(a.stateDir, a.storage(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.srv.RequireTokens(store)
+	primary, err := os.ReadFile(filepath.Join(a.stateDir, "token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.token = strings.TrimSpace(string(primary))
+}
+
+// createToken returns the secret and ID of a new token with scopes
+func (a *testAgent) createToken(t *testing.T, scopes ...string) (secret, id string) {
+	t.Helper()
+	var created struct {
+		Token string `json:"token"`
+		ID    string `json:"id"`
+	}
+	quoted := make([]string, len(scopes))
+	for i, scope := range scopes {
+		quoted[i] = fmt.Sprintf("%q", scope)
+	}
+	a.post(t, "/api/tokens", fmt.Sprintf(`{"name":"test","scopes":[%s]}`, strings.Join(quoted, ",")), &created)
+	if created.Token == "" || created.ID == "" {
+		t.Fatalf("token create answered %+v", created)
+	}
+	return created.Token, created.ID
+}
+
+// as returns the status of a local API request sent with token
+func (a *testAgent) as(t *testing.T, token, method, path, body string) int {
+	t.Helper()
+	saved := a.token
+	a.token = token
+	defer func() { a.token = saved }()
+	status, _ := a.do(t, method, path, body, nil)
+	return status
+}
+
+func TestScopeEnforcement(t *testing.T) {
+	a := newTestAgent(t)
+	a.withTokens(t)
+
+	tokens := map[string]string{}
+	for _, scope := range []string{auth.ScopeRead, auth.ScopePeers, auth.ScopeSessions, auth.ScopeFiles} {
+		tokens[scope], _ = a.createToken(t, scope)
+	}
+
+	type check struct {
+		method, path, body string
+	}
+	var (
+		readPeers     = check{http.MethodGet, "/api/peers", ""}
+		setPresence   = check{http.MethodPost, "/api/presence", `{"status":"editing"}`}
+		readSessions  = check{http.MethodGet, "/api/sessions", ""}
+		createSession = check{http.MethodPost, "/api/session/create", `{"filePath":"main.go","initiator":"alice"}`}
+		listTransfers = check{http.MethodGet, "/api/transfers", ""}
+		readJournal   = check{http.MethodGet, "/api/fetches", ""}
+		listTokens    = check{http.MethodGet, "/api/tokens", ""}
+	)
+	for _, tc := range []struct {
+		scope   string
+		allowed []check
+		denied  []check
+	}{
+		{auth.ScopeRead, []check{readPeers, readSessions, readJournal}, []check{setPresence, createSession, listTransfers, listTokens}},
+		{auth.ScopePeers, []check{readPeers, setPresence}, []check{readSessions, createSession, listTransfers, readJournal, listTokens}},
+		{auth.ScopeSessions, []check{readSessions, createSession}, []check{readPeers, setPresence, listTransfers, readJournal, listTokens}},
+		{auth.ScopeFiles, []check{listTransfers, readJournal}, []check{readPeers, setPresence, readSessions, createSession, listTokens}},
+	} {
+		for _, c := range tc.allowed {
+			if status := a.as(t, tokens[tc.scope], c.method, c.path, c.body); status != http.StatusOK {
+				t.Errorf("%s token: %s %s answered %d, want 200", tc.scope, c.method, c.path, status)
+			}
+		}
+		for _, c := range tc.denied {
+			if status := a.as(t, tokens[tc.scope], c.method, c.path, c.body); status != http.StatusForbidden {
+				t.Errorf("%s token: %s %s answered %d, want 403", tc.scope, c.method, c.path, status)
+			}
+		}
+	}
+
+	// The primary token has full scope; no token or an unknown one gets 401
+	if status := a.as(t, a.token, http.MethodGet, "/api/tokens", ""); status != http.StatusOK {
+		t.Errorf("primary token: GET /api/tokens answered %d", status)
+	}
+	if status := a.as(t, "", http.MethodGet, "/api/peers", ""); status != http.StatusUnauthorized {
+		t.Errorf("no token: GET /api/peers answered %d, want 401", status)
+	}
+	if status := a.as(t, "zpr_unknown", http.MethodGet, "/api/peers", ""); status != http.StatusUnauthorized {
+		t.Errorf("unknown token: GET /api/peers answered %d, want 401", status)
+	}
+	if status := a.as(t, "", http.MethodGet, "/api/status", ""); status != http.StatusOK {
+		t.Errorf("no token: GET /api/status answered %d, want 200", status)
+	}
+}
+
+func TestRevocationTakesEffectImmediately(t *testing.T) {
+	a := newTestAgent(t)
+	a.withTokens(t)
+	secret, id := a.createToken(t, auth.ScopeRead)
+
+	if status := a.as(t, secret, http.MethodGet, "/api/peers", ""); status != http.StatusOK {
+		t.Fatalf("before revoking: %d", status)
+	}
+	if status, body := a.do(t, http.MethodDelete, "/api/tokens/"+id, "", nil); status != http.StatusOK {
+		t.Fatalf("revoke: %d %s", status, body)
+	}
+	if status := a.as(t, secret, http.MethodGet, "/api/peers", ""); status != http.StatusUnauthorized {
+		t.Errorf("after revoking: %d, want 401", status)
+	}
+}
+
+// TestSessionSocketsWithRequiredTokens checks the sync, chat and bridge
+// sockets take the token issued for them in place of an API token, for
+// editors and for the bridges of other agents, which have neither an API
+// token nor a header to send one in
+func TestSessionSocketsWithRequiredTokens(t *testing.T) {
+	host, guest := newPairedAgents(t)
+	host.withTokens(t)
+	session := host.createSession(t, "alice")
+
+	for _, path := range []string{session.WSURL, session.ChatURL} {
+		socket := path[strings.Index(path, "/ws/"):]
+		if _, status := host.dial(t, socket); status != http.StatusSwitchingProtocols {
+			t.Errorf("%s answered %d", socket, status)
+		}
+		bare := socket[:strings.Index(socket, "?")]
+		for name, query := range map[string]string{
+			"no token":                     "",
+			"an API token":                 "?token=" + host.token,
+			"an API token as a sync token": "?sync=" + host.token,
+			"a sync token as an API token": "?token=" + session.SyncToken,
+		} {
+			if _, status := host.dial(t, bare+query); status != http.StatusUnauthorized {
+				t.Errorf("%s with %s answered %d, want 401", bare, name, status)
+			}
+		}
+	}
+
+	// A peer's bridge dials the host's sync socket with bob's sync token,
+	// and bob's editor the bridge with the token the guest issued
+	guest.withTokens(t)
+	joined := guest.bridge(t, session.SessionID, "bob", "")
+	if !strings.Contains(joined.WSPath, "?sync=") {
+		t.Fatalf("bridge answered %+v", joined)
+	}
+	if _, status := guest.dial(t, joined.WSPath); status != http.StatusSwitchingProtocols {
+		t.Fatalf("bridge socket answered %d", status)
+	}
+	waitConnected(t, host.testAgent, session.SessionID, 2)
+}
@@ -0,0 +1,270 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/zeropr/agent/internal/api"
+	"github.com/zeropr/agent/internal/i18n"
+	"github.com/zeropr/agent/internal/peerclient"
+	"github.com/zeropr/agent/internal/sessions"
+)
+
+// bridge carries a local editor's sync socket into a session another agent
+// hosts. The editor dials this agent, which dials the host, so the frames
+// passing between them are seen, and recorded, on both sides.
+type bridge struct {
+	PeerID        string
+	SessionID     string
+	ParticipantID string
+	Fingerprint   string // the host agent's identity
+	target        peerclient.Target
+	hostPath      string // the host's sync socket path, carrying the participant's token
+	hostPort      int    // where the host serves it; zero for its API port
+	token         string // what the local editor dials the bridge with
+}
+
+// bridges are the sessions on other agents local editors are in, by the
+// token each editor dials with
+type bridges struct {
+	mu      sync.Mutex
+	byToken map[string]*bridge
+}
+
+// add keeps b, replacing any earlier bridge of the same participant
+func (bs *bridges) add(b *bridge) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if bs.byToken == nil {
+		bs.byToken = make(map[string]*bridge)
+	}
+	for token, existing := range bs.byToken {
+		if existing.SessionID == b.SessionID && existing.ParticipantID == b.ParticipantID {
+			delete(bs.byToken, token)
+		}
+	}
+	bs.byToken[b.token] = b
+}
+
+// get returns the bridge into sessionID that token opens
+func (bs *bridges) get(sessionID, token string) (*bridge, bool) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	b, ok := bs.byToken[token]
+	if !ok || b.SessionID != sessionID {
+		return nil, false
+	}
+	return b, true
+}
+
+// inSession returns the bridges into a session
+func (bs *bridges) inSession(sessionID string) []*bridge {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	var found []*bridge
+	for _, b := range bs.byToken {
+		if b.SessionID == sessionID {
+			found = append(found, b)
+		}
+	}
+	return found
+}
+
+// remove drops a participant's bridge into a session, reporting whether
+// there was one and whether it was the session's last
+func (bs *bridges) remove(sessionID, participantID string) (removed, last bool) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	last = true
+	for token, b := range bs.byToken {
+		switch {
+		case b.SessionID != sessionID:
+		case b.ParticipantID == participantID:
+			delete(bs.byToken, token)
+			removed = true
+		default:
+			last = false
+		}
+	}
+	return removed, last
+}
+
+// bridgeRequest is the body of POST /api/session/bridge: a join, sent on
+// to the agent hosting the session
+type bridgeRequest struct {
+	PeerID        string `json:"peerId"`
+	SessionID     string `json:"sessionId"`
+	ParticipantID string `json:"participantId"`
+	Name          string `json:"name,omitempty"`
+	Color         string `json:"color,omitempty"`
+	Role          string `json:"role,omitempty"`
+}
+
+// handleSessionBridge joins a local participant to a session another agent
+// hosts, and hands their editor a socket on this agent that carries the
+// session's sync to and from the host
+func (s *Server) handleSessionBridge(w http.ResponseWriter, r *http.Request) {
+	var req bridgeRequest
+	if err := api.DecodeLocal(r.Body, &req); err != nil || req.PeerID == "" || req.ParticipantID == "" {
+		s.writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, i18n.MsgInvalidRequest)
+		return
+	}
+	if err := api.CheckParticipant(req.Name, req.Color, req.Role); err != nil {
+		s.writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, i18n.MsgInvalidRequest)
+		return
+	}
+	if !s.checkSessionID(w, r, req.SessionID) {
+		return
+	}
+	peer, ok := s.lookupPeer(w, r, req.PeerID)
+	if !ok {
+		return
+	}
+	if peer.Incompatible {
+		s.writeError(w, r, http.StatusConflict, CodeIncompatiblePeer, i18n.MsgPeerIncompatible, peer.IncompatibleReason, peer.Version, peer.ProtocolVersion)
+		return
+	}
+
+	body, _ := json.Marshal(api.JoinRequest{
+		Header:        api.Current,
+		SessionID:     req.SessionID,
+		ParticipantID: req.ParticipantID,
+		Name:          req.Name,
+		Color:         req.Color,
+		Role:          req.Role,
+	})
+	target := peerclient.TargetOf(peer)
+	resp, err := s.peerClient.Do(r.Context(), http.MethodPost, target, "/api/session/join", body)
+	if err != nil {
+		status, code := peerFileError(err)
+		s.writeError(w, r, status, code, i18n.MsgPeerRequestFailed, err)
+		return
+	}
+	var joined api.JoinResponse
+	err = api.DecodePeer(resp.Body, &joined, s.logger)
+	resp.Body.Close()
+	if err != nil {
+		s.writeError(w, r, http.StatusBadGateway, CodePeerRequestFailed, i18n.MsgPeerRequestFailed, err)
+		return
+	}
+
+	token, err := newBridgeToken()
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, CodeInternal, i18n.MsgBridgeIssueFailed)
+		return
+	}
+	s.bridges.add(&bridge{
+		PeerID:        peer.ID,
+		SessionID:     req.SessionID,
+		ParticipantID: req.ParticipantID,
+		Fingerprint:   peer.Fingerprint,
+		target:        target,
+		hostPath:      joined.WSPath,
+		hostPort:      joined.WSPort,
+		token:         token,
+	})
+	s.logger.Info("Bridged participant into peer's session", "peerId", peer.ID, "session", req.SessionID, "participant", req.ParticipantID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status": "joined",
+		"peerId": peer.ID,
+		"role":   joined.Role,
+		"wsPath": fmt.Sprintf("/ws/bridge/%s?sync=%s", req.SessionID, token),
+	})
+}
+
+// handleBridgeSync pipes a local editor's sync socket to the host's,
+// recording what passes each way in the session's frames
+func (s *Server) handleBridgeSync(w http.ResponseWriter, r *http.Request) {
+	sessionID := mux.Vars(r)["sessionId"]
+	if !s.checkSessionID(w, r, sessionID) {
+		return
+	}
+	b, ok := s.bridges.get(sessionID, r.URL.Query().Get("sync"))
+	if !ok {
+		s.writeError(w, r, http.StatusUnauthorized, CodeSessionToken, i18n.MsgSessionToken)
+		return
+	}
+
+	// The host is dialed first, so its refusal reaches the editor as an
+	// HTTP error like the host's own socket would answer
+	host, err := s.peerClient.DialSync(r.Context(), b.target, b.hostPort, b.hostPath)
+	if err != nil {
+		status, code := peerFileError(err)
+		s.writeError(w, r, status, code, i18n.MsgPeerRequestFailed, err)
+		return
+	}
+	defer host.Close()
+	conn, err := s.upgrader().Upgrade(w, r, nil)
+	if err != nil {
+		s.logger.Warn("WebSocket upgrade failed", "remote", r.RemoteAddr, "err", err)
+		return
+	}
+	defer conn.Close()
+	s.logger.Info("Bridge connected", "peerId", b.PeerID, "session", sessionID, "participant", b.ParticipantID)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.pipeSync(b, host, conn, sessions.FrameOut)
+		conn.Close()
+	}()
+	s.pipeSync(b, conn, host, sessions.FrameIn)
+	host.Close()
+	<-done
+	s.logger.Info("Bridge closed", "peerId", b.PeerID, "session", sessionID, "participant", b.ParticipantID)
+}
+
+// pipeSync copies frames from one end of a bridge to the other, recording
+// the binary ones, until from closes. Its close code is passed on, so the
+// editor learns why the host let it go.
+func (s *Server) pipeSync(b *bridge, from, to *websocket.Conn, direction string) {
+	for {
+		messageType, data, err := from.ReadMessage()
+		if err != nil {
+			code, text := websocket.CloseGoingAway, ""
+			var closed *websocket.CloseError
+			// 1005 and 1006 say no frame came, and can't be sent in one
+			if errors.As(err, &closed) && closed.Code != websocket.CloseNoStatusReceived && closed.Code != websocket.CloseAbnormalClosure {
+				code, text = closed.Code, closed.Text
+			}
+			to.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(time.Second))
+			return
+		}
+		if messageType == websocket.BinaryMessage {
+			s.hub.RecordFrame(b.SessionID, sessions.Frame{Participant: b.ParticipantID, Direction: direction, Data: data})
+		}
+		if err := to.WriteMessage(messageType, data); err != nil {
+			return
+		}
+	}
+}
+
+// leaveBridge drops a participant's bridge into a session, and the
+// session's recording with its last bridge. It reports whether there was
+// a bridge.
+func (s *Server) leaveBridge(sessionID, participantID string) bool {
+	removed, last := s.bridges.remove(sessionID, participantID)
+	if removed && last {
+		s.hub.ForgetFrames(sessionID)
+	}
+	return removed
+}
+
+// newBridgeToken returns a random token for an editor's bridge socket
+func newBridgeToken() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/zeropr/agent/internal/crypto"
+	"github.com/zeropr/agent/internal/peers"
+	"github.com/zeropr/agent/internal/sessions"
+)
+
+// pairedAgent is a test agent serving its peer API too, with an identity
+type pairedAgent struct {
+	*testAgent
+	identity *crypto.Identity
+	trust    *crypto.TrustStore
+	peers    *httptest.Server
+}
+
+// newPairedAgents starts two agents that list and trust each other, as
+// "host" and "guest"
+func newPairedAgents(t *testing.T, args ...string) (host, guest *pairedAgent) {
+	t.Helper()
+	start := func() *pairedAgent {
+		a := &pairedAgent{testAgent: newTestAgent(t, args...)}
+		a.identity, a.trust = a.withPeerIdentity(t)
+		a.peers = httptest.NewServer(a.srv.PeerHandler())
+		t.Cleanup(a.peers.Close)
+		return a
+	}
+	host, guest = start(), start()
+	host.lists(t, "guest", guest)
+	guest.lists(t, "host", host)
+	return host, guest
+}
+
+// lists adds other to a's peers under id, trusting its identity
+func (a *pairedAgent) lists(t *testing.T, id string, other *pairedAgent) {
+	t.Helper()
+	host, port, _ := net.SplitHostPort(other.peers.Listener.Addr().String())
+	n, _ := strconv.Atoi(port)
+	a.registry.Add(&peers.Peer{
+		ID:          id,
+		Name:        id,
+		Address:     host,
+		Port:        n,
+		Fingerprint: other.identity.Fingerprint(),
+		LastSeen:    time.Now(),
+	})
+	if _, err := a.trust.Trust(other.identity.PublicKey, id, crypto.Provenance{Method: crypto.ProvenancePairingCode, At: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// bridged is what POST /api/session/bridge answers
+type bridged struct {
+	Status string `json:"status"`
+	Role   string `json:"role"`
+	WSPath string `json:"wsPath"`
+}
+
+// bridge joins participantID to a session the "host" peer hosts
+func (a *pairedAgent) bridge(t *testing.T, sessionID, participantID, role string) bridged {
+	t.Helper()
+	var joined bridged
+	a.post(t, "/api/session/bridge", `{"peerId":"host","sessionId":"`+sessionID+`","participantId":"`+participantID+`","role":"`+role+`"}`, &joined)
+	return joined
+}
+
+func TestBridge(t *testing.T) {
+	host, guest := newPairedAgents(t)
+	session := host.createSession(t, "alice")
+	alice, _ := host.dial(t, "/ws/sync/"+session.SessionID+"?sync="+session.SyncToken)
+
+	joined := guest.bridge(t, session.SessionID, "bob", "")
+	if joined.Status != "joined" || joined.Role != sessions.RoleParticipant {
+		t.Fatalf("bridge answered %+v", joined)
+	}
+	bob, status := guest.dial(t, joined.WSPath)
+	if status != http.StatusSwitchingProtocols {
+		t.Fatalf("bridge socket answered %d", status)
+	}
+	waitConnected(t, host.testAgent, session.SessionID, 2)
+
+	// Updates cross the bridge both ways
+	alice.WriteMessage(websocket.BinaryMessage, update(1))
+	if got := readBinary(t, bob, 2*time.Second); !bytes.Equal(got, update(1)) {
+		t.Fatalf("bob got %v, want alice's update", got)
+	}
+	bob.WriteMessage(websocket.BinaryMessage, update(2))
+	if got := readBinary(t, alice, 2*time.Second); !bytes.Equal(got, update(2)) {
+		t.Fatalf("alice got %v, want bob's update", got)
+	}
+
+	// and the guest recorded them as they passed
+	segment := guest.srv.hub.Segment(session.SessionID, time.Time{}, time.Time{})
+	if len(segment) != 2 {
+		t.Fatalf("guest recorded %+v", segment)
+	}
+	for _, frame := range segment {
+		want := sessions.FrameOut
+		if bytes.Equal(frame.Data, update(2)) {
+			want = sessions.FrameIn
+		}
+		if frame.Participant != "bob" || frame.Direction != want {
+			t.Errorf("frame %+v, want bob's %s", frame, want)
+		}
+	}
+
+	// The host knows which agent joined bob
+	current, _ := host.srv.sessionMgr.Get(session.SessionID)
+	for _, member := range current.Members {
+		if want := map[string]string{"alice": "", "bob": guest.identity.Fingerprint()}[member.ID]; member.Agent != want {
+			t.Errorf("%s joined by %q, want %q", member.ID, member.Agent, want)
+		}
+	}
+
+	if _, status := guest.dial(t, "/ws/bridge/"+session.SessionID+"?sync=wrong"); status != http.StatusUnauthorized {
+		t.Errorf("a wrong bridge token got %d, want 401", status)
+	}
+
+	// Leaving drops the bridge and what it recorded
+	guest.post(t, "/api/session/leave", `{"sessionId":"`+session.SessionID+`","participantId":"bob"}`, nil)
+	if _, status := guest.dial(t, joined.WSPath); status != http.StatusUnauthorized {
+		t.Errorf("the bridge of a participant who left answered %d, want 401", status)
+	}
+	if got := guest.srv.hub.Segment(session.SessionID, time.Time{}, time.Time{}); len(got) != 0 {
+		t.Errorf("recording outlived the bridge: %+v", got)
+	}
+}
+
+func TestBridgeToUnknownSession(t *testing.T) {
+	_, guest := newPairedAgents(t)
+	status, body := guest.do(t, http.MethodPost, "/api/session/bridge", `{"peerId":"host","sessionId":"nope","participantId":"bob"}`, nil)
+	if status != http.StatusNotFound || errorCode(body) != CodeSessionNotFound {
+		t.Errorf("bridging into an unknown session answered %d %s", status, body)
+	}
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/zeropr/agent/internal/sessions"
+)
+
+func TestJoinRaceForLastSlot(t *testing.T) {
+	a := newTestAgent(t)
+	var session createdSession
+	a.post(t, "/api/session/create", `{"filePath":"main.go","initiator":"alice","maxParticipants":2}`, &session)
+
+	// Both joiners ask at once; one gets the seat, the other a full session
+	var wg sync.WaitGroup
+	codes := make(chan string, 2)
+	for _, id := range []string{"bob", "carol"} {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			body, _ := json.Marshal(map[string]string{"sessionId": session.SessionID, "participantId": id})
+			req, _ := http.NewRequest(http.MethodPost, a.local.URL+"/api/session/join", bytes.NewReader(body))
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				codes <- err.Error()
+				return
+			}
+			defer resp.Body.Close()
+			var answer struct {
+				Code string `json:"code"`
+			}
+			json.NewDecoder(resp.Body).Decode(&answer)
+			codes <- fmt.Sprintf("%d %s", resp.StatusCode, answer.Code)
+		}(id)
+	}
+	wg.Wait()
+	close(codes)
+	got := map[string]int{}
+	for code := range codes {
+		got[code]++
+	}
+	if got["200 "] != 1 || got["409 "+CodeSessionFull] != 1 {
+		t.Fatalf("joins answered %v", got)
+	}
+
+	var list struct {
+		Sessions []struct {
+			ID              string
+			MaxParticipants int
+			Occupancy       int
+		} `json:"sessions"`
+	}
+	a.do(t, http.MethodGet, "/api/sessions", "", &list)
+	if len(list.Sessions) != 1 || list.Sessions[0].MaxParticipants != 2 || list.Sessions[0].Occupancy != 2 {
+		t.Errorf("sessions %+v", list.Sessions)
+	}
+}
+
+func TestRaiseSessionCap(t *testing.T) {
+	a := newTestAgent(t, "-session-max-participants", "1")
+	session := a.createSession(t, "alice")
+	join := `{"sessionId":"` + session.SessionID + `","participantId":"bob"}`
+	if status, body := a.do(t, http.MethodPost, "/api/session/join", join, nil); status != http.StatusConflict || errorCode(body) != CodeSessionFull {
+		t.Fatalf("joining a session for one: %d %s", status, body)
+	}
+
+	capacity := "/api/session/" + session.SessionID + "/capacity"
+	for body, want := range map[string]string{
+		`{"initiator":"bob","maxParticipants":2}`:    CodeNotInitiator,
+		`{"initiator":"alice","maxParticipants":-1}`: CodeInvalidRequest,
+		`{"initiator":"alice"}`:                      CodeInvalidRequest,
+	} {
+		if _, got := a.do(t, http.MethodPost, capacity, body, nil); errorCode(got) != want {
+			t.Errorf("capacity %s: %s, want %s", body, got, want)
+		}
+	}
+	var raised struct {
+		MaxParticipants int `json:"maxParticipants"`
+		Occupancy       int `json:"occupancy"`
+	}
+	a.post(t, capacity, `{"initiator":"alice","maxParticipants":2}`, &raised)
+	if raised.MaxParticipants != 2 || raised.Occupancy != 1 {
+		t.Errorf("raised cap %+v", raised)
+	}
+	if status, body := a.do(t, http.MethodPost, "/api/session/join", join, nil); status != http.StatusOK {
+		t.Errorf("joining after the cap was raised: %d %s", status, body)
+	}
+}
+
+func TestRejoinFullSessionCloses(t *testing.T) {
+	a := newTestAgent(t, "-session-max-participants", "2")
+	session := a.createSession(t, "alice")
+	bob := a.join(t, session.SessionID, "bob", "")
+	// Bob's seat goes without his reconnection token going with it, as
+	// leaving would take it, and carol takes the seat
+	a.srv.sessionMgr.RemoveParticipant(session.SessionID, "bob")
+	a.join(t, session.SessionID, "carol", "")
+
+	// Coming back on the token, bob is told the session is full by a close
+	// frame a browser can read
+	conn, status := a.dial(t, "/ws/sync/"+session.SessionID+"?reconnect="+bob.ReconnectToken)
+	if status != http.StatusSwitchingProtocols {
+		t.Fatalf("reconnect = %d", status)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err := conn.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != sessions.CloseFull {
+		t.Errorf("rejoining a full session: %v", err)
+	}
+}
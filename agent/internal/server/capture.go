@@ -0,0 +1,526 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/zeropr/agent/internal/api"
+	"github.com/zeropr/agent/internal/i18n"
+	"github.com/zeropr/agent/internal/peerclient"
+	"github.com/zeropr/agent/internal/protocol"
+	"github.com/zeropr/agent/internal/sessions"
+	"github.com/zeropr/agent/internal/version"
+	"github.com/zeropr/agent/internal/ydoc"
+)
+
+// EventCaptureRequested asks the user whether to share a session's
+// recording with the other agent in it, for a divergence capture. It
+// carries a CaptureRequest; answer with POST
+// /api/debug/capture-requests/{id} before it expires.
+const EventCaptureRequested = "debug.capture_requested"
+
+// Reasons a side of a divergence capture holds nothing recorded
+const (
+	CaptureDeclined      = "declined"       // the other agent's user chose not to share
+	CaptureTimedOut      = "timeout"        // nobody answered on the other side in time
+	CaptureUnavailable   = "unavailable"    // the other agent couldn't be asked, e.g. it's offline or predates captures
+	CaptureNoCounterpart = "no_counterpart" // nobody in the session is on another agent
+)
+
+// What an agent is in a session, seen from a divergence capture
+const (
+	sideHost   = "host"   // serves the session's sync socket
+	sideBridge = "bridge" // carries a participant's editor to the host
+)
+
+// defaultCaptureWindow is how far back a divergence capture reaches when
+// the request doesn't say
+const defaultCaptureWindow = 5 * time.Minute
+
+// CaptureRequest is another agent's request for this agent's recording of
+// a session, waiting on the user
+type CaptureRequest struct {
+	ID          string    `json:"id"`
+	SessionID   string    `json:"sessionId"`
+	PeerID      string    `json:"peerId,omitempty"` // the asking agent, when it's listed
+	Fingerprint string    `json:"fingerprint"`
+	Since       time.Time `json:"since"`
+	Until       time.Time `json:"until"`
+	ExpiresAt   time.Time `json:"expiresAt"` // declined by default after this
+}
+
+// captureConsents are the capture requests waiting on the user, by ID
+type captureConsents struct {
+	mu      sync.Mutex
+	waiting map[string]chan bool
+}
+
+// wait registers a request and returns where its answer arrives
+func (c *captureConsents) wait(id string) <-chan bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.waiting == nil {
+		c.waiting = make(map[string]chan bool)
+	}
+	answer := make(chan bool, 1)
+	c.waiting[id] = answer
+	return answer
+}
+
+// forget drops a request that was answered or gave up
+func (c *captureConsents) forget(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.waiting, id)
+}
+
+// answer passes the user's decision to a waiting request, reporting
+// whether one was waiting
+func (c *captureConsents) answer(id string, share bool) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	answer, ok := c.waiting[id]
+	if ok {
+		answer <- share
+		delete(c.waiting, id)
+	}
+	return ok
+}
+
+// askConsent publishes a capture request and waits for the user's answer,
+// returning why nothing may be shared, or "" when it may
+func (s *Server) askConsent(ctx context.Context, request CaptureRequest) string {
+	answer := s.consents.wait(request.ID)
+	defer s.consents.forget(request.ID)
+	s.bus.Publish(EventCaptureRequested, request)
+
+	timer := time.NewTimer(time.Until(request.ExpiresAt))
+	defer timer.Stop()
+	select {
+	case share := <-answer:
+		if share {
+			return ""
+		}
+		return CaptureDeclined
+	case <-timer.C:
+		return CaptureTimedOut
+	case <-ctx.Done():
+		return CaptureTimedOut
+	}
+}
+
+// counterpart is another agent in a session
+type counterpart struct {
+	peerID      string // when known without looking it up
+	fingerprint string
+	role        string
+}
+
+// counterparts returns the other agents in a session this agent hosts or
+// bridges into, with what this agent is in it, and whether it's in it at
+// all. A host's counterparts are the agents that joined participants to
+// it; a bridge's is the host.
+func (s *Server) counterparts(sessionID string) ([]counterpart, string, bool) {
+	if session, ok := s.sessionMgr.Get(sessionID); ok {
+		var found []counterpart
+		seen := make(map[string]bool)
+		for _, member := range session.Members {
+			if member.Agent != "" && !seen[member.Agent] {
+				seen[member.Agent] = true
+				found = append(found, counterpart{fingerprint: member.Agent, role: sideBridge})
+			}
+		}
+		return found, sideHost, true
+	}
+	bridges := s.bridges.inSession(sessionID)
+	if len(bridges) == 0 {
+		return nil, "", false
+	}
+	// Every bridge into a session leads to the same host
+	return []counterpart{{peerID: bridges[0].PeerID, fingerprint: bridges[0].Fingerprint, role: sideHost}}, sideBridge, true
+}
+
+// segmentOf is what an agent shares of the frames it recorded: the frames,
+// the document those that weren't dropped add up to, and the state vector
+// each participant last announced
+func segmentOf(frames []sessions.Frame) api.Segment {
+	segment := api.Segment{
+		Header:          api.Current,
+		Shared:          true,
+		Version:         version.Version,
+		ProtocolVersion: protocol.Version,
+		Frames:          make([]api.RecordedFrame, 0, len(frames)),
+	}
+	var updates [][]byte
+	for _, frame := range frames {
+		segment.Frames = append(segment.Frames, api.RecordedFrame(frame))
+		if frame.Dropped == "" {
+			updates = append(updates, frame.Data)
+		}
+		if frame.Direction != sessions.FrameIn {
+			continue
+		}
+		if vector, ok, _ := ydoc.StateVectorOf(frame.Data); ok {
+			if segment.StateVectors == nil {
+				segment.StateVectors = make(map[string]map[uint64]uint64)
+			}
+			segment.StateVectors[frame.Participant] = vector
+		}
+	}
+	document, _ := ydoc.FromMessages(updates)
+	segment.Document = &document
+	return segment
+}
+
+// handleDivergenceSegment answers another agent's divergence capture with
+// this agent's recording of the session they share, if the user agrees
+func (s *Server) handleDivergenceSegment(w http.ResponseWriter, r *http.Request) {
+	caller, ok := peerFromContext(r.Context())
+	if !ok || !caller.Trusted {
+		s.writeError(w, r, http.StatusForbidden, CodeUntrustedPeer, i18n.MsgUntrustedPeer)
+		return
+	}
+	var req api.SegmentRequest
+	if err := api.DecodePeer(r.Body, &req, s.logger); err != nil {
+		s.writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, i18n.MsgInvalidRequest)
+		return
+	}
+	if !s.checkSessionID(w, r, req.SessionID) {
+		return
+	}
+	if !s.hub.RecordingFrames() {
+		s.writeError(w, r, http.StatusNotFound, CodeFeatureDisabled, i18n.MsgRecordingDisabled)
+		return
+	}
+	// Only an agent in the session learns it exists
+	others, _, _ := s.counterparts(req.SessionID)
+	party := false
+	for _, other := range others {
+		party = party || other.fingerprint == caller.Fingerprint
+	}
+	if !party {
+		s.writeError(w, r, http.StatusNotFound, CodeSessionNotFound, i18n.MsgSessionNotFound)
+		return
+	}
+
+	id, err := newCaptureID()
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, CodeInternal, i18n.MsgCaptureFailed, err)
+		return
+	}
+	request := CaptureRequest{
+		ID:          id,
+		SessionID:   req.SessionID,
+		Fingerprint: caller.Fingerprint,
+		Since:       req.Since,
+		Until:       req.Until,
+		ExpiresAt:   time.Now().Add(s.consentWait),
+	}
+	if peer, err := s.registry.Resolve(caller.Fingerprint); err == nil {
+		request.PeerID = peer.ID
+	}
+	s.logger.Info("Peer asked for session recording", "session", req.SessionID, "fingerprint", caller.Fingerprint, "request", id)
+
+	segment := api.Segment{Header: api.Current, Version: version.Version, ProtocolVersion: protocol.Version}
+	if segment.Reason = s.askConsent(r.Context(), request); segment.Reason == "" {
+		segment = segmentOf(s.hub.Segment(req.SessionID, req.Since, req.Until))
+	}
+	s.logger.Info("Answered peer's capture request", "session", req.SessionID, "request", id, "shared", segment.Shared, "reason", segment.Reason)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(segment)
+}
+
+// handleResolveCapture passes on the user's answer to a capture request
+func (s *Server) handleResolveCapture(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Decision string `json:"decision"`
+	}
+	if err := api.DecodeLocal(r.Body, &req); err != nil || (req.Decision != "share" && req.Decision != "decline") {
+		s.writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, i18n.MsgCaptureDecision)
+		return
+	}
+	id := mux.Vars(r)["id"]
+	if !s.consents.answer(id, req.Decision == "share") {
+		s.writeError(w, r, http.StatusNotFound, CodeCaptureNotFound, i18n.MsgCaptureNotFound)
+		return
+	}
+	s.logger.Info("Resolved capture request", "request", id, "decision", req.Decision)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": req.Decision})
+}
+
+// captureSide is one agent's part of a divergence capture
+type captureSide struct {
+	Agent           string                       `json:"agent"` // "local", or the other agent's peer ID
+	Fingerprint     string                       `json:"fingerprint,omitempty"`
+	Role            string                       `json:"role"` // sideHost or sideBridge
+	Shared          bool                         `json:"shared"`
+	Reason          string                       `json:"reason,omitempty"` // why not, when not shared
+	Error           string                       `json:"error,omitempty"`  // what went wrong asking, when unavailable
+	Version         string                       `json:"version,omitempty"`
+	ProtocolVersion string                       `json:"protocolVersion,omitempty"`
+	SchemaVersion   int                          `json:"schemaVersion,omitempty"`
+	Frames          int                          `json:"frames"`
+	FramesFile      string                       `json:"framesFile,omitempty"` // in the archive
+	Document        *ydoc.State                  `json:"document,omitempty"`
+	StateVectors    map[string]map[uint64]uint64 `json:"stateVectors,omitempty"`
+	Missing         map[uint64]uint64            `json:"missing,omitempty"` // per client, operations another side has and this one lacks
+
+	frames []api.RecordedFrame
+}
+
+// sideOf turns an agent's segment into its side of a capture
+func sideOf(segment api.Segment) captureSide {
+	return captureSide{
+		Shared:          segment.Shared,
+		Reason:          segment.Reason,
+		Version:         segment.Version,
+		ProtocolVersion: segment.ProtocolVersion,
+		SchemaVersion:   segment.Schema(),
+		Frames:          len(segment.Frames),
+		Document:        segment.Document,
+		StateVectors:    segment.StateVectors,
+		frames:          segment.Frames,
+	}
+}
+
+// captureManifest is manifest.json in a divergence capture
+type captureManifest struct {
+	SessionID   string        `json:"sessionId"`
+	CapturedAt  time.Time     `json:"capturedAt"`
+	Since       time.Time     `json:"since"`
+	Until       time.Time     `json:"until"`
+	SingleSided bool          `json:"singleSided"`
+	Reason      string        `json:"reason,omitempty"` // why, when single-sided
+	Diverged    bool          `json:"diverged"`         // the shared sides' documents differ
+	Compatible  bool          `json:"protocolCompatible"`
+	Sides       []captureSide `json:"sides"` // this agent's first
+}
+
+// compare fills in what the sides' documents say about each other
+func (m *captureManifest) compare() {
+	local := &m.Sides[0]
+	m.SingleSided = true
+	m.Compatible = true
+	m.Reason = CaptureNoCounterpart
+	for i := range m.Sides[1:] {
+		side := &m.Sides[i+1]
+		if !side.Shared {
+			if m.SingleSided {
+				m.Reason = side.Reason
+			}
+			continue
+		}
+		m.SingleSided, m.Reason = false, ""
+		m.Compatible = m.Compatible && protocol.Compatible(local.ProtocolVersion, side.ProtocolVersion)
+		m.Diverged = m.Diverged || side.Document.Hash != local.Document.Hash
+		side.Missing = ydoc.Missing(local.Document.Vector, side.Document.Vector)
+		for client, n := range ydoc.Missing(side.Document.Vector, local.Document.Vector) {
+			if local.Missing == nil {
+				local.Missing = make(map[uint64]uint64)
+			}
+			if n > local.Missing[client] {
+				local.Missing[client] = n
+			}
+		}
+	}
+}
+
+// divergenceRequest is the body of POST /api/debug/capture-divergence
+type divergenceRequest struct {
+	SessionID     string `json:"sessionId"`
+	WindowSeconds int    `json:"windowSeconds,omitempty"` // default defaultCaptureWindow
+}
+
+// handleCaptureDivergence bundles what this agent and the other agents in
+// a session recorded of it over the same window into one archive under the
+// debug directory
+func (s *Server) handleCaptureDivergence(w http.ResponseWriter, r *http.Request) {
+	var req divergenceRequest
+	if err := api.DecodeLocal(r.Body, &req); err != nil || req.WindowSeconds < 0 {
+		s.writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, i18n.MsgInvalidRequest)
+		return
+	}
+	if !s.checkSessionID(w, r, req.SessionID) {
+		return
+	}
+	if !s.hub.RecordingFrames() {
+		s.writeError(w, r, http.StatusNotFound, CodeFeatureDisabled, i18n.MsgRecordingDisabled)
+		return
+	}
+	others, role, ok := s.counterparts(req.SessionID)
+	if !ok {
+		s.writeError(w, r, http.StatusNotFound, CodeSessionNotFound, i18n.MsgSessionNotFound)
+		return
+	}
+
+	window := defaultCaptureWindow
+	if req.WindowSeconds > 0 {
+		window = time.Duration(req.WindowSeconds) * time.Second
+	}
+	manifest := &captureManifest{SessionID: req.SessionID, CapturedAt: time.Now().UTC()}
+	manifest.Until = manifest.CapturedAt
+	manifest.Since = manifest.Until.Add(-window)
+
+	local := sideOf(segmentOf(s.hub.Segment(req.SessionID, manifest.Since, manifest.Until)))
+	local.Agent, local.Role = "local", role
+	if s.identity != nil {
+		local.Fingerprint = s.identity.Fingerprint()
+	}
+	// Each side waits on its own user, so they're asked at once
+	remote := make([]captureSide, len(others))
+	var wg sync.WaitGroup
+	for i, other := range others {
+		wg.Add(1)
+		go func(i int, other counterpart) {
+			defer wg.Done()
+			remote[i] = s.askCounterpart(r.Context(), manifest, other)
+		}(i, other)
+	}
+	wg.Wait()
+	manifest.Sides = append([]captureSide{local}, remote...)
+	manifest.compare()
+
+	path, err := s.writeCapture(manifest)
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, CodeInternal, i18n.MsgCaptureFailed, err)
+		return
+	}
+	s.logger.Info("Captured session divergence", "session", req.SessionID, "path", path, "singleSided", manifest.SingleSided, "diverged", manifest.Diverged)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"path":     path,
+		"manifest": manifest,
+	})
+}
+
+// askCounterpart asks another agent in the session for its side of a
+// capture. Failing to reach it leaves its side empty and unavailable.
+func (s *Server) askCounterpart(ctx context.Context, manifest *captureManifest, other counterpart) captureSide {
+	unavailable := func(err error) captureSide {
+		return captureSide{Agent: other.peerID, Fingerprint: other.fingerprint, Role: other.role, Reason: CaptureUnavailable, Error: err.Error()}
+	}
+	ref := other.peerID
+	if ref == "" {
+		ref = other.fingerprint
+	}
+	peer, err := s.registry.Resolve(ref)
+	if err != nil {
+		return unavailable(err)
+	}
+	other.peerID = peer.ID
+
+	body, _ := json.Marshal(api.SegmentRequest{
+		Header:    api.Current,
+		SessionID: manifest.SessionID,
+		Since:     manifest.Since,
+		Until:     manifest.Until,
+	})
+	resp, err := s.peerClient.Do(ctx, http.MethodPost, peerclient.TargetOf(peer), "/api/debug/divergence-segment", body)
+	if err != nil {
+		return unavailable(err)
+	}
+	var segment api.Segment
+	err = api.DecodePeer(resp.Body, &segment, s.logger)
+	resp.Body.Close()
+	if err != nil {
+		return unavailable(err)
+	}
+	side := sideOf(segment)
+	side.Agent, side.Fingerprint, side.Role = other.peerID, other.fingerprint, other.role
+	return side
+}
+
+// writeCapture stores a capture as a gzipped tar under the debug
+// directory, holding manifest.json and each shared side's frames as JSON
+// lines, and returns its path. It's written aside and renamed into place,
+// so the directory never holds half an archive.
+func (s *Server) writeCapture(manifest *captureManifest) (string, error) {
+	if err := os.MkdirAll(s.debugDir, 0o700); err != nil {
+		return "", err
+	}
+	for i := range manifest.Sides {
+		side := &manifest.Sides[i]
+		switch {
+		case !side.Shared:
+		case i == 0:
+			side.FramesFile = "local/frames.jsonl"
+		default:
+			side.FramesFile = fmt.Sprintf("remote-%d/frames.jsonl", i)
+		}
+	}
+
+	tmp, err := os.CreateTemp(s.debugDir, ".divergence-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	zw := gzip.NewWriter(tmp)
+	tw := tar.NewWriter(zw)
+	add := func(name string, data []byte) error {
+		header := &tar.Header{Name: name, Mode: 0o600, Size: int64(len(data)), ModTime: manifest.CapturedAt}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		_, err := tw.Write(data)
+		return err
+	}
+
+	data, _ := json.MarshalIndent(manifest, "", "  ")
+	err = add("manifest.json", append(data, '\n'))
+	for _, side := range manifest.Sides {
+		if side.FramesFile == "" || err != nil {
+			continue
+		}
+		var lines bytes.Buffer
+		enc := json.NewEncoder(&lines)
+		for _, frame := range side.frames {
+			enc.Encode(frame)
+		}
+		err = add(side.FramesFile, lines.Bytes())
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	name := fmt.Sprintf("divergence-%s-%s.tar.gz", manifest.SessionID, manifest.CapturedAt.Format("20060102T150405.000Z"))
+	path := filepath.Join(s.debugDir, name)
+	return path, os.Rename(tmp.Name(), path)
+}
+
+// newCaptureID returns a random ID for a capture request
+func newCaptureID() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
@@ -0,0 +1,226 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/zeropr/agent/internal/api"
+)
+
+// captured is what POST /api/debug/capture-divergence answers
+type captured struct {
+	Path     string          `json:"path"`
+	Manifest captureManifest `json:"manifest"`
+}
+
+// divergedSession has bob, on the guest, bridged as a viewer into a
+// session the host holds for alice. Both see alice's update; bob's goes
+// out through the guest but the host drops it, so the two agents'
+// documents part.
+func divergedSession(t *testing.T, args ...string) (host, guest *pairedAgent, sessionID string) {
+	t.Helper()
+	host, guest = newPairedAgents(t, args...)
+	session := host.createSession(t, "alice")
+	alice, _ := host.dial(t, "/ws/sync/"+session.SessionID+"?sync="+session.SyncToken)
+	joined := guest.bridge(t, session.SessionID, "bob", api.RoleViewer)
+	bob, _ := guest.dial(t, joined.WSPath)
+	waitConnected(t, host.testAgent, session.SessionID, 2)
+
+	alice.WriteMessage(websocket.BinaryMessage, textUpdate(1, 0, "a"))
+	if got := readBinary(t, bob, 2*time.Second); !bytes.Equal(got, textUpdate(1, 0, "a")) {
+		t.Fatalf("bob got %v, want alice's update", got)
+	}
+	bob.WriteMessage(websocket.BinaryMessage, textUpdate(2, 0, "b"))
+	deadline := time.Now().Add(2 * time.Second)
+	for len(host.srv.hub.Segment(session.SessionID, time.Time{}, time.Time{})) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("the host never recorded bob's update")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return host, guest, session.SessionID
+}
+
+// answerCaptures resolves the next capture request a's user is asked,
+// with decision. What went wrong arrives on the returned channel.
+func answerCaptures(a *pairedAgent, decision string) <-chan error {
+	events, cancel := a.bus.Subscribe("capture-test", 16)
+	result := make(chan error, 1)
+	go func() {
+		defer cancel()
+		for event := range events {
+			request, ok := event.Data.(CaptureRequest)
+			if event.Type != EventCaptureRequested || !ok {
+				continue
+			}
+			req, _ := http.NewRequest(http.MethodPost, a.local.URL+"/api/debug/capture-requests/"+request.ID, strings.NewReader(`{"decision":"`+decision+`"}`))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer "+a.token)
+			resp, err := http.DefaultClient.Do(req)
+			if err == nil {
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					err = fmt.Errorf("resolving %s answered %d", request.ID, resp.StatusCode)
+				}
+			}
+			result <- err
+			return
+		}
+	}()
+	return result
+}
+
+// readCapture returns the files in a capture archive, by name
+func readCapture(t *testing.T, path string) map[string][]byte {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string][]byte)
+	tr := tar.NewReader(zr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[header.Name], _ = io.ReadAll(tr)
+	}
+}
+
+// framesIn decodes a frames.jsonl file
+func framesIn(t *testing.T, data []byte) []api.RecordedFrame {
+	t.Helper()
+	var frames []api.RecordedFrame
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for dec.More() {
+		var frame api.RecordedFrame
+		if err := dec.Decode(&frame); err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+func TestCaptureDivergence(t *testing.T) {
+	host, guest, sessionID := divergedSession(t)
+	answered := answerCaptures(host, "share")
+
+	var got captured
+	guest.post(t, "/api/debug/capture-divergence", `{"sessionId":"`+sessionID+`"}`, &got)
+	if err := <-answered; err != nil {
+		t.Fatal(err)
+	}
+	m := got.Manifest
+	if m.SingleSided || !m.Diverged || !m.Compatible || len(m.Sides) != 2 {
+		t.Fatalf("manifest %+v, want both sides, diverged", m)
+	}
+	local, remote := m.Sides[0], m.Sides[1]
+	if local.Role != sideBridge || remote.Role != sideHost || remote.Agent != "host" || remote.Fingerprint != host.identity.Fingerprint() {
+		t.Errorf("sides %+v and %+v", local, remote)
+	}
+	// The host never took bob's operation
+	if remote.Missing[2] != 1 || len(local.Missing) != 0 {
+		t.Errorf("missing %v on the host and %v here, want bob's operation on the host", remote.Missing, local.Missing)
+	}
+
+	files := readCapture(t, got.Path)
+	var stored captureManifest
+	if err := json.Unmarshal(files["manifest.json"], &stored); err != nil || stored.Sides[1].Document.Hash != remote.Document.Hash {
+		t.Fatalf("archived manifest %s: %v", files["manifest.json"], err)
+	}
+	// Both agents recorded the same two frames over the same window: alice's
+	// update going to bob, and bob's, which only the host dropped
+	for _, side := range m.Sides {
+		frames := framesIn(t, files[side.FramesFile])
+		if len(frames) != 2 {
+			t.Fatalf("%s shared %+v", side.Agent, frames)
+		}
+		for _, frame := range frames {
+			if frame.At.Before(m.Since) || frame.At.After(m.Until) {
+				t.Errorf("%s frame at %v, outside %v to %v", side.Agent, frame.At, m.Since, m.Until)
+			}
+			wantDropped := side.Role == sideHost && frame.Participant == "bob"
+			if (frame.Dropped != "") != wantDropped {
+				t.Errorf("%s frame %+v, dropped should be %v", side.Agent, frame, wantDropped)
+			}
+		}
+		if !bytes.Equal(frames[0].Data, textUpdate(1, 0, "a")) || !bytes.Equal(frames[1].Data, textUpdate(2, 0, "b")) {
+			t.Errorf("%s frames out of step: %+v", side.Agent, frames)
+		}
+	}
+}
+
+func TestCaptureDivergenceDeclined(t *testing.T) {
+	host, guest, sessionID := divergedSession(t)
+	answered := answerCaptures(host, "decline")
+
+	var got captured
+	guest.post(t, "/api/debug/capture-divergence", `{"sessionId":"`+sessionID+`"}`, &got)
+	if err := <-answered; err != nil {
+		t.Fatal(err)
+	}
+	if m := got.Manifest; !m.SingleSided || m.Reason != CaptureDeclined || m.Sides[1].Shared || m.Sides[1].FramesFile != "" {
+		t.Fatalf("manifest %+v, want single-sided, declined", m)
+	}
+	files := readCapture(t, got.Path)
+	if len(files) != 2 || len(framesIn(t, files["local/frames.jsonl"])) != 2 {
+		t.Errorf("a single-sided capture held %d files", len(files))
+	}
+}
+
+func TestCaptureDivergenceUnanswered(t *testing.T) {
+	_, guest, sessionID := divergedSession(t, "-capture-consent-wait", "50ms")
+	var got captured
+	guest.post(t, "/api/debug/capture-divergence", `{"sessionId":"`+sessionID+`"}`, &got)
+	if m := got.Manifest; !m.SingleSided || m.Reason != CaptureTimedOut {
+		t.Fatalf("manifest %+v, want single-sided, timed out", m)
+	}
+}
+
+func TestCaptureDivergenceWithoutCounterpart(t *testing.T) {
+	a := newTestAgent(t)
+	session := a.createSession(t, "alice")
+	var got captured
+	a.post(t, "/api/debug/capture-divergence", `{"sessionId":"`+session.SessionID+`"}`, &got)
+	if m := got.Manifest; !m.SingleSided || m.Reason != CaptureNoCounterpart || len(m.Sides) != 1 {
+		t.Fatalf("manifest %+v, want this agent's side alone", m)
+	}
+
+	status, body := a.do(t, http.MethodPost, "/api/debug/capture-divergence", `{"sessionId":"nope"}`, nil)
+	if status != http.StatusNotFound || errorCode(body) != CodeSessionNotFound {
+		t.Errorf("capturing an unknown session answered %d %s", status, body)
+	}
+	status, body = a.do(t, http.MethodPost, "/api/debug/capture-requests/nope", `{"decision":"share"}`, nil)
+	if status != http.StatusNotFound || errorCode(body) != CodeCaptureNotFound {
+		t.Errorf("resolving an unknown capture request answered %d %s", status, body)
+	}
+}
+
+func TestCaptureDivergenceNotRecording(t *testing.T) {
+	a := newTestAgent(t, "-session-recording", "0")
+	session := a.createSession(t, "alice")
+	status, body := a.do(t, http.MethodPost, "/api/debug/capture-divergence", `{"sessionId":"`+session.SessionID+`"}`, nil)
+	if status != http.StatusNotFound || errorCode(body) != CodeFeatureDisabled {
+		t.Errorf("capturing without recording answered %d %s", status, body)
+	}
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/zeropr/agent/internal/crypto"
+	"github.com/zeropr/agent/internal/i18n"
+)
+
+// gzipWriters reuses compressors, whose internal state is large. BestSpeed
+// keeps most of the size reduction on source text at roughly half the CPU
+// of the default level (see the FileGet benchmarks).
+var gzipWriters = sync.Pool{
+	New: func() interface{} {
+		gz, _ := gzip.NewWriterLevel(io.Discard, gzip.BestSpeed)
+		return gz
+	},
+}
+
+// acceptsGzip reports whether the request's Accept-Encoding allows gzip
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// shouldCompress decides whether a body of size n is gzipped for r
+func (s *Server) shouldCompress(r *http.Request, n int) bool {
+	threshold := s.settings.Load().gzipThreshold
+	return threshold >= 0 && n >= threshold && acceptsGzip(r)
+}
+
+// writeFileJSON writes a file endpoint response, gzipping it when the
+// client accepts gzip and the body is over the threshold
+func (s *Server) writeFileJSON(w http.ResponseWriter, r *http.Request, response interface{}) {
+	body, err := json.Marshal(response)
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, CodeInternal, i18n.MsgEncodeFailed)
+		return
+	}
+	body = append(body, '\n')
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Add("Vary", "Accept-Encoding")
+	if !s.shouldCompress(r, len(body)) {
+		w.Write(body)
+		return
+	}
+
+	w.Header().Set("Content-Encoding", "gzip")
+	gz := gzipWriters.Get().(*gzip.Writer)
+	defer gzipWriters.Put(gz)
+	gz.Reset(w)
+	gz.Write(body)
+	if err := gz.Close(); err != nil {
+		s.logger.Warn("Compressed response failed", "remote", r.RemoteAddr, "err", err)
+	}
+}
+
+// sealedBody wraps the plaintext writer of an encrypted transfer in gzip
+// when negotiated. Ciphertext doesn't compress, so compression happens
+// before sealing and is signalled with crypto.HeaderSealedEncoding rather
+// than Content-Encoding, which would describe the sealed bytes.
+func (s *Server) sealedBody(w http.ResponseWriter, r *http.Request, sealer io.Writer, n int) (io.Writer, func() error) {
+	if !s.shouldCompress(r, n) {
+		return sealer, func() error { return nil }
+	}
+	w.Header().Set(crypto.HeaderSealedEncoding, "gzip")
+	gz := gzipWriters.Get().(*gzip.Writer)
+	gz.Reset(sealer)
+	return gz, func() error {
+		defer gzipWriters.Put(gz)
+		return gz.Close()
+	}
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/zeropr/agent/internal/logging"
+)
+
+// SetLogLimiter exposes the log rate limiter's suppression counts in /api/debug/runtime
+func (s *Server) SetLogLimiter(limiter *logging.RateLimitHandler) {
+	s.logLimiter = limiter
+}
+
+func (s *Server) handleDebugRuntime(w http.ResponseWriter, r *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	suppressions := []logging.Suppression{}
+	if s.logLimiter != nil {
+		suppressions = s.logLimiter.Suppressions()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"goVersion":     runtime.Version(),
+		"goroutines":    runtime.NumGoroutine(),
+		"uptimeSeconds": int64(time.Since(s.startedAt).Seconds()),
+		"memory": map[string]uint64{
+			"heapAlloc": mem.HeapAlloc,
+			"heapInuse": mem.HeapInuse,
+			"sys":       mem.Sys,
+			"numGC":     uint64(mem.NumGC),
+		},
+		"logSuppressions": suppressions,
+		"outbound":        s.peerClient.Throttles(),
+	})
+}
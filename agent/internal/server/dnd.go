@@ -0,0 +1,79 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/zeropr/agent/internal/i18n"
+)
+
+// statusDND is the status of a user who doesn't want to be interrupted:
+// peers can't join their sessions and fetches aren't surfaced until it ends
+const statusDND = "dnd"
+
+// dndLocked reports whether the user is in do-not-disturb;
+// s.presence.mu must be held
+func (p *presenceState) dndLocked() bool {
+	return p.current.Status == statusDND
+}
+
+// doNotDisturb reports whether the user is in do-not-disturb right now
+func (s *Server) doNotDisturb() bool {
+	s.presence.mu.RLock()
+	defer s.presence.mu.RUnlock()
+	return s.presence.dndLocked()
+}
+
+// armDNDLocked schedules the end of a do-not-disturb posted with an until
+// time, replacing any earlier schedule; s.presence.mu must be held
+func (s *Server) armDNDLocked() {
+	p := &s.presence
+	if p.dndTimer != nil {
+		p.dndTimer.Stop()
+		p.dndTimer = nil
+	}
+	if p.dndLocked() && p.current.Until != nil {
+		p.dndTimer = time.AfterFunc(time.Until(*p.current.Until), s.expireDND)
+	}
+}
+
+// expireDND ends a do-not-disturb whose until time has come, bringing back
+// the status posted before it
+func (s *Server) expireDND() {
+	p := &s.presence
+	p.mu.Lock()
+	p.dndTimer = nil
+	if !p.dndLocked() || p.current.Until == nil || time.Now().Before(*p.current.Until) {
+		p.mu.Unlock()
+		return
+	}
+	withheld := p.withheldLocked()
+	p.current.Status = p.beforeDND
+	p.current.Until = nil
+	back := withheld && !p.withheldLocked()
+	status := p.current.Status
+	p.mu.Unlock()
+
+	s.logger.Info("Do-not-disturb ended; advertising status", "status", status)
+	s.propagatePresence()
+	if back {
+		s.cameBack()
+	}
+}
+
+// unlessDoNotDisturb declines requests from other agents while the user
+// is in do-not-disturb. With -dnd-allow-verified, a peer whose trust was
+// verified with a pairing code gets through.
+func (s *Server) unlessDoNotDisturb(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if isLoopback(r.RemoteAddr) || !s.doNotDisturb() {
+			h(w, r)
+			return
+		}
+		if caller, ok := peerFromContext(r.Context()); ok && s.settings.Load().dndAllowVerified && caller.Provenance.Verified() {
+			h(w, r)
+			return
+		}
+		s.writeError(w, r, http.StatusConflict, CodeDoNotDisturb, i18n.MsgDoNotDisturb)
+	}
+}
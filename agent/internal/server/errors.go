@@ -0,0 +1,158 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/zeropr/agent/internal/auth"
+	"github.com/zeropr/agent/internal/crypto"
+	"github.com/zeropr/agent/internal/i18n"
+	"github.com/zeropr/agent/internal/redact"
+	"github.com/zeropr/agent/internal/retention"
+	"github.com/zeropr/agent/internal/sessions"
+)
+
+// Error codes returned in the code field of error responses. They are
+// stable; messages are for people and may change.
+const (
+	CodeInvalidRequest    = "invalid_request"
+	CodeInternal          = "internal_error"
+	CodeFeatureDisabled   = "feature_disabled"
+	CodeMissingToken      = "missing_token"
+	CodeInvalidToken      = "invalid_token"
+	CodeInsufficientScope = "insufficient_scope"
+	CodeInvalidSignature  = "invalid_signature"
+	CodeUntrustedPeer     = "untrusted_peer"
+	CodeCapabilityDenied  = "capability_denied"
+	CodePeerNotFound      = "peer_not_found"
+	CodeAmbiguousPeer     = "ambiguous_peer_id"
+	CodePeerBlocked       = "peer_blocked"
+	CodePeerNoKey         = "peer_no_key"
+	CodePeerNotTrusted    = "peer_not_trusted"
+	CodePeerUnreachable   = "peer_unreachable"
+	CodePeerRequestFailed = "peer_request_failed"
+	CodeIncompatiblePeer  = "incompatible_protocol"
+	CodeTransferNotFound  = "transfer_not_found"
+	CodeCaptureNotFound   = "capture_request_not_found"
+	CodeNotResumable      = "transfer_not_resumable"
+	CodePairingMismatch   = "pairing_code_mismatch"
+	CodeTrustConflict     = "trust_conflict"
+	CodeTokenNotFound     = "token_not_found"
+	CodeRepoNotFound      = "repo_not_found"
+	CodeNoShareRoot       = "no_share_root"
+	CodeFileNotFound      = "file_not_found"
+	CodeFileChanged       = "file_changed"
+	CodeFileTooLarge      = "file_too_large"
+	CodePathForbidden     = "path_forbidden"
+	CodeSessionNotFound   = "session_not_found"
+	CodeInvalidSessionID  = "invalid_session_id"
+	CodeSessionActive     = "session_active"
+	CodeSessionFull       = "session_full"
+	CodeParticipantExists = "participant_exists"
+	CodeNoDocument        = "document_unavailable"
+	CodeSessionToken      = "invalid_session_token"
+	CodeNotParticipant    = "not_participant"
+	CodeNotInitiator      = "not_initiator"
+	CodeLockNotFound      = "lock_not_found"
+	CodeLockConflict      = "lock_conflict"
+	CodeBroadcastFailed   = "broadcast_failed"
+	CodeServingDisabled   = "serving_disabled"
+	CodeObservingDisabled = "observing_disabled"
+	CodeReadOnly          = "read_only"
+	CodeUnattended        = "unattended_unverified"
+	CodeDoNotDisturb      = "do_not_disturb"
+	CodeBusy              = "busy"
+	CodeInvalidConfig     = "invalid_config"
+)
+
+// errorMessages maps errors from other packages that reach clients to the
+// catalog messages describing them
+var errorMessages = []struct {
+	err error
+	id  string
+}{
+	{sessions.ErrSessionNotFound, i18n.MsgSessionNotFound},
+	{sessions.ErrInvalidSessionID, i18n.MsgInvalidSessionID},
+	{sessions.ErrNotParticipant, i18n.MsgNotParticipant},
+	{sessions.ErrNotInitiator, i18n.MsgNotInitiator},
+	{sessions.ErrSessionFull, i18n.MsgSessionFull},
+	{sessions.ErrAlreadyParticipant, i18n.MsgParticipantExists},
+	{sessions.ErrCapBelowOccupancy, i18n.MsgCapBelowOccupancy},
+	{sessions.ErrInitiatorRole, i18n.MsgInitiatorRole},
+	{sessions.ErrInvalidRange, i18n.MsgInvalidRange},
+	{sessions.ErrLockConflict, i18n.MsgLockConflict},
+	{sessions.ErrLockNotFound, i18n.MsgLockNotFound},
+	{sessions.ErrUnknownReconnect, i18n.MsgReconnectUnknown},
+	{sessions.ErrReconnectExpired, i18n.MsgReconnectExpired},
+	{crypto.ErrStepUpRequired, i18n.MsgStepUpRequired},
+	{crypto.ErrPairingCode, i18n.MsgPairingMismatch},
+	{crypto.ErrUnsigned, i18n.MsgUnsigned},
+	{crypto.ErrBadSignature, i18n.MsgBadSignature},
+	{crypto.ErrStaleRequest, i18n.MsgStaleRequest},
+	{crypto.ErrUnknownTrust, i18n.MsgTrustNotFound},
+	{retention.ErrActiveSession, i18n.MsgSessionActive},
+	{auth.ErrUnknownToken, i18n.MsgTokenNotFound},
+}
+
+// errorResponse is the body of every error response. MessageID names the
+// catalog entry Message was rendered from, if any, so clients can render
+// their own text.
+type errorResponse struct {
+	Code      string `json:"code"`
+	MessageID string `json:"messageId,omitempty"`
+	Message   string `json:"message"`
+}
+
+// localeFor picks the locale to answer r in
+func (s *Server) localeFor(r *http.Request) string {
+	return i18n.Match(r.Header.Get("Accept-Language"), s.locale)
+}
+
+// writeError writes an error response whose message is catalog entry id,
+// rendered with args in the request's locale. Paths in error args are
+// redacted for other agents.
+func (s *Server) writeError(w http.ResponseWriter, r *http.Request, status int, code, id string, args ...interface{}) {
+	if _, fromPeer := peerFromContext(r.Context()); fromPeer {
+		for i, arg := range args {
+			if err, ok := arg.(error); ok {
+				args[i] = redact.Error(err)
+			}
+		}
+	}
+	locale := s.localeFor(r)
+	h := w.Header()
+	h.Set("Content-Language", locale)
+	h.Add("Vary", "Accept-Language")
+	writeErrorResponse(w, status, errorResponse{Code: code, MessageID: id, Message: i18n.Text(locale, id, args...)})
+}
+
+// writeErrorFor writes err as an error response, localized when it's one
+// of the errors in errorMessages and passed through as is otherwise
+func (s *Server) writeErrorFor(w http.ResponseWriter, r *http.Request, status int, code string, err error) {
+	for _, known := range errorMessages {
+		if errors.Is(err, known.err) {
+			s.writeError(w, r, status, code, known.id)
+			return
+		}
+	}
+	if _, fromPeer := peerFromContext(r.Context()); fromPeer {
+		err = redact.Error(err)
+	}
+	writeJSONError(w, status, code, err.Error())
+}
+
+// writeJSONError writes an error response with a stable code and a
+// human-readable message that isn't in the catalog
+func writeJSONError(w http.ResponseWriter, status int, code, msg string) {
+	writeErrorResponse(w, status, errorResponse{Code: code, Message: msg})
+}
+
+func writeErrorResponse(w http.ResponseWriter, status int, body errorResponse) {
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+
+	"github.com/zeropr/agent/internal/api"
+	"github.com/zeropr/agent/internal/i18n"
+	"github.com/zeropr/agent/internal/sessions"
+	"github.com/zeropr/agent/internal/workspace"
+)
+
+// handleSessionEstimate tells an editor what co-editing a file would cost
+// before it opens a session: the initial sync, how fast the update log
+// grows, and whether this agent's budget, network profile, or file size
+// limit would make the session degraded or refuse it
+func (s *Server) handleSessionEstimate(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Repo         string `json:"repo"`     // default the default root
+		FilePath     string `json:"filePath"` // measured on disk; or give size
+		Size         *int64 `json:"size"`
+		Participants int    `json:"participants"` // default 2
+	}
+	if err := api.DecodeLocal(r.Body, &req); err != nil {
+		s.writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, i18n.MsgInvalidRequest)
+		return
+	}
+
+	var size int64
+	switch {
+	case req.FilePath != "":
+		root, ok := s.lookupRoot(w, r, req.Repo)
+		if !ok {
+			return
+		}
+		info, ok := s.statSessionFile(w, r, root, req.FilePath)
+		if !ok {
+			return
+		}
+		size = info.Size()
+	case req.Size != nil && *req.Size >= 0:
+		size = *req.Size
+	default:
+		s.writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, i18n.MsgEstimateSizeRequired)
+		return
+	}
+
+	estimate := sessions.EstimateSession(size, req.Participants, s.settings.Load().estimateLimits)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(estimate)
+}
+
+// statSessionFile stats a file a session would be opened on, writing an
+// error response and returning false if it's outside root or missing
+func (s *Server) statSessionFile(w http.ResponseWriter, r *http.Request, root *workspace.Root, relPath string) (os.FileInfo, bool) {
+	fullPath, err := root.Resolve(relPath)
+	if err != nil {
+		s.writeError(w, r, http.StatusForbidden, CodePathForbidden, i18n.MsgPathForbidden)
+		return nil, false
+	}
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		s.writeError(w, r, http.StatusNotFound, CodeFileNotFound, i18n.MsgFileNotFound, relPath)
+		return nil, false
+	}
+	return info, true
+}
+
+// sessionFileTooLarge writes an error response and returns true if a file
+// of size bytes is over the session file size limit
+func (s *Server) sessionFileTooLarge(w http.ResponseWriter, r *http.Request, size int64) bool {
+	limit := s.settings.Load().estimateLimits.MaxFileSize
+	if limit <= 0 || size <= limit {
+		return false
+	}
+	s.writeError(w, r, http.StatusRequestEntityTooLarge, CodeFileTooLarge, i18n.MsgSessionFileTooLarge, size, limit)
+	return true
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/zeropr/agent/internal/sessions"
+)
+
+func TestSessionEstimate(t *testing.T) {
+	a := newTestAgent(t, "-max-session-file-size", "100", "-network-profile", "metered")
+	if err := os.WriteFile(filepath.Join(a.root, "big.txt"), []byte(strings.Repeat("x", 200)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var e sessions.Estimate
+	if status, body := a.do(t, "POST", "/api/session/estimate", `{"filePath":"main.go","participants":3}`, &e); status != http.StatusOK {
+		t.Fatalf("estimate: %d %s", status, body)
+	}
+	if e.Size != 13 || e.Participants != 3 || e.Blocked || e.NetworkProfile != sessions.ProfileMetered || e.MaxFileSize != 100 {
+		t.Errorf("estimate of main.go %+v", e)
+	}
+	e = sessions.Estimate{}
+	a.do(t, "POST", "/api/session/estimate", `{"filePath":"big.txt"}`, &e)
+	if !e.Blocked || e.Size != 200 {
+		t.Errorf("estimate of a file over the maximum %+v", e)
+	}
+	e = sessions.Estimate{}
+	a.do(t, "POST", "/api/session/estimate", `{"size":50}`, &e)
+	if e.Size != 50 || e.Blocked {
+		t.Errorf("estimate by size %+v", e)
+	}
+
+	for body, want := range map[string]string{
+		`{}`:                        CodeInvalidRequest,
+		`{"size":-1}`:               CodeInvalidRequest,
+		`{"filePath":"gone.go"}`:    CodeFileNotFound,
+		`{"filePath":"../etc/pwd"}`: CodePathForbidden,
+	} {
+		if _, got := a.do(t, "POST", "/api/session/estimate", body, nil); errorCode(got) != want {
+			t.Errorf("estimate %s: %s, want %s", body, got, want)
+		}
+	}
+}
+
+func TestSessionCreateSizeLimit(t *testing.T) {
+	a := newTestAgent(t, "-max-session-file-size", "100")
+	if err := os.WriteFile(filepath.Join(a.root, "big.txt"), []byte(strings.Repeat("x", 200)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	status, body := a.do(t, "POST", "/api/session/create", `{"filePath":"big.txt","initiator":"alice"}`, nil)
+	if status != http.StatusRequestEntityTooLarge || errorCode(body) != CodeFileTooLarge {
+		t.Errorf("creating a session on a file over the maximum: %d %s", status, body)
+	}
+	var session createdSession
+	if status, body := a.do(t, "POST", "/api/session/create", `{"filePath":"big.txt","initiator":"alice","force":true}`, &session); status != http.StatusOK || session.SessionID == "" {
+		t.Errorf("forcing a session on it: %d %s", status, body)
+	}
+	// A file yet to be written has no size to refuse
+	if status, body := a.do(t, "POST", "/api/session/create", `{"filePath":"new.go","initiator":"alice"}`, nil); status != http.StatusOK {
+		t.Errorf("creating a session on a new file: %d %s", status, body)
+	}
+}
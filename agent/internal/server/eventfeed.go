@@ -0,0 +1,260 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/zeropr/agent/internal/events"
+	"github.com/zeropr/agent/internal/peers"
+	"github.com/zeropr/agent/internal/sessions"
+)
+
+// Event feed categories a client can subscribe to
+const (
+	FeedPeers     = "peers"
+	FeedSessions  = "sessions"
+	FeedBroadcast = "broadcast"
+)
+
+// Messages on the event feed that aren't bus events
+const (
+	feedSubscribe  = "subscribe"  // from the client, choosing its categories
+	feedSubscribed = "subscribed" // the categories the feed now sends
+	feedGap        = "gap"        // events were missed; list again to catch up
+	feedError      = "error"      // a client message the feed couldn't use
+)
+
+// maxFeedMessage bounds what a client may send on the event feed; only
+// subscribe messages are expected
+const maxFeedMessage = 4 << 10
+
+// feedCategories maps the bus events the feed carries to their category
+var feedCategories = map[string]string{
+	peers.EventPeerAdded:         FeedPeers,
+	peers.EventPeerUpdated:       FeedPeers,
+	peers.EventPeerRemoved:       FeedPeers,
+	sessions.EventSessionCreated: FeedSessions,
+	sessions.EventSessionUpdated: FeedSessions,
+	sessions.EventSessionEnded:   FeedSessions,
+	EventBroadcastChanged:        FeedBroadcast,
+}
+
+// allFeedCategories is what a client is sent until it subscribes
+var allFeedCategories = []string{FeedBroadcast, FeedPeers, FeedSessions}
+
+// feedMessage is one JSON message on the event feed. Bus events carry
+// their category and ID; the feed's own messages only a type and data.
+type feedMessage struct {
+	Type     string      `json:"type"`
+	Category string      `json:"category,omitempty"`
+	ID       uint64      `json:"id,omitempty"`
+	Time     time.Time   `json:"time"`
+	Data     interface{} `json:"data,omitempty"`
+}
+
+// feedSubscription is the data of a subscribed message
+type feedSubscription struct {
+	Categories []string `json:"categories"`
+	Unknown    []string `json:"unknown,omitempty"` // requested categories that don't exist
+}
+
+// feedProblem is the data of an error message
+type feedProblem struct {
+	Message string `json:"message"`
+}
+
+// feedRequest is a message a client sends on the event feed
+type feedRequest struct {
+	Type       string   `json:"type"`
+	Categories []string `json:"categories"`
+}
+
+// eventFeeds tracks the open event feed sockets, which http.Server doesn't
+// once they're hijacked, so Shutdown can close them
+type eventFeeds struct {
+	conns  map[*websocket.Conn]struct{}
+	closed bool
+	mu     sync.Mutex
+}
+
+// add tracks conn, unless the feeds were closed for shutdown
+func (f *eventFeeds) add(conn *websocket.Conn) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return false
+	}
+	if f.conns == nil {
+		f.conns = make(map[*websocket.Conn]struct{})
+	}
+	f.conns[conn] = struct{}{}
+	return true
+}
+
+func (f *eventFeeds) remove(conn *websocket.Conn) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.conns, conn)
+}
+
+// closeAll sends every open feed a going-away close frame and closes it,
+// refusing new ones from then on
+func (f *eventFeeds) closeAll() {
+	f.mu.Lock()
+	f.closed = true
+	conns := make([]*websocket.Conn, 0, len(f.conns))
+	for conn := range f.conns {
+		conns = append(conns, conn)
+	}
+	f.mu.Unlock()
+
+	for _, conn := range conns {
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"), time.Now().Add(time.Second))
+		conn.Close()
+	}
+}
+
+// handleEventFeed streams peer, session, and broadcast changes over one
+// WebSocket as tagged JSON messages, for clients that would rather hold a
+// socket than several follow streams. Every category is sent until the
+// client sends {"type":"subscribe","categories":[...]}, which replaces the
+// set. A client too slow to keep up is sent a gap and should list again.
+func (s *Server) handleEventFeed(w http.ResponseWriter, r *http.Request) {
+	conn, err := s.upgrader().Upgrade(w, r, nil)
+	if err != nil {
+		s.logger.Warn("WebSocket upgrade failed", "remote", r.RemoteAddr, "err", err)
+		return
+	}
+	defer conn.Close()
+	if !s.feeds.add(conn) {
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"), time.Now().Add(time.Second))
+		return
+	}
+	defer s.feeds.remove(conn)
+	conn.SetReadLimit(maxFeedMessage)
+
+	// Subscribe before anything else so the client misses nothing from here on
+	changes, unsubscribe := s.bus.Subscribe("event-feed", 64)
+	defer unsubscribe()
+
+	k := s.keepalive
+	if k.Interval > 0 {
+		conn.SetReadDeadline(time.Now().Add(k.PongWait()))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(k.PongWait()))
+		})
+	}
+
+	// Reads happen on their own goroutine; every write is made below
+	requests := make(chan []byte)
+	gone := make(chan struct{})
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(gone)
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			select {
+			case requests <- data:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	send := func(msg feedMessage) bool {
+		conn.SetWriteDeadline(k.Deadline())
+		return conn.WriteJSON(msg) == nil
+	}
+
+	wanted := make(map[string]bool, len(allFeedCategories))
+	for _, category := range allFeedCategories {
+		wanted[category] = true
+	}
+	if !send(feedMessage{Type: feedSubscribed, Time: time.Now(), Data: feedSubscription{Categories: allFeedCategories}}) {
+		return
+	}
+
+	var ping <-chan time.Time
+	if k.Interval > 0 {
+		ticker := time.NewTicker(k.Interval)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
+
+	for {
+		select {
+		case <-gone:
+			return
+		case <-ping:
+			if conn.WriteControl(websocket.PingMessage, nil, k.Deadline()) != nil {
+				return
+			}
+		case data := <-requests:
+			if !send(subscribe(data, wanted)) {
+				return
+			}
+		case event, ok := <-changes:
+			if !ok {
+				return
+			}
+			if event.Type == events.EventGap {
+				if !send(feedMessage{Type: feedGap, Time: event.Time, Data: event.Data}) {
+					return
+				}
+				continue
+			}
+			category, ok := feedCategories[event.Type]
+			if !ok || !wanted[category] {
+				continue
+			}
+			if !send(feedMessage{Type: event.Type, Category: category, ID: event.ID, Time: event.Time, Data: event.Data}) {
+				return
+			}
+		}
+	}
+}
+
+// subscribe applies a client's message to wanted, the categories its feed
+// sends, and returns the reply
+func subscribe(data []byte, wanted map[string]bool) feedMessage {
+	var req feedRequest
+	if err := json.Unmarshal(data, &req); err != nil || req.Type != feedSubscribe {
+		return feedMessage{Type: feedError, Time: time.Now(), Data: feedProblem{Message: `expected {"type":"subscribe","categories":[...]}`}}
+	}
+
+	sub := feedSubscription{Categories: []string{}}
+	for category := range wanted {
+		delete(wanted, category)
+	}
+	for _, category := range req.Categories {
+		switch {
+		case wanted[category]:
+		case knownFeedCategory(category):
+			wanted[category] = true
+			sub.Categories = append(sub.Categories, category)
+		default:
+			sub.Unknown = append(sub.Unknown, category)
+		}
+	}
+	sort.Strings(sub.Categories)
+	return feedMessage{Type: feedSubscribed, Time: time.Now(), Data: sub}
+}
+
+// knownFeedCategory reports whether category is one the feed sends
+func knownFeedCategory(category string) bool {
+	for _, known := range allFeedCategories {
+		if known == category {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/zeropr/agent/internal/i18n"
+	"github.com/zeropr/agent/internal/retention"
+	"github.com/zeropr/agent/internal/sessions"
+	"github.com/zeropr/agent/internal/ydoc"
+)
+
+// documentArtifact is the snapshot artifact an ended session's document is
+// kept in
+const documentArtifact = "document.bin"
+
+// sessionExport is a session's document, for the editor to rebuild and
+// diff against the file it was opened on
+type sessionExport struct {
+	SessionID    string     `json:"sessionId"`
+	Repo         string     `json:"repo"`
+	FilePath     string     `json:"filePath"`
+	Initiator    string     `json:"initiator"`
+	Participants []string   `json:"participants"` // in the session now; empty once it ended
+	Contributors []string   `json:"contributors"` // everyone who took part
+	CreatedAt    time.Time  `json:"createdAt"`
+	Active       bool       `json:"active"`
+	Updates      [][]byte   `json:"updates"`  // y-websocket sync messages, base64-encoded, in the order they were relayed
+	Document     ydoc.State `json:"document"` // what the updates add up to, to check an editor's copy against
+}
+
+// archiveSession keeps an ended session's document among its artifacts,
+// under the retention policy, so it can still be exported
+func (s *Server) archiveSession(session sessions.Session, updates [][]byte) {
+	session = session.Redacted()
+	data, err := sessions.EncodeSnapshot(session, updates)
+	if err == nil {
+		err = s.janitor.Store().Append(session.ID, retention.TypeSnapshot, documentArtifact, data)
+	}
+	if err != nil {
+		s.logger.Warn("Failed to keep ended session's document", "session", session.ID, "err", err)
+	}
+}
+
+// handleSessionExport returns a session's document as the updates its
+// participants sent, live or, while its artifacts are kept, ended. The
+// agent doesn't merge Yjs updates itself; applying them to an empty Y.Doc
+// gives the final content, whose state vector and hash are reported.
+func (s *Server) handleSessionExport(w http.ResponseWriter, r *http.Request) {
+	sessionID := mux.Vars(r)["id"]
+
+	var export sessionExport
+	if session, ok := s.sessionMgr.Get(sessionID); ok {
+		updates, recorded := s.hub.Document(sessionID)
+		if !recorded {
+			s.documentUnavailable(w, r)
+			return
+		}
+		export = newSessionExport(session, updates)
+		export.Active = true
+	} else {
+		session, updates, err := s.endedDocument(sessionID)
+		switch {
+		case errors.Is(err, retention.ErrUnknownSession):
+			s.writeError(w, r, http.StatusNotFound, CodeSessionNotFound, i18n.MsgSessionNotFound)
+			return
+		case err != nil:
+			s.writeError(w, r, http.StatusNotFound, CodeNoDocument, i18n.MsgDocumentUnavailable)
+			return
+		}
+		export = newSessionExport(session, updates)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(export)
+}
+
+// documentUnavailable explains why a live session's document can't be
+// exported
+func (s *Server) documentUnavailable(w http.ResponseWriter, r *http.Request) {
+	if s.hub.Recording() {
+		s.writeError(w, r, http.StatusNotFound, CodeNoDocument, i18n.MsgDocumentUnavailable)
+		return
+	}
+	s.writeError(w, r, http.StatusNotFound, CodeFeatureDisabled, i18n.MsgDocumentsDisabled)
+}
+
+// endedDocument reads back the document archived when a session ended
+func (s *Server) endedDocument(sessionID string) (*sessions.Session, [][]byte, error) {
+	if s.janitor == nil {
+		return nil, nil, retention.ErrUnknownSession
+	}
+	data, err := s.janitor.Store().Read(sessionID, documentArtifact)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sessions.DecodeSnapshot(data)
+}
+
+func newSessionExport(session *sessions.Session, updates [][]byte) sessionExport {
+	document, _ := ydoc.FromMessages(updates)
+	return sessionExport{
+		SessionID:    session.ID,
+		Repo:         session.Repo,
+		FilePath:     session.FilePath,
+		Initiator:    session.Initiator,
+		Participants: append([]string{}, session.Participants...),
+		Contributors: append([]string{}, session.Contributors()...),
+		CreatedAt:    session.CreatedAt,
+		Updates:      append([][]byte{}, updates...),
+		Document:     document,
+	}
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/zeropr/agent/internal/sessions"
+)
+
+// textUpdate is a y-websocket sync update in which Yjs client inserts s at
+// clock into the root type "text"
+func textUpdate(client, clock byte, s string) []byte {
+	update := []byte{1, 1, client, clock, 4, 1, 4, 't', 'e', 'x', 't', byte(len(s))}
+	update = append(update, s...)
+	update = append(update, 0) // no deletions
+	return append([]byte{0, 2, byte(len(update))}, update...)
+}
+
+// withDocuments has the agent keep sessions' documents
+func (a *testAgent) withDocuments(t *testing.T) {
+	t.Helper()
+	store, err := sessions.OpenSessionStore(filepath.Join(a.stateDir, "sessions"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.srv.SetSessionStore(store)
+}
+
+func TestExportReportsDocumentState(t *testing.T) {
+	a := newTestAgent(t)
+	a.withDocuments(t)
+	session := a.createSession(t, "alice")
+	bob := a.join(t, session.SessionID, "bob", "")
+	alice, _ := a.dial(t, "/ws/sync/"+session.SessionID+"?sync="+session.SyncToken)
+	bobConn, _ := a.dial(t, bob.WSPath)
+	waitConnected(t, a, session.SessionID, 2)
+
+	hello, hi := textUpdate(7, 0, "hello"), textUpdate(9, 0, "hi")
+	alice.WriteMessage(websocket.BinaryMessage, hello)
+	bobConn.WriteMessage(websocket.BinaryMessage, hi)
+	if got := readBinary(t, bobConn, 2*time.Second); !bytes.Equal(got, hello) {
+		t.Fatalf("bob got %v", got)
+	}
+	if got := readBinary(t, alice, 2*time.Second); !bytes.Equal(got, hi) {
+		t.Fatalf("alice got %v", got)
+	}
+
+	var export struct {
+		Updates  [][]byte `json:"updates"`
+		Document struct {
+			StateVector map[string]uint64 `json:"stateVector"`
+			Hash        string            `json:"hash"`
+		} `json:"document"`
+	}
+	if status, body := a.do(t, http.MethodGet, "/api/session/"+session.SessionID+"/export", "", &export); status != http.StatusOK {
+		t.Fatalf("export: %d %s", status, body)
+	}
+	if len(export.Updates) != 2 || export.Document.StateVector["7"] != 5 || export.Document.StateVector["9"] != 2 || export.Document.Hash == "" {
+		t.Errorf("exported %+v", export)
+	}
+}
+
+// exported is GET /api/session/{id}/export as a client reads it
+type exported struct {
+	FilePath     string   `json:"filePath"`
+	Initiator    string   `json:"initiator"`
+	Participants []string `json:"participants"`
+	Contributors []string `json:"contributors"`
+	Active       bool     `json:"active"`
+	Updates      [][]byte `json:"updates"`
+}
+
+func TestExportEndedSession(t *testing.T) {
+	a := newTestAgent(t)
+	a.withDocuments(t)
+	a.withRetention(t)
+	session := a.createSession(t, "alice")
+	bob := a.join(t, session.SessionID, "bob", "")
+	alice, _ := a.dial(t, "/ws/sync/"+session.SessionID+"?sync="+session.SyncToken)
+	bobConn, _ := a.dial(t, bob.WSPath)
+	waitConnected(t, a, session.SessionID, 2)
+	hello := textUpdate(7, 0, "hello")
+	alice.WriteMessage(websocket.BinaryMessage, hello)
+	readBinary(t, bobConn, 2*time.Second)
+
+	path := "/api/session/" + session.SessionID + "/export"
+	var live exported
+	a.do(t, http.MethodGet, path, "", &live)
+	if !live.Active || len(live.Participants) != 2 {
+		t.Errorf("live export %+v", live)
+	}
+
+	// Once everyone leaves, the document is read back from its artifacts
+	for _, id := range []string{"alice", "bob"} {
+		a.post(t, "/api/session/leave", `{"sessionId":"`+session.SessionID+`","participantId":"`+id+`"}`, nil)
+	}
+	var ended exported
+	if status, body := a.do(t, http.MethodGet, path, "", &ended); status != http.StatusOK {
+		t.Fatalf("export of the ended session: %d %s", status, body)
+	}
+	if ended.Active || len(ended.Participants) != 0 || len(ended.Contributors) != 2 || ended.FilePath != "main.go" ||
+		ended.Initiator != "alice" || len(ended.Updates) != 1 || !bytes.Equal(ended.Updates[0], hello) {
+		t.Errorf("ended export %+v", ended)
+	}
+
+	// and is gone with them
+	if status, body := a.do(t, http.MethodDelete, "/api/sessions/ended/"+session.SessionID, "", nil); status != http.StatusOK {
+		t.Fatalf("deleting the artifacts: %d %s", status, body)
+	}
+	if _, body := a.do(t, http.MethodGet, path, "", nil); errorCode(body) != CodeSessionNotFound {
+		t.Errorf("export after the artifacts were deleted: %s", body)
+	}
+}
+
+func TestExportUnavailable(t *testing.T) {
+	a := newTestAgent(t)
+	session := a.createSession(t, "alice")
+	if status, body := a.do(t, http.MethodGet, "/api/session/"+session.SessionID+"/export", "", nil); status != http.StatusNotFound || errorCode(body) != CodeFeatureDisabled {
+		t.Errorf("export without documents kept: %d %s", status, body)
+	}
+	if _, body := a.do(t, http.MethodGet, "/api/session/nobody/export", "", nil); errorCode(body) != CodeSessionNotFound {
+		t.Errorf("export of an unknown session: %s", body)
+	}
+}
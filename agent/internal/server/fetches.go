@@ -0,0 +1,114 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/zeropr/agent/internal/fetchlog"
+	"github.com/zeropr/agent/internal/i18n"
+)
+
+// statusAway is the status an editor posts when its user stepped away
+const statusAway = "away"
+
+// unattendedLocked reports whether nobody is at the keyboard: the editor
+// says away, has gone quiet for the idle period, or never attached;
+// s.presence.mu must be held
+func (p *presenceState) unattendedLocked() bool {
+	return p.current.Status == statusAway || p.autoIdle || p.updatedAt.IsZero()
+}
+
+// withheldLocked reports whether fetches aren't surfaced now, because
+// nobody is at the keyboard or they're in do-not-disturb;
+// s.presence.mu must be held
+func (p *presenceState) withheldLocked() bool {
+	return p.unattendedLocked() || p.dndLocked()
+}
+
+// attendance reports whether nobody is at the keyboard right now, and
+// whether the user is in do-not-disturb
+func (s *Server) attendance() (unattended, dnd bool) {
+	s.presence.mu.RLock()
+	defer s.presence.mu.RUnlock()
+	return s.presence.unattendedLocked(), s.presence.dndLocked()
+}
+
+// cameBack closes the away or do-not-disturb period: what peers fetched
+// during it is published as a fetchlog.Summary, so a desktop notification
+// can tell
+func (s *Server) cameBack() {
+	summary := s.fetches.Returned(time.Now().UTC())
+	if summary.Fetches == 0 {
+		return
+	}
+	s.logger.Info("Peers fetched files while you were away", "fetches", summary.Fetches, "peers", len(summary.Peers))
+	s.bus.Publish(fetchlog.EventAwaySummary, summary)
+}
+
+// journaled records the files peers fetch through h in the fetch log,
+// flagged unattended when nobody is at the keyboard as the request
+// arrives, and held back during do-not-disturb. With -unattended-verified-only, a peer whose trust wasn't
+// verified with a pairing code is refused while nobody is.
+func (s *Server) journaled(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller, signed := peerFromContext(r.Context())
+		if !signed || isLoopback(r.RemoteAddr) {
+			h(w, r)
+			return
+		}
+
+		unattended, dnd := s.attendance()
+		if unattended && s.settings.Load().unattendedVerifiedOnly && !caller.Provenance.Verified() {
+			s.countFileDenied(r)
+			s.writeError(w, r, http.StatusForbidden, CodeUnattended, i18n.MsgUnattendedUnverified)
+			return
+		}
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h(rec, r)
+		if rec.status != http.StatusOK && rec.status != http.StatusPartialContent {
+			return
+		}
+
+		name := caller.Fingerprint[:16]
+		if entry, ok := s.trust.Get(caller.Fingerprint); ok {
+			name = entry.Name
+		}
+		entry := fetchlog.Entry{
+			At:           time.Now().UTC(),
+			Peer:         name,
+			Fingerprint:  caller.Fingerprint,
+			Repo:         r.URL.Query().Get("repo"),
+			Path:         r.URL.Query().Get("path"),
+			Unattended:   unattended,
+			DoNotDisturb: dnd,
+		}
+		s.fetches.Record(entry)
+		s.bus.Publish(fetchlog.EventFetchRecorded, entry)
+	}
+}
+
+// handleListFetches lists the files peers fetched, newest first;
+// ?unattended=true keeps those fetched while nobody was at the keyboard,
+// and follows only those
+func (s *Server) handleListFetches(w http.ResponseWriter, r *http.Request) {
+	unattendedOnly := r.URL.Query().Get("unattended") == "true"
+	list := fetchList
+	if unattendedOnly {
+		list = list.matching(func(item interface{}) bool {
+			entry, ok := item.(fetchlog.Entry)
+			return ok && entry.Unattended
+		})
+	}
+	writeList(s, w, r, list, s.fetches.Entries(unattendedOnly))
+}
+
+// handleAwayFetches summarizes what peers fetched since the user was last
+// at the keyboard, listing them by peer
+func (s *Server) handleAwayFetches(w http.ResponseWriter, r *http.Request) {
+	summary := s.fetches.Away()
+	writeList(s, w, r, awayFetchList.with(map[string]interface{}{
+		"since":   summary.Since,
+		"fetches": summary.Fetches,
+	}), summary.Peers)
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/zeropr/agent/internal/crypto"
+	"github.com/zeropr/agent/internal/events"
+	"github.com/zeropr/agent/internal/fetchlog"
+)
+
+// peerFetch has caller fetch main.go as a remote agent would, past the
+// signature check, and returns the status
+func (a *testAgent) peerFetch(caller *callerPeer) (int, []byte) {
+	r := httptest.NewRequest(http.MethodGet, "/api/file/get?repo=test&path=main.go", nil)
+	r.RemoteAddr = "192.0.2.7:50000"
+	r = r.WithContext(context.WithValue(r.Context(), peerContextKey, caller))
+	w := httptest.NewRecorder()
+	a.srv.journaled(a.srv.handleFileGet)(w, r)
+	return w.Code, w.Body.Bytes()
+}
+
+// trustedCaller trusts a new key under name with provenance method and
+// returns it as a signed caller
+func trustedCaller(t *testing.T, trust *crypto.TrustStore, name, method string) *callerPeer {
+	t.Helper()
+	identity, err := crypto.LoadOrCreateIdentity(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := trust.Trust(identity.PublicKey, name, crypto.Provenance{Method: method, At: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &callerPeer{Key: identity.PublicKey, Fingerprint: identity.Fingerprint(), Trusted: true, Provenance: entry.Provenance}
+}
+
+// fetchEntries lists the agent's fetch log
+func (a *testAgent) fetchEntries(t *testing.T) []fetchlog.Entry {
+	t.Helper()
+	var list struct {
+		Fetches []fetchlog.Entry `json:"fetches"`
+	}
+	a.do(t, http.MethodGet, "/api/fetches", "", &list)
+	return list.Fetches
+}
+
+// nextAwaySummary returns the next summary published on ch
+func nextAwaySummary(t *testing.T, ch <-chan events.Event) fetchlog.Summary {
+	t.Helper()
+	for {
+		select {
+		case event := <-ch:
+			if event.Type == fetchlog.EventAwaySummary {
+				return event.Data.(fetchlog.Summary)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("no away summary was published")
+		}
+	}
+}
+
+func TestFetchesFlaggedUnattended(t *testing.T) {
+	a := newTestAgent(t, "-idle-after", "0", "-presence-debounce", "0")
+	_, trust := a.withPeerIdentity(t)
+	bob := trustedCaller(t, trust, "bob", crypto.ProvenancePairingCode)
+	summaries, cancel := a.bus.Subscribe("test", 16)
+	defer cancel()
+
+	// No editor has attached yet; attaching closes that away period
+	a.peerFetch(bob)
+	a.post(t, "/api/presence", `{"activeFile":"main.go","status":"editing"}`, nil)
+	if summary := nextAwaySummary(t, summaries); summary.Fetches != 1 {
+		t.Errorf("summary on attaching %+v", summary)
+	}
+	a.peerFetch(bob)
+	a.post(t, "/api/presence", `{"activeFile":"main.go","status":"away"}`, nil)
+	a.peerFetch(bob)
+	a.peerFetch(bob)
+
+	entries := a.fetchEntries(t)
+	if len(entries) != 4 || !entries[0].Unattended || !entries[1].Unattended || entries[2].Unattended || !entries[3].Unattended {
+		t.Fatalf("fetches %+v, want attended only while editing", entries)
+	}
+	if entries[0].Peer != "bob" || entries[0].Path != "main.go" || entries[0].Repo != "test" {
+		t.Errorf("entry %+v", entries[0])
+	}
+
+	// Only what was fetched since coming back is summarized
+	var away struct {
+		Fetches int                    `json:"fetches"`
+		Peers   []fetchlog.PeerFetches `json:"peers"`
+	}
+	a.do(t, http.MethodGet, "/api/fetches/away", "", &away)
+	if away.Fetches != 2 || len(away.Peers) != 1 || away.Peers[0].Fetches != 2 {
+		t.Errorf("GET /api/fetches/away %+v", away)
+	}
+	a.post(t, "/api/presence", `{"activeFile":"main.go","status":"editing"}`, nil)
+	if summary := nextAwaySummary(t, summaries); summary.Fetches != 2 || summary.Peers[0].Peer != "bob" || len(summary.Peers[0].Files) != 1 {
+		t.Errorf("summary on coming back %+v", summary)
+	}
+}
+
+func TestUnattendedVerifiedOnly(t *testing.T) {
+	a := newTestAgent(t, "-idle-after", "0", "-presence-debounce", "0", "-unattended-verified-only")
+	_, trust := a.withPeerIdentity(t)
+	verified := trustedCaller(t, trust, "alice", crypto.ProvenancePairingCode)
+	tofu := trustedCaller(t, trust, "mallory", crypto.ProvenanceTOFU)
+
+	if code, body := a.peerFetch(tofu); code != http.StatusForbidden || errorCode(body) != CodeUnattended {
+		t.Errorf("unverified fetch while unattended: %d %s", code, body)
+	}
+	if code, body := a.peerFetch(verified); code != http.StatusOK {
+		t.Errorf("verified fetch while unattended: %d %s", code, body)
+	}
+	a.post(t, "/api/presence", `{"activeFile":"main.go","status":"editing"}`, nil)
+	if code, body := a.peerFetch(tofu); code != http.StatusOK {
+		t.Errorf("unverified fetch while attended: %d %s", code, body)
+	}
+
+	// Refused fetches aren't journaled
+	entries := a.fetchEntries(t)
+	if len(entries) != 2 || entries[0].Peer != "mallory" || entries[0].Unattended || entries[1].Peer != "alice" || !entries[1].Unattended {
+		t.Errorf("fetches %+v", entries)
+	}
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"container/list"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/zeropr/agent/internal/metrics"
+)
+
+// fileCache keeps the content of recently served files in memory, up to a
+// total size, so hot files requested over and over skip the disk. An entry
+// is only used while the file's modification time and size are unchanged.
+type fileCache struct {
+	capacity int64 // total content bytes kept
+	used     int64
+	entries  map[string]*list.Element // path -> element holding a *cachedFile
+	order    *list.List               // most recently used first
+	mu       sync.Mutex
+}
+
+// cachedFile is one file's content as it was read
+type cachedFile struct {
+	path    string
+	modTime time.Time
+	size    int64
+	content []byte // shared by every response; never modified
+	hash    string
+}
+
+// newFileCache returns a cache holding up to capacity bytes, or nil, which
+// caches nothing, when capacity isn't positive
+func newFileCache(capacity int64) *fileCache {
+	if capacity <= 0 {
+		return nil
+	}
+	return &fileCache{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// get returns the cached file at path if it still matches info, dropping
+// an entry the file has changed since
+func (c *fileCache) get(path string, info os.FileInfo) (*cachedFile, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[path]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*cachedFile)
+	if !entry.modTime.Equal(info.ModTime()) || entry.size != info.Size() {
+		c.removeLocked(element)
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	return entry, true
+}
+
+// put caches a file as read, evicting the least recently used entries to
+// make room. Files larger than the whole cache aren't kept.
+func (c *fileCache) put(entry *cachedFile) {
+	if entry.size > c.capacity {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[entry.path]; ok {
+		c.removeLocked(element)
+	}
+	for c.used+entry.size > c.capacity {
+		c.removeLocked(c.order.Back())
+	}
+	c.entries[entry.path] = c.order.PushFront(entry)
+	c.used += entry.size
+}
+
+// removeLocked drops an entry; c.mu must be held
+func (c *fileCache) removeLocked(element *list.Element) {
+	entry := c.order.Remove(element).(*cachedFile)
+	delete(c.entries, entry.path)
+	c.used -= entry.size
+}
+
+// readServedFile reads a file for file/get along with its metadata and
+// content hash, from the file cache when it's on and the file unchanged
+func (s *Server) readServedFile(path string) ([]byte, os.FileInfo, string, error) {
+	if s.fileCache != nil {
+		if info, err := os.Stat(path); err == nil {
+			if entry, ok := s.fileCache.get(path, info); ok {
+				s.metrics.FileCache(metrics.CacheHit)
+				return entry.content, info, entry.hash, nil
+			}
+		}
+		s.metrics.FileCache(metrics.CacheMiss)
+	}
+
+	content, info, err := readFile(path)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	hash := contentHash(content)
+	if s.fileCache != nil {
+		s.fileCache.put(&cachedFile{path: path, modTime: info.ModTime(), size: int64(len(content)), content: content, hash: hash})
+	}
+	return content, info, hash, nil
+}
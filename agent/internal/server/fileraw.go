@@ -0,0 +1,154 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+
+	"github.com/zeropr/agent/internal/api"
+	"github.com/zeropr/agent/internal/crypto"
+	"github.com/zeropr/agent/internal/i18n"
+	"github.com/zeropr/agent/internal/metrics"
+)
+
+// sealedTagKey keys the entity tags of sealed raw responses, which mustn't
+// reveal the content hash the way a plain ETag does. It lives as long as
+// the process, so a download resumed after a restart starts over.
+var sealedTagKey = func() []byte {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+}()
+
+// sealedETag is the entity tag of a sealed raw response for a content hash
+func sealedETag(hash string) string {
+	mac := hmac.New(sha256.New, sealedTagKey)
+	mac.Write([]byte(hash))
+	return `"s-` + hex.EncodeToString(mac.Sum(nil)) + `"`
+}
+
+// handleFileRaw serves a file's bytes rather than a JSON document, so a
+// download cut off halfway can be finished with a Range request. The whole
+// file's hash and size come in headers on every response, the partial ones
+// included, and If-Match pins a resumed download to the version it started
+// on: a file that changed in between answers 412 and the client starts over.
+//
+// Sealed responses carry the hash as the first 64 bytes of the sealed
+// stream, ahead of the requested range, rather than in a header.
+func (s *Server) handleFileRaw(w http.ResponseWriter, r *http.Request) {
+	filePath := r.URL.Query().Get("path")
+	if filePath == "" {
+		s.writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, i18n.MsgMissingPath)
+		return
+	}
+
+	fullPath, ok := s.resolvePath(w, r, r.URL.Query().Get("repo"), filePath)
+	if !ok {
+		return
+	}
+	if !s.acquireRead(w, r) {
+		return
+	}
+	defer s.releaseRead()
+
+	content, info, err := readFile(fullPath)
+	if err != nil {
+		s.logger.Warn("Failed to read file", "path", fullPath, "err", err)
+		s.writeError(w, r, http.StatusNotFound, CodeFileNotFound, i18n.MsgFileNotFound, err)
+		return
+	}
+	s.metrics.FileRequest(metrics.FileServed)
+
+	hash := contentHash(content)
+	caller, signed := peerFromContext(r.Context())
+	sealed := signed && s.identity != nil && r.Header.Get(crypto.HeaderAcceptEncryption) == crypto.TransferScheme
+
+	etag := hashETag(hash)
+	if sealed {
+		etag = sealedETag(hash)
+	} else {
+		w.Header().Set(api.HeaderSHA256, hash)
+	}
+	if header := r.Header.Get("If-Match"); header != "" && !etagMatches(header, etag) {
+		s.writeError(w, r, http.StatusPreconditionFailed, CodeFileChanged, i18n.MsgFileChanged)
+		return
+	}
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set(api.HeaderSize, strconv.Itoa(len(content)))
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Type", "application/octet-stream")
+
+	if !sealed {
+		http.ServeContent(w, r, "", info.ModTime(), bytes.NewReader(content))
+		return
+	}
+
+	sw := &sealingWriter{ResponseWriter: w, s: s, caller: caller, hash: hash}
+	http.ServeContent(sw, r, "", info.ModTime(), bytes.NewReader(content))
+	if err := sw.close(); err != nil {
+		s.logger.Error("Encrypted transfer failed", "remote", r.RemoteAddr, "err", err)
+	}
+}
+
+// sealingWriter seals the body of successful responses written through it
+// to the calling agent's key. Error responses pass through in the clear,
+// as they do everywhere else.
+type sealingWriter struct {
+	http.ResponseWriter
+	s      *Server
+	caller *callerPeer
+	hash   string
+	sealer *crypto.SealWriter
+	err    error
+}
+
+func (sw *sealingWriter) WriteHeader(status int) {
+	if status == http.StatusOK || status == http.StatusPartialContent {
+		header, sealer, err := sw.s.identity.SealTransfer(sw.ResponseWriter, sw.caller.Key)
+		if err != nil {
+			sw.err = err
+			sw.ResponseWriter.Header().Del("Content-Length")
+			sw.ResponseWriter.Header().Del("Content-Range")
+			sw.ResponseWriter.Header().Del("Content-Type")
+			sw.ResponseWriter.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		// Sealing changes the length; Content-Range still names the file
+		// bytes inside the seal
+		h := sw.ResponseWriter.Header()
+		h.Del("Content-Length")
+		h.Set(crypto.HeaderEncryption, crypto.TransferScheme)
+		h.Set(crypto.HeaderTransferKey, header)
+		sw.sealer = sealer
+		_, sw.err = sealer.Write([]byte(sw.hash))
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+// Write seals the body once WriteHeader started a sealed response, which
+// ServeContent always calls before writing
+func (sw *sealingWriter) Write(b []byte) (int, error) {
+	if sw.err != nil {
+		return 0, sw.err
+	}
+	if sw.sealer == nil {
+		return sw.ResponseWriter.Write(b)
+	}
+	return sw.sealer.Write(b)
+}
+
+// close finishes the sealed stream, if one was started
+func (sw *sealingWriter) close() error {
+	if sw.err != nil {
+		return sw.err
+	}
+	if sw.sealer == nil {
+		return nil
+	}
+	return sw.sealer.Close()
+}
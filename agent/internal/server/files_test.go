@@ -0,0 +1,207 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zeropr/agent/internal/api"
+)
+
+// get sends a GET to the agent's local API with extra headers, returning
+// the response with its body read
+func (a *testAgent) get(t *testing.T, path string, headers map[string]string) (*http.Response, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, a.local.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	if a.token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp, body
+}
+
+func TestFileMetadata(t *testing.T) {
+	a := newTestAgent(t)
+	content := []byte("package main\n\nfunc main() {}\n")
+	path := filepath.Join(a.root, "main.go")
+	modTime := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	if err := os.WriteFile(path, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, body := a.get(t, "/api/file/get?path=main.go&repo=test", nil)
+	var file api.File
+	if err := json.Unmarshal(body, &file); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET answered %d %s", resp.StatusCode, body)
+	}
+	sum := sha256.Sum256(content)
+	hash := hex.EncodeToString(sum[:])
+	if file.Content != string(content) || file.Size != int64(len(content)) || file.SHA256 != hash || file.ModTime == nil || !file.ModTime.Equal(modTime) {
+		t.Errorf("file %+v", file)
+	}
+	if etag := resp.Header.Get("ETag"); etag != `"`+hash+`"` {
+		t.Errorf("ETag %s, want the content hash", etag)
+	}
+	if resp.Header.Get("Cache-Control") != "no-cache" {
+		t.Errorf("Cache-Control %q, want no-cache", resp.Header.Get("Cache-Control"))
+	}
+}
+
+func TestEmptyAndBinaryFiles(t *testing.T) {
+	a := newTestAgent(t)
+	gif := []byte("GIF89a\x01\x00\x01\x00\x80\x00\x00\xff\xff\xff\x00\x00\x00!\xf9\x04")
+	for name, content := range map[string][]byte{"empty.txt": {}, "dot.gif": gif} {
+		if err := os.WriteFile(filepath.Join(a.root, name), content, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var file api.File
+	if status, body := a.do(t, "GET", "/api/file/get?path=empty.txt", "", &file); status != http.StatusOK {
+		t.Fatalf("GET of an empty file answered %d %s", status, body)
+	}
+	if file.Content != "" || file.Encoding != "" || file.Size != 0 || file.SHA256 != "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" {
+		t.Errorf("empty file %+v", file)
+	}
+
+	file = api.File{}
+	a.do(t, "GET", "/api/file/get?path=dot.gif", "", &file)
+	content, err := file.Bytes()
+	sum := sha256.Sum256(gif)
+	if err != nil || string(content) != string(gif) || file.Encoding != api.EncodingBase64 || file.ContentType != "image/gif" ||
+		file.Size != int64(len(gif)) || file.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("binary file %+v, content %q, %v", file, content, err)
+	}
+}
+
+// TestFileSendRejectsBadBodies checks POST /api/file/send, which only the
+// extension calls, holds its body to what the agent knows
+func TestFileSendRejectsBadBodies(t *testing.T) {
+	a := newTestAgent(t)
+	if err := os.WriteFile(filepath.Join(a.root, "main.go"), []byte("package main\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var file api.File
+	if status, body := a.do(t, http.MethodPost, "/api/file/send", `{"filePath":"main.go"}`, &file); status != http.StatusOK || file.Content != "package main\n" {
+		t.Fatalf("send answered %d %s", status, body)
+	}
+	for name, body := range map[string]string{
+		"not JSON":         `filePath=main.go`,
+		"a misspelling":    `{"filepth":"main.go"}`,
+		"an unknown field": `{"filePath":"main.go","force":true}`,
+		"trailing data":    `{"filePath":"main.go"} {}`,
+		"no path":          `{}`,
+	} {
+		if status, answer := a.do(t, http.MethodPost, "/api/file/send", body, nil); status != http.StatusBadRequest || errorCode(answer) != CodeInvalidRequest {
+			t.Errorf("%s answered %d %s, want 400", name, status, answer)
+		}
+	}
+}
+
+func TestFileNotModified(t *testing.T) {
+	a := newTestAgent(t)
+	resp, _ := a.get(t, "/api/file/get?path=main.go", nil)
+	etag := resp.Header.Get("ETag")
+
+	for _, header := range []string{etag, "W/" + etag, `"stale", ` + etag, "*"} {
+		resp, body := a.get(t, "/api/file/get?path=main.go", map[string]string{"If-None-Match": header})
+		if resp.StatusCode != http.StatusNotModified || len(body) != 0 || resp.Header.Get("ETag") != etag {
+			t.Errorf("If-None-Match %s answered %d with %d bytes", header, resp.StatusCode, len(body))
+		}
+	}
+
+	// A changed file is sent whole, under a new tag
+	if err := os.WriteFile(filepath.Join(a.root, "main.go"), []byte("package changed\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	resp, body := a.get(t, "/api/file/get?path=main.go", map[string]string{"If-None-Match": etag})
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") == etag {
+		t.Errorf("a changed file answered %d, ETag %s: %s", resp.StatusCode, resp.Header.Get("ETag"), body)
+	}
+}
+
+func TestErrorsFollowAcceptLanguage(t *testing.T) {
+	a := newTestAgent(t, "-locale", "es")
+	for _, tt := range []struct {
+		header, locale, message string
+	}{
+		{"", "es", "Falta el parámetro path"}, // the configured locale
+		{"en-GB,en;q=0.9", "en", "Missing path parameter"},
+		{"fr, es;q=0.8", "es", "Falta el parámetro path"},
+	} {
+		resp, body := a.get(t, "/api/file/get", map[string]string{"Accept-Language": tt.header})
+		var e errorResponse
+		if err := json.Unmarshal(body, &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Code != CodeInvalidRequest || e.MessageID != "error.missing_path" || e.Message != tt.message || resp.Header.Get("Content-Language") != tt.locale {
+			t.Errorf("Accept-Language %q answered %s in %s", tt.header, body, resp.Header.Get("Content-Language"))
+		}
+	}
+}
+
+func TestFileReadsOverLimit(t *testing.T) {
+	a := newTestAgent(t, "-max-file-reads", "2", "-file-read-wait", "300ms")
+
+	// Two reads in flight take every slot
+	a.srv.reads.slots <- struct{}{}
+	a.srv.reads.slots <- struct{}{}
+
+	start := time.Now()
+	resp, body := a.get(t, "/api/file/get?path=main.go", nil)
+	var e errorResponse
+	json.Unmarshal(body, &e)
+	if resp.StatusCode != http.StatusServiceUnavailable || e.Code != CodeBusy || resp.Header.Get("Retry-After") != "1" {
+		t.Fatalf("the third read answered %d %s, Retry-After %q", resp.StatusCode, body, resp.Header.Get("Retry-After"))
+	}
+	if waited := time.Since(start); waited < 300*time.Millisecond {
+		t.Errorf("turned away after %s, before its wait was up", waited)
+	}
+
+	// One that queues is served as soon as a read finishes
+	time.AfterFunc(50*time.Millisecond, a.srv.releaseRead)
+	if resp, body := a.get(t, "/api/file/get?path=main.go", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("a queued read answered %d %s", resp.StatusCode, body)
+	}
+	// and gives its slot back
+	if len(a.srv.reads.slots) != 1 {
+		t.Errorf("%d slots taken after the queued read, want 1", len(a.srv.reads.slots))
+	}
+}
+
+func TestStatusShowsPeerFilter(t *testing.T) {
+	a := newTestAgent(t, "-allow", "alice,fp-bob", "-block", "mallory")
+	a.registry.SetFilter(a.cfg.PeerFilter)
+	var status struct {
+		PeerFilter struct {
+			Mode  string   `json:"mode"`
+			Allow []string `json:"allow"`
+			Block []string `json:"block"`
+		} `json:"peerFilter"`
+	}
+	a.do(t, http.MethodGet, "/api/status", "", &status)
+	if f := status.PeerFilter; f.Mode != "allow" || len(f.Allow) != 2 || f.Allow[1] != "fp-bob" || len(f.Block) != 1 || f.Block[0] != "mallory" {
+		t.Errorf("peer filter %+v", f)
+	}
+}
@@ -0,0 +1,249 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/zeropr/agent/internal/config"
+	"github.com/zeropr/agent/internal/crypto"
+	"github.com/zeropr/agent/internal/discovery"
+	"github.com/zeropr/agent/internal/events"
+	"github.com/zeropr/agent/internal/peerclient"
+	"github.com/zeropr/agent/internal/peers"
+	"github.com/zeropr/agent/internal/storage"
+	"github.com/zeropr/agent/internal/workspace"
+)
+
+// testAgent is an agent built as cmd/agent builds one, minus discovery's
+// broadcasts and background loops, serving its local API over httptest
+type testAgent struct {
+	srv      *Server
+	local    *httptest.Server
+	bus      *events.Bus
+	registry *peers.Registry
+	cfg      *config.Config
+	stateDir string
+	root     string        // the "test" share root
+	db       storage.Store // opened by storage
+	token    string        // sent with local API requests when set
+}
+
+// newTestAgent starts an agent with a "test" root holding main.go, taking
+// extra command-line flags
+func newTestAgent(t *testing.T, args ...string) *testAgent {
+	t.Helper()
+	dir := t.TempDir()
+	a := &testAgent{stateDir: filepath.Join(dir, "state"), root: filepath.Join(dir, "repo")}
+	if err := os.MkdirAll(a.root, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(a.root, "main.go"), []byte("package main\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := config.Load(append([]string{
+		"-state-dir", a.stateDir,
+		"-root", "test=" + a.root,
+		"-name", "test-agent",
+	}, args...), func(string) (string, bool) { return "", false })
+	if err != nil {
+		t.Fatalf("config: %v", err)
+	}
+	a.cfg = cfg
+	a.bus = events.NewBus()
+	a.registry = peers.NewRegistry(a.bus)
+	disc, err := discovery.NewService(cfg, a.registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws, err := workspace.New(cfg.Roots)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.srv = NewServer(cfg, a.registry, disc, a.bus, ws)
+	a.srv.SetLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	a.local = httptest.NewServer(a.srv.Handler())
+	t.Cleanup(a.local.Close)
+	return a
+}
+
+// storage opens the agent's store in its state directory, once
+func (a *testAgent) storage(t *testing.T) storage.Store {
+	t.Helper()
+	if a.db == nil {
+		db, err := storage.Open(a.cfg.Storage, a.stateDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a.db = db
+	}
+	return a.db
+}
+
+// withPeerIdentity gives the agent an identity and a trust store, so it
+// signs its requests to other agents and checks theirs
+func (a *testAgent) withPeerIdentity(t *testing.T) (*crypto.Identity, *crypto.TrustStore) {
+	t.Helper()
+	identity, err := crypto.LoadOrCreateIdentity(a.stateDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trust, err := crypto.OpenTrustStore(a.stateDir, a.storage(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.srv.SetPeerIdentity(identity, trust, peerclient.New(identity, a.cfg.PeerTimeouts))
+	return identity, trust
+}
+
+// do sends a local API request with a JSON body, decoding a 2xx response
+// into out if set, and returns the status and raw body
+func (a *testAgent) do(t *testing.T, method, path, body string, out interface{}) (int, []byte) {
+	t.Helper()
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	req, err := http.NewRequest(method, a.local.URL+path, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if a.token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	if out != nil && resp.StatusCode < 300 {
+		if err := json.Unmarshal(data, out); err != nil {
+			t.Fatalf("%s %s: decoding %s: %v", method, path, data, err)
+		}
+	}
+	return resp.StatusCode, data
+}
+
+// post is do for a POST that must succeed
+func (a *testAgent) post(t *testing.T, path, body string, out interface{}) {
+	t.Helper()
+	if status, data := a.do(t, http.MethodPost, path, body, out); status >= 300 {
+		t.Fatalf("POST %s: %d %s", path, status, data)
+	}
+}
+
+// errorCode returns the stable code of an error response body
+func errorCode(body []byte) string {
+	var typed struct {
+		Code string `json:"code"`
+	}
+	json.Unmarshal(body, &typed)
+	return typed.Code
+}
+
+// createdSession is what POST /api/session/create answers
+type createdSession struct {
+	SessionID      string `json:"sessionId"`
+	SyncToken      string `json:"syncToken"`
+	ReconnectToken string `json:"reconnectToken"`
+	WSURL          string `json:"wsUrl"`
+	ChatURL        string `json:"chatUrl"`
+}
+
+// joinedSession is what POST /api/session/join answers
+type joinedSession struct {
+	Role           string `json:"role"`
+	SyncToken      string `json:"syncToken"`
+	ReconnectToken string `json:"reconnectToken"`
+	WSPath         string `json:"wsPath"`
+}
+
+// createSession starts a session on main.go with initiator
+func (a *testAgent) createSession(t *testing.T, initiator string) createdSession {
+	t.Helper()
+	var session createdSession
+	a.post(t, "/api/session/create", `{"filePath":"main.go","initiator":"`+initiator+`"}`, &session)
+	return session
+}
+
+// join adds participantID to a session with the given role
+func (a *testAgent) join(t *testing.T, sessionID, participantID, role string) joinedSession {
+	t.Helper()
+	body, _ := json.Marshal(map[string]string{"sessionId": sessionID, "participantId": participantID, "role": role})
+	var joined joinedSession
+	a.post(t, "/api/session/join", string(body), &joined)
+	return joined
+}
+
+// dial opens a WebSocket on the agent's local listener. It returns the
+// HTTP status when the upgrade is refused.
+func (a *testAgent) dial(t *testing.T, path string) (*websocket.Conn, int) {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(a.local.URL, "http") + path
+	conn, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		if resp != nil {
+			return nil, resp.StatusCode
+		}
+		t.Fatalf("dial %s: %v", path, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, http.StatusSwitchingProtocols
+}
+
+// readBinary returns the next binary message on conn, skipping text
+// frames, or nil if none arrives within wait
+func readBinary(t *testing.T, conn *websocket.Conn, wait time.Duration) []byte {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(wait))
+	defer conn.SetReadDeadline(time.Time{})
+	for {
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			return nil
+		}
+		if messageType == websocket.BinaryMessage {
+			return data
+		}
+	}
+}
+
+// readJSON reads text frames from conn until one decodes with the given
+// type, failing the test if none does within wait
+func readJSON(t *testing.T, conn *websocket.Conn, frameType string, wait time.Duration, out interface{}) {
+	t.Helper()
+	deadline := time.Now().Add(wait)
+	conn.SetReadDeadline(deadline)
+	defer conn.SetReadDeadline(time.Time{})
+	for {
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("waiting for a %q frame: %v", frameType, err)
+		}
+		var typed struct {
+			Type string `json:"type"`
+		}
+		if messageType != websocket.TextMessage || json.Unmarshal(data, &typed) != nil || typed.Type != frameType {
+			continue
+		}
+		if err := json.NewDecoder(bytes.NewReader(data)).Decode(out); err != nil {
+			t.Fatalf("decoding %s: %v", data, err)
+		}
+		return
+	}
+}
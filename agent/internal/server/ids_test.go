@@ -0,0 +1,53 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestMalformedSessionIDs(t *testing.T) {
+	a := newTestAgent(t)
+	session := a.createSession(t, "alice")
+	malformed := []string{
+		"../../etc/passwd",
+		"session-1?token=x",
+		"'; DROP TABLE sessions;--",
+		"<script>alert(1)</script>",
+		"session 1",
+		"session-1\r\nX-Injected: 1",
+		"-session",
+	}
+
+	for _, id := range malformed {
+		for _, path := range []string{"/api/session/join", "/api/session/leave"} {
+			body, _ := json.Marshal(map[string]string{"sessionId": id, "participantId": "bob"})
+			status, got := a.do(t, http.MethodPost, path, string(body), nil)
+			if status != http.StatusBadRequest || errorCode(got) != CodeInvalidSessionID {
+				t.Errorf("%s with %q: %d %s", path, id, status, got)
+			}
+		}
+	}
+	// A well-formed ID that names no session is still just not found
+	status, got := a.do(t, http.MethodPost, "/api/session/join", `{"sessionId":"session-0","participantId":"bob"}`, nil)
+	if status != http.StatusNotFound || errorCode(got) != CodeSessionNotFound {
+		t.Errorf("joining a session that doesn't exist: %d %s", status, got)
+	}
+
+	// The sockets refuse them before looking for a session or a token. One
+	// with a slash in it doesn't reach them at all.
+	for _, id := range malformed {
+		want := http.StatusBadRequest
+		if strings.Contains(id, "/") {
+			want = http.StatusNotFound
+		}
+		for _, socket := range []string{"/ws/sync/", "/ws/chat/"} {
+			resp, body := a.get(t, socket+url.PathEscape(id)+"?sync="+session.SyncToken, nil)
+			if resp.StatusCode != want || (want == http.StatusBadRequest && errorCode(body) != CodeInvalidSessionID) {
+				t.Errorf("%s%q: %d %s", socket, id, resp.StatusCode, body)
+			}
+		}
+	}
+}
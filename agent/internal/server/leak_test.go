@@ -0,0 +1,221 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/zeropr/agent/internal/crypto"
+	"github.com/zeropr/agent/internal/events"
+)
+
+// leakRemoteAddr is where requests from another agent appear to come from
+const leakRemoteAddr = "192.0.2.7:40000"
+
+// fixture is a secret the agent holds, by name, in every encoding it
+// could leak in
+type fixture struct {
+	name   string
+	values []string
+}
+
+// leakHunt is what an agent under test has said so far, and the secrets
+// it must not have said
+type leakHunt struct {
+	t       *testing.T
+	secrets []fixture // must appear nowhere
+	paths   []fixture // must not reach other agents
+	checked int
+}
+
+// secret adds a value that must appear nowhere
+func (h *leakHunt) secret(name, value string) {
+	h.t.Helper()
+	if value == "" {
+		h.t.Fatalf("no %s to look for", name)
+	}
+	h.secrets = append(h.secrets, fixture{name, []string{value}})
+}
+
+// keyFile adds the key seed in path, raw and in the encodings keys are
+// usually printed in
+func (h *leakHunt) keyFile(name, path string) {
+	h.t.Helper()
+	seed, err := os.ReadFile(path)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	h.secrets = append(h.secrets, fixture{name, []string{
+		string(seed),
+		hex.EncodeToString(seed),
+		base64.StdEncoding.EncodeToString(seed),
+		base64.RawURLEncoding.EncodeToString(seed),
+	}})
+}
+
+// check reports each fixture in output; paths count only in what other
+// agents see
+func (h *leakHunt) check(surface string, output []byte, remote bool) {
+	h.t.Helper()
+	h.checked++
+	fixtures := h.secrets
+	if remote {
+		fixtures = append(fixtures[:len(fixtures):len(fixtures)], h.paths...)
+	}
+	for _, f := range fixtures {
+		for _, value := range f.values {
+			if bytes.Contains(output, []byte(value)) {
+				h.t.Errorf("%s leaks the %s", surface, f.name)
+				break
+			}
+		}
+	}
+}
+
+// lockedBuffer is a log destination safe for handlers logging at once
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte(nil), b.buf.Bytes()...)
+}
+
+// expand fills in a path template's variables with every value in vars;
+// a template with a variable there are no values for expands to nothing
+func expand(template string, vars map[string][]string) []string {
+	start := strings.Index(template, "{")
+	if start < 0 {
+		return []string{template}
+	}
+	end := start + strings.Index(template[start:], "}")
+	var paths []string
+	for _, value := range vars[template[start+1:end]] {
+		paths = append(paths, expand(template[:start]+value+template[end+1:], vars)...)
+	}
+	return paths
+}
+
+// TestNoSecretLeaks holds one of every secret the agent keeps and checks
+// none turns up in what it serializes outward: every GET endpoint of the
+// local API, what other agents are answered, the event stream, and the
+// logs. Its share root's path is a secret too in what other agents see.
+func TestNoSecretLeaks(t *testing.T) {
+	a := newTestAgent(t, "-log-level", "debug")
+	logs := &lockedBuffer{}
+	a.srv.SetLogger(slog.New(slog.NewJSONHandler(logs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	a.withTokens(t)
+	a.withRetention(t)
+	_, trust := a.withPeerIdentity(t)
+	captured, unsubscribe := a.bus.Subscribe("leak-test", 1024)
+
+	// Another agent, trusted, to sign requests as
+	remoteDir := t.TempDir()
+	remote, err := crypto.LoadOrCreateIdentity(remoteDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := trust.Trust(remote.PublicKey, "remote", crypto.Provenance{Method: crypto.ProvenancePairingCode, At: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	h := &leakHunt{t: t}
+	h.secret("primary API token", a.token)
+	h.keyFile("identity key", filepath.Join(a.stateDir, "identity.key"))
+	h.keyFile("remote identity key", filepath.Join(remoteDir, "identity.key"))
+	h.paths = append(h.paths,
+		fixture{"share root path", []string{a.root}},
+		fixture{"state dir path", []string{a.stateDir}})
+
+	// A second API token, a live session and an ended one, each with
+	// reconnect tokens, and a presence
+	secret, _ := a.createToken(t, "read")
+	h.secret("API token", secret)
+	a.post(t, "/api/presence", `{"status":"editing","activeFile":"main.go","message":"checking for leaks"}`, nil)
+	vars := map[string][]string{"fingerprint": {remote.Fingerprint()}}
+	for _, name := range []string{"live", "ended"} {
+		session := a.createSession(t, "alice")
+		h.secret(name+" session sync token", session.SyncToken)
+		h.secret(name+" session reconnect token", session.ReconnectToken)
+		joined := a.join(t, session.SessionID, "bob", "")
+		h.secret(name+" session joiner's reconnect token", joined.ReconnectToken)
+		if name == "ended" {
+			for _, participant := range []string{"bob", "alice"} {
+				a.post(t, "/api/session/leave", fmt.Sprintf(`{"sessionId":%q,"participantId":%q}`, session.SessionID, participant), nil)
+			}
+		}
+		vars["id"] = append(vars["id"], session.SessionID)
+	}
+
+	// Every GET endpoint of the local API
+	router := a.srv.Handler().(*mux.Router)
+	err = router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		methods, _ := route.GetMethods()
+		template, err := route.GetPathTemplate()
+		if err != nil || len(methods) == 0 || methods[0] != http.MethodGet || strings.HasPrefix(template, "/ws/") {
+			return nil
+		}
+		for _, path := range expand(template, vars) {
+			_, body := a.do(t, http.MethodGet, path, "", nil)
+			h.check("GET "+path, body, false)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The requests other agents make, with their mistakes
+	peer := a.srv.PeerHandler()
+	for _, path := range []string{
+		"/api/status",
+		"/api/file/get?path=main.go",
+		"/api/file/get?path=missing.go",
+		"/api/file/raw?path=missing.go",
+		"/api/file/get?path=../../etc/passwd",
+	} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = leakRemoteAddr
+		if path != "/api/status" {
+			remote.SignRequest(req, nil)
+		}
+		rec := httptest.NewRecorder()
+		peer.ServeHTTP(rec, req)
+		h.check("peer GET "+path, rec.Body.Bytes(), true)
+	}
+
+	time.Sleep(100 * time.Millisecond) // let timelines and subscribers catch up
+	unsubscribe()
+	var seen []events.Event
+	for event := range captured {
+		seen = append(seen, event)
+		data, _ := json.Marshal(event)
+		h.check("event "+event.Type, data, false)
+	}
+	h.check("the logs", logs.Bytes(), false)
+	if len(seen) == 0 || len(logs.Bytes()) == 0 {
+		t.Fatalf("nothing to check: %d events, %d bytes of logs", len(seen), len(logs.Bytes()))
+	}
+	t.Logf("no secrets in %d responses, %d events, or the logs", h.checked-len(seen)-1, len(seen))
+}
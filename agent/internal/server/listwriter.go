@@ -0,0 +1,186 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/zeropr/agent/internal/events"
+)
+
+const ndjsonContentType = "application/x-ndjson"
+
+// listing describes one list endpoint: the key its items are wrapped in,
+// and, for lists that can be followed, the bus events reporting changes to
+// its items
+type listing struct {
+	key    string                      // wraps the items in the JSON response
+	fields map[string]interface{}      // the JSON response's other fields
+	prefix string                      // of the events about its items; "" if it can't be followed
+	ops    map[string]string           // event type suffix -> change operation
+	keep   func(item interface{}) bool // the changes a filtered listing follows; nil keeps all
+}
+
+// with returns the listing with fields added to its JSON response
+func (l listing) with(fields map[string]interface{}) listing {
+	l.fields = fields
+	return l
+}
+
+// matching returns the listing following only the changes to items keep
+// accepts, for a listing filtered the same way
+func (l listing) matching(keep func(item interface{}) bool) listing {
+	l.keep = keep
+	return l
+}
+
+// The list endpoints. Those with a prefix can be followed.
+var (
+	peerList = listing{key: "peers", prefix: "peer.", ops: map[string]string{
+		"added":   "add",
+		"updated": "update",
+		"removed": "remove",
+	}}
+	sessionList = listing{key: "sessions", prefix: "session.", ops: map[string]string{
+		"created": "add",
+		"updated": "update",
+		"ended":   "remove",
+	}}
+	// Ended sessions are listed once their artifacts are kept, until the
+	// last of them is deleted or the session is restored
+	endedSessionList = listing{key: "sessions", prefix: "artifacts.", ops: map[string]string{
+		"kept":     "add",
+		"updated":  "update",
+		"deleted":  "remove",
+		"reopened": "remove",
+	}}
+	// Transfers stay listed once finished until they're forgotten
+	transferList = listing{key: "transfers", prefix: "transfer.", ops: map[string]string{
+		"started":   "add",
+		"progress":  "update",
+		"done":      "update",
+		"failed":    "update",
+		"cancelled": "update",
+		"resumed":   "update",
+		"removed":   "remove",
+	}}
+	// Fetches age out of the journal without a change record
+	fetchList = listing{key: "fetches", prefix: "fetches.", ops: map[string]string{
+		"recorded": "add",
+	}}
+	awayFetchList   = listing{key: "peers"}
+	peerHistoryList = listing{key: "history"}
+	participantList = listing{key: "participants"}
+	chatList        = listing{key: "messages"}
+	trustList       = listing{key: "trusted"}
+	tokenList       = listing{key: "tokens"}
+)
+
+// changeRecord is one follow-mode line describing a change to a list item
+type changeRecord struct {
+	Op   string      `json:"op"`
+	Item interface{} `json:"item"`
+}
+
+// wantsNDJSON reports whether the client asked for newline-delimited JSON
+func wantsNDJSON(r *http.Request) bool {
+	if r.URL.Query().Get("format") == "ndjson" {
+		return true
+	}
+	return strings.Contains(r.Header.Get("Accept"), ndjsonContentType)
+}
+
+// wantsFollow reports whether the client asked to follow a listing
+func wantsFollow(r *http.Request) bool {
+	follow := r.URL.Query().Get("follow")
+	return follow == "1" || follow == "true"
+}
+
+// writeList writes a list endpoint response. By default the items are
+// wrapped in a single {key: [...]} object alongside the list's fields;
+// clients asking for ndjson get one object per line, and with ?follow=1 a
+// list that can be followed is followed by live change records until the
+// client disconnects. A follower too slow to keep up is sent a gap record
+// in place of the changes it missed.
+func writeList[T any](s *Server, w http.ResponseWriter, r *http.Request, list listing, items []T) {
+	if !wantsNDJSON(r) {
+		body := make(map[string]interface{}, len(list.fields)+1)
+		for name, value := range list.fields {
+			body[name] = value
+		}
+		body[list.key] = items
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(body)
+		return
+	}
+
+	follow := list.prefix != "" && wantsFollow(r)
+
+	// Subscribe before writing the listing so no change falls in between
+	var changes <-chan events.Event
+	if follow {
+		ch, unsubscribe := s.bus.Subscribe("list-follow", 64)
+		defer unsubscribe()
+		changes = ch
+	}
+
+	w.Header().Set("Content-Type", ndjsonContentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+
+	flush := func() {
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	for _, item := range items {
+		if err := enc.Encode(item); err != nil {
+			return
+		}
+		flush()
+	}
+
+	if !follow {
+		return
+	}
+	// A listing with nothing in it still tells the client it's following
+	flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-changes:
+			if !ok {
+				return
+			}
+			record, ok := list.change(event)
+			if !ok {
+				continue
+			}
+			if err := enc.Encode(record); err != nil {
+				return
+			}
+			flush()
+		}
+	}
+}
+
+// change returns the change record event makes to the listing, if any
+func (l listing) change(event events.Event) (changeRecord, bool) {
+	// Changes were skipped while the client wasn't reading; it has to
+	// list again to catch up
+	if event.Type == events.EventGap {
+		return changeRecord{Op: "gap", Item: event.Data}, true
+	}
+	if !strings.HasPrefix(event.Type, l.prefix) {
+		return changeRecord{}, false
+	}
+	op, ok := l.ops[strings.TrimPrefix(event.Type, l.prefix)]
+	if !ok || (l.keep != nil && !l.keep(event.Data)) {
+		return changeRecord{}, false
+	}
+	return changeRecord{Op: op, Item: event.Data}, true
+}
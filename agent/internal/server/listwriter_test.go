@@ -0,0 +1,386 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zeropr/agent/internal/events"
+	"github.com/zeropr/agent/internal/fetchlog"
+	"github.com/zeropr/agent/internal/gitinfo"
+	"github.com/zeropr/agent/internal/peers"
+	"github.com/zeropr/agent/internal/retention"
+)
+
+// stream reads an ndjson response line by line as it arrives
+type stream struct {
+	lines chan string
+}
+
+// openStream GETs path on the agent's local API, failing unless it answers
+// with ndjson
+func (a *testAgent) openStream(t *testing.T, path string) *stream {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, a.local.URL+path, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET %s: %v", path, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: %s", path, resp.Status)
+	}
+	if got := resp.Header.Get("Content-Type"); got != ndjsonContentType {
+		t.Fatalf("GET %s: Content-Type %q", path, got)
+	}
+
+	s := &stream{lines: make(chan string, 64)}
+	go func() {
+		defer resp.Body.Close()
+		defer close(s.lines)
+		reader := bufio.NewReader(resp.Body)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			s.lines <- line
+		}
+	}()
+	return s
+}
+
+// next decodes the next line into out, failing if none arrives within a
+// few seconds or it isn't one whole JSON object
+func (s *stream) next(t *testing.T, out interface{}) {
+	t.Helper()
+	select {
+	case line, ok := <-s.lines:
+		if !ok {
+			t.Fatal("stream ended")
+		}
+		if !strings.HasSuffix(line, "\n") || strings.Count(line, "\n") != 1 {
+			t.Fatalf("not one line: %q", line)
+		}
+		if err := json.Unmarshal([]byte(line), out); err != nil {
+			t.Fatalf("line %q: %v", line, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no line within 5s")
+	}
+}
+
+// ended reports whether the stream ends without another line
+func (s *stream) ended(t *testing.T) bool {
+	t.Helper()
+	select {
+	case line, ok := <-s.lines:
+		if ok {
+			t.Fatalf("unexpected line %q", line)
+		}
+		return true
+	case <-time.After(5 * time.Second):
+		return false
+	}
+}
+
+// record is a follow-mode change record with the item left encoded
+type record struct {
+	Op   string          `json:"op"`
+	Item json.RawMessage `json:"item"`
+}
+
+// nextChange returns the next change record, decoding its item into item
+func (s *stream) nextChange(t *testing.T, item interface{}) string {
+	t.Helper()
+	var r record
+	s.next(t, &r)
+	if r.Op == "" {
+		t.Fatalf("not a change record: %+v", r)
+	}
+	if item != nil {
+		if err := json.Unmarshal(r.Item, item); err != nil {
+			t.Fatalf("item %s: %v", r.Item, err)
+		}
+	}
+	return r.Op
+}
+
+func addPeers(a *testAgent, ids ...string) {
+	for i, id := range ids {
+		a.registry.Add(&peers.Peer{ID: id, Name: id, Address: "10.0.0.1", Port: 9000 + i})
+	}
+}
+
+func TestListNDJSON(t *testing.T) {
+	a := newTestAgent(t)
+	addPeers(a, "alpha", "beta", "gamma")
+
+	var wrapped struct {
+		Peers []peers.Peer `json:"peers"`
+	}
+	a.do(t, http.MethodGet, "/api/peers", "", &wrapped)
+	if len(wrapped.Peers) != 3 {
+		t.Fatalf("wrapped listing has %d peers, want 3", len(wrapped.Peers))
+	}
+
+	listing := a.openStream(t, "/api/peers?format=ndjson")
+	seen := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		var peer peers.Peer
+		listing.next(t, &peer)
+		seen[peer.ID] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("listed %v, want 3 distinct peers", seen)
+	}
+	if !listing.ended(t) {
+		t.Error("a listing without follow stayed open")
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, a.local.URL+"/api/peers", nil)
+	req.Header.Set("Accept", ndjsonContentType)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if got := resp.Header.Get("Content-Type"); got != ndjsonContentType {
+		t.Fatalf("Accept: ndjson answered %q", got)
+	}
+	if lines := strings.Count(string(body), "\n"); lines != 3 {
+		t.Errorf("Accept: ndjson gave %d lines, want 3", lines)
+	}
+}
+
+// TestListFieldsAroundItems checks lists with fields beside their items
+// keep them in the wrapped response and leave them out of ndjson
+func TestListFieldsAroundItems(t *testing.T) {
+	a := newTestAgent(t)
+	a.srv.fetches.Record(fetchlog.Entry{At: time.Now(), Peer: "bob", Fingerprint: "fp", Path: "main.go", Unattended: true})
+
+	var summary fetchlog.Summary
+	a.do(t, http.MethodGet, "/api/fetches/away", "", &summary)
+	if summary.Fetches != 1 || len(summary.Peers) != 1 || summary.Peers[0].Peer != "bob" {
+		t.Fatalf("away summary %+v", summary)
+	}
+
+	listing := a.openStream(t, "/api/fetches/away?format=ndjson")
+	var peer fetchlog.PeerFetches
+	listing.next(t, &peer)
+	if peer.Peer != "bob" || len(peer.Files) != 1 {
+		t.Errorf("away line %+v", peer)
+	}
+	if !listing.ended(t) {
+		t.Error("away listing stayed open")
+	}
+
+	// Lists that can't be followed end after the listing even when asked
+	listing = a.openStream(t, "/api/fetches/away?format=ndjson&follow=1")
+	listing.next(t, &peer)
+	if !listing.ended(t) {
+		t.Error("follow kept a list with no change events open")
+	}
+}
+
+// flushRecorder records how much of the body had been written at each flush
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushedAt []int
+}
+
+func (f *flushRecorder) Flush() {
+	f.flushedAt = append(f.flushedAt, f.Body.Len())
+	f.ResponseRecorder.Flush()
+}
+
+func TestListFlushesEachItem(t *testing.T) {
+	s := &Server{bus: events.NewBus()}
+	items := []map[string]int{{"n": 1}, {"n": 2}, {"n": 3}}
+
+	rec := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	writeList(s, rec, httptest.NewRequest(http.MethodGet, "/?format=ndjson", nil), listing{key: "items"}, items)
+
+	body := rec.Body.String()
+	if len(rec.flushedAt) != len(items) {
+		t.Fatalf("flushed %d times for %d items", len(rec.flushedAt), len(items))
+	}
+	for i, at := range rec.flushedAt {
+		if at == 0 || body[at-1] != '\n' {
+			t.Errorf("flush %d came mid-line, at byte %d of %q", i, at, body)
+		}
+		if lines := strings.Count(body[:at], "\n"); lines != i+1 {
+			t.Errorf("flush %d came after %d lines, want %d", i, lines, i+1)
+		}
+	}
+}
+
+func TestListChangeRecords(t *testing.T) {
+	unattended := fetchList.matching(func(item interface{}) bool {
+		entry, ok := item.(fetchlog.Entry)
+		return ok && entry.Unattended
+	})
+	for _, tc := range []struct {
+		list   listing
+		event  string
+		data   interface{}
+		wantOp string
+	}{
+		{peerList, peers.EventPeerAdded, peers.Peer{}, "add"},
+		{peerList, peers.EventPeerUpdated, peers.Peer{}, "update"},
+		{peerList, peers.EventPeerRemoved, peers.Peer{}, "remove"},
+		{peerList, "session.created", nil, ""},
+		{sessionList, "session.ended", nil, "remove"},
+		{sessionList, "session.throttled", nil, ""},
+		{endedSessionList, "session.ended", nil, ""},
+		{endedSessionList, retention.EventArtifactsKept, retention.Manifest{}, "add"},
+		{endedSessionList, retention.EventArtifactsUpdated, retention.Manifest{}, "update"},
+		{endedSessionList, retention.EventArtifactsDeleted, retention.Manifest{}, "remove"},
+		{endedSessionList, retention.EventArtifactsReopened, retention.Manifest{}, "remove"},
+		{transferList, EventTransferProgress, nil, "update"},
+		{transferList, EventTransferRemoved, nil, "remove"},
+		{fetchList, fetchlog.EventFetchRecorded, fetchlog.Entry{}, "add"},
+		{fetchList, fetchlog.EventAwaySummary, fetchlog.Summary{}, ""},
+		{unattended, fetchlog.EventFetchRecorded, fetchlog.Entry{}, ""},
+		{unattended, fetchlog.EventFetchRecorded, fetchlog.Entry{Unattended: true}, "add"},
+		{tokenList, events.EventGap, events.Gap{}, "gap"},
+	} {
+		record, ok := tc.list.change(events.Event{Type: tc.event, Data: tc.data})
+		if got := record.Op; got != tc.wantOp || ok != (tc.wantOp != "") {
+			t.Errorf("%s on %s: op %q (%v), want %q", tc.event, tc.list.key, got, ok, tc.wantOp)
+		}
+	}
+}
+
+func TestFollowPeers(t *testing.T) {
+	a := newTestAgent(t)
+	addPeers(a, "alpha")
+	hash := gitinfo.NewRepo(a.root).Hash()
+
+	all := a.openStream(t, "/api/peers?format=ndjson&follow=1")
+	sameRepo := a.openStream(t, "/api/peers?format=ndjson&follow=1&repo=test")
+	var peer peers.Peer
+	all.next(t, &peer)
+	if peer.ID != "alpha" {
+		t.Fatalf("listed %q", peer.ID)
+	}
+
+	// Subscribed before the listing, so nothing in between is missed
+	a.registry.Add(&peers.Peer{ID: "beta", Name: "beta", Address: "10.0.0.2", Port: 9000, RepoHash: hash})
+	if op := all.nextChange(t, &peer); op != "add" || peer.ID != "beta" {
+		t.Errorf("got %s %s, want add beta", op, peer.ID)
+	}
+	if op := sameRepo.nextChange(t, &peer); op != "add" || peer.ID != "beta" {
+		t.Errorf("repo follower got %s %s, want add beta", op, peer.ID)
+	}
+
+	a.registry.Add(&peers.Peer{ID: "gamma", Name: "gamma", Address: "10.0.0.3", Port: 9000})
+	a.registry.Update("beta", func(p *peers.Peer) { p.Status = "editing" })
+	a.registry.Remove("alpha")
+	for _, want := range []struct{ op, id string }{{"add", "gamma"}, {"update", "beta"}, {"remove", "alpha"}} {
+		if op := all.nextChange(t, &peer); op != want.op || peer.ID != want.id {
+			t.Errorf("got %s %s, want %s %s", op, peer.ID, want.op, want.id)
+		}
+	}
+	// The repo follower skips the peers serving other repos
+	if op := sameRepo.nextChange(t, &peer); op != "update" || peer.ID != "beta" || peer.Status != "editing" {
+		t.Errorf("repo follower got %s %s, want update beta", op, peer.ID)
+	}
+	a.registry.Remove("beta")
+	if op := sameRepo.nextChange(t, &peer); op != "remove" || peer.ID != "beta" {
+		t.Errorf("repo follower got %s %s, want remove beta", op, peer.ID)
+	}
+}
+
+func TestFollowFetches(t *testing.T) {
+	a := newTestAgent(t)
+	all := a.openStream(t, "/api/fetches?format=ndjson&follow=1")
+	unattended := a.openStream(t, "/api/fetches?format=ndjson&follow=1&unattended=true")
+
+	for i, away := range []bool{false, true} {
+		a.bus.Publish(fetchlog.EventFetchRecorded, fetchlog.Entry{Peer: "bob", Path: fmt.Sprintf("f%d.go", i), Unattended: away})
+	}
+	var entry fetchlog.Entry
+	for _, want := range []string{"f0.go", "f1.go"} {
+		if op := all.nextChange(t, &entry); op != "add" || entry.Path != want {
+			t.Errorf("got %s %s, want add %s", op, entry.Path, want)
+		}
+	}
+	if op := unattended.nextChange(t, &entry); op != "add" || entry.Path != "f1.go" {
+		t.Errorf("unattended follower got %s %s, want add f1.go", op, entry.Path)
+	}
+}
+
+// withRetention keeps the agent's session artifacts as cmd/agent does
+func (a *testAgent) withRetention(t *testing.T) {
+	t.Helper()
+	store, err := retention.OpenStore(a.stateDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	janitor, err := retention.NewJanitor(store, a.stateDir, a.storage(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go retention.RecordTimelines(ctx, a.bus, store)
+	a.srv.SetRetention(janitor)
+}
+
+func TestFollowEndedSessions(t *testing.T) {
+	a := newTestAgent(t)
+	a.withRetention(t)
+	live := a.openStream(t, "/api/sessions?format=ndjson&follow=1")
+	ended := a.openStream(t, "/api/sessions/ended?format=ndjson&follow=1")
+
+	session := a.createSession(t, "alice")
+	var item struct {
+		ID        string `json:"id"`
+		SessionID string `json:"sessionId"`
+	}
+	if op := live.nextChange(t, &item); op != "add" || item.ID != session.SessionID {
+		t.Fatalf("live list got %s %s, want add", op, item.ID)
+	}
+	a.post(t, "/api/session/leave", fmt.Sprintf(`{"sessionId":%q,"participantId":"alice"}`, session.SessionID), nil)
+
+	// The session leaves the live list and joins the ended one
+	for {
+		op := live.nextChange(t, &item)
+		if op == "remove" {
+			break
+		}
+		if op != "update" {
+			t.Fatalf("live list got %s, want remove", op)
+		}
+	}
+	if op := ended.nextChange(t, &item); op != "add" || item.SessionID != session.SessionID {
+		t.Fatalf("ended list got %s %s, want add", op, item.SessionID)
+	}
+
+	if status, body := a.do(t, http.MethodDelete, "/api/sessions/ended/"+session.SessionID, "", nil); status != http.StatusOK {
+		t.Fatalf("delete: %d %s", status, body)
+	}
+	for {
+		op := ended.nextChange(t, &item)
+		if op == "remove" {
+			break
+		}
+		// The document may be kept after the session is marked ended
+		if op != "update" {
+			t.Fatalf("ended list got %s, want remove", op)
+		}
+	}
+	if item.SessionID != session.SessionID {
+		t.Errorf("removed %s, want %s", item.SessionID, session.SessionID)
+	}
+}
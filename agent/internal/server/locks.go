@@ -0,0 +1,74 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/zeropr/agent/internal/api"
+	"github.com/zeropr/agent/internal/i18n"
+	"github.com/zeropr/agent/internal/sessions"
+)
+
+// writeLockError writes the error response for a lock error
+func (s *Server) writeLockError(w http.ResponseWriter, r *http.Request, err error) {
+	switch err {
+	case sessions.ErrSessionNotFound:
+		s.writeErrorFor(w, r, http.StatusNotFound, CodeSessionNotFound, err)
+	case sessions.ErrLockNotFound:
+		s.writeErrorFor(w, r, http.StatusNotFound, CodeLockNotFound, err)
+	case sessions.ErrNotParticipant:
+		s.writeErrorFor(w, r, http.StatusForbidden, CodeNotParticipant, err)
+	case sessions.ErrLockConflict:
+		s.writeErrorFor(w, r, http.StatusConflict, CodeLockConflict, err)
+	default:
+		s.writeErrorFor(w, r, http.StatusBadRequest, CodeInvalidRequest, err)
+	}
+}
+
+func (s *Server) handleSessionLock(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		SessionID     string `json:"sessionId"`
+		ParticipantID string `json:"participantId"`
+		StartLine     int    `json:"startLine"`
+		EndLine       int    `json:"endLine"`
+		TTLSeconds    int    `json:"ttlSeconds"`
+	}
+	if err := api.DecodeLocal(r.Body, &req); err != nil {
+		s.writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, i18n.MsgInvalidRequest)
+		return
+	}
+
+	ttl := time.Duration(req.TTLSeconds) * time.Second
+	lock, err := s.sessionMgr.AcquireLock(req.SessionID, req.ParticipantID, req.StartLine, req.EndLine, ttl)
+	if err != nil {
+		s.writeLockError(w, r, err)
+		return
+	}
+	s.logger.Info("Lock acquired", "session", lock.SessionID, "participant", lock.ParticipantID, "lock", lock.ID, "startLine", lock.StartLine, "endLine", lock.EndLine)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(lock)
+}
+
+func (s *Server) handleSessionUnlock(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		SessionID     string `json:"sessionId"`
+		ParticipantID string `json:"participantId"`
+		LockID        string `json:"lockId"`
+	}
+	if err := api.DecodeLocal(r.Body, &req); err != nil || req.ParticipantID == "" {
+		s.writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, i18n.MsgInvalidRequest)
+		return
+	}
+
+	if err := s.sessionMgr.ReleaseLock(req.SessionID, req.LockID, req.ParticipantID); err != nil {
+		s.writeLockError(w, r, err)
+		return
+	}
+	s.logger.Info("Lock released", "session", req.SessionID, "participant", req.ParticipantID, "lock", req.LockID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "released"})
+}
@@ -0,0 +1,12 @@
+package server
+
+import (
+	"testing"
+
+	"go.uber.org/goleak"
+)
+
+// TestMain fails the package's tests if any leaves a goroutine running
+func TestMain(m *testing.M) {
+	goleak.VerifyTestMain(m)
+}
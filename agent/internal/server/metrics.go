@@ -0,0 +1,54 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/zeropr/agent/internal/metrics"
+)
+
+// SetMetrics enables GET /metrics on the local listener and instruments the
+// server, sync relay, and both routers with m
+func (s *Server) SetMetrics(m *metrics.Metrics) {
+	s.metrics = m
+	s.hub.SetMetrics(m)
+	m.TrackSessions(s.sessionMgr.Count, s.hub.Connections)
+}
+
+// statusRecorder captures the status code a handler writes
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Flush keeps streaming list responses working through the recorder
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// metricsMiddleware records request durations by route template. Sync
+// sockets are long-lived and counted as connections instead. It's only
+// installed when metrics are enabled.
+func (s *Server) metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, err := mux.CurrentRoute(r).GetPathTemplate()
+		if err != nil || strings.HasPrefix(route, "/ws/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		s.metrics.ObserveHTTP(route, r.Method, rec.status, time.Since(start))
+	})
+}
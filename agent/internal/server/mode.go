@@ -0,0 +1,63 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/zeropr/agent/internal/api"
+	"github.com/zeropr/agent/internal/i18n"
+)
+
+// modeBody is the body of GET and POST /api/mode
+type modeBody struct {
+	ReadOnly bool `json:"readOnly"`
+}
+
+// setReadOnly turns read-only mode on or off. While it's on the agent
+// serves no files, and says so in its TXT so peers don't offer to ask it
+// for one; discovery and sessions carry on.
+func (s *Server) setReadOnly(on bool) {
+	if s.readOnly.Swap(on) == on {
+		return
+	}
+	if on {
+		s.discovery.SetTXT("readOnly", "1")
+		s.logger.Info("Read-only mode on; files are no longer served")
+	} else {
+		s.discovery.SetTXT("readOnly", "")
+		s.logger.Info("Read-only mode off")
+	}
+}
+
+// unlessReadOnly refuses requests to h with read_only while read-only mode
+// is on
+func (s *Server) unlessReadOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.readOnly.Load() {
+			s.writeError(w, r, http.StatusForbidden, CodeReadOnly, i18n.MsgReadOnly)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func (s *Server) handleGetMode(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(modeBody{ReadOnly: s.readOnly.Load()})
+}
+
+// handleSetMode switches read-only mode at runtime; it lasts until the
+// agent restarts, which goes back to --read-only
+func (s *Server) handleSetMode(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ReadOnly *bool `json:"readOnly"`
+	}
+	if err := api.DecodeLocal(r.Body, &req); err != nil || req.ReadOnly == nil {
+		s.writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, i18n.MsgInvalidRequest)
+		return
+	}
+	s.setReadOnly(*req.ReadOnly)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(modeBody{ReadOnly: s.readOnly.Load()})
+}
@@ -0,0 +1,23 @@
+package server
+
+import "strings"
+
+// allowedOrigins indexes the browser origins allowed to call the API and
+// open sync sockets; "*" allows any. Requests without an Origin header,
+// such as those from the editor extension, are always allowed.
+func allowedOrigins(origins []string) map[string]bool {
+	allowed := make(map[string]bool, len(origins))
+	for _, origin := range origins {
+		allowed[strings.ToLower(strings.TrimSuffix(origin, "/"))] = true
+	}
+	return allowed
+}
+
+// originAllowed reports whether a request's Origin header is acceptable
+func (s *Server) originAllowed(origin string) bool {
+	if origin == "" {
+		return true
+	}
+	origins := s.settings.Load().origins
+	return origins["*"] || origins[strings.ToLower(origin)]
+}
@@ -0,0 +1,295 @@
+package server
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/zeropr/agent/internal/api"
+	"github.com/zeropr/agent/internal/crypto"
+	"github.com/zeropr/agent/internal/i18n"
+	"github.com/zeropr/agent/internal/metrics"
+	"github.com/zeropr/agent/internal/peerclient"
+)
+
+// callerPeer is the verified identity of an agent that signed a request
+type callerPeer struct {
+	Key         ed25519.PublicKey
+	Fingerprint string
+	Trusted     bool
+	Provenance  *crypto.Provenance // how trust was granted, when trusted
+}
+
+// SetPeerIdentity enables signed agent-to-agent requests. Outbound calls go
+// through client, and inbound signatures are checked against trust, as are
+// certificates trusted peers attest when theirs no longer match the pin.
+func (s *Server) SetPeerIdentity(identity *crypto.Identity, trust *crypto.TrustStore, client *peerclient.Client) {
+	s.identity = identity
+	s.trust = trust
+	s.peerClient = client
+	client.SetReachabilityWatcher(s.notePeerReachability)
+	if trust != nil {
+		client.SetRepinner(s.repinPeer)
+	}
+}
+
+// peerFromContext returns the verified calling agent, if the request was signed
+func peerFromContext(ctx context.Context) (*callerPeer, bool) {
+	caller, ok := ctx.Value(peerContextKey).(*callerPeer)
+	return caller, ok
+}
+
+// peerRoute reports whether path serves other agents rather than local clients
+func peerRoute(path string) bool {
+	return path == "/api/file/get" || path == "/api/file/raw" || path == "/api/session/join" ||
+		path == "/api/debug/divergence-segment"
+}
+
+// peerAuthMiddleware verifies signed agent-to-agent requests. Unsigned
+// requests pass through to token auth, except that file endpoints only
+// answer remote callers that signed with a trusted key.
+func (s *Server) peerAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, err := s.verifier.Verify(r)
+		switch {
+		case err == crypto.ErrUnsigned:
+		case err != nil:
+			s.logger.Warn("Rejected signed request", "remote", r.RemoteAddr, "path", r.URL.Path, "err", err)
+			s.writeErrorFor(w, r, http.StatusUnauthorized, CodeInvalidSignature, err)
+			return
+		default:
+			caller := &callerPeer{
+				Key:         key,
+				Fingerprint: crypto.Fingerprint(key),
+				Trusted:     s.trust.IsTrusted(key),
+			}
+			if entry, ok := s.trust.Get(caller.Fingerprint); ok && caller.Trusted {
+				caller.Provenance = entry.Provenance
+			}
+			r = r.WithContext(context.WithValue(r.Context(), peerContextKey, caller))
+		}
+
+		if peerRoute(r.URL.Path) && !isLoopback(r.RemoteAddr) {
+			caller, ok := peerFromContext(r.Context())
+			if !ok || !caller.Trusted {
+				s.countFileDenied(r)
+				s.writeError(w, r, http.StatusForbidden, CodeUntrustedPeer, i18n.MsgUntrustedPeer)
+				return
+			}
+			if err := s.settings.Load().policy.Allow(caller.Provenance, crypto.CapabilityFiles); err != nil {
+				s.countFileDenied(r)
+				s.writeErrorFor(w, r, http.StatusForbidden, CodeCapabilityDenied, err)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// countFileDenied records a refused file request; session joins share the
+// peer checks but aren't file requests
+func (s *Server) countFileDenied(r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/api/file/") {
+		s.metrics.FileRequest(metrics.FileDenied)
+	}
+}
+
+// isLoopback reports whether a request's remote address is on this machine
+func isLoopback(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	return ip != nil && ip.IsLoopback()
+}
+
+// Trust management handlers
+
+func (s *Server) handleListTrust(w http.ResponseWriter, r *http.Request) {
+	if s.trust == nil {
+		s.writeError(w, r, http.StatusNotFound, CodeFeatureDisabled, i18n.MsgIdentityDisabled)
+		return
+	}
+
+	writeList(s, w, r, trustList.with(map[string]interface{}{
+		"fingerprint": s.identity.Fingerprint(),
+	}), s.trust.List())
+}
+
+func (s *Server) handleTrustPeer(w http.ResponseWriter, r *http.Request) {
+	if s.trust == nil {
+		s.writeError(w, r, http.StatusNotFound, CodeFeatureDisabled, i18n.MsgIdentityDisabled)
+		return
+	}
+
+	// A pairing code verifies the key; without one it's accepted on first use
+	var req struct {
+		PairingCode string `json:"pairingCode"`
+	}
+	if r.ContentLength != 0 {
+		if err := api.DecodeLocal(r.Body, &req); err != nil {
+			s.writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, i18n.MsgInvalidRequest)
+			return
+		}
+	}
+
+	peer, ok := s.lookupPeer(w, r, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+	key, err := crypto.DecodeKey(peer.PublicKey)
+	if err != nil {
+		s.writeError(w, r, http.StatusConflict, CodePeerNoKey, i18n.MsgPeerNoKey)
+		return
+	}
+
+	provenance := crypto.Provenance{Method: crypto.ProvenanceTOFU, Artifacts: []string{peer.Fingerprint}}
+	if req.PairingCode != "" {
+		if !crypto.CheckPairingCode(req.PairingCode, s.identity.PublicKey, key) {
+			s.writeError(w, r, http.StatusForbidden, CodePairingMismatch, i18n.MsgPairingMismatch)
+			return
+		}
+		provenance = crypto.Provenance{Method: crypto.ProvenancePairingCode, Artifacts: s.pairingArtifacts(peer.Fingerprint)}
+	}
+
+	entry, err := s.trust.Trust(key, peer.Name, provenance)
+	if err != nil {
+		s.writeErrorFor(w, r, http.StatusInternalServerError, CodeInternal, err)
+		return
+	}
+	s.registry.SetTrusted(entry.Fingerprint, true)
+	s.logger.Info("Trusted peer", "peerId", peer.ID, "peer", peer.Name, "fingerprint", entry.Fingerprint, "method", provenance.Method)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entry)
+}
+
+func (s *Server) handleUntrustPeer(w http.ResponseWriter, r *http.Request) {
+	if s.trust == nil {
+		s.writeError(w, r, http.StatusNotFound, CodeFeatureDisabled, i18n.MsgIdentityDisabled)
+		return
+	}
+
+	peer, ok := s.lookupPeer(w, r, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+
+	revoked, err := s.trust.Revoke(peer.Fingerprint)
+	if err != nil {
+		s.writeErrorFor(w, r, http.StatusInternalServerError, CodeInternal, err)
+		return
+	}
+	if !revoked {
+		s.writeError(w, r, http.StatusNotFound, CodePeerNotTrusted, i18n.MsgPeerNotTrusted)
+		return
+	}
+	s.registry.SetTrusted(peer.Fingerprint, false)
+	s.logger.Info("Revoked trust for peer", "peerId", peer.ID, "peer", peer.Name, "fingerprint", peer.Fingerprint)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "revoked"})
+}
+
+// EventTrustReconciled is published with a crypto.ReconcileSummary after each pass
+const EventTrustReconciled = "trust.reconciled"
+
+// ReconcileTrust checks the trust store against the keys live peers present
+// and the given revoked fingerprints, quarantining conflicting entries
+func (s *Server) ReconcileTrust(revoked []string) (crypto.ReconcileSummary, error) {
+	var claims []crypto.Claim
+	for _, peer := range s.registry.GetAll() {
+		if peer.Fingerprint != "" {
+			claims = append(claims, crypto.Claim{Name: peer.Name, Fingerprint: peer.Fingerprint})
+		}
+	}
+	revokedSet := make(map[string]bool, len(revoked))
+	for _, fp := range revoked {
+		revokedSet[strings.ToLower(fp)] = true
+	}
+
+	summary, err := s.trust.Reconcile(claims, revokedSet)
+	for _, fp := range summary.Flagged {
+		s.registry.SetTrusted(fp, false)
+	}
+	if err != nil {
+		return summary, err
+	}
+
+	if summary.Conflicts > 0 {
+		s.logger.Warn("Trust reconciliation quarantined entries", "conflicts", summary.Conflicts, "quarantined", summary.Quarantined)
+	}
+	s.bus.Publish(EventTrustReconciled, summary)
+	return summary, nil
+}
+
+func (s *Server) handleReconcileTrust(w http.ResponseWriter, r *http.Request) {
+	if s.trust == nil {
+		s.writeError(w, r, http.StatusNotFound, CodeFeatureDisabled, i18n.MsgIdentityDisabled)
+		return
+	}
+
+	// Fingerprints the team manifest revokes; the body is optional
+	var req struct {
+		Revoked []string `json:"revoked"`
+	}
+	if r.ContentLength != 0 {
+		if err := api.DecodeLocal(r.Body, &req); err != nil {
+			s.writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, i18n.MsgInvalidRequest)
+			return
+		}
+	}
+
+	summary, err := s.ReconcileTrust(req.Revoked)
+	if err != nil {
+		s.writeErrorFor(w, r, http.StatusInternalServerError, CodeInternal, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summary)
+}
+
+func (s *Server) handleResolveTrust(w http.ResponseWriter, r *http.Request) {
+	if s.trust == nil {
+		s.writeError(w, r, http.StatusNotFound, CodeFeatureDisabled, i18n.MsgIdentityDisabled)
+		return
+	}
+
+	var req struct {
+		Decision string `json:"decision"`
+	}
+	if err := api.DecodeLocal(r.Body, &req); err != nil || (req.Decision != "keep" && req.Decision != "revoke") {
+		s.writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, i18n.MsgInvalidDecision)
+		return
+	}
+
+	fingerprint := mux.Vars(r)["fingerprint"]
+	entry, err := s.trust.Resolve(fingerprint, req.Decision == "keep")
+	switch {
+	case err == crypto.ErrUnknownTrust:
+		s.writeErrorFor(w, r, http.StatusNotFound, CodePeerNotTrusted, err)
+		return
+	case err != nil:
+		s.writeErrorFor(w, r, http.StatusConflict, CodeTrustConflict, err)
+		return
+	}
+	s.registry.SetTrusted(fingerprint, entry != nil)
+	s.logger.Info("Resolved quarantined trust entry", "fingerprint", fingerprint, "decision", req.Decision)
+
+	status := "kept"
+	if entry == nil {
+		status = "revoked"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": status,
+		"entry":  entry,
+	})
+}
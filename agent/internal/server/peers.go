@@ -0,0 +1,282 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/zeropr/agent/internal/api"
+	"github.com/zeropr/agent/internal/crypto"
+	"github.com/zeropr/agent/internal/i18n"
+	"github.com/zeropr/agent/internal/peerclient"
+	"github.com/zeropr/agent/internal/peers"
+)
+
+// probeTimeout bounds the reachability check for manually added peers
+const probeTimeout = 3 * time.Second
+
+// offlineNoticeTimeout bounds telling peers we're shutting down, which
+// comes out of the shutdown deadline
+const offlineNoticeTimeout = time.Second
+
+// maxAliasLength bounds local peer labels
+const maxAliasLength = 64
+
+// peerDetail is a single peer plus fields computed at request time
+type peerDetail struct {
+	*peers.Peer
+	Online          bool               `json:"online"`
+	LastSeenSeconds int64              `json:"lastSeenSeconds"`
+	Trust           *crypto.TrustEntry `json:"trust,omitempty"` // including how trust was granted
+}
+
+// lookupPeer resolves ref, a peer's ID, fingerprint, or short ID (or a
+// prefix of one), writing an error response if it names no peer or more
+// than one
+func (s *Server) lookupPeer(w http.ResponseWriter, r *http.Request, ref string) (*peers.Peer, bool) {
+	peer, err := s.registry.Resolve(ref)
+	if err != nil {
+		var ambiguous *peers.AmbiguousError
+		if errors.As(err, &ambiguous) {
+			s.writeError(w, r, http.StatusConflict, CodeAmbiguousPeer, i18n.MsgAmbiguousPeer, ref, strings.Join(ambiguous.Candidates, ", "))
+			return nil, false
+		}
+		s.writeError(w, r, http.StatusNotFound, CodePeerNotFound, i18n.MsgPeerNotFound)
+		return nil, false
+	}
+	return peer, true
+}
+
+func (s *Server) handleGetPeer(w http.ResponseWriter, r *http.Request) {
+	peer, ok := s.lookupPeer(w, r, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+
+	sinceSeen := time.Since(peer.LastSeen)
+	w.Header().Set("Content-Type", "application/json")
+	detail := peerDetail{
+		Peer:            peer,
+		Online:          sinceSeen < peers.TTL && peer.ConnectionState != peers.StateOffline,
+		LastSeenSeconds: int64(sinceSeen.Seconds()),
+	}
+	if entry, ok := s.trust.Get(peer.Fingerprint); ok {
+		detail.Trust = entry
+	}
+	json.NewEncoder(w).Encode(detail)
+}
+
+// handleGetPeerHistory lists the presences a peer advertised recently,
+// newest first
+func (s *Server) handleGetPeerHistory(w http.ResponseWriter, r *http.Request) {
+	peer, ok := s.lookupPeer(w, r, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+	history, ok := s.registry.History(peer.ID)
+	if !ok {
+		s.writeError(w, r, http.StatusNotFound, CodePeerNotFound, i18n.MsgPeerNotFound)
+		return
+	}
+
+	writeList(s, w, r, peerHistoryList.with(map[string]interface{}{
+		"peerId": peer.ID,
+	}), history)
+}
+
+func (s *Server) handleAddPeer(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Address         string `json:"address"`
+		Port            int    `json:"port"`
+		Name            string `json:"name"`
+		TLS             bool   `json:"tls"`
+		CertFingerprint string `json:"certFingerprint"`
+	}
+	if err := api.DecodeLocal(r.Body, &req); err != nil {
+		s.writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, i18n.MsgInvalidRequest)
+		return
+	}
+
+	host, port, err := parseHostPort(req.Address, req.Port)
+	if err != nil {
+		s.writeErrorFor(w, r, http.StatusBadRequest, CodeInvalidRequest, err)
+		return
+	}
+
+	// Probe before adding so we never list an address nobody answers on
+	ctx, cancel := context.WithTimeout(r.Context(), probeTimeout)
+	defer cancel()
+	target := peerclient.Target{
+		Host:            host,
+		Port:            port,
+		TLS:             req.TLS,
+		CertFingerprint: strings.ToLower(strings.TrimSpace(req.CertFingerprint)),
+	}
+	status, _, err := s.peerClient.Status(ctx, target)
+	if err != nil {
+		s.writeError(w, r, http.StatusBadGateway, CodePeerUnreachable, i18n.MsgPeerUnreachable, err)
+		return
+	}
+
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		name = net.JoinHostPort(host, strconv.Itoa(port))
+	}
+
+	now := time.Now()
+	peer := &peers.Peer{
+		ID:              fmt.Sprintf("%s@%s:%d", name, host, port),
+		Name:            name,
+		Address:         host,
+		Port:            port,
+		TLS:             target.TLS,
+		CertFingerprint: target.CertFingerprint,
+		Status:          "idle",
+		LastHealthy:     &now,
+		Manual:          true,
+	}
+	if key, err := crypto.DecodeKey(status.PublicKey); err == nil {
+		peer.PublicKey = crypto.EncodeKey(key)
+		peer.Fingerprint = crypto.Fingerprint(key)
+		peer.Trusted = s.trust.IsTrusted(key)
+	}
+	peer.SetCompatibility(status.ProtocolVersion, status.Version, status.MinCompatible)
+	if !s.registry.Add(peer) {
+		s.writeError(w, r, http.StatusForbidden, CodePeerBlocked, i18n.MsgPeerBlocked, s.registry.Filter().Mode())
+		return
+	}
+	s.logger.Info("Added manual peer", "peerId", peer.ID, "peer", peer.Name, "addr", net.JoinHostPort(host, strconv.Itoa(port)))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(peer)
+}
+
+func (s *Server) handleDeletePeer(w http.ResponseWriter, r *http.Request) {
+	peer, ok := s.lookupPeer(w, r, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+	id := peer.ID
+
+	if !s.registry.Remove(id) {
+		s.writeError(w, r, http.StatusNotFound, CodePeerNotFound, i18n.MsgPeerNotFound)
+		return
+	}
+	s.logger.Info("Removed peer", "peerId", id)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "removed"})
+}
+
+func (s *Server) handlePatchPeer(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Alias *string `json:"alias"`
+	}
+	if err := api.DecodeLocal(r.Body, &req); err != nil || req.Alias == nil {
+		s.writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, i18n.MsgInvalidRequest)
+		return
+	}
+
+	alias := strings.TrimSpace(*req.Alias)
+	if len(alias) > maxAliasLength {
+		s.writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, i18n.MsgAliasTooLong, maxAliasLength)
+		return
+	}
+
+	target, ok := s.lookupPeer(w, r, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+	peer, ok, err := s.registry.SetAlias(target.ID, alias)
+	if !ok {
+		s.writeError(w, r, http.StatusNotFound, CodePeerNotFound, i18n.MsgPeerNotFound)
+		return
+	}
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, CodeInternal, i18n.MsgAliasSaveFailed, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(peer)
+}
+
+// parseHostPort accepts either "host:port" or a bare host plus a port field
+// handlePeerOffline drops an agent that says it's shutting down. Only the
+// signer's own entries are touched, so any signed agent may call it.
+func (s *Server) handlePeerOffline(w http.ResponseWriter, r *http.Request) {
+	caller, ok := peerFromContext(r.Context())
+	if !ok {
+		s.writeErrorFor(w, r, http.StatusUnauthorized, CodeInvalidSignature, crypto.ErrUnsigned)
+		return
+	}
+
+	changed := s.registry.Depart(caller.Fingerprint)
+	s.logger.Info("Peer went offline", "fingerprint", caller.Fingerprint, "peers", changed)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"removed": changed})
+}
+
+// notePeerReachability is the peer client's ReachabilityWatcher: it marks
+// the peers at target's address unreachable, or reachable again, so
+// clients can grey out the ones still announced but no longer answering
+func (s *Server) notePeerReachability(target peerclient.Target, reach peers.Reachability) {
+	s.registry.RecordReachability(target.Host, target.Port, reach)
+}
+
+// announceOffline tells every peer we might still be listed by that we're
+// shutting down, giving up on any that don't answer within
+// offlineNoticeTimeout
+func (s *Server) announceOffline(ctx context.Context) {
+	if s.peerClient == nil || s.identity == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, offlineNoticeTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, peer := range s.registry.GetAll() {
+		if peer.ConnectionState == peers.StateOffline {
+			continue
+		}
+		wg.Add(1)
+		go func(peer *peers.Peer) {
+			defer wg.Done()
+			if err := s.peerClient.Offline(ctx, peerclient.TargetOf(peer)); err != nil {
+				s.logger.Debug("Failed to tell peer we're going offline", "peerId", peer.ID, "err", err)
+			}
+		}(peer)
+	}
+	wg.Wait()
+}
+
+func parseHostPort(address string, port int) (string, int, error) {
+	address = strings.TrimSpace(address)
+	if address == "" {
+		return "", 0, fmt.Errorf("address is required")
+	}
+
+	host := address
+	if h, p, err := net.SplitHostPort(address); err == nil {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return "", 0, fmt.Errorf("invalid port %q", p)
+		}
+		host, port = h, n
+	}
+
+	if port <= 0 || port > 65535 {
+		return "", 0, fmt.Errorf("a port between 1 and 65535 is required")
+	}
+	return host, port, nil
+}
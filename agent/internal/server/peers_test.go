@@ -0,0 +1,86 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/zeropr/agent/internal/peers"
+)
+
+func TestShutdownTellsPeers(t *testing.T) {
+	host, guest := newPairedAgents(t)
+	guest.lists(t, "host-lan", host) // listed twice, as over two networks
+
+	host.srv.announceOffline(context.Background())
+	if n := guest.registry.Count(); n != 0 {
+		t.Errorf("the guest still lists %d peers after the host went offline", n)
+	}
+	if guest.registry.Add(&peers.Peer{ID: "host", Name: "host", Fingerprint: host.identity.Fingerprint()}) {
+		t.Error("a stale announcement brought the host back")
+	}
+	if _, ok := host.registry.Get("guest"); !ok {
+		t.Error("going offline dropped the host's own listing of the guest")
+	}
+}
+
+func TestPeerOfflineNeedsSignature(t *testing.T) {
+	_, guest := newPairedAgents(t)
+	resp, err := http.Post(guest.peers.URL+"/api/peer/offline", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("unsigned offline notice: %d", resp.StatusCode)
+	}
+	if _, ok := guest.registry.Get("host"); !ok {
+		t.Error("an unsigned notice dropped a peer")
+	}
+}
+
+func TestPeerPathsTakeShortIDs(t *testing.T) {
+	a := newTestAgent(t)
+	// Keys sharing their first 24 bits share the first four characters of
+	// their short IDs
+	alice := &peers.Peer{ID: "Sam's MacBook@192.168.1.40:8080", Name: "Sam's MacBook", Fingerprint: "00000000" + strings.Repeat("a", 56)}
+	bob := &peers.Peer{ID: "bob@192.168.1.41:8080", Name: "bob", Fingerprint: "00000080" + strings.Repeat("b", 56)}
+	a.registry.Add(alice)
+	a.registry.Add(bob)
+
+	var got peers.Peer
+	for _, ref := range []string{alice.ShortID, alice.ShortID[:5], alice.Fingerprint} {
+		if code, body := a.do(t, http.MethodGet, "/api/peers/"+ref, "", &got); code != http.StatusOK || got.ID != alice.ID {
+			t.Errorf("GET /api/peers/%s: %d %s", ref, code, body)
+		}
+	}
+	code, body := a.do(t, http.MethodDelete, "/api/peers/"+alice.ShortID[:4], "", nil)
+	if code != http.StatusConflict || errorCode(body) != CodeAmbiguousPeer || !strings.Contains(string(body), bob.ShortID) {
+		t.Errorf("DELETE by a shared prefix: %d %s", code, body)
+	}
+	if code, body := a.do(t, http.MethodDelete, "/api/peers/"+bob.ShortID, "", nil); code >= 300 {
+		t.Errorf("DELETE by short ID: %d %s", code, body)
+	}
+	if _, ok := a.registry.Get(bob.ID); ok {
+		t.Error("bob is still listed")
+	}
+}
+
+func TestMockPeerNeedsDebug(t *testing.T) {
+	a := newTestAgent(t)
+	if status, _ := a.do(t, "POST", "/api/debug/add-mock-peer", "", nil); status != http.StatusNotFound {
+		t.Errorf("adding a mock peer without -debug: %d", status)
+	}
+	if len(a.registry.GetAll()) != 0 {
+		t.Error("a mock peer was listed without -debug")
+	}
+
+	a = newTestAgent(t, "-debug")
+	if status, body := a.do(t, "POST", "/api/debug/add-mock-peer", "", nil); status != http.StatusOK {
+		t.Fatalf("adding a mock peer with -debug: %d %s", status, body)
+	}
+	if _, ok := a.registry.Get("mock-peer-1"); !ok {
+		t.Error("the mock peer wasn't listed")
+	}
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/zeropr/agent/internal/api"
+	"github.com/zeropr/agent/internal/crypto"
+	"github.com/zeropr/agent/internal/i18n"
+	"github.com/zeropr/agent/internal/peerclient"
+	"github.com/zeropr/agent/internal/peers"
+)
+
+// EventPinRotated is published with a PinRotated when a trusted peer's
+// certificate pin moves to a certificate the peer attested
+const EventPinRotated = "trust.pin_rotated"
+
+// PinRotated describes a peer's certificate pin being replaced
+type PinRotated struct {
+	Fingerprint string `json:"fingerprint"` // the peer's identity key
+	Name        string `json:"name"`
+	crypto.PinRotation
+}
+
+// handleCertAttestation serves this agent's TLS certificate signed by its
+// identity key, so peers that pinned an earlier certificate can move their
+// pin. It's signed afresh from whatever certificate is being served, so a
+// regenerated certificate is attested without anyone stepping in.
+func (s *Server) handleCertAttestation(w http.ResponseWriter, r *http.Request) {
+	if s.tlsConfig == nil || len(s.tlsConfig.Certificates) == 0 {
+		s.writeError(w, r, http.StatusNotFound, CodeFeatureDisabled, i18n.MsgTLSDisabled)
+		return
+	}
+	if s.identity == nil {
+		s.writeError(w, r, http.StatusNotFound, CodeFeatureDisabled, i18n.MsgIdentityDisabled)
+		return
+	}
+
+	der := s.tlsConfig.Certificates[0].Certificate[0]
+	signature, err := s.identity.AttestCertificate(der)
+	if err != nil {
+		s.writeErrorFor(w, r, http.StatusInternalServerError, CodeInternal, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(api.CertAttestation{
+		Header:      api.Current,
+		Certificate: der,
+		Signature:   signature,
+	})
+}
+
+// repinPeer is the peer client's Repinner: it accepts a new certificate
+// only from a peer whose key is trusted, records the rotation on its trust
+// entry, and moves every listed peer with that key and the old pin over
+func (s *Server) repinPeer(target peerclient.Target, from, to crypto.CertPin) bool {
+	addr := net.JoinHostPort(target.Host, strconv.Itoa(target.Port))
+	key, err := crypto.DecodeKey(target.PublicKey)
+	if err != nil || !s.trust.IsTrusted(key) {
+		s.logger.Warn("Untrusted peer attested a new certificate", "addr", addr, "certFingerprint", to.Fingerprint)
+		return false
+	}
+
+	keyFingerprint := crypto.Fingerprint(key)
+	rotation, err := s.trust.RecordPinRotation(keyFingerprint, from, to)
+	if err != nil {
+		s.logger.Warn("Refused peer certificate rotation", "addr", addr, "fingerprint", keyFingerprint, "certFingerprint", to.Fingerprint, "err", err)
+		return false
+	}
+
+	for _, peer := range s.registry.GetAll() {
+		if peer.Fingerprint == keyFingerprint && peer.CertFingerprint == from.Fingerprint {
+			s.registry.Update(peer.ID, func(p *peers.Peer) {
+				p.CertFingerprint = to.Fingerprint
+			})
+		}
+	}
+
+	event := PinRotated{Fingerprint: keyFingerprint, PinRotation: *rotation}
+	if entry, ok := s.trust.Get(keyFingerprint); ok {
+		event.Name = entry.Name
+	}
+	s.logger.Info("Peer certificate rotated", "addr", addr, "peer", event.Name, "fingerprint", keyFingerprint, "from", rotation.From, "to", rotation.To)
+	s.bus.Publish(EventPinRotated, event)
+	return true
+}
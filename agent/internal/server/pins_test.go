@@ -0,0 +1,118 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/zeropr/agent/internal/api"
+	"github.com/zeropr/agent/internal/crypto"
+	"github.com/zeropr/agent/internal/peerclient"
+	"github.com/zeropr/agent/internal/peers"
+)
+
+// newCert returns a fresh certificate for identity's key, as a reinstall
+// would generate, and its pin
+func newCert(t *testing.T, identity *crypto.Identity) ([]byte, crypto.CertPin) {
+	t.Helper()
+	cert, fingerprint, err := identity.LoadOrCreateCertificate(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der := cert.Certificate[0]
+	spki, err := crypto.SPKIFingerprint(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der, crypto.CertPin{Fingerprint: fingerprint, SPKI: spki}
+}
+
+func TestCertAttestation(t *testing.T) {
+	host, _ := newPairedAgents(t)
+	get := func() (int, api.CertAttestation, string) {
+		resp, err := http.Get(host.peers.URL + peerclient.AttestationPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var body struct {
+			api.CertAttestation
+			Code string `json:"code"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		return resp.StatusCode, body.CertAttestation, body.Code
+	}
+	if status, _, code := get(); status != http.StatusNotFound || code != CodeFeatureDisabled {
+		t.Errorf("attestation without TLS: %d %s", status, code)
+	}
+
+	// Whatever certificate is served is what gets attested
+	cert, fingerprint, err := host.identity.LoadOrCreateCertificate(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host.srv.SetTLS(cert, fingerprint)
+	status, attestation, _ := get()
+	if status != http.StatusOK {
+		t.Fatalf("attestation: %d", status)
+	}
+	attested, err := crypto.VerifyAttestation(host.identity.PublicKey, cert.Certificate[0], attestation.Certificate, attestation.Signature)
+	if err != nil || attested.Fingerprint != fingerprint {
+		t.Errorf("the served attestation: %+v, %v", attested, err)
+	}
+}
+
+func TestRepinPeer(t *testing.T) {
+	host, guest := newPairedAgents(t)
+	_, old := newCert(t, host.identity)
+	_, renewed := newCert(t, host.identity)
+	guest.registry.Update("host", func(p *peers.Peer) { p.CertFingerprint = old.Fingerprint })
+	rotated, cancel := guest.bus.Subscribe("pins", 4)
+	defer cancel()
+
+	target := peerclient.Target{Host: "192.0.2.7", Port: 7000, TLS: true, CertFingerprint: old.Fingerprint, PublicKey: crypto.EncodeKey(host.identity.PublicKey)}
+	if !guest.srv.repinPeer(target, old, renewed) {
+		t.Fatal("a trusted peer's attested certificate was refused")
+	}
+	if peer, _ := guest.registry.Get("host"); peer.CertFingerprint != renewed.Fingerprint {
+		t.Errorf("the listed peer is pinned to %s", peer.CertFingerprint)
+	}
+	if entry, _ := guest.trust.Get(host.identity.Fingerprint()); len(entry.PinRotations) != 1 || entry.PinRotations[0].From != old.Fingerprint {
+		t.Errorf("trust entry rotations %+v", entry.PinRotations)
+	}
+	// The peer updates are published too; the rotation follows them
+	for published := false; !published; {
+		select {
+		case e := <-rotated:
+			if e.Type != EventPinRotated {
+				continue
+			}
+			published = true
+			if event, ok := e.Data.(PinRotated); !ok || event.Name != "host" || event.To != renewed.Fingerprint {
+				t.Errorf("published %+v", e.Data)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("no pin rotation event")
+		}
+	}
+
+	// Someone holding the old certificate can't move the pin back, and a
+	// key no one trusts can't move it at all
+	target.CertFingerprint = renewed.Fingerprint
+	if guest.srv.repinPeer(target, renewed, old) {
+		t.Error("the pin moved back to a retired certificate")
+	}
+	stranger, err := crypto.LoadOrCreateIdentity(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, theirs := newCert(t, stranger)
+	target.PublicKey = crypto.EncodeKey(stranger.PublicKey)
+	if guest.srv.repinPeer(target, renewed, theirs) {
+		t.Error("an untrusted key moved a pin")
+	}
+	if peer, _ := guest.registry.Get("host"); peer.CertFingerprint != renewed.Fingerprint {
+		t.Errorf("after refused rotations the peer is pinned to %s", peer.CertFingerprint)
+	}
+}
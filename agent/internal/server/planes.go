@@ -0,0 +1,245 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zeropr/agent/internal/api"
+	"github.com/zeropr/agent/internal/i18n"
+	"github.com/zeropr/agent/internal/sessions"
+	"github.com/zeropr/agent/internal/storage"
+)
+
+const planesKey = "planes"
+
+// EventBroadcastChanged is published with the broadcast status when the
+// agent starts or stops advertising
+const EventBroadcastChanged = "broadcast.changed"
+
+// Planes are the parts of the agent that can be switched off on their own,
+// so someone can stop being interruptible and still see the team
+type Planes struct {
+	Observe   bool `json:"observe"`   // browse for peers and list them
+	Advertise bool `json:"advertise"` // announce this agent over mDNS
+	Serve     bool `json:"serve"`     // serve files, sessions, and sync sockets to peers
+}
+
+// defaultPlanes apply until a switch is first flipped: the agent observes
+// and serves, and advertises once asked to
+var defaultPlanes = Planes{Observe: true, Serve: true}
+
+// planeState is the switches as applied, with the drain that follows
+// turning serving off
+type planeState struct {
+	planes        Planes
+	store         storage.Collection // nil keeps the switches in memory only
+	off           atomic.Bool        // the serve plane is off; read on every gated request
+	drain         *time.Timer        // closes live sockets once the grace is up
+	drainingUntil time.Time
+	mu            sync.Mutex
+}
+
+// planesStatus is the body of GET and PUT /api/planes
+type planesStatus struct {
+	Planes
+	DrainingUntil *time.Time `json:"drainingUntil,omitempty"` // when live sessions are closed, while draining
+}
+
+// SetPlaneStore loads the plane switches saved in store, or the defaults,
+// and applies them; switches flipped from now on are saved there. Call it
+// after SetTLS so the first announcement is complete.
+func (s *Server) SetPlaneStore(store storage.Collection) error {
+	planes := defaultPlanes
+	data, err := store.Get(planesKey)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &planes); err != nil {
+			return err
+		}
+	case err != storage.ErrNotFound:
+		return err
+	}
+
+	s.planes.mu.Lock()
+	defer s.planes.mu.Unlock()
+	s.planes.store = store
+	if err := s.applyPlanesLocked(planes); err != nil {
+		s.logger.Warn("Failed to resume advertising", "err", err)
+	}
+	s.logger.Info("Planes switched", "observe", s.planes.planes.Observe, "advertise", s.planes.planes.Advertise, "serve", s.planes.planes.Serve)
+	return nil
+}
+
+// updatePlanes flips switches with change, applies the result, and saves
+// it. The returned error is from starting the broadcast, in which case
+// advertise stays off; the other switches apply regardless.
+func (s *Server) updatePlanes(change func(*Planes)) (planesStatus, error) {
+	s.planes.mu.Lock()
+	defer s.planes.mu.Unlock()
+
+	advertising := s.planes.planes.Advertise
+	next := s.planes.planes
+	change(&next)
+	err := s.applyPlanesLocked(next)
+	if s.planes.planes.Advertise != advertising {
+		s.bus.Publish(EventBroadcastChanged, s.discovery.BroadcastStatus())
+	}
+	if s.planes.store != nil {
+		data, _ := json.Marshal(s.planes.planes)
+		if saveErr := s.planes.store.Put(planesKey, data); saveErr != nil {
+			s.logger.Warn("Failed to save the plane switches; they reset on restart", "err", saveErr)
+		}
+	}
+	return s.planesStatusLocked(), err
+}
+
+// applyPlanesLocked moves every plane to its switch in next; s.planes.mu
+// must be held
+func (s *Server) applyPlanesLocked(next Planes) error {
+	current := &s.planes.planes
+	s.discovery.SetObserving(next.Observe)
+	current.Observe = next.Observe
+
+	if next.Serve != current.Serve {
+		current.Serve = next.Serve
+		s.planes.off.Store(!next.Serve)
+		if next.Serve {
+			s.resumeServingLocked()
+		} else {
+			s.stopServingLocked()
+		}
+	}
+
+	switch {
+	case next.Advertise && !s.discovery.IsBroadcasting():
+		if err := s.discovery.StartBroadcast(); err != nil {
+			current.Advertise = false
+			return err
+		}
+	case !next.Advertise && s.discovery.IsBroadcasting():
+		s.discovery.StopBroadcast()
+	}
+	current.Advertise = next.Advertise
+	return nil
+}
+
+// stopServingLocked tells peers we no longer take invites and gives live
+// sessions the drain grace before their sockets are closed; new joins,
+// file fetches, and sockets are refused from now on
+func (s *Server) stopServingLocked() {
+	s.discovery.SetTXT("serve", "0")
+	live := s.hub.Connections() + s.chat.Connections()
+	if live == 0 {
+		s.logger.Info("Stopped serving")
+		return
+	}
+
+	grace := s.settings.Load().drainGrace
+	s.planes.drainingUntil = time.Now().Add(grace)
+	s.planes.drain = time.AfterFunc(grace, s.closeDrained)
+	s.logger.Info("Stopped serving; draining live sessions", "grace", grace, "connections", live)
+}
+
+// resumeServingLocked cancels a drain in progress and takes invites again
+func (s *Server) resumeServingLocked() {
+	if s.planes.drain != nil {
+		s.planes.drain.Stop()
+		s.planes.drain = nil
+		s.planes.drainingUntil = time.Time{}
+	}
+	s.discovery.SetTXT("serve", "")
+	s.logger.Info("Serving again")
+}
+
+// closeDrained closes the sockets still open when the drain grace is up
+func (s *Server) closeDrained() {
+	s.planes.mu.Lock()
+	defer s.planes.mu.Unlock()
+	if !s.planes.off.Load() || s.planes.drain == nil {
+		return
+	}
+	s.planes.drain = nil
+	s.planes.drainingUntil = time.Time{}
+
+	syncs := s.hub.CloseAll(sessions.CloseNotServing, "serving disabled")
+	chats := s.chat.CloseAll(sessions.CloseNotServing, "serving disabled")
+	s.logger.Info("Drain finished; closed live sessions", "syncConnections", syncs, "chatConnections", chats)
+}
+
+// planesStatusLocked reports the switches; s.planes.mu must be held
+func (s *Server) planesStatusLocked() planesStatus {
+	status := planesStatus{Planes: s.planes.planes}
+	if !s.planes.drainingUntil.IsZero() {
+		until := s.planes.drainingUntil
+		status.DrainingUntil = &until
+	}
+	return status
+}
+
+// whileServing refuses requests to h with serving_disabled while the serve
+// plane is off
+func (s *Server) whileServing(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.planes.off.Load() {
+			s.writeError(w, r, http.StatusServiceUnavailable, CodeServingDisabled, i18n.MsgServingDisabled)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// whileObserving refuses requests to h with observing_disabled while the
+// observe plane is off
+func (s *Server) whileObserving(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.discovery.IsObserving() {
+			s.writeError(w, r, http.StatusServiceUnavailable, CodeObservingDisabled, i18n.MsgObservingDisabled)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func (s *Server) handleGetPlanes(w http.ResponseWriter, r *http.Request) {
+	s.planes.mu.Lock()
+	status := s.planesStatusLocked()
+	s.planes.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// handlePutPlanes flips the switches named in the body, leaving the others
+func (s *Server) handlePutPlanes(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Observe   *bool `json:"observe"`
+		Advertise *bool `json:"advertise"`
+		Serve     *bool `json:"serve"`
+	}
+	if err := api.DecodeLocal(r.Body, &req); err != nil {
+		s.writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, i18n.MsgInvalidRequest)
+		return
+	}
+
+	status, err := s.updatePlanes(func(p *Planes) {
+		if req.Observe != nil {
+			p.Observe = *req.Observe
+		}
+		if req.Advertise != nil {
+			p.Advertise = *req.Advertise
+		}
+		if req.Serve != nil {
+			p.Serve = *req.Serve
+		}
+	})
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, CodeBroadcastFailed, i18n.MsgBroadcastFailed, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/zeropr/agent/internal/sessions"
+)
+
+// putPlanes sets the plane switches, which may start discovery's loops,
+// so they're stopped when the test ends
+func (a *testAgent) putPlanes(t *testing.T, body string) planesStatus {
+	t.Helper()
+	t.Cleanup(a.srv.discovery.Stop)
+	var status planesStatus
+	if code, data := a.do(t, http.MethodPut, "/api/planes", body, &status); code != http.StatusOK {
+		t.Fatalf("PUT /api/planes %s: %d %s", body, code, data)
+	}
+	return status
+}
+
+func TestPlanes(t *testing.T) {
+	for _, observe := range []bool{true, false} {
+		for _, serve := range []bool{true, false} {
+			t.Run(fmt.Sprintf("observe=%v,serve=%v", observe, serve), func(t *testing.T) {
+				a := newTestAgent(t)
+				status := a.putPlanes(t, fmt.Sprintf(`{"observe":%v,"serve":%v}`, observe, serve))
+				if status.Observe != observe || status.Serve != serve || status.Advertise || status.DrainingUntil != nil {
+					t.Errorf("planes %+v", status)
+				}
+
+				code, body := a.do(t, http.MethodGet, "/api/peers", "", nil)
+				if observe && code != http.StatusOK || !observe && errorCode(body) != CodeObservingDisabled {
+					t.Errorf("GET /api/peers: %d %s", code, body)
+				}
+				// Serving off refuses new work, from here and from peers
+				for _, req := range []struct{ method, path, body string }{
+					{http.MethodPost, "/api/session/create", `{"filePath":"main.go","initiator":"alice"}`},
+					{http.MethodGet, "/api/file/get?path=main.go&repo=test", ""},
+				} {
+					code, body := a.do(t, req.method, req.path, req.body, nil)
+					if serve && code >= 300 || !serve && (code != http.StatusServiceUnavailable || errorCode(body) != CodeServingDisabled) {
+						t.Errorf("%s %s: %d %s", req.method, req.path, code, body)
+					}
+				}
+				// and peers are told not to offer invites
+				txt := strings.Join(a.srv.discovery.TXTRecords(), " ")
+				if strings.Contains(txt, "serve=0") == serve {
+					t.Errorf("TXT %s", txt)
+				}
+				// Status and the switches themselves stay reachable
+				var got planesStatus
+				if code, _ := a.do(t, http.MethodGet, "/api/planes", "", &got); code != http.StatusOK || got.Planes != status.Planes {
+					t.Errorf("GET /api/planes: %d %+v", code, got)
+				}
+			})
+		}
+	}
+}
+
+func TestPlanesSaved(t *testing.T) {
+	a := newTestAgent(t)
+	store, err := a.storage(t).Collection("planes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.srv.SetPlaneStore(store); err != nil {
+		t.Fatal(err)
+	}
+	a.putPlanes(t, `{"observe":false}`)
+	a.putPlanes(t, `{"serve":false}`) // leaves observe as it was
+
+	restarted := newTestAgent(t)
+	t.Cleanup(restarted.srv.discovery.Stop)
+	if err := restarted.srv.SetPlaneStore(store); err != nil {
+		t.Fatal(err)
+	}
+	var got planesStatus
+	restarted.do(t, http.MethodGet, "/api/planes", "", &got)
+	if got.Planes != (Planes{}) {
+		t.Errorf("planes after a restart %+v, want all off", got.Planes)
+	}
+	if code, body := restarted.do(t, http.MethodGet, "/api/peers", "", nil); errorCode(body) != CodeObservingDisabled {
+		t.Errorf("GET /api/peers after a restart: %d %s", code, body)
+	}
+}
+
+func TestServeDrain(t *testing.T) {
+	const grace = 300 * time.Millisecond
+	a := newTestAgent(t, "-drain-grace", grace.String())
+	session := a.createSession(t, "alice")
+	bob := a.join(t, session.SessionID, "bob", "")
+	aliceConn, _ := a.dial(t, "/ws/sync/"+session.SessionID+"?sync="+session.SyncToken)
+	bobConn, _ := a.dial(t, "/ws/sync/"+session.SessionID+"?sync="+bob.SyncToken)
+	waitConnected(t, a, session.SessionID, 2)
+
+	start := time.Now()
+	status := a.putPlanes(t, `{"serve":false}`)
+	if status.DrainingUntil == nil || status.DrainingUntil.Before(start) {
+		t.Fatalf("planes %+v, want a drain under way", status)
+	}
+
+	// The live session carries on, but no one new gets in
+	bobConn.WriteMessage(websocket.BinaryMessage, update('b'))
+	relayedUntil(t, aliceConn, 'b')
+	if _, code := a.dial(t, "/ws/sync/"+session.SessionID+"?reconnect="+bob.ReconnectToken); code != http.StatusServiceUnavailable {
+		t.Errorf("a socket opened while draining: %d", code)
+	}
+
+	// Once the grace is up the sockets are closed, saying why
+	aliceConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var closeErr *websocket.CloseError
+	for {
+		_, _, err := aliceConn.ReadMessage()
+		if err != nil {
+			if !errors.As(err, &closeErr) || closeErr.Code != sessions.CloseNotServing {
+				t.Fatalf("socket ended with %v, want close %d", err, sessions.CloseNotServing)
+			}
+			break
+		}
+	}
+	if took := time.Since(start); took < grace {
+		t.Errorf("closed after %v, before the %v grace", took, grace)
+	}
+	var after planesStatus
+	a.do(t, http.MethodGet, "/api/planes", "", &after)
+	if after.DrainingUntil != nil {
+		t.Errorf("still draining %+v", after)
+	}
+
+	// Serving again lets participants back in
+	a.putPlanes(t, `{"serve":true}`)
+	if _, code := a.dial(t, "/ws/sync/"+session.SessionID+"?sync="+session.SyncToken); code != http.StatusSwitchingProtocols {
+		t.Errorf("rejoining once serving again: %d", code)
+	}
+}
+
+func TestServeAgainCancelsDrain(t *testing.T) {
+	const grace = 200 * time.Millisecond
+	a := newTestAgent(t, "-drain-grace", grace.String())
+	session := a.createSession(t, "alice")
+	bob := a.join(t, session.SessionID, "bob", "")
+	aliceConn, _ := a.dial(t, "/ws/sync/"+session.SessionID+"?sync="+session.SyncToken)
+	bobConn, _ := a.dial(t, "/ws/sync/"+session.SessionID+"?sync="+bob.SyncToken)
+	waitConnected(t, a, session.SessionID, 2)
+
+	a.putPlanes(t, `{"serve":false}`)
+	if status := a.putPlanes(t, `{"serve":true}`); status.DrainingUntil != nil {
+		t.Errorf("planes %+v after serving again", status)
+	}
+	time.Sleep(2 * grace)
+	bobConn.WriteMessage(websocket.BinaryMessage, update('b'))
+	relayedUntil(t, aliceConn, 'b')
+}
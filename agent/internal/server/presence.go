@@ -0,0 +1,242 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/zeropr/agent/internal/api"
+	"github.com/zeropr/agent/internal/i18n"
+	"github.com/zeropr/agent/internal/peers"
+)
+
+// Cursor is a position in a file as the editor reports it
+type Cursor struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+// LocalPresence stores this device's presence information
+type LocalPresence struct {
+	ActiveFile     string     `json:"activeFile"`
+	Cursor         *Cursor    `json:"cursor"`
+	SelectionStart *Cursor    `json:"selectionStart,omitempty"` // set with SelectionEnd while text is selected
+	SelectionEnd   *Cursor    `json:"selectionEnd,omitempty"`
+	Status         string     `json:"status"`
+	Until          *time.Time `json:"until,omitempty"`   // with status dnd, when it ends by itself
+	Message        string     `json:"message,omitempty"` // free text beside the status, up to peers.MaxMessage characters
+}
+
+// EventPresenceChanged is published with a LocalPresence each time our
+// presence is propagated to peers, at most once per debounce window and on
+// every automatic move to or from idle. Its status is the advertised one.
+const EventPresenceChanged = "presence.changed"
+
+// statusIdle is the status advertised after a spell of inactivity
+const statusIdle = "idle"
+
+// presenceState is the latest presence the editor posted; handlers read
+// and replace it concurrently
+type presenceState struct {
+	current    LocalPresence // as the editor posted it, status included
+	updatedAt  time.Time     // zero until the first update
+	published  LocalPresence // what peers were last told
+	flush      *time.Timer   // propagates the updates coalesced since the window opened
+	lastActive time.Time     // last presence update or message on a local socket
+	autoIdle   bool          // idle is advertised for inactivity in place of current.Status
+	idleTimer  *time.Timer   // checks for inactivity once the idle period could be up
+	beforeDND  string        // status posted before do-not-disturb, brought back when it expires
+	dndTimer   *time.Timer   // ends a do-not-disturb posted with an until time
+	mu         sync.RWMutex
+	publishMu  sync.Mutex // keeps propagations in order
+}
+
+// presenceStatus is the body of GET /api/presence
+type presenceStatus struct {
+	LocalPresence
+	AdvertisedStatus string     `json:"advertisedStatus"` // idle while inactive outside dnd, else status
+	UpdatedAt        *time.Time `json:"updatedAt"`        // null until the editor first posts presence
+}
+
+// advertisedLocked returns the presence as peers see it; p.mu must be held
+func (p *presenceState) advertisedLocked() LocalPresence {
+	presence := p.current
+	if p.autoIdle && !p.dndLocked() {
+		presence.Status = statusIdle
+	}
+	return presence
+}
+
+// get returns the presence and when it was last updated
+func (p *presenceState) get() presenceStatus {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	status := presenceStatus{LocalPresence: p.current, AdvertisedStatus: p.advertisedLocked().Status}
+	if !p.updatedAt.IsZero() {
+		updatedAt := p.updatedAt
+		status.UpdatedAt = &updatedAt
+	}
+	return status
+}
+
+func (s *Server) handleGetPresence(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.presence.get())
+}
+
+func (s *Server) handleUpdatePresence(w http.ResponseWriter, r *http.Request) {
+	var presence LocalPresence
+	if err := api.DecodeLocal(r.Body, &presence); err != nil {
+		s.writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, i18n.MsgInvalidRequestBody)
+		return
+	}
+	if presence.Status != statusDND {
+		presence.Until = nil
+	} else if presence.Until != nil && !presence.Until.After(time.Now()) {
+		s.writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, i18n.MsgPresenceUntilPast, presence.Until.Format(time.RFC3339))
+		return
+	}
+	message, err := peers.CheckMessage(presence.Message)
+	switch err {
+	case peers.ErrMessageTooLong:
+		s.writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, i18n.MsgStatusMessageLong, peers.MaxMessage)
+		return
+	case peers.ErrMessageControl:
+		s.writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, i18n.MsgStatusMessageControl)
+		return
+	}
+	presence.Message = message
+
+	s.updatePresence(presence)
+	s.logger.Debug("Presence updated", "path", presence.ActiveFile, "status", presence.Status)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "updated"})
+}
+
+// updatePresence replaces the presence, which GET /api/presence shows at
+// once. Peers hear of a status change at once too; any other change opens
+// a debounce window, and what the presence is when it closes goes out as
+// one update, however many arrived in between.
+func (s *Server) updatePresence(presence LocalPresence) {
+	p := &s.presence
+	p.mu.Lock()
+	withheld := p.withheldLocked()
+	if presence.Status == statusDND && !p.dndLocked() {
+		p.beforeDND = p.current.Status
+		if p.beforeDND == "" {
+			p.beforeDND = statusIdle
+		}
+	}
+	p.current = presence
+	p.updatedAt = time.Now().UTC()
+	s.armDNDLocked()
+	if s.activeLocked() {
+		s.logger.Info("Active again; advertising status", "status", presence.Status)
+	}
+	if withheld && !p.withheldLocked() {
+		defer s.cameBack()
+	}
+
+	window := s.settings.Load().presenceDebounce
+	if window > 0 && presence.Status == p.published.Status {
+		if p.flush == nil {
+			p.flush = time.AfterFunc(window, s.propagatePresence)
+		}
+		p.mu.Unlock()
+		return
+	}
+	p.mu.Unlock()
+	s.propagatePresence()
+}
+
+// propagatePresence advertises the current presence in our TXT records and
+// publishes EventPresenceChanged, ending any debounce window
+func (s *Server) propagatePresence() {
+	p := &s.presence
+	p.publishMu.Lock()
+	defer p.publishMu.Unlock()
+
+	p.mu.Lock()
+	if p.flush != nil {
+		p.flush.Stop()
+		p.flush = nil
+	}
+	presence := p.advertisedLocked()
+	p.published = presence
+	p.mu.Unlock()
+
+	s.discovery.SetTXTFields(map[string]string{
+		"activeFile": presence.ActiveFile,
+		"status":     presence.Status,
+		"message":    presence.Message,
+	})
+	s.bus.Publish(EventPresenceChanged, presence)
+}
+
+// noteActivity records that the user is at their editor, as a message on
+// one of its sockets shows, bringing the advertised status back from idle
+func (s *Server) noteActivity() {
+	p := &s.presence
+	p.mu.Lock()
+	withheld := p.withheldLocked()
+	woke := s.activeLocked()
+	back := withheld && !p.withheldLocked()
+	status := p.current.Status
+	p.mu.Unlock()
+	if woke {
+		s.logger.Info("Active again; advertising status", "status", status)
+		s.propagatePresence()
+	}
+	if back {
+		s.cameBack()
+	}
+}
+
+// activeLocked records activity now and arms the idle check, reporting
+// whether that ended an automatic idle; s.presence.mu must be held
+func (s *Server) activeLocked() bool {
+	p := &s.presence
+	p.lastActive = time.Now()
+	woke := p.autoIdle
+	p.autoIdle = false
+	if p.idleTimer == nil {
+		if after := s.settings.Load().idleAfter; after > 0 {
+			p.idleTimer = time.AfterFunc(after, s.checkIdle)
+		}
+	}
+	return woke
+}
+
+// checkIdle advertises idle once nothing has happened for the idle period,
+// or checks again when the period since the last activity is up
+func (s *Server) checkIdle() {
+	p := &s.presence
+	p.mu.Lock()
+	p.idleTimer = nil
+	after := s.settings.Load().idleAfter
+	if after <= 0 || p.autoIdle {
+		p.mu.Unlock()
+		return
+	}
+	if remaining := after - time.Since(p.lastActive); remaining > 0 {
+		p.idleTimer = time.AfterFunc(remaining, s.checkIdle)
+		p.mu.Unlock()
+		return
+	}
+	if p.current.Status == statusIdle {
+		p.mu.Unlock()
+		return
+	}
+	p.autoIdle = true
+	dnd := p.dndLocked()
+	p.mu.Unlock()
+	if dnd {
+		// dnd stays advertised; idle only counts as nobody at the keyboard
+		return
+	}
+
+	s.logger.Info("Inactive; advertising status idle", "after", after)
+	s.propagatePresence()
+}
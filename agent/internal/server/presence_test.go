@@ -0,0 +1,160 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zeropr/agent/internal/events"
+)
+
+const postedPresence = `{"activeFile":"main.go","cursor":{"line":10,"column":4},"selectionStart":{"line":10,"column":4},"selectionEnd":{"line":12,"column":0},"status":"editing"}`
+
+func TestCursorRoundTrip(t *testing.T) {
+	var presence LocalPresence
+	if err := json.Unmarshal([]byte(postedPresence), &presence); err != nil {
+		t.Fatal(err)
+	}
+	if presence.Cursor == nil || *presence.Cursor != (Cursor{Line: 10, Column: 4}) || presence.SelectionEnd == nil || presence.SelectionEnd.Line != 12 {
+		t.Fatalf("decoded %+v", presence)
+	}
+	encoded, err := json.Marshal(presence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var compact bytes.Buffer
+	json.Compact(&compact, []byte(postedPresence))
+	if !bytes.Equal(encoded, compact.Bytes()) {
+		t.Errorf("encoded %s, want %s", encoded, compact.Bytes())
+	}
+}
+
+func TestGetPresence(t *testing.T) {
+	a := newTestAgent(t)
+	var got presenceStatus
+	a.do(t, http.MethodGet, "/api/presence", "", &got)
+	if got.UpdatedAt != nil || got.Cursor != nil {
+		t.Errorf("presence before any update %+v", got)
+	}
+
+	before := time.Now()
+	a.post(t, "/api/presence", postedPresence, nil)
+	a.do(t, http.MethodGet, "/api/presence", "", &got)
+	if got.ActiveFile != "main.go" || got.Cursor == nil || *got.Cursor != (Cursor{10, 4}) ||
+		got.SelectionStart == nil || got.SelectionEnd == nil || *got.SelectionEnd != (Cursor{12, 0}) ||
+		got.Status != "editing" || got.AdvertisedStatus != "editing" {
+		t.Errorf("presence read back %+v", got)
+	}
+	if got.UpdatedAt == nil || got.UpdatedAt.Before(before.Add(-time.Second)) || got.UpdatedAt.After(time.Now()) {
+		t.Errorf("updatedAt %v, want about %v", got.UpdatedAt, before)
+	}
+
+	// Selection bounds are dropped with the selection
+	a.post(t, "/api/presence", `{"activeFile":"main.go","cursor":{"line":1,"column":0},"status":"editing"}`, nil)
+	got = presenceStatus{}
+	a.do(t, http.MethodGet, "/api/presence", "", &got)
+	if got.SelectionStart != nil || got.SelectionEnd != nil || got.Cursor.Line != 1 {
+		t.Errorf("presence after the selection ended %+v", got)
+	}
+}
+
+func TestPresenceConcurrentUpdates(t *testing.T) {
+	a := newTestAgent(t)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			a.do(t, http.MethodPost, "/api/presence", fmt.Sprintf(`{"activeFile":"f%d.go","cursor":{"line":%d,"column":0},"status":"editing"}`, i, i), nil)
+		}(i)
+		go func() {
+			defer wg.Done()
+			var got presenceStatus
+			a.do(t, http.MethodGet, "/api/presence", "", &got)
+			if got.Cursor != nil && got.ActiveFile != fmt.Sprintf("f%d.go", got.Cursor.Line) {
+				t.Errorf("read a torn presence %+v", got)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// nextPresence returns the next presence propagated to peers, or false if
+// none is within wait
+func nextPresence(t *testing.T, ch <-chan events.Event, wait time.Duration) (LocalPresence, bool) {
+	t.Helper()
+	for {
+		select {
+		case event := <-ch:
+			if event.Type == EventPresenceChanged {
+				return event.Data.(LocalPresence), true
+			}
+		case <-time.After(wait):
+			return LocalPresence{}, false
+		}
+	}
+}
+
+func TestPresenceDebounce(t *testing.T) {
+	const window = 300 * time.Millisecond
+	a := newTestAgent(t, "-presence-debounce", window.String(), "-idle-after", "0")
+	changes, cancel := a.bus.Subscribe("test", 16)
+	defer cancel()
+	at := func(file, status string) string {
+		return `{"activeFile":"` + file + `","cursor":{"line":1,"column":0},"status":"` + status + `"}`
+	}
+
+	// A new status goes out at once
+	a.post(t, "/api/presence", at("a.go", "editing"), nil)
+	if got, ok := nextPresence(t, changes, window/3); !ok || got.ActiveFile != "a.go" {
+		t.Fatalf("status change propagated %+v, %v", got, ok)
+	}
+
+	// Moves within the window go out once, as the last of them, while
+	// reading presence back shows each at once
+	start := time.Now()
+	for _, file := range []string{"b.go", "c.go", "d.go"} {
+		a.post(t, "/api/presence", at(file, "editing"), nil)
+		var local presenceStatus
+		if a.do(t, http.MethodGet, "/api/presence", "", &local); local.ActiveFile != file {
+			t.Errorf("read back %s right after posting %s", local.ActiveFile, file)
+		}
+	}
+	got, ok := nextPresence(t, changes, 2*window)
+	if !ok || got.ActiveFile != "d.go" {
+		t.Fatalf("coalesced update %+v, %v", got, ok)
+	}
+	if waited := time.Since(start); waited < window*2/3 {
+		t.Errorf("coalesced update went out after %v, inside the %v window", waited, window)
+	}
+	if extra, ok := nextPresence(t, changes, window+100*time.Millisecond); ok {
+		t.Errorf("another update %+v after the window", extra)
+	}
+	if txt := strings.Join(a.srv.discovery.TXTRecords(), " "); !strings.Contains(txt, "activeFile=d.go") {
+		t.Errorf("TXT %s", txt)
+	}
+
+	// A status change doesn't wait for a window already open
+	a.post(t, "/api/presence", at("e.go", "editing"), nil)
+	a.post(t, "/api/presence", at("e.go", "away"), nil)
+	if got, ok := nextPresence(t, changes, window/3); !ok || got.Status != "away" {
+		t.Errorf("status change inside a window propagated %+v, %v", got, ok)
+	}
+}
+
+func TestPresenceDebounceOff(t *testing.T) {
+	a := newTestAgent(t, "-presence-debounce", "0", "-idle-after", "0")
+	changes, cancel := a.bus.Subscribe("test", 16)
+	defer cancel()
+	for _, file := range []string{"a.go", "b.go"} {
+		a.post(t, "/api/presence", `{"activeFile":"`+file+`","status":"editing"}`, nil)
+		if got, ok := nextPresence(t, changes, time.Second); !ok || got.ActiveFile != file {
+			t.Errorf("without a window, posting %s propagated %+v, %v", file, got, ok)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/zeropr/agent/internal/i18n"
+	"github.com/zeropr/agent/internal/metrics"
+)
+
+// readSlots bounds how many file reads run at once, since each holds the
+// whole file in memory plus an open descriptor. Reads over the limit wait
+// up to wait for a slot and are then turned away with 503.
+type readSlots struct {
+	slots chan struct{} // nil means unlimited
+	wait  time.Duration
+}
+
+func newReadSlots(n int, wait time.Duration) readSlots {
+	if n <= 0 {
+		return readSlots{}
+	}
+	return readSlots{slots: make(chan struct{}, n), wait: wait}
+}
+
+// acquireRead takes a file read slot for r, to be given back with
+// releaseRead. If none frees up in time it writes a 503 with Retry-After
+// and returns false.
+func (s *Server) acquireRead(w http.ResponseWriter, r *http.Request) bool {
+	reads := s.reads
+	if reads.slots == nil {
+		return true
+	}
+
+	// Most reads find a free slot; only waiting needs a timer
+	select {
+	case reads.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if reads.wait > 0 {
+		timer := time.NewTimer(reads.wait)
+		defer timer.Stop()
+		select {
+		case reads.slots <- struct{}{}:
+			return true
+		case <-timer.C:
+		case <-r.Context().Done():
+		}
+	}
+
+	s.metrics.FileRequest(metrics.FileBusy)
+	s.logger.Warn("File read turned away; all slots busy", "slots", cap(reads.slots), "remote", r.RemoteAddr)
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter(reads.wait)))
+	s.writeError(w, r, http.StatusServiceUnavailable, CodeBusy, i18n.MsgFileReadsBusy)
+	return false
+}
+
+// releaseRead gives back a slot taken by acquireRead
+func (s *Server) releaseRead() {
+	if s.reads.slots != nil {
+		<-s.reads.slots
+	}
+}
+
+// retryAfter suggests how many whole seconds a turned-away read should wait,
+// at least one
+func retryAfter(wait time.Duration) int {
+	return max(1, int((wait+time.Second-1)/time.Second))
+}
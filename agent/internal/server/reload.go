@@ -0,0 +1,94 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/zeropr/agent/internal/config"
+	"github.com/zeropr/agent/internal/crypto"
+	"github.com/zeropr/agent/internal/i18n"
+	"github.com/zeropr/agent/internal/sessions"
+)
+
+// settings are what a reload can change while requests are in flight;
+// handlers read them through s.settings.Load()
+type settings struct {
+	origins                map[string]bool
+	policy                 crypto.Policy
+	gzipThreshold          int           // file responses at least this large are gzipped; negative disables
+	drainGrace             time.Duration // how long sessions carry on once serving is turned off
+	presenceDebounce       time.Duration // window presence updates are coalesced in before peers hear of them
+	idleAfter              time.Duration // inactivity before idle is advertised; 0 never
+	unattendedVerifiedOnly bool          // while nobody is at the keyboard, serve files to verified peers only
+	dndAllowVerified       bool          // verified peers may join sessions during do-not-disturb
+	estimateLimits         sessions.EstimateLimits
+	maxParticipants        int // cap on sessions created without their own; 0 is none
+}
+
+func newSettings(cfg *config.Config) *settings {
+	return &settings{
+		origins:                allowedOrigins(cfg.AllowedOrigins),
+		policy:                 cfg.VerifiedOnly,
+		gzipThreshold:          cfg.CompressThreshold,
+		drainGrace:             cfg.DrainGrace,
+		presenceDebounce:       cfg.PresenceDebounce,
+		idleAfter:              cfg.IdleAfter,
+		unattendedVerifiedOnly: cfg.UnattendedVerifiedOnly,
+		dndAllowVerified:       cfg.DNDAllowVerified,
+		maxParticipants:        cfg.SessionMaxParticipants,
+		estimateLimits: sessions.EstimateLimits{
+			Budget:      cfg.SessionBudget,
+			MaxFileSize: cfg.MaxSessionFileSize,
+			Profile:     cfg.NetworkProfile,
+		},
+	}
+}
+
+// Reloader re-reads the configuration and applies what it can to the
+// running agent, reporting the settings it applied and those that changed
+// but need a restart
+type Reloader func() (applied, restart []string, err error)
+
+// SetReloader enables POST /api/admin/reload
+func (s *Server) SetReloader(reload Reloader) {
+	s.reloader = reload
+}
+
+// Reload applies cfg's reloadable settings: allowed origins, the
+// verified-only policy, the compression threshold, the cursor ghost, the
+// drain grace of the next serve shutdown, the presence debounce and idle
+// period, the session file size limit and network profile, and the relay
+// budget of sessions opened from now on. Listeners, sessions,
+// and sync connections are left as they are.
+func (s *Server) Reload(cfg *config.Config) {
+	s.settings.Store(newSettings(cfg))
+	s.hub.SetGhostTTL(cfg.CursorGhost)
+	s.hub.SetBudget(cfg.SessionBudget)
+}
+
+// handleReload reloads the configuration, as SIGHUP does
+func (s *Server) handleReload(w http.ResponseWriter, r *http.Request) {
+	if s.reloader == nil {
+		s.writeError(w, r, http.StatusNotFound, CodeFeatureDisabled, i18n.MsgReloadDisabled)
+		return
+	}
+	applied, restart, err := s.reloader()
+	if err != nil {
+		// Configuration errors name a file line or variable; they aren't catalogued
+		writeJSONError(w, http.StatusBadRequest, CodeInvalidConfig, err.Error())
+		return
+	}
+	if applied == nil {
+		applied = []string{}
+	}
+	if restart == nil {
+		restart = []string{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]string{
+		"applied":         applied,
+		"restartRequired": restart,
+	})
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"log/slog"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/zeropr/agent/internal/config"
+	"github.com/zeropr/agent/internal/peers"
+)
+
+func TestReloadKeepsSessions(t *testing.T) {
+	flags := []string{"-log-level", "info", "-allowed-origins", "http://a.example"}
+	a := newTestAgent(t, flags...)
+
+	// Reload as the agent's main does, re-reading flags that change under it
+	a.srv.SetReloader(func() ([]string, []string, error) {
+		next, err := config.Load(append([]string{
+			"-state-dir", a.stateDir,
+			"-root", "test=" + a.root,
+			"-name", "test-agent",
+		}, flags...), func(string) (string, bool) { return "", false })
+		if err != nil {
+			return nil, nil, err
+		}
+		applied, restart := a.cfg.Adopt(next)
+		a.registry.SetFilter(a.cfg.PeerFilter)
+		a.srv.Reload(a.cfg)
+		return applied, restart, nil
+	})
+
+	session := a.createSession(t, "alice")
+	joined := a.join(t, session.SessionID, "bob", "")
+	alice, _ := a.dial(t, "/ws/sync/"+session.SessionID+"?sync="+session.SyncToken)
+	bob, _ := a.dial(t, "/ws/sync/"+session.SessionID+"?sync="+joined.SyncToken)
+	waitConnected(t, a, session.SessionID, 2)
+
+	flags = []string{"-log-level", "debug", "-allowed-origins", "http://b.example", "-block", "mallory", "-http-port", "9999"}
+	var result struct {
+		Applied         []string `json:"applied"`
+		RestartRequired []string `json:"restartRequired"`
+	}
+	a.post(t, "/api/admin/reload", "", &result)
+	if want := []string{"allowed-origins", "block", "log-level"}; !reflect.DeepEqual(result.Applied, want) {
+		t.Errorf("applied %v, want %v", result.Applied, want)
+	}
+	if !reflect.DeepEqual(result.RestartRequired, []string{"http-port"}) {
+		t.Errorf("restart required for %v, want the port", result.RestartRequired)
+	}
+
+	// The new settings hold at once
+	if a.cfg.LogLevel != slog.LevelDebug || a.cfg.HTTPPort == 9999 {
+		t.Errorf("log level %v and port %d after the reload", a.cfg.LogLevel, a.cfg.HTTPPort)
+	}
+	resp, _ := a.get(t, "/api/status", map[string]string{"Origin": "http://b.example"})
+	if resp.Header.Get("Access-Control-Allow-Origin") != "http://b.example" {
+		t.Error("the newly allowed origin was refused")
+	}
+	resp, _ = a.get(t, "/api/status", map[string]string{"Origin": "http://a.example"})
+	if resp.Header.Get("Access-Control-Allow-Origin") != "" {
+		t.Error("the origin no longer allowed still is")
+	}
+	if a.registry.Add(&peers.Peer{ID: "mallory@192.0.2.66:7000", Name: "mallory", Address: "192.0.2.66", Port: 7000}) {
+		t.Error("a newly blocked peer was listed")
+	}
+
+	// while the session carries on over the same sockets
+	alice.WriteMessage(websocket.BinaryMessage, update('a'))
+	relayedUntil(t, bob, 'a')
+
+	// A configuration that doesn't load changes nothing
+	flags = []string{"-log-level", "loud"}
+	if status, body := a.do(t, http.MethodPost, "/api/admin/reload", "", nil); status != http.StatusBadRequest || errorCode(body) != CodeInvalidConfig {
+		t.Errorf("reloading a bad configuration answered %d %s", status, body)
+	}
+	if a.cfg.LogLevel != slog.LevelDebug {
+		t.Errorf("log level %v after a failed reload", a.cfg.LogLevel)
+	}
+}
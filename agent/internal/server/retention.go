@@ -0,0 +1,116 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/zeropr/agent/internal/api"
+	"github.com/zeropr/agent/internal/i18n"
+	"github.com/zeropr/agent/internal/retention"
+)
+
+// SetRetention enables the ended-session and retention endpoints backed by
+// janitor, keeps ended sessions' documents among their artifacts, and has
+// changes to them published for following the ended-session list
+func (s *Server) SetRetention(janitor *retention.Janitor) {
+	s.janitor = janitor
+	janitor.Store().SetBus(s.bus)
+	s.sessionMgr.SetArchive(s.archiveSession)
+}
+
+// retentionEnabled writes an error response if retention isn't configured
+func (s *Server) retentionEnabled(w http.ResponseWriter, r *http.Request) bool {
+	if s.janitor == nil {
+		s.writeError(w, r, http.StatusNotFound, CodeFeatureDisabled, i18n.MsgRetentionDisabled)
+		return false
+	}
+	return true
+}
+
+// handleGetEndedSessions lists the sessions whose artifacts are still kept
+func (s *Server) handleGetEndedSessions(w http.ResponseWriter, r *http.Request) {
+	if !s.retentionEnabled(w, r) {
+		return
+	}
+	writeList(s, w, r, endedSessionList, s.janitor.Store().Ended())
+}
+
+// handleDeleteEndedSession removes every artifact of one ended session
+func (s *Server) handleDeleteEndedSession(w http.ResponseWriter, r *http.Request) {
+	if !s.retentionEnabled(w, r) {
+		return
+	}
+
+	deletion, err := s.janitor.Store().Delete(mux.Vars(r)["id"])
+	switch {
+	case err == retention.ErrUnknownSession:
+		s.writeError(w, r, http.StatusNotFound, CodeSessionNotFound, i18n.MsgSessionNotFound)
+		return
+	case err == retention.ErrActiveSession:
+		s.writeErrorFor(w, r, http.StatusConflict, CodeSessionActive, err)
+		return
+	case err != nil:
+		s.writeErrorFor(w, r, http.StatusInternalServerError, CodeInternal, err)
+		return
+	}
+	s.logger.Info("Deleted session artifacts", "session", deletion.SessionID, "bytes", deletion.Bytes)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deletion)
+}
+
+func (s *Server) handleGetRetention(w http.ResponseWriter, r *http.Request) {
+	if !s.retentionEnabled(w, r) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"policy": s.janitor.Policy(),
+		"types":  retention.Types,
+	})
+}
+
+// handlePutRetention replaces the retention policy. The body maps artifact
+// types to rules, e.g. {"timeline": {"keepDays": 30, "maxBytes": 1048576}}.
+func (s *Server) handlePutRetention(w http.ResponseWriter, r *http.Request) {
+	if !s.retentionEnabled(w, r) {
+		return
+	}
+
+	var policy retention.Policy
+	if err := api.DecodeLocal(r.Body, &policy); err != nil {
+		s.writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, i18n.MsgInvalidRequest)
+		return
+	}
+	if err := policy.Validate(); err != nil {
+		s.writeErrorFor(w, r, http.StatusBadRequest, CodeInvalidRequest, err)
+		return
+	}
+	if err := s.janitor.SetPolicy(policy); err != nil {
+		s.writeErrorFor(w, r, http.StatusInternalServerError, CodeInternal, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"policy": s.janitor.Policy()})
+}
+
+// handleRunRetention enforces the policy now and reports what was deleted
+func (s *Server) handleRunRetention(w http.ResponseWriter, r *http.Request) {
+	if !s.retentionEnabled(w, r) {
+		return
+	}
+
+	report, err := s.janitor.Run(time.Now())
+	if err != nil {
+		s.writeErrorFor(w, r, http.StatusInternalServerError, CodeInternal, err)
+		return
+	}
+	s.logger.Info("Retention run finished", "sessions", len(report.Deleted), "bytesReclaimed", report.BytesReclaimed)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
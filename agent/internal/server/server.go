@@ -2,255 +2,930 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
+	"github.com/zeropr/agent/internal/api"
+	"github.com/zeropr/agent/internal/auth"
+	"github.com/zeropr/agent/internal/config"
+	"github.com/zeropr/agent/internal/crypto"
 	"github.com/zeropr/agent/internal/discovery"
+	"github.com/zeropr/agent/internal/events"
+	"github.com/zeropr/agent/internal/fetchlog"
+	"github.com/zeropr/agent/internal/i18n"
+	"github.com/zeropr/agent/internal/logging"
+	"github.com/zeropr/agent/internal/metrics"
+	"github.com/zeropr/agent/internal/peerclient"
 	"github.com/zeropr/agent/internal/peers"
+	"github.com/zeropr/agent/internal/protocol"
+	"github.com/zeropr/agent/internal/redact"
+	"github.com/zeropr/agent/internal/retention"
 	"github.com/zeropr/agent/internal/sessions"
+	"github.com/zeropr/agent/internal/version"
+	"github.com/zeropr/agent/internal/workspace"
 )
 
-const version = "0.1.0"
-
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true // Allow all origins for local development
-	},
+// upgrader accepts WebSocket upgrades only from allowed browser origins
+func (s *Server) upgrader() *websocket.Upgrader {
+	return &websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool {
+			return s.originAllowed(r.Header.Get("Origin"))
+		},
+	}
 }
 
 // Server handles HTTP and WebSocket connections
 type Server struct {
-	httpPort      int
-	wsPort        int
-	registry      *peers.Registry
-	discovery     *discovery.Service
-	sessionMgr    *sessions.Manager
-	httpServer    *http.Server
-	wsServer      *http.Server
-	localPresence *LocalPresence
-	workingDir    string
-}
-
-// LocalPresence stores this device's presence information
-type LocalPresence struct {
-	ActiveFile string                           `json:"activeFile"`
-	Cursor     *struct{ Line, Column int }      `json:"cursor"`
-	Status     string                           `json:"status"`
-}
-
-// NewServer creates a new server instance
-func NewServer(httpPort, wsPort int, registry *peers.Registry, discovery *discovery.Service) *Server {
-	workingDir, _ := os.Getwd()
-	
-	return &Server{
-		httpPort:   httpPort,
-		wsPort:     wsPort,
+	listenAddr  string
+	peerAddr    string
+	syncAddr    string // sync-only listener; empty serves sync sockets on the API listeners
+	registry    *peers.Registry
+	discovery   *discovery.Service
+	bus         *events.Bus
+	tokens      *auth.Store
+	identity    *crypto.Identity
+	trust       *crypto.TrustStore
+	verifier    *crypto.Verifier
+	peerClient  *peerclient.Client
+	tlsConfig   *tls.Config
+	settings    atomic.Pointer[settings]
+	reloader    Reloader
+	reads       readSlots
+	fileCache   *fileCache // nil unless -file-cache-size is set
+	fetches     *fetchlog.Log
+	transfers   *transfers
+	locale      string // for messages when Accept-Language names no catalog
+	debug       bool   // serve the debug helpers that change state
+	certFP      string
+	logLimiter  *logging.RateLimitHandler
+	logger      *slog.Logger // scoped to the server component
+	rootLogger  *slog.Logger // handed to the hub and session manager
+	sessionMgr  *sessions.Manager
+	hub         *sessions.Hub
+	chat        *sessions.Chat
+	feeds       eventFeeds         // open /ws/events sockets
+	keepalive   sessions.Keepalive // pings and write timeout on event feed sockets
+	planes      planeState
+	readOnly    atomic.Bool // serve no files; see setReadOnly
+	reconnects  *sessions.ReconnectTokens
+	bridges     bridges // sessions on other agents local editors are in
+	consents    captureConsents
+	consentWait time.Duration // how long a peer's capture request waits on the user
+	debugDir    string        // where divergence captures are written
+	janitor     *retention.Janitor
+	metrics     *metrics.Metrics
+	httpServer  *http.Server
+	peerServer  *http.Server
+	syncServer  *http.Server
+	presence    presenceState
+	workspace   *workspace.Workspace
+	startedAt   time.Time
+	ready       atomic.Bool
+	onListening func() // called once every listener is bound
+}
+
+// NewServer creates a new server instance from cfg. The full client API
+// listens on cfg.Listen; cfg.PeerListen, if set, serves only the endpoints
+// other agents need; cfg.SyncListen, if set, takes the sync sockets off
+// both and serves them alone.
+func NewServer(cfg *config.Config, registry *peers.Registry, discovery *discovery.Service, bus *events.Bus, ws *workspace.Workspace) *Server {
+	s := &Server{
+		listenAddr: cfg.Listen,
+		peerAddr:   cfg.PeerListen,
+		syncAddr:   cfg.SyncListen,
 		registry:   registry,
 		discovery:  discovery,
-		sessionMgr: sessions.NewManager(),
-		localPresence: &LocalPresence{
-			Status: "idle",
-		},
-		workingDir: workingDir,
+		bus:        bus,
+		sessionMgr: sessions.NewManager(bus),
+		hub:        sessions.NewHub(cfg.DuplicatePolicy),
+		chat:       sessions.NewChat(cfg.DuplicatePolicy),
+		reconnects: sessions.NewReconnectTokens(cfg.RejoinGrace),
+		verifier:   crypto.NewVerifier(),
+		peerClient: peerclient.New(nil, peerclient.DefaultTimeouts),
+		reads:      newReadSlots(cfg.FileReads, cfg.FileReadWait),
+		fileCache:  newFileCache(cfg.FileCacheSize),
+		fetches:    fetchlog.New(fetchlog.DefaultCapacity),
+		transfers:  newTransfers(),
+		debugDir:   filepath.Join(cfg.StateDir, "debug"),
+		locale:     cfg.Locale,
+		debug:      cfg.Debug,
+		logger:     logging.Component(nil, "server"),
+		rootLogger: slog.Default(),
+		workspace:  ws,
+		startedAt:  time.Now(),
+	}
+	s.planes.planes = defaultPlanes
+	s.presence.current.Status = "idle"
+	s.presence.published.Status = "idle"
+	s.setReadOnly(cfg.ReadOnly)
+	s.hub.SetBus(bus)
+	s.hub.SetRoles(s.rosterRole)
+	s.hub.SetKeepalive(cfg.SyncKeepalive)
+	s.hub.RecordFrames(cfg.SessionRecording)
+	s.chat.SetKeepalive(cfg.SyncKeepalive)
+	s.keepalive = cfg.SyncKeepalive
+	s.consentWait = cfg.CaptureConsentWait
+	s.sessionMgr.SetHub(s.hub)
+	s.Reload(cfg)
+	return s
+}
+
+// rosterRole names a participant's role for the session roster: the
+// initiator hosts, and everyone else edits or views as they joined
+func (s *Server) rosterRole(sessionID, participantID string) string {
+	if session, ok := s.sessionMgr.Get(sessionID); ok && session.Initiator == participantID {
+		return sessions.RosterHost
+	}
+	if member, ok := s.sessionMgr.Member(sessionID, participantID); ok && member.Role == sessions.RosterViewer {
+		return sessions.RosterViewer
+	}
+	return sessions.RosterEditor
+}
+
+// SetLogger sets the logger the server and its sessions report to
+func (s *Server) SetLogger(logger *slog.Logger) {
+	s.rootLogger = logger
+	s.logger = logging.Component(logger, "server")
+	s.sessionMgr.SetLogger(logger)
+	s.hub.SetLogger(logger)
+	s.chat.SetLogger(logger)
+}
+
+// SetTLS serves the API and sync sockets over TLS with cert, whose
+// fingerprint is reported in /api/status. Must be called before Start.
+func (s *Server) SetTLS(cert tls.Certificate, fingerprint string) {
+	s.tlsConfig = &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
 	}
+	s.certFP = fingerprint
+}
+
+// SetSessionStore restores the sessions saved in store, with their
+// documents, and has the hub keep documents so they're saved there too.
+// It returns the IDs of the sessions restored. Must be called before Start.
+func (s *Server) SetSessionStore(store *sessions.SessionStore) []string {
+	s.hub.RecordDocs()
+	return s.sessionMgr.SetStore(store)
+}
+
+// SnapshotSessions saves changed sessions to the session store every
+// interval until ctx is done
+func (s *Server) SnapshotSessions(ctx context.Context, interval time.Duration) {
+	s.sessionMgr.Snapshot(ctx, interval)
+}
+
+// RequireTokens enables API token auth backed by store. Must be called before Start.
+func (s *Server) RequireTokens(store *auth.Store) {
+	s.tokens = store
 }
 
-// Start starts both HTTP and WebSocket servers
+// OnListening registers fn to run once Start has bound every listener.
+// Must be called before Start.
+func (s *Server) OnListening(fn func()) {
+	s.onListening = fn
+}
+
+// Start binds the local API listener and, if configured, the peer listener,
+// then serves both until one fails or Shutdown is called
 func (s *Server) Start() error {
+	local, err := net.Listen("tcp", s.listenAddr)
+	if err != nil {
+		return err
+	}
+	s.httpServer = &http.Server{Handler: s.Handler(), TLSConfig: s.tlsConfig}
+
+	errs := make(chan error, 3)
+	if s.peerAddr != "" {
+		peer, err := net.Listen("tcp", s.peerAddr)
+		if err != nil {
+			local.Close()
+			return err
+		}
+		s.peerServer = &http.Server{Handler: s.PeerHandler(), TLSConfig: s.tlsConfig}
+		go func() { errs <- s.serve(s.peerServer, peer) }()
+	}
+	if s.syncAddr != "" {
+		syncListener, err := net.Listen("tcp", s.syncAddr)
+		if err != nil {
+			local.Close()
+			if s.peerServer != nil {
+				s.peerServer.Close()
+			}
+			return err
+		}
+		s.syncServer = &http.Server{Handler: s.SyncHandler(), TLSConfig: s.tlsConfig}
+		go func() { errs <- s.serve(s.syncServer, syncListener) }()
+	}
+
+	// The ports are bound; we're ready once discovery is initialized too
+	s.ready.Store(s.discovery != nil)
+	if s.onListening != nil {
+		s.onListening()
+	}
+
+	go func() { errs <- s.serve(s.httpServer, local) }()
+	return <-errs
+}
+
+// serve runs srv on listener, over TLS when enabled
+func (s *Server) serve(srv *http.Server, listener net.Listener) error {
+	if s.tlsConfig != nil {
+		return srv.ServeTLS(listener, "", "")
+	}
+	return srv.Serve(listener)
+}
+
+// Handler builds the router serving the full client API and WebSocket
+// endpoints, meant for the loopback listener
+func (s *Server) Handler() http.Handler {
 	// Setup HTTP API
 	router := mux.NewRouter()
-	
+
 	// API endpoints
 	api := router.PathPrefix("/api").Subrouter()
-	api.HandleFunc("/peers", s.handleGetPeers).Methods("GET")
-	api.HandleFunc("/status", s.handleGetStatus).Methods("GET")
+	s.peerRoutes(router, api)
+	api.HandleFunc("/peers", s.whileObserving(s.handleGetPeers)).Methods("GET")
+	api.HandleFunc("/peers", s.handleAddPeer).Methods("POST")
+	api.HandleFunc("/peers/{id}", s.whileObserving(s.handleGetPeer)).Methods("GET")
+	api.HandleFunc("/peers/{id}/history", s.whileObserving(s.handleGetPeerHistory)).Methods("GET")
+	api.HandleFunc("/peers/{id}", s.handlePatchPeer).Methods("PATCH")
+	api.HandleFunc("/peers/{id}", s.handleDeletePeer).Methods("DELETE")
+	api.HandleFunc("/ready", s.handleGetReady).Methods("GET")
 	api.HandleFunc("/broadcast/start", s.handleStartBroadcast).Methods("POST")
 	api.HandleFunc("/broadcast/stop", s.handleStopBroadcast).Methods("POST")
+	api.HandleFunc("/broadcast/status", s.handleBroadcastStatus).Methods("GET")
+	api.HandleFunc("/planes", s.handleGetPlanes).Methods("GET")
+	api.HandleFunc("/planes", s.handlePutPlanes).Methods("PUT")
+	api.HandleFunc("/mode", s.handleGetMode).Methods("GET")
+	api.HandleFunc("/mode", s.handleSetMode).Methods("POST")
+	api.HandleFunc("/presence", s.handleGetPresence).Methods("GET")
 	api.HandleFunc("/presence", s.handleUpdatePresence).Methods("POST")
 	api.HandleFunc("/file/request", s.handleFileRequest).Methods("POST")
-	api.HandleFunc("/file/send", s.handleFileSend).Methods("POST")
-	api.HandleFunc("/file/get", s.handleFileGet).Methods("GET")
-	api.HandleFunc("/session/create", s.handleSessionCreate).Methods("POST")
-	api.HandleFunc("/session/join", s.handleSessionJoin).Methods("POST")
+	api.HandleFunc("/file/send", s.unlessReadOnly(s.handleFileSend)).Methods("POST")
+	api.HandleFunc("/transfers", s.handleListTransfers).Methods("GET")
+	api.HandleFunc("/fetches", s.handleListFetches).Methods("GET")
+	api.HandleFunc("/fetches/away", s.handleAwayFetches).Methods("GET")
+	api.HandleFunc("/transfers/{id}", s.handleGetTransfer).Methods("GET")
+	api.HandleFunc("/transfers/{id}", s.handleCancelTransfer).Methods("DELETE")
+	api.HandleFunc("/transfers/{id}/resume", s.handleResumeTransfer).Methods("POST")
+	api.HandleFunc("/session/estimate", s.handleSessionEstimate).Methods("POST")
+	api.HandleFunc("/session/create", s.whileServing(s.handleSessionCreate)).Methods("POST")
 	api.HandleFunc("/session/leave", s.handleSessionLeave).Methods("POST")
+	api.HandleFunc("/session/bridge", s.handleSessionBridge).Methods("POST")
+	api.HandleFunc("/session/lock", s.handleSessionLock).Methods("POST")
+	api.HandleFunc("/session/unlock", s.handleSessionUnlock).Methods("POST")
+	api.HandleFunc("/session/{id}/participants", s.handleGetSessionParticipants).Methods("GET")
+	api.HandleFunc("/session/{id}/role", s.handleSessionRole).Methods("POST")
+	api.HandleFunc("/session/{id}/capacity", s.handleSessionCapacity).Methods("POST")
+	api.HandleFunc("/session/{id}/export", s.handleSessionExport).Methods("GET")
+	api.HandleFunc("/session/{id}/chat", s.handleGetSessionChat).Methods("GET")
 	api.HandleFunc("/sessions", s.handleGetSessions).Methods("GET")
-	api.HandleFunc("/debug/add-mock-peer", s.handleAddMockPeer).Methods("POST")
-	
-	// WebSocket endpoint for Yjs sync
-	router.HandleFunc("/ws/sync/{sessionId}", s.handleYjsSync)
-	
-	// CORS middleware
-	router.Use(corsMiddleware)
-	
-	s.httpServer = &http.Server{
-		Addr:    fmt.Sprintf(":%d", s.httpPort),
-		Handler: router,
-	}
-	
-	return s.httpServer.ListenAndServe()
-}
-
-// Shutdown gracefully shuts down the server
+	api.HandleFunc("/sessions/stats", s.handleGetSessionStats).Methods("GET")
+	api.HandleFunc("/sessions/ended", s.handleGetEndedSessions).Methods("GET")
+	api.HandleFunc("/sessions/ended/{id}", s.handleDeleteEndedSession).Methods("DELETE")
+	api.HandleFunc("/retention", s.handleGetRetention).Methods("GET")
+	api.HandleFunc("/retention", s.handlePutRetention).Methods("PUT")
+	api.HandleFunc("/retention/run", s.handleRunRetention).Methods("POST")
+	api.HandleFunc("/debug/runtime", s.handleDebugRuntime).Methods("GET")
+	api.HandleFunc("/debug/capture-divergence", s.handleCaptureDivergence).Methods("POST")
+	api.HandleFunc("/debug/capture-requests/{id}", s.handleResolveCapture).Methods("POST")
+	api.HandleFunc("/admin/reload", s.handleReload).Methods("POST")
+	api.HandleFunc("/tokens", s.handleListTokens).Methods("GET")
+	api.HandleFunc("/tokens", s.handleCreateToken).Methods("POST")
+	api.HandleFunc("/tokens/{id}", s.handleRevokeToken).Methods("DELETE")
+	api.HandleFunc("/trust", s.handleListTrust).Methods("GET")
+	api.HandleFunc("/trust/reconcile", s.handleReconcileTrust).Methods("POST")
+	api.HandleFunc("/trust/{fingerprint}/resolve", s.handleResolveTrust).Methods("POST")
+	api.HandleFunc("/trust/export", s.handleExportTrust).Methods("GET")
+	api.HandleFunc("/trust/import", s.handleImportTrust).Methods("POST")
+	api.HandleFunc("/peers/{id}/trust", s.handleTrustPeer).Methods("POST")
+	api.HandleFunc("/peers/{id}/trust", s.handleUntrustPeer).Methods("DELETE")
+	api.HandleFunc("/peers/{id}/trust/verify", s.handleVerifyPeer).Methods("POST")
+	api.HandleFunc("/peers/{id}/pairing-code", s.handlePairingCode).Methods("GET")
+	router.HandleFunc("/ws/events", s.handleEventFeed)
+	router.HandleFunc("/ws/bridge/{sessionId}", s.handleBridgeSync)
+	// Fake peers would mislead anyone on a real network, so they take -debug
+	if s.debug {
+		api.HandleFunc("/debug/add-mock-peer", s.handleAddMockPeer).Methods("POST")
+	}
+	if s.metrics != nil {
+		router.Handle("/metrics", s.metrics.Handler()).Methods("GET")
+		router.Use(s.metricsMiddleware)
+	}
+
+	// CORS, peer signature, and token auth middleware
+	router.Use(s.corsMiddleware)
+	router.Use(s.peerAuthMiddleware)
+	router.Use(s.authMiddleware)
+
+	return router
+}
+
+// PeerHandler builds the LAN-facing router, limited to what other agents
+// legitimately call
+func (s *Server) PeerHandler() http.Handler {
+	router := mux.NewRouter()
+	api := router.PathPrefix("/api").Subrouter()
+	s.peerRoutes(router, api)
+
+	if s.metrics != nil {
+		router.Use(s.metricsMiddleware)
+	}
+	router.Use(s.peerAuthMiddleware)
+	router.Use(s.authMiddleware)
+
+	return router
+}
+
+// SyncHandler builds the router for the sync-only listener, serving
+// nothing but sync sockets
+func (s *Server) SyncHandler() http.Handler {
+	router := mux.NewRouter()
+	s.syncRoutes(router)
+
+	if s.metrics != nil {
+		router.Use(s.metricsMiddleware)
+	}
+	router.Use(s.peerAuthMiddleware)
+	router.Use(s.authMiddleware)
+
+	return router
+}
+
+// peerRoutes registers the endpoints served on both listeners: the status
+// probe, the certificate attestation, file fetches, joining a session,
+// divergence captures, and the sync socket unless it has a listener of its
+// own
+func (s *Server) peerRoutes(router, api *mux.Router) {
+	api.HandleFunc("/status", s.handleGetStatus).Methods("GET")
+	router.HandleFunc(peerclient.AttestationPath, s.handleCertAttestation).Methods("GET")
+	api.HandleFunc("/file/get", s.whileServing(s.unlessReadOnly(s.journaled(s.handleFileGet)))).Methods("GET")
+	api.HandleFunc("/file/raw", s.whileServing(s.unlessReadOnly(s.journaled(s.handleFileRaw)))).Methods("GET")
+	api.HandleFunc("/session/join", s.whileServing(s.unlessDoNotDisturb(s.handleSessionJoin))).Methods("POST")
+	api.HandleFunc("/peer/offline", s.handlePeerOffline).Methods("POST")
+	api.HandleFunc("/debug/divergence-segment", s.handleDivergenceSegment).Methods("POST")
+
+	if s.syncAddr == "" {
+		s.syncRoutes(router)
+	}
+}
+
+// syncRoutes registers the WebSocket endpoints for Yjs sync and session chat
+func (s *Server) syncRoutes(router *mux.Router) {
+	router.HandleFunc("/ws/sync/{sessionId}", s.whileServing(s.handleYjsSync))
+	router.HandleFunc("/ws/chat/{sessionId}", s.whileServing(s.handleChat))
+}
+
+// IsReady reports whether the server has bound its ports and discovery is initialized
+func (s *Server) IsReady() bool {
+	return s.ready.Load()
+}
+
+// Shutdown tells peers we're going offline, gracefully shuts down the
+// listeners, then closes live sync connections with a "server shutting
+// down" frame and waits for them to drain until ctx is done. Sessions are
+// saved last, if there's a session store.
 func (s *Server) Shutdown(ctx context.Context) error {
+	s.ready.Store(false)
+	s.announceOffline(ctx)
+
+	var err error
+	if s.peerServer != nil {
+		err = s.peerServer.Shutdown(ctx)
+	}
+	if s.syncServer != nil {
+		if syncErr := s.syncServer.Shutdown(ctx); syncErr != nil {
+			err = syncErr
+		}
+	}
 	if s.httpServer != nil {
-		return s.httpServer.Shutdown(ctx)
+		if localErr := s.httpServer.Shutdown(ctx); localErr != nil {
+			err = localErr
+		}
+	}
+
+	// Background transfers outlive their requests; abort them with the server
+	s.transfers.cancel()
+
+	// Hijacked sync sockets aren't tracked by http.Server; drain them here
+	if hubErr := s.hub.Shutdown(ctx); hubErr != nil {
+		err = hubErr
 	}
-	return nil
+	if chatErr := s.chat.Shutdown(ctx); chatErr != nil {
+		err = chatErr
+	}
+	s.feeds.closeAll()
+
+	// Nothing is relayed now, so this snapshot is each session's last word
+	s.sessionMgr.SaveAll()
+	return err
 }
 
 // HTTP Handlers
 
 func (s *Server) handleGetPeers(w http.ResponseWriter, r *http.Request) {
 	peers := s.registry.GetAll()
-	
-	response := map[string]interface{}{
-		"peers": peers,
+	list := peerList
+
+	// ?repo= keeps the peers serving the same repo as one of our roots,
+	// and the changes to them
+	if repo, ok := r.URL.Query()["repo"]; ok {
+		root, ok := s.lookupRoot(w, r, repo[0])
+		if !ok {
+			return
+		}
+		hash := root.RepoHash()
+		kept := peers[:0]
+		for _, peer := range peers {
+			if peer.HasRepo(hash) {
+				kept = append(kept, peer)
+			}
+		}
+		peers = kept
+		list = list.matching(servesRepo(hash))
+	}
+
+	switch r.URL.Query().Get("sort") {
+	case "":
+	case "latency":
+		sortByLatency(peers)
+	default:
+		s.writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, i18n.MsgUnsupportedSort)
+		return
+	}
+
+	writeList(s, w, r, list, peers)
+}
+
+// servesRepo keeps the peer changes about peers serving the repo with hash
+func servesRepo(hash string) func(item interface{}) bool {
+	return func(item interface{}) bool {
+		peer, ok := item.(peers.Peer)
+		return ok && peer.HasRepo(hash)
 	}
-	
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+}
+
+// sortByLatency orders peers fastest first, with unmeasured peers last
+func sortByLatency(list []*peers.Peer) {
+	sort.SliceStable(list, func(i, j int) bool {
+		a, b := list[i].LatencyMs, list[j].LatencyMs
+		if a == nil || b == nil {
+			return a != nil
+		}
+		return *a < *b
+	})
 }
 
 func (s *Server) handleGetStatus(w http.ResponseWriter, r *http.Request) {
+	build := version.Get()
 	response := map[string]interface{}{
-		"running":        true,
-		"version":        version,
-		"peersCount":     s.registry.Count(),
-		"broadcasting":   s.discovery.IsBroadcasting(),
-		"activeSessions": s.sessionMgr.Count(),
+		"schemaVersion":     api.SchemaVersion,
+		"running":           true,
+		"ready":             s.IsReady(),
+		"version":           build.Version,
+		"commit":            build.Commit,
+		"buildDate":         build.BuildDate,
+		"goVersion":         build.GoVersion,
+		"minCompatible":     build.MinCompatible,
+		"protocolVersion":   protocol.Version,
+		"startedAt":         s.startedAt,
+		"uptimeSeconds":     int64(time.Since(s.startedAt).Seconds()),
+		"peersCount":        s.registry.Count(),
+		"broadcasting":      s.discovery.IsBroadcasting(),
+		"discoveryDegraded": s.discovery.Degraded(),
+		"activeSessions":    s.sessionMgr.Count(),
+		"connections":       s.hub.Connections(),
+		"repoHash":          "",
+		"branch":            "",
+		"repos":             s.workspace.Info(),
+		"root":              nil,
+	}
+	// The share root lets clients check the agent serves the workspace
+	// they have open; it stays null when the agent serves no files. Only
+	// callers on this machine see where roots are on disk.
+	local := isLoopback(r.RemoteAddr)
+	if root := s.defaultRoot(); root != nil {
+		response["root"] = redact.SensitivePath(root.Path)
+		if local {
+			response["root"] = root.Path
+		}
+		response["repoHash"] = root.RepoHash()
+		response["branch"] = root.Branch()
+	}
+	if s.tlsConfig != nil {
+		response["tls"] = true
+		response["certFingerprint"] = s.certFP
 	}
-	
+	if s.identity != nil {
+		response["publicKey"] = s.identity.EncodedPublicKey()
+		response["fingerprint"] = s.identity.Fingerprint()
+	}
+	if local {
+		response["repos"] = revealRoots(s.workspace.Info())
+	}
+	// Only callers on this machine see the filter, so a blocked peer
+	// can't read that it's blocked
+	if local {
+		filter := s.registry.Filter()
+		allow, block := filter.Allow, filter.Block
+		if allow == nil {
+			allow = []string{}
+		}
+		if block == nil {
+			block = []string{}
+		}
+		response["peerFilter"] = map[string]interface{}{
+			"mode":  filter.Mode(),
+			"allow": allow,
+			"block": block,
+		}
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
+// revealedRoot is a root as callers on this machine see it, path and all
+type revealedRoot struct {
+	workspace.Info
+	Path string `json:"path"`
+}
+
+// revealRoots unwraps the paths of roots for callers on this machine
+func revealRoots(infos []workspace.Info) []revealedRoot {
+	roots := make([]revealedRoot, 0, len(infos))
+	for _, info := range infos {
+		roots = append(roots, revealedRoot{Info: info, Path: info.Path.Reveal()})
+	}
+	return roots
+}
+
+// syncHostPort is the address local clients reach sync sockets on
+func (s *Server) syncHostPort() string {
+	addr := s.listenAddr
+	if s.syncAddr != "" {
+		addr = s.syncAddr
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && (ip.IsUnspecified() || ip.IsLoopback())) {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// wsScheme is the scheme clients use for sync sockets
+func (s *Server) wsScheme() string {
+	if s.tlsConfig != nil {
+		return "wss"
+	}
+	return "ws"
+}
+
+// defaultRoot returns the default root, whose hash and branch are what we advertise
+func (s *Server) defaultRoot() *workspace.Root {
+	root, _ := s.workspace.Root("")
+	return root
+}
+
+// handleGetReady is the readiness probe: 503 until ports are bound and discovery is up
+func (s *Server) handleGetReady(w http.ResponseWriter, r *http.Request) {
+	ready := s.IsReady()
+
+	w.Header().Set("Content-Type", "application/json")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(map[string]bool{"ready": ready})
+}
+
+// handleStartBroadcast turns the advertise plane on
 func (s *Server) handleStartBroadcast(w http.ResponseWriter, r *http.Request) {
-	err := s.discovery.StartBroadcast()
+	_, err := s.updatePlanes(func(p *Planes) { p.Advertise = true })
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to start broadcast: %v", err), http.StatusInternalServerError)
+		s.writeError(w, r, http.StatusInternalServerError, CodeBroadcastFailed, i18n.MsgBroadcastFailed, err)
 		return
 	}
-	
+
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{"status": "started"})
 }
 
+// handleStopBroadcast turns the advertise plane off
 func (s *Server) handleStopBroadcast(w http.ResponseWriter, r *http.Request) {
-	s.discovery.StopBroadcast()
-	
+	s.updatePlanes(func(p *Planes) { p.Advertise = false })
+
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{"status": "stopped"})
 }
 
-func (s *Server) handleUpdatePresence(w http.ResponseWriter, r *http.Request) {
-	var presence LocalPresence
-	if err := json.NewDecoder(r.Body).Decode(&presence); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		return
-	}
-	
-	s.localPresence = &presence
-	log.Printf("Presence updated: file=%s, status=%s", presence.ActiveFile, presence.Status)
-	
-	// TODO: Update mDNS TXT records with this information
-	
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"status": "updated"})
+// handleBroadcastStatus reports exactly what this agent advertises, so two
+// agents that can't see each other can be compared side by side
+func (s *Server) handleBroadcastStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.discovery.BroadcastStatus())
 }
 
 func (s *Server) handleFileRequest(w http.ResponseWriter, r *http.Request) {
 	var req struct {
 		PeerID   string `json:"peerId"`
+		Repo     string `json:"repo"`
 		FilePath string `json:"filePath"`
+		Async    bool   `json:"async"`
 	}
-	
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+
+	if err := api.DecodeLocal(r.Body, &req); err != nil {
+		s.writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, i18n.MsgInvalidRequest)
 		return
 	}
-	
-	peer, exists := s.registry.Get(req.PeerID)
-	if !exists {
-		http.Error(w, "Peer not found", http.StatusNotFound)
+
+	peer, ok := s.lookupPeer(w, r, req.PeerID)
+	if !ok {
 		return
 	}
-	
+	if peer.Incompatible {
+		s.writeError(w, r, http.StatusConflict, CodeIncompatiblePeer, i18n.MsgPeerIncompatible, peer.IncompatibleReason, peer.Version, peer.ProtocolVersion)
+		return
+	}
+
+	// Large files are better fetched in the background and followed
+	// through /api/transfers
+	if req.Async {
+		transfer, err := s.startTransfer(peer, req.Repo, req.FilePath)
+		if err != nil {
+			s.writeError(w, r, http.StatusInternalServerError, CodeInternal, i18n.MsgTransferStartFailed, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", "/api/transfers/"+transfer.ID)
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"transferId": transfer.ID,
+			"transfer":   transfer,
+		})
+		return
+	}
+
 	// Forward request to peer's agent
-	log.Printf("Forwarding file request to %s: %s", peer.Name, req.FilePath)
-	
-	// TODO: Make HTTP request to peer's agent to get file
-	// For now, return mock response
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"status":  "pending",
-		"message": "File request sent to peer",
-	})
+	s.logger.Info("Forwarding file request", "peerId", peer.ID, "peer", peer.Name, "path", req.FilePath)
+
+	file, err := s.peerClient.GetFile(r.Context(), peer, req.Repo, req.FilePath, nil)
+	if err != nil {
+		var down *peerclient.UnreachableError
+		if errors.As(err, &down) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(down.RetryAt)/time.Second)+1))
+		}
+		status, code := peerFileError(err)
+		s.writeError(w, r, status, code, i18n.MsgPeerRequestFailed, err)
+		return
+	}
+
+	response := fileResponse(peer, file)
+	etag := hashETag(file.SHA256)
+	w.Header().Set("Cache-Control", "no-cache")
+	if notModified(w, r, etag) {
+		return
+	}
+
+	w.Header().Set("ETag", etag)
+	s.writeFileJSON(w, r, response)
+}
+
+// peerFileError maps a failed peer fetch to our response status and code,
+// passing on the peer's own client errors
+func peerFileError(err error) (int, string) {
+	status, code := http.StatusBadGateway, CodePeerRequestFailed
+	var peerErr *peerclient.StatusError
+	var down *peerclient.UnreachableError
+	if errors.As(err, &down) {
+		return http.StatusServiceUnavailable, CodePeerUnreachable
+	}
+	if errors.As(err, &peerErr) && peerErr.Code < 500 {
+		status = peerErr.Code
+		if peerErr.ErrorCode != "" {
+			code = peerErr.ErrorCode
+		}
+	}
+	return status, code
+}
+
+// fileResponse is the body answering a peer file request
+func fileResponse(peer *peers.Peer, file *peerclient.File) map[string]interface{} {
+	response := map[string]interface{}{
+		"status":   "success",
+		"peerId":   peer.ID,
+		"filePath": file.FilePath,
+		"content":  file.Content,
+		"size":     file.Size,
+		"modTime":  file.ModTime,
+		"sha256":   file.SHA256,
+	}
+	if file.Encoding != "" {
+		response["encoding"] = file.Encoding
+	}
+	if file.ContentType != "" {
+		response["contentType"] = file.ContentType
+	}
+	return response
 }
 
 func (s *Server) handleFileSend(w http.ResponseWriter, r *http.Request) {
-	var req struct {
-		FilePath string `json:"filePath"`
+	var req api.FileSendRequest
+	if err := api.DecodeLocal(r.Body, &req); err != nil {
+		s.writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, i18n.MsgInvalidRequest)
+		return
+	}
+
+	fullPath, ok := s.resolvePath(w, r, req.Repo, req.FilePath)
+	if !ok {
+		return
 	}
-	
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+	if !s.acquireRead(w, r) {
 		return
 	}
-	
-	// Construct full file path relative to working directory
-	fullPath := filepath.Join(s.workingDir, req.FilePath)
-	
+	defer s.releaseRead()
+
 	// Read file content
 	content, err := os.ReadFile(fullPath)
 	if err != nil {
-		log.Printf("Error reading file %s: %v", fullPath, err)
-		http.Error(w, fmt.Sprintf("File not found: %v", err), http.StatusNotFound)
+		s.logger.Warn("Failed to read file", "path", fullPath, "err", err)
+		s.writeError(w, r, http.StatusNotFound, CodeFileNotFound, i18n.MsgFileNotFound, err)
 		return
 	}
-	
-	log.Printf("Sending file: %s (%d bytes)", req.FilePath, len(content))
-	
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"filePath": req.FilePath,
-		"content":  string(content),
-		"status":   "success",
-	})
+
+	s.logger.Info("Sending file", "path", req.FilePath, "bytes", len(content))
+
+	response := &api.File{
+		Header:   api.Current,
+		Status:   "success",
+		FilePath: req.FilePath,
+		Size:     int64(len(content)),
+		SHA256:   contentHash(content),
+	}
+	response.SetContent(content)
+	s.writeFileJSON(w, r, response)
 }
 
 func (s *Server) handleFileGet(w http.ResponseWriter, r *http.Request) {
 	filePath := r.URL.Query().Get("path")
 	if filePath == "" {
-		http.Error(w, "Missing path parameter", http.StatusBadRequest)
+		s.writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, i18n.MsgMissingPath)
+		return
+	}
+
+	fullPath, ok := s.resolvePath(w, r, r.URL.Query().Get("repo"), filePath)
+	if !ok {
+		return
+	}
+	// The slot is held until the response is written, since the content
+	// stays in memory until then
+	if !s.acquireRead(w, r) {
 		return
 	}
-	
-	// Construct full file path relative to working directory
-	fullPath := filepath.Join(s.workingDir, filePath)
-	
+	defer s.releaseRead()
+
 	// Read file content
-	content, err := os.ReadFile(fullPath)
+	content, info, hash, err := s.readServedFile(fullPath)
 	if err != nil {
-		log.Printf("Error reading file %s: %v", fullPath, err)
-		http.Error(w, fmt.Sprintf("File not found: %v", err), http.StatusNotFound)
+		s.logger.Warn("Failed to read file", "path", fullPath, "err", err)
+		s.writeError(w, r, http.StatusNotFound, CodeFileNotFound, i18n.MsgFileNotFound, err)
 		return
 	}
-	
-	log.Printf("Serving file: %s (%d bytes)", filePath, len(content))
-	
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"filePath": filePath,
-		"content":  string(content),
-		"status":   "success",
-	})
+
+	s.metrics.FileRequest(metrics.FileServed)
+
+	// Clients revalidate cached copies against the content hash
+	etag := hashETag(hash)
+	w.Header().Set("Cache-Control", "no-cache")
+	if notModified(w, r, etag) {
+		return
+	}
+
+	// Boxing the arguments allocates even when debug is off, on the hottest path
+	if s.logger.Enabled(r.Context(), slog.LevelDebug) {
+		s.logger.Debug("Serving file", "path", filePath, "bytes", len(content), "remote", r.RemoteAddr)
+	}
+
+	modTime := info.ModTime().UTC()
+	response := &api.File{
+		Header:   api.Current,
+		Status:   "success",
+		FilePath: filePath,
+		Size:     int64(len(content)),
+		ModTime:  &modTime,
+		SHA256:   hash,
+	}
+	response.SetContent(content)
+
+	// Seal the payload for agents that can decrypt it; older agents get
+	// plaintext. The ETag header is left off sealed responses so the
+	// content hash isn't visible on the wire.
+	caller, signed := peerFromContext(r.Context())
+	if signed && s.identity != nil && r.Header.Get(crypto.HeaderAcceptEncryption) == crypto.TransferScheme {
+		s.writeSealed(w, r, caller, response, len(content))
+		return
+	}
+
+	w.Header().Set("ETag", etag)
+	s.writeFileJSON(w, r, response)
+}
+
+// readFile reads a file along with its metadata from the same open handle
+func readFile(path string) ([]byte, os.FileInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	if info.IsDir() {
+		return nil, nil, fmt.Errorf("%s is a directory", path)
+	}
+	content, err := io.ReadAll(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	return content, info, nil
+}
+
+// writeSealed encrypts a JSON response to the calling agent's key,
+// compressing first when negotiated
+func (s *Server) writeSealed(w http.ResponseWriter, r *http.Request, caller *callerPeer, response interface{}, size int) {
+	header, sealer, err := s.identity.SealTransfer(w, caller.Key)
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, CodeInternal, i18n.MsgEncryptFailed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set(crypto.HeaderEncryption, crypto.TransferScheme)
+	w.Header().Set(crypto.HeaderTransferKey, header)
+	body, closeBody := s.sealedBody(w, r, sealer, size)
+	if err := json.NewEncoder(body).Encode(response); err != nil {
+		s.logger.Error("Encrypted transfer failed", "remote", r.RemoteAddr, "err", err)
+		return
+	}
+	if err := closeBody(); err != nil {
+		s.logger.Error("Encrypted transfer failed", "remote", r.RemoteAddr, "err", err)
+		return
+	}
+	if err := sealer.Close(); err != nil {
+		s.logger.Error("Encrypted transfer failed", "remote", r.RemoteAddr, "err", err)
+	}
+}
+
+// resolvePath maps a repo-relative path into its root's sandbox, writing an
+// error response and returning false if the repo is unknown or the path escapes it
+func (s *Server) resolvePath(w http.ResponseWriter, r *http.Request, repo, relPath string) (string, bool) {
+	root, ok := s.lookupRoot(w, r, repo)
+	if !ok {
+		return "", false
+	}
+
+	fullPath, err := root.Resolve(relPath)
+	if err != nil {
+		s.metrics.FileRequest(metrics.FileDenied)
+		s.writeError(w, r, http.StatusForbidden, CodePathForbidden, i18n.MsgPathForbidden)
+		return "", false
+	}
+	return fullPath, true
+}
+
+// lookupRoot finds the named root, or the default one for an empty name,
+// writing an error response and returning false if there's no such root
+func (s *Server) lookupRoot(w http.ResponseWriter, r *http.Request, repo string) (*workspace.Root, bool) {
+	root, err := s.workspace.Root(repo)
+	if errors.Is(err, workspace.ErrNoRoots) {
+		s.writeError(w, r, http.StatusServiceUnavailable, CodeNoShareRoot, i18n.MsgNoShareRoot)
+		return nil, false
+	}
+	if err != nil {
+		s.writeError(w, r, http.StatusNotFound, CodeRepoNotFound, i18n.MsgRepoNotFound, repo)
+		return nil, false
+	}
+	return root, true
 }
 
 func (s *Server) handleAddMockPeer(w http.ResponseWriter, r *http.Request) {
@@ -266,59 +941,207 @@ func (s *Server) handleAddMockPeer(w http.ResponseWriter, r *http.Request) {
 		LastSeen:   time.Now(),
 		Trusted:    false,
 	}
-	
+
 	s.registry.Add(mockPeer)
-	log.Printf("Added mock peer: %s", mockPeer.Name)
-	
+	s.logger.Info("Added mock peer", "peerId", mockPeer.ID, "peer", mockPeer.Name)
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"status": "added"})
 }
 
 func (s *Server) handleSessionCreate(w http.ResponseWriter, r *http.Request) {
 	var req struct {
+		Repo      string `json:"repo"` // default the default root
 		FilePath  string `json:"filePath"`
 		Initiator string `json:"initiator"`
+		Name      string `json:"name"`            // the initiator's display name
+		Color     string `json:"color"`           // the initiator's cursor color; default the first the session assigns
+		Force     bool   `json:"force"`           // open a file over the session size limit anyway
+		Max       *int   `json:"maxParticipants"` // default -session-max-participants; 0 is no cap
 	}
-	
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+
+	if err := api.DecodeLocal(r.Body, &req); err != nil || strings.TrimSpace(req.Initiator) == "" ||
+		api.CheckParticipant(req.Name, req.Color, "") != nil || (req.Max != nil && *req.Max < 0) {
+		s.writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, i18n.MsgInvalidRequest)
+		return
+	}
+
+	// The session records the root by name, so it's clear which repo the
+	// file is in even when the request left it to the default
+	root, ok := s.lookupRoot(w, r, req.Repo)
+	if !ok {
 		return
 	}
-	
+	if req.FilePath != "" {
+		fullPath, err := root.Resolve(req.FilePath)
+		if err != nil {
+			s.writeError(w, r, http.StatusForbidden, CodePathForbidden, i18n.MsgPathForbidden)
+			return
+		}
+		// A file that doesn't exist yet may still be co-edited into being
+		if info, err := os.Stat(fullPath); err == nil && !req.Force && s.sessionFileTooLarge(w, r, info.Size()) {
+			return
+		}
+	}
+
 	// Generate session ID
 	sessionID := fmt.Sprintf("session-%d", time.Now().UnixNano())
-	
-	session := s.sessionMgr.Create(sessionID, req.FilePath, req.Initiator)
-	log.Printf("Created session: %s for file %s", sessionID, req.FilePath)
-	
+
+	maxParticipants := s.settings.Load().maxParticipants
+	if req.Max != nil {
+		maxParticipants = *req.Max
+	}
+	initiator := sessions.Member{ID: req.Initiator, Name: req.Name, Color: req.Color}
+	session, err := s.sessionMgr.Create(sessionID, root.Name, req.FilePath, initiator, maxParticipants)
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, CodeInternal, i18n.MsgSessionCreateFailed)
+		return
+	}
+	s.logger.Info("Created session", "session", sessionID, "repo", root.Name, "path", req.FilePath)
+
+	syncToken, err := s.sessionMgr.ParticipantToken(session.ID, req.Initiator)
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, CodeInternal, i18n.MsgSessionCreateFailed)
+		return
+	}
+	reconnectToken, err := s.reconnects.Issue(session.ID, req.Initiator, sessions.RoleInitiator)
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, CodeInternal, i18n.MsgReconnectIssueFailed)
+		return
+	}
+	response := map[string]interface{}{
+		"sessionId":       session.ID,
+		"repo":            session.Repo,
+		"filePath":        session.FilePath,
+		"maxParticipants": session.MaxParticipants,
+		"syncToken":       syncToken.Reveal(),
+		"reconnectToken":  reconnectToken.Reveal(),
+		"wsUrl":           fmt.Sprintf("%s://%s%s", s.wsScheme(), s.syncHostPort(), syncPath(session.ID, syncToken)),
+		"chatUrl":         fmt.Sprintf("%s://%s%s", s.wsScheme(), s.syncHostPort(), chatPath(session.ID, syncToken)),
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"sessionId": session.ID,
-		"filePath":  session.FilePath,
-		"wsUrl":     fmt.Sprintf("ws://localhost:%d/ws/sync/%s", s.httpPort, session.ID),
-	})
+	json.NewEncoder(w).Encode(response)
 }
 
 func (s *Server) handleSessionJoin(w http.ResponseWriter, r *http.Request) {
-	var req struct {
-		SessionID     string `json:"sessionId"`
-		ParticipantID string `json:"participantId"`
+	// Other agents join too, and may run a different release
+	var req api.JoinRequest
+	var err error
+	if _, fromPeer := peerFromContext(r.Context()); fromPeer {
+		err = api.DecodePeer(r.Body, &req, s.logger)
+	} else {
+		err = api.DecodeLocal(r.Body, &req)
+	}
+	if err != nil {
+		s.writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, i18n.MsgInvalidRequest)
+		return
+	}
+	if !s.checkSessionID(w, r, req.SessionID) {
+		return
+	}
+
+	member := sessions.Member{ID: req.ParticipantID, Name: req.Name, Color: req.Color, Role: req.Role}
+	if caller, fromPeer := peerFromContext(r.Context()); fromPeer {
+		member.Agent = caller.Fingerprint
+	}
+	switch err := s.sessionMgr.AddParticipant(req.SessionID, member); {
+	case errors.Is(err, sessions.ErrAlreadyParticipant):
+		// Joining again is for the participant, and whoever else names them
+		// would get their tokens and role
+		if !s.joinsAsThemselves(req, member.Agent) {
+			s.writeErrorFor(w, r, http.StatusConflict, CodeParticipantExists, err)
+			return
+		}
+	case errors.Is(err, sessions.ErrSessionFull):
+		s.writeErrorFor(w, r, http.StatusConflict, CodeSessionFull, err)
+		return
+	case err != nil:
+		s.writeError(w, r, http.StatusNotFound, CodeSessionNotFound, i18n.MsgSessionNotFound)
+		return
+	}
+
+	session, ok := s.sessionMgr.Get(req.SessionID)
+	if !ok {
+		s.writeError(w, r, http.StatusNotFound, CodeSessionNotFound, i18n.MsgSessionNotFound)
+		return
+	}
+	role := sessions.RoleParticipant
+	if session.Initiator == req.ParticipantID {
+		role = sessions.RoleInitiator
 	}
-	
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+	syncToken, err := s.sessionMgr.ParticipantToken(req.SessionID, req.ParticipantID)
+	if err != nil {
+		// They left, or the session ended, since joining
+		s.writeError(w, r, http.StatusNotFound, CodeSessionNotFound, i18n.MsgSessionNotFound)
 		return
 	}
-	
-	if !s.sessionMgr.AddParticipant(req.SessionID, req.ParticipantID) {
-		http.Error(w, "Session not found", http.StatusNotFound)
+	token, err := s.reconnects.Issue(req.SessionID, req.ParticipantID, role)
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, CodeInternal, i18n.MsgReconnectIssueFailed)
 		return
 	}
-	
-	log.Printf("Participant %s joined session %s", req.ParticipantID, req.SessionID)
-	
+
+	s.logger.Info("Participant joined session", "session", req.SessionID, "participant", req.ParticipantID)
+
+	response := api.JoinResponse{
+		Header:         api.Current,
+		Status:         "joined",
+		Role:           role,
+		ReconnectToken: token.Reveal(),
+		SyncToken:      syncToken.Reveal(),
+		WSPath:         syncPath(session.ID, syncToken),
+		// Joining peers dial wsPath on this port rather than the one they
+		// called; zero leaves it out
+		WSPort: syncPort(s.syncAddr),
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"status": "joined"})
+	json.NewEncoder(w).Encode(response)
+}
+
+// joinsAsThemselves reports whether a join naming a participant already in
+// the session proves it's from them: it carries their sync or reconnection
+// token, or comes from the agent that joined them
+func (s *Server) joinsAsThemselves(req api.JoinRequest, agent string) bool {
+	if s.sessionMgr.Recognizes(req.SessionID, req.ParticipantID, req.Token, agent) {
+		return true
+	}
+	if req.Token == "" {
+		return false
+	}
+	rejoin, err := s.reconnects.Redeem(req.SessionID, req.Token)
+	return err == nil && rejoin.ParticipantID == req.ParticipantID
+}
+
+// checkSessionID answers 400 for a session ID that isn't well formed, so
+// clients sending one learn it's their mistake rather than a session that
+// ended, and reports whether id was fine
+func (s *Server) checkSessionID(w http.ResponseWriter, r *http.Request, id string) bool {
+	if sessions.ValidID(id) {
+		return true
+	}
+	s.writeErrorFor(w, r, http.StatusBadRequest, CodeInvalidSessionID, sessions.ErrInvalidSessionID)
+	return false
+}
+
+// syncPort returns the port of the sync-only listener address, or 0
+func syncPort(addr string) int {
+	_, port, _ := net.SplitHostPort(addr)
+	n, _ := strconv.Atoi(port)
+	return n
+}
+
+// syncPath is a participant's sync socket path for a session, carrying
+// their token
+func syncPath(sessionID string, token redact.Secret) string {
+	return fmt.Sprintf("/ws/sync/%s?sync=%s", sessionID, token.Reveal())
+}
+
+// chatPath is a participant's chat socket path for a session, carrying
+// their token
+func chatPath(sessionID string, token redact.Secret) string {
+	return fmt.Sprintf("/ws/chat/%s?sync=%s", sessionID, token.Reveal())
 }
 
 func (s *Server) handleSessionLeave(w http.ResponseWriter, r *http.Request) {
@@ -326,115 +1149,345 @@ func (s *Server) handleSessionLeave(w http.ResponseWriter, r *http.Request) {
 		SessionID     string `json:"sessionId"`
 		ParticipantID string `json:"participantId"`
 	}
-	
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+
+	if err := api.DecodeLocal(r.Body, &req); err != nil || req.ParticipantID == "" {
+		s.writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, i18n.MsgInvalidRequest)
+		return
+	}
+	if !s.checkSessionID(w, r, req.SessionID) {
+		return
+	}
+	// A session another agent hosts is left by dropping the bridge into it
+	if s.leaveBridge(req.SessionID, req.ParticipantID) {
+		s.logger.Info("Participant left bridged session", "session", req.SessionID, "participant", req.ParticipantID)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "left"})
 		return
 	}
-	
+	if _, exists := s.sessionMgr.Get(req.SessionID); !exists {
+		s.writeError(w, r, http.StatusNotFound, CodeSessionNotFound, i18n.MsgSessionNotFound)
+		return
+	}
+
 	s.sessionMgr.RemoveParticipant(req.SessionID, req.ParticipantID)
-	log.Printf("Participant %s left session %s", req.ParticipantID, req.SessionID)
-	
+	s.reconnects.Revoke(req.SessionID, req.ParticipantID)
+	s.logger.Info("Participant left session", "session", req.SessionID, "participant", req.ParticipantID)
+	if _, exists := s.sessionMgr.Get(req.SessionID); !exists {
+		s.chat.Forget(req.SessionID)
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"status": "left"})
 }
 
 func (s *Server) handleGetSessions(w http.ResponseWriter, r *http.Request) {
 	sessions := s.sessionMgr.GetAll()
-	
+	for _, session := range sessions {
+		session.Connected = s.hub.Participants(session.ID)
+	}
+
+	writeList(s, w, r, sessionList, sessions)
+}
+
+// handleGetSessionParticipants lists one session's participants with their
+// roles and whether each holds a live sync socket
+func (s *Server) handleGetSessionParticipants(w http.ResponseWriter, r *http.Request) {
+	sessionID := mux.Vars(r)["id"]
+	participants, err := s.sessionMgr.Participants(sessionID)
+	if err != nil {
+		s.writeErrorFor(w, r, http.StatusNotFound, CodeSessionNotFound, err)
+		return
+	}
+
+	writeList(s, w, r, participantList.with(map[string]interface{}{
+		"sessionId": sessionID,
+	}), participants)
+}
+
+// handleSessionRole makes a participant an editor or a viewer. Only the
+// session's initiator may; a viewer's connection stops having its document
+// updates relayed, or starts again, at once.
+func (s *Server) handleSessionRole(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Initiator     string `json:"initiator"` // who's asking; must have started the session
+		ParticipantID string `json:"participantId"`
+		Role          string `json:"role"`
+	}
+
+	if err := api.DecodeLocal(r.Body, &req); err != nil || req.Role == "" || api.CheckParticipant("", "", req.Role) != nil {
+		s.writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, i18n.MsgInvalidRequest)
+		return
+	}
+
+	sessionID := mux.Vars(r)["id"]
+	member, err := s.sessionMgr.SetRole(sessionID, req.Initiator, req.ParticipantID, req.Role)
+	switch {
+	case errors.Is(err, sessions.ErrSessionNotFound):
+		s.writeErrorFor(w, r, http.StatusNotFound, CodeSessionNotFound, err)
+		return
+	case errors.Is(err, sessions.ErrNotInitiator):
+		s.writeErrorFor(w, r, http.StatusForbidden, CodeNotInitiator, err)
+		return
+	case errors.Is(err, sessions.ErrNotParticipant):
+		s.writeErrorFor(w, r, http.StatusNotFound, CodeNotParticipant, err)
+		return
+	case err != nil:
+		s.writeErrorFor(w, r, http.StatusBadRequest, CodeInvalidRequest, err)
+		return
+	}
+	s.logger.Info("Participant role changed", "session", sessionID, "participant", member.ID, "role", member.Role)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(member)
+}
+
+// handleGetSessionChat lists a live session's recent chat, oldest first,
+// for participants who weren't connected when it was sent
+func (s *Server) handleGetSessionChat(w http.ResponseWriter, r *http.Request) {
+	sessionID := mux.Vars(r)["id"]
+	if _, exists := s.sessionMgr.Get(sessionID); !exists {
+		s.writeError(w, r, http.StatusNotFound, CodeSessionNotFound, i18n.MsgSessionNotFound)
+		return
+	}
+
+	writeList(s, w, r, chatList.with(map[string]interface{}{
+		"sessionId": sessionID,
+	}), s.chat.History(sessionID))
+}
+
+// handleSessionCapacity changes how many participants a live session
+// takes. Only the session's initiator may, and not below the participants
+// already in it.
+func (s *Server) handleSessionCapacity(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Initiator string `json:"initiator"`       // who's asking; must have started the session
+		Max       *int   `json:"maxParticipants"` // 0 lifts the cap
+	}
+
+	if err := api.DecodeLocal(r.Body, &req); err != nil || req.Max == nil || *req.Max < 0 {
+		s.writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, i18n.MsgInvalidRequest)
+		return
+	}
+
+	sessionID := mux.Vars(r)["id"]
+	session, err := s.sessionMgr.SetMaxParticipants(sessionID, req.Initiator, *req.Max)
+	switch {
+	case errors.Is(err, sessions.ErrSessionNotFound):
+		s.writeErrorFor(w, r, http.StatusNotFound, CodeSessionNotFound, err)
+		return
+	case errors.Is(err, sessions.ErrNotInitiator):
+		s.writeErrorFor(w, r, http.StatusForbidden, CodeNotInitiator, err)
+		return
+	case errors.Is(err, sessions.ErrCapBelowOccupancy):
+		s.writeErrorFor(w, r, http.StatusConflict, CodeSessionFull, err)
+		return
+	case err != nil:
+		s.writeErrorFor(w, r, http.StatusInternalServerError, CodeInternal, err)
+		return
+	}
+	s.logger.Info("Session cap changed", "session", sessionID, "maxParticipants", session.MaxParticipants)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"sessionId":       session.ID,
+		"maxParticipants": session.MaxParticipants,
+		"occupancy":       session.Occupancy,
+	})
+}
+
+// handleGetSessionStats reports each connected session's relay load,
+// busiest first
+func (s *Server) handleGetSessionStats(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"sessions": sessions,
+		"sessions": s.hub.Loads(),
 	})
 }
 
 func (s *Server) handleYjsSync(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	sessionID := vars["sessionId"]
-	
+	if !s.checkSessionID(w, r, sessionID) {
+		return
+	}
+
 	// Check if session exists
 	session, exists := s.sessionMgr.Get(sessionID)
 	if !exists {
-		http.Error(w, "Session not found", http.StatusNotFound)
+		s.writeError(w, r, http.StatusNotFound, CodeSessionNotFound, i18n.MsgSessionNotFound)
 		return
 	}
-	
+
+	// The socket speaks for whoever the token was issued to: a participant
+	// token from create or join, or a reconnection token, which also puts a
+	// participant who dropped back in the session
+	participantID, reconnect, ok := s.socketParticipant(w, r, sessionID, true)
+	if !ok {
+		return
+	}
+
 	// Upgrade to WebSocket
-	conn, err := upgrader.Upgrade(w, r, nil)
+	conn, err := s.upgrader().Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("WebSocket upgrade failed: %v", err)
+		s.logger.Warn("WebSocket upgrade failed", "remote", r.RemoteAddr, "err", err)
 		return
 	}
 	defer conn.Close()
-	
-	log.Printf("WebSocket connected for session %s (file: %s)", sessionID, session.FilePath)
-	
-	// Simple message relay for Yjs
-	// In production, this would relay binary Yjs update messages between all connected clients
+
+	// A full session turns a rejoining participant away with a close frame
+	// browsers can read, where an HTTP error before the upgrade would be
+	// opaque to them
+	if reconnect {
+		err = s.sessionMgr.AddParticipant(sessionID, sessions.Member{ID: participantID})
+		if err == sessions.ErrAlreadyParticipant {
+			err = nil
+		}
+		if err == sessions.ErrSessionFull {
+			s.logger.Info("Refusing connection to full session", "session", sessionID, "participant", participantID)
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(sessions.CloseFull, err.Error()), time.Now().Add(time.Second))
+			return
+		}
+		if err != nil {
+			// The session ended since it was looked up
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, err.Error()), time.Now().Add(time.Second))
+			return
+		}
+	}
+
+	client, err := s.hub.Register(sessionID, participantID, conn)
+	if err == sessions.ErrShuttingDown {
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, err.Error()), time.Now().Add(time.Second))
+		return
+	}
+	if err != nil {
+		s.logger.Info("Refusing duplicate connection", "session", sessionID, "participant", participantID)
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(sessions.CloseDuplicate, err.Error()), time.Now().Add(time.Second))
+		return
+	}
+
+	s.reconnects.Connected(sessionID, participantID)
+	s.logger.Info("WebSocket connected", "session", sessionID, "path", session.FilePath, "participant", participantID)
+
+	// Relay Yjs messages to every other participant in the session. Edits
+	// from the editor on this machine count as activity; its awareness is
+	// renewed on a timer, so that doesn't.
+	local := isLoopback(r.RemoteAddr)
 	for {
 		messageType, message, err := conn.ReadMessage()
 		if err != nil {
-			log.Printf("WebSocket read error: %v", err)
+			if !s.hub.Unresponsive(client, err) && !websocket.IsCloseError(err, sessions.CloseReplaced, websocket.CloseGoingAway) {
+				s.logger.Debug("WebSocket read failed", "session", sessionID, "participant", participantID, "err", err)
+			}
 			break
 		}
-		
-		log.Printf("Received Yjs message: %d bytes", len(message))
-		
-		// TODO: Broadcast to all other participants in the session
-		// For now, just echo back
-		if err := conn.WriteMessage(messageType, message); err != nil {
-			log.Printf("WebSocket write error: %v", err)
-			break
+
+		if local && !sessions.IsAwareness(message) {
+			s.noteActivity()
 		}
+		s.hub.Broadcast(client, messageType, message)
 	}
-	
-	log.Printf("WebSocket closed for session %s", sessionID)
-}
-
-// Middleware
 
-func corsMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-		
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
-		}
-		
-		next.ServeHTTP(w, r)
-	})
+	if s.hub.Unregister(client) {
+		s.reconnects.Disconnected(sessionID, participantID)
+		s.logger.Info("WebSocket closed; participant left", "session", sessionID, "participant", participantID)
+	} else {
+		s.logger.Debug("WebSocket replaced; participant still connected", "session", sessionID, "participant", participantID)
+	}
 }
 
-// WebSocket handlers (placeholder for future implementation)
+// handleChat relays a session's chat. It takes the participant token like
+// the sync socket; the participant it was issued to is the author of what
+// the socket sends.
+func (s *Server) handleChat(w http.ResponseWriter, r *http.Request) {
+	sessionID := mux.Vars(r)["sessionId"]
+	if !s.checkSessionID(w, r, sessionID) {
+		return
+	}
+	if _, exists := s.sessionMgr.Get(sessionID); !exists {
+		s.writeError(w, r, http.StatusNotFound, CodeSessionNotFound, i18n.MsgSessionNotFound)
+		return
+	}
+	participantID, _, ok := s.socketParticipant(w, r, sessionID, false)
+	if !ok {
+		return
+	}
 
-func (s *Server) handleWebSocketConnection(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+	conn, err := s.upgrader().Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("WebSocket upgrade failed: %v", err)
+		s.logger.Warn("WebSocket upgrade failed", "remote", r.RemoteAddr, "err", err)
 		return
 	}
 	defer conn.Close()
-	
-	log.Println("WebSocket connection established")
-	
-	// TODO: Implement WebSocket message handling
+	conn.SetReadLimit(sessions.MaxChatFrame)
+
+	client, err := s.chat.Join(sessionID, participantID, conn)
+	if err == sessions.ErrShuttingDown {
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, err.Error()), time.Now().Add(time.Second))
+		return
+	}
+	if err != nil {
+		s.logger.Info("Refusing duplicate chat connection", "session", sessionID, "participant", participantID)
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(sessions.CloseDuplicate, err.Error()), time.Now().Add(time.Second))
+		return
+	}
+	s.logger.Debug("Chat connected", "session", sessionID, "participant", participantID)
+
 	for {
 		messageType, message, err := conn.ReadMessage()
 		if err != nil {
-			log.Printf("WebSocket read error: %v", err)
+			if !websocket.IsCloseError(err, sessions.CloseReplaced, websocket.CloseGoingAway) {
+				s.logger.Debug("Chat read failed", "session", sessionID, "participant", participantID, "err", err)
+			}
 			break
 		}
-		
-		log.Printf("Received: %s", message)
-		
-		// Echo back for now
-		if err := conn.WriteMessage(messageType, message); err != nil {
-			log.Printf("WebSocket write error: %v", err)
-			break
+		if isLoopback(r.RemoteAddr) {
+			s.noteActivity()
+		}
+		if err := s.chat.Receive(client, messageType, message); err != nil {
+			s.logger.Debug("Refused chat message", "session", sessionID, "participant", participantID, "err", err)
 		}
 	}
+	s.chat.Leave(client)
 }
 
+// socketParticipant returns who a session socket request speaks for, taken
+// from its token: the participant a token from create or join was issued
+// to, or, where reconnecting is allowed, the one a reconnection token
+// restores. Anything else is answered 401, and ok is false.
+func (s *Server) socketParticipant(w http.ResponseWriter, r *http.Request, sessionID string, allowReconnect bool) (participantID string, reconnect, ok bool) {
+	query := r.URL.Query()
+	if member, ok := s.sessionMgr.Identify(sessionID, query.Get("sync")); ok {
+		return member.ID, false, true
+	}
+	if token := query.Get("reconnect"); allowReconnect && token != "" {
+		rejoin, err := s.reconnects.Redeem(sessionID, token)
+		if err != nil {
+			s.writeErrorFor(w, r, http.StatusUnauthorized, CodeSessionToken, err)
+			return "", false, false
+		}
+		s.logger.Info("Participant rejoining session", "session", sessionID, "participant", rejoin.ParticipantID, "role", rejoin.Role)
+		return rejoin.ParticipantID, true, true
+	}
+	s.writeError(w, r, http.StatusUnauthorized, CodeSessionToken, i18n.MsgSessionToken)
+	return "", false, false
+}
+
+// Middleware
+
+func (s *Server) corsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if origin := r.Header.Get("Origin"); origin != "" && s.originAllowed(origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		w.Header().Add("Vary", "Origin")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+
+		if r.Method == "OPTIONS" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
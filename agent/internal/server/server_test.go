@@ -0,0 +1,277 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/zeropr/agent/internal/sessions"
+	"github.com/zeropr/agent/internal/wire"
+)
+
+// update returns a y-websocket sync message carrying a one-byte document
+// update, marked so the receiving end can tell who sent it
+func update(mark byte) []byte {
+	return []byte{0, 2, 1, mark}
+}
+
+// relayedUntil reads the updates relayed to conn until the one marked
+// until, returning the marks of those that came before it. A read that
+// times out breaks the connection, so tests wait for an update they know
+// is coming rather than for the absence of one.
+func relayedUntil(t *testing.T, conn *websocket.Conn, until byte) []byte {
+	t.Helper()
+	var before []byte
+	for {
+		data := readBinary(t, conn, 2*time.Second)
+		if data == nil {
+			t.Fatalf("update %q never arrived", until)
+		}
+		mark := data[len(data)-1]
+		if mark == until {
+			return before
+		}
+		before = append(before, mark)
+	}
+}
+
+func TestCreateNeedsInitiator(t *testing.T) {
+	a := newTestAgent(t)
+	for _, body := range []string{`{"filePath":"main.go"}`, `{"filePath":"main.go","initiator":"  "}`} {
+		if status, data := a.do(t, http.MethodPost, "/api/session/create", body, nil); status != http.StatusBadRequest {
+			t.Errorf("create %s = %d %s, want 400", body, status, data)
+		}
+	}
+}
+
+func TestJoinNeedsParticipant(t *testing.T) {
+	a := newTestAgent(t)
+	session := a.createSession(t, "alice")
+	for _, participant := range []string{"", "   "} {
+		body := `{"sessionId":"` + session.SessionID + `","participantId":"` + participant + `"}`
+		if status, data := a.do(t, http.MethodPost, "/api/session/join", body, nil); status != http.StatusBadRequest {
+			t.Errorf("join as %q = %d %s, want 400", participant, status, data)
+		}
+	}
+}
+
+func TestParticipantsGetTheirOwnTokens(t *testing.T) {
+	a := newTestAgent(t)
+	session := a.createSession(t, "alice")
+	bob := a.join(t, session.SessionID, "bob", "")
+	carol := a.join(t, session.SessionID, "carol", "")
+
+	tokens := map[string]bool{session.SyncToken: true, bob.SyncToken: true, carol.SyncToken: true}
+	if len(tokens) != 3 || tokens[""] {
+		t.Fatalf("sync tokens %q, %q, %q; want three different ones", session.SyncToken, bob.SyncToken, carol.SyncToken)
+	}
+	if !strings.Contains(bob.WSPath, "?sync="+bob.SyncToken) {
+		t.Errorf("wsPath %q doesn't carry bob's token", bob.WSPath)
+	}
+	if !strings.Contains(session.WSURL, "?sync="+session.SyncToken) || !strings.Contains(session.ChatURL, "?sync="+session.SyncToken) {
+		t.Errorf("create's URLs %q, %q don't carry the initiator's token", session.WSURL, session.ChatURL)
+	}
+
+	// Joining again, as bob can prove he is, hands back the same token
+	var again joinedSession
+	a.post(t, "/api/session/join", `{"sessionId":"`+session.SessionID+`","participantId":"bob","token":"`+bob.SyncToken+`"}`, &again)
+	if again.SyncToken != bob.SyncToken {
+		t.Errorf("bob's token changed on joining again")
+	}
+}
+
+func TestSocketsRefuseUnknownParticipants(t *testing.T) {
+	a := newTestAgent(t)
+	session := a.createSession(t, "alice")
+	bob := a.join(t, session.SessionID, "bob", "")
+	a.post(t, "/api/session/leave", `{"sessionId":"`+session.SessionID+`","participantId":"bob"}`, nil)
+
+	for _, socket := range []string{"/ws/sync/", "/ws/chat/"} {
+		for name, query := range map[string]string{
+			"no token":            "",
+			"participant only":    "?participant=alice",
+			"unknown token":       "?sync=0123456789abcdef",
+			"left's token":        "?sync=" + bob.SyncToken,
+			"another's reconnect": "?sync=" + session.ReconnectToken,
+		} {
+			if _, status := a.dial(t, socket+session.SessionID+query); status != http.StatusUnauthorized {
+				t.Errorf("%s with %s = %d, want 401", socket, name, status)
+			}
+		}
+	}
+}
+
+// TestIdentityComesFromToken has a viewer connect naming the initiator on
+// the URL: the socket is still theirs, so their edits are dropped
+func TestIdentityComesFromToken(t *testing.T) {
+	a := newTestAgent(t)
+	session := a.createSession(t, "alice")
+	viewer := a.join(t, session.SessionID, "bob", "viewer")
+	editor := a.join(t, session.SessionID, "carol", "editor")
+
+	alice, _ := a.dial(t, "/ws/sync/"+session.SessionID+"?sync="+session.SyncToken)
+	bob, _ := a.dial(t, "/ws/sync/"+session.SessionID+"?sync="+viewer.SyncToken+"&participant=alice")
+	carol, _ := a.dial(t, "/ws/sync/"+session.SessionID+"?sync="+editor.SyncToken)
+	waitConnected(t, a, session.SessionID, 3)
+
+	if err := bob.WriteMessage(websocket.BinaryMessage, update('b')); err != nil {
+		t.Fatal(err)
+	}
+	if err := carol.WriteMessage(websocket.BinaryMessage, update('c')); err != nil {
+		t.Fatal(err)
+	}
+	if before := relayedUntil(t, alice, 'c'); len(before) > 0 {
+		t.Errorf("a viewer claiming to be the initiator had updates relayed: %q", before)
+	}
+}
+
+func TestChatAuthorComesFromToken(t *testing.T) {
+	a := newTestAgent(t)
+	session := a.createSession(t, "alice")
+	bob := a.join(t, session.SessionID, "bob", "")
+
+	alice, _ := a.dial(t, "/ws/chat/"+session.SessionID+"?sync="+session.SyncToken)
+	impostor, _ := a.dial(t, "/ws/chat/"+session.SessionID+"?sync="+bob.SyncToken+"&participant=alice")
+	if err := impostor.WriteJSON(map[string]string{"text": "hi", "author": "alice"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var message struct {
+		Author string `json:"author"`
+		Text   string `json:"text"`
+	}
+	readJSON(t, alice, "chat", time.Second, &message)
+	if message.Author != "bob" || message.Text != "hi" {
+		t.Errorf("chat = %+v, want bob saying hi", message)
+	}
+}
+
+func TestReconnectTokenRestoresParticipant(t *testing.T) {
+	a := newTestAgent(t)
+	session := a.createSession(t, "alice")
+	viewer := a.join(t, session.SessionID, "bob", "viewer")
+	editor := a.join(t, session.SessionID, "carol", "")
+	alice, _ := a.dial(t, "/ws/sync/"+session.SessionID+"?sync="+session.SyncToken)
+	carol, _ := a.dial(t, "/ws/sync/"+session.SessionID+"?sync="+editor.SyncToken)
+
+	// The reconnection token stands in for bob's, whoever the URL names
+	bob, status := a.dial(t, "/ws/sync/"+session.SessionID+"?reconnect="+viewer.ReconnectToken+"&participant=alice")
+	if status != http.StatusSwitchingProtocols {
+		t.Fatalf("reconnect = %d", status)
+	}
+	waitConnected(t, a, session.SessionID, 3)
+	bob.WriteMessage(websocket.BinaryMessage, update('b'))
+	carol.WriteMessage(websocket.BinaryMessage, update('c'))
+	if before := relayedUntil(t, alice, 'c'); len(before) > 0 {
+		t.Errorf("a reconnected viewer had updates relayed: %q", before)
+	}
+}
+
+// waitConnected waits until n participants have a live sync socket
+func waitConnected(t *testing.T, a *testAgent, sessionID string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if a.srv.hub.Participants(sessionID) >= n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%d participants never connected to %s", n, sessionID)
+}
+
+func TestMembershipFramesReachSockets(t *testing.T) {
+	a := newTestAgent(t)
+	session := a.createSession(t, "alice")
+	alice, _ := a.dial(t, "/ws/sync/"+session.SessionID+"?sync="+session.SyncToken)
+	waitConnected(t, a, session.SessionID, 1)
+	alice.WriteMessage(websocket.TextMessage, []byte(`{"type":"rosterSync","v":1}`))
+	var roster wire.Roster
+	readJSON(t, alice, wire.TypeRoster, 2*time.Second, &roster)
+
+	var change wire.ParticipantChange
+	next := func(frameType string) {
+		t.Helper()
+		change = wire.ParticipantChange{}
+		readJSON(t, alice, frameType, 2*time.Second, &change)
+		if change.SessionID != session.SessionID {
+			t.Errorf("%s for session %q", frameType, change.SessionID)
+		}
+	}
+
+	a.join(t, session.SessionID, "bob", "")
+	next(wire.TypeParticipantJoined)
+	if change.ParticipantID != "bob" || strings.Join(change.Participants, ",") != "alice,bob" || len(change.Members) != 2 || change.Members[1].Color == "" {
+		t.Errorf("bob joining: %+v", change)
+	}
+
+	a.post(t, "/api/session/"+session.SessionID+"/role", `{"initiator":"alice","participantId":"bob","role":"viewer"}`, nil)
+	next(wire.TypeParticipantRole)
+	if change.ParticipantID != "bob" || change.Role != "viewer" {
+		t.Errorf("bob made a viewer: %+v", change)
+	}
+
+	a.post(t, "/api/session/leave", `{"sessionId":"`+session.SessionID+`","participantId":"bob"}`, nil)
+	next(wire.TypeParticipantLeft)
+	if change.ParticipantID != "bob" || strings.Join(change.Participants, ",") != "alice" {
+		t.Errorf("bob leaving: %+v", change)
+	}
+}
+
+// TestJoinAsExistingParticipant checks joining under the ID of someone
+// already in the session is refused unless the caller proves it's them,
+// so nobody gets another participant's tokens or the initiator's role
+func TestJoinAsExistingParticipant(t *testing.T) {
+	host, guest := newPairedAgents(t)
+	session := host.createSession(t, "alice")
+	bob := host.join(t, session.SessionID, "bob", "")
+
+	joinAs := func(participant, token string) (int, []byte, joinedSession) {
+		body, _ := json.Marshal(map[string]string{"sessionId": session.SessionID, "participantId": participant, "token": token})
+		var joined joinedSession
+		status, data := host.do(t, http.MethodPost, "/api/session/join", string(body), &joined)
+		return status, data, joined
+	}
+	for name, tc := range map[string]struct{ participant, token string }{
+		"the initiator":                       {"alice", ""},
+		"bob":                                 {"bob", ""},
+		"the initiator with bob's sync token": {"alice", bob.SyncToken},
+		"the initiator with bob's reconnect token": {"alice", bob.ReconnectToken},
+		"bob with an unknown token":                {"bob", "0123456789abcdef"},
+	} {
+		status, data, _ := joinAs(tc.participant, tc.token)
+		if status != http.StatusConflict || errorCode(data) != CodeParticipantExists {
+			t.Errorf("joining as %s answered %d %s, want 409", name, status, data)
+		}
+		for _, secret := range []string{session.SyncToken, session.ReconnectToken, bob.SyncToken} {
+			if strings.Contains(string(data), secret) {
+				t.Errorf("joining as %s handed out a token: %s", name, data)
+			}
+		}
+	}
+
+	// bob proves it's him with either of his tokens; each join issues a new
+	// reconnection token, so that one goes first
+	for _, token := range []string{bob.ReconnectToken, bob.SyncToken} {
+		status, data, joined := joinAs("bob", token)
+		if status != http.StatusOK || joined.SyncToken != bob.SyncToken || joined.Role != sessions.RoleParticipant {
+			t.Errorf("bob with his token %s answered %d %s", token, status, data)
+		}
+	}
+
+	// and an agent may join again whoever it joined, but nobody else
+	guest.bridge(t, session.SessionID, "carol", "")
+	guest.bridge(t, session.SessionID, "carol", "")
+	status, data := guest.do(t, http.MethodPost, "/api/session/bridge", `{"peerId":"host","sessionId":"`+session.SessionID+`","participantId":"alice"}`, nil)
+	if status != http.StatusConflict || errorCode(data) != CodeParticipantExists {
+		t.Errorf("bridging in as the initiator answered %d %s, want 409", status, data)
+	}
+
+	current, _ := host.srv.sessionMgr.Get(session.SessionID)
+	if got := strings.Join(current.Participants, ","); got != "alice,bob,carol" {
+		t.Errorf("participants %s", got)
+	}
+}
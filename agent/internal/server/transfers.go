@@ -0,0 +1,361 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/zeropr/agent/internal/i18n"
+	"github.com/zeropr/agent/internal/peerclient"
+	"github.com/zeropr/agent/internal/peers"
+)
+
+// Events published as asynchronous peer file fetches move along. Each
+// carries a Transfer; progress events come at most every progressInterval.
+const (
+	EventTransferStarted   = "transfer.started"
+	EventTransferResumed   = "transfer.resumed"
+	EventTransferProgress  = "transfer.progress"
+	EventTransferDone      = "transfer.done"
+	EventTransferFailed    = "transfer.failed"
+	EventTransferCancelled = "transfer.cancelled"
+	EventTransferRemoved   = "transfer.removed"
+)
+
+// Transfer states
+const (
+	TransferRunning   = "running"
+	TransferDone      = "done"
+	TransferFailed    = "failed"
+	TransferCancelled = "cancelled"
+)
+
+const (
+	// progressInterval throttles transfer.progress events
+	progressInterval = 500 * time.Millisecond
+
+	// transferKeep is how long a finished transfer, and the file it
+	// fetched, stays available to GET /api/transfers/{id}
+	transferKeep = 10 * time.Minute
+
+	// rateWeight is the weight of the newest sample in the rolling rate
+	rateWeight = 0.3
+)
+
+// Transfer is the state of an asynchronous peer file fetch. Bytes and Total
+// count the file's bytes, except from agents too old to serve raw files:
+// those count what crosses the wire, which is compressed and sealed.
+type Transfer struct {
+	ID         string     `json:"id"`
+	PeerID     string     `json:"peerId"`
+	Repo       string     `json:"repo,omitempty"`
+	FilePath   string     `json:"filePath"`
+	State      string     `json:"state"`
+	Bytes      int64      `json:"bytes"`
+	Total      int64      `json:"total"` // -1 until known, or when the peer doesn't say
+	Rate       float64    `json:"bytesPerSecond"`
+	ETASeconds *float64   `json:"etaSeconds,omitempty"`
+	StartedAt  time.Time  `json:"startedAt"`
+	EndedAt    *time.Time `json:"endedAt,omitempty"`
+	Code       string     `json:"code,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	Resumes    int        `json:"resumes,omitempty"`
+	Resumable  bool       `json:"resumable,omitempty"` // a failed transfer that can pick up where it stopped
+}
+
+// transfer is a Transfer in flight, with what it needs to cancel and report
+type transfer struct {
+	Transfer
+	file     map[string]interface{} // the file response, once done
+	peer     *peers.Peer
+	download *peerclient.Download // what has arrived, kept for a resume
+	cancel   context.CancelFunc
+	forget   *time.Timer // drops a finished transfer after transferKeep
+	lastEmit time.Time
+	lastSent int64
+}
+
+// transfers tracks asynchronous peer file fetches
+type transfers struct {
+	ctx    context.Context // parent of every fetch; cancelled on shutdown
+	cancel context.CancelFunc
+	byID   map[string]*transfer
+	mu     sync.Mutex
+}
+
+func newTransfers() *transfers {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &transfers{ctx: ctx, cancel: cancel, byID: make(map[string]*transfer)}
+}
+
+// startTransfer fetches path from peer in the background and returns the
+// transfer tracking it
+func (s *Server) startTransfer(peer *peers.Peer, repo, path string) (Transfer, error) {
+	idBytes := make([]byte, 8)
+	if _, err := rand.Read(idBytes); err != nil {
+		return Transfer{}, err
+	}
+
+	ctx, cancel := context.WithCancel(s.transfers.ctx)
+	t := &transfer{
+		Transfer: Transfer{
+			ID:        hex.EncodeToString(idBytes),
+			PeerID:    peer.ID,
+			Repo:      repo,
+			FilePath:  path,
+			State:     TransferRunning,
+			Total:     -1,
+			StartedAt: time.Now(),
+		},
+		peer:     peer,
+		download: peerclient.NewDownload(repo, path),
+		cancel:   cancel,
+	}
+	t.lastEmit = t.StartedAt
+
+	s.transfers.mu.Lock()
+	s.transfers.byID[t.ID] = t
+	snapshot := t.Transfer
+	s.transfers.mu.Unlock()
+	s.bus.Publish(EventTransferStarted, snapshot)
+	s.logger.Info("Started file transfer", "transfer", t.ID, "peerId", peer.ID, "path", path)
+
+	go s.runTransfer(ctx, t)
+	return snapshot, nil
+}
+
+// runTransfer fetches a transfer's file, continuing from what an earlier
+// attempt left in its download
+func (s *Server) runTransfer(ctx context.Context, t *transfer) {
+	progress := func(read, total int64) {
+		s.transferProgress(t, read, total)
+	}
+	err := s.peerClient.Fetch(ctx, t.peer, t.download, progress)
+	if errors.Is(err, peerclient.ErrChanged) {
+		// The download was reset; start again on the new version
+		s.logger.Info("File changed on peer; restarting transfer", "transfer", t.ID)
+		err = s.peerClient.Fetch(ctx, t.peer, t.download, progress)
+	}
+
+	var file *peerclient.File
+	switch {
+	case err == nil:
+		file = t.download.File()
+	case errors.Is(err, peerclient.ErrRawUnsupported):
+		file, err = s.peerClient.GetFile(ctx, t.peer, t.Repo, t.FilePath, progress)
+	}
+	s.finishTransfer(t, t.peer, file, err)
+}
+
+// transferProgress records read bytes and publishes progress, throttled
+func (s *Server) transferProgress(t *transfer, read, total int64) {
+	now := time.Now()
+	s.transfers.mu.Lock()
+	t.Bytes, t.Total = read, total
+	if read < t.lastSent {
+		// The fetch started over
+		t.lastSent = 0
+	}
+	elapsed := now.Sub(t.lastEmit)
+	if elapsed < progressInterval || t.State != TransferRunning {
+		s.transfers.mu.Unlock()
+		return
+	}
+
+	sample := float64(read-t.lastSent) / elapsed.Seconds()
+	if t.Rate == 0 {
+		t.Rate = sample
+	} else {
+		t.Rate = rateWeight*sample + (1-rateWeight)*t.Rate
+	}
+	t.ETASeconds = nil
+	if total > 0 && t.Rate > 0 {
+		eta := float64(total-read) / t.Rate
+		t.ETASeconds = &eta
+	}
+	t.lastEmit, t.lastSent = now, read
+	snapshot := t.Transfer
+	s.transfers.mu.Unlock()
+
+	s.bus.Publish(EventTransferProgress, snapshot)
+}
+
+// finishTransfer records how a fetch ended and publishes the terminal event.
+// A transfer cancelled through the API already says so.
+func (s *Server) finishTransfer(t *transfer, peer *peers.Peer, file *peerclient.File, err error) {
+	now := time.Now()
+	s.transfers.mu.Lock()
+	if t.State != TransferRunning {
+		s.transfers.mu.Unlock()
+		return
+	}
+	t.EndedAt = &now
+	t.ETASeconds = nil
+	event := EventTransferDone
+	switch {
+	case err == nil:
+		t.State = TransferDone
+		if t.Total < 0 {
+			t.Total = t.Bytes
+		}
+		t.file = fileResponse(peer, file)
+	case errors.Is(err, context.Canceled):
+		// Only shutdown cancels the parent context
+		t.State, t.Error = TransferCancelled, "agent shutting down"
+		event = EventTransferCancelled
+	default:
+		_, code := peerFileError(err)
+		t.State, t.Code, t.Error = TransferFailed, code, err.Error()
+		t.Resumable = t.download.Resumable()
+		event = EventTransferFailed
+	}
+	t.cancel()
+	t.forget = time.AfterFunc(transferKeep, func() { s.forgetTransfer(t.ID) })
+	snapshot := t.Transfer
+	s.transfers.mu.Unlock()
+
+	s.bus.Publish(event, snapshot)
+	s.logger.Info("File transfer ended", "transfer", t.ID, "state", snapshot.State, "bytes", snapshot.Bytes, "err", snapshot.Error)
+}
+
+// resumeTransfer restarts a failed transfer, from where it stopped when
+// the peer can serve the rest. It reports whether the transfer exists and,
+// if it does but can't be resumed, the state it's in.
+func (s *Server) resumeTransfer(id string) (Transfer, bool, error) {
+	s.transfers.mu.Lock()
+	t, ok := s.transfers.byID[id]
+	if !ok {
+		s.transfers.mu.Unlock()
+		return Transfer{}, false, nil
+	}
+	if t.State != TransferFailed {
+		snapshot := t.Transfer
+		s.transfers.mu.Unlock()
+		return snapshot, true, errNotResumable
+	}
+
+	t.forget.Stop()
+	ctx, cancel := context.WithCancel(s.transfers.ctx)
+	t.cancel = cancel
+	t.State, t.Code, t.Error, t.EndedAt = TransferRunning, "", "", nil
+	t.Resumable = false
+	t.Resumes++
+	t.Rate, t.lastEmit, t.lastSent = 0, time.Now(), int64(len(t.download.Content))
+	t.Bytes = t.lastSent
+	snapshot := t.Transfer
+	s.transfers.mu.Unlock()
+
+	s.bus.Publish(EventTransferResumed, snapshot)
+	s.logger.Info("Resumed file transfer", "transfer", id, "from", snapshot.Bytes)
+	go s.runTransfer(ctx, t)
+	return snapshot, true, nil
+}
+
+// errNotResumable is returned when resuming a transfer that hasn't failed
+var errNotResumable = errors.New("transfer not resumable")
+
+// cancelTransfer aborts a running transfer, then forgets it
+func (s *Server) cancelTransfer(id string) (Transfer, bool) {
+	s.transfers.mu.Lock()
+	t, ok := s.transfers.byID[id]
+	if !ok {
+		s.transfers.mu.Unlock()
+		return Transfer{}, false
+	}
+	running := t.State == TransferRunning
+	if running {
+		now := time.Now()
+		t.State, t.EndedAt, t.ETASeconds = TransferCancelled, &now, nil
+		t.cancel()
+	}
+	snapshot := t.Transfer
+	s.transfers.mu.Unlock()
+
+	if running {
+		s.bus.Publish(EventTransferCancelled, snapshot)
+		s.logger.Info("Cancelled file transfer", "transfer", id, "bytes", snapshot.Bytes)
+	}
+	s.forgetTransfer(id)
+	return snapshot, true
+}
+
+// forgetTransfer drops a transfer and the file it holds
+func (s *Server) forgetTransfer(id string) {
+	s.transfers.mu.Lock()
+	t, ok := s.transfers.byID[id]
+	var snapshot Transfer
+	if ok {
+		snapshot = t.Transfer
+		delete(s.transfers.byID, id)
+	}
+	s.transfers.mu.Unlock()
+
+	if ok {
+		s.bus.Publish(EventTransferRemoved, snapshot)
+	}
+}
+
+func (s *Server) handleListTransfers(w http.ResponseWriter, r *http.Request) {
+	s.transfers.mu.Lock()
+	list := make([]Transfer, 0, len(s.transfers.byID))
+	for _, t := range s.transfers.byID {
+		list = append(list, t.Transfer)
+	}
+	s.transfers.mu.Unlock()
+
+	writeList(s, w, r, transferList, list)
+}
+
+// handleGetTransfer reports a transfer's state, with the file once it's done
+func (s *Server) handleGetTransfer(w http.ResponseWriter, r *http.Request) {
+	s.transfers.mu.Lock()
+	t, ok := s.transfers.byID[mux.Vars(r)["id"]]
+	var response struct {
+		Transfer
+		File map[string]interface{} `json:"file,omitempty"`
+	}
+	if ok {
+		response.Transfer, response.File = t.Transfer, t.file
+	}
+	s.transfers.mu.Unlock()
+
+	if !ok {
+		s.writeError(w, r, http.StatusNotFound, CodeTransferNotFound, i18n.MsgTransferNotFound)
+		return
+	}
+	s.writeFileJSON(w, r, response)
+}
+
+// handleResumeTransfer restarts a failed transfer in the background
+func (s *Server) handleResumeTransfer(w http.ResponseWriter, r *http.Request) {
+	t, ok, err := s.resumeTransfer(mux.Vars(r)["id"])
+	switch {
+	case !ok:
+		s.writeError(w, r, http.StatusNotFound, CodeTransferNotFound, i18n.MsgTransferNotFound)
+		return
+	case err != nil:
+		s.writeError(w, r, http.StatusConflict, CodeNotResumable, i18n.MsgTransferNotResumable, t.State)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(t)
+}
+
+// handleCancelTransfer aborts a running transfer, closing the request to
+// the peer, and forgets it
+func (s *Server) handleCancelTransfer(w http.ResponseWriter, r *http.Request) {
+	t, ok := s.cancelTransfer(mux.Vars(r)["id"])
+	if !ok {
+		s.writeError(w, r, http.StatusNotFound, CodeTransferNotFound, i18n.MsgTransferNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/zeropr/agent/internal/api"
+	"github.com/zeropr/agent/internal/events"
+	"github.com/zeropr/agent/internal/peers"
+)
+
+// slowPeer lists a peer as "slow" whose agent serves any raw file as size
+// bytes, chunk bytes every interval. aborted is closed if the request is
+// cut off before the last byte.
+func (a *testAgent) slowPeer(t *testing.T, size, chunk int, interval time.Duration) (aborted <-chan struct{}) {
+	t.Helper()
+	content := make([]byte, size)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	sum := sha256.Sum256(content)
+	cut := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/file/raw" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set(api.HeaderSHA256, hex.EncodeToString(sum[:]))
+		w.Header().Set(api.HeaderSize, strconv.Itoa(size))
+		w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+		w.WriteHeader(http.StatusOK)
+		for sent := 0; sent < size; sent += chunk {
+			select {
+			case <-r.Context().Done():
+				close(cut)
+				return
+			case <-time.After(interval):
+			}
+			w.Write(content[sent:min(sent+chunk, size)])
+			w.(http.Flusher).Flush()
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	host, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	n, _ := strconv.Atoi(port)
+	a.registry.Add(&peers.Peer{ID: "slow", Name: "slow", Address: host, Port: n, LastSeen: time.Now()})
+	return cut
+}
+
+// startTransfer requests path from the slow peer in the background,
+// returning the transfer's ID
+func (a *testAgent) startTransfer(t *testing.T, path string) string {
+	t.Helper()
+	var started struct {
+		TransferID string   `json:"transferId"`
+		Transfer   Transfer `json:"transfer"`
+	}
+	status, body := a.do(t, http.MethodPost, "/api/file/request", `{"peerId":"slow","filePath":"`+path+`","async":true}`, &started)
+	if status != http.StatusAccepted || started.TransferID == "" || started.Transfer.State != TransferRunning {
+		t.Fatalf("async request answered %d %s", status, body)
+	}
+	return started.TransferID
+}
+
+// nextTransferEvent returns the next transfer event on ch
+func nextTransferEvent(t *testing.T, ch <-chan events.Event) (string, Transfer) {
+	t.Helper()
+	for {
+		select {
+		case event := <-ch:
+			if transfer, ok := event.Data.(Transfer); ok {
+				return event.Type, transfer
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no transfer event")
+		}
+	}
+}
+
+func TestTransferProgress(t *testing.T) {
+	const size, chunk = 160 << 10, 8 << 10 // 20 chunks, 80KB a second
+	a := newTestAgent(t)
+	a.slowPeer(t, size, chunk, 100*time.Millisecond)
+	ch, cancel := a.bus.Subscribe("test", 64)
+	defer cancel()
+
+	id := a.startTransfer(t, "big.bin")
+	if eventType, transfer := nextTransferEvent(t, ch); eventType != EventTransferStarted || transfer.ID != id {
+		t.Fatalf("first event %s %+v", eventType, transfer)
+	}
+
+	var progress []Transfer
+	var lastAt time.Time
+	for {
+		eventType, transfer := nextTransferEvent(t, ch)
+		if eventType == EventTransferDone {
+			if transfer.State != TransferDone || transfer.Bytes != size || transfer.Total != size || transfer.ETASeconds != nil {
+				t.Errorf("done %+v", transfer)
+			}
+			break
+		}
+		if eventType != EventTransferProgress {
+			t.Fatalf("unexpected %s %+v", eventType, transfer)
+		}
+		// Throttled to two a second
+		if now := time.Now(); !lastAt.IsZero() && now.Sub(lastAt) < progressInterval-50*time.Millisecond {
+			t.Errorf("progress events %s apart", now.Sub(lastAt))
+		}
+		lastAt = time.Now()
+		progress = append(progress, transfer)
+	}
+	if len(progress) < 2 {
+		t.Fatalf("%d progress events over a two-second transfer", len(progress))
+	}
+	for i, p := range progress {
+		if p.Total != size || p.Bytes <= 0 || (i > 0 && p.Bytes < progress[i-1].Bytes) {
+			t.Errorf("progress %d: %d of %d bytes", i, p.Bytes, p.Total)
+		}
+		// The peer sends 80KB a second; allow the rate and ETA some slack
+		if p.Rate < 20<<10 || p.Rate > 320<<10 || p.ETASeconds == nil {
+			t.Errorf("progress %d: %.0f bytes a second, ETA %v", i, p.Rate, p.ETASeconds)
+			continue
+		}
+		if want := float64(size-p.Bytes) / (80 << 10); *p.ETASeconds < want/4 || *p.ETASeconds > want*4+0.5 {
+			t.Errorf("progress %d: ETA %.2fs with %d bytes left, want about %.2fs", i, *p.ETASeconds, size-p.Bytes, want)
+		}
+	}
+
+	var got struct {
+		Transfer
+		File map[string]interface{} `json:"file"`
+	}
+	if status, body := a.do(t, http.MethodGet, "/api/transfers/"+id, "", &got); status != http.StatusOK || got.State != TransferDone || got.File == nil {
+		t.Errorf("GET answered %d %.200s", status, body)
+	}
+}
+
+func TestTransferCancel(t *testing.T) {
+	a := newTestAgent(t)
+	aborted := a.slowPeer(t, 1<<20, 8<<10, 100*time.Millisecond)
+	ch, cancel := a.bus.Subscribe("test", 64)
+	defer cancel()
+
+	id := a.startTransfer(t, "huge.bin")
+	for {
+		if eventType, _ := nextTransferEvent(t, ch); eventType == EventTransferProgress {
+			break
+		}
+	}
+
+	var cancelled Transfer
+	if status, body := a.do(t, http.MethodDelete, "/api/transfers/"+id, "", &cancelled); status != http.StatusOK || cancelled.State != TransferCancelled {
+		t.Fatalf("DELETE answered %d %s", status, body)
+	}
+	// The request to the peer is cut off, not left to run
+	select {
+	case <-aborted:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the peer kept sending after the transfer was cancelled")
+	}
+	for _, want := range []string{EventTransferCancelled, EventTransferRemoved} {
+		eventType, transfer := nextTransferEvent(t, ch)
+		for eventType == EventTransferProgress {
+			eventType, transfer = nextTransferEvent(t, ch)
+		}
+		if eventType != want || transfer.ID != id {
+			t.Errorf("published %s, want %s", eventType, want)
+		}
+	}
+	if status, body := a.do(t, http.MethodGet, "/api/transfers/"+id, "", nil); status != http.StatusNotFound || errorCode(body) != CodeTransferNotFound {
+		t.Errorf("a cancelled transfer answered %d %s", status, body)
+	}
+}
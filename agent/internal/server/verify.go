@@ -0,0 +1,127 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/zeropr/agent/internal/api"
+	"github.com/zeropr/agent/internal/crypto"
+	"github.com/zeropr/agent/internal/i18n"
+)
+
+// pairingArtifacts are the fingerprints a pairing-code check vouches for
+func (s *Server) pairingArtifacts(peerFingerprint string) []string {
+	return []string{peerFingerprint, s.identity.Fingerprint()}
+}
+
+// peerKey resolves the peer in the URL to its advertised key,
+// writing an error response if there isn't one
+func (s *Server) peerKey(w http.ResponseWriter, r *http.Request) (string, ed25519.PublicKey, bool) {
+	if s.trust == nil {
+		s.writeError(w, r, http.StatusNotFound, CodeFeatureDisabled, i18n.MsgIdentityDisabled)
+		return "", nil, false
+	}
+	peer, ok := s.lookupPeer(w, r, mux.Vars(r)["id"])
+	if !ok {
+		return "", nil, false
+	}
+	key, err := crypto.DecodeKey(peer.PublicKey)
+	if err != nil {
+		s.writeError(w, r, http.StatusConflict, CodePeerNoKey, i18n.MsgPeerNoKey)
+		return "", nil, false
+	}
+	return peer.Name, key, true
+}
+
+// handlePairingCode shows the code this user reads to the peer's user, who
+// enters it on their side (and vice versa)
+func (s *Server) handlePairingCode(w http.ResponseWriter, r *http.Request) {
+	name, key, ok := s.peerKey(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"peer":        name,
+		"fingerprint": crypto.Fingerprint(key),
+		"pairingCode": crypto.PairingCode(s.identity.PublicKey, key),
+	})
+}
+
+// handleVerifyPeer steps a trusted peer up to pairing-code provenance
+func (s *Server) handleVerifyPeer(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		PairingCode string `json:"pairingCode"`
+	}
+	if err := api.DecodeLocal(r.Body, &req); err != nil || req.PairingCode == "" {
+		s.writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, i18n.MsgPairingCodeRequired)
+		return
+	}
+
+	name, key, ok := s.peerKey(w, r)
+	if !ok {
+		return
+	}
+	if !crypto.CheckPairingCode(req.PairingCode, s.identity.PublicKey, key) {
+		s.logger.Warn("Pairing code mismatch", "peer", name)
+		s.writeError(w, r, http.StatusForbidden, CodePairingMismatch, i18n.MsgPairingMismatch)
+		return
+	}
+
+	fingerprint := crypto.Fingerprint(key)
+	entry, err := s.trust.StepUp(fingerprint, crypto.ProvenancePairingCode, s.pairingArtifacts(fingerprint))
+	switch {
+	case err == crypto.ErrUnknownTrust:
+		s.writeError(w, r, http.StatusNotFound, CodePeerNotTrusted, i18n.MsgPeerNotTrusted)
+		return
+	case err != nil:
+		s.writeErrorFor(w, r, http.StatusInternalServerError, CodeInternal, err)
+		return
+	}
+	s.logger.Info("Verified peer with a pairing code", "peer", name, "fingerprint", fingerprint)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entry)
+}
+
+func (s *Server) handleExportTrust(w http.ResponseWriter, r *http.Request) {
+	if s.trust == nil {
+		s.writeError(w, r, http.StatusNotFound, CodeFeatureDisabled, i18n.MsgIdentityDisabled)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="zeropr-trust.json"`)
+	json.NewEncoder(w).Encode(s.trust.List())
+}
+
+func (s *Server) handleImportTrust(w http.ResponseWriter, r *http.Request) {
+	if s.trust == nil {
+		s.writeError(w, r, http.StatusNotFound, CodeFeatureDisabled, i18n.MsgIdentityDisabled)
+		return
+	}
+
+	var entries []crypto.TrustEntry
+	if err := api.DecodeLocal(r.Body, &entries); err != nil {
+		s.writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, i18n.MsgInvalidRequest)
+		return
+	}
+
+	added, err := s.trust.Import(entries)
+	if err != nil {
+		s.writeErrorFor(w, r, http.StatusBadRequest, CodeInvalidRequest, err)
+		return
+	}
+	for _, e := range entries {
+		if entry, ok := s.trust.Get(e.Fingerprint); ok && entry.State == crypto.StateTrusted {
+			s.registry.SetTrusted(e.Fingerprint, true)
+		}
+	}
+	s.logger.Info("Imported trust entries", "count", added)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"imported": added})
+}
@@ -0,0 +1,132 @@
+package sessions
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+)
+
+// DefaultGhostTTL is how long a departed participant's cursor lingers
+const DefaultGhostTTL = 60 * time.Second
+
+// messageAwareness is the y-websocket message type carrying awareness updates
+const messageAwareness = 1
+
+// awarenessState is the last state a Yjs client published
+type awarenessState struct {
+	clock uint64
+	state []byte // JSON, "null" once the client removed itself
+}
+
+// presence is one participant's retained awareness, keyed by Yjs client ID.
+// After the participant leaves it lingers as a ghost until timer fires.
+type presence struct {
+	states   map[uint64]awarenessState
+	departed bool
+	timer    *time.Timer
+}
+
+// IsAwareness reports whether a sync message carries awareness, which
+// editors renew on a timer whether or not anyone is typing
+func IsAwareness(data []byte) bool {
+	return len(data) > 0 && data[0] == messageAwareness
+}
+
+// decodeAwareness parses a y-websocket awareness message. ok is false for
+// any other message type or a malformed frame.
+func decodeAwareness(data []byte) (map[uint64]awarenessState, bool) {
+	if len(data) == 0 || data[0] != messageAwareness {
+		return nil, false
+	}
+	update, ok := readBytes(data[1:])
+	if !ok {
+		return nil, false
+	}
+
+	count, n := binary.Uvarint(update)
+	if n <= 0 {
+		return nil, false
+	}
+	update = update[n:]
+
+	states := make(map[uint64]awarenessState, count)
+	for i := uint64(0); i < count; i++ {
+		clientID, n := binary.Uvarint(update)
+		if n <= 0 {
+			return nil, false
+		}
+		update = update[n:]
+		clock, n := binary.Uvarint(update)
+		if n <= 0 {
+			return nil, false
+		}
+		update = update[n:]
+		state, ok := readBytes(update)
+		if !ok {
+			return nil, false
+		}
+		update = update[uvarintLen(uint64(len(state)))+len(state):]
+		states[clientID] = awarenessState{clock: clock, state: append([]byte{}, state...)}
+	}
+	return states, true
+}
+
+// encodeAwareness builds an awareness message announcing states
+func encodeAwareness(states map[uint64]awarenessState) []byte {
+	var update []byte
+	update = binary.AppendUvarint(update, uint64(len(states)))
+	for clientID, s := range states {
+		update = binary.AppendUvarint(update, clientID)
+		update = binary.AppendUvarint(update, s.clock)
+		update = binary.AppendUvarint(update, uint64(len(s.state)))
+		update = append(update, s.state...)
+	}
+
+	msg := []byte{messageAwareness}
+	msg = binary.AppendUvarint(msg, uint64(len(update)))
+	return append(msg, update...)
+}
+
+// readBytes reads a length-prefixed byte string
+func readBytes(data []byte) ([]byte, bool) {
+	size, n := binary.Uvarint(data)
+	if n <= 0 || uint64(len(data)-n) < size {
+		return nil, false
+	}
+	return data[n : n+int(size)], true
+}
+
+func uvarintLen(v uint64) int {
+	var buf [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(buf[:], v)
+}
+
+// departedStates marks each live state as departed so clients can fade the
+// cursor. Clocks advance by one so peers accept the update.
+func departedStates(states map[uint64]awarenessState) map[uint64]awarenessState {
+	out := make(map[uint64]awarenessState, len(states))
+	for clientID, s := range states {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(s.state, &fields); err != nil || fields == nil {
+			continue
+		}
+		fields["departed"] = json.RawMessage("true")
+		state, err := json.Marshal(fields)
+		if err != nil {
+			continue
+		}
+		out[clientID] = awarenessState{clock: s.clock + 1, state: state}
+	}
+	return out
+}
+
+// removedStates announces that each client is gone. Yjs accepts a null
+// state at the current clock, and a client that sees its own ID removed
+// re-announces itself with a higher clock.
+func removedStates(states map[uint64]awarenessState) map[uint64]awarenessState {
+	out := make(map[uint64]awarenessState, len(states))
+	for clientID, s := range states {
+		out[clientID] = awarenessState{clock: s.clock, state: []byte("null")}
+	}
+	return out
+}
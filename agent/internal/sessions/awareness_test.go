@@ -0,0 +1,119 @@
+package sessions
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// nextAwareness returns the states in the next awareness frame on conn,
+// failing if none arrives within wait
+func nextAwareness(t *testing.T, conn *websocket.Conn, wait time.Duration) map[uint64]awarenessState {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(wait))
+	defer conn.SetReadDeadline(time.Time{})
+	for {
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("waiting for awareness: %v", err)
+		}
+		if messageType != websocket.BinaryMessage {
+			continue
+		}
+		if states, ok := decodeAwareness(data); ok {
+			return states
+		}
+	}
+}
+
+// departed reports whether a state is marked as a departed participant's
+func departed(s awarenessState) bool {
+	var fields struct {
+		Departed bool `json:"departed"`
+	}
+	json.Unmarshal(s.state, &fields)
+	return fields.Departed
+}
+
+// bobsCursor is an awareness frame in which Yjs client 7 is at clock 3
+var bobsCursor = encodeAwareness(map[uint64]awarenessState{7: {clock: 3, state: []byte(`{"user":{"name":"Bob"}}`)}})
+
+func TestCursorGhost(t *testing.T) {
+	hub := NewHub(DuplicateReplace)
+	hub.SetGhostTTL(200 * time.Millisecond)
+	url := serveHub(t, hub)
+	alice := dialHub(t, url, "alice")
+	bob := dialHub(t, url, "bob")
+	waitParticipants(t, hub, 2)
+
+	bob.WriteMessage(websocket.BinaryMessage, bobsCursor)
+	if got := nextAwareness(t, alice, 2*time.Second); got[7].clock != 3 {
+		t.Fatalf("alice saw %+v, want bob's cursor", got)
+	}
+
+	// Bob leaves: his cursor turns into a ghost, at a clock Yjs accepts
+	bob.Close()
+	ghost := nextAwareness(t, alice, 2*time.Second)[7]
+	if ghost.clock != 4 || !departed(ghost) {
+		t.Fatalf("alice saw %s at clock %d, want bob's ghost", ghost.state, ghost.clock)
+	}
+
+	// Someone joining meanwhile is shown the ghost too
+	carol := dialHub(t, url, "carol")
+	if got := nextAwareness(t, carol, 2*time.Second)[7]; !departed(got) {
+		t.Errorf("carol saw %s, want bob's ghost", got.state)
+	}
+
+	// and once its time is up everyone is told it's gone
+	for _, conn := range []*websocket.Conn{alice, carol} {
+		if got := nextAwareness(t, conn, 2*time.Second)[7]; string(got.state) != "null" || got.clock != 4 {
+			t.Errorf("saw %s at clock %d, want bob removed", got.state, got.clock)
+		}
+	}
+	hub.mu.Lock()
+	snapshot := hub.snapshotLocked("s")
+	hub.mu.Unlock()
+	if snapshot != nil {
+		t.Error("the expired ghost is still shown to joiners")
+	}
+}
+
+func TestCursorGhostReplacedOnRejoin(t *testing.T) {
+	hub := NewHub(DuplicateReplace)
+	hub.SetGhostTTL(time.Hour)
+	url := serveHub(t, hub)
+	alice := dialHub(t, url, "alice")
+	bob := dialHub(t, url, "bob")
+	waitParticipants(t, hub, 2)
+	bob.WriteMessage(websocket.BinaryMessage, bobsCursor)
+	nextAwareness(t, alice, 2*time.Second)
+	bob.Close()
+	nextAwareness(t, alice, 2*time.Second)
+
+	// Bob's return clears his ghost at once, for him as for alice, so his
+	// editor announces a live cursor afresh
+	again := dialHub(t, url, "bob")
+	for _, conn := range []*websocket.Conn{alice, again} {
+		if got := nextAwareness(t, conn, 2*time.Second)[7]; string(got.state) != "null" {
+			t.Errorf("saw %s, want bob's ghost removed", got.state)
+		}
+	}
+}
+
+func TestCursorGhostsOff(t *testing.T) {
+	hub := NewHub(DuplicateReplace)
+	hub.SetGhostTTL(0)
+	url := serveHub(t, hub)
+	alice := dialHub(t, url, "alice")
+	bob := dialHub(t, url, "bob")
+	waitParticipants(t, hub, 2)
+	bob.WriteMessage(websocket.BinaryMessage, bobsCursor)
+	nextAwareness(t, alice, 2*time.Second)
+
+	bob.Close()
+	if got := nextAwareness(t, alice, 2*time.Second)[7]; string(got.state) != "null" {
+		t.Errorf("alice saw %s, want bob removed at once", got.state)
+	}
+}
@@ -0,0 +1,52 @@
+package sessions
+
+import "errors"
+
+// DefaultMaxParticipants is how many participants a session takes unless
+// configured or created otherwise: enough for a team huddle, few enough
+// that the relay and the file's owner aren't swamped
+const DefaultMaxParticipants = 10
+
+var (
+	// ErrSessionFull is returned when a session already holds as many
+	// participants as its cap allows
+	ErrSessionFull = errors.New("session is full")
+	// ErrCapBelowOccupancy is returned when lowering a session's cap below
+	// the participants already in it
+	ErrCapBelowOccupancy = errors.New("cap is below the participants already in the session")
+)
+
+// occupancy counts the participants held against the session's cap
+func (s *Session) occupancy() int {
+	return len(s.Participants)
+}
+
+// full reports whether the session has no seat left for a newcomer
+func (s *Session) full() bool {
+	return s.MaxParticipants > 0 && s.occupancy() >= s.MaxParticipants
+}
+
+// SetMaxParticipants changes a live session's cap on behalf of by, who must
+// be the session's initiator; zero lifts it. A cap can't go below the
+// participants already in the session, so nobody is turned out.
+func (m *Manager) SetMaxParticipants(sessionID, by string, max int) (Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, ok := m.sessions[sessionID]
+	if !ok {
+		return Session{}, ErrSessionNotFound
+	}
+	if by == "" || by != session.Initiator {
+		return Session{}, ErrNotInitiator
+	}
+	if max > 0 && max < session.occupancy() {
+		return Session{}, ErrCapBelowOccupancy
+	}
+	if session.MaxParticipants != max {
+		session.MaxParticipants = max
+		session.revision++
+		m.bus.Publish(EventSessionUpdated, session.snapshot())
+	}
+	return session.snapshot(), nil
+}
@@ -0,0 +1,92 @@
+package sessions
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestLastSlotRace(t *testing.T) {
+	for round := 0; round < 50; round++ {
+		m := newTestManager(t)
+		if _, err := m.Create("s", "test", "main.go", Member{ID: "alice"}, 3); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.AddParticipant("s", Member{ID: "bob"}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Two joiners, and a few more behind them, go for the one seat left
+		var (
+			wg      sync.WaitGroup
+			start   = make(chan struct{})
+			results = make(chan error, 8)
+		)
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				<-start
+				results <- m.AddParticipant("s", Member{ID: fmt.Sprintf("joiner-%d", i)})
+			}(i)
+		}
+		close(start)
+		wg.Wait()
+		close(results)
+
+		joined := 0
+		for err := range results {
+			switch {
+			case err == nil:
+				joined++
+			case !errors.Is(err, ErrSessionFull):
+				t.Fatalf("a joiner got %v", err)
+			}
+		}
+		session, _ := m.Get("s")
+		if joined != 1 || len(session.Participants) != 3 {
+			t.Fatalf("round %d: %d joined, %d participants", round, joined, len(session.Participants))
+		}
+	}
+}
+
+func TestSetMaxParticipants(t *testing.T) {
+	m := newTestManager(t)
+	if _, err := m.Create("s", "test", "main.go", Member{ID: "alice"}, 2); err != nil {
+		t.Fatal(err)
+	}
+	m.AddParticipant("s", Member{ID: "bob"})
+	if err := m.AddParticipant("s", Member{ID: "carol"}); err != ErrSessionFull {
+		t.Fatalf("a third joiner of a session for two: %v", err)
+	}
+	// Whoever is already in isn't turned away by the cap
+	if err := m.AddParticipant("s", Member{ID: "bob"}); err != ErrAlreadyParticipant {
+		t.Errorf("bob rejoining: %v", err)
+	}
+
+	if _, err := m.SetMaxParticipants("s", "bob", 5); err != ErrNotInitiator {
+		t.Errorf("a participant raised the cap: %v", err)
+	}
+	if _, err := m.SetMaxParticipants("s", "alice", 1); err != ErrCapBelowOccupancy {
+		t.Errorf("the cap went below the participants: %v", err)
+	}
+	if _, err := m.SetMaxParticipants("nobody", "alice", 5); err != ErrSessionNotFound {
+		t.Errorf("raising an unknown session's cap: %v", err)
+	}
+	session, err := m.SetMaxParticipants("s", "alice", 3)
+	if err != nil || session.MaxParticipants != 3 || session.Occupancy != 2 {
+		t.Fatalf("raised the cap to %+v, %v", session, err)
+	}
+	if err := m.AddParticipant("s", Member{ID: "carol"}); err != nil {
+		t.Errorf("carol after the cap was raised: %v", err)
+	}
+
+	// Zero lifts it
+	m.SetMaxParticipants("s", "alice", 0)
+	for i := 0; i < 20; i++ {
+		if err := m.AddParticipant("s", Member{ID: fmt.Sprint(i)}); err != nil {
+			t.Fatalf("joiner %d of an uncapped session: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package sessions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+	"github.com/zeropr/agent/internal/logging"
+	"github.com/zeropr/agent/internal/wire"
+)
+
+const (
+	// ChatBacklog is how many recent messages each session keeps for
+	// participants who join later, listed by History
+	ChatBacklog = 200
+
+	// ChatReplay is how many of the backlog's latest messages a chat socket
+	// is sent as it joins; History has the rest
+	ChatReplay = 50
+
+	// MaxChatLength is the longest message text accepted, in characters
+	MaxChatLength = 2000
+
+	// MaxChatFrame bounds a chat socket's frames, well above any message
+	// MaxChatLength allows
+	MaxChatFrame = 16 << 10
+)
+
+var (
+	// ErrChatEmpty is returned for a message with no text
+	ErrChatEmpty = errors.New("chat message is empty")
+	// ErrChatTooLong is returned for a message over MaxChatLength
+	ErrChatTooLong = errors.New("chat message is too long")
+	// ErrChatInvalid is returned for a frame that isn't a chat message
+	ErrChatInvalid = errors.New("chat frame must be JSON with a text field")
+)
+
+// Chat relays short text messages between a session's participants over
+// their own sockets, next to the sync socket. It keeps the last
+// ChatBacklog messages of each session in memory so joiners see recent
+// conversation; nothing is written to disk, and Forget drops them when the
+// session ends.
+type Chat struct {
+	hub     *Hub                          // the chat sockets, by session and participant
+	frames  *wire.Dispatcher[*Client]     // routes what the sockets send
+	backlog map[string][]wire.ChatMessage // session ID -> recent messages, oldest first
+	mu      sync.Mutex
+}
+
+// NewChat creates a chat relay; a participant's second chat socket is
+// handled as policy says
+func NewChat(policy DuplicatePolicy) *Chat {
+	hub := NewHub(policy)
+	hub.logger = logging.Component(nil, "chat")
+	c := &Chat{
+		hub:     hub,
+		backlog: make(map[string][]wire.ChatMessage),
+	}
+	// Nothing reaches other participants without being stamped, so
+	// frames of types this agent doesn't know are refused
+	c.frames = wire.NewDispatcher[*Client](wire.Consume, nil)
+	c.frames.Handle(wire.TypeChat, c.post)
+	c.frames.Untyped(wire.TypeChat) // clients have always sent {"text": "..."}
+	return c
+}
+
+// SetLogger sets the logger chat connections are reported to
+func (c *Chat) SetLogger(logger *slog.Logger) {
+	c.hub.mu.Lock()
+	defer c.hub.mu.Unlock()
+	c.hub.logger = logging.Component(logger, "chat")
+}
+
+// SetKeepalive sets the ping interval and write timeout of chat sockets
+// opened from now on
+func (c *Chat) SetKeepalive(k Keepalive) {
+	c.hub.SetKeepalive(k)
+}
+
+// Join registers a participant's chat socket and sends it the latest
+// ChatReplay messages of the session's backlog
+func (c *Chat) Join(sessionID, participantID string, conn *websocket.Conn) (*Client, error) {
+	client, err := c.hub.Register(sessionID, participantID, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	backlog := c.History(sessionID)
+	if len(backlog) > ChatReplay {
+		backlog = backlog[len(backlog)-ChatReplay:]
+	}
+	for i := range backlog {
+		if frame, err := wire.Encode(&backlog[i]); err == nil {
+			client.write(websocket.TextMessage, frame)
+		}
+	}
+	return client, nil
+}
+
+// History returns a copy of the session's backlog, oldest first
+func (c *Chat) History(sessionID string) []wire.ChatMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]wire.ChatMessage{}, c.backlog[sessionID]...)
+}
+
+// Leave unregisters a chat socket
+func (c *Chat) Leave(client *Client) {
+	c.hub.Unregister(client)
+}
+
+// Receive handles a frame from a chat socket: a valid message is stamped,
+// kept in the backlog, and sent to everyone in the session, its author
+// included; anything else is refused back to the author alone
+func (c *Chat) Receive(from *Client, messageType int, data []byte) error {
+	err := ErrChatInvalid
+	if messageType == websocket.TextMessage {
+		err = c.frames.Dispatch(from, data)
+	}
+	if err == nil {
+		return nil
+	}
+
+	reason := "invalid"
+	switch err {
+	case ErrChatEmpty:
+		reason = "empty"
+	case ErrChatTooLong:
+		reason = "too_long"
+	default:
+		if err != ErrChatInvalid {
+			err = fmt.Errorf("%w: %v", ErrChatInvalid, err)
+		}
+	}
+	if frame, encodeErr := wire.Encode(&wire.ChatRejected{Reason: reason}); encodeErr == nil {
+		from.write(websocket.TextMessage, frame)
+	}
+	return err
+}
+
+// post relays a wire.ChatMessage a client sent. The author is the
+// participant the socket belongs to, never what the client claims.
+func (c *Chat) post(from *Client, frame wire.Frame) error {
+	message := frame.(*wire.ChatMessage)
+	message.Text = strings.TrimSpace(cleanChat(message.Text))
+	switch {
+	case message.Text == "":
+		return ErrChatEmpty
+	case utf8.RuneCountInString(message.Text) > MaxChatLength:
+		return ErrChatTooLong
+	}
+	message.Author = from.ParticipantID
+	message.Timestamp = time.Now().UTC()
+	data, err := wire.Encode(message)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	backlog := append(c.backlog[from.SessionID], *message)
+	if len(backlog) > ChatBacklog {
+		backlog = append([]wire.ChatMessage(nil), backlog[len(backlog)-ChatBacklog:]...)
+	}
+	c.backlog[from.SessionID] = backlog
+	c.mu.Unlock()
+
+	c.hub.mu.RLock()
+	targets := c.hub.targetsLocked(from.SessionID, nil)
+	c.hub.mu.RUnlock()
+	for _, target := range targets {
+		target.write(websocket.TextMessage, data)
+	}
+	return nil
+}
+
+// cleanChat drops the control characters of text, keeping newlines and
+// tabs, so a message can't carry terminal escapes or other invisible
+// controls to whoever displays it
+func cleanChat(text string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\t' || !unicode.IsControl(r) {
+			return r
+		}
+		return -1
+	}, text)
+}
+
+// Forget drops an ended session's backlog
+func (c *Chat) Forget(sessionID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.backlog, sessionID)
+}
+
+// Connections returns the number of live chat sockets
+func (c *Chat) Connections() int {
+	return c.hub.Connections()
+}
+
+// CloseAll asks every chat socket to close; see Hub.CloseAll
+func (c *Chat) CloseAll(code int, reason string) int {
+	return c.hub.CloseAll(code, reason)
+}
+
+// Shutdown closes every chat socket; see Hub.Shutdown
+func (c *Chat) Shutdown(ctx context.Context) error {
+	return c.hub.Shutdown(ctx)
+}
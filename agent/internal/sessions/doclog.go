@@ -0,0 +1,133 @@
+package sessions
+
+// y-websocket sync message types carrying document updates
+const (
+	messageSync     = 0
+	syncStep2       = 1 // the updates a peer lacked, answering its state vector
+	syncUpdate      = 2
+	maxDocLogLength = 32 << 20
+)
+
+// docLog is the document updates a session's participants have sent, in
+// the order they were relayed. Yjs applies updates idempotently and in any
+// order, so replaying the log rebuilds the document without the agent
+// having to merge it.
+type docLog struct {
+	updates   [][]byte // whole sync messages, as relayed
+	size      int
+	revision  uint64 // bumped on every change, for snapshots
+	truncated bool   // outgrew maxDocLogLength and was dropped
+}
+
+// isDocUpdate reports whether a sync message carries document content
+func isDocUpdate(data []byte) bool {
+	return len(data) > 1 && data[0] == messageSync && (data[1] == syncStep2 || data[1] == syncUpdate)
+}
+
+// RecordDocs has the hub keep each session's document updates from now
+// on, for snapshots and for replaying to participants who join later
+func (h *Hub) RecordDocs() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.docs == nil {
+		h.docs = make(map[string]*docLog)
+	}
+}
+
+// Recording reports whether the hub keeps session documents
+func (h *Hub) Recording() bool {
+	if h == nil {
+		return false
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.docs != nil
+}
+
+// openDoc starts a session's document log with updates, if documents are
+// recorded
+func (h *Hub) openDoc(sessionID string, updates [][]byte) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.docs == nil {
+		return
+	}
+	log := &docLog{updates: updates}
+	for _, update := range updates {
+		log.size += len(update)
+	}
+	h.docs[sessionID] = log
+}
+
+// forgetDoc drops an ended session's document log
+func (h *Hub) forgetDoc(sessionID string) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.docs, sessionID)
+}
+
+// recordDoc appends an update to its session's log. data must not be
+// modified afterwards.
+func (h *Hub) recordDoc(sessionID string, data []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	log, ok := h.docs[sessionID]
+	if !ok || log.truncated {
+		return
+	}
+	if log.size+len(data) > maxDocLogLength {
+		// Half a document is worse than none: participants resync among
+		// themselves, and a restart restores the session without content
+		log.updates, log.size, log.truncated = nil, 0, true
+		log.revision++
+		h.logger.Warn("Session document outgrew its log; it won't be replayed or restored", "session", sessionID, "limit", maxDocLogLength)
+		return
+	}
+	log.updates = append(log.updates, data)
+	log.size += len(data)
+	log.revision++
+}
+
+// docLocked returns a session's logged updates and the log's revision;
+// h.mu must be held. The updates are shared, never modified.
+func (h *Hub) docLocked(sessionID string) ([][]byte, uint64) {
+	log, ok := h.docs[sessionID]
+	if !ok {
+		return nil, 0
+	}
+	return log.updates[:len(log.updates):len(log.updates)], log.revision
+}
+
+// doc returns a session's logged updates and the log's revision
+func (h *Hub) doc(sessionID string) ([][]byte, uint64) {
+	if h == nil {
+		return nil, 0
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.docLocked(sessionID)
+}
+
+// Document returns the updates logged for a session's document, in the
+// order they were relayed. It reports false when documents aren't recorded
+// or the session's log outgrew its limit.
+func (h *Hub) Document(sessionID string) ([][]byte, bool) {
+	if h == nil {
+		return nil, false
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	log, ok := h.docs[sessionID]
+	if !ok || log.truncated {
+		return nil, false
+	}
+	updates, _ := h.docLocked(sessionID)
+	return updates, true
+}
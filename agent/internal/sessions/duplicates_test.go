@@ -0,0 +1,65 @@
+package sessions
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestDuplicateConnectionReplaces(t *testing.T) {
+	hub := NewHub(DuplicateReplace)
+	url := serveHub(t, hub)
+	alice := dialHub(t, url, "alice")
+	old := dialHub(t, url, "bob")
+	waitParticipants(t, hub, 2)
+
+	replacement := dialHub(t, url, "bob")
+	old.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		_, _, err := old.ReadMessage()
+		if err == nil {
+			continue
+		}
+		var closed *websocket.CloseError
+		if !errors.As(err, &closed) || closed.Code != CloseReplaced {
+			t.Fatalf("the older connection ended with %v, want close %d", err, CloseReplaced)
+		}
+		break
+	}
+
+	// The replacement is live, and the older connection ending didn't take
+	// bob out of the session: he still counts once
+	replacement.WriteMessage(websocket.BinaryMessage, update(1))
+	alice.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, data, err := alice.ReadMessage(); err != nil || data[len(data)-1] != 1 {
+		t.Fatalf("alice got %v, %v, want bob's update", data, err)
+	}
+	if n := hub.Participants("s"); n != 2 {
+		t.Errorf("%d participants after bob reconnected, want 2", n)
+	}
+	replacement.Close()
+	waitParticipants(t, hub, 1)
+}
+
+func TestDuplicateConnectionRefused(t *testing.T) {
+	hub := NewHub(DuplicateRefuse)
+	url := serveHub(t, hub)
+	first := dialHub(t, url, "bob")
+	waitParticipants(t, hub, 1)
+
+	second := dialHub(t, url, "bob")
+	second.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, _, err := second.ReadMessage(); err == nil {
+		t.Fatal("a second connection from bob was kept")
+	}
+	if n := hub.Participants("s"); n != 1 {
+		t.Errorf("%d participants, want bob once", n)
+	}
+
+	// The first connection is untouched
+	first.WriteMessage(websocket.BinaryMessage, update(1))
+	first.Close()
+	waitParticipants(t, hub, 0)
+}
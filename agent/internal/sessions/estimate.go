@@ -0,0 +1,109 @@
+package sessions
+
+import (
+	"errors"
+	"math"
+)
+
+// NetworkProfile says what kind of link this machine is on, for estimates
+type NetworkProfile string
+
+const (
+	ProfileNormal   NetworkProfile = "normal"
+	ProfileMetered  NetworkProfile = "metered"   // every byte costs, e.g. a phone hotspot
+	ProfileLowPower NetworkProfile = "low-power" // a laptop saving battery
+)
+
+// ParseProfile validates a network profile name
+func ParseProfile(value string) (NetworkProfile, error) {
+	switch NetworkProfile(value) {
+	case ProfileNormal, ProfileMetered, ProfileLowPower:
+		return NetworkProfile(value), nil
+	}
+	return "", errors.New("network profile must be normal, metered, or low-power")
+}
+
+// The estimate heuristics. Clients rely on the fields following these
+// formulas, documented in the README; change both together.
+const (
+	// A Yjs text document encodes to the content plus about 15% of item
+	// metadata, plus a fixed header: initialSyncBytes = size*115/100 + 1024
+	syncOverheadPercent = 15
+	syncOverheadBytes   = 1024
+
+	// A typical editor sends about one update a second of about 64 bytes,
+	// every one of which each participant's document keeps:
+	// updateLogBytesPerHour = participants * 3600 * 64
+	updatesPerSecond = 1
+	updateBytes      = 64
+
+	// On a metered or low-power profile an initial sync over 1 MiB is
+	// expected to feel slow
+	degradedSyncBytes = 1 << 20
+)
+
+// Reasons an estimate gives for a degraded or blocked session
+const (
+	ReasonOverBudget = "over_budget" // the initial sync outgrows the session's queue and stalls senders
+	ReasonProfile    = "profile"     // large for a metered or low-power link
+	ReasonTooLarge   = "too_large"   // over the co-editable maximum
+)
+
+// EstimateLimits are what a session on this agent would run under
+type EstimateLimits struct {
+	Budget      Budget
+	MaxFileSize int64 // largest co-editable file in bytes; 0 is unlimited
+	Profile     NetworkProfile
+}
+
+// Estimate is what a session on a file of a given size would cost
+type Estimate struct {
+	Size                  int64          `json:"size"`
+	Participants          int            `json:"participants"`
+	InitialSyncBytes      int64          `json:"initialSyncBytes"`
+	UpdateLogBytesPerHour int64          `json:"updateLogBytesPerHour"`
+	SyncSeconds           float64        `json:"syncSeconds"`   // relaying the initial sync at the byte budget; 0 when unlimited
+	ExceedsBudget         bool           `json:"exceedsBudget"` // the initial sync alone fills the session's queue
+	NetworkProfile        NetworkProfile `json:"networkProfile"`
+	Degraded              bool           `json:"degraded"`
+	MaxFileSize           int64          `json:"maxFileSize"` // 0 is unlimited
+	Blocked               bool           `json:"blocked"`     // session create refuses the file without force
+	Reasons               []string       `json:"reasons"`
+}
+
+// EstimateSession estimates a session with participants on a file of size
+// bytes under limits; fewer than two participants counts as two
+func EstimateSession(size int64, participants int, limits EstimateLimits) Estimate {
+	if participants < 2 {
+		participants = 2
+	}
+	e := Estimate{
+		Size:                  size,
+		Participants:          participants,
+		InitialSyncBytes:      size + size*syncOverheadPercent/100 + syncOverheadBytes,
+		UpdateLogBytesPerHour: int64(participants) * 3600 * updatesPerSecond * updateBytes,
+		NetworkProfile:        limits.Profile,
+		MaxFileSize:           limits.MaxFileSize,
+		Reasons:               []string{},
+	}
+	if e.NetworkProfile == "" {
+		e.NetworkProfile = ProfileNormal
+	}
+
+	if bytes := limits.Budget.Bytes; bytes > 0 {
+		e.SyncSeconds = math.Round(float64(e.InitialSyncBytes)/float64(bytes)*100) / 100
+		if e.InitialSyncBytes > int64(queueSeconds*bytes) {
+			e.ExceedsBudget = true
+			e.Reasons = append(e.Reasons, ReasonOverBudget)
+		}
+	}
+	if e.NetworkProfile != ProfileNormal && e.InitialSyncBytes > degradedSyncBytes {
+		e.Reasons = append(e.Reasons, ReasonProfile)
+	}
+	if limits.MaxFileSize > 0 && size > limits.MaxFileSize {
+		e.Blocked = true
+		e.Reasons = append(e.Reasons, ReasonTooLarge)
+	}
+	e.Degraded = len(e.Reasons) > 0
+	return e
+}
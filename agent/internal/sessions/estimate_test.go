@@ -0,0 +1,62 @@
+package sessions
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestEstimateFormulas pins the estimate to the formulas the README
+// documents, since clients rely on them
+func TestEstimateFormulas(t *testing.T) {
+	const mib = 1 << 20
+	budget := Budget{Frames: 500, Bytes: 4 * mib}
+	tests := []struct {
+		name         string
+		size         int64
+		participants int
+		limits       EstimateLimits
+		want         Estimate
+	}{
+		{"empty file, unlimited", 0, 0, EstimateLimits{}, Estimate{
+			Participants: 2, InitialSyncBytes: 1024, UpdateLogBytesPerHour: 2 * 3600 * 64,
+			NetworkProfile: ProfileNormal, Reasons: []string{},
+		}},
+		{"a small file", 10000, 3, EstimateLimits{Budget: budget, MaxFileSize: 16 * mib}, Estimate{
+			Size: 10000, Participants: 3, InitialSyncBytes: 10000 + 1500 + 1024, UpdateLogBytesPerHour: 3 * 3600 * 64,
+			NetworkProfile: ProfileNormal, MaxFileSize: 16 * mib, Reasons: []string{},
+		}},
+		{"over the budget's queue", 8 * mib, 2, EstimateLimits{Budget: budget}, Estimate{
+			Size: 8 * mib, Participants: 2, InitialSyncBytes: 8*mib + 8*mib*15/100 + 1024, UpdateLogBytesPerHour: 2 * 3600 * 64,
+			SyncSeconds: 2.3, ExceedsBudget: true, NetworkProfile: ProfileNormal, Degraded: true, Reasons: []string{ReasonOverBudget},
+		}},
+		{"large on a metered link", 2 * mib, 2, EstimateLimits{Profile: ProfileMetered}, Estimate{
+			Size: 2 * mib, Participants: 2, InitialSyncBytes: 2*mib + 2*mib*15/100 + 1024, UpdateLogBytesPerHour: 2 * 3600 * 64,
+			NetworkProfile: ProfileMetered, Degraded: true, Reasons: []string{ReasonProfile},
+		}},
+		{"over the maximum", 20 * mib, 2, EstimateLimits{Budget: budget, MaxFileSize: 16 * mib, Profile: ProfileLowPower}, Estimate{
+			Size: 20 * mib, Participants: 2, InitialSyncBytes: 20*mib + 20*mib*15/100 + 1024, UpdateLogBytesPerHour: 2 * 3600 * 64,
+			SyncSeconds: 5.75, ExceedsBudget: true, NetworkProfile: ProfileLowPower, Degraded: true,
+			MaxFileSize: 16 * mib, Blocked: true, Reasons: []string{ReasonOverBudget, ReasonProfile, ReasonTooLarge},
+		}},
+	}
+	for _, tt := range tests {
+		if got := EstimateSession(tt.size, tt.participants, tt.limits); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s:\n got %+v\nwant %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestEstimateAtTheEdges(t *testing.T) {
+	// Exactly the maximum is allowed, and a sync that just fits the metered
+	// threshold isn't degraded
+	if e := EstimateSession(100, 2, EstimateLimits{MaxFileSize: 100}); e.Blocked {
+		t.Error("a file exactly at the maximum was blocked")
+	}
+	fits := int64((degradedSyncBytes - syncOverheadBytes) * 100 / (100 + syncOverheadPercent))
+	if e := EstimateSession(fits, 2, EstimateLimits{Profile: ProfileMetered}); e.Degraded {
+		t.Errorf("a %d-byte sync was degraded on a metered link", e.InitialSyncBytes)
+	}
+	if _, err := ParseProfile("satellite"); err == nil {
+		t.Error("an unknown network profile was accepted")
+	}
+}
@@ -0,0 +1,358 @@
+package sessions
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// EventSessionThrottled is published when a session goes over its relay budget
+const EventSessionThrottled = "session.throttled"
+
+// loadWindow is how often a session's frame rate is sampled
+const loadWindow = time.Second
+
+// queueSeconds is how many seconds of budget a throttled session may have
+// queued before its senders are made to wait
+const queueSeconds = 2
+
+// Budget caps how much one session may relay per second, so a misbehaving
+// editor sending updates in a tight loop slows only its own session. Frames
+// over budget are queued and relayed as it refills, with awareness updates
+// coalesced. A zero field is unlimited.
+type Budget struct {
+	Frames int `json:"frames"` // inbound frames per second
+	Bytes  int `json:"bytes"`  // inbound bytes per second
+}
+
+func (b Budget) unlimited() bool {
+	return b.Frames <= 0 && b.Bytes <= 0
+}
+
+// Throttle is the payload of EventSessionThrottled
+type Throttle struct {
+	SessionID       string  `json:"sessionId"`
+	TopTalker       string  `json:"topTalker"` // participant who sent the most frames this window
+	TopTalkerFrames int     `json:"topTalkerFrames"`
+	FramesPerSecond float64 `json:"framesPerSecond"`
+	Budget          Budget  `json:"budget"`
+}
+
+// SessionLoad is one session's relay accounting
+type SessionLoad struct {
+	SessionID       string  `json:"sessionId"`
+	FramesPerSecond float64 `json:"framesPerSecond"` // inbound frames processed over the last window
+	BytesPerSecond  float64 `json:"bytesPerSecond"`
+	Throttled       bool    `json:"throttled"` // frames are waiting for budget
+	Queued          int     `json:"queued"`
+	QueuedBytes     int     `json:"queuedBytes"`
+	Coalesced       uint64  `json:"coalesced"` // awareness frames merged into queued ones
+	Throttles       uint64  `json:"throttles"` // times the session went over budget
+}
+
+// queuedFrame is a frame held back until the session's budget allows it
+type queuedFrame struct {
+	from        *Client
+	messageType int
+	data        []byte
+	awareness   map[uint64]awarenessState // set for awareness frames, which coalesce
+}
+
+// sessionLoad meters one session's inbound frames against its budget and
+// holds the frames it couldn't afford
+type sessionLoad struct {
+	budget Budget
+
+	// Token buckets holding up to one second of budget
+	frameTokens float64
+	byteTokens  float64
+	refilled    time.Time
+
+	// Accounting for the current and last completed window
+	windowStart time.Time
+	frames      int
+	bytes       int
+	talkers     map[string]int // participant ID -> frames this window
+	frameRate   float64
+	byteRate    float64
+
+	queue       []*queuedFrame
+	queuedBytes int
+	flushing    bool
+	closed      bool
+	throttled   bool
+	throttles   uint64
+	coalesced   uint64
+
+	mu   sync.Mutex
+	room *sync.Cond // signalled as the queue drains
+}
+
+func newSessionLoad(budget Budget, now time.Time) *sessionLoad {
+	l := &sessionLoad{
+		budget:      budget,
+		frameTokens: float64(budget.Frames),
+		byteTokens:  float64(budget.Bytes),
+		refilled:    now,
+		windowStart: now,
+		talkers:     make(map[string]int),
+	}
+	l.room = sync.NewCond(&l.mu)
+	return l
+}
+
+// accountLocked records an inbound frame and rolls the window over; l.mu
+// must be held
+func (l *sessionLoad) accountLocked(participantID string, size int, now time.Time) {
+	if elapsed := now.Sub(l.windowStart); elapsed >= loadWindow {
+		l.frameRate = float64(l.frames) / elapsed.Seconds()
+		l.byteRate = float64(l.bytes) / elapsed.Seconds()
+		l.frames, l.bytes = 0, 0
+		clear(l.talkers)
+		l.windowStart = now
+	}
+	l.frames++
+	l.bytes += size
+	l.talkers[participantID]++
+}
+
+// refillLocked tops the buckets up for the time since the last refill; l.mu
+// must be held
+func (l *sessionLoad) refillLocked(now time.Time) {
+	elapsed := now.Sub(l.refilled).Seconds()
+	l.refilled = now
+	if l.budget.Frames > 0 {
+		l.frameTokens = min(l.frameTokens+elapsed*float64(l.budget.Frames), float64(l.budget.Frames))
+	}
+	if l.budget.Bytes > 0 {
+		l.byteTokens = min(l.byteTokens+elapsed*float64(l.budget.Bytes), float64(l.budget.Bytes))
+	}
+}
+
+// waitLocked returns how long until a frame of size fits the budget, or
+// zero if it fits now. A frame larger than a whole second of bytes is let
+// through once the byte bucket is full. l.mu must be held.
+func (l *sessionLoad) waitLocked(size int) time.Duration {
+	var wait float64
+	if l.budget.Frames > 0 && l.frameTokens < 1 {
+		wait = (1 - l.frameTokens) / float64(l.budget.Frames)
+	}
+	if l.budget.Bytes > 0 {
+		need := float64(min(size, l.budget.Bytes))
+		if l.byteTokens < need {
+			wait = max(wait, (need-l.byteTokens)/float64(l.budget.Bytes))
+		}
+	}
+	return time.Duration(wait * float64(time.Second))
+}
+
+// takeLocked spends the budget for a frame of size; l.mu must be held
+func (l *sessionLoad) takeLocked(size int) {
+	if l.budget.Frames > 0 {
+		l.frameTokens--
+	}
+	if l.budget.Bytes > 0 {
+		l.byteTokens -= float64(min(size, l.budget.Bytes))
+	}
+}
+
+// queueFullLocked reports whether senders should wait for the queue to
+// drain; l.mu must be held
+func (l *sessionLoad) queueFullLocked() bool {
+	if l.budget.Frames > 0 && len(l.queue) >= queueSeconds*l.budget.Frames {
+		return true
+	}
+	return l.budget.Bytes > 0 && l.queuedBytes >= queueSeconds*l.budget.Bytes
+}
+
+// enqueueLocked holds a frame back. An awareness frame is merged into one
+// already queued from the same connection, keeping each Yjs client's newest
+// state, so a flood of cursor moves costs one frame. l.mu must be held.
+func (l *sessionLoad) enqueueLocked(frame *queuedFrame) {
+	if frame.awareness != nil {
+		for _, queued := range l.queue {
+			if queued.from != frame.from || queued.awareness == nil {
+				continue
+			}
+			for clientID, state := range frame.awareness {
+				if current, ok := queued.awareness[clientID]; !ok || state.clock >= current.clock {
+					queued.awareness[clientID] = state
+				}
+			}
+			l.queuedBytes -= len(queued.data)
+			queued.data = encodeAwareness(queued.awareness)
+			l.queuedBytes += len(queued.data)
+			l.coalesced++
+			return
+		}
+	}
+	l.queue = append(l.queue, frame)
+	l.queuedBytes += len(frame.data)
+}
+
+// topTalkerLocked returns the participant who sent the most frames this
+// window; l.mu must be held
+func (l *sessionLoad) topTalkerLocked() (string, int) {
+	var top string
+	var frames int
+	for participantID, n := range l.talkers {
+		if n > frames || (n == frames && participantID < top) {
+			top, frames = participantID, n
+		}
+	}
+	return top, frames
+}
+
+// snapshot reports the session's load as of now
+func (l *sessionLoad) snapshot(sessionID string, now time.Time) SessionLoad {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	frameRate, byteRate := l.frameRate, l.byteRate
+	// A session that went quiet has no completed window to report
+	if now.Sub(l.windowStart) >= 2*loadWindow {
+		frameRate, byteRate = 0, 0
+	}
+	return SessionLoad{
+		SessionID:       sessionID,
+		FramesPerSecond: frameRate,
+		BytesPerSecond:  byteRate,
+		Throttled:       l.throttled,
+		Queued:          len(l.queue),
+		QueuedBytes:     l.queuedBytes,
+		Coalesced:       l.coalesced,
+		Throttles:       l.throttles,
+	}
+}
+
+// close drops anything queued and releases waiting senders once the
+// session's last connection is gone
+func (l *sessionLoad) close() {
+	l.mu.Lock()
+	l.closed = true
+	l.queue = nil
+	l.queuedBytes = 0
+	l.room.Broadcast()
+	l.mu.Unlock()
+}
+
+// admit accounts for a frame from a session's participant and reports
+// whether it may be relayed right away. Otherwise the frame has been queued
+// for the session's flusher; if the queue is full the sender waits here for
+// room, which pushes back on the connection flooding it.
+func (h *Hub) admit(l *sessionLoad, from *Client, messageType int, data []byte, awareness map[uint64]awarenessState) bool {
+	now := time.Now()
+	l.mu.Lock()
+	l.accountLocked(from.ParticipantID, len(data), now)
+	if l.budget.unlimited() || l.closed {
+		l.mu.Unlock()
+		return true
+	}
+
+	l.refillLocked(now)
+	// Once anything is queued, later frames queue behind it to keep order
+	if len(l.queue) == 0 && l.waitLocked(len(data)) == 0 {
+		l.takeLocked(len(data))
+		l.mu.Unlock()
+		return true
+	}
+
+	var throttle *Throttle
+	if !l.throttled {
+		l.throttled = true
+		l.throttles++
+		top, frames := l.topTalkerLocked()
+		throttle = &Throttle{
+			SessionID:       from.SessionID,
+			TopTalker:       top,
+			TopTalkerFrames: frames,
+			FramesPerSecond: float64(l.frames) / max(now.Sub(l.windowStart).Seconds(), loadWindow.Seconds()),
+			Budget:          l.budget,
+		}
+	}
+	for l.queueFullLocked() && !l.closed {
+		l.room.Wait()
+	}
+	if !l.closed {
+		l.enqueueLocked(&queuedFrame{from: from, messageType: messageType, data: data, awareness: awareness})
+	}
+	startFlusher := !l.flushing && len(l.queue) > 0
+	if startFlusher {
+		l.flushing = true
+	}
+	l.mu.Unlock()
+
+	if throttle != nil {
+		h.logger.Warn("Session over relay budget; queueing frames", "session", throttle.SessionID, "topTalker", throttle.TopTalker, "frames", throttle.TopTalkerFrames)
+		h.mu.RLock()
+		bus := h.bus
+		h.mu.RUnlock()
+		bus.Publish(EventSessionThrottled, *throttle)
+	}
+	if startFlusher {
+		go h.flush(l)
+	}
+	return false
+}
+
+// flush relays a throttled session's queued frames as its budget refills,
+// exiting once the queue is empty
+func (h *Hub) flush(l *sessionLoad) {
+	for {
+		l.mu.Lock()
+		if len(l.queue) == 0 {
+			l.flushing = false
+			l.throttled = false
+			l.mu.Unlock()
+			return
+		}
+
+		now := time.Now()
+		l.refillLocked(now)
+		head := l.queue[0]
+		if wait := l.waitLocked(len(head.data)); wait > 0 {
+			l.mu.Unlock()
+			time.Sleep(wait)
+			continue
+		}
+		l.takeLocked(len(head.data))
+		l.queue[0] = nil
+		l.queue = l.queue[1:]
+		l.queuedBytes -= len(head.data)
+		l.room.Broadcast()
+		l.mu.Unlock()
+
+		h.relay(head.from, head.messageType, head.data)
+	}
+}
+
+// SetBudget sets the relay budget of sessions opened from now on
+func (h *Hub) SetBudget(budget Budget) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.budget = budget
+}
+
+// Loads reports relay accounting for every session with live connections,
+// busiest first
+func (h *Hub) Loads() []SessionLoad {
+	h.mu.RLock()
+	loads := make(map[string]*sessionLoad, len(h.loads))
+	for sessionID, l := range h.loads {
+		loads[sessionID] = l
+	}
+	h.mu.RUnlock()
+
+	now := time.Now()
+	result := make([]SessionLoad, 0, len(loads))
+	for sessionID, l := range loads {
+		result = append(result, l.snapshot(sessionID, now))
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].FramesPerSecond != result[j].FramesPerSecond {
+			return result[i].FramesPerSecond > result[j].FramesPerSecond
+		}
+		return result[i].SessionID < result[j].SessionID
+	})
+	return result
+}
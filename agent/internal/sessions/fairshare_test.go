@@ -0,0 +1,146 @@
+package sessions
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/zeropr/agent/internal/events"
+)
+
+// dialSession connects participant to sessionID on a hub served by serveHub
+func dialSession(t *testing.T, url, sessionID, participant string) *websocket.Conn {
+	t.Helper()
+	return dialHub(t, url, participant+"&session="+sessionID)
+}
+
+func TestFloodingSessionDoesNotSlowOthers(t *testing.T) {
+	hub := NewHub(DuplicateReplace)
+	bus := events.NewBus()
+	hub.SetBus(bus)
+	throttles, cancel := bus.Subscribe("test", 16)
+	defer cancel()
+	hub.SetBudget(Budget{Frames: 50})
+	url := serveHub(t, hub)
+
+	mallory := dialSession(t, url, "flood", "mallory")
+	dialSession(t, url, "flood", "observer")
+	alice := dialSession(t, url, "calm", "alice")
+	bob := dialSession(t, url, "calm", "bob")
+	waitSession := func(sessionID string) {
+		deadline := time.Now().Add(5 * time.Second)
+		for hub.Participants(sessionID) != 2 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitSession("flood")
+	waitSession("calm")
+
+	// Mallory's editor sends as fast as the socket lets it, until closed
+	flooding := make(chan struct{})
+	go func() {
+		defer close(flooding)
+		for seq := 0; ; seq++ {
+			if err := mallory.WriteMessage(websocket.BinaryMessage, stamped(seq, 256)); err != nil {
+				return
+			}
+		}
+	}()
+	defer func() {
+		mallory.Close()
+		<-flooding
+	}()
+
+	// Meanwhile alice types at a human pace, within the budget
+	const frames = 20
+	go func() {
+		for seq := 0; seq < frames; seq++ {
+			if alice.WriteMessage(websocket.BinaryMessage, stamped(seq, 64)) != nil {
+				return
+			}
+			time.Sleep(30 * time.Millisecond)
+		}
+	}()
+	var worst time.Duration
+	bob.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for got := 0; got < frames; {
+		_, data, err := bob.ReadMessage()
+		if err != nil {
+			t.Fatalf("bob got %d of alice's frames: %v", got, err)
+		}
+		if len(data) != 64 {
+			continue
+		}
+		sent := time.Unix(0, int64(binary.BigEndian.Uint64(data[10:])))
+		worst = max(worst, time.Since(sent))
+		got++
+	}
+	if worst > 200*time.Millisecond {
+		t.Errorf("alice's frames took up to %s to reach bob beside the flood", worst)
+	}
+
+	select {
+	case event := <-throttles:
+		throttle, ok := event.Data.(Throttle)
+		if event.Type != EventSessionThrottled || !ok || throttle.SessionID != "flood" || throttle.TopTalker != "mallory" {
+			t.Errorf("published %s %+v", event.Type, event.Data)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("the flooding session wasn't reported throttled")
+	}
+
+	loads := make(map[string]SessionLoad)
+	for _, load := range hub.Loads() {
+		loads[load.SessionID] = load
+	}
+	if !loads["flood"].Throttled || loads["flood"].Throttles == 0 || loads["flood"].Queued == 0 {
+		t.Errorf("flood's load %+v", loads["flood"])
+	}
+	if loads["calm"].Throttles != 0 || loads["calm"].Throttled {
+		t.Errorf("calm's load %+v", loads["calm"])
+	}
+}
+
+func TestQueuedAwarenessCoalesces(t *testing.T) {
+	l := newSessionLoad(Budget{Frames: 1}, time.Now())
+	alice, bob := &Client{ParticipantID: "alice"}, &Client{ParticipantID: "bob"}
+	cursor := func(from *Client, clientID uint64, clock uint64) *queuedFrame {
+		states := map[uint64]awarenessState{clientID: {clock: clock, state: []byte(`{"cursor":1}`)}}
+		return &queuedFrame{from: from, messageType: websocket.BinaryMessage, data: encodeAwareness(states), awareness: states}
+	}
+
+	l.mu.Lock()
+	l.enqueueLocked(&queuedFrame{from: alice, messageType: websocket.BinaryMessage, data: update(1)})
+	for clock := uint64(1); clock <= 50; clock++ {
+		l.enqueueLocked(cursor(alice, 1, clock))
+	}
+	l.enqueueLocked(cursor(alice, 1, 10)) // older than what's queued
+	l.enqueueLocked(cursor(bob, 2, 1))
+	l.mu.Unlock()
+
+	if len(l.queue) != 3 || l.coalesced != 50 {
+		t.Fatalf("%d frames queued, %d coalesced", len(l.queue), l.coalesced)
+	}
+	if states, _ := decodeAwareness(l.queue[1].data); states[1].clock != 50 {
+		t.Errorf("alice's queued cursor is at clock %d, want her newest", states[1].clock)
+	}
+}
+
+func TestSessionLoadRates(t *testing.T) {
+	start := time.Now()
+	l := newSessionLoad(Budget{}, start)
+	l.mu.Lock()
+	for i := 0; i < 30; i++ {
+		l.accountLocked("alice", 100, start.Add(time.Duration(i)*10*time.Millisecond))
+	}
+	l.accountLocked("bob", 100, start.Add(loadWindow))
+	l.mu.Unlock()
+
+	if load := l.snapshot("s", start.Add(loadWindow)); load.FramesPerSecond != 30 || load.BytesPerSecond != 3000 {
+		t.Errorf("load after one window %+v", load)
+	}
+	if load := l.snapshot("s", start.Add(3*loadWindow)); load.FramesPerSecond != 0 {
+		t.Errorf("a quiet session still reports %v frames a second", load.FramesPerSecond)
+	}
+}
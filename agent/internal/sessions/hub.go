@@ -0,0 +1,593 @@
+package sessions
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/zeropr/agent/internal/events"
+	"github.com/zeropr/agent/internal/logging"
+	"github.com/zeropr/agent/internal/metrics"
+	"github.com/zeropr/agent/internal/wire"
+)
+
+// DuplicatePolicy decides what happens when a participant opens a second
+// sync connection to a session they're already connected to
+type DuplicatePolicy string
+
+const (
+	// DuplicateReplace closes the older connection in favor of the new one
+	DuplicateReplace DuplicatePolicy = "replace"
+	// DuplicateRefuse rejects the new connection
+	DuplicateRefuse DuplicatePolicy = "refuse"
+)
+
+// WebSocket close codes sent by the hub
+const (
+	CloseReplaced   = 4001 // superseded by a newer connection from the same participant
+	CloseDuplicate  = 4002 // refused because the participant is already connected
+	CloseNotServing = 4003 // the agent stopped serving sessions; don't reconnect until it serves again
+	CloseTooSlow    = 4004 // the client fell a whole send queue behind; reconnecting resyncs it
+	CloseFull       = 4005 // the session is at its participant cap
+)
+
+// ErrDuplicateConnection is returned by Register under DuplicateRefuse
+var ErrDuplicateConnection = errors.New("participant already connected")
+
+// ErrShuttingDown is returned by Register once Shutdown has been called
+var ErrShuttingDown = errors.New("server shutting down")
+
+// closeTimeout bounds how long we wait to deliver a close frame
+const closeTimeout = time.Second
+
+// ParsePolicy validates a duplicate-connection policy name
+func ParsePolicy(value string) (DuplicatePolicy, error) {
+	switch DuplicatePolicy(value) {
+	case DuplicateReplace, DuplicateRefuse:
+		return DuplicatePolicy(value), nil
+	}
+	return "", errors.New("duplicate connection policy must be replace or refuse")
+}
+
+// Client is one participant's live sync connection
+type Client struct {
+	SessionID     string
+	ParticipantID string
+
+	conn      *websocket.Conn
+	send      chan outgoing // messages waiting for writeLoop
+	done      chan struct{} // closed once the client is unregistered
+	stopOnce  sync.Once
+	dropped   func(reason string) // records the hub giving up on the client
+	dropOnce  sync.Once
+	connected time.Time
+
+	// For the roster
+	lastFrame   atomic.Int64 // unix nanoseconds of the last frame received, or connecting
+	writeAvg    atomic.Int64 // running average write time, in nanoseconds
+	writeFailed atomic.Bool  // the last write failed
+	roster      atomic.Bool  // the client asked for roster frames
+
+	viewer atomic.Bool // the participant views without editing; their document updates are dropped
+}
+
+// write queues a message for the client's writer. Rather than wait, it
+// fails with ErrSendQueueFull when the client has fallen behind, so one
+// stuck client can't hold up a broadcast; the client is then dropped,
+// since a Yjs peer that missed updates can't be caught up by later ones.
+func (c *Client) write(messageType int, data []byte) error {
+	select {
+	case <-c.done:
+		return ErrClientGone
+	default:
+	}
+	select {
+	case c.send <- outgoing{messageType: messageType, data: data}:
+		return nil
+	default:
+		c.tooSlow()
+		return ErrSendQueueFull
+	}
+}
+
+// sendClose sends a close frame with code and reason, leaving the socket
+// open for the peer's reply. Control frames may be written alongside the
+// client's writer.
+func (c *Client) sendClose(code int, reason string) {
+	c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(closeTimeout))
+}
+
+// closeWith sends a close frame with code and reason, then closes the socket
+func (c *Client) closeWith(code int, reason string) {
+	c.sendClose(code, reason)
+	c.conn.Close()
+}
+
+// Hub relays sync messages between the connections of each session. Members
+// are keyed by participant identity, not by connection, so a participant
+// with overlapping connections counts once. The hub also keeps each
+// participant's last awareness state, replaying it to late joiners and
+// leaving a departed participant's cursor behind as a ghost for a while.
+type Hub struct {
+	rooms          map[string]map[string]*Client   // session ID -> participant ID -> client
+	presence       map[string]map[string]*presence // session ID -> participant ID -> awareness
+	policy         DuplicatePolicy
+	ghostTTL       time.Duration
+	loads          map[string]*sessionLoad // session ID -> relay accounting, while connected
+	budget         Budget
+	roles          RoleFunc
+	rosters        map[string]*rosterState // session ID -> last roster sent, while connected
+	rosterRevision uint64
+	docs           map[string]*docLog    // session ID -> document updates, once RecordDocs is called
+	recordings     map[string]*recording // session ID -> recent sync frames, once RecordFrames is called
+	recordLimit    int                   // bytes of frames kept per session
+	keepalive      Keepalive
+	logger         *slog.Logger
+	metrics        *metrics.Metrics
+	bus            *events.Bus
+	frames         *wire.Dispatcher[*Client] // routes the text frames clients send
+	drained        chan struct{}             // closed once the last connection leaves after Shutdown
+	mu             sync.RWMutex
+}
+
+// NewHub creates a hub with the given duplicate-connection policy
+func NewHub(policy DuplicatePolicy) *Hub {
+	if policy == "" {
+		policy = DuplicateReplace
+	}
+	h := &Hub{
+		rooms:     make(map[string]map[string]*Client),
+		presence:  make(map[string]map[string]*presence),
+		loads:     make(map[string]*sessionLoad),
+		rosters:   make(map[string]*rosterState),
+		policy:    policy,
+		ghostTTL:  DefaultGhostTTL,
+		keepalive: DefaultKeepalive,
+		logger:    logging.Component(nil, "relay"),
+	}
+	// Text frames of types this agent doesn't know are relayed like Yjs
+	// traffic, so newer editors can use them through it
+	h.frames = wire.NewDispatcher(wire.Relay, func(from *Client, data []byte) {
+		h.forward(from, websocket.TextMessage, data, nil)
+	})
+	h.frames.Handle(wire.TypeRosterSync, h.rosterSync)
+	return h
+}
+
+// SetLogger sets the logger relay events are reported to
+func (h *Hub) SetLogger(logger *slog.Logger) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.logger = logging.Component(logger, "relay")
+}
+
+// SetMetrics sets where relayed messages are counted
+func (h *Hub) SetMetrics(m *metrics.Metrics) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.metrics = m
+}
+
+// SetBus sets the bus throttled sessions are announced on
+func (h *Hub) SetBus(bus *events.Bus) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.bus = bus
+}
+
+// SetGhostTTL sets how long a departed participant's cursor is kept; zero
+// or less removes it as soon as they leave
+func (h *Hub) SetGhostTTL(ttl time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.ghostTTL = ttl
+}
+
+// Register adds a connection for a participant. If the participant is
+// already connected the older connection is closed with CloseReplaced, or
+// ErrDuplicateConnection is returned, depending on the policy. A replaced
+// connection is swapped in place so the participant never appears to leave.
+// The connection is pinged from then on, and reads from it fail once it
+// stops answering.
+func (h *Hub) Register(sessionID, participantID string, conn *websocket.Conn) (*Client, error) {
+	client := &Client{
+		SessionID:     sessionID,
+		ParticipantID: participantID,
+		conn:          conn,
+		send:          make(chan outgoing, sendQueue),
+		done:          make(chan struct{}),
+		connected:     time.Now(),
+	}
+	client.dropped = func(reason string) { h.dropped(client, reason) }
+	client.lastFrame.Store(client.connected.UnixNano())
+
+	h.mu.Lock()
+	if h.drained != nil {
+		h.mu.Unlock()
+		return nil, ErrShuttingDown
+	}
+	room, ok := h.rooms[sessionID]
+	if !ok {
+		room = make(map[string]*Client)
+		h.rooms[sessionID] = room
+		h.loads[sessionID] = newSessionLoad(h.budget, time.Now())
+	}
+
+	previous, exists := room[participantID]
+	if exists && h.policy == DuplicateRefuse {
+		h.mu.Unlock()
+		return nil, ErrDuplicateConnection
+	}
+	room[participantID] = client
+	client.viewer.Store(h.roles != nil && h.roles(sessionID, participantID) == RosterViewer)
+	client.expectPongs(h.keepalive)
+	backlog, _ := h.docLocked(sessionID)
+	go client.writeLoop(h.keepalive, backlog)
+
+	// A rejoining participant replaces their ghost; everyone, including the
+	// participant, is told it's gone before the live cursor reappears
+	var removed []byte
+	if ghost, ok := h.presence[sessionID][participantID]; ok && ghost.departed {
+		ghost.timer.Stop()
+		h.deletePresenceLocked(sessionID, participantID)
+		if len(ghost.states) > 0 {
+			removed = encodeAwareness(removedStates(ghost.states))
+		}
+	}
+	others := h.targetsLocked(sessionID, client)
+	snapshot := h.snapshotLocked(sessionID)
+	h.mu.Unlock()
+
+	if exists {
+		previous.closeWith(CloseReplaced, "replaced by a newer connection")
+		h.logger.Info("Replaced duplicate connection", "session", sessionID, "participant", participantID)
+	}
+	if removed != nil {
+		for _, other := range others {
+			other.write(websocket.BinaryMessage, removed)
+		}
+		client.write(websocket.BinaryMessage, removed)
+	}
+	if snapshot != nil {
+		client.write(websocket.BinaryMessage, snapshot)
+	}
+	h.sendRoster(sessionID, nil)
+	return client, nil
+}
+
+// Unregister removes a connection. It returns true if the participant has
+// left, and false if the connection had already been replaced.
+func (h *Hub) Unregister(client *Client) bool {
+	client.stop()
+	h.mu.Lock()
+
+	room, ok := h.rooms[client.SessionID]
+	if !ok || room[client.ParticipantID] != client {
+		h.mu.Unlock()
+		return false
+	}
+
+	delete(room, client.ParticipantID)
+	if len(room) == 0 {
+		delete(h.rooms, client.SessionID)
+		h.loads[client.SessionID].close()
+		delete(h.loads, client.SessionID)
+		if h.drained != nil && len(h.rooms) == 0 {
+			close(h.drained)
+		}
+	}
+
+	departed := h.departLocked(client.SessionID, client.ParticipantID)
+	targets := h.targetsLocked(client.SessionID, nil)
+	h.mu.Unlock()
+
+	if departed != nil {
+		for _, target := range targets {
+			target.write(websocket.BinaryMessage, departed)
+		}
+	}
+	h.sendRoster(client.SessionID, nil)
+	return true
+}
+
+// Broadcast relays a message from one client to every other participant
+// in its session; text frames are routed by the wire registry. A viewer's
+// document updates are dropped, while their awareness still goes out so
+// others see where they're looking. A session over its budget has the
+// message queued instead, so data must not be modified afterwards.
+func (h *Hub) Broadcast(from *Client, messageType int, data []byte) {
+	from.lastFrame.Store(time.Now().UnixNano())
+	if messageType == websocket.TextMessage {
+		if err := h.frames.Dispatch(from, data); err != nil {
+			h.logger.Debug("Dropped control frame", "session", from.SessionID, "participant", from.ParticipantID, "err", err)
+		}
+		return
+	}
+
+	var states map[uint64]awarenessState
+	if decoded, ok := decodeAwareness(data); ok {
+		h.recordAwareness(from, decoded)
+		states = decoded
+	} else if isDocUpdate(data) {
+		if from.viewer.Load() {
+			h.recordReceived(from, messageType, data, "viewer")
+			h.dropViewerUpdate(from)
+			return
+		}
+		h.recordDoc(from.SessionID, data)
+	}
+	h.recordReceived(from, messageType, data, "")
+	h.forward(from, messageType, data, states)
+}
+
+// dropViewerUpdate counts a document update a viewer sent instead of
+// relaying it
+func (h *Hub) dropViewerUpdate(from *Client) {
+	h.mu.RLock()
+	m := h.metrics
+	h.mu.RUnlock()
+
+	m.ViewerDropped()
+	h.logger.Debug("Dropped viewer's document update", "session", from.SessionID, "participant", from.ParticipantID)
+}
+
+// setViewer applies a participant's new role to their live connection, if
+// any, and sends the session's roster. A nil hub does nothing.
+func (h *Hub) setViewer(sessionID, participantID string, viewer bool) {
+	if h == nil {
+		return
+	}
+	h.mu.RLock()
+	client, ok := h.rooms[sessionID][participantID]
+	h.mu.RUnlock()
+
+	if ok {
+		client.viewer.Store(viewer)
+	}
+	h.sendRoster(sessionID, nil)
+}
+
+// forward relays a message within its session's budget
+func (h *Hub) forward(from *Client, messageType int, data []byte, states map[uint64]awarenessState) {
+	h.mu.RLock()
+	load := h.loads[from.SessionID]
+	h.mu.RUnlock()
+
+	if load != nil && !h.admit(load, from, messageType, data, states) {
+		return
+	}
+	h.relay(from, messageType, data)
+}
+
+// relay writes a message to every participant in from's session but from
+func (h *Hub) relay(from *Client, messageType int, data []byte) {
+	h.mu.RLock()
+	targets := h.targetsLocked(from.SessionID, from)
+	m := h.metrics
+	h.mu.RUnlock()
+
+	for _, client := range targets {
+		if err := client.write(messageType, data); err != nil {
+			h.logger.Debug("Relay write failed", "session", client.SessionID, "participant", client.ParticipantID, "err", err)
+			continue
+		}
+		m.Relayed(len(data))
+	}
+}
+
+// targetsLocked lists a session's clients other than except; h.mu must be held
+func (h *Hub) targetsLocked(sessionID string, except *Client) []*Client {
+	targets := make([]*Client, 0, len(h.rooms[sessionID]))
+	for _, client := range h.rooms[sessionID] {
+		if client != except {
+			targets = append(targets, client)
+		}
+	}
+	return targets
+}
+
+// recordAwareness retains the latest awareness state of each Yjs client a
+// participant publishes
+func (h *Hub) recordAwareness(from *Client, states map[uint64]awarenessState) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.rooms[from.SessionID][from.ParticipantID] != from {
+		return
+	}
+	room, ok := h.presence[from.SessionID]
+	if !ok {
+		room = make(map[string]*presence)
+		h.presence[from.SessionID] = room
+	}
+	p, ok := room[from.ParticipantID]
+	if !ok {
+		p = &presence{states: make(map[uint64]awarenessState)}
+		room[from.ParticipantID] = p
+	}
+	for clientID, s := range states {
+		if string(s.state) == "null" {
+			delete(p.states, clientID)
+		} else {
+			p.states[clientID] = s
+		}
+	}
+}
+
+// snapshotLocked encodes every retained awareness state in a session, live
+// and departed, for a participant who just connected; h.mu must be held
+func (h *Hub) snapshotLocked(sessionID string) []byte {
+	states := make(map[uint64]awarenessState)
+	for _, p := range h.presence[sessionID] {
+		for clientID, s := range p.states {
+			states[clientID] = s
+		}
+	}
+	if len(states) == 0 {
+		return nil
+	}
+	return encodeAwareness(states)
+}
+
+// departLocked turns a leaving participant's awareness into a ghost and
+// returns the frame announcing it, or nil if there's nothing to show;
+// h.mu must be held
+func (h *Hub) departLocked(sessionID, participantID string) []byte {
+	p, ok := h.presence[sessionID][participantID]
+	if !ok {
+		return nil
+	}
+	if h.ghostTTL <= 0 {
+		h.deletePresenceLocked(sessionID, participantID)
+		if len(p.states) == 0 {
+			return nil
+		}
+		return encodeAwareness(removedStates(p.states))
+	}
+
+	p.states = departedStates(p.states)
+	if len(p.states) == 0 {
+		h.deletePresenceLocked(sessionID, participantID)
+		return nil
+	}
+	p.departed = true
+	p.timer = time.AfterFunc(h.ghostTTL, func() {
+		h.expireGhost(sessionID, participantID, p)
+	})
+	return encodeAwareness(p.states)
+}
+
+// expireGhost removes a ghost whose time is up, unless the participant has
+// since rejoined
+func (h *Hub) expireGhost(sessionID, participantID string, ghost *presence) {
+	h.mu.Lock()
+	if h.presence[sessionID][participantID] != ghost {
+		h.mu.Unlock()
+		return
+	}
+	h.deletePresenceLocked(sessionID, participantID)
+	targets := h.targetsLocked(sessionID, nil)
+	h.mu.Unlock()
+
+	h.logger.Debug("Cursor ghost expired", "session", sessionID, "participant", participantID)
+	removed := encodeAwareness(removedStates(ghost.states))
+	for _, target := range targets {
+		target.write(websocket.BinaryMessage, removed)
+	}
+	h.sendRoster(sessionID, nil)
+}
+
+// deletePresenceLocked forgets a participant's awareness; h.mu must be held
+func (h *Hub) deletePresenceLocked(sessionID, participantID string) {
+	room := h.presence[sessionID]
+	delete(room, participantID)
+	if len(room) == 0 {
+		delete(h.presence, sessionID)
+	}
+}
+
+// Participants returns the number of unique participants connected to a session
+func (h *Hub) Participants(sessionID string) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return len(h.rooms[sessionID])
+}
+
+// ConnectedSince returns when each participant connected to a session
+// opened their live connection. A nil hub has none.
+func (h *Hub) ConnectedSince(sessionID string) map[string]time.Time {
+	if h == nil {
+		return nil
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	since := make(map[string]time.Time, len(h.rooms[sessionID]))
+	for participantID, client := range h.rooms[sessionID] {
+		since[participantID] = client.connected
+	}
+	return since
+}
+
+// Connections returns the number of live sync connections across all sessions
+func (h *Hub) Connections() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	total := 0
+	for _, room := range h.rooms {
+		total += len(room)
+	}
+	return total
+}
+
+// Shutdown refuses new connections and sends every live one a close frame
+// with CloseGoingAway, then waits for their handlers to unregister them.
+// Connections still open when ctx is done are closed outright and ctx's
+// error is returned.
+func (h *Hub) Shutdown(ctx context.Context) error {
+	h.mu.Lock()
+	if h.drained == nil {
+		h.drained = make(chan struct{})
+		if len(h.rooms) == 0 {
+			close(h.drained)
+		}
+	}
+	drained := h.drained
+	clients := h.clientsLocked()
+	h.mu.Unlock()
+
+	if len(clients) > 0 {
+		h.logger.Info("Closing sync connections", "connections", len(clients))
+	}
+	for _, client := range clients {
+		client.sendClose(websocket.CloseGoingAway, ErrShuttingDown.Error())
+	}
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+	}
+
+	h.mu.RLock()
+	clients = h.clientsLocked()
+	h.mu.RUnlock()
+	for _, client := range clients {
+		client.conn.Close()
+	}
+	if len(clients) > 0 {
+		h.logger.Warn("Forced sync connections closed", "connections", len(clients))
+	}
+	return ctx.Err()
+}
+
+// CloseAll asks every live connection to close with code and reason,
+// leaving the hub open to new ones; it returns how many were asked.
+// Each handler unregisters its connection once the client answers.
+func (h *Hub) CloseAll(code int, reason string) int {
+	h.mu.RLock()
+	clients := h.clientsLocked()
+	h.mu.RUnlock()
+
+	for _, client := range clients {
+		client.sendClose(code, reason)
+	}
+	return len(clients)
+}
+
+// clientsLocked lists every live connection; h.mu must be held
+func (h *Hub) clientsLocked() []*Client {
+	var clients []*Client
+	for _, room := range h.rooms {
+		for _, client := range room {
+			clients = append(clients, client)
+		}
+	}
+	return clients
+}
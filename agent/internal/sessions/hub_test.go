@@ -0,0 +1,274 @@
+package sessions
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/zeropr/agent/internal/metrics"
+)
+
+// serveHub serves hub's sync sockets the way the server does: register,
+// relay every frame read, unregister once reading fails. Connections join
+// session "s" unless ?session= names another.
+func serveHub(t *testing.T, hub *Hub) string {
+	t.Helper()
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		sessionID := r.URL.Query().Get("session")
+		if sessionID == "" {
+			sessionID = "s"
+		}
+		client, err := hub.Register(sessionID, r.URL.Query().Get("participant"), conn)
+		if err != nil {
+			conn.Close()
+			return
+		}
+		defer hub.Unregister(client)
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			hub.Broadcast(client, messageType, data)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+func dialHub(t *testing.T, url, participant string) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("%s?participant=%s", url, participant), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func waitParticipants(t *testing.T, hub *Hub, want int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for hub.Participants("s") != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d participants connected, want %d", hub.Participants("s"), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// stamped is a sync step 1 frame, which the hub relays without recording,
+// carrying its sequence number and when it was sent, padded to size
+func stamped(seq int, size int) []byte {
+	data := make([]byte, size)
+	binary.BigEndian.PutUint64(data[2:], uint64(seq))
+	binary.BigEndian.PutUint64(data[10:], uint64(time.Now().UnixNano()))
+	return data
+}
+
+func TestNonReadingClientIsDropped(t *testing.T) {
+	const (
+		frames = 1000
+		size   = 64 << 10 // enough in all to fill the stalled socket's buffers and its queue
+	)
+	hub := NewHub(DuplicateReplace)
+	url := serveHub(t, hub)
+	sender := dialHub(t, url, "sender")
+	reader := dialHub(t, url, "reader")
+	stalled := dialHub(t, url, "stalled") // never read
+	waitParticipants(t, hub, 3)
+
+	type arrival struct {
+		seq     int
+		latency time.Duration
+	}
+	arrivals := make(chan arrival, frames)
+	go func() {
+		defer close(arrivals)
+		for {
+			_, data, err := reader.ReadMessage()
+			if err != nil {
+				return
+			}
+			if len(data) != size {
+				continue
+			}
+			sent := time.Unix(0, int64(binary.BigEndian.Uint64(data[10:])))
+			arrivals <- arrival{int(binary.BigEndian.Uint64(data[2:])), time.Since(sent)}
+			if len(arrivals) == frames {
+				return
+			}
+		}
+	}()
+
+	start := time.Now()
+	for seq := 0; seq < frames; seq++ {
+		if err := sender.WriteMessage(websocket.BinaryMessage, stamped(seq, size)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var worst time.Duration
+	for want := 0; want < frames; want++ {
+		select {
+		case got, ok := <-arrivals:
+			if !ok {
+				t.Fatalf("reader's socket closed after %d frames", want)
+			}
+			if got.seq != want {
+				t.Fatalf("reader got frame %d, want %d", got.seq, want)
+			}
+			if got.latency > worst {
+				worst = got.latency
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("reader stuck after %d frames", want)
+		}
+	}
+	t.Logf("%d frames of %d bytes relayed in %s; worst latency %s", frames, size, time.Since(start), worst)
+	if worst > 2*time.Second {
+		t.Errorf("worst latency %s; the stalled client held the relay up", worst)
+	}
+
+	// The stalled client was dropped rather than waited on
+	waitParticipants(t, hub, 2)
+	stalled.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for {
+		_, _, err := stalled.NextReader()
+		if err == nil {
+			continue
+		}
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			t.Error("the stalled client's socket was left open")
+		}
+		break
+	}
+}
+
+func TestQueueOverflowClosesTooSlow(t *testing.T) {
+	hub := NewHub(DuplicateReplace)
+	m := metrics.New()
+	hub.SetMetrics(m)
+	url := serveHub(t, hub)
+	conn := dialHub(t, url, "p")
+	waitParticipants(t, hub, 1)
+
+	hub.mu.RLock()
+	client := hub.rooms["s"]["p"]
+	hub.mu.RUnlock()
+
+	// Fill the queue faster than the writer can empty it, without a
+	// reader on the other end to make room
+	var err error
+	for i := 0; i < 100*sendQueue && err == nil; i++ {
+		err = client.write(websocket.BinaryMessage, make([]byte, 64<<10))
+	}
+	if err != ErrSendQueueFull {
+		t.Fatalf("write error %v, want %v", err, ErrSendQueueFull)
+	}
+	if err := client.write(websocket.BinaryMessage, nil); err != ErrSendQueueFull && err != ErrClientGone {
+		t.Errorf("writing to a dropped client: %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for {
+		_, _, err := conn.NextReader()
+		if err == nil {
+			continue
+		}
+		var closeErr *websocket.CloseError
+		if errors.As(err, &closeErr) && closeErr.Code != CloseTooSlow {
+			t.Errorf("closed with %d, want %d", closeErr.Code, CloseTooSlow)
+		}
+		break
+	}
+	waitParticipants(t, hub, 0)
+
+	// However many writes overflowed, the drop is counted once
+	scrape := httptest.NewRecorder()
+	m.Handler().ServeHTTP(scrape, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{`zeropr_websocket_dropped_total{reason="too_slow"} 1`, `zeropr_websocket_dropped_total{reason="write_failed"} 0`} {
+		if !strings.Contains(scrape.Body.String(), line+"\n") {
+			t.Errorf("metrics don't show %s", line)
+		}
+	}
+}
+
+func TestShutdownDrainsConnections(t *testing.T) {
+	hub := NewHub(DuplicateReplace)
+	url := serveHub(t, hub)
+	alice := dialHub(t, url, "alice")
+	bob := dialHub(t, url, "bob")
+	waitParticipants(t, hub, 2)
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdown <- hub.Shutdown(ctx)
+	}()
+
+	// Each is told why, and answering the close lets the hub drain
+	for _, conn := range []*websocket.Conn{alice, bob} {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, _, err := conn.ReadMessage()
+		var closeErr *websocket.CloseError
+		if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseGoingAway || closeErr.Text != ErrShuttingDown.Error() {
+			t.Errorf("read %v, want a going-away close", err)
+		}
+	}
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Errorf("Shutdown: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown didn't return once every connection closed")
+	}
+
+	// and nobody new gets in
+	carol := dialHub(t, url, "carol")
+	carol.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, _, err := carol.ReadMessage(); err == nil || hub.Participants("s") != 0 {
+		t.Errorf("a connection after shutdown was kept: %v", err)
+	}
+}
+
+func TestShutdownForcesStragglers(t *testing.T) {
+	hub := NewHub(DuplicateReplace)
+	url := serveHub(t, hub)
+	stalled := dialHub(t, url, "alice")
+	waitParticipants(t, hub, 1)
+
+	// A client that never reads never answers the close, so once the
+	// wait is over its connection is cut
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := hub.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown: %v, want the deadline", err)
+	}
+	waitParticipants(t, hub, 0)
+	stalled.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		if _, _, err := stalled.ReadMessage(); err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				t.Error("the straggler's connection was left open")
+			}
+			break
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package sessions
+
+import "errors"
+
+// MaxIDLength is the longest session ID ValidID accepts
+const MaxIDLength = 64
+
+// ErrInvalidSessionID is returned for a session ID that isn't one this
+// agent could have handed out
+var ErrInvalidSessionID = errors.New("session ID is malformed")
+
+// ValidID reports whether id has the shape of a session ID: letters, digits,
+// '-' and '_', starting with a letter or digit, at most MaxIDLength bytes.
+// The agent hands out "session-<nanos>", and IDs end up in URL paths, log
+// lines and snapshot file names, so anything else is refused before it's
+// looked up.
+func ValidID(id string) bool {
+	if id == "" || len(id) > MaxIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case (c == '-' || c == '_') && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
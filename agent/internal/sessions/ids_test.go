@@ -0,0 +1,36 @@
+package sessions
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidID(t *testing.T) {
+	for id, want := range map[string]bool{
+		"session-1760630400000000000":    true,
+		"s":                              true,
+		"Team_Huddle-2":                  true,
+		strings.Repeat("a", MaxIDLength): true,
+
+		"":                                 false,
+		strings.Repeat("a", MaxIDLength+1): false,
+		"-session":                         false,
+		"_session":                         false,
+		"../../etc/passwd":                 false,
+		"session-1/../../x":                false,
+		"session-1?token=x":                false,
+		"session-1%2F..":                   false,
+		"session 1":                        false,
+		"session-1\n":                      false,
+		"session-1\x00":                    false,
+		"'; DROP TABLE sessions;--":        false,
+		"<script>alert(1)</script>":        false,
+		"$(rm -rf ~)":                      false,
+		"séssion":                          false,
+		"session-１":                        false, // fullwidth digit
+	} {
+		if got := ValidID(id); got != want {
+			t.Errorf("ValidID(%q) = %v", id, got)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package sessions
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/zeropr/agent/internal/metrics"
+)
+
+// sendQueue is how many messages may wait to be written to one client
+const sendQueue = 256
+
+var (
+	// ErrSendQueueFull is returned when a message is dropped because the
+	// client isn't keeping up with what it's sent
+	ErrSendQueueFull = errors.New("client send queue full")
+	// ErrClientGone is returned when writing to a client that has left
+	ErrClientGone = errors.New("client disconnected")
+)
+
+// Keepalive is how the hub tells a live connection from one that half-died,
+// e.g. when a participant's laptop went to sleep
+type Keepalive struct {
+	Interval     time.Duration // between pings; a client that misses two is dropped (0 disables)
+	WriteTimeout time.Duration // how long a single write may take before the client is dropped (0 is unbounded)
+}
+
+// DefaultKeepalive pings every 20 seconds and gives each write 10
+var DefaultKeepalive = Keepalive{Interval: 20 * time.Second, WriteTimeout: 10 * time.Second}
+
+// PongWait is how long a client may go without answering a ping: two
+// missed pings, with half an interval of grace for the second
+func (k Keepalive) PongWait() time.Duration {
+	return 2*k.Interval + k.Interval/2
+}
+
+// Deadline returns when a write started now must be done by, or the zero
+// time for none
+func (k Keepalive) Deadline() time.Time {
+	if k.WriteTimeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(k.WriteTimeout)
+}
+
+// outgoing is a message waiting in a client's send queue
+type outgoing struct {
+	messageType int
+	data        []byte
+}
+
+// SetKeepalive sets the ping interval and write timeout of connections
+// registered from now on
+func (h *Hub) SetKeepalive(k Keepalive) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.keepalive = k
+}
+
+// expectPongs has the client's reads fail once it misses two pings; the
+// handler reading from the socket then unregisters it
+func (c *Client) expectPongs(k Keepalive) {
+	if k.Interval <= 0 {
+		return
+	}
+	wait := k.PongWait()
+	c.conn.SetReadDeadline(time.Now().Add(wait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(wait))
+	})
+}
+
+// writeLoop writes backlog, the session's document so far, then the
+// client's queued messages, each within the write timeout, and pings it
+// every interval, until the client is stopped. A write that fails closes
+// the socket, which ends the handler's read. Messages relayed while the
+// backlog is written wait in the queue behind it.
+func (c *Client) writeLoop(k Keepalive, backlog [][]byte) {
+	var ping <-chan time.Time
+	if k.Interval > 0 {
+		ticker := time.NewTicker(k.Interval)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
+
+	for _, data := range backlog {
+		c.conn.SetWriteDeadline(k.Deadline())
+		if err := c.conn.WriteMessage(websocket.BinaryMessage, data); err != nil {
+			c.abandon()
+			return
+		}
+	}
+
+	for {
+		var err error
+		select {
+		case <-c.done:
+			return
+		case msg := <-c.send:
+			c.conn.SetWriteDeadline(k.Deadline())
+			start := time.Now()
+			err = c.conn.WriteMessage(msg.messageType, msg.data)
+			c.observeWrite(time.Since(start), err)
+		case <-ping:
+			err = c.conn.WriteControl(websocket.PingMessage, nil, k.Deadline())
+		}
+		if err != nil {
+			c.abandon()
+			return
+		}
+	}
+}
+
+// abandon drops the client after a failed write, unless the connection
+// was closed under the writer
+func (c *Client) abandon() {
+	select {
+	case <-c.done:
+	default:
+		c.drop(metrics.DropWriteFailed)
+		c.conn.Close()
+	}
+}
+
+// tooSlow drops a client whose send queue overflowed, telling it why with
+// a CloseTooSlow frame. The frame is sent off the caller's goroutine, which
+// is usually relaying to the rest of the session.
+func (c *Client) tooSlow() {
+	if c.drop(metrics.DropTooSlow) {
+		go c.closeWith(CloseTooSlow, "too slow")
+	}
+}
+
+// drop records the hub giving up on the client for reason, once; it
+// reports whether this call was the one recorded
+func (c *Client) drop(reason string) bool {
+	first := false
+	c.dropOnce.Do(func() {
+		first = true
+		c.dropped(reason)
+	})
+	return first
+}
+
+// stop ends the client's writer; messages still queued are discarded
+func (c *Client) stop() {
+	c.stopOnce.Do(func() { close(c.done) })
+}
+
+// Unresponsive reports whether err, from reading client's socket, means
+// the client stopped answering pings, and records the drop if so
+func (h *Hub) Unresponsive(client *Client, err error) bool {
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		return false
+	}
+	client.drop(metrics.DropPingTimeout)
+	return true
+}
+
+// dropped records that the hub gave up on a client's connection
+func (h *Hub) dropped(client *Client, reason string) {
+	h.mu.RLock()
+	m := h.metrics
+	h.mu.RUnlock()
+
+	m.SyncDropped(reason)
+	h.logger.Info("Dropped connection", "session", client.SessionID, "participant", client.ParticipantID, "reason", reason)
+}
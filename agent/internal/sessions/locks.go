@@ -0,0 +1,153 @@
+package sessions
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Events published when advisory locks change
+const (
+	EventLockAcquired = "session.lock"
+	EventLockReleased = "session.unlock"
+)
+
+// Lock lifetimes
+const (
+	DefaultLockTTL = 5 * time.Minute
+	MaxLockTTL     = 30 * time.Minute
+)
+
+var (
+	// ErrSessionNotFound is returned for unknown session IDs
+	ErrSessionNotFound = errors.New("session not found")
+	// ErrNotParticipant is returned when a non-member tries to lock
+	ErrNotParticipant = errors.New("not a participant in this session")
+	// ErrAlreadyParticipant is returned when adding a participant the
+	// session already has
+	ErrAlreadyParticipant = errors.New("already a participant in this session")
+	// ErrInvalidRange is returned for empty or inverted line ranges
+	ErrInvalidRange = errors.New("invalid line range")
+	// ErrLockConflict is returned when the range overlaps another participant's lock
+	ErrLockConflict = errors.New("range is locked by another participant")
+	// ErrLockNotFound is returned when releasing a lock that doesn't exist or isn't ours
+	ErrLockNotFound = errors.New("lock not found")
+)
+
+// Lock is an advisory claim on a line range of a session's file. Editors
+// are expected to discourage edits inside other participants' locks; the
+// CRDT itself does not enforce them.
+type Lock struct {
+	ID            string
+	SessionID     string
+	ParticipantID string
+	StartLine     int // 1-based, inclusive
+	EndLine       int // inclusive
+	AcquiredAt    time.Time
+	ExpiresAt     time.Time
+}
+
+// overlaps reports whether two line ranges share a line
+func (l Lock) overlaps(start, end int) bool {
+	return l.StartLine <= end && start <= l.EndLine
+}
+
+// AcquireLock claims lines start..end for a participant until ttl elapses.
+// Overlapping the participant's own locks is allowed.
+func (m *Manager) AcquireLock(sessionID, participantID string, start, end int, ttl time.Duration) (Lock, error) {
+	if start < 1 || end < start {
+		return Lock{}, ErrInvalidRange
+	}
+	if ttl <= 0 {
+		ttl = DefaultLockTTL
+	}
+	if ttl > MaxLockTTL {
+		ttl = MaxLockTTL
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, ok := m.sessions[sessionID]
+	if !ok {
+		return Lock{}, ErrSessionNotFound
+	}
+	if !contains(session.Participants, participantID) {
+		return Lock{}, ErrNotParticipant
+	}
+	for _, existing := range session.Locks {
+		if existing.ParticipantID != participantID && existing.overlaps(start, end) {
+			return Lock{}, ErrLockConflict
+		}
+	}
+
+	now := time.Now()
+	lock := Lock{
+		ID:            fmt.Sprintf("lock-%d", now.UnixNano()),
+		SessionID:     sessionID,
+		ParticipantID: participantID,
+		StartLine:     start,
+		EndLine:       end,
+		AcquiredAt:    now,
+		ExpiresAt:     now.Add(ttl),
+	}
+	session.Locks = append(session.Locks, lock)
+	m.lockTimers[lock.ID] = time.AfterFunc(ttl, func() {
+		if m.ReleaseLock(sessionID, lock.ID, "") == nil {
+			m.logger.Debug("Lock expired", "session", sessionID, "lock", lock.ID, "participant", participantID)
+		}
+	})
+
+	m.bus.Publish(EventLockAcquired, lock)
+	m.bus.Publish(EventSessionUpdated, session.snapshot())
+	return lock, nil
+}
+
+// ReleaseLock drops a lock. A non-empty participantID must match the holder.
+func (m *Manager) ReleaseLock(sessionID, lockID, participantID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, ok := m.sessions[sessionID]
+	if !ok {
+		return ErrSessionNotFound
+	}
+	released := m.releaseLocksLocked(session, func(l Lock) bool {
+		return l.ID == lockID && (participantID == "" || l.ParticipantID == participantID)
+	})
+	if !released {
+		return ErrLockNotFound
+	}
+	m.bus.Publish(EventSessionUpdated, session.snapshot())
+	return nil
+}
+
+// releaseLocksLocked removes the session's locks matching match and stops
+// their timers, returning true if any were removed; m.mu must be held
+func (m *Manager) releaseLocksLocked(session *Session, match func(Lock) bool) bool {
+	kept := session.Locks[:0]
+	released := false
+	for _, lock := range session.Locks {
+		if !match(lock) {
+			kept = append(kept, lock)
+			continue
+		}
+		if timer, ok := m.lockTimers[lock.ID]; ok {
+			timer.Stop()
+			delete(m.lockTimers, lock.ID)
+		}
+		m.bus.Publish(EventLockReleased, lock)
+		released = true
+	}
+	session.Locks = kept
+	return released
+}
+
+func contains(list []string, item string) bool {
+	for _, v := range list {
+		if v == item {
+			return true
+		}
+	}
+	return false
+}
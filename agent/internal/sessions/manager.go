@@ -1,47 +1,147 @@
 package sessions
 
 import (
+	"log/slog"
 	"sync"
 	"time"
+
+	"github.com/zeropr/agent/internal/events"
+	"github.com/zeropr/agent/internal/logging"
+	"github.com/zeropr/agent/internal/redact"
+	"github.com/zeropr/agent/internal/wire"
+)
+
+// Events published on the bus when sessions change
+const (
+	EventSessionCreated = "session.created"
+	EventSessionUpdated = "session.updated"
+	EventSessionEnded   = "session.ended"
 )
 
 // Session represents a co-editing session
 type Session struct {
 	ID           string
+	Repo         string // the root FilePath is in
 	FilePath     string
 	Participants []string
+	Members      []Member // the participants with how they're shown, in the same order
 	Initiator    string
 	CreatedAt    time.Time
+	Connected    int    // unique participants with a live sync connection
+	Locks        []Lock // advisory edit locks on line ranges
+
+	MaxParticipants int // how many participants it takes; 0 is no cap
+	Occupancy       int // participants counted against MaxParticipants, in snapshots
+
+	contributors []string                 // everyone who has been a participant, in the order they joined
+	tokens       map[string]redact.Secret // participant -> the token their sockets take; never listed
+	revision     uint64                   // bumped when what's snapshotted to disk changes
+}
+
+// snapshot returns a copy that is safe to hand out after the lock is released
+func (s *Session) snapshot() Session {
+	cp := *s
+	cp.Participants = append([]string(nil), s.Participants...)
+	cp.Members = append([]Member(nil), s.Members...)
+	cp.contributors = append([]string(nil), s.contributors...)
+	cp.Locks = append([]Lock{}, s.Locks...)
+	cp.Occupancy = s.occupancy()
+	cp.tokens = make(map[string]redact.Secret, len(s.tokens))
+	for id, token := range s.tokens {
+		cp.tokens[id] = token
+	}
+	return cp
+}
+
+// Contributors returns everyone who has been a participant in the session,
+// including those who since left, in the order they joined
+func (s *Session) Contributors() []string {
+	return append([]string(nil), s.contributors...)
+}
+
+// addContributor records participantID as having taken part
+func (s *Session) addContributor(participantID string) {
+	for _, c := range s.contributors {
+		if c == participantID {
+			return
+		}
+	}
+	s.contributors = append(s.contributors, participantID)
 }
 
 // Manager manages active sessions
 type Manager struct {
-	sessions map[string]*Session
-	mu       sync.RWMutex
+	sessions   map[string]*Session
+	lockTimers map[string]*time.Timer // lock ID -> expiry timer
+	bus        *events.Bus
+	hub        *Hub                                    // told when participants join and leave
+	store      *SessionStore                           // where sessions are snapshotted, if anywhere
+	saved      map[string]uint64                       // session ID -> revision last snapshotted
+	archive    func(session Session, updates [][]byte) // handed each session as it ends
+	logger     *slog.Logger
+	mu         sync.RWMutex
 }
 
-// NewManager creates a new session manager
-func NewManager() *Manager {
+// NewManager creates a new session manager that publishes changes on bus
+func NewManager(bus *events.Bus) *Manager {
 	return &Manager{
-		sessions: make(map[string]*Session),
+		sessions:   make(map[string]*Session),
+		lockTimers: make(map[string]*time.Timer),
+		bus:        bus,
+		logger:     logging.Component(nil, "sessions"),
 	}
 }
 
-// Create creates a new session
-func (m *Manager) Create(id, filePath, initiator string) *Session {
+// SetLogger sets the logger session lifecycle is reported to
+func (m *Manager) SetLogger(logger *slog.Logger) {
+	m.logger = logging.Component(logger, "sessions")
+}
+
+// SetHub sets the hub whose sync clients are told when participants join
+// or leave a session
+func (m *Manager) SetHub(hub *Hub) {
+	m.hub = hub
+}
+
+// SetArchive sets fn to be handed each session as it ends, with its
+// document's updates if the hub recorded them in full
+func (m *Manager) SetArchive(fn func(session Session, updates [][]byte)) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	m.archive = fn
+}
 
+// Create creates a new session on a file in the named root, with initiator
+// as its first participant, holding a fresh token, and taking at most
+// maxParticipants of them (0 for no cap)
+func (m *Manager) Create(id, repo, filePath string, initiator Member, maxParticipants int) (*Session, error) {
+	token, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+
+	initiator = initiator.withDefaults(nil)
 	session := &Session{
 		ID:           id,
+		Repo:         repo,
 		FilePath:     filePath,
-		Participants: []string{initiator},
-		Initiator:    initiator,
+		Participants: []string{initiator.ID},
+		Members:      []Member{initiator},
+		Initiator:    initiator.ID,
+		contributors: []string{initiator.ID},
 		CreatedAt:    time.Now(),
+		tokens:       map[string]redact.Secret{initiator.ID: token},
 	}
+	session.MaxParticipants = maxParticipants
 
 	m.sessions[id] = session
-	return session
+	m.bus.Publish(EventSessionCreated, session.snapshot())
+	m.mu.Unlock()
+
+	m.hub.openDoc(id, nil)
+	return session, nil
 }
 
 // Get retrieves a session by ID
@@ -53,59 +153,124 @@ func (m *Manager) Get(id string) (*Session, bool) {
 	return session, ok
 }
 
-// AddParticipant adds a participant to a session
-func (m *Manager) AddParticipant(sessionID, participantID string) bool {
+// AddParticipant adds a participant to a session, with the session's next
+// free color unless they brought one. A participant already in it keeps
+// how they first joined, and ErrAlreadyParticipant is returned for them,
+// so callers decide whether whoever asked may speak for them. It fails with
+// ErrSessionNotFound, or with ErrSessionFull when the session is at its cap
+// and the participant doesn't already hold a seat by being connected to its
+// sync socket.
+func (m *Manager) AddParticipant(sessionID string, member Member) error {
 	m.mu.Lock()
-	defer m.mu.Unlock()
-
 	session, ok := m.sessions[sessionID]
 	if !ok {
-		return false
+		m.mu.Unlock()
+		return ErrSessionNotFound
 	}
 
 	// Check if already participant
 	for _, p := range session.Participants {
-		if p == participantID {
-			return true
+		if p == member.ID {
+			m.mu.Unlock()
+			return ErrAlreadyParticipant
 		}
 	}
+	if session.full() {
+		m.mu.Unlock()
+		return ErrSessionFull
+	}
 
-	session.Participants = append(session.Participants, participantID)
-	return true
+	member = member.withDefaults(session.Members)
+	session.Participants = append(session.Participants, member.ID)
+	session.Members = append(session.Members, member)
+	session.addContributor(member.ID)
+	session.revision++
+	snapshot := session.snapshot()
+	m.bus.Publish(EventSessionUpdated, snapshot)
+	m.mu.Unlock()
+
+	m.hub.ParticipantsChanged(sessionID, wire.TypeParticipantJoined, member, snapshot.Members)
+	return nil
 }
 
 // RemoveParticipant removes a participant from a session
 func (m *Manager) RemoveParticipant(sessionID, participantID string) {
+	member, participants, ended := m.removeParticipant(sessionID, participantID)
+	if ended != nil {
+		m.mu.RLock()
+		archive := m.archive
+		m.mu.RUnlock()
+		if updates, ok := m.hub.Document(sessionID); ok && archive != nil {
+			archive(*ended, updates)
+		}
+		m.hub.forgetDoc(sessionID)
+		m.hub.ForgetFrames(sessionID)
+	}
+	if member != nil {
+		m.hub.ParticipantsChanged(sessionID, wire.TypeParticipantLeft, *member, participants)
+	}
+}
+
+// removeParticipant does RemoveParticipant's work under the lock, returning
+// the participant if they were in the session, who's left, and the session
+// if that ended it
+func (m *Manager) removeParticipant(sessionID, participantID string) (*Member, []Member, *Session) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
 	session, ok := m.sessions[sessionID]
 	if !ok {
-		return
+		return nil, nil, nil
 	}
 
 	// Remove participant
-	for i, p := range session.Participants {
-		if p == participantID {
-			session.Participants = append(session.Participants[:i], session.Participants[i+1:]...)
+	removed := false
+	var left *Member
+	for i, p := range session.Members {
+		if p.ID == participantID {
+			member := p
+			left = &member
+			session.Members = append(session.Members[:i], session.Members[i+1:]...)
+			session.Participants = memberIDs(session.Members)
+			delete(session.tokens, participantID)
+			removed = true
+			session.revision++
 			break
 		}
 	}
 
+	// Locks never outlive their holder
+	if m.releaseLocksLocked(session, func(l Lock) bool { return l.ParticipantID == participantID }) {
+		removed = true
+	}
+
 	// If no participants left, delete session
 	if len(session.Participants) == 0 {
+		m.releaseLocksLocked(session, func(Lock) bool { return true })
 		delete(m.sessions, sessionID)
+		m.forgetLocked(sessionID)
+		ended := session.snapshot().Redacted()
+		m.bus.Publish(EventSessionEnded, ended)
+		m.logger.Info("Session ended", "session", sessionID, "path", session.FilePath)
+		return left, []Member{}, &ended
+	}
+
+	snapshot := session.snapshot()
+	if removed {
+		m.bus.Publish(EventSessionUpdated, snapshot)
 	}
+	return left, snapshot.Members, nil
 }
 
-// GetAll returns all active sessions
+// GetAll returns snapshots of all active sessions
 func (m *Manager) GetAll() []*Session {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
 	sessions := make([]*Session, 0, len(m.sessions))
 	for _, session := range m.sessions {
-		sessions = append(sessions, session)
+		snapshot := session.snapshot()
+		sessions = append(sessions, &snapshot)
 	}
 	return sessions
 }
@@ -117,4 +282,3 @@ func (m *Manager) Count() int {
 
 	return len(m.sessions)
 }
-
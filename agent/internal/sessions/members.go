@@ -0,0 +1,146 @@
+package sessions
+
+import (
+	"errors"
+
+	"github.com/zeropr/agent/internal/wire"
+)
+
+var (
+	// ErrNotInitiator is returned when someone other than the session's
+	// initiator changes a participant's role or the session's cap
+	ErrNotInitiator = errors.New("only the session's initiator can do that")
+	// ErrInitiatorRole is returned when changing the initiator's own role
+	ErrInitiatorRole = errors.New("the initiator's role can't change")
+)
+
+// Member is a participant with how editors show them: a display name, a
+// cursor color, and whether they edit the file or only view it
+type Member struct {
+	ID    string `json:"participantId"`
+	Name  string `json:"name,omitempty"`
+	Color string `json:"color"` // #rrggbb
+	Role  string `json:"role"`  // RosterEditor or RosterViewer
+	Agent string `json:"-"`     // fingerprint of the agent that joined them on its user's behalf, if one did
+}
+
+// palette is the cursor colors handed to participants who don't pick one,
+// chosen to tell apart on light and dark themes
+var palette = []string{
+	"#e6194b", "#3cb44b", "#4363d8", "#f58231",
+	"#911eb4", "#42d4f4", "#f032e6", "#9a6324",
+	"#469990", "#800000", "#808000", "#000075",
+}
+
+// pickColor returns the first palette color none of members has, or once
+// every one is taken, the one fewest have
+func pickColor(members []Member) string {
+	used := make(map[string]int, len(members))
+	for _, m := range members {
+		used[m.Color]++
+	}
+	best := palette[0]
+	for _, color := range palette {
+		if used[color] == 0 {
+			return color
+		}
+		if used[color] < used[best] {
+			best = color
+		}
+	}
+	return best
+}
+
+// withDefaults returns the member with the role defaulted to editor and,
+// without a color of its own, one the session's other members don't have
+func (m Member) withDefaults(members []Member) Member {
+	if m.Role == "" {
+		m.Role = RosterEditor
+	}
+	if m.Color == "" {
+		m.Color = pickColor(members)
+	}
+	return m
+}
+
+// memberIDs lists members' participant IDs, in order
+func memberIDs(members []Member) []string {
+	ids := make([]string, len(members))
+	for i, m := range members {
+		ids[i] = m.ID
+	}
+	return ids
+}
+
+// Member returns a session's participant as they joined it
+func (m *Manager) Member(sessionID, participantID string) (Member, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	session, ok := m.sessions[sessionID]
+	if !ok {
+		return Member{}, false
+	}
+	for _, member := range session.Members {
+		if member.ID == participantID {
+			return member, true
+		}
+	}
+	return Member{}, false
+}
+
+// SetRole makes a session's participant an editor or a viewer, on behalf
+// of by, who must be the session's initiator. The change reaches their
+// live connection at once, and the session's roster clients are told.
+func (m *Manager) SetRole(sessionID, by, participantID, role string) (Member, error) {
+	m.mu.Lock()
+	session, ok := m.sessions[sessionID]
+	if !ok {
+		m.mu.Unlock()
+		return Member{}, ErrSessionNotFound
+	}
+	if by == "" || by != session.Initiator {
+		m.mu.Unlock()
+		return Member{}, ErrNotInitiator
+	}
+	if participantID == session.Initiator {
+		m.mu.Unlock()
+		return Member{}, ErrInitiatorRole
+	}
+	i := -1
+	for j, member := range session.Members {
+		if member.ID == participantID {
+			i = j
+			break
+		}
+	}
+	if i < 0 {
+		m.mu.Unlock()
+		return Member{}, ErrNotParticipant
+	}
+	if session.Members[i].Role == role {
+		member := session.Members[i]
+		m.mu.Unlock()
+		return member, nil
+	}
+
+	session.Members[i].Role = role
+	member := session.Members[i]
+	session.revision++
+	snapshot := session.snapshot()
+	m.bus.Publish(EventSessionUpdated, snapshot)
+	m.mu.Unlock()
+
+	m.hub.setViewer(sessionID, participantID, role == RosterViewer)
+	m.hub.ParticipantsChanged(sessionID, wire.TypeParticipantRole, member, snapshot.Members)
+	return member, nil
+}
+
+// wireMembers converts members for a frame
+func wireMembers(members []Member) []wire.Member {
+	out := make([]wire.Member, len(members))
+	for i, m := range members {
+		out[i] = wire.Member{ParticipantID: m.ID, Name: m.Name, Color: m.Color, Role: m.Role}
+	}
+	return out
+}
@@ -0,0 +1,66 @@
+package sessions
+
+import (
+	"sort"
+	"time"
+)
+
+// How a participant is connected to a session
+const (
+	ConnectionSocket = "ws"   // holds a live sync socket
+	ConnectionHTTP   = "http" // joined through the API and hasn't connected, or has left the socket
+)
+
+// Participant is one participant in a session and how they're connected
+type Participant struct {
+	ParticipantID string     `json:"participantId"`
+	Role          string     `json:"role"`       // RoleInitiator or RoleParticipant
+	Connection    string     `json:"connection"` // ConnectionSocket or ConnectionHTTP
+	ConnectedAt   *time.Time `json:"connectedAt,omitempty"`
+	Joined        bool       `json:"joined"` // in the participant list, rather than only connected to the socket
+}
+
+// Participants lists who's in a session now: everyone who joined it, and
+// anyone connected to its sync socket without joining, such as an editor
+// opening the socket with the session token alone. The initiator comes
+// first, then the others by ID.
+func (m *Manager) Participants(sessionID string) ([]Participant, error) {
+	m.mu.RLock()
+	session, ok := m.sessions[sessionID]
+	if !ok {
+		m.mu.RUnlock()
+		return nil, ErrSessionNotFound
+	}
+	snapshot := session.snapshot()
+	m.mu.RUnlock()
+
+	connected := m.hub.ConnectedSince(sessionID)
+	participants := make([]Participant, 0, len(snapshot.Participants)+len(connected))
+	add := func(participantID string, joined bool) {
+		p := Participant{ParticipantID: participantID, Role: RoleParticipant, Connection: ConnectionHTTP, Joined: joined}
+		if participantID == snapshot.Initiator {
+			p.Role = RoleInitiator
+		}
+		if since, ok := connected[participantID]; ok {
+			p.Connection = ConnectionSocket
+			p.ConnectedAt = &since
+			delete(connected, participantID)
+		}
+		participants = append(participants, p)
+	}
+	for _, participantID := range snapshot.Participants {
+		add(participantID, true)
+	}
+	for participantID := range connected {
+		add(participantID, false)
+	}
+
+	sort.SliceStable(participants, func(i, j int) bool {
+		a, b := participants[i], participants[j]
+		if (a.Role == RoleInitiator) != (b.Role == RoleInitiator) {
+			return a.Role == RoleInitiator
+		}
+		return a.ParticipantID < b.ParticipantID
+	})
+	return participants, nil
+}
@@ -0,0 +1,378 @@
+package sessions
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/zeropr/agent/internal/redact"
+)
+
+const (
+	// DefaultSnapshotInterval is how often live sessions are saved
+	DefaultSnapshotInterval = 10 * time.Second
+	// DefaultRestoreTTL is how long a saved session may go unsaved and
+	// still be restored
+	DefaultRestoreTTL = time.Hour
+
+	snapshotMagic = "zeropr-session-v1\n"
+	snapshotExt   = ".bin"
+)
+
+// errBadSnapshot is returned for a snapshot file that can't be read back
+var errBadSnapshot = errors.New("malformed session snapshot")
+
+// SessionStore keeps each live session in <dir>/<id>.bin: the session
+// itself, with its sync token so participants' editors can reconnect, and
+// its document updates. Files are replaced atomically and removed when the
+// session ends.
+type SessionStore struct {
+	dir string
+	ttl time.Duration
+}
+
+// savedSession is the metadata part of a snapshot
+type savedSession struct {
+	ID           string            `json:"id"`
+	Repo         string            `json:"repo"`
+	FilePath     string            `json:"filePath"`
+	Participants []string          `json:"participants"`
+	Members      []Member          `json:"members,omitempty"`
+	Contributors []string          `json:"contributors,omitempty"`
+	Initiator    string            `json:"initiator"`
+	CreatedAt    time.Time         `json:"createdAt"`
+	Tokens       map[string]string `json:"tokens,omitempty"` // participant -> socket token
+	SavedAt      time.Time         `json:"savedAt"`
+	Max          int               `json:"maxParticipants,omitempty"`
+}
+
+// restoredSession is a snapshot read back at startup
+type restoredSession struct {
+	session *Session
+	updates [][]byte
+}
+
+// OpenSessionStore keeps session snapshots in dir; those last saved more
+// than ttl ago aren't restored
+func OpenSessionStore(dir string, ttl time.Duration) (*SessionStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+	return &SessionStore{dir: dir, ttl: ttl}, nil
+}
+
+func (s *SessionStore) path(id string) string {
+	return filepath.Join(s.dir, id+snapshotExt)
+}
+
+// EncodeSnapshot serializes a session and its document updates as they're
+// saved to disk, participants' tokens included
+func EncodeSnapshot(session Session, updates [][]byte) ([]byte, error) {
+	meta, err := json.Marshal(savedSession{
+		ID:           session.ID,
+		Repo:         session.Repo,
+		FilePath:     session.FilePath,
+		Participants: session.Participants,
+		Members:      session.Members,
+		Contributors: session.contributors,
+		Initiator:    session.Initiator,
+		CreatedAt:    session.CreatedAt,
+		Tokens:       revealTokens(session.tokens),
+		SavedAt:      time.Now(),
+		Max:          session.MaxParticipants,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(snapshotMagic)
+	writeChunk(&buf, meta)
+	for _, update := range updates {
+		writeChunk(&buf, update)
+	}
+	return buf.Bytes(), nil
+}
+
+// revealTokens returns participants' tokens as they're saved
+func revealTokens(tokens map[string]redact.Secret) map[string]string {
+	if len(tokens) == 0 {
+		return nil
+	}
+	revealed := make(map[string]string, len(tokens))
+	for id, token := range tokens {
+		revealed[id] = token.Reveal()
+	}
+	return revealed
+}
+
+func writeChunk(buf *bytes.Buffer, data []byte) {
+	var n [binary.MaxVarintLen64]byte
+	buf.Write(n[:binary.PutUvarint(n[:], uint64(len(data)))])
+	buf.Write(data)
+}
+
+// save writes a session's snapshot to a temporary file and renames it
+// over the last one, so a crash mid-write leaves the previous snapshot
+func (s *SessionStore) save(session Session, updates [][]byte) error {
+	if !ValidID(session.ID) {
+		return fmt.Errorf("invalid session ID %q", session.ID)
+	}
+	data, err := EncodeSnapshot(session, updates)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(s.dir, "."+session.ID+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path(session.ID))
+}
+
+// remove deletes an ended session's snapshot
+func (s *SessionStore) remove(id string) error {
+	if !ValidID(id) {
+		return nil
+	}
+	if err := os.Remove(s.path(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// load reads back every snapshot saved within the TTL. Older snapshots,
+// unreadable ones, and temporary files a crash left behind are removed.
+func (s *SessionStore) load() ([]restoredSession, []error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, []error{err}
+	}
+
+	var restored []restoredSession
+	var errs []error
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			continue
+		}
+		path := filepath.Join(s.dir, name)
+		if strings.HasPrefix(name, ".") {
+			os.Remove(path)
+			continue
+		}
+		if !strings.HasSuffix(name, snapshotExt) {
+			continue
+		}
+
+		r, savedAt, err := readSnapshot(path)
+		if err == nil && r.session.ID != strings.TrimSuffix(name, snapshotExt) {
+			err = errBadSnapshot
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			os.Remove(path)
+			continue
+		}
+		if time.Since(savedAt) > s.ttl {
+			os.Remove(path)
+			continue
+		}
+		restored = append(restored, r)
+	}
+	return restored, errs
+}
+
+func readSnapshot(path string) (restoredSession, time.Time, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return restoredSession{}, time.Time{}, err
+	}
+	return decodeSnapshot(data)
+}
+
+// DecodeSnapshot reads back a session and its document updates serialized
+// by EncodeSnapshot
+func DecodeSnapshot(data []byte) (*Session, [][]byte, error) {
+	r, _, err := decodeSnapshot(data)
+	return r.session, r.updates, err
+}
+
+func decodeSnapshot(data []byte) (restoredSession, time.Time, error) {
+	if !bytes.HasPrefix(data, []byte(snapshotMagic)) {
+		return restoredSession{}, time.Time{}, errBadSnapshot
+	}
+	r := bytes.NewReader(data[len(snapshotMagic):])
+
+	meta, err := readChunk(r)
+	if err != nil {
+		return restoredSession{}, time.Time{}, errBadSnapshot
+	}
+	var saved savedSession
+	if err := json.Unmarshal(meta, &saved); err != nil || !ValidID(saved.ID) {
+		return restoredSession{}, time.Time{}, errBadSnapshot
+	}
+
+	var updates [][]byte
+	for r.Len() > 0 {
+		update, err := readChunk(r)
+		if err != nil {
+			return restoredSession{}, time.Time{}, errBadSnapshot
+		}
+		updates = append(updates, update)
+	}
+
+	session := &Session{
+		ID:           saved.ID,
+		Repo:         saved.Repo,
+		FilePath:     saved.FilePath,
+		Participants: saved.Participants,
+		Members:      saved.Members,
+		Initiator:    saved.Initiator,
+		CreatedAt:    saved.CreatedAt,
+		contributors: saved.Contributors,
+	}
+	// Snapshots from before participants had their own tokens held one
+	// for the whole session; its participants are sent new ones when they
+	// join again
+	for id, token := range saved.Tokens {
+		if session.tokens == nil {
+			session.tokens = make(map[string]redact.Secret)
+		}
+		session.tokens[id] = redact.Secret(token)
+	}
+	session.MaxParticipants = saved.Max
+	if session.Participants == nil {
+		session.Participants = []string{}
+	}
+	if len(session.Members) != len(session.Participants) {
+		session.Members = make([]Member, 0, len(session.Participants))
+		for _, id := range session.Participants {
+			session.Members = append(session.Members, Member{ID: id}.withDefaults(session.Members))
+		}
+	}
+	return restoredSession{session: session, updates: updates}, saved.SavedAt, nil
+}
+
+func readChunk(r *bytes.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil || n > uint64(r.Len()) {
+		return nil, errBadSnapshot
+	}
+	chunk := make([]byte, n)
+	if _, err := io.ReadFull(r, chunk); err != nil {
+		return nil, err
+	}
+	return chunk, nil
+}
+
+// SetStore restores the sessions saved in store, with their documents, and
+// saves sessions there from now on. It returns the IDs of the sessions
+// restored. Call it before serving.
+func (m *Manager) SetStore(store *SessionStore) []string {
+	restored, errs := store.load()
+	for _, err := range errs {
+		m.logger.Warn("Discarded unreadable session snapshot", "err", err)
+	}
+
+	m.mu.Lock()
+	m.store = store
+	m.saved = make(map[string]uint64)
+	for _, r := range restored {
+		m.sessions[r.session.ID] = r.session
+	}
+	m.mu.Unlock()
+
+	ids := make([]string, 0, len(restored))
+	for _, r := range restored {
+		m.hub.openDoc(r.session.ID, r.updates)
+		m.logger.Info("Restored session", "session", r.session.ID, "path", r.session.FilePath, "participants", len(r.session.Participants), "updates", len(r.updates))
+		ids = append(ids, r.session.ID)
+	}
+	return ids
+}
+
+// SaveAll snapshots every session that changed since it was last saved
+func (m *Manager) SaveAll() {
+	m.mu.RLock()
+	store := m.store
+	var sessions []Session
+	for _, session := range m.sessions {
+		sessions = append(sessions, session.snapshot())
+	}
+	m.mu.RUnlock()
+	if store == nil {
+		return
+	}
+
+	for _, session := range sessions {
+		updates, docRevision := m.hub.doc(session.ID)
+		revision := session.revision + docRevision
+
+		m.mu.Lock()
+		_, live := m.sessions[session.ID]
+		saved, ok := m.saved[session.ID]
+		m.mu.Unlock()
+		if !live || (ok && saved == revision) {
+			continue
+		}
+
+		if err := store.save(session, updates); err != nil {
+			m.logger.Warn("Failed to save session", "session", session.ID, "err", err)
+			continue
+		}
+		m.mu.Lock()
+		if _, live := m.sessions[session.ID]; live {
+			m.saved[session.ID] = revision
+		} else {
+			// It ended while being written
+			store.remove(session.ID)
+		}
+		m.mu.Unlock()
+	}
+}
+
+// Snapshot saves changed sessions every interval until ctx is done
+func (m *Manager) Snapshot(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.SaveAll()
+		}
+	}
+}
+
+// forgetLocked removes an ended session's snapshot; m.mu must be held
+func (m *Manager) forgetLocked(sessionID string) {
+	if m.store == nil {
+		return
+	}
+	delete(m.saved, sessionID)
+	if err := m.store.remove(sessionID); err != nil {
+		m.logger.Warn("Failed to remove session snapshot", "session", sessionID, "err", err)
+	}
+}
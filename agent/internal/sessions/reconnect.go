@@ -0,0 +1,162 @@
+package sessions
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/zeropr/agent/internal/redact"
+)
+
+// DefaultRejoinGrace is how long a dropped participant may reconnect as themselves
+const DefaultRejoinGrace = 2 * time.Minute
+
+// Participant roles restored on reconnect
+const (
+	RoleInitiator   = "initiator"
+	RoleParticipant = "participant"
+)
+
+var (
+	// ErrUnknownReconnect is returned for tokens we never issued or that were revoked
+	ErrUnknownReconnect = errors.New("unknown reconnection token")
+	// ErrReconnectExpired is returned once the grace period after a drop has passed
+	ErrReconnectExpired = errors.New("reconnection token expired")
+)
+
+// Rejoin is the identity a reconnection token restores
+type Rejoin struct {
+	SessionID     string
+	ParticipantID string
+	Role          string
+}
+
+type reconnectEntry struct {
+	Rejoin
+	connected bool      // a sync socket is currently open for the participant
+	expiresAt time.Time // meaningful only while disconnected
+}
+
+// ReconnectTokens issues one token per participant per session. A token
+// stays valid while its participant is connected and for a grace period
+// after their last sync socket drops.
+type ReconnectTokens struct {
+	grace   time.Duration
+	entries map[string]*reconnectEntry // token -> entry
+	byKey   map[string]string          // session/participant -> token
+	mu      sync.Mutex
+}
+
+// NewReconnectTokens creates a token store with the given grace period
+func NewReconnectTokens(grace time.Duration) *ReconnectTokens {
+	if grace <= 0 {
+		grace = DefaultRejoinGrace
+	}
+	return &ReconnectTokens{
+		grace:   grace,
+		entries: make(map[string]*reconnectEntry),
+		byKey:   make(map[string]string),
+	}
+}
+
+func participantKey(sessionID, participantID string) string {
+	return sessionID + "/" + participantID
+}
+
+// Issue returns a fresh token for a participant, replacing any earlier one
+func (t *ReconnectTokens) Issue(sessionID, participantID, role string) (redact.Secret, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	t.pruneLocked(now)
+
+	key := participantKey(sessionID, participantID)
+	if previous, ok := t.byKey[key]; ok {
+		delete(t.entries, previous)
+	}
+	t.byKey[key] = token
+	t.entries[token] = &reconnectEntry{
+		Rejoin:    Rejoin{SessionID: sessionID, ParticipantID: participantID, Role: role},
+		expiresAt: now.Add(t.grace),
+	}
+	return redact.Secret(token), nil
+}
+
+// Redeem resolves a token presented on the sync socket for sessionID
+func (t *ReconnectTokens) Redeem(sessionID, token string) (Rejoin, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entry, ok := t.entries[token]
+	if !ok || entry.SessionID != sessionID {
+		return Rejoin{}, ErrUnknownReconnect
+	}
+	if !entry.connected && !time.Now().Before(entry.expiresAt) {
+		t.deleteLocked(token, entry)
+		return Rejoin{}, ErrReconnectExpired
+	}
+	return entry.Rejoin, nil
+}
+
+// Connected marks a participant as having a live sync socket, so their
+// token doesn't lapse while they're connected
+func (t *ReconnectTokens) Connected(sessionID, participantID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if entry, ok := t.entries[t.byKey[participantKey(sessionID, participantID)]]; ok {
+		entry.connected = true
+	}
+}
+
+// Disconnected starts the grace period for a participant whose socket dropped
+func (t *ReconnectTokens) Disconnected(sessionID, participantID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if entry, ok := t.entries[t.byKey[participantKey(sessionID, participantID)]]; ok {
+		entry.connected = false
+		entry.expiresAt = time.Now().Add(t.grace)
+	}
+}
+
+// Revoke invalidates a participant's token, e.g. after an explicit leave
+func (t *ReconnectTokens) Revoke(sessionID, participantID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	token, ok := t.byKey[participantKey(sessionID, participantID)]
+	if !ok {
+		return
+	}
+	t.deleteLocked(token, t.entries[token])
+}
+
+// pruneLocked drops tokens whose grace period has passed; t.mu must be held
+func (t *ReconnectTokens) pruneLocked(now time.Time) {
+	for token, entry := range t.entries {
+		if !entry.connected && !now.Before(entry.expiresAt) {
+			t.deleteLocked(token, entry)
+		}
+	}
+}
+
+// deleteLocked removes a token and its index entry; t.mu must be held
+func (t *ReconnectTokens) deleteLocked(token string, entry *reconnectEntry) {
+	delete(t.entries, token)
+	if entry != nil {
+		key := participantKey(entry.SessionID, entry.ParticipantID)
+		if t.byKey[key] == token {
+			delete(t.byKey, key)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package sessions
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReconnectTokens(t *testing.T) {
+	tokens := NewReconnectTokens(time.Hour)
+	token, err := tokens.Issue("s1", "bob", RoleParticipant)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rejoin, err := tokens.Redeem("s1", token.Reveal())
+	if err != nil || rejoin != (Rejoin{SessionID: "s1", ParticipantID: "bob", Role: RoleParticipant}) {
+		t.Fatalf("redeemed %+v, %v", rejoin, err)
+	}
+	if _, err := tokens.Redeem("s2", token.Reveal()); !errors.Is(err, ErrUnknownReconnect) {
+		t.Errorf("redeemed in another session: %v", err)
+	}
+	if _, err := tokens.Redeem("s1", "nope"); !errors.Is(err, ErrUnknownReconnect) {
+		t.Errorf("redeemed a token never issued: %v", err)
+	}
+
+	// A new token replaces the participant's earlier one
+	again, err := tokens.Issue("s1", "bob", RoleParticipant)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tokens.Redeem("s1", token.Reveal()); !errors.Is(err, ErrUnknownReconnect) {
+		t.Errorf("the replaced token still redeems: %v", err)
+	}
+
+	tokens.Revoke("s1", "bob")
+	if _, err := tokens.Redeem("s1", again.Reveal()); !errors.Is(err, ErrUnknownReconnect) {
+		t.Errorf("a revoked token still redeems: %v", err)
+	}
+}
+
+func TestReconnectGrace(t *testing.T) {
+	tokens := NewReconnectTokens(20 * time.Millisecond)
+	token, err := tokens.Issue("s1", "bob", RoleParticipant)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Connected, the token outlives the grace period
+	tokens.Connected("s1", "bob")
+	time.Sleep(40 * time.Millisecond)
+	if _, err := tokens.Redeem("s1", token.Reveal()); err != nil {
+		t.Fatalf("a connected participant's token lapsed: %v", err)
+	}
+
+	// and lapses once that long passes after the socket drops
+	tokens.Disconnected("s1", "bob")
+	if _, err := tokens.Redeem("s1", token.Reveal()); err != nil {
+		t.Fatalf("the token lapsed as the socket dropped: %v", err)
+	}
+	time.Sleep(40 * time.Millisecond)
+	if _, err := tokens.Redeem("s1", token.Reveal()); !errors.Is(err, ErrReconnectExpired) {
+		t.Errorf("redeemed after the grace period: %v", err)
+	}
+	if _, err := tokens.Redeem("s1", token.Reveal()); !errors.Is(err, ErrUnknownReconnect) {
+		t.Errorf("an expired token wasn't forgotten: %v", err)
+	}
+}
@@ -0,0 +1,132 @@
+package sessions
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// DefaultRecording is how many bytes of each session's sync frames are
+// kept for debugging
+const DefaultRecording = 4 << 20
+
+// Directions of a recorded frame
+const (
+	FrameIn  = "in"  // sent to this agent by a participant's editor
+	FrameOut = "out" // sent by this agent to a participant's editor
+)
+
+// Frame is one sync frame as the agent saw it pass
+type Frame struct {
+	At          time.Time `json:"at"`
+	Participant string    `json:"participant"`
+	Direction   string    `json:"dir"`
+	Dropped     string    `json:"dropped,omitempty"` // why the frame went no further, if it didn't
+	Data        []byte    `json:"data"`
+}
+
+// recording is a session's most recent sync frames, oldest first
+type recording struct {
+	frames []Frame
+	size   int
+}
+
+// RecordFrames has the hub keep up to limit bytes of each session's sync
+// protocol frames, dropping the oldest past that, until the session ends.
+// Zero or less keeps none.
+func (h *Hub) RecordFrames(limit int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.recordLimit = limit
+	if limit <= 0 {
+		h.recordings = nil
+		return
+	}
+	if h.recordings == nil {
+		h.recordings = make(map[string]*recording)
+	}
+}
+
+// RecordFrame adds a frame to a session's recording, if frames are
+// recorded. Only sync protocol frames are kept: awareness and control
+// frames say nothing about the document. data must not be modified
+// afterwards.
+func (h *Hub) RecordFrame(sessionID string, frame Frame) {
+	if h == nil || len(frame.Data) == 0 || frame.Data[0] != messageSync {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.recordings == nil || len(frame.Data) > h.recordLimit {
+		return
+	}
+	rec, ok := h.recordings[sessionID]
+	if !ok {
+		rec = &recording{}
+		h.recordings[sessionID] = rec
+	}
+	if frame.At.IsZero() {
+		frame.At = time.Now()
+	}
+	rec.frames = append(rec.frames, frame)
+	rec.size += len(frame.Data)
+	drop := 0
+	for rec.size > h.recordLimit {
+		rec.size -= len(rec.frames[drop].Data)
+		drop++
+	}
+	if drop > 0 {
+		rec.frames = append(rec.frames[:0:0], rec.frames[drop:]...)
+	}
+}
+
+// recordReceived records a binary frame a participant's editor sent
+func (h *Hub) recordReceived(from *Client, messageType int, data []byte, dropped string) {
+	if messageType != websocket.BinaryMessage {
+		return
+	}
+	h.RecordFrame(from.SessionID, Frame{Participant: from.ParticipantID, Direction: FrameIn, Dropped: dropped, Data: data})
+}
+
+// ForgetFrames drops a session's recording, as when it ends
+func (h *Hub) ForgetFrames(sessionID string) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.recordings, sessionID)
+}
+
+// Segment returns the frames recorded for a session from since until
+// until, oldest first. A zero since or until leaves that end open.
+func (h *Hub) Segment(sessionID string, since, until time.Time) []Frame {
+	if h == nil {
+		return nil
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	rec, ok := h.recordings[sessionID]
+	if !ok {
+		return []Frame{}
+	}
+	segment := []Frame{}
+	for _, frame := range rec.frames {
+		if (!since.IsZero() && frame.At.Before(since)) || (!until.IsZero() && frame.At.After(until)) {
+			continue
+		}
+		segment = append(segment, frame)
+	}
+	return segment
+}
+
+// RecordingFrames reports whether the hub records sync frames
+func (h *Hub) RecordingFrames() bool {
+	if h == nil {
+		return false
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.recordings != nil
+}
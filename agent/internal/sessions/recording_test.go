@@ -0,0 +1,117 @@
+package sessions
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/zeropr/agent/internal/events"
+)
+
+// update is a sync update frame carrying mark
+func update(mark byte) []byte {
+	return []byte{messageSync, syncUpdate, 1, mark}
+}
+
+func TestRecordFrames(t *testing.T) {
+	hub := NewHub(DuplicateReplace)
+	hub.RecordFrames(1 << 20)
+	hub.SetRoles(func(sessionID, participantID string) string {
+		if participantID == "viewer" {
+			return RosterViewer
+		}
+		return RosterEditor
+	})
+	url := serveHub(t, hub)
+	editor := dialHub(t, url, "editor")
+	viewer := dialHub(t, url, "viewer")
+	waitParticipants(t, hub, 2)
+
+	start := time.Now()
+	editor.WriteMessage(websocket.BinaryMessage, update(1))
+	viewer.WriteMessage(websocket.BinaryMessage, update(2))
+	editor.WriteMessage(websocket.TextMessage, []byte(`{"type":"hello"}`))
+	// Awareness isn't part of the document
+	editor.WriteMessage(websocket.BinaryMessage, []byte{messageAwareness, 0})
+	editor.WriteMessage(websocket.BinaryMessage, update(3))
+
+	var segment []Frame
+	deadline := time.Now().Add(5 * time.Second)
+	for len(segment) < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		segment = hub.Segment("s", time.Time{}, time.Time{})
+	}
+	if len(segment) != 3 {
+		t.Fatalf("recorded %d frames, want 3: %+v", len(segment), segment)
+	}
+	byMark := map[byte]Frame{}
+	for _, frame := range segment {
+		if frame.Direction != FrameIn || frame.At.Before(start) {
+			t.Errorf("frame %+v", frame)
+		}
+		byMark[frame.Data[3]] = frame
+	}
+	if f := byMark[1]; f.Participant != "editor" || f.Dropped != "" {
+		t.Errorf("editor's update recorded as %+v", f)
+	}
+	if f := byMark[2]; f.Participant != "viewer" || f.Dropped != "viewer" {
+		t.Errorf("viewer's update recorded as %+v", f)
+	}
+
+	// The window bounds the segment
+	if got := hub.Segment("s", time.Now(), time.Time{}); len(got) != 0 {
+		t.Errorf("segment from now holds %d frames", len(got))
+	}
+	if got := hub.Segment("other", time.Time{}, time.Time{}); len(got) != 0 {
+		t.Errorf("unknown session's segment holds %d frames", len(got))
+	}
+}
+
+func TestRecordingDropsOldestPastLimit(t *testing.T) {
+	hub := NewHub(DuplicateReplace)
+	hub.RecordFrames(10)
+	base := time.Now()
+	for i := 0; i < 5; i++ {
+		hub.RecordFrame("s", Frame{At: base.Add(time.Duration(i) * time.Second), Participant: "p", Direction: FrameIn, Data: update(byte(i))})
+	}
+	segment := hub.Segment("s", time.Time{}, time.Time{})
+	if len(segment) != 2 || segment[0].Data[3] != 3 || segment[1].Data[3] != 4 {
+		t.Fatalf("kept %+v, want the last two frames", segment)
+	}
+	window := hub.Segment("s", base.Add(4*time.Second), base.Add(4*time.Second))
+	if len(window) != 1 || !bytes.Equal(window[0].Data, update(4)) {
+		t.Errorf("window holds %+v", window)
+	}
+
+	// A frame bigger than the limit isn't kept at all
+	hub.RecordFrame("s", Frame{Data: append(update(9), make([]byte, 10)...)})
+	if got := hub.Segment("s", time.Time{}, time.Time{}); len(got) != 2 {
+		t.Errorf("oversized frame changed the recording to %+v", got)
+	}
+
+	hub.RecordFrames(0)
+	hub.RecordFrame("s", Frame{Data: update(5)})
+	if hub.RecordingFrames() || len(hub.Segment("s", time.Time{}, time.Time{})) != 0 {
+		t.Error("frames recorded after recording was turned off")
+	}
+}
+
+func TestRecordingEndsWithSession(t *testing.T) {
+	hub := NewHub(DuplicateReplace)
+	hub.RecordFrames(1 << 20)
+	m := NewManager(events.NewBus())
+	m.SetHub(hub)
+	session, err := m.Create("0123456789abcdef", "repo", "main.go", Member{ID: "alice"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub.RecordFrame(session.ID, Frame{Participant: "alice", Direction: FrameIn, Data: update(1)})
+	if len(hub.Segment(session.ID, time.Time{}, time.Time{})) != 1 {
+		t.Fatal("frame not recorded")
+	}
+	m.RemoveParticipant(session.ID, "alice")
+	if len(hub.Segment(session.ID, time.Time{}, time.Time{})) != 0 {
+		t.Error("recording outlived its session")
+	}
+}
@@ -0,0 +1,271 @@
+package sessions
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/zeropr/agent/internal/wire"
+)
+
+// RosterInterval is how often a session's roster is re-sent when nothing
+// prompts it sooner, so clients that missed an update catch up
+const RosterInterval = 30 * time.Second
+
+// dormantAfter is how long a connected participant may send nothing before
+// the roster marks them dormant
+const dormantAfter = 2 * time.Minute
+
+// Roles shown in the roster
+const (
+	RosterHost   = "host" // started the session
+	RosterEditor = "editor"
+	RosterViewer = "viewer" // joined to follow along without editing
+)
+
+// Connection quality buckets, by how long writes to a participant take
+const (
+	QualityGood = "good"
+	QualityFair = "fair"
+	QualityPoor = "poor" // writes are slow or the last one failed
+)
+
+// Write times marking the quality buckets
+const (
+	fairWrite = 50 * time.Millisecond
+	poorWrite = 250 * time.Millisecond
+)
+
+// RoleFunc names a participant's role in a session, one of the Roster roles
+type RoleFunc func(sessionID, participantID string) string
+
+// rosterState is what the hub last told a session about its roster
+type rosterState struct {
+	revision     uint64
+	participants []byte // the JSON sent, to spot changes
+	timer        *time.Timer
+}
+
+// SetRoles sets how participants' roles are looked up for the roster;
+// without it everyone is an editor
+func (h *Hub) SetRoles(roles RoleFunc) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.roles = roles
+}
+
+// rosterSync handles a wire.RosterSync: a client opts into roster frames
+// by sending one, which y-websocket clients that can't handle text frames
+// never do, and from then on is sent the roster on every change and every
+// RosterInterval. A client that sees a gap in the revisions can send
+// another to be sent the current roster.
+func (h *Hub) rosterSync(from *Client, _ wire.Frame) error {
+	from.roster.Store(true)
+	h.sendRoster(from.SessionID, from)
+	return nil
+}
+
+// sendRoster sends a session's roster to every participant who asked for
+// it, or only to requester if set and nothing has changed since the last
+// one, and schedules the next heartbeat
+func (h *Hub) sendRoster(sessionID string, requester *Client) {
+	h.mu.Lock()
+	frame, changed := h.rosterFrameLocked(sessionID, time.Now())
+	targets := h.targetsLocked(sessionID, nil)
+	h.mu.Unlock()
+
+	if frame == nil {
+		return
+	}
+	if requester != nil && !changed {
+		targets = []*Client{requester}
+	}
+	for _, target := range targets {
+		if target.roster.Load() {
+			target.write(websocket.TextMessage, frame)
+		}
+	}
+}
+
+// rosterFrameLocked encodes a session's roster, moving to a new revision if
+// it changed, and reports whether it did. It returns nil once the session
+// has no connections. h.mu must be held.
+func (h *Hub) rosterFrameLocked(sessionID string, now time.Time) ([]byte, bool) {
+	if len(h.rooms[sessionID]) == 0 {
+		h.dropRosterLocked(sessionID)
+		return nil, false
+	}
+
+	entries := h.rosterLocked(sessionID, now)
+	participants, err := json.Marshal(entries)
+	if err != nil {
+		return nil, false
+	}
+	state, ok := h.rosters[sessionID]
+	if !ok {
+		state = &rosterState{}
+		h.rosters[sessionID] = state
+	}
+	changed := !bytes.Equal(participants, state.participants)
+	if changed {
+		// One counter across sessions keeps a session's revisions rising
+		// even after it empties and its state is dropped
+		h.rosterRevision++
+		state.revision = h.rosterRevision
+		state.participants = participants
+	}
+
+	if state.timer == nil {
+		state.timer = time.AfterFunc(RosterInterval, func() { h.sendRoster(sessionID, nil) })
+	} else {
+		state.timer.Reset(RosterInterval)
+	}
+
+	frame, err := wire.Encode(&wire.Roster{
+		SessionID:    sessionID,
+		Revision:     state.revision,
+		Participants: entries,
+	})
+	if err != nil {
+		return nil, false
+	}
+	return frame, changed
+}
+
+// rosterLocked lists a session's connected participants and ghosts by ID;
+// h.mu must be held
+func (h *Hub) rosterLocked(sessionID string, now time.Time) []wire.RosterEntry {
+	entries := make([]wire.RosterEntry, 0, len(h.rooms[sessionID]))
+	for participantID, client := range h.rooms[sessionID] {
+		entry := h.rosterEntryLocked(sessionID, participantID)
+		entry.Quality = client.quality()
+		entry.Dormant = now.Sub(client.lastActive()) >= dormantAfter
+		entries = append(entries, entry)
+	}
+	for participantID, p := range h.presence[sessionID] {
+		if p.departed {
+			entry := h.rosterEntryLocked(sessionID, participantID)
+			entry.Ghost = true
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ParticipantID < entries[j].ParticipantID })
+	return entries
+}
+
+// rosterEntryLocked fills in what a participant's entry shows whether or
+// not they're connected; h.mu must be held
+func (h *Hub) rosterEntryLocked(sessionID, participantID string) wire.RosterEntry {
+	entry := wire.RosterEntry{ParticipantID: participantID, Role: RosterEditor}
+	if h.roles != nil {
+		entry.Role = h.roles(sessionID, participantID)
+	}
+	if p, ok := h.presence[sessionID][participantID]; ok {
+		entry.Name, entry.Color = p.user()
+	}
+	return entry
+}
+
+// dropRosterLocked forgets a session's roster once it has no connections;
+// h.mu must be held
+func (h *Hub) dropRosterLocked(sessionID string) {
+	if state, ok := h.rosters[sessionID]; ok {
+		if state.timer != nil {
+			state.timer.Stop()
+		}
+		delete(h.rosters, sessionID)
+	}
+}
+
+// user returns the name and color a participant's Yjs clients publish in
+// their awareness "user" field, taking the lowest client ID that has one
+// so the answer is stable
+func (p *presence) user() (name, color string) {
+	ids := make([]uint64, 0, len(p.states))
+	for clientID := range p.states {
+		ids = append(ids, clientID)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for _, clientID := range ids {
+		var state struct {
+			User struct {
+				Name  string `json:"name"`
+				Color string `json:"color"`
+			} `json:"user"`
+		}
+		if json.Unmarshal(p.states[clientID].state, &state) == nil && state.User.Name != "" {
+			return state.User.Name, state.User.Color
+		}
+	}
+	return "", ""
+}
+
+// observeWrite folds a write's duration into the client's running average
+func (c *Client) observeWrite(took time.Duration, err error) {
+	c.writeFailed.Store(err != nil)
+	if err != nil {
+		return
+	}
+	avg := time.Duration(c.writeAvg.Load())
+	if avg == 0 {
+		avg = took
+	} else {
+		avg = (avg*7 + took) / 8
+	}
+	c.writeAvg.Store(int64(avg))
+}
+
+// quality buckets how quickly writes to the client go through
+func (c *Client) quality() string {
+	avg := time.Duration(c.writeAvg.Load())
+	switch {
+	case c.writeFailed.Load() || avg >= poorWrite:
+		return QualityPoor
+	case avg >= fairWrite:
+		return QualityFair
+	default:
+		return QualityGood
+	}
+}
+
+// lastActive is when the client last sent a frame, or connected
+func (c *Client) lastActive() time.Time {
+	return time.Unix(0, c.lastFrame.Load())
+}
+
+// ParticipantsChanged tells a session's roster clients that member joined,
+// left, or changed role, frameType (wire.TypeParticipantJoined,
+// wire.TypeParticipantLeft, or wire.TypeParticipantRole) saying which, and
+// who's in the session now. Unlike the roster, which
+// follows sync connections, this follows the session's participant list,
+// so it covers participants not connected yet. A nil hub does nothing.
+func (h *Hub) ParticipantsChanged(sessionID, frameType string, member Member, members []Member) {
+	if h == nil {
+		return
+	}
+	frame, err := wire.Encode(&wire.ParticipantChange{
+		Header:        wire.Header{Type: frameType},
+		SessionID:     sessionID,
+		ParticipantID: member.ID,
+		Name:          member.Name,
+		Color:         member.Color,
+		Role:          member.Role,
+		Participants:  memberIDs(members),
+		Members:       wireMembers(members),
+	})
+	if err != nil {
+		return
+	}
+
+	h.mu.RLock()
+	targets := h.targetsLocked(sessionID, nil)
+	h.mu.RUnlock()
+	for _, target := range targets {
+		if target.roster.Load() {
+			target.write(websocket.TextMessage, frame)
+		}
+	}
+}
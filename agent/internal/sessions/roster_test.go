@@ -0,0 +1,173 @@
+package sessions
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/zeropr/agent/internal/wire"
+)
+
+var rosterSync = []byte(`{"type":"rosterSync","v":1}`)
+
+// nextRoster returns the next roster frame on conn, failing if none
+// arrives within wait
+func nextRoster(t *testing.T, conn *websocket.Conn, wait time.Duration) wire.Roster {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(wait))
+	defer conn.SetReadDeadline(time.Time{})
+	for {
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("waiting for the roster: %v", err)
+		}
+		var roster wire.Roster
+		if messageType == websocket.TextMessage && json.Unmarshal(data, &roster) == nil && roster.Type == wire.TypeRoster {
+			return roster
+		}
+	}
+}
+
+// noRoster fails if a roster frame arrives on conn within wait
+func noRoster(t *testing.T, conn *websocket.Conn, wait time.Duration) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(wait))
+	defer conn.SetReadDeadline(time.Time{})
+	for {
+		messageType, data, err := conn.ReadMessage()
+		var timeout net.Error
+		if errors.As(err, &timeout) && timeout.Timeout() {
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if messageType == websocket.TextMessage && json.Valid(data) {
+			t.Fatalf("unexpected frame %s", data)
+		}
+	}
+}
+
+// rosterIDs lists the participants a roster shows connected
+func rosterIDs(roster wire.Roster) []string {
+	var ids []string
+	for _, entry := range roster.Participants {
+		if !entry.Ghost {
+			ids = append(ids, entry.ParticipantID)
+		}
+	}
+	return ids
+}
+
+func TestRosterFollowsMembership(t *testing.T) {
+	hub := NewHub(DuplicateReplace)
+	hub.SetRoles(func(_, participantID string) string {
+		switch participantID {
+		case "alice":
+			return RosterHost
+		case "carol":
+			return RosterViewer
+		}
+		return RosterEditor
+	})
+	url := serveHub(t, hub)
+	alice := dialHub(t, url, "alice")
+	waitParticipants(t, hub, 1)
+	alice.WriteMessage(websocket.TextMessage, rosterSync)
+	first := nextRoster(t, alice, 2*time.Second)
+	if first.SessionID != "s" || len(first.Participants) != 1 || first.Participants[0].Role != RosterHost || first.Participants[0].Quality != QualityGood {
+		t.Fatalf("first roster %+v", first)
+	}
+
+	// Each join and leave is a new revision
+	last := first.Revision
+	step := func(what string, want ...string) {
+		t.Helper()
+		roster := nextRoster(t, alice, 2*time.Second)
+		if roster.Revision <= last {
+			t.Errorf("after %s: revision %d, last was %d", what, roster.Revision, last)
+		}
+		if ids := rosterIDs(roster); len(ids) != len(want) || (len(want) > 0 && ids[len(ids)-1] != want[len(want)-1]) {
+			t.Errorf("after %s: roster shows %v, want %v", what, ids, want)
+		}
+		last = roster.Revision
+	}
+	bob := dialHub(t, url, "bob")
+	step("bob joined", "alice", "bob")
+	carol := dialHub(t, url, "carol")
+	step("carol joined", "alice", "bob", "carol")
+	bob.WriteMessage(websocket.BinaryMessage, bobsCursor)
+	nextAwareness(t, carol, 2*time.Second)
+	bob.Close()
+	roster := nextRoster(t, alice, 2*time.Second)
+	if roster.Revision <= last {
+		t.Errorf("after bob left: revision %d, last was %d", roster.Revision, last)
+	}
+	// Bob's cursor lingers, and so does he, as a ghost with his name
+	for _, entry := range roster.Participants {
+		switch entry.ParticipantID {
+		case "bob":
+			if !entry.Ghost || entry.Name != "Bob" || entry.Quality != "" {
+				t.Errorf("bob after leaving %+v", entry)
+			}
+		case "carol":
+			if entry.Role != RosterViewer || entry.Ghost {
+				t.Errorf("carol %+v", entry)
+			}
+		}
+	}
+
+	// Clients that never asked aren't sent rosters
+	noRoster(t, carol, 200*time.Millisecond)
+}
+
+func TestRosterResync(t *testing.T) {
+	hub := NewHub(DuplicateReplace)
+	url := serveHub(t, hub)
+	alice := dialHub(t, url, "alice")
+	bob := dialHub(t, url, "bob")
+	waitParticipants(t, hub, 2)
+	alice.WriteMessage(websocket.TextMessage, rosterSync)
+	bob.WriteMessage(websocket.TextMessage, rosterSync)
+	revision := nextRoster(t, alice, 2*time.Second).Revision
+	if got := nextRoster(t, bob, 2*time.Second).Revision; got != revision {
+		t.Fatalf("bob got revision %d, alice %d", got, revision)
+	}
+
+	// Asking again when nothing changed resends the same revision, to
+	// the one who asked only
+	alice.WriteMessage(websocket.TextMessage, rosterSync)
+	if got := nextRoster(t, alice, 2*time.Second); got.Revision != revision || len(got.Participants) != 2 {
+		t.Errorf("resent %+v, want revision %d again", got, revision)
+	}
+	noRoster(t, bob, 200*time.Millisecond)
+}
+
+func TestConnectionQuality(t *testing.T) {
+	tests := []struct {
+		writes []time.Duration
+		failed bool
+		want   string
+	}{
+		{[]time.Duration{time.Millisecond}, false, QualityGood},
+		{[]time.Duration{100 * time.Millisecond}, false, QualityFair},
+		{[]time.Duration{time.Second}, false, QualityPoor},
+		{[]time.Duration{time.Second, time.Millisecond}, false, QualityPoor}, // one fast write doesn't undo a slow one
+		{[]time.Duration{time.Millisecond}, true, QualityPoor},
+	}
+	for _, tt := range tests {
+		c := &Client{}
+		for _, took := range tt.writes {
+			c.observeWrite(took, nil)
+		}
+		if tt.failed {
+			c.observeWrite(0, errors.New("broken pipe"))
+		}
+		if got := c.quality(); got != tt.want {
+			t.Errorf("writes %v, failed %v: %s, want %s", tt.writes, tt.failed, got, tt.want)
+		}
+	}
+}
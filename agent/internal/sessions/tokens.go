@@ -0,0 +1,103 @@
+package sessions
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+
+	"github.com/zeropr/agent/internal/redact"
+)
+
+// newToken returns a random socket token
+func newToken() (redact.Secret, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return redact.Secret(hex.EncodeToString(buf)), nil
+}
+
+// ParticipantToken returns the token a session's participant opens its
+// sync and chat sockets with, minting it the first time. Each participant
+// has their own, and the sockets take the participant's identity and role
+// from it, so nobody can connect as someone else.
+func (m *Manager) ParticipantToken(sessionID, participantID string) (redact.Secret, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, ok := m.sessions[sessionID]
+	if !ok {
+		return "", ErrSessionNotFound
+	}
+	if !contains(session.Participants, participantID) {
+		return "", ErrNotParticipant
+	}
+	if token, ok := session.tokens[participantID]; ok {
+		return token, nil
+	}
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	if session.tokens == nil {
+		session.tokens = make(map[string]redact.Secret)
+	}
+	session.tokens[participantID] = token
+	session.revision++
+	return token, nil
+}
+
+// Identify returns the participant of a session whose token this is
+func (m *Manager) Identify(sessionID, token string) (Member, bool) {
+	if token == "" {
+		return Member{}, false
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	session, ok := m.sessions[sessionID]
+	if !ok {
+		return Member{}, false
+	}
+	// Every token is compared, so timing doesn't tell how far down the
+	// list a guess got
+	found := -1
+	for i, member := range session.Members {
+		if held, ok := session.tokens[member.ID]; ok && subtle.ConstantTimeCompare([]byte(token), []byte(held.Reveal())) == 1 {
+			found = i
+		}
+	}
+	if found < 0 {
+		return Member{}, false
+	}
+	return session.Members[found], true
+}
+
+// Recognizes reports whether a request naming participantID of a session
+// comes from them: token is the sync token they were issued, or agent is
+// the fingerprint of the agent that joined them. Either may be empty.
+func (m *Manager) Recognizes(sessionID, participantID, token, agent string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	session, ok := m.sessions[sessionID]
+	if !ok {
+		return false
+	}
+	if held, ok := session.tokens[participantID]; ok && token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(held.Reveal())) == 1 {
+		return true
+	}
+	for _, member := range session.Members {
+		if member.ID == participantID {
+			return agent != "" && member.Agent == agent
+		}
+	}
+	return false
+}
+
+// Redacted returns the session without its participants' tokens, for
+// keeping after it ended
+func (s Session) Redacted() Session {
+	s.tokens = nil
+	return s
+}
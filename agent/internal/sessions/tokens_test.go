@@ -0,0 +1,121 @@
+package sessions
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/zeropr/agent/internal/events"
+)
+
+func newTestManager(t *testing.T) *Manager {
+	t.Helper()
+	return NewManager(events.NewBus())
+}
+
+func TestParticipantTokens(t *testing.T) {
+	m := newTestManager(t)
+	if _, err := m.Create("s1", "test", "main.go", Member{ID: "alice"}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.AddParticipant("s1", Member{ID: "bob", Role: RosterViewer}); err != nil {
+		t.Fatal(err)
+	}
+
+	alice, err := m.ParticipantToken("s1", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := m.ParticipantToken("s1", "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alice == "" || bob == "" || alice == bob {
+		t.Fatalf("tokens %q and %q, want two different ones", alice, bob)
+	}
+	if again, _ := m.ParticipantToken("s1", "bob"); again != bob {
+		t.Error("a participant's token changed on asking again")
+	}
+
+	if member, ok := m.Identify("s1", bob.Reveal()); !ok || member.ID != "bob" || member.Role != RosterViewer {
+		t.Errorf("Identify(bob's token) = %+v, %v", member, ok)
+	}
+	for name, token := range map[string]string{"empty": "", "unknown": "0123", "other session": alice.Reveal()} {
+		sessionID := "s1"
+		if name == "other session" {
+			sessionID = "s2"
+		}
+		if member, ok := m.Identify(sessionID, token); ok {
+			t.Errorf("Identify(%s) = %+v", name, member)
+		}
+	}
+
+	if _, err := m.ParticipantToken("s1", "carol"); !errors.Is(err, ErrNotParticipant) {
+		t.Errorf("ParticipantToken(non-member) = %v, want ErrNotParticipant", err)
+	}
+	if _, err := m.ParticipantToken("s2", "alice"); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("ParticipantToken(unknown session) = %v, want ErrSessionNotFound", err)
+	}
+
+	// Leaving takes the token with them, and joining again gets a new one
+	m.RemoveParticipant("s1", "bob")
+	if _, ok := m.Identify("s1", bob.Reveal()); ok {
+		t.Error("a participant who left is still identified by their token")
+	}
+	m.AddParticipant("s1", Member{ID: "bob"})
+	if rejoined, _ := m.ParticipantToken("s1", "bob"); rejoined == bob {
+		t.Error("rejoining handed back the token from before leaving")
+	}
+}
+
+func TestRecognizes(t *testing.T) {
+	m := newTestManager(t)
+	m.Create("s1", "test", "main.go", Member{ID: "alice"}, 0)
+	m.AddParticipant("s1", Member{ID: "bob", Agent: "fp-guest"})
+	alice, _ := m.ParticipantToken("s1", "alice")
+	bob, _ := m.ParticipantToken("s1", "bob")
+
+	for _, tc := range []struct {
+		name, participant, token, agent string
+		want                            bool
+	}{
+		{"alice's token", "alice", alice.Reveal(), "", true},
+		{"bob's agent", "bob", "", "fp-guest", true},
+		{"nothing", "alice", "", "", false},
+		{"bob's token for alice", "alice", bob.Reveal(), "", false},
+		{"bob's agent for alice", "alice", "", "fp-guest", false},
+		{"another agent for bob", "bob", "", "fp-other", false},
+		{"an unknown token", "bob", "0123", "", false},
+		{"someone not in it", "carol", "", "fp-guest", false},
+	} {
+		if got := m.Recognizes("s1", tc.participant, tc.token, tc.agent); got != tc.want {
+			t.Errorf("%s: Recognizes = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+	if m.Recognizes("s2", "alice", alice.Reveal(), "") {
+		t.Error("a token recognized in another session")
+	}
+}
+
+func TestTokensSurviveSnapshots(t *testing.T) {
+	m := newTestManager(t)
+	session, _ := m.Create("s1", "test", "main.go", Member{ID: "alice"}, 0)
+	token, _ := m.ParticipantToken("s1", "alice")
+
+	data, err := EncodeSnapshot(session.snapshot(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, _, err := DecodeSnapshot(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.tokens["alice"] != token {
+		t.Errorf("restored token %q, want %q", restored.tokens["alice"], token)
+	}
+
+	redacted, _ := EncodeSnapshot(session.snapshot().Redacted(), nil)
+	restored, _, _ = DecodeSnapshot(redacted)
+	if len(restored.tokens) != 0 {
+		t.Errorf("a redacted session kept tokens %v", restored.tokens)
+	}
+}
@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const boltFile = "zeropr.db"
+
+// boltStore keeps each collection as a bucket in one bbolt database. Every
+// write is its own transaction and reads run in read-only transactions,
+// which see a consistent snapshot.
+type boltStore struct {
+	db *bolt.DB
+}
+
+func openBolt(stateDir string) (*boltStore, error) {
+	path := filepath.Join(stateDir, boltFile)
+	// The database is locked while open; fail rather than wait on another agent
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	return &boltStore{db: db}, nil
+}
+
+func (s *boltStore) Backend() string {
+	return BackendBolt
+}
+
+func (s *boltStore) Collection(name string) (Collection, error) {
+	if err := checkCollection(name); err != nil {
+		return nil, err
+	}
+	return &boltCollection{db: s.db, bucket: []byte(name)}, nil
+}
+
+func (s *boltStore) Collections() ([]string, error) {
+	var names []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			if b.Stats().KeyN > 0 {
+				names = append(names, string(name))
+			}
+			return nil
+		})
+	})
+	sort.Strings(names)
+	return names, err
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+type boltCollection struct {
+	db     *bolt.DB
+	bucket []byte
+}
+
+func (c *boltCollection) Get(key string) ([]byte, error) {
+	var value []byte
+	err := c.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(c.bucket)
+		if b == nil {
+			return ErrNotFound
+		}
+		v := b.Get([]byte(key))
+		if v == nil {
+			return ErrNotFound
+		}
+		// Values are only valid inside the transaction
+		value = append([]byte(nil), v...)
+		return nil
+	})
+	return value, err
+}
+
+func (c *boltCollection) Put(key string, value []byte) error {
+	value, err := compactValue(key, value)
+	if err != nil {
+		return err
+	}
+	return c.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(c.bucket)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), value)
+	})
+}
+
+func (c *boltCollection) Delete(key string) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(c.bucket)
+		if b == nil {
+			return nil
+		}
+		return b.Delete([]byte(key))
+	})
+}
+
+func (c *boltCollection) List() (map[string][]byte, error) {
+	values := make(map[string][]byte)
+	err := c.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(c.bucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			values[string(k)] = append([]byte(nil), v...)
+			return nil
+		})
+	})
+	return values, err
+}
@@ -0,0 +1,191 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const filesDir = "store"
+
+// filesStore keeps each collection as a JSON object in <dir>/<name>.json,
+// held in memory and rewritten whole on every write
+type filesStore struct {
+	dir         string
+	collections map[string]*fileCollection
+	mu          sync.Mutex
+}
+
+func openFiles(stateDir string) (*filesStore, error) {
+	dir := filepath.Join(stateDir, filesDir)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+	return &filesStore{dir: dir, collections: make(map[string]*fileCollection)}, nil
+}
+
+func (s *filesStore) Backend() string {
+	return BackendFiles
+}
+
+func (s *filesStore) Collection(name string) (Collection, error) {
+	if err := checkCollection(name); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if c, ok := s.collections[name]; ok {
+		return c, nil
+	}
+
+	c := &fileCollection{
+		path:   filepath.Join(s.dir, name+".json"),
+		values: make(map[string]json.RawMessage),
+	}
+	data, err := os.ReadFile(c.path)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &c.values); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", c.path, err)
+		}
+		// The file is indented for people; hand values back as they were put
+		for key, value := range c.values {
+			if c.values[key], err = compactValue(key, value); err != nil {
+				return nil, err
+			}
+		}
+	case !os.IsNotExist(err):
+		return nil, fmt.Errorf("failed to read %s: %w", c.path, err)
+	}
+	s.collections[name] = c
+	return c, nil
+}
+
+func (s *filesStore) Collections() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".json")
+		if ok && !entry.IsDir() && checkCollection(name) == nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *filesStore) Close() error {
+	return nil
+}
+
+type fileCollection struct {
+	path   string
+	values map[string]json.RawMessage
+	mu     sync.RWMutex
+}
+
+func (c *fileCollection) Get(key string) ([]byte, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	value, ok := c.values[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return append([]byte(nil), value...), nil
+}
+
+func (c *fileCollection) Put(key string, value []byte) error {
+	value, err := compactValue(key, value)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	previous, existed := c.values[key]
+	c.values[key] = value
+	if err := c.saveLocked(); err != nil {
+		if existed {
+			c.values[key] = previous
+		} else {
+			delete(c.values, key)
+		}
+		return err
+	}
+	return nil
+}
+
+func (c *fileCollection) Delete(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	previous, ok := c.values[key]
+	if !ok {
+		return nil
+	}
+	delete(c.values, key)
+	if err := c.saveLocked(); err != nil {
+		c.values[key] = previous
+		return err
+	}
+	return nil
+}
+
+func (c *fileCollection) List() (map[string][]byte, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	values := make(map[string][]byte, len(c.values))
+	for key, value := range c.values {
+		values[key] = append([]byte(nil), value...)
+	}
+	return values, nil
+}
+
+// saveLocked replaces the file in one rename, synced before and after so a
+// crash leaves either the old file or the new one; c.mu must be held
+func (c *fileCollection) saveLocked() error {
+	data, err := json.MarshalIndent(c.values, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := c.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write %s: %w", c.path, err)
+	}
+	if err := os.Rename(tmp, c.path); err != nil {
+		return err
+	}
+
+	// Persist the rename itself
+	if dir, err := os.Open(filepath.Dir(c.path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+// Package storage keeps the agent's keyed state (trust entries, tokens,
+// peer aliases, policies) behind one interface with two backends: JSON
+// files in the state directory, the default, and an embedded bbolt
+// database for large teams that don't want every file re-parsed on start.
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+)
+
+// Backends
+const (
+	BackendFiles = "files" // one JSON file per collection under <state-dir>/store
+	BackendBolt  = "bolt"  // a single bbolt database, <state-dir>/zeropr.db
+)
+
+// Backends lists every backend Open accepts
+var Backends = []string{BackendFiles, BackendBolt}
+
+// ErrNotFound is returned by Get for a key that isn't stored
+var ErrNotFound = errors.New("key not found")
+
+var validCollection = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// Collection is a keyed set of JSON documents.
+//
+// Every backend guarantees the same crash consistency:
+//   - Put and Delete are atomic per key. After a crash a key holds either
+//     its previous value or the new one, never a mix, and a call that
+//     returned nil survives the crash.
+//   - Writes to different keys are independent: a crash between two Puts
+//     may keep the first without the second.
+//   - List reads a snapshot. It sees each write entirely or not at all,
+//     even while other goroutines are writing.
+//
+// Collections are safe for concurrent use.
+type Collection interface {
+	// Get returns the value stored under key, or ErrNotFound
+	Get(key string) ([]byte, error)
+	// Put stores value, which must be valid JSON, under key. Values are
+	// stored compacted.
+	Put(key string, value []byte) error
+	// Delete removes key; removing a missing key is not an error
+	Delete(key string) error
+	// List returns a snapshot of every key and value
+	List() (map[string][]byte, error)
+}
+
+// Store is a set of named collections
+type Store interface {
+	// Backend names the implementation, BackendFiles or BackendBolt
+	Backend() string
+	// Collection opens a collection, creating it on first write. Names are
+	// lowercase letters, digits, '-' and '_'.
+	Collection(name string) (Collection, error)
+	// Collections lists the collections that hold data
+	Collections() ([]string, error)
+	// Close releases the store; collections must not be used afterwards
+	Close() error
+}
+
+// Open opens the backend's store in stateDir
+func Open(backend, stateDir string) (Store, error) {
+	if err := os.MkdirAll(stateDir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create state dir: %w", err)
+	}
+	switch backend {
+	case BackendFiles, "":
+		return openFiles(stateDir)
+	case BackendBolt:
+		return openBolt(stateDir)
+	}
+	return nil, fmt.Errorf("unknown storage backend %q (want files or bolt)", backend)
+}
+
+func checkCollection(name string) error {
+	if !validCollection.MatchString(name) {
+		return fmt.Errorf("invalid collection name %q", name)
+	}
+	return nil
+}
+
+// compactValue checks a value being stored and compacts it, so every
+// backend hands back the same bytes
+func compactValue(key string, value []byte) ([]byte, error) {
+	if key == "" {
+		return nil, errors.New("empty key")
+	}
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, value); err != nil {
+		return nil, fmt.Errorf("value for %q is not valid JSON", key)
+	}
+	return buf.Bytes(), nil
+}
+
+// Migrate copies every collection in from into to, overwriting keys both
+// hold, and returns how many keys each collection had. Running it again
+// after an interruption finishes the copy.
+func Migrate(from, to Store) (map[string]int, error) {
+	names, err := from.Collections()
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int, len(names))
+	for _, name := range names {
+		src, err := from.Collection(name)
+		if err != nil {
+			return counts, err
+		}
+		dst, err := to.Collection(name)
+		if err != nil {
+			return counts, err
+		}
+		values, err := src.List()
+		if err != nil {
+			return counts, fmt.Errorf("failed to read %s: %w", name, err)
+		}
+		for key, value := range values {
+			if err := dst.Put(key, value); err != nil {
+				return counts, fmt.Errorf("failed to write %s/%s: %w", name, key, err)
+			}
+		}
+		counts[name] = len(values)
+	}
+	return counts, nil
+}
+
+// ImportFile moves a state file written before the storage layer into c.
+// split turns the file's contents into keyed values; they are all written
+// before the file is renamed to <path>.imported, so an interrupted import
+// is redone on the next start. A missing file is not an error.
+func ImportFile(c Collection, path string, split func([]byte) (map[string][]byte, error)) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	values, err := split(data)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	for key, value := range values {
+		if err := c.Put(key, value); err != nil {
+			return err
+		}
+	}
+	return os.Rename(path, path+".imported")
+}
+
+// SplitArray splits a JSON array of objects, keying each by the string
+// field keyField
+func SplitArray(keyField string) func([]byte) (map[string][]byte, error) {
+	return func(data []byte) (map[string][]byte, error) {
+		var list []json.RawMessage
+		if err := json.Unmarshal(data, &list); err != nil {
+			return nil, err
+		}
+
+		values := make(map[string][]byte, len(list))
+		for _, raw := range list {
+			var fields map[string]json.RawMessage
+			if err := json.Unmarshal(raw, &fields); err != nil {
+				return nil, err
+			}
+			var key string
+			if err := json.Unmarshal(fields[keyField], &key); err != nil || key == "" {
+				return nil, fmt.Errorf("entry without a %q", keyField)
+			}
+			values[key] = raw
+		}
+		return values, nil
+	}
+}
+
+// Whole keeps an entire file as one value under key
+func Whole(key string) func([]byte) (map[string][]byte, error) {
+	return func(data []byte) (map[string][]byte, error) {
+		if !json.Valid(data) {
+			return nil, errors.New("not valid JSON")
+		}
+		return map[string][]byte{key: data}, nil
+	}
+}
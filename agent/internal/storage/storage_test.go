@@ -0,0 +1,230 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// forEachBackend runs the test against a fresh store of every backend,
+// handing it a function that reopens the store in the same directory
+func forEachBackend(t *testing.T, test func(t *testing.T, open func() Store)) {
+	for _, backend := range Backends {
+		t.Run(backend, func(t *testing.T) {
+			dir := t.TempDir()
+			var current Store
+			open := func() Store {
+				t.Helper()
+				if current != nil {
+					current.Close()
+				}
+				s, err := Open(backend, dir)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if s.Backend() != backend {
+					t.Fatalf("opened %s, want %s", s.Backend(), backend)
+				}
+				current = s
+				return s
+			}
+			t.Cleanup(func() { current.Close() })
+			test(t, open)
+		})
+	}
+}
+
+func collection(t *testing.T, s Store, name string) Collection {
+	t.Helper()
+	c, err := s.Collection(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestCollection(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, open func() Store) {
+		c := collection(t, open(), "trust")
+		if _, err := c.Get("alice"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Get of a missing key: %v", err)
+		}
+		if err := c.Put("alice", []byte(`{ "name": "alice",  "trusted": true }`)); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Put("bob", []byte(`{"name":"bob"}`)); err != nil {
+			t.Fatal(err)
+		}
+		if value, err := c.Get("alice"); err != nil || string(value) != `{"name":"alice","trusted":true}` {
+			t.Errorf("Get = %s, %v; want the value compacted", value, err)
+		}
+		if err := c.Put("carol", []byte(`{not json`)); err == nil {
+			t.Error("stored a value that isn't JSON")
+		}
+		if err := c.Put("", []byte(`{}`)); err == nil {
+			t.Error("stored a value under an empty key")
+		}
+		if err := c.Delete("bob"); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Delete("nobody"); err != nil {
+			t.Errorf("deleting a missing key: %v", err)
+		}
+
+		// What was written survives a reopen
+		s := open()
+		values, err := collection(t, s, "trust").List()
+		want := map[string][]byte{"alice": []byte(`{"name":"alice","trusted":true}`)}
+		if err != nil || !reflect.DeepEqual(values, want) {
+			t.Errorf("after reopening: %s, %v", values, err)
+		}
+		if names, err := s.Collections(); err != nil || !reflect.DeepEqual(names, []string{"trust"}) {
+			t.Errorf("collections %v, %v", names, err)
+		}
+		for _, name := range []string{"", "Trust", "../escape", "-x"} {
+			if _, err := s.Collection(name); err == nil {
+				t.Errorf("opened a collection named %q", name)
+			}
+		}
+	})
+}
+
+func TestCollectionValuesAreCopies(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, open func() Store) {
+		c := collection(t, open(), "tokens")
+		c.Put("t", []byte(`"abc"`))
+		value, _ := c.Get("t")
+		value[1] = 'X'
+		list, _ := c.List()
+		list["t"][1] = 'X'
+		if again, _ := c.Get("t"); string(again) != `"abc"` {
+			t.Errorf("changing a returned value changed the store: %s", again)
+		}
+	})
+}
+
+func TestListDuringWrites(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, open func() Store) {
+		c := collection(t, open(), "aliases")
+
+		// Each key's value always names its key and carries a full payload;
+		// a List overlapping the writes must never see half of one
+		var wg sync.WaitGroup
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < 25; i++ {
+					key := fmt.Sprintf("k%d", w)
+					value, _ := json.Marshal(map[string]any{"key": key, "round": i, "pad": string(make([]byte, 512))})
+					if err := c.Put(key, value); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}(w)
+		}
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		for {
+			values, err := c.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for key, value := range values {
+				var v struct{ Key string }
+				if err := json.Unmarshal(value, &v); err != nil || v.Key != key {
+					t.Fatalf("List saw %s = %.40s, %v", key, value, err)
+				}
+			}
+			select {
+			case <-done:
+				if values, _ := c.List(); len(values) != 4 {
+					t.Errorf("%d keys after the writes, want 4", len(values))
+				}
+				return
+			default:
+			}
+		}
+	})
+}
+
+func TestMigrate(t *testing.T) {
+	from, err := Open(BackendFiles, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer from.Close()
+	to, err := Open(BackendBolt, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer to.Close()
+
+	collection(t, from, "trust").Put("alice", []byte(`{"name":"alice"}`))
+	collection(t, from, "trust").Put("bob", []byte(`{"name":"bob"}`))
+	collection(t, from, "aliases").Put("p1", []byte(`"Al"`))
+	collection(t, to, "trust").Put("alice", []byte(`{"name":"stale"}`))
+
+	// Running it twice, as after an interruption, copies the same
+	for i := 0; i < 2; i++ {
+		counts, err := Migrate(from, to)
+		if err != nil || !reflect.DeepEqual(counts, map[string]int{"trust": 2, "aliases": 1}) {
+			t.Fatalf("migrated %v, %v", counts, err)
+		}
+	}
+	if value, _ := collection(t, to, "trust").Get("alice"); string(value) != `{"name":"alice"}` {
+		t.Errorf("alice in the new store is %s", value)
+	}
+	if value, _ := collection(t, to, "aliases").Get("p1"); string(value) != `"Al"` {
+		t.Errorf("p1's alias in the new store is %s", value)
+	}
+}
+
+func TestImportFile(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, open func() Store) {
+		s := open()
+		dir := t.TempDir()
+		path := filepath.Join(dir, "trust.json")
+		os.WriteFile(path, []byte(`[{"fingerprint":"fp-a","name":"alice"},{"fingerprint":"fp-b","name":"bob"}]`), 0o600)
+
+		c := collection(t, s, "trust")
+		if err := ImportFile(c, path, SplitArray("fingerprint")); err != nil {
+			t.Fatal(err)
+		}
+		if values, _ := c.List(); len(values) != 2 || string(values["fp-b"]) != `{"fingerprint":"fp-b","name":"bob"}` {
+			t.Errorf("imported %s", values)
+		}
+		if _, err := os.Stat(path + ".imported"); err != nil {
+			t.Errorf("the imported file wasn't set aside: %v", err)
+		}
+		// Once imported, or never written, there's nothing to do
+		if err := ImportFile(c, path, SplitArray("fingerprint")); err != nil {
+			t.Error(err)
+		}
+
+		policy := filepath.Join(dir, "retention.json")
+		os.WriteFile(policy, []byte(`{"chat":{"keepDays":7}}`), 0o600)
+		if err := ImportFile(collection(t, s, "retention"), policy, Whole("policy")); err != nil {
+			t.Fatal(err)
+		}
+
+		// A file that doesn't parse is left where it is, to be looked at
+		broken := filepath.Join(dir, "tokens.json")
+		os.WriteFile(broken, []byte(`[{"name":"no id"}]`), 0o600)
+		if err := ImportFile(collection(t, s, "tokens"), broken, SplitArray("id")); err == nil {
+			t.Error("imported entries without a key")
+		}
+		if _, err := os.Stat(broken); err != nil {
+			t.Errorf("the file that failed to import was moved: %v", err)
+		}
+	})
+}
@@ -0,0 +1,119 @@
+// Package version reports which build of the agent is running. Release
+// builds stamp it through the linker:
+//
+//	go build -ldflags "-X github.com/zeropr/agent/internal/version.Version=0.2.0 \
+//	  -X github.com/zeropr/agent/internal/version.Commit=$(git rev-parse --short HEAD) \
+//	  -X github.com/zeropr/agent/internal/version.Date=$(date -u +%Y-%m-%dT%H:%M:%SZ)" ./cmd/agent
+//
+// Without them, the commit and date come from the VCS stamp Go embeds when
+// building inside a checkout, or read "unknown".
+package version
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// Set with -ldflags -X; see the package comment
+var (
+	Version = "0.1.0"
+	Commit  = ""
+	Date    = ""
+)
+
+// MinCompatible is the oldest agent version this one works with. Peers
+// older than it are flagged incompatible.
+const MinCompatible = "0.1.0"
+
+const unknown = "unknown"
+
+func init() {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return
+	}
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			if Commit == "" && len(setting.Value) >= 12 {
+				Commit = setting.Value[:12]
+			}
+		case "vcs.time":
+			if Date == "" {
+				Date = setting.Value
+			}
+		}
+	}
+}
+
+// Info is the build metadata /api/status reports
+type Info struct {
+	Version       string `json:"version"`
+	Commit        string `json:"commit"`
+	BuildDate     string `json:"buildDate"`
+	GoVersion     string `json:"goVersion"`
+	MinCompatible string `json:"minCompatible"`
+}
+
+// Get returns this build's metadata
+func Get() Info {
+	return Info{
+		Version:       Version,
+		Commit:        orUnknown(Commit),
+		BuildDate:     orUnknown(Date),
+		GoVersion:     runtime.Version(),
+		MinCompatible: MinCompatible,
+	}
+}
+
+// String renders the metadata for --version
+func (i Info) String() string {
+	return fmt.Sprintf("zeropr-agent %s (commit %s, built %s, %s)", i.Version, i.Commit, i.BuildDate, i.GoVersion)
+}
+
+// Compare orders two dotted versions such as "0.1.0" and "0.10", returning
+// -1, 0, or 1. Missing parts count as zero and a pre-release or build
+// suffix is ignored; a part that isn't a number sorts as zero.
+func Compare(a, b string) int {
+	as, bs := parts(a), parts(b)
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x = as[i]
+		}
+		if i < len(bs) {
+			y = bs[i]
+		}
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+	}
+	return 0
+}
+
+// parts splits a version into its numeric parts
+func parts(v string) []int {
+	v = strings.TrimPrefix(v, "v")
+	if i := strings.IndexAny(v, "-+"); i >= 0 {
+		v = v[:i]
+	}
+	fields := strings.Split(v, ".")
+	nums := make([]int, len(fields))
+	for i, field := range fields {
+		nums[i], _ = strconv.Atoi(field)
+	}
+	return nums
+}
+
+func orUnknown(s string) string {
+	if s == "" {
+		return unknown
+	}
+	return s
+}
@@ -0,0 +1,69 @@
+package wire
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Dispatcher routes the text frames clients send on one kind of socket by
+// the registry: a frame whose type has a handler goes to it, a Relay frame
+// is relayed, and anything else is refused. Frames of types this agent
+// doesn't know, including text that isn't a frame at all, are relayed or
+// refused as the dispatcher's unknown policy says, so newer clients can
+// talk to each other through an older agent where that's safe.
+type Dispatcher[C any] struct {
+	handlers map[string]func(C, Frame) error
+	unknown  Class
+	untyped  string
+	relay    func(C, []byte)
+}
+
+// NewDispatcher creates a dispatcher handling unknown frames as unknown
+// says; relay passes a frame on from a client, and may be nil when
+// nothing is relayed
+func NewDispatcher[C any](unknown Class, relay func(C, []byte)) *Dispatcher[C] {
+	return &Dispatcher[C]{
+		handlers: make(map[string]func(C, Frame) error),
+		unknown:  unknown,
+		relay:    relay,
+	}
+}
+
+// Handle sets the handler of a frame type; the type must be registered
+// and sent by clients
+func (d *Dispatcher[C]) Handle(frameType string, handler func(C, Frame) error) {
+	spec, ok := registry[frameType]
+	if !ok || spec.Direction == FromAgent {
+		panic("wire: no client frame type " + frameType)
+	}
+	d.handlers[frameType] = handler
+}
+
+// Untyped sets the type of frames clients send without one
+func (d *Dispatcher[C]) Untyped(frameType string) {
+	d.untyped = frameType
+}
+
+// Dispatch routes one text frame from a client
+func (d *Dispatcher[C]) Dispatch(from C, data []byte) error {
+	frame, spec, err := Decode(data, d.untyped)
+	switch {
+	case errors.Is(err, ErrNotFrame), errors.Is(err, ErrUnknownType):
+		return d.pass(d.unknown, from, data, err)
+	case err != nil:
+		return err
+	}
+	if handler, ok := d.handlers[spec.Type]; ok {
+		return handler(from, frame)
+	}
+	return d.pass(spec.Class, from, data, fmt.Errorf("%w: %s", ErrNotAccepted, spec.Type))
+}
+
+// pass relays a frame when class says to, and otherwise returns refused
+func (d *Dispatcher[C]) pass(class Class, from C, data []byte, refused error) error {
+	if class != Relay || d.relay == nil {
+		return refused
+	}
+	d.relay(from, data)
+	return nil
+}
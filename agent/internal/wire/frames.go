@@ -0,0 +1,117 @@
+package wire
+
+import (
+	"errors"
+	"time"
+)
+
+// Frame types
+const (
+	TypeRoster            = "roster"
+	TypeRosterSync        = "rosterSync" // a client asking for the roster again
+	TypeParticipantJoined = "participant_joined"
+	TypeParticipantLeft   = "participant_left"
+	TypeParticipantRole   = "participant_role" // the initiator made someone an editor or a viewer
+	TypeChat              = "chat"
+	TypeChatRejected      = "chatRejected" // sent back to the author only
+)
+
+func init() {
+	register(Spec{Type: TypeRoster, Version: 1, Direction: FromAgent, Class: Consume, new: func() Frame { return new(Roster) }})
+	register(Spec{Type: TypeRosterSync, Version: 1, Direction: FromClient, Class: Consume, new: func() Frame { return new(RosterSync) }})
+	register(Spec{Type: TypeParticipantJoined, Version: 1, Direction: FromAgent, Class: Consume, new: func() Frame { return new(ParticipantChange) }})
+	register(Spec{Type: TypeParticipantLeft, Version: 1, Direction: FromAgent, Class: Consume, new: func() Frame { return new(ParticipantChange) }})
+	register(Spec{Type: TypeParticipantRole, Version: 1, Direction: FromAgent, Class: Consume, new: func() Frame { return new(ParticipantChange) }})
+	register(Spec{Type: TypeChat, Version: 1, Direction: Both, Class: Consume, new: func() Frame { return new(ChatMessage) }})
+	register(Spec{Type: TypeChatRejected, Version: 1, Direction: FromAgent, Class: Consume, new: func() Frame { return new(ChatRejected) }})
+}
+
+// RosterEntry is one participant as the roster shows them
+type RosterEntry struct {
+	ParticipantID string `json:"participantId"`
+	Name          string `json:"name,omitempty"`  // from the participant's awareness "user"
+	Color         string `json:"color,omitempty"` // likewise
+	Role          string `json:"role"`
+	Quality       string `json:"quality,omitempty"` // absent for ghosts
+	Dormant       bool   `json:"dormant,omitempty"` // connected but silent for a while
+	Ghost         bool   `json:"ghost,omitempty"`   // left, with their cursor still shown
+}
+
+// Roster tells a session's clients who's in it. Revision grows whenever
+// the participants change.
+type Roster struct {
+	Header
+	SessionID    string        `json:"sessionId"`
+	Revision     uint64        `json:"revision"`
+	Participants []RosterEntry `json:"participants"`
+}
+
+func (f *Roster) validate() error {
+	if f.SessionID == "" || f.Participants == nil {
+		return errors.New("sessionId and participants are required")
+	}
+	return nil
+}
+
+// RosterSync asks for the roster, and for roster frames from then on
+type RosterSync struct {
+	Header
+}
+
+// Member is a session participant with how editors show them
+type Member struct {
+	ParticipantID string `json:"participantId"`
+	Name          string `json:"name,omitempty"`
+	Color         string `json:"color"`
+	Role          string `json:"role"` // editor or viewer
+}
+
+// ParticipantChange tells a session's clients that someone joined or left
+// it through the API or had their role changed, with everyone now in the
+// session
+type ParticipantChange struct {
+	Header
+	SessionID     string   `json:"sessionId"`
+	ParticipantID string   `json:"participantId"`
+	Name          string   `json:"name,omitempty"`  // the participant's display name
+	Color         string   `json:"color,omitempty"` // their cursor color, #rrggbb
+	Role          string   `json:"role,omitempty"`  // editor or viewer
+	Participants  []string `json:"participants"`
+	Members       []Member `json:"members,omitempty"` // Participants with how they're shown, in the same order
+}
+
+func (f *ParticipantChange) validate() error {
+	if f.SessionID == "" || f.ParticipantID == "" || f.Participants == nil {
+		return errors.New("sessionId, participantId, and participants are required")
+	}
+	return nil
+}
+
+// ChatMessage is one chat message. Clients send the text alone; the agent
+// stamps the author and time before relaying it.
+type ChatMessage struct {
+	Header
+	Author    string    `json:"author"`
+	Text      string    `json:"text"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+func (f *ChatMessage) validate() error {
+	if f.Author == "" || f.Text == "" || f.Timestamp.IsZero() {
+		return errors.New("author, text, and timestamp are required")
+	}
+	return nil
+}
+
+// ChatRejected tells an author why their message wasn't relayed
+type ChatRejected struct {
+	Header
+	Reason string `json:"reason"` // empty, too_long, or invalid
+}
+
+func (f *ChatRejected) validate() error {
+	if f.Reason == "" {
+		return errors.New("reason is required")
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+// Package wire defines the control frames the agent and editors exchange
+// as JSON text frames on session sockets, next to the binary Yjs traffic.
+// Every frame is a flat JSON object with a "type" and a "v", the version
+// of that type's payload, and one registry says which types exist:
+//
+//   - Frames are strict on send: Encode refuses a type that isn't
+//     registered, a struct that isn't the type's, and missing fields the
+//     type requires, and stamps the current version.
+//   - Frames are lenient on receive: fields this agent doesn't know come
+//     from newer clients and are ignored, and a frame without "v" predates
+//     it and reads as version 1. Receivers check what they need.
+//   - A new field is optional, with a default an older frame decodes to;
+//     a field is never removed or retyped. Bump a type's version when its
+//     defaults depend on it.
+//
+// What a hub does with a frame a client sends depends on the type's Class,
+// and for types it doesn't know, on the Dispatcher's policy.
+// shared/src/frames.ts is generated from the registry by cmd/wiregen.
+package wire
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// Legacy is the version of frames sent before frames carried one
+const Legacy = 1
+
+// Class says what a hub does with a frame of a type when a client sends it
+type Class string
+
+const (
+	// Relay frames are passed on untouched to the session's other clients
+	Relay Class = "relay"
+	// Consume frames are handled by the hub and go no further
+	Consume Class = "consume"
+)
+
+// Direction says who sends a frame type
+type Direction string
+
+const (
+	FromClient Direction = "client" // editors send it to the agent
+	FromAgent  Direction = "agent"  // the agent sends it to editors
+	Both       Direction = "both"
+)
+
+var (
+	// ErrNotFrame is returned for a text frame that isn't a JSON object
+	ErrNotFrame = errors.New("not a JSON control frame")
+	// ErrUnknownType is returned for a frame whose type isn't registered,
+	// or that has none
+	ErrUnknownType = errors.New("unknown frame type")
+	// ErrNotAccepted is returned for a frame of a known type that the
+	// receiving socket doesn't take from clients
+	ErrNotAccepted = errors.New("frame not accepted from clients")
+)
+
+// Header is embedded in every frame
+type Header struct {
+	Type    string `json:"type"`
+	Version int    `json:"v,omitempty"` // absent from frames that predate it
+}
+
+func (h *Header) header() *Header { return h }
+
+// defaults and validate are overridden by the frames that need them
+func (h *Header) defaults(from int) {}
+func (h *Header) validate() error   { return nil }
+
+// Frame is a control frame. Only this package defines them, so each one
+// has its defaults and checks next to its fields.
+type Frame interface {
+	header() *Header
+
+	// defaults fills in what senders of version from, or of this version
+	// that predate a field, leave out
+	defaults(from int)
+
+	// validate checks the fields Encode won't send without
+	validate() error
+}
+
+// Spec describes one registered frame type
+type Spec struct {
+	Type      string    `json:"type"`
+	Version   int       `json:"version"`
+	Direction Direction `json:"direction"`
+	Class     Class     `json:"class"`
+	Payload   string    `json:"payload"` // the Go struct it decodes to
+
+	new func() Frame
+}
+
+var (
+	registry = make(map[string]Spec)
+	byStruct = make(map[reflect.Type][]string) // frame struct -> the types using it
+)
+
+// register adds a frame type; frames.go registers them all at startup
+func register(spec Spec) {
+	if _, dup := registry[spec.Type]; dup {
+		panic("wire: frame type registered twice: " + spec.Type)
+	}
+	t := reflect.TypeOf(spec.new()).Elem()
+	spec.Payload = t.Name()
+	registry[spec.Type] = spec
+	byStruct[t] = append(byStruct[t], spec.Type)
+}
+
+// Lookup returns the spec of a frame type
+func Lookup(frameType string) (Spec, bool) {
+	spec, ok := registry[frameType]
+	return spec, ok
+}
+
+// Specs lists every registered frame type, by type
+func Specs() []Spec {
+	specs := make([]Spec, 0, len(registry))
+	for _, spec := range registry {
+		specs = append(specs, spec)
+	}
+	sort.Slice(specs, func(i, j int) bool { return specs[i].Type < specs[j].Type })
+	return specs
+}
+
+// Encode checks a frame and marshals it with its type's current version.
+// A frame whose struct serves a single type may leave Type empty.
+func Encode(frame Frame) ([]byte, error) {
+	h := frame.header()
+	t := reflect.TypeOf(frame).Elem()
+	if h.Type == "" {
+		if types := byStruct[t]; len(types) == 1 {
+			h.Type = types[0]
+		}
+	}
+	spec, ok := registry[h.Type]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownType, h.Type)
+	}
+	if reflect.TypeOf(spec.new()).Elem() != t {
+		return nil, fmt.Errorf("wire: %s frame sent as %s, want %s", h.Type, t.Name(), spec.Payload)
+	}
+	if err := frame.validate(); err != nil {
+		return nil, fmt.Errorf("wire: %s frame: %w", h.Type, err)
+	}
+	h.Version = spec.Version
+	return json.Marshal(frame)
+}
+
+// Decode reads a frame leniently: unknown fields are ignored, and a frame
+// without a version is read as Legacy. A frame without a type is read as
+// untyped when that's set, for clients that predate types.
+func Decode(data []byte, untyped string) (Frame, Spec, error) {
+	var h Header
+	if err := json.Unmarshal(data, &h); err != nil {
+		return nil, Spec{}, ErrNotFrame
+	}
+	frameType := h.Type
+	if frameType == "" {
+		frameType = untyped
+	}
+	spec, ok := registry[frameType]
+	if !ok {
+		return nil, Spec{}, fmt.Errorf("%w %q", ErrUnknownType, h.Type)
+	}
+
+	frame := spec.new()
+	if err := json.Unmarshal(data, frame); err != nil {
+		return nil, spec, fmt.Errorf("%s frame: %w", spec.Type, err)
+	}
+	fh := frame.header()
+	fh.Type = spec.Type
+	if fh.Version == 0 {
+		fh.Version = Legacy
+	}
+	frame.defaults(fh.Version)
+	return frame, spec, nil
+}
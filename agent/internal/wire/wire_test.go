@@ -0,0 +1,150 @@
+package wire
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// samples holds a valid frame of every registered type
+var samples = map[string]Frame{
+	TypeRoster: &Roster{SessionID: "s", Revision: 3, Participants: []RosterEntry{
+		{ParticipantID: "alice", Name: "Alice", Color: "#ff0000", Role: "host", Quality: "good"},
+		{ParticipantID: "bob", Role: "editor", Ghost: true},
+	}},
+	TypeRosterSync: &RosterSync{},
+	TypeParticipantJoined: &ParticipantChange{Header: Header{Type: TypeParticipantJoined}, SessionID: "s", ParticipantID: "bob",
+		Color: "#00ff00", Role: "editor", Participants: []string{"alice", "bob"},
+		Members: []Member{{ParticipantID: "alice", Color: "#ff0000", Role: "editor"}, {ParticipantID: "bob", Color: "#00ff00", Role: "editor"}}},
+	TypeParticipantLeft: &ParticipantChange{Header: Header{Type: TypeParticipantLeft}, SessionID: "s", ParticipantID: "bob", Participants: []string{"alice"}},
+	TypeParticipantRole: &ParticipantChange{Header: Header{Type: TypeParticipantRole}, SessionID: "s", ParticipantID: "bob", Role: "viewer", Participants: []string{"alice", "bob"}},
+	TypeChat:            &ChatMessage{Author: "alice", Text: "hi", Timestamp: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)},
+	TypeChatRejected:    &ChatRejected{Reason: "too_long"},
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, spec := range Specs() {
+		sample, ok := samples[spec.Type]
+		if !ok {
+			t.Errorf("no sample %s frame; add one", spec.Type)
+			continue
+		}
+		data, err := Encode(sample)
+		if err != nil {
+			t.Errorf("Encode %s: %v", spec.Type, err)
+			continue
+		}
+		frame, decoded, err := Decode(data, "")
+		if err != nil || decoded.Type != spec.Type {
+			t.Errorf("Decode %s: %v, %v", data, decoded.Type, err)
+			continue
+		}
+		if h := sample.header(); h.Type != spec.Type || h.Version != spec.Version {
+			t.Errorf("Encode stamped %+v, want %s v%d", *h, spec.Type, spec.Version)
+		}
+		if !reflect.DeepEqual(frame, sample) {
+			t.Errorf("%s round trip:\n got %+v\nwant %+v", spec.Type, frame, sample)
+		}
+	}
+}
+
+func TestEncodeIsStrict(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame Frame
+	}{
+		{"unregistered type", &ChatRejected{Header: Header{Type: "follow"}, Reason: "x"}},
+		{"another type's struct", &ChatRejected{Header: Header{Type: TypeChat}, Reason: "x"}},
+		{"missing required fields", &ChatMessage{Author: "alice"}},
+		{"struct shared by several types, no type", &ParticipantChange{SessionID: "s", ParticipantID: "bob", Participants: []string{}}},
+		{"roster without participants", &Roster{SessionID: "s"}},
+	}
+	for _, tt := range tests {
+		if data, err := Encode(tt.frame); err == nil {
+			t.Errorf("%s: encoded %s", tt.name, data)
+		}
+	}
+}
+
+// TestNewerFramesDecode feeds frames as a newer client or agent would send
+// them, and as clients did before frames were versioned
+func TestNewerFramesDecode(t *testing.T) {
+	frame, spec, err := Decode([]byte(`{"type":"chat","v":3,"author":"alice","text":"hi","timestamp":"2026-01-02T03:04:05Z","replyTo":"m1","reactions":{"+1":2}}`), "")
+	if err != nil || spec.Type != TypeChat {
+		t.Fatalf("decoding a newer chat frame: %v", err)
+	}
+	if chat := frame.(*ChatMessage); chat.Text != "hi" || chat.Version != 3 {
+		t.Errorf("decoded %+v", chat)
+	}
+
+	frame, _, err = Decode([]byte(`{"type":"rosterSync"}`), "")
+	if err != nil || frame.header().Version != Legacy {
+		t.Errorf("a frame without a version decoded as %+v, %v", frame, err)
+	}
+	// Clients that predate types send chat as the text alone
+	frame, spec, err = Decode([]byte(`{"text":"hello"}`), TypeChat)
+	if err != nil || spec.Type != TypeChat || frame.(*ChatMessage).Text != "hello" {
+		t.Errorf("untyped chat decoded as %+v, %v", frame, err)
+	}
+
+	if _, _, err := Decode([]byte(`{"type":"follow","target":"bob"}`), ""); !errors.Is(err, ErrUnknownType) {
+		t.Errorf("a frame type from the future: %v", err)
+	}
+	for _, data := range []string{`hello`, `[1,2]`, `"chat"`} {
+		if _, _, err := Decode([]byte(data), ""); !errors.Is(err, ErrNotFrame) {
+			t.Errorf("Decode(%s): %v", data, err)
+		}
+	}
+	if _, _, err := Decode([]byte(`{"type":"chat","text":7}`), ""); err == nil || errors.Is(err, ErrNotFrame) {
+		t.Errorf("a chat frame with a mistyped field: %v", err)
+	}
+}
+
+func TestDispatcher(t *testing.T) {
+	type call struct {
+		from    string
+		handled string
+		relayed string
+	}
+	for _, unknown := range []Class{Relay, Consume} {
+		var calls []call
+		d := NewDispatcher(unknown, func(from string, data []byte) { calls = append(calls, call{from: from, relayed: string(data)}) })
+		d.Handle(TypeRosterSync, func(from string, frame Frame) error {
+			calls = append(calls, call{from: from, handled: frame.header().Type})
+			return nil
+		})
+
+		if err := d.Dispatch("alice", []byte(`{"type":"rosterSync","v":1}`)); err != nil || len(calls) != 1 || calls[0].handled != TypeRosterSync {
+			t.Errorf("%s: a handled frame: %v, %+v", unknown, err, calls)
+		}
+		// A frame clients don't send, and one no handler takes, stop here
+		for _, data := range []string{`{"type":"roster","sessionId":"s","participants":[]}`, `{"type":"chat","text":"hi"}`} {
+			if err := d.Dispatch("alice", []byte(data)); !errors.Is(err, ErrNotAccepted) {
+				t.Errorf("%s: Dispatch(%s): %v", unknown, data, err)
+			}
+		}
+
+		// What this agent doesn't know follows the unknown policy
+		calls = nil
+		future := `{"type":"follow","v":2,"target":"bob"}`
+		err := d.Dispatch("bob", []byte(future))
+		switch unknown {
+		case Relay:
+			if err != nil || len(calls) != 1 || calls[0].relayed != future || calls[0].from != "bob" {
+				t.Errorf("relay: an unknown frame: %v, %+v", err, calls)
+			}
+		case Consume:
+			if !errors.Is(err, ErrUnknownType) || len(calls) != 0 {
+				t.Errorf("consume: an unknown frame: %v, %+v", err, calls)
+			}
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("a handler was set for a frame type only the agent sends")
+		}
+	}()
+	NewDispatcher[string](Consume, nil).Handle(TypeRoster, func(string, Frame) error { return nil })
+}
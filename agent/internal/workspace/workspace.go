@@ -0,0 +1,185 @@
+package workspace
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/zeropr/agent/internal/gitinfo"
+	"github.com/zeropr/agent/internal/redact"
+)
+
+// DefaultRootName is used when the agent is started without any -root flags
+const DefaultRootName = "default"
+
+var (
+	// ErrUnknownRoot is returned when a request names a root that isn't registered
+	ErrUnknownRoot = errors.New("unknown repo")
+	// ErrOutsideRoot is returned when a path escapes its root's sandbox
+	ErrOutsideRoot = errors.New("path outside repository root")
+	// ErrNoRoots is returned by a workspace with nothing to serve
+	ErrNoRoots = errors.New("no share root configured")
+)
+
+// Root is a named directory the agent serves files from
+type Root struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+
+	git *gitinfo.Repo
+}
+
+// Info describes a root for status responses. Its path shows redacted
+// unless revealed, since the status reaches other agents too.
+type Info struct {
+	Name   string               `json:"name"`
+	Path   redact.SensitivePath `json:"path"`
+	Hash   string               `json:"hash"`
+	Branch string               `json:"branch,omitempty"`
+}
+
+// Workspace is the set of roots registered with the agent
+type Workspace struct {
+	roots map[string]*Root
+	order []string
+}
+
+// ParseRoot parses a -root flag value of the form name=path. A bare path is
+// named after its final element.
+func ParseRoot(value string) (Root, error) {
+	name, path, ok := strings.Cut(value, "=")
+	if !ok {
+		path = value
+		name = filepath.Base(filepath.Clean(value))
+	}
+
+	name = strings.TrimSpace(name)
+	path = strings.TrimSpace(path)
+	if name == "" || path == "" {
+		return Root{}, fmt.Errorf("invalid root %q: expected name=path", value)
+	}
+	return Root{Name: name, Path: path}, nil
+}
+
+// New validates the roots and builds a workspace. The first root is the
+// default for requests that don't name one. Without roots the workspace
+// serves nothing, and every lookup fails with ErrNoRoots.
+func New(roots []Root) (*Workspace, error) {
+	w := &Workspace{roots: make(map[string]*Root, len(roots))}
+	for _, root := range roots {
+		if _, dup := w.roots[root.Name]; dup {
+			return nil, fmt.Errorf("duplicate root name %q", root.Name)
+		}
+
+		abs, err := filepath.Abs(root.Path)
+		if err != nil {
+			return nil, fmt.Errorf("root %q: %w", root.Name, err)
+		}
+		// Sandbox checks compare against the real path, so resolve symlinks once here
+		if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+			abs = resolved
+		}
+
+		info, err := os.Stat(abs)
+		if err != nil {
+			return nil, fmt.Errorf("root %q: %w", root.Name, err)
+		}
+		if !info.IsDir() {
+			return nil, fmt.Errorf("root %q: %s is not a directory", root.Name, abs)
+		}
+
+		w.roots[root.Name] = &Root{Name: root.Name, Path: abs, git: gitinfo.NewRepo(abs)}
+		w.order = append(w.order, root.Name)
+	}
+	return w, nil
+}
+
+// Root returns the named root, or the default root when name is empty
+func (w *Workspace) Root(name string) (*Root, error) {
+	if len(w.order) == 0 {
+		return nil, ErrNoRoots
+	}
+	if name == "" {
+		name = w.order[0]
+	}
+	root, ok := w.roots[name]
+	if !ok {
+		return nil, ErrUnknownRoot
+	}
+	return root, nil
+}
+
+// Roots returns all roots in registration order
+func (w *Workspace) Roots() []Root {
+	roots := make([]Root, 0, len(w.order))
+	for _, name := range w.order {
+		roots = append(roots, *w.roots[name])
+	}
+	return roots
+}
+
+// Info returns name, path, and repo hash for every root in registration order
+func (w *Workspace) Info() []Info {
+	infos := make([]Info, 0, len(w.order))
+	for _, name := range w.order {
+		root := w.roots[name]
+		infos = append(infos, Info{Name: root.Name, Path: redact.SensitivePath(root.Path), Hash: root.RepoHash(), Branch: root.Branch()})
+	}
+	return infos
+}
+
+// Hashes returns every root's repo hash in registration order
+func (w *Workspace) Hashes() []string {
+	hashes := make([]string, 0, len(w.order))
+	for _, name := range w.order {
+		hashes = append(hashes, w.roots[name].RepoHash())
+	}
+	return hashes
+}
+
+// RepoHash returns the cached repository identity advertised to peers
+func (r *Root) RepoHash() string {
+	return r.git.Hash()
+}
+
+// Branch returns the root's checked-out branch, or the short commit when detached
+func (r *Root) Branch() string {
+	return r.git.Branch()
+}
+
+// WatchBranch calls onChange whenever the root's branch changes, polling
+// every interval until ctx is cancelled
+func (r *Root) WatchBranch(ctx context.Context, interval time.Duration, onChange func(branch string)) {
+	r.git.Watch(ctx, interval, onChange)
+}
+
+// Resolve maps a root-relative path to an absolute path, refusing anything
+// that escapes the root either lexically or through a symlink.
+func (r *Root) Resolve(rel string) (string, error) {
+	full := filepath.Join(r.Path, filepath.FromSlash(rel))
+	if !r.contains(full) {
+		return "", ErrOutsideRoot
+	}
+
+	// Follow symlinks for paths that exist; missing files are left for the caller to report
+	if resolved, err := filepath.EvalSymlinks(full); err == nil {
+		if !r.contains(resolved) {
+			return "", ErrOutsideRoot
+		}
+		full = resolved
+	}
+	return full, nil
+}
+
+// contains reports whether path is the root itself or lies beneath it
+func (r *Root) contains(path string) bool {
+	rel, err := filepath.Rel(r.Path, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
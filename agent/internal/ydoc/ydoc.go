@@ -0,0 +1,591 @@
+// Package ydoc reads what a Yjs document holds out of the binary updates
+// its editors exchange (the v1 encoding y-websocket sends), without merging
+// their content: which of each Yjs client's operations it has, and which
+// it has deleted. Two replicas holding the same operations and deletions
+// show the same document, so that is enough to tell whether they diverged
+// and where.
+package ydoc
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"unicode/utf8"
+)
+
+// y-websocket message types
+const (
+	messageSync = 0
+	syncStep1   = 0 // a state vector, asking for what it lacks
+	syncStep2   = 1 // the updates a state vector lacked
+	syncUpdate  = 2
+)
+
+// ErrMalformed is returned for an update or message that doesn't decode
+var ErrMalformed = errors.New("malformed Yjs update")
+
+// span is a run of one client's clocks, [clock, clock+length)
+type span struct {
+	clock, length uint64
+}
+
+func (s span) end() uint64 { return s.clock + s.length }
+
+// Doc is the operations and deletions a set of updates adds up to
+type Doc struct {
+	structs map[uint64][]span // client -> clocks of the operations held
+	deletes map[uint64][]span // client -> clocks deleted
+}
+
+// New returns an empty document
+func New() *Doc {
+	return &Doc{structs: make(map[uint64][]span), deletes: make(map[uint64][]span)}
+}
+
+// State is what a document holds, in a form two replicas can be compared in
+type State struct {
+	// Vector is, per Yjs client ID, how many of its operations the
+	// document has integrated: those counted from clock 0 without a gap
+	Vector map[uint64]uint64 `json:"stateVector"`
+	// Pending is, per client, how many operations are held past a gap,
+	// waiting for ones the document never received
+	Pending map[uint64]uint64 `json:"pending,omitempty"`
+	// Deleted is how many operations the document has seen deleted
+	Deleted uint64 `json:"deleted"`
+	// Hash identifies the integrated operations and the deletions; equal
+	// hashes mean the same document
+	Hash string `json:"hash"`
+}
+
+// Apply adds a v1-encoded update to the document
+func (d *Doc) Apply(update []byte) error {
+	r := &reader{data: update}
+	structs, err := readStructs(r)
+	if err != nil {
+		return err
+	}
+	deletes, err := readDeleteSet(r)
+	if err != nil {
+		return err
+	}
+	for client, spans := range structs {
+		d.structs[client] = append(d.structs[client], spans...)
+	}
+	for client, spans := range deletes {
+		d.deletes[client] = append(d.deletes[client], spans...)
+	}
+	return nil
+}
+
+// ApplyMessage adds the update a y-websocket sync message carries, and
+// reports whether it carried one. Other messages, such as awareness or a
+// sync step 1, are left alone.
+func (d *Doc) ApplyMessage(message []byte) (bool, error) {
+	update, ok, err := UpdateOf(message)
+	if !ok || err != nil {
+		return false, err
+	}
+	return true, d.Apply(update)
+}
+
+// FromMessages returns the state of a document built from y-websocket
+// sync messages, and how many carried an update that didn't decode.
+// Messages carrying no update are passed over.
+func FromMessages(messages [][]byte) (State, int) {
+	d := New()
+	malformed := 0
+	for _, message := range messages {
+		if _, err := d.ApplyMessage(message); err != nil {
+			malformed++
+		}
+	}
+	return d.State(), malformed
+}
+
+// UpdateOf returns the update a y-websocket sync step 2 or update message
+// carries, reporting false for any other message
+func UpdateOf(message []byte) ([]byte, bool, error) {
+	r := &reader{data: message}
+	kind, sync, ok := syncKind(r)
+	if !ok || (sync != syncStep2 && sync != syncUpdate) || kind != messageSync {
+		return nil, false, nil
+	}
+	update, err := r.bytes()
+	if err != nil {
+		return nil, false, err
+	}
+	return update, true, nil
+}
+
+// StateVectorOf returns the state vector a y-websocket sync step 1
+// message announces: what the editor sending it holds. It reports false
+// for any other message.
+func StateVectorOf(message []byte) (map[uint64]uint64, bool, error) {
+	r := &reader{data: message}
+	kind, sync, ok := syncKind(r)
+	if !ok || kind != messageSync || sync != syncStep1 {
+		return nil, false, nil
+	}
+	encoded, err := r.bytes()
+	if err != nil {
+		return nil, false, err
+	}
+	r = &reader{data: encoded}
+	n, err := r.uint()
+	if err != nil {
+		return nil, false, err
+	}
+	vector := make(map[uint64]uint64, min(n, 1024))
+	for i := uint64(0); i < n; i++ {
+		client, err := r.uint()
+		if err != nil {
+			return nil, false, err
+		}
+		clock, err := r.uint()
+		if err != nil {
+			return nil, false, err
+		}
+		vector[client] = clock
+	}
+	return vector, true, nil
+}
+
+// syncKind reads a message's y-websocket type and, for a sync message,
+// its sync type
+func syncKind(r *reader) (kind, sync uint64, ok bool) {
+	kind, err := r.uint()
+	if err != nil || kind != messageSync {
+		return kind, 0, false
+	}
+	sync, err = r.uint()
+	return kind, sync, err == nil
+}
+
+// State returns what the document holds
+func (d *Doc) State() State {
+	state := State{Vector: make(map[uint64]uint64), Pending: make(map[uint64]uint64)}
+	for client, spans := range d.structs {
+		merged := merge(spans)
+		if merged[0].clock == 0 {
+			state.Vector[client] = merged[0].end()
+			merged = merged[1:]
+		}
+		for _, s := range merged {
+			state.Pending[client] += s.length
+		}
+	}
+	if len(state.Pending) == 0 {
+		state.Pending = nil
+	}
+
+	h := sha256.New()
+	for _, client := range sortedClients(state.Vector) {
+		fmt.Fprintf(h, "s %d %d\n", client, state.Vector[client])
+	}
+	deleted := make(map[uint64][]span, len(d.deletes))
+	for client, spans := range d.deletes {
+		deleted[client] = merge(spans)
+	}
+	for _, client := range sortedClients(deleted) {
+		for _, s := range deleted[client] {
+			state.Deleted += s.length
+			fmt.Fprintf(h, "d %d %d %d\n", client, s.clock, s.length)
+		}
+	}
+	state.Hash = "sha256:" + hex.EncodeToString(h.Sum(nil))
+	return state
+}
+
+// Missing returns, per client, how many of the operations in have a
+// replica at vector lacks
+func Missing(have, vector map[uint64]uint64) map[uint64]uint64 {
+	missing := make(map[uint64]uint64)
+	for client, clock := range have {
+		if clock > vector[client] {
+			missing[client] = clock - vector[client]
+		}
+	}
+	return missing
+}
+
+// merge sorts spans and joins those that overlap or touch
+func merge(spans []span) []span {
+	sorted := append([]span(nil), spans...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].clock < sorted[j].clock })
+	merged := sorted[:1]
+	for _, s := range sorted[1:] {
+		last := &merged[len(merged)-1]
+		if s.clock <= last.end() {
+			if s.end() > last.end() {
+				last.length = s.end() - last.clock
+			}
+			continue
+		}
+		merged = append(merged, s)
+	}
+	return merged
+}
+
+func sortedClients[V any](m map[uint64]V) []uint64 {
+	clients := make([]uint64, 0, len(m))
+	for client := range m {
+		clients = append(clients, client)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i] < clients[j] })
+	return clients
+}
+
+// Struct kinds, the low five bits of a struct's info byte
+const (
+	kindGC      = 0
+	kindDeleted = 1
+	kindJSON    = 2
+	kindBinary  = 3
+	kindString  = 4
+	kindEmbed   = 5
+	kindFormat  = 6
+	kindType    = 7
+	kindAny     = 8
+	kindDoc     = 9
+	kindSkip    = 10
+)
+
+// Info byte flags of an item
+const (
+	hasOrigin      = 0x80
+	hasRightOrigin = 0x40
+	hasParentSub   = 0x20
+	kindBits       = 0x1f
+)
+
+// Type references whose content carries a name
+const (
+	typeXMLElement = 3
+	typeXMLHook    = 5
+)
+
+// readStructs reads an update's structs section: per client, the clocks
+// of the operations it carries. Skips are gaps, not operations.
+func readStructs(r *reader) (map[uint64][]span, error) {
+	groups, err := r.uint()
+	if err != nil {
+		return nil, err
+	}
+	structs := make(map[uint64][]span)
+	for g := uint64(0); g < groups; g++ {
+		count, err := r.uint()
+		if err != nil {
+			return nil, err
+		}
+		client, err := r.uint()
+		if err != nil {
+			return nil, err
+		}
+		clock, err := r.uint()
+		if err != nil {
+			return nil, err
+		}
+		for i := uint64(0); i < count; i++ {
+			info, err := r.byte()
+			if err != nil {
+				return nil, err
+			}
+			length, err := readStruct(r, info)
+			if err != nil {
+				return nil, err
+			}
+			if info&kindBits != kindSkip && length > 0 {
+				structs[client] = append(structs[client], span{clock, length})
+			}
+			clock += length
+		}
+	}
+	return structs, nil
+}
+
+// readStruct reads one struct after its info byte and returns how many
+// clocks it takes
+func readStruct(r *reader, info byte) (uint64, error) {
+	switch info & kindBits {
+	case kindGC, kindSkip:
+		return r.uint()
+	}
+	if info&hasOrigin != 0 {
+		if err := r.skipID(); err != nil {
+			return 0, err
+		}
+	}
+	if info&hasRightOrigin != 0 {
+		if err := r.skipID(); err != nil {
+			return 0, err
+		}
+	}
+	// Without either origin the item names its parent
+	if info&(hasOrigin|hasRightOrigin) == 0 {
+		named, err := r.uint()
+		if err != nil {
+			return 0, err
+		}
+		if named == 1 {
+			_, err = r.string()
+		} else {
+			err = r.skipID()
+		}
+		if err != nil {
+			return 0, err
+		}
+		if info&hasParentSub != 0 {
+			if _, err := r.string(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return readContent(r, info&kindBits)
+}
+
+// readContent reads an item's content and returns its length in clocks
+func readContent(r *reader, kind byte) (uint64, error) {
+	switch kind {
+	case kindDeleted:
+		return r.uint()
+	case kindJSON:
+		n, err := r.uint()
+		if err != nil {
+			return 0, err
+		}
+		for i := uint64(0); i < n; i++ {
+			if _, err := r.string(); err != nil {
+				return 0, err
+			}
+		}
+		return n, nil
+	case kindBinary:
+		_, err := r.bytes()
+		return 1, err
+	case kindString:
+		s, err := r.string()
+		return utf16Length(s), err
+	case kindEmbed:
+		_, err := r.string()
+		return 1, err
+	case kindFormat:
+		if _, err := r.string(); err != nil {
+			return 0, err
+		}
+		_, err := r.string()
+		return 1, err
+	case kindType:
+		ref, err := r.uint()
+		if err != nil {
+			return 0, err
+		}
+		if ref == typeXMLElement || ref == typeXMLHook {
+			_, err = r.string()
+		}
+		return 1, err
+	case kindAny:
+		n, err := r.uint()
+		if err != nil {
+			return 0, err
+		}
+		for i := uint64(0); i < n; i++ {
+			if err := r.skipAny(0); err != nil {
+				return 0, err
+			}
+		}
+		return n, nil
+	case kindDoc:
+		if _, err := r.string(); err != nil {
+			return 0, err
+		}
+		return 1, r.skipAny(0)
+	}
+	return 0, fmt.Errorf("%w: unknown content kind %d", ErrMalformed, kind)
+}
+
+// readDeleteSet reads an update's delete set
+func readDeleteSet(r *reader) (map[uint64][]span, error) {
+	clients, err := r.uint()
+	if err != nil {
+		return nil, err
+	}
+	deletes := make(map[uint64][]span)
+	for c := uint64(0); c < clients; c++ {
+		client, err := r.uint()
+		if err != nil {
+			return nil, err
+		}
+		n, err := r.uint()
+		if err != nil {
+			return nil, err
+		}
+		for i := uint64(0); i < n; i++ {
+			clock, err := r.uint()
+			if err != nil {
+				return nil, err
+			}
+			length, err := r.uint()
+			if err != nil {
+				return nil, err
+			}
+			if length > 0 {
+				deletes[client] = append(deletes[client], span{clock, length})
+			}
+		}
+	}
+	return deletes, nil
+}
+
+// utf16Length is how many UTF-16 code units s takes, which is how Yjs
+// counts a string's clocks
+func utf16Length(s string) uint64 {
+	var n uint64
+	for _, c := range s {
+		if c > 0xffff {
+			n += 2
+		} else {
+			n++
+		}
+	}
+	return n
+}
+
+// reader decodes lib0's encoding
+type reader struct {
+	data []byte
+	pos  int
+}
+
+func (r *reader) byte() (byte, error) {
+	if r.pos >= len(r.data) {
+		return 0, fmt.Errorf("%w: unexpected end", ErrMalformed)
+	}
+	b := r.data[r.pos]
+	r.pos++
+	return b, nil
+}
+
+// uint reads a variable-length unsigned integer
+func (r *reader) uint() (uint64, error) {
+	var n uint64
+	for shift := 0; shift < 64; shift += 7 {
+		b, err := r.byte()
+		if err != nil {
+			return 0, err
+		}
+		n |= uint64(b&0x7f) << shift
+		if b < 0x80 {
+			return n, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: integer overflows", ErrMalformed)
+}
+
+// bytes reads a length-prefixed byte array
+func (r *reader) bytes() ([]byte, error) {
+	n, err := r.uint()
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(len(r.data)-r.pos) {
+		return nil, fmt.Errorf("%w: %d bytes past the end", ErrMalformed, n)
+	}
+	b := r.data[r.pos : r.pos+int(n)]
+	r.pos += int(n)
+	return b, nil
+}
+
+// string reads a length-prefixed UTF-8 string
+func (r *reader) string() (string, error) {
+	b, err := r.bytes()
+	if err != nil {
+		return "", err
+	}
+	if !utf8.Valid(b) {
+		return "", fmt.Errorf("%w: invalid UTF-8", ErrMalformed)
+	}
+	return string(b), nil
+}
+
+func (r *reader) skip(n int) error {
+	if n > len(r.data)-r.pos {
+		return fmt.Errorf("%w: unexpected end", ErrMalformed)
+	}
+	r.pos += n
+	return nil
+}
+
+// skipID skips a struct ID: a client and a clock
+func (r *reader) skipID() error {
+	if _, err := r.uint(); err != nil {
+		return err
+	}
+	_, err := r.uint()
+	return err
+}
+
+// maxAnyDepth bounds how deeply nested a value may be
+const maxAnyDepth = 64
+
+// skipAny skips a value in lib0's self-describing encoding
+func (r *reader) skipAny(depth int) error {
+	if depth > maxAnyDepth {
+		return fmt.Errorf("%w: value nested too deeply", ErrMalformed)
+	}
+	tag, err := r.byte()
+	if err != nil {
+		return err
+	}
+	switch tag {
+	case 127, 126, 121, 120: // undefined, null, false, true
+		return nil
+	case 125: // signed variable-length integer
+		for {
+			b, err := r.byte()
+			if err != nil {
+				return err
+			}
+			if b < 0x80 {
+				return nil
+			}
+		}
+	case 124: // float32
+		return r.skip(4)
+	case 123, 122: // float64, bigint
+		return r.skip(8)
+	case 119: // string
+		_, err := r.string()
+		return err
+	case 118: // object
+		n, err := r.uint()
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < n; i++ {
+			if _, err := r.string(); err != nil {
+				return err
+			}
+			if err := r.skipAny(depth + 1); err != nil {
+				return err
+			}
+		}
+		return nil
+	case 117: // array
+		n, err := r.uint()
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < n; i++ {
+			if err := r.skipAny(depth + 1); err != nil {
+				return err
+			}
+		}
+		return nil
+	case 116: // bytes
+		_, err := r.bytes()
+		return err
+	}
+	return fmt.Errorf("%w: unknown value tag %d", ErrMalformed, tag)
+}
@@ -0,0 +1,262 @@
+package ydoc
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// encoder writes lib0's encoding, as Yjs does
+type encoder []byte
+
+func (e *encoder) uint(n uint64) *encoder {
+	for n >= 0x80 {
+		*e = append(*e, byte(n)|0x80)
+		n >>= 7
+	}
+	*e = append(*e, byte(n))
+	return e
+}
+
+func (e *encoder) string(s string) *encoder {
+	e.uint(uint64(len(s)))
+	*e = append(*e, s...)
+	return e
+}
+
+func (e *encoder) raw(b ...byte) *encoder {
+	*e = append(*e, b...)
+	return e
+}
+
+// item is one struct of an update: an info byte and what follows it
+type item struct {
+	info byte
+	body []byte
+}
+
+// text is a string inserted at the root type "text"
+func text(s string) item {
+	var e encoder
+	e.uint(1).string("text").string(s)
+	return item{kindString, e}
+}
+
+// after is a string inserted after an existing operation
+func after(client, clock uint64, s string) item {
+	var e encoder
+	e.uint(client).uint(clock).string(s)
+	return item{kindString | hasOrigin, e}
+}
+
+// group is one client's run of structs starting at clock
+type group struct {
+	client, clock uint64
+	items         []item
+}
+
+// deletion is a run of a client's clocks deleted
+type deletion struct {
+	client, clock, length uint64
+}
+
+func encodeUpdate(groups []group, deletes ...deletion) []byte {
+	var e encoder
+	e.uint(uint64(len(groups)))
+	for _, g := range groups {
+		e.uint(uint64(len(g.items))).uint(g.client).uint(g.clock)
+		for _, it := range g.items {
+			e.raw(it.info).raw(it.body...)
+		}
+	}
+	byClient := map[uint64][]deletion{}
+	var order []uint64
+	for _, d := range deletes {
+		if _, ok := byClient[d.client]; !ok {
+			order = append(order, d.client)
+		}
+		byClient[d.client] = append(byClient[d.client], d)
+	}
+	e.uint(uint64(len(order)))
+	for _, client := range order {
+		e.uint(client).uint(uint64(len(byClient[client])))
+		for _, d := range byClient[client] {
+			e.uint(d.clock).uint(d.length)
+		}
+	}
+	return e
+}
+
+// message wraps an update as a y-websocket sync message
+func message(sync byte, update []byte) []byte {
+	var e encoder
+	e.uint(messageSync).uint(uint64(sync)).uint(uint64(len(update))).raw(update...)
+	return e
+}
+
+func stateOf(t *testing.T, updates ...[]byte) State {
+	t.Helper()
+	d := New()
+	for _, update := range updates {
+		if err := d.Apply(update); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return d.State()
+}
+
+func TestStateVector(t *testing.T) {
+	hello := encodeUpdate([]group{{client: 7, items: []item{text("hello")}}})
+	world := encodeUpdate([]group{{client: 7, clock: 5, items: []item{after(7, 4, " world")}}})
+	other := encodeUpdate([]group{{client: 300, items: []item{after(7, 10, "!")}}})
+
+	state := stateOf(t, hello, world, other)
+	if want := map[uint64]uint64{7: 11, 300: 1}; !reflect.DeepEqual(state.Vector, want) {
+		t.Errorf("vector %v, want %v", state.Vector, want)
+	}
+	if state.Pending != nil {
+		t.Errorf("pending %v", state.Pending)
+	}
+
+	// Updates integrate in any order
+	if reordered := stateOf(t, other, world, hello); reordered.Hash != state.Hash {
+		t.Error("the same updates in another order hash differently")
+	}
+	// and the same operations split differently are the same document
+	whole := encodeUpdate([]group{
+		{client: 7, items: []item{text("hello"), after(7, 4, " world")}},
+		{client: 300, items: []item{after(7, 10, "!")}},
+	})
+	if merged := stateOf(t, whole); merged.Hash != state.Hash {
+		t.Error("one update carrying the same operations hashes differently")
+	}
+
+	// Missing the middle update leaves the later one pending
+	gap := stateOf(t, hello, other)
+	if gap.Vector[7] != 5 || gap.Hash == state.Hash {
+		t.Errorf("without the middle update: %+v", gap)
+	}
+	withoutHello := stateOf(t, world)
+	if _, ok := withoutHello.Vector[7]; ok || withoutHello.Pending[7] != 6 {
+		t.Errorf("an update after a gap: %+v", withoutHello)
+	}
+	if missing := Missing(state.Vector, gap.Vector); !reflect.DeepEqual(missing, map[uint64]uint64{7: 6}) {
+		t.Errorf("missing %v", missing)
+	}
+}
+
+func TestDeletesChangeTheHash(t *testing.T) {
+	hello := encodeUpdate([]group{{client: 7, items: []item{text("hello")}}})
+	deleted := encodeUpdate(nil, deletion{7, 1, 2}, deletion{7, 3, 1})
+	before := stateOf(t, hello)
+	after := stateOf(t, hello, deleted)
+	if after.Hash == before.Hash || after.Deleted != 3 || !reflect.DeepEqual(after.Vector, before.Vector) {
+		t.Errorf("before %+v, after %+v", before, after)
+	}
+	// Deleting the same run in one go is the same document
+	if once := stateOf(t, hello, encodeUpdate(nil, deletion{7, 1, 3})); once.Hash != after.Hash {
+		t.Error("one deletion of the same run hashes differently")
+	}
+}
+
+// atRoot is the parent info of an item in the root type name
+func atRoot(name string) *encoder {
+	var e encoder
+	return e.uint(1).string(name)
+}
+
+// origin is the left origin of an item inserted after client's clock
+func origin(client, clock uint64) *encoder {
+	var e encoder
+	return e.uint(client).uint(clock)
+}
+
+func TestLengthsOfContent(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		info   byte
+		body   *encoder
+		length uint64
+	}{
+		{"string counted in UTF-16", kindString, atRoot("text").string("é😀"), 3},
+		{"deleted", kindDeleted | hasOrigin, origin(1, 0).uint(4), 4},
+		{"JSON", kindJSON | hasOrigin, origin(1, 0).uint(2).string(`{"a":1}`).string("undefined"), 2},
+		{"binary", kindBinary, atRoot("blobs").uint(3).raw(1, 2, 3), 1},
+		{"embed", kindEmbed | hasRightOrigin, origin(1, 0).string(`{"image":"x.png"}`), 1},
+		{"format", kindFormat | hasRightOrigin, origin(1, 0).string("bold").string("true"), 1},
+		{"XML element", kindType, atRoot("doc").uint(typeXMLElement).string("p"), 1},
+		{"text type", kindType | hasOrigin, origin(1, 0).uint(2), 1},
+		{"any values", kindAny | hasOrigin, origin(1, 0).uint(3).
+			raw(118).uint(2).string("a").raw(125, 0x81, 0x01).string("b").raw(117).uint(2).raw(120).raw(123, 0, 0, 0, 0, 0, 0, 0, 0).
+			raw(119).string("s").
+			raw(116).uint(2).raw(1, 2), 3},
+		{"subdocument", kindDoc, atRoot("docs").string("guid").raw(118).uint(0), 1},
+		{"map entry", kindString | hasParentSub, atRoot("map").string("key").string("v"), 1},
+		{"parent by ID", kindString, (&encoder{}).uint(0).uint(5).uint(2).string("ab"), 2},
+		{"garbage collected", kindGC, (&encoder{}).uint(5), 5},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			update := encodeUpdate([]group{{client: 1, items: []item{{tc.info, *tc.body}}}})
+			state := stateOf(t, update)
+			if state.Vector[1] != tc.length {
+				t.Errorf("length %d, want %d", state.Vector[1], tc.length)
+			}
+		})
+	}
+}
+
+func TestSkipsAreGaps(t *testing.T) {
+	update := encodeUpdate([]group{{client: 1, items: []item{text("ab"), {kindSkip, *(&encoder{}).uint(3)}, after(1, 1, "c")}}})
+	state := stateOf(t, update)
+	if state.Vector[1] != 2 || state.Pending[1] != 1 {
+		t.Errorf("state %+v", state)
+	}
+}
+
+func TestMessages(t *testing.T) {
+	update := encodeUpdate([]group{{client: 9, items: []item{text("x")}}})
+	d := New()
+	for _, sync := range []byte{syncStep2, syncUpdate} {
+		if ok, err := d.ApplyMessage(message(sync, update)); !ok || err != nil {
+			t.Errorf("sync type %d: %v %v", sync, ok, err)
+		}
+	}
+	if ok, _ := d.ApplyMessage([]byte{1, 0}); ok {
+		t.Error("awareness message applied")
+	}
+	if d.State().Vector[9] != 1 {
+		t.Errorf("state %+v", d.State())
+	}
+
+	state, malformed := FromMessages([][]byte{message(syncUpdate, update), {1, 0}, message(syncUpdate, update[:3])})
+	if malformed != 1 || state.Hash != d.State().Hash {
+		t.Errorf("from messages: %+v, %d malformed", state, malformed)
+	}
+
+	var vector encoder
+	vector.uint(2).uint(9).uint(1).uint(300).uint(12)
+	got, ok, err := StateVectorOf(message(syncStep1, vector))
+	if !ok || err != nil || !reflect.DeepEqual(got, map[uint64]uint64{9: 1, 300: 12}) {
+		t.Errorf("state vector %v %v %v", got, ok, err)
+	}
+	if _, ok, _ := StateVectorOf(message(syncUpdate, update)); ok {
+		t.Error("an update read as a state vector")
+	}
+}
+
+func TestMalformed(t *testing.T) {
+	update := encodeUpdate([]group{{client: 7, items: []item{text("hello")}}})
+	for name, data := range map[string][]byte{
+		"truncated":       update[:len(update)-3],
+		"unknown kind":    encodeUpdate([]group{{client: 1, items: []item{{20, *atRoot("text")}}}}),
+		"string too long": {1, 1, 1, 0, kindString, 1, 4, 50, 'a'},
+		"empty":           {},
+	} {
+		if err := New().Apply(data); !errors.Is(err, ErrMalformed) {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	if _, err := New().ApplyMessage(message(syncUpdate, update)[:5]); !errors.Is(err, ErrMalformed) {
+		t.Errorf("truncated message: %v", err)
+	}
+}
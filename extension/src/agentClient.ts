@@ -1,5 +1,21 @@
-import axios, { AxiosInstance } from 'axios';
-import { Peer, StatusResponse, API_ENDPOINTS } from '@zeropr/shared';
+import axios, { AxiosError, AxiosInstance } from 'axios';
+import { Peer, StatusResponse, ErrorResponse, API_ENDPOINTS } from '@zeropr/shared';
+
+/**
+ * An error response from the agent, carrying its stable error code and,
+ * for catalogued messages, the message ID
+ */
+export class AgentError extends Error {
+  constructor(
+    public readonly code: string,
+    message: string,
+    public readonly status: number,
+    public readonly messageId?: string,
+  ) {
+    super(message);
+    this.name = 'AgentError';
+  }
+}
 
 /**
  * Client for communicating with the local ZeroPR agent
@@ -7,10 +23,21 @@ import { Peer, StatusResponse, API_ENDPOINTS } from '@zeropr/shared';
 export class AgentClient {
   private client: AxiosInstance;
 
-  constructor(baseURL: string = 'http://localhost:8080') {
+  constructor(baseURL: string = 'http://localhost:8080', language?: string) {
     this.client = axios.create({
       baseURL,
       timeout: 5000,
+      // The agent localizes error messages it has a catalog for
+      headers: language ? { 'Accept-Language': language } : undefined,
+    });
+
+    // Surface the agent's {code, message} error bodies as AgentErrors
+    this.client.interceptors.response.use(undefined, (error: AxiosError<ErrorResponse>) => {
+      const body = error.response?.data;
+      if (body && typeof body === 'object' && body.code) {
+        return Promise.reject(new AgentError(body.code, body.message, error.response!.status, body.messageId));
+      }
+      return Promise.reject(error);
     });
   }
 
@@ -99,7 +126,7 @@ export class AgentClient {
   /**
    * Create co-editing session
    */
-  async createSession(filePath: string): Promise<{ sessionId: string; wsUrl: string; filePath: string }> {
+  async createSession(filePath: string): Promise<{ sessionId: string; wsUrl: string; syncToken: string; filePath: string }> {
     const response = await this.client.post('/api/session/create', {
       filePath,
       initiator: 'local-user'
@@ -118,13 +145,20 @@ export class AgentClient {
   }
 
   /**
-   * Leave session
+   * Leave session. A session that already ended has been left.
    */
   async leaveSession(sessionId: string): Promise<void> {
-    await this.client.post('/api/session/leave', {
-      sessionId,
-      participantId: 'local-user'
-    });
+    try {
+      await this.client.post('/api/session/leave', {
+        sessionId,
+        participantId: 'local-user'
+      });
+    } catch (error) {
+      if (error instanceof AgentError && error.code === 'session_not_found') {
+        return;
+      }
+      throw error;
+    }
   }
 }
 
@@ -17,7 +17,7 @@ export async function activate(context: vscode.ExtensionContext) {
   // Initialize agent client
   const config = vscode.workspace.getConfiguration('zeropr');
   const agentPort = config.get<number>('agentPort', 8080);
-  agentClient = new AgentClient(`http://localhost:${agentPort}`);
+  agentClient = new AgentClient(`http://localhost:${agentPort}`, vscode.env.language);
 
   // Check if agent is running
   const agentRunning = await agentClient.isAgentRunning();
@@ -35,11 +35,12 @@ export class SessionManager {
         ytext.insert(0, content);
       }
 
-      // Connect to WebSocket
+      // Connect to WebSocket; the agent requires the session's sync token
       const provider = new WebsocketProvider(
-        response.wsUrl.replace('ws://', ''),
+        response.wsUrl.split('?')[0].replace('ws://', ''),
         response.sessionId,
-        ydoc
+        ydoc,
+        { params: { sync: response.syncToken } }
       );
 
       // Bind Yjs to editor
@@ -0,0 +1,28 @@
+// Code generated by go run ./cmd/wiregen in agent/; DO NOT EDIT.
+
+/**
+ * Control frame types on session sockets, with the payload version
+ * the agent sends, who sends them, and whether the agent relays a
+ * client's frame of the type (relay) or handles it (consume)
+ */
+export const FRAME_TYPES = {
+  CHAT: 'chat',
+  CHAT_REJECTED: 'chatRejected',
+  PARTICIPANT_JOINED: 'participant_joined',
+  PARTICIPANT_LEFT: 'participant_left',
+  PARTICIPANT_ROLE: 'participant_role',
+  ROSTER: 'roster',
+  ROSTER_SYNC: 'rosterSync',
+} as const;
+
+export type FrameType = (typeof FRAME_TYPES)[keyof typeof FRAME_TYPES];
+
+export const FRAME_SPECS: Record<FrameType, { version: number; direction: 'client' | 'agent' | 'both'; class: 'relay' | 'consume' }> = {
+  chat: { version: 1, direction: 'both', class: 'consume' },
+  chatRejected: { version: 1, direction: 'agent', class: 'consume' },
+  participant_joined: { version: 1, direction: 'agent', class: 'consume' },
+  participant_left: { version: 1, direction: 'agent', class: 'consume' },
+  participant_role: { version: 1, direction: 'agent', class: 'consume' },
+  roster: { version: 1, direction: 'agent', class: 'consume' },
+  rosterSync: { version: 1, direction: 'client', class: 'consume' },
+};
@@ -4,4 +4,5 @@
 
 export * from './types';
 export * from './protocol';
+export * from './frames';
 
@@ -56,7 +56,6 @@ export const API_ENDPOINTS = {
  */
 export const DEFAULT_PORTS = {
   AGENT_HTTP: 8080,
-  AGENT_WS: 9000,
   MDNS_PORT: 5353,
 } as const;
 
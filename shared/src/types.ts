@@ -8,14 +8,20 @@
 export interface Peer {
   /** Unique peer identifier */
   id: string;
-  /** Display name */
+  /** Compact, URL-safe identifier, stable across restarts; any unique prefix of it names the peer */
+  shortId: string;
+  /** Display name: the one the peer advertises, else its instance name */
   name: string;
+  /** mDNS instance name, when name is a display name */
+  instance?: string;
   /** IP address */
   address: string;
   /** Port for WebSocket connections */
   port: number;
   /** Current Git repository hash */
   repoHash: string;
+  /** Every repo the peer serves, when it serves several */
+  repoHashes?: string[];
   /** Current branch name */
   branch: string;
   /** Currently active file path (relative to repo root) */
@@ -24,10 +30,41 @@ export interface Peer {
   cursor: CursorPosition | null;
   /** Current status */
   status: PeerStatus;
+  /** Free text the user set beside their status; show it as a tooltip */
+  message?: string;
   /** Last seen timestamp */
   lastSeen: number;
   /** Whether this peer is trusted */
   trusted: boolean;
+  /** Agent version the peer advertises */
+  version?: string;
+  /** Protocol version the peer advertises */
+  protocolVersion?: string;
+  /** Set when the peer can't work with our agent; warn instead of connecting */
+  incompatible?: boolean;
+  /** Why: 'protocol', 'too_old', or 'too_new' */
+  incompatibleReason?: 'protocol' | 'too_old' | 'too_new';
+  /** Set when the peer has turned its serve plane off; don't offer it invites */
+  notServing?: boolean;
+  /** Set when the peer is in read-only mode; grey out requesting files from it */
+  readOnly?: boolean;
+  /** Set when our last 3 or more calls to the peer failed to reach it; grey it out */
+  unreachable?: boolean;
+  /** Calls in a row that failed to reach the peer */
+  failedCalls?: number;
+  /** Calls to the peer are held off until then (RFC 3339) */
+  retryAt?: string;
+  /** TXT schema the peer announces: 1 for agents that predate schema 2; unset for peers added by hand */
+  announceSchema?: number;
+}
+
+/**
+ * A presence a peer advertised, from GET /api/peers/{id}/history (newest first)
+ */
+export interface PresenceEntry {
+  activeFile?: string;
+  status: PeerStatus;
+  at: string;
 }
 
 /**
@@ -41,7 +78,7 @@ export interface CursorPosition {
 /**
  * Peer status
  */
-export type PeerStatus = 'editing' | 'idle' | 'away';
+export type PeerStatus = 'editing' | 'idle' | 'away' | 'dnd';
 
 /**
  * Presence broadcast message (sent via mDNS/UDP)
@@ -71,6 +108,101 @@ export interface Session {
   createdAt: number;
 }
 
+export type ParticipantRole = 'editor' | 'viewer';
+
+/**
+ * A participant with how editors show them, from the Members of
+ * GET /api/sessions, participant_joined/participant_left/participant_role
+ * frames, and POST /api/session/{id}/role
+ */
+export interface SessionMember {
+  participantId: string;
+  name?: string;
+  color: string; // #rrggbb, assigned by the session when not given
+  role: ParticipantRole;
+}
+
+/**
+ * One participant from GET /api/session/{id}/participants
+ */
+export interface SessionParticipant {
+  participantId: string;
+  role: 'initiator' | 'participant';
+  connection: 'ws' | 'http'; // ws while they hold a live sync socket
+  connectedAt?: string;
+  joined: boolean; // false for sockets opened without joining
+}
+
+/**
+ * Roster frame sent over the sync socket once a client sends {type: 'rosterSync'}
+ */
+export interface RosterEntry {
+  participantId: string;
+  name?: string;
+  color?: string;
+  role: 'host' | 'editor' | 'viewer';
+  quality?: 'good' | 'fair' | 'poor';
+  dormant?: boolean;
+  ghost?: boolean;
+}
+
+/**
+ * Control frames carry their payload version in v (see FRAME_SPECS);
+ * frames without one predate it and read as version 1
+ */
+export interface FrameHeader {
+  v?: number;
+}
+
+export interface Roster extends FrameHeader {
+  type: 'roster';
+  sessionId: string;
+  revision: number;
+  participants: RosterEntry[];
+}
+
+/**
+ * Sent to roster clients when someone joins or leaves through the API, or
+ * the initiator changes their role
+ */
+export interface ParticipantChange extends FrameHeader {
+  type: 'participant_joined' | 'participant_left' | 'participant_role';
+  sessionId: string;
+  participantId: string;
+  name?: string;
+  color?: string;
+  role?: ParticipantRole;
+  /** Everyone now in the session */
+  participants: string[];
+  /** The same participants with how they're shown */
+  members?: SessionMember[];
+}
+
+/**
+ * Frames on the chat socket, /ws/chat/{sessionId}. Clients send {text};
+ * the agent stamps the author and time and relays it to everyone,
+ * the sender included.
+ */
+export interface ChatMessage extends FrameHeader {
+  type: 'chat';
+  author: string;
+  text: string;
+  timestamp: string;
+}
+
+export interface ChatRejected extends FrameHeader {
+  type: 'chatRejected';
+  reason: 'empty' | 'too_long' | 'invalid';
+}
+
+/**
+ * A live session's recent chat, oldest first, from GET /api/session/{id}/chat
+ */
+export interface SessionChat {
+  sessionId: string;
+  messages: ChatMessage[]; // at most 200
+}
+
 /**
  * Request to join a co-editing session
  */
@@ -91,6 +223,124 @@ export interface SessionResponse {
   reason?: string;
 }
 
+/**
+ * A session on another agent joined through this one, from POST
+ * /api/session/bridge. Dial wsPath on the local agent.
+ */
+export interface SessionBridge {
+  status: 'joined';
+  peerId: string;
+  role: 'initiator' | 'participant';
+  wsPath: string;
+}
+
+/**
+ * A session's document, from GET /api/session/{id}/export. Apply the
+ * updates to an empty Y.Doc to get the final content.
+ */
+export interface SessionExport {
+  sessionId: string;
+  repo: string;
+  filePath: string;
+  initiator: string;
+  participants: string[]; // in the session now; empty once it ended
+  contributors: string[]; // everyone who took part
+  createdAt: string;
+  active: boolean;
+  updates: string[]; // base64 y-websocket sync messages, in relay order
+  document: DocumentState; // what the updates add up to
+}
+
+/**
+ * What a Yjs document holds, read from its updates without merging them.
+ * Two copies with the same hash hold the same document.
+ */
+export interface DocumentState {
+  stateVector: Record<string, number>; // Yjs client ID -> operations integrated
+  pending?: Record<string, number>; // client ID -> operations held past a gap
+  deleted: number;
+  hash: string; // "sha256:<hex>"
+}
+
+/**
+ * Another agent's request for this agent's recording of a session, from a
+ * debug.capture_requested event. Answer it with POST
+ * /api/debug/capture-requests/{id} before it expires.
+ */
+export interface CaptureRequest {
+  id: string;
+  sessionId: string;
+  peerId?: string; // the asking agent, when it's listed
+  fingerprint: string;
+  since: string;
+  until: string;
+  expiresAt: string; // declined after this
+}
+
+export type CaptureReason = 'declined' | 'timeout' | 'unavailable' | 'no_counterpart';
+
+/** One agent's part of a divergence capture */
+export interface CaptureSide {
+  agent: string; // "local", or the other agent's peer ID
+  fingerprint?: string;
+  role: 'host' | 'bridge';
+  shared: boolean;
+  reason?: CaptureReason; // why not, when not shared
+  error?: string; // what went wrong asking, when unavailable
+  version?: string;
+  protocolVersion?: string;
+  schemaVersion?: number;
+  frames: number;
+  framesFile?: string; // in the archive, as JSON lines
+  document?: DocumentState;
+  stateVectors?: Record<string, Record<string, number>>; // participant -> last announced state vector
+  missing?: Record<string, number>; // client ID -> operations another side has and this one lacks
+}
+
+/** A divergence capture, from POST /api/debug/capture-divergence */
+export interface DivergenceCapture {
+  path: string; // the archive
+  manifest: {
+    sessionId: string;
+    capturedAt: string;
+    since: string;
+    until: string;
+    singleSided: boolean;
+    reason?: CaptureReason; // why, when single-sided
+    diverged: boolean;
+    protocolCompatible: boolean;
+    sides: CaptureSide[]; // this agent's first
+  };
+}
+
+/**
+ * A session's participant cap, from POST /api/session/{id}/capacity. A
+ * full session refuses joins with session_full and sync sockets with
+ * close code 4005.
+ */
+export interface SessionCapacity {
+  sessionId: string;
+  maxParticipants: number; // 0 is no cap
+  occupancy: number; // seats taken: joined participants and socket-only guests
+}
+
+/**
+ * What a session on a file would cost, from POST /api/session/estimate
+ */
+export interface SessionEstimate {
+  size: number;
+  participants: number;
+  initialSyncBytes: number;
+  updateLogBytesPerHour: number;
+  syncSeconds: number; // 0 when the byte budget is off
+  exceedsBudget: boolean;
+  networkProfile: 'normal' | 'metered' | 'low-power';
+  degraded: boolean;
+  maxFileSize: number; // 0 is unlimited
+  blocked: boolean; // session create refuses the file without force
+  reasons: Array<'over_budget' | 'profile' | 'too_large'>;
+}
+
 /**
  * File diff message
  */
@@ -126,15 +376,180 @@ export interface PeersResponse {
   peers: Peer[];
 }
 
+export interface DiscoveryDegraded {
+  reason: 'bind_conflict' | 'foreign_announcement' | 'daemon_unavailable' | 'multicast_silent';
+  detail: string;
+  remedy: string;
+  since: string;
+}
+
+/**
+ * The plane switches, from GET and PUT /api/planes
+ */
+export interface Planes {
+  observe: boolean;
+  advertise: boolean;
+  serve: boolean;
+  /** While serving is off and live sessions are draining: when they're closed */
+  drainingUntil?: string;
+}
+
+export type EventFeedCategory = 'broadcast' | 'peers' | 'sessions';
+
+/**
+ * A change on the /ws/events socket, tagged with its bus event type
+ */
+export type EventFeedChange =
+  | { type: 'peer.added' | 'peer.updated' | 'peer.removed'; category: 'peers'; id: number; time: string; data: Peer }
+  | { type: 'session.created' | 'session.updated' | 'session.ended'; category: 'sessions'; id: number; time: string; data: Session }
+  | { type: 'broadcast.changed'; category: 'broadcast'; id: number; time: string; data: Record<string, unknown> };
+
+/**
+ * Everything the /ws/events socket sends
+ */
+export type EventFeedMessage =
+  | EventFeedChange
+  | { type: 'subscribed'; time: string; data: { categories: EventFeedCategory[]; unknown?: string[] } }
+  | { type: 'gap'; time: string; data: { lastEventId: number } }
+  | { type: 'error'; time: string; data: { message: string } };
+
+/**
+ * Sent on the /ws/events socket to choose the categories it sends
+ */
+export interface EventFeedSubscribe {
+  type: 'subscribe';
+  categories: EventFeedCategory[];
+}
+
+/**
+ * This device's presence as posted to and read back from /api/presence
+ */
+export interface LocalPresence {
+  activeFile: string | null;
+  cursor: CursorPosition | null;
+  /** Set with selectionEnd while text is selected */
+  selectionStart?: CursorPosition;
+  selectionEnd?: CursorPosition;
+  status: PeerStatus;
+  /** With status dnd, when it ends by itself */
+  until?: string;
+  /** Free text beside the status, up to 100 characters without control characters */
+  message?: string;
+  /** The status peers see: idle after a spell of inactivity outside dnd, else status; only in GET responses */
+  advertisedStatus?: PeerStatus;
+  /** When the editor last posted presence; only in GET responses, null until the first post */
+  updatedAt?: string | null;
+}
+
 export interface StatusResponse {
+  /** Schema of the payloads agents exchange; absent from older agents */
+  schemaVersion?: number;
   running: boolean;
   version: string;
+  commit: string;
+  buildDate: string;
+  goVersion: string;
+  minCompatible: string;
+  protocolVersion: string;
   peersCount: number;
   activeSessions: number;
+  /** Why discovery isn't working; null while it is */
+  discoveryDegraded: DiscoveryDegraded | null;
+  /** Directory files are served from by default, redacted to its final element for other agents; null when the agent serves none */
+  root: string | null;
+  /** Which peers may be listed; only reported to callers on the same machine */
+  peerFilter?: PeerFilter;
 }
 
-export interface ErrorResponse {
-  error: string;
+export interface PeerFilter {
+  mode: 'off' | 'block' | 'allow';
+  /** Peer IDs, names, addresses, or key fingerprints; when not empty, the only peers listed */
+  allow: string[];
+  /** Entries that are never listed, even if allowed */
+  block: string[];
+}
+
+/**
+ * File from GET /api/file/get or POST /api/file/request
+ */
+export interface FileResponse {
+  status: 'success';
+  /** Set by POST /api/file/request */
+  peerId?: string;
+  filePath: string;
+  /** UTF-8 text, or the file's bytes in base64 when encoding says so */
+  content: string;
+  encoding?: 'base64';
+  /** Sniffed from the file's bytes, e.g. image/png */
+  contentType?: string;
+  size: number;
+  modTime?: string;
+  sha256?: string;
+}
+
+/**
+ * Background peer file fetch, from POST /api/file/request with async: true
+ */
+export interface Transfer {
+  id: string;
+  peerId: string;
+  repo?: string;
+  filePath: string;
+  state: 'running' | 'done' | 'failed' | 'cancelled';
+  /** File bytes received so far; bytes on the wire from agents that predate /api/file/raw */
+  bytes: number;
+  /** Bytes expected, counted the same way, or -1 when unknown */
+  total: number;
+  bytesPerSecond: number;
+  etaSeconds?: number;
+  startedAt: string;
+  endedAt?: string;
   code?: string;
+  error?: string;
+  /** Times the transfer was resumed with POST /api/transfers/{id}/resume */
+  resumes?: number;
+  /** A failed transfer that can pick up where it stopped */
+  resumable?: boolean;
+}
+
+/**
+ * A file a peer fetched from this agent, from GET /api/fetches
+ */
+export interface Fetch {
+  at: string;
+  /** The name the peer was trusted under */
+  peer: string;
+  fingerprint: string;
+  repo?: string;
+  path: string;
+  /** Nobody was at the keyboard when the request arrived */
+  unattended: boolean;
+  /** The user was in do-not-disturb */
+  doNotDisturb?: boolean;
+}
+
+/**
+ * What peers fetched while nobody was at the keyboard, from GET /api/fetches/away
+ */
+export interface AwaySummary {
+  /** When the user was last back; the zero time before the first return */
+  since: string;
+  fetches: number;
+  /** Most recent first */
+  peers: {
+    peer: string;
+    fingerprint: string;
+    /** Distinct paths, first fetched first */
+    files: string[];
+    fetches: number;
+    last: string;
+  }[];
+}
+
+export interface ErrorResponse {
+  code: string;
+  /** Catalog ID the message was rendered from, for clients that render their own text */
+  messageId?: string;
+  message: string;
 }
 